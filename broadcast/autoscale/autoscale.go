@@ -0,0 +1,152 @@
+// Package autoscale sizes the broadcaster's worker pool from its measured load. Publishing is
+// almost all network wait, so the right number of workers depends on how slow the destination
+// relays are, not on CPUs: the controller grows the pool while events wait in the queue longer
+// than the target and the workers are busy, and shrinks it again once they mostly idle.
+package autoscale
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Thresholds of the control loop
+const (
+	growUtilization   = 0.8 // grow only while workers are this busy (otherwise waiting is not their fault)
+	shrinkUtilization = 0.5 // shrink only while workers are this idle
+	growStep          = 4   // grow by a quarter of the pool (at least 1)
+	shrinkStep        = 8   // shrink by an eighth of the pool (at least 1)
+)
+
+// Pool is the worker pool being sized (implemented by *broadcaster.Broadcaster)
+type Pool interface {
+	Workers() int
+	SetWorkers(n int)
+	Load() broadcaster.Load
+}
+
+// Config controls the controller
+type Config struct {
+	Min        int           // fewest workers (default 1)
+	Max        int           // most workers (default 4x the starting pool)
+	TargetWait time.Duration // queue wait to stay under (default 1s)
+	Interval   time.Duration // how often the load is measured and the pool adjusted (default 10s)
+}
+
+// Controller adjusts a Pool every Interval
+type Controller struct {
+	cfg  Config
+	pool Pool
+
+	mu     sync.Mutex
+	last   broadcaster.Load
+	action string // "grow", "shrink" or "hold"
+	grown  int64
+	shrunk int64
+}
+
+// New returns a Controller for pool
+func New(cfg Config, pool Pool) *Controller {
+	if cfg.Min <= 0 {
+		cfg.Min = 1
+	}
+	if cfg.Max <= 0 {
+		cfg.Max = pool.Workers() * 4
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	if cfg.TargetWait <= 0 {
+		cfg.TargetWait = time.Second
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	logging.DebugMethod("autoscale", "New", "Sizing worker pool between %d and %d workers for a queue wait under %v",
+		cfg.Min, cfg.Max, cfg.TargetWait)
+	return &Controller{cfg: cfg, pool: pool, action: "hold"}
+}
+
+// Run adjusts the pool until ctx is canceled
+func (c *Controller) Run(ctx context.Context) {
+	// Start inside the bounds
+	if workers := c.pool.Workers(); workers < c.cfg.Min || workers > c.cfg.Max {
+		c.pool.SetWorkers(min(max(workers, c.cfg.Min), c.cfg.Max))
+	}
+	c.pool.Load() // discard what accumulated before the first interval
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.adjust()
+		}
+	}
+}
+
+// adjust applies one step of the control loop
+func (c *Controller) adjust() {
+	load := c.pool.Load()
+	workers := load.Workers
+	target := workers
+	action := "hold"
+
+	switch {
+	case load.Paused:
+		// Events wait for the resume, not for workers
+	case (load.QueueWait > c.cfg.TargetWait || load.QueueDepth > int64(workers)) && load.Utilization >= growUtilization:
+		target = min(workers+max(workers/growStep, 1), c.cfg.Max)
+	case load.QueueWait < c.cfg.TargetWait/2 && load.Utilization < shrinkUtilization:
+		target = max(workers-max(workers/shrinkStep, 1), c.cfg.Min)
+	}
+
+	c.mu.Lock()
+	if target > workers {
+		action = "grow"
+		c.grown++
+	} else if target < workers {
+		action = "shrink"
+		c.shrunk++
+	}
+	c.last, c.action = load, action
+	c.mu.Unlock()
+
+	if target != workers {
+		logging.DebugMethod("autoscale", "adjust", "%s: %d -> %d workers (queue wait %v, max %v, depth %d, utilization %.0f%%)",
+			action, workers, target, load.QueueWait, load.MaxWait, load.QueueDepth, load.Utilization*100)
+		c.pool.SetWorkers(target)
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (c *Controller) GetStatsName() string {
+	return "autoscale"
+}
+
+// GetStats returns the bounds, the last measurement and the adjustments as a JsonEntity
+func (c *Controller) GetStats() json.JsonEntity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("workers", json.NewJsonValue(c.pool.Workers()))
+	obj.Set("min_workers", json.NewJsonValue(c.cfg.Min))
+	obj.Set("max_workers", json.NewJsonValue(c.cfg.Max))
+	obj.Set("target_wait_ms", json.NewJsonValue(c.cfg.TargetWait.Milliseconds()))
+	obj.Set("interval_seconds", json.NewJsonValue(c.cfg.Interval.Seconds()))
+	obj.Set("last_action", json.NewJsonValue(c.action))
+	obj.Set("last_queue_wait_ms", json.NewJsonValue(c.last.QueueWait.Milliseconds()))
+	obj.Set("last_max_wait_ms", json.NewJsonValue(c.last.MaxWait.Milliseconds()))
+	obj.Set("last_utilization", json.NewJsonValue(c.last.Utilization))
+	obj.Set("last_events", json.NewJsonValue(c.last.Events))
+	obj.Set("grown", json.NewJsonValue(c.grown))
+	obj.Set("shrunk", json.NewJsonValue(c.shrunk))
+	return obj
+}
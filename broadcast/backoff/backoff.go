@@ -0,0 +1,251 @@
+// Package backoff tracks relay hosts that throttle us at the HTTP level (429 Too Many Requests
+// or 503 Service Unavailable on the WebSocket upgrade, typically from Cloudflare or a reverse
+// proxy). A throttled host is left alone until its Retry-After has passed, or for an
+// exponentially growing period when the response did not say, instead of being dialed again
+// and counted as a broken relay.
+package backoff
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+const (
+	// defaultBackoff is the first wait for a throttled host that sent no Retry-After
+	defaultBackoff = 30 * time.Second
+	// maxBackoff caps both the exponential wait and whatever Retry-After a host asks for
+	maxBackoff = 10 * time.Minute
+)
+
+// ThrottledError is a WebSocket upgrade refused with 429 or 503. RetryAfter is zero when the
+// response carried no usable Retry-After header.
+type ThrottledError struct {
+	Host       string
+	StatusCode int
+	RetryAfter time.Duration
+	Until      time.Time // set once the tracker decided how long to back off
+}
+
+func (e *ThrottledError) Error() string {
+	if !e.Until.IsZero() {
+		return fmt.Sprintf("throttled by %s (HTTP %d), backing off until %s",
+			e.Host, e.StatusCode, e.Until.Format(time.RFC3339))
+	}
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("throttled by %s (HTTP %d), retry after %v", e.Host, e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("throttled by %s (HTTP %d)", e.Host, e.StatusCode)
+}
+
+// Throttled marks the error for netdiag without an import cycle
+func (e *ThrottledError) Throttled() bool {
+	return true
+}
+
+// IsThrottling reports whether an HTTP status means "slow down" rather than "broken"
+func IsThrottling(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// FromResponse returns a ThrottledError for a throttling upgrade response to relayURL, or nil
+func FromResponse(relayURL string, resp *http.Response) *ThrottledError {
+	if resp == nil || !IsThrottling(resp.StatusCode) {
+		return nil
+	}
+	retryAfter, _ := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return &ThrottledError{Host: Host(relayURL), StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+}
+
+// statusPattern matches the status in upgrade errors from libraries that drop the response,
+// e.g. "expected handshake response status code 101 but got 429"
+var statusPattern = regexp.MustCompile(`but got (\d{3})`)
+
+// FromError returns the ThrottledError in err, or one rebuilt from the status code in its
+// message (without Retry-After) when the dialer discarded the response; nil if err is not
+// throttling
+func FromError(relayURL string, err error) *ThrottledError {
+	if err == nil {
+		return nil
+	}
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		return throttled
+	}
+	match := statusPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return nil
+	}
+	code, _ := strconv.Atoi(match[1])
+	if !IsThrottling(code) {
+		return nil
+	}
+	return &ThrottledError{Host: Host(relayURL), StatusCode: code}
+}
+
+// ParseRetryAfter reads a Retry-After header in either delay-seconds or HTTP-date form
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := at.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Host returns the host[:port] of a relay URL, the unit hosts are backed off by; relays on
+// different paths of one host share a proxy and its limits
+func Host(relayURL string) string {
+	u, err := url.Parse(relayURL)
+	if err != nil || u.Host == "" {
+		return relayURL
+	}
+	return strings.ToLower(u.Host)
+}
+
+type hostState struct {
+	until      time.Time
+	streak     int // consecutive throttles without a successful connection in between
+	statusCode int
+	throttled  int64 // throttling responses received
+	skipped    int64 // connections not attempted because the host was backed off
+}
+
+// Tracker remembers throttled hosts. A nil *Tracker never backs off.
+type Tracker struct {
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+// New returns an empty Tracker
+func New() *Tracker {
+	return &Tracker{hosts: make(map[string]*hostState)}
+}
+
+// Throttle backs off the host of err: for its Retry-After, or 30s doubling per consecutive
+// throttle without one, both capped at 10 minutes. It sets err.Until and returns it.
+func (t *Tracker) Throttle(err *ThrottledError) *ThrottledError {
+	if t == nil || err == nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, ok := t.hosts[err.Host]
+	if !ok {
+		st = &hostState{}
+		t.hosts[err.Host] = st
+	}
+	st.streak++
+	st.throttled++
+	st.statusCode = err.StatusCode
+
+	wait := err.RetryAfter
+	if wait <= 0 {
+		wait = defaultBackoff << min(st.streak-1, 5)
+	}
+	wait = min(wait, maxBackoff)
+
+	now := time.Now()
+	if until := now.Add(wait); until.After(st.until) {
+		st.until = until
+	}
+	err.Until = st.until
+	logging.Warn("Backoff: %s answered HTTP %d, not connecting until %s (%v)",
+		err.Host, err.StatusCode, st.until.Format(time.RFC3339), st.until.Sub(now).Round(time.Second))
+	return err
+}
+
+// Check returns a ThrottledError if the host of relayURL is still backed off, nil otherwise
+func (t *Tracker) Check(relayURL string) error {
+	if t == nil {
+		return nil
+	}
+	host := Host(relayURL)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, ok := t.hosts[host]
+	if !ok || !time.Now().Before(st.until) {
+		return nil
+	}
+	st.skipped++
+	return &ThrottledError{Host: host, StatusCode: st.statusCode, Until: st.until}
+}
+
+// Succeeded resets the exponential backoff of relayURL's host after a connection went through
+func (t *Tracker) Succeeded(relayURL string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st, ok := t.hosts[Host(relayURL)]; ok {
+		st.streak = 0
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (t *Tracker) GetStatsName() string {
+	return "backoff"
+}
+
+// GetStats returns the hosts that throttled us, as a JsonEntity
+func (t *Tracker) GetStats() json.JsonEntity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hosts := make([]string, 0, len(t.hosts))
+	for host := range t.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	now := time.Now()
+	active := 0
+	var totalThrottled, totalSkipped int64
+	hostsObj := json.NewJsonObject()
+	for _, host := range hosts {
+		st := t.hosts[host]
+		totalThrottled += st.throttled
+		totalSkipped += st.skipped
+
+		hostObj := json.NewJsonObject()
+		hostObj.Set("last_status", json.NewJsonValue(st.statusCode))
+		hostObj.Set("throttled", json.NewJsonValue(st.throttled))
+		hostObj.Set("skipped", json.NewJsonValue(st.skipped))
+		if now.Before(st.until) {
+			active++
+			hostObj.Set("backed_off_until", json.NewJsonValue(st.until.Format(time.RFC3339)))
+		}
+		hostsObj.Set(host, hostObj)
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("throttled_hosts", json.NewJsonValue(active))
+	obj.Set("throttled", json.NewJsonValue(totalThrottled))
+	obj.Set("skipped", json.NewJsonValue(totalSkipped))
+	obj.Set("hosts", hostsObj)
+	return obj
+}
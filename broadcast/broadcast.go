@@ -0,0 +1,1098 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/autoscale"
+	"github.com/girino/nostr-brodcast-relay/broadcast/backoff"
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/budget"
+	"github.com/girino/nostr-brodcast-relay/broadcast/bus"
+	"github.com/girino/nostr-brodcast-relay/broadcast/consistency"
+	"github.com/girino/nostr-brodcast-relay/broadcast/discovery"
+	"github.com/girino/nostr-brodcast-relay/broadcast/dmrelays"
+	"github.com/girino/nostr-brodcast-relay/broadcast/fallback"
+	"github.com/girino/nostr-brodcast-relay/broadcast/federation"
+	"github.com/girino/nostr-brodcast-relay/broadcast/health"
+	"github.com/girino/nostr-brodcast-relay/broadcast/kindmatrix"
+	"github.com/girino/nostr-brodcast-relay/broadcast/kindschema"
+	"github.com/girino/nostr-brodcast-relay/broadcast/ledger"
+	"github.com/girino/nostr-brodcast-relay/broadcast/maintenance"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/broadcast/onion"
+	"github.com/girino/nostr-brodcast-relay/broadcast/operators"
+	"github.com/girino/nostr-brodcast-relay/broadcast/outbox"
+	"github.com/girino/nostr-brodcast-relay/broadcast/politeness"
+	"github.com/girino/nostr-brodcast-relay/broadcast/regions"
+	"github.com/girino/nostr-brodcast-relay/broadcast/requirements"
+	"github.com/girino/nostr-brodcast-relay/broadcast/resultlog"
+	"github.com/girino/nostr-brodcast-relay/broadcast/testsink"
+	"github.com/girino/nostr-brodcast-relay/kv"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/stats"
+	"github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BroadcastStats represents the complete statistics from the broadcast system
+// Using JsonEntity for ordered JSON output
+type BroadcastStats json.JsonEntity
+
+// BroadcastSystem provides a unified interface for relay broadcasting
+type BroadcastSystem struct {
+	manager       manager.RelayManager
+	discovery     *discovery.Discovery
+	broadcaster   *broadcaster.Broadcaster
+	healthChecker *health.Checker
+	regions       *regions.Selector // nil unless regional selection is configured
+	testSink      *testsink.Sink    // nil unless TestMode
+	results       *bus.Bus
+	ledger        *ledger.Ledger         // nil unless LedgerSize > 0
+	requirements  *requirements.Checker  // nil unless NIP-11 requirements are checked
+	consistency   *consistency.Tracker   // nil unless ConsistencyCheck
+	federation    *federation.Federation // nil unless federation peers are configured
+	autoscaler    *autoscale.Controller  // nil unless the worker pool is sized adaptively
+	kindSchema    *kindschema.Schema     // nil unless KindSchema
+	maintenance   *maintenance.Detector  // nil unless MaintenanceWindows
+	kindMatrix    *kindmatrix.Matrix     // nil unless KindMatrixWindow > 0
+	state         *kv.Store              // nil unless StateFile
+	// Relay score persistence (nil unless ScoreSnapshotFile or StateFile is set)
+	snapshots        *manager.Manager
+	snapshotState    kv.Target
+	snapshotInterval time.Duration
+	// Stale relays are re-checked every healthInterval (0 = never; see Components)
+	healthInterval time.Duration
+}
+
+// resultTracker records publish results in the manager and then on the results bus
+type resultTracker struct {
+	manager manager.RelayManager
+	results *bus.Bus
+}
+
+func (t resultTracker) TrackPublishResult(ctx context.Context, url string, success bool, responseTime time.Duration, err error) error {
+	trackErr := t.manager.TrackPublishResult(ctx, url, success, responseTime, err)
+	t.results.Report(bus.PublishResult, url, success, responseTime, err)
+	return trackErr
+}
+
+func (t resultTracker) TrackLateSuccess(ctx context.Context, url string, responseTime time.Duration) error {
+	err := t.manager.RecordLateSuccess(ctx, url, responseTime)
+	t.results.Report(bus.PublishResult, url, true, responseTime, nil)
+	return err
+}
+
+func (t resultTracker) TrackDuplicate(ctx context.Context, url string, responseTime time.Duration) error {
+	err := t.manager.RecordDuplicate(ctx, url, responseTime)
+	t.results.Report(bus.PublishResult, url, true, responseTime, nil)
+	return err
+}
+
+// Config holds configuration for the broadcast system
+type Config struct {
+	// Manager replaces the in-memory relay manager (e.g. a shared-store implementation);
+	// nil uses manager.NewManager(TopNRelays, SuccessRateDecay)
+	Manager          manager.RelayManager
+	TopNRelays       int
+	SuccessRateDecay float64
+	MandatoryRelays  []string
+	// HealthCheckInterval re-checks the relays neither checked nor published to for that long
+	// (0 = only when discovered; never in TestMode)
+	HealthCheckInterval time.Duration
+	WorkerCount         int
+	CacheTTL            time.Duration
+	InitialTimeout      time.Duration
+	// Per-kind dedup windows overriding CacheTTL, and ephemeral kinds kept out of the cache
+	CacheKindTTLs         []broadcaster.KindTTL
+	CacheExcludeEphemeral bool
+	// RealtimeKinds take the fast path: no dedup cache, ahead of every queue, only to the
+	// RealtimeRelays fastest relays of the top N (plus mandatory relays); RealtimeQueue bounds it
+	RealtimeKinds  []int
+	RealtimeRelays int
+	RealtimeQueue  int
+	// Regional selection: static region groups and/or remote probe measurements
+	Regions         map[string][]string
+	RelaysPerRegion int
+	ProbesEnabled   bool
+	ProbeMaxAge     time.Duration
+	// Outbound concurrency shared by publishes and probes (0 = unlimited); probes yield to publishes
+	OutboundConcurrency int
+	ProbeConcurrency    int
+	// Politeness: per-relay events-per-minute ceilings (0 = unlimited) and per-URL overrides
+	RelayMaxPerMinute  int
+	RelayRateOverrides map[string]int
+	RelayThrottleQueue int
+	// Ingest lanes: live (client) events dispatched per pull/mirror event while both wait, and
+	// the size of the ingest lane (0 = defaults, 4 and 10000)
+	LiveLaneWeight  int
+	IngestQueueSize int
+	// TargetAuthKey (hex) answers the NIP-42 challenges of relays rejecting events with
+	// "auth-required:" ("" = never authenticate)
+	TargetAuthKey string
+	// RateLimitedPause holds publishes to a relay back this long after it answered "rate-limited:" (0 = off)
+	RateLimitedPause time.Duration
+	// TestMode records publishes in an in-memory sink instead of contacting relays
+	TestMode bool
+	// StartPaused holds all outbound publishing until Resume (events are still queued)
+	StartPaused bool
+	// Flap damping: relays flipping FlapThreshold times within FlapWindow stay out of the top N
+	// until healthy for FlapHoldDown (FlapThreshold 0 = disabled)
+	FlapThreshold int
+	FlapWindow    time.Duration
+	FlapHoldDown  time.Duration
+	// Scoring: the base score of relays is weighted by ScoringStrategy (balanced, latency-first or
+	// reliability-first; "" = balanced), each ScoreWeight* >= 0 overriding the strategy's weight
+	// (ignored with a custom Manager)
+	ScoringStrategy     string
+	ScoreWeightSuccess  float64
+	ScoreWeightLatency  float64
+	ScoreWeightRecency  float64
+	ScoreWeightAttempts float64
+	// CoveragePenalty ranks relays that already receive every event through other paths (all
+	// publishes answered "duplicate:") this many score points lower (0 = disabled)
+	CoveragePenalty float64
+	// TopTieMargin shuffles the relays scoring within this many points of the last top-N slot by
+	// weighted random on each selection, spreading load at the margin (0 = deterministic order)
+	TopTieMargin float64
+	// CanaryScoreWeight ranks relays accepting every canary instantly this many score points
+	// higher (0 = disabled)
+	CanaryScoreWeight float64
+	// LateOKWindow keeps listening this long for OKs of timed-out publishes (0 = disabled)
+	LateOKWindow time.Duration
+	// ConnectionKeepWarm keeps connections to the broadcast relays open, checked this often
+	// (0 = disabled; always off in TestMode)
+	ConnectionKeepWarm time.Duration
+	// Address family of relay connections: auto, prefer-ipv6, prefer-ipv4 or happy-eyeballs, the
+	// latter giving the first family a DialFallbackDelay head start
+	DialMode          string
+	DialFallbackDelay time.Duration
+	// .onion relays are dialed through the SOCKS5 proxy TorProxy (host:port); without one they
+	// are not added at all if SkipOnionRelays is set (TorProxy is ignored in TestMode)
+	TorProxy        string
+	SkipOnionRelays bool
+	// NIP-11 requirements: skip relays demanding payment, auth or more PoW than an event has
+	// (policy off, record or exclude); allowed and mandatory relays are never skipped
+	RequirementsPolicy  string
+	RequirementsRefresh time.Duration
+	RequirementsAllow   []string
+	// NIP-11 consistency: relays behaving against their NIP-11 claims (EVENT answers, plus a REQ
+	// probe every ConsistencyProbeInterval) score below ConsistencyThreshold and are reported; a
+	// ConsistencyPenalty ranks them up to that many score points lower (needs the NIP-11 checks)
+	ConsistencyCheck         bool
+	ConsistencyProbeInterval time.Duration
+	ConsistencyThreshold     float64
+	ConsistencyPenalty       float64
+	// Ledger of recently broadcast events, replayed to mandatory relays added at runtime
+	// (LedgerSize 0 = disabled)
+	LedgerSize   int
+	LedgerMaxAge time.Duration
+	// Operator diversity: at most MaxRelaysPerOperator top-N relays run by the same NIP-11
+	// pubkey/contact (0 = unlimited; ignored with a custom Manager and in TestMode)
+	MaxRelaysPerOperator int
+	// EventDeadline bounds the total time all publishes of one event may take (0 = none)
+	EventDeadline time.Duration
+	// Publish retries: transient publish failures are tried up to PublishMaxAttempts times (<= 1 =
+	// no retries) with exponential backoff from PublishRetryBaseDelay up to PublishRetryMaxDelay
+	PublishMaxAttempts    int
+	PublishRetryBaseDelay time.Duration
+	PublishRetryMaxDelay  time.Duration
+	// Federation: instances behind one ingest point gossip relay scores and split the relay set
+	// between them so each relay gets an event once (no FederationPeers = disabled)
+	FederationNodeID   string
+	FederationPeers    []string
+	FederationSecret   string
+	FederationInterval time.Duration
+	// Fallback endpoints: alternates per relay URL tried when the relay cannot be reached, and
+	// plain ws:// on the same host for wss:// relays failing at the TLS level (ignored in TestMode)
+	RelayFallbacks  map[string][]string
+	FallbackPlainWS bool
+	// Community floor: a CommunityFloor share of the top N reserved for the best CommunityRelays
+	// with at least CommunityMinSuccessRate (ignored with a custom Manager)
+	CommunityRelays         []string
+	CommunityFloor          float64
+	CommunityMinSuccessRate float64
+	// Discovery sources: TopNSources limits the top N to relays from those sources (empty = all,
+	// ignored with a custom Manager); relays from an EvictSources source going that long without
+	// a successful publish are evicted by EvictRelays if below EvictMinSuccessRate
+	TopNSources         []string
+	EvictSources        map[string]time.Duration
+	EvictMinSuccessRate float64
+	// NIP-17 routing: gift wraps go to their recipients' kind 10050 DM relays, looked up on
+	// DMLookupRelays (none in TestMode) and cached for DMRelayCacheTTL; DMRelayFallback
+	// (top, mandatory, none) applies when no recipient has a list
+	DMRouting       bool
+	DMLookupRelays  []string
+	DMRelayCacheTTL time.Duration
+	DMRelayFallback string
+	// NIP-65 outbox routing: events also go to up to OutboxMaxRelays write relays from their
+	// author's kind 10002 list, looked up on OutboxLookupRelays and the current top relays (none
+	// in TestMode) and cached for OutboxCacheTTL
+	OutboxRouting      bool
+	OutboxLookupRelays []string
+	OutboxMaxRelays    int
+	OutboxCacheTTL     time.Duration
+	// Adaptive worker pool: between WorkerMin and WorkerMax workers (0 = defaults), keeping the
+	// queue wait under WorkerTargetWait
+	WorkerAutoscale  bool
+	WorkerMin        int
+	WorkerMax        int
+	WorkerTargetWait time.Duration
+	// MaxOverflowBytes caps the approximate size of the events waiting in the overflow queue; new
+	// events over it are dropped (0 = no cap)
+	MaxOverflowBytes int64
+	// QueueJournalFile receives the events still queued when the system stops; they are queued
+	// again at the next start ("" = dropped)
+	QueueJournalFile string
+	// Sampled result logging: 1 in ResultLogSample publish results of each outcome class is logged
+	// at Info, ResultLogRates overriding the rate per class (0 = off); failures to mandatory
+	// relays are always logged while any sampling is on
+	ResultLogSample int
+	ResultLogRates  map[string]int
+	// Refused kinds: relay/kind pairs rejected KindSchemaThreshold times in a row are not sent
+	// for KindSchemaExpiry; the matrix is kept in KindSchemaFile ("" = memory only)
+	KindSchema          bool
+	KindSchemaThreshold int
+	KindSchemaExpiry    time.Duration
+	KindSchemaFile      string
+	// Maintenance windows: daily slots in which a relay failed on MaintenanceMinDays of the last
+	// MaintenanceHistoryDays days; events for it are held during them and replayed afterwards. The
+	// history is kept in MaintenanceFile ("" = memory only)
+	MaintenanceWindows     bool
+	MaintenanceHistoryDays int
+	MaintenanceMinDays     int
+	MaintenanceFile        string
+	// KindMatrixWindow is the rolling window of the kind x relay success matrix (0 = disabled)
+	KindMatrixWindow time.Duration
+	// MaxRelaysPerEvent caps the relay URLs one event may add to the pool (0 = no cap)
+	MaxRelaysPerEvent int
+	// Score snapshots: the in-memory manager's relay scores and health history are saved to
+	// ScoreSnapshotFile every ScoreSnapshotInterval and on Stop, and restored at startup unless
+	// older than ScoreSnapshotMaxAge ("" = not persisted; ignored with a custom Manager)
+	ScoreSnapshotFile     string
+	ScoreSnapshotInterval time.Duration
+	ScoreSnapshotMaxAge   time.Duration
+	// StateFile is the shared key-value store; when set, the refused kinds matrix, maintenance
+	// history and relay scores (not in TestMode) are kept in its buckets and KindSchemaFile,
+	// MaintenanceFile and ScoreSnapshotFile are not used ("" = each keeps its own file)
+	StateFile string
+	// Stats is where the components register their metric providers (nil = stats.Default())
+	Stats stats.Registrar
+}
+
+// NewBroadcastSystem creates a new broadcast system with all components
+func NewBroadcastSystem(cfg *Config) *BroadcastSystem {
+	logging.Debug("BroadcastSystem: Initializing broadcast system")
+
+	// Shared state store, falling back to the per-subsystem files if it cannot be opened
+	var state *kv.Store
+	if cfg.StateFile != "" {
+		store, err := kv.Open(cfg.StateFile)
+		if err != nil {
+			logging.Error("BroadcastSystem: Cannot open state store %s, using the per-subsystem files: %v", cfg.StateFile, err)
+		} else {
+			state = store
+		}
+	}
+	scoreState := kv.TargetFor(state, "relay_scores", cfg.ScoreSnapshotFile)
+	if state != nil && cfg.TestMode {
+		scoreState = nil // TEST_MODE relays and results are synthetic
+	}
+
+	// Create manager unless the caller supplied one
+	mgr := cfg.Manager
+	var operatorDirectory *operators.Directory
+	var snapshots *manager.Manager // the manager whose scores are persisted, if any
+	if mgr == nil {
+		local := manager.NewManager(cfg.TopNRelays, cfg.SuccessRateDecay)
+		local.SetFlapDamping(manager.FlapDamping{
+			Threshold: cfg.FlapThreshold,
+			Window:    cfg.FlapWindow,
+			HoldDown:  cfg.FlapHoldDown,
+		})
+		local.SetCoveragePenalty(cfg.CoveragePenalty)
+		local.SetScoringWeights(scoringWeights(cfg))
+		local.SetTieMargin(cfg.TopTieMargin)
+		local.SetCanaryWeight(cfg.CanaryScoreWeight)
+		local.SetConsistencyPenalty(cfg.ConsistencyPenalty)
+		if len(cfg.CommunityRelays) > 0 && cfg.CommunityFloor > 0 {
+			local.SetCommunityFloor(manager.CommunityFloor{
+				Relays:         cfg.CommunityRelays,
+				Fraction:       cfg.CommunityFloor,
+				MinSuccessRate: cfg.CommunityMinSuccessRate,
+			})
+			logging.Info("BroadcastSystem: %.0f%% of the top relays reserved for %d community relays", cfg.CommunityFloor*100, len(cfg.CommunityRelays))
+		}
+		if len(cfg.TopNSources) > 0 {
+			for _, source := range cfg.TopNSources {
+				if !manager.ValidSource(source) {
+					logging.Warn("BroadcastSystem: Unknown discovery source %q in the top N sources (known: %v)", source, manager.Sources)
+				}
+			}
+			local.SetTopSources(cfg.TopNSources)
+			logging.Info("BroadcastSystem: Top relays limited to discovery sources %v", cfg.TopNSources)
+		}
+		if cfg.MaxRelaysPerOperator > 0 && !cfg.TestMode {
+			operatorDirectory = operators.New(operators.Config{})
+			local.SetOperatorLimit(manager.OperatorLimit{
+				MaxPerOperator: cfg.MaxRelaysPerOperator,
+				OperatorOf:     operatorDirectory.Operator,
+			})
+			logging.Info("BroadcastSystem: At most %d top relays per operator", cfg.MaxRelaysPerOperator)
+		}
+		if scoreState != nil {
+			restored, err := local.LoadSnapshot(scoreState, cfg.ScoreSnapshotMaxAge)
+			if err != nil {
+				logging.Warn("BroadcastSystem: Cannot restore relay scores from %s: %v", scoreState, err)
+			} else if restored > 0 {
+				logging.Info("BroadcastSystem: Restored scores of %d relays from %s", restored, scoreState)
+			}
+			snapshots = local
+		}
+		mgr = local
+	}
+
+	// Results bus: health-check and publish results for in-process subscribers
+	results := bus.New()
+
+	// Create health checker
+	healthChecker := health.NewChecker(mgr, cfg.InitialTimeout)
+	healthChecker.SetBus(results)
+
+	// Create discovery with manager as registry and health checker
+	disc := discovery.NewDiscovery(mgr, healthChecker)
+	disc.SetMaxRelaysPerEvent(cfg.MaxRelaysPerEvent)
+	if len(cfg.EvictSources) > 0 {
+		disc.SetEvictionPolicy(discovery.EvictionPolicy{MaxAge: cfg.EvictSources, MinSuccessRate: cfg.EvictMinSuccessRate})
+		logging.Info("BroadcastSystem: Evicting unproductive relays by discovery source: %v", cfg.EvictSources)
+	}
+
+	// Relay provider: manager top-N, optionally extended with the best relays of each region
+	var relayProvider broadcaster.RelayProvider = mgr
+	var regionSelector *regions.Selector
+	if len(cfg.Regions) > 0 || cfg.ProbesEnabled {
+		regionSelector = regions.New(mgr, regions.Config{
+			Regions:         cfg.Regions,
+			RelaysPerRegion: cfg.RelaysPerRegion,
+			ProbeMaxAge:     cfg.ProbeMaxAge,
+		})
+		relayProvider = regionSelector
+		logging.Info("BroadcastSystem: Regional selection enabled (%d static regions, probes=%v)", len(cfg.Regions), cfg.ProbesEnabled)
+	}
+
+	// Federation: the federation-wide top set, of which this instance keeps the relays it owns
+	fed := federation.New(federation.Config{
+		NodeID:   cfg.FederationNodeID,
+		Peers:    cfg.FederationPeers,
+		Secret:   cfg.FederationSecret,
+		Interval: cfg.FederationInterval,
+	}, relayProvider, mgr)
+	if fed != nil {
+		relayProvider = fed
+		logging.Info("BroadcastSystem: Federation enabled as node %s with %d peers", cfg.FederationNodeID, len(cfg.FederationPeers))
+	}
+
+	// Create broadcaster with the relay provider and manager (via the bus) as result tracker
+	bc := broadcaster.NewBroadcaster(relayProvider, resultTracker{manager: mgr, results: results}, cfg.MandatoryRelays, cfg.WorkerCount, cfg.CacheTTL)
+	bc.SetCachePolicy(cfg.CacheKindTTLs, cfg.CacheExcludeEphemeral)
+	if len(cfg.RealtimeKinds) > 0 {
+		bc.SetRealtime(broadcaster.RealtimeConfig{
+			Kinds:  cfg.RealtimeKinds,
+			Relays: cfg.RealtimeRelays,
+			Queue:  cfg.RealtimeQueue,
+			Latency: func(url string) (time.Duration, bool) {
+				info, err := mgr.GetRelayInfo(context.Background(), url)
+				if err != nil || info.TotalAttempts == 0 {
+					return 0, false
+				}
+				return info.AvgResponseTime, true
+			},
+		})
+	}
+	if cfg.StartPaused {
+		bc.Pause("paused at startup")
+	}
+	if cfg.LateOKWindow > 0 {
+		bc.SetLateOKWindow(cfg.LateOKWindow)
+	}
+	if cfg.EventDeadline > 0 {
+		bc.SetEventDeadline(cfg.EventDeadline)
+	}
+	if cfg.MaxOverflowBytes > 0 {
+		bc.SetOverflowLimit(cfg.MaxOverflowBytes)
+	}
+	if cfg.QueueJournalFile != "" {
+		bc.SetJournal(cfg.QueueJournalFile)
+	}
+	if cfg.PublishMaxAttempts > 1 {
+		bc.SetRetryPolicy(broadcaster.RetryPolicy{
+			MaxAttempts: cfg.PublishMaxAttempts,
+			BaseDelay:   cfg.PublishRetryBaseDelay,
+			MaxDelay:    cfg.PublishRetryMaxDelay,
+		})
+	}
+	bc.SetDialMode(cfg.DialMode, cfg.DialFallbackDelay)
+	bc.OnDial(results.ReportHandshake)
+	bc.SetLanes(cfg.LiveLaneWeight, cfg.IngestQueueSize)
+	if cfg.TargetAuthKey != "" {
+		bc.SetAuthKey(cfg.TargetAuthKey)
+		logging.Info("BroadcastSystem: Authenticating to relays that require NIP-42 AUTH")
+	}
+	if cfg.ConnectionKeepWarm > 0 && !cfg.TestMode {
+		bc.KeepWarm(cfg.ConnectionKeepWarm)
+	}
+
+	// Outbox relays are added before any other filter runs, so federation ownership, NIP-11
+	// requirements and learned refusals apply to them as well
+	var outboxRouter *outbox.Router
+	if cfg.OutboxRouting {
+		var lookup func() []string
+		if !cfg.TestMode {
+			lookup = func() []string {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				relays := append([]string{}, cfg.OutboxLookupRelays...)
+				if top, err := mgr.GetBroadcastRelays(ctx); err == nil {
+					relays = append(relays, top...)
+				}
+				return relays
+			}
+		}
+		outboxRouter = outbox.New(outbox.Config{
+			Lookup:    lookup,
+			MaxRelays: cfg.OutboxMaxRelays,
+			CacheTTL:  cfg.OutboxCacheTTL,
+		})
+		bc.AddRelayFilter(outboxRouter)
+		bc.AddReporter(outboxRouter)
+		logging.Info("BroadcastSystem: NIP-65 outbox routing enabled (up to %d write relays per author)", cfg.OutboxMaxRelays)
+	}
+	if fed != nil {
+		bc.AddRelayFilter(fed)
+		fed.SetQueue(bc)
+	}
+
+	// Register stats providers, with the process-wide registry unless the caller supplied one
+	registrar := cfg.Stats
+	if registrar == nil {
+		registrar = stats.Default()
+	}
+	registrar.Register(mgr)
+	registrar.Register(disc)
+	bc.RegisterStats(registrar)
+	registrar.Register(healthChecker)
+	registrar.Register(results)
+	if regionSelector != nil {
+		registrar.Register(regionSelector)
+	}
+	if operatorDirectory != nil {
+		registrar.Register(operatorDirectory)
+	}
+	if state != nil {
+		registrar.Register(state)
+	}
+	if fed != nil {
+		registrar.Register(fed)
+	}
+	if outboxRouter != nil {
+		registrar.Register(outboxRouter)
+	}
+
+	// Hosts answering 429/503 (Cloudflare, proxies) are backed off by publishes and probes alike
+	hostBackoff := backoff.New()
+	bc.SetBackoff(hostBackoff)
+	healthChecker.SetBackoff(hostBackoff)
+	registrar.Register(hostBackoff)
+
+	// Tor hidden services are only reachable through a SOCKS5 proxy
+	if cfg.TorProxy != "" && !cfg.TestMode {
+		torProxy, err := onion.New(cfg.TorProxy)
+		if err != nil {
+			logging.Error("BroadcastSystem: Invalid Tor proxy %s, onion relays unreachable: %v", cfg.TorProxy, err)
+		} else {
+			bc.SetOnionProxy(torProxy)
+			healthChecker.SetOnionProxy(torProxy)
+			registrar.Register(torProxy)
+		}
+	} else if cfg.SkipOnionRelays {
+		disc.SetSkipOnion(true)
+		logging.Info("BroadcastSystem: Skipping .onion relays (no TOR_PROXY)")
+	}
+
+	if cfg.OutboundConcurrency > 0 {
+		outbound := budget.New(cfg.OutboundConcurrency, cfg.ProbeConcurrency)
+		bc.SetBudget(outbound)
+		healthChecker.SetBudget(outbound)
+		registrar.Register(outbound)
+	}
+
+	if throttle := politeness.New(politeness.Config{
+		DefaultPerMinute: cfg.RelayMaxPerMinute,
+		Overrides:        cfg.RelayRateOverrides,
+		MaxQueued:        cfg.RelayThrottleQueue,
+		RateLimitedPause: cfg.RateLimitedPause,
+	}); throttle != nil {
+		bc.SetThrottle(throttle)
+		registrar.Register(throttle)
+	}
+
+	// Nothing to fetch in TEST_MODE: publishes never leave the process
+	var checker *requirements.Checker
+	if !cfg.TestMode {
+		checker = requirements.New(requirements.Config{
+			Policy:  cfg.RequirementsPolicy,
+			Refresh: cfg.RequirementsRefresh,
+			Allow:   append(append([]string{}, cfg.RequirementsAllow...), cfg.MandatoryRelays...),
+			CanAuth: cfg.TargetAuthKey != "",
+		})
+		if checker != nil {
+			bc.AddRelayFilter(checker)
+			healthChecker.SetCapabilities(checker)
+			registrar.Register(checker)
+		}
+	}
+
+	// Claims vs behavior of the NIP-11 documents fetched above
+	var tracker *consistency.Tracker
+	if cfg.ConsistencyCheck && checker != nil {
+		var sink consistency.ScoreSink // ranking untouched without a penalty
+		if cfg.ConsistencyPenalty > 0 {
+			sink = mgr
+		}
+		tracker = consistency.New(consistency.Config{
+			Claims: checker,
+			Sink:   sink,
+			Targets: func() []string {
+				relays, err := mgr.GetTopRelays(context.Background())
+				if err != nil {
+					return nil
+				}
+				urls := make([]string, len(relays))
+				for i, relay := range relays {
+					urls[i] = relay.URL
+				}
+				return urls
+			},
+			ProbeInterval: cfg.ConsistencyProbeInterval,
+			Threshold:     cfg.ConsistencyThreshold,
+		})
+		bc.AddReporter(tracker)
+		registrar.Register(tracker)
+		logging.Info("BroadcastSystem: Checking relays against their NIP-11 claims (REQ probe every %v, penalty %.1f)", cfg.ConsistencyProbeInterval, cfg.ConsistencyPenalty)
+	} else if cfg.ConsistencyCheck && !cfg.TestMode {
+		logging.Warn("BroadcastSystem: CONSISTENCY_CHECK needs the NIP-11 checks (RELAY_REQUIREMENTS), disabled")
+	}
+
+	// NIP-17 routing goes after the NIP-11 checks: DM relays commonly demand auth for reading,
+	// which must not keep gift wraps away from them
+	if cfg.DMRouting {
+		lookupRelays := cfg.DMLookupRelays
+		if cfg.TestMode {
+			lookupRelays = nil // lists are only learned from events passing through
+		}
+		dmRouter := dmrelays.New(dmrelays.Config{
+			LookupRelays: lookupRelays,
+			CacheTTL:     cfg.DMRelayCacheTTL,
+			Fallback:     cfg.DMRelayFallback,
+			Mandatory:    bc.MandatoryRelays,
+		})
+		bc.AddRelayFilter(dmRouter)
+		bc.AddReporter(dmRouter)
+		registrar.Register(dmRouter)
+		logging.Info("BroadcastSystem: NIP-17 gift wraps routed to DM relay lists (%d lookup relays, fallback %s)",
+			len(lookupRelays), cfg.DMRelayFallback)
+	}
+
+	// Kinds a relay refuses are not sent there (mandatory relays still get everything)
+	var schema *kindschema.Schema
+	if cfg.KindSchema {
+		schema = kindschema.New(kindschema.Config{
+			Threshold: cfg.KindSchemaThreshold,
+			Expiry:    cfg.KindSchemaExpiry,
+			State:     kv.TargetFor(state, "kind_schema", cfg.KindSchemaFile),
+			Mandatory: bc.MandatoryRelays,
+		})
+		bc.AddRelayFilter(schema)
+		bc.AddReporter(schema)
+		registrar.Register(schema)
+	}
+
+	// Relays in their detected maintenance window get their events once it is over
+	var detector *maintenance.Detector
+	if cfg.MaintenanceWindows {
+		detector = maintenance.New(maintenance.Config{
+			Days:    cfg.MaintenanceHistoryDays,
+			MinDays: cfg.MaintenanceMinDays,
+			State:   kv.TargetFor(state, "maintenance", cfg.MaintenanceFile),
+			Replay:  bc.Replay,
+		})
+		results.OnEvent(detector.Record)
+		bc.AddRelayFilter(detector)
+		bc.AddReporter(detector)
+		registrar.Register(detector)
+	}
+
+	// Kind x relay success rates of the last KindMatrixWindow, served at /api/matrix
+	var matrix *kindmatrix.Matrix
+	if cfg.KindMatrixWindow > 0 {
+		matrix = kindmatrix.New(cfg.KindMatrixWindow)
+		bc.AddReporter(matrix)
+		registrar.Register(matrix)
+	}
+
+	var autoscaler *autoscale.Controller
+	if cfg.WorkerAutoscale {
+		autoscaler = autoscale.New(autoscale.Config{
+			Min:        cfg.WorkerMin,
+			Max:        cfg.WorkerMax,
+			TargetWait: cfg.WorkerTargetWait,
+		}, bc)
+		registrar.Register(autoscaler)
+	}
+
+	if cfg.ResultLogSample > 0 || len(cfg.ResultLogRates) > 0 {
+		sampler := resultlog.New(resultlog.Config{
+			DefaultRate: cfg.ResultLogSample,
+			Rates:       cfg.ResultLogRates,
+			Mandatory:   bc.MandatoryRelays,
+		})
+		bc.AddReporter(sampler)
+		registrar.Register(sampler)
+		logging.Info("BroadcastSystem: Logging 1 in %d publish results (per class: %v)", cfg.ResultLogSample, cfg.ResultLogRates)
+	}
+
+	var recent *ledger.Ledger
+	if cfg.LedgerSize > 0 {
+		recent = ledger.New(ledger.Config{Size: cfg.LedgerSize, MaxAge: cfg.LedgerMaxAge})
+		bc.AddReporter(recent)
+		registrar.Register(recent)
+	}
+
+	// Alternate endpoints of relays that cannot be reached; results count for the primary URL
+	if !cfg.TestMode {
+		if alternates := fallback.New(fallback.Config{
+			Alternates: cfg.RelayFallbacks,
+			PlainWS:    cfg.FallbackPlainWS,
+		}, bc.Publisher()); alternates != nil {
+			bc.SetPublisher(alternates)
+			registrar.Register(alternates)
+		}
+	}
+
+	var sink *testsink.Sink
+	if cfg.TestMode {
+		sink = testsink.New(0)
+		bc.SetPublisher(sink)
+		healthChecker.SetOffline(true)
+		registrar.Register(sink)
+		logging.Warn("BroadcastSystem: TEST_MODE enabled - events are recorded in memory, not published")
+	}
+
+	return &BroadcastSystem{
+		manager:          mgr,
+		discovery:        disc,
+		broadcaster:      bc,
+		healthChecker:    healthChecker,
+		regions:          regionSelector,
+		testSink:         sink,
+		results:          results,
+		ledger:           recent,
+		requirements:     checker,
+		consistency:      tracker,
+		federation:       fed,
+		autoscaler:       autoscaler,
+		kindSchema:       schema,
+		maintenance:      detector,
+		kindMatrix:       matrix,
+		snapshots:        snapshots,
+		state:            state,
+		snapshotState:    scoreState,
+		snapshotInterval: cfg.ScoreSnapshotInterval,
+		healthInterval:   cfg.HealthCheckInterval,
+	}
+}
+
+// scoringWeights returns the strategy and weights of cfg, the strategy's weights overridden by
+// the non-negative ScoreWeight* values
+func scoringWeights(cfg *Config) (string, manager.ScoringWeights) {
+	strategy := cfg.ScoringStrategy
+	weights, ok := manager.StrategyWeights(strategy)
+	if !ok {
+		strategy = manager.StrategyBalanced
+		weights, _ = manager.StrategyWeights(strategy)
+	}
+	custom := false
+	for _, override := range []struct {
+		value  float64
+		weight *float64
+	}{
+		{cfg.ScoreWeightSuccess, &weights.Success},
+		{cfg.ScoreWeightLatency, &weights.Latency},
+		{cfg.ScoreWeightRecency, &weights.Recency},
+		{cfg.ScoreWeightAttempts, &weights.Attempts},
+	} {
+		if override.value >= 0 {
+			*override.weight, custom = override.value, true
+		}
+	}
+	if custom {
+		strategy += " (custom weights)"
+	}
+	return strategy, weights
+}
+
+// Start initializes and starts the broadcast system; its background loops are run by Components
+func (bs *BroadcastSystem) Start() {
+	logging.Info("BroadcastSystem: Starting broadcast system")
+	bs.broadcaster.Start()
+}
+
+// Stop gracefully stops the broadcast system, after the Components were stopped
+func (bs *BroadcastSystem) Stop() {
+	logging.Info("BroadcastSystem: Stopping broadcast system")
+	bs.broadcaster.Stop()
+	if bs.kindSchema != nil {
+		bs.kindSchema.Save()
+	}
+	if bs.maintenance != nil {
+		bs.maintenance.Save()
+	}
+	if bs.snapshots != nil {
+		bs.saveScoresOnce()
+	}
+	if bs.state != nil {
+		if err := bs.state.Close(); err != nil {
+			logging.Error("BroadcastSystem: Failed to close state store: %v", err)
+		}
+	}
+}
+
+// saveScores snapshots the relay scores every interval until ctx is canceled
+func (bs *BroadcastSystem) saveScores(ctx context.Context) {
+	interval := bs.snapshotInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			bs.saveScoresOnce()
+		}
+	}
+}
+
+func (bs *BroadcastSystem) saveScoresOnce() {
+	if err := bs.snapshots.SaveSnapshot(bs.snapshotState); err != nil {
+		logging.Error("BroadcastSystem: Failed to save relay scores to %s: %v", bs.snapshotState, err)
+		return
+	}
+	logging.DebugMethod("broadcast", "saveScores", "Saved relay scores to %s", bs.snapshotState)
+}
+
+// DiscoverFromSeeds performs relay discovery from seed relays
+func (bs *BroadcastSystem) DiscoverFromSeeds(ctx context.Context, seedRelays []string) {
+	if bs.testSink != nil {
+		// TEST_MODE: the seeds are the destination set; nothing is fetched
+		for _, url := range seedRelays {
+			bs.discovery.AddRelayIfNew(url, manager.SourceSeed)
+		}
+		return
+	}
+	bs.discovery.DiscoverFromSeeds(ctx, seedRelays)
+}
+
+// ImportRelays adds the relays of a curated list (http(s) URL or file) and tests them
+func (bs *BroadcastSystem) ImportRelays(ctx context.Context, source string, maxRelays int) (int, error) {
+	return bs.discovery.ImportFromList(ctx, source, maxRelays)
+}
+
+// DiscoverFromFollows adds the write relays of pubkey's follows (NIP-65) to the pool
+func (bs *BroadcastSystem) DiscoverFromFollows(ctx context.Context, seedRelays []string, pubkey string, maxRelays int) int {
+	if bs.testSink != nil {
+		return 0
+	}
+	return bs.discovery.DiscoverFromFollows(ctx, seedRelays, pubkey, maxRelays)
+}
+
+// MarkInitialized marks the system as initialized
+func (bs *BroadcastSystem) MarkInitialized() {
+	if err := bs.manager.MarkInitialized(context.Background()); err != nil {
+		logging.Error("BroadcastSystem: Failed to mark manager initialized: %v", err)
+	}
+}
+
+// BroadcastEvent broadcasts an event to the top relays
+func (bs *BroadcastSystem) BroadcastEvent(event *nostr.Event) {
+	bs.broadcaster.Broadcast(event)
+}
+
+// BroadcastBatch queues events accepted together with one dedup-cache update, skipping those
+// already cached; it returns how many were queued
+func (bs *BroadcastSystem) BroadcastBatch(batch []broadcaster.BatchEvent) int {
+	return bs.broadcaster.BroadcastBatch(batch)
+}
+
+// IngestEvent queues an event from a bulk source (pull mode, mirror) in the ingest lane, behind
+// client events by weight; false if the lane is full
+func (bs *BroadcastSystem) IngestEvent(event *nostr.Event) bool {
+	return bs.broadcaster.BroadcastIngest(event)
+}
+
+// BroadcastEventWithFanout queues event for the best topN relays instead of the configured top N
+func (bs *BroadcastSystem) BroadcastEventWithFanout(event *nostr.Event, topN int) {
+	bs.broadcaster.BroadcastWithFanout(event, topN)
+}
+
+// PlanBroadcast returns the relay set an event would be broadcast to right now, without broadcasting it
+func (bs *BroadcastSystem) PlanBroadcast(event *nostr.Event) broadcaster.RelayPlan {
+	return bs.broadcaster.Plan(event)
+}
+
+// AddBroadcastReporter registers a reporter for per-event delivery results
+func (bs *BroadcastSystem) AddBroadcastReporter(reporter broadcaster.BroadcastReporter) {
+	bs.broadcaster.AddReporter(reporter)
+}
+
+// SubscribeResults returns a channel of health-check and publish results plus relay up/down
+// changes, and a function to unsubscribe. Events are dropped if the channel's buffer is full.
+func (bs *BroadcastSystem) SubscribeResults(buffer int) (<-chan bus.Event, func()) {
+	return bs.results.Subscribe(buffer)
+}
+
+// OnResult registers a callback for every result and relay up/down change; it must return quickly
+func (bs *BroadcastSystem) OnResult(fn func(bus.Event)) {
+	bs.results.OnEvent(fn)
+}
+
+// AddRelayFilter registers a per-event relay selection policy
+func (bs *BroadcastSystem) AddRelayFilter(filter broadcaster.RelayFilter) {
+	bs.broadcaster.AddRelayFilter(filter)
+}
+
+// GetStats returns comprehensive statistics as a JsonEntity
+func (bs *BroadcastSystem) GetStats() json.JsonEntity {
+	reg := stats.NewRegistry()
+	bs.broadcaster.RegisterStats(reg)
+	reg.Register(bs.manager)
+	reg.Register(bs.healthChecker)
+
+	obj := reg.Snapshot()
+	obj.Set("timestamp", json.NewJsonValue(time.Now().Unix()))
+
+	return obj
+}
+
+// AddMandatoryRelays adds mandatory relays to the system
+func (bs *BroadcastSystem) AddMandatoryRelays(urls []string) {
+	for _, url := range urls {
+		if err := bs.manager.AddMandatoryRelay(context.Background(), url); err != nil {
+			logging.Error("BroadcastSystem: Failed to add mandatory relay %s: %v", url, err)
+		}
+	}
+}
+
+// AddMandatoryRelay makes url a mandatory relay at runtime. With backfill > 0 the events
+// broadcast within that window (as far as the ledger reaches) are replayed to it in the
+// background; replaying is the number of events queued for the replay. added is false if url
+// already was mandatory, in which case nothing is replayed.
+func (bs *BroadcastSystem) AddMandatoryRelay(url string, backfill time.Duration) (added bool, replaying int) {
+	if !bs.broadcaster.AddMandatoryRelay(url) {
+		return false, 0
+	}
+	bs.AddMandatoryRelays([]string{url})
+	if bs.requirements != nil {
+		bs.requirements.Allow(url)
+	}
+	if backfill <= 0 || bs.ledger == nil {
+		return true, 0
+	}
+
+	events := bs.ledger.Since(time.Now().Add(-backfill))
+	if len(events) == 0 {
+		return true, 0
+	}
+	logging.Info("BroadcastSystem: Replaying %d events from the last %v to new mandatory relay %s", len(events), backfill, url)
+	go func() {
+		delivered, failed := bs.broadcaster.Replay(url, events)
+		bs.ledger.CountReplayed(delivered + failed)
+		logging.Info("BroadcastSystem: Replay to %s finished: %d delivered, %d failed", url, delivered, failed)
+	}()
+	return true, len(events)
+}
+
+// LedgerEnabled reports whether recent events are kept for replays
+func (bs *BroadcastSystem) LedgerEnabled() bool {
+	return bs.ledger != nil
+}
+
+// FederationHandler returns the handler peers pull gossip from, or nil without federation
+func (bs *BroadcastSystem) FederationHandler() http.Handler {
+	if bs.federation == nil {
+		return nil
+	}
+	return bs.federation
+}
+
+// GetTopRelays returns the top relays
+func (bs *BroadcastSystem) GetTopRelays() []*manager.RelayInfo {
+	relays, err := bs.manager.GetTopRelays(context.Background())
+	if err != nil {
+		logging.Error("BroadcastSystem: Failed to get top relays: %v", err)
+	}
+	return relays
+}
+
+// RecordCanary scores a relay on its answer to a pipeline canary (see canary.ScoreRecorder)
+func (bs *BroadcastSystem) RecordCanary(ctx context.Context, url string, success bool, responseTime time.Duration) error {
+	return bs.manager.RecordCanary(ctx, url, success, responseTime)
+}
+
+// ResetRelayStats clears a relay's health history and re-tests it. Returns false if the relay is unknown.
+func (bs *BroadcastSystem) ResetRelayStats(url string) bool {
+	if err := bs.manager.ResetRelayStats(context.Background(), url); err != nil {
+		if !errors.Is(err, manager.ErrRelayNotFound) {
+			logging.Error("BroadcastSystem: Failed to reset stats of %s: %v", url, err)
+		}
+		return false
+	}
+	go bs.healthChecker.CheckInitial(url)
+	return true
+}
+
+// ResetAllRelayStats clears every relay's health history and re-tests the pool in the background
+func (bs *BroadcastSystem) ResetAllRelayStats() int {
+	ctx := context.Background()
+	count, err := bs.manager.ResetAllRelayStats(ctx)
+	if err != nil {
+		logging.Error("BroadcastSystem: Failed to reset relay stats: %v", err)
+		return 0
+	}
+	relays, err := bs.manager.GetAllRelays(ctx)
+	if err != nil {
+		logging.Error("BroadcastSystem: Failed to list relays for re-testing: %v", err)
+		return count
+	}
+	go bs.healthChecker.CheckBatch(relays)
+	return count
+}
+
+// Pause stops outbound publishing while events keep queueing; false if already paused
+func (bs *BroadcastSystem) Pause(reason string) bool {
+	return bs.broadcaster.Pause(reason)
+}
+
+// Resume restarts outbound publishing and drains the queue; false if not paused
+func (bs *BroadcastSystem) Resume() bool {
+	return bs.broadcaster.Resume()
+}
+
+// PauseState reports whether broadcasting is paused, since when and why
+func (bs *BroadcastSystem) PauseState() (bool, time.Time, string) {
+	return bs.broadcaster.PauseState()
+}
+
+// QueueDepth returns the number of events waiting to be broadcast
+func (bs *BroadcastSystem) QueueDepth() int64 {
+	return bs.broadcaster.QueueDepth()
+}
+
+// ResetCounters clears the broadcaster's cumulative queue and cache counters
+func (bs *BroadcastSystem) ResetCounters() {
+	bs.broadcaster.ResetCounters()
+}
+
+// GetRelayCount returns the number of tracked relays
+func (bs *BroadcastSystem) GetRelayCount() int {
+	count, err := bs.manager.GetRelayCount(context.Background())
+	if err != nil {
+		logging.Error("BroadcastSystem: Failed to count relays: %v", err)
+	}
+	return count
+}
+
+// GetRelayStats returns the statistics, failure breakdown and recent errors of one relay, or false if it is unknown
+func (bs *BroadcastSystem) GetRelayStats(url string) (*json.JsonObject, bool) {
+	info, err := bs.manager.GetRelayInfo(context.Background(), url)
+	if err != nil {
+		if !errors.Is(err, manager.ErrRelayNotFound) {
+			logging.Error("BroadcastSystem: Failed to get relay %s: %v", url, err)
+		}
+		return nil, false
+	}
+	return bs.manager.RelayDetailObject(info), true
+}
+
+// EventOutcome returns the per-relay broadcast outcome of a recent event; false if it is not in
+// the ledger (unknown, too old, or the ledger is disabled)
+func (bs *BroadcastSystem) EventOutcome(eventID string) (*json.JsonObject, bool) {
+	if bs.ledger == nil {
+		return nil, false
+	}
+	return bs.ledger.Outcome(eventID)
+}
+
+// KindMatrix returns the kind x relay success rates selected by q; false if the matrix is disabled
+func (bs *BroadcastSystem) KindMatrix(q kindmatrix.Query) (*json.JsonObject, bool) {
+	if bs.kindMatrix == nil {
+		return nil, false
+	}
+	return bs.kindMatrix.Matrix(q), true
+}
+
+// ConsistencyReport lists the relays behaving against their NIP-11 claims; false if consistency
+// checks are disabled
+func (bs *BroadcastSystem) ConsistencyReport() (*json.JsonObject, bool) {
+	if bs.consistency == nil {
+		return nil, false
+	}
+	return bs.consistency.Report(), true
+}
+
+// RecordProbe stores latency measurements from a remote probe agent. Returns false if regional selection is disabled.
+func (bs *BroadcastSystem) RecordProbe(agent, region string, results []regions.Measurement) (int, bool) {
+	if bs.regions == nil {
+		return 0, false
+	}
+	return bs.regions.RecordProbe(agent, region, results), true
+}
+
+// GetTestSink returns the in-memory publish sink, or nil outside TEST_MODE
+func (bs *BroadcastSystem) GetTestSink() *testsink.Sink {
+	return bs.testSink
+}
+
+// GetManager returns the underlying manager for external health checking
+func (bs *BroadcastSystem) GetManager() manager.RelayManager {
+	return bs.manager
+}
+
+// GetHealthChecker returns the health checker for external use
+func (bs *BroadcastSystem) GetHealthChecker() *health.Checker {
+	return bs.healthChecker
+}
+
+// IsEventCached checks if an event is cached (for duplicate detection)
+func (bs *BroadcastSystem) IsEventCached(eventID string) bool {
+	return bs.broadcaster.IsEventCached(eventID)
+}
+
+// ExtractRelaysFromEvent extracts relay URLs from an event
+func (bs *BroadcastSystem) ExtractRelaysFromEvent(event *nostr.Event) []string {
+	return bs.discovery.ExtractRelaysFromEvent(event)
+}
+
+// EvictRelays applies the discovery source eviction policy and returns how many relays were removed
+func (bs *BroadcastSystem) EvictRelays(ctx context.Context) int {
+	return bs.discovery.EvictRelays(ctx)
+}
+
+// AddRelayIfNew adds a relay discovered through source (see manager.Sources) if it's not already known
+func (bs *BroadcastSystem) AddRelayIfNew(url string, source string) {
+	bs.discovery.AddRelayIfNew(url, source)
+}
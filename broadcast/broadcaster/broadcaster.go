@@ -0,0 +1,1293 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/backoff"
+	"github.com/girino/nostr-brodcast-relay/broadcast/budget"
+	"github.com/girino/nostr-brodcast-relay/broadcast/netdiag"
+	"github.com/girino/nostr-brodcast-relay/broadcast/onion"
+	"github.com/girino/nostr-brodcast-relay/broadcast/politeness"
+	"github.com/girino/nostr-brodcast-relay/broadcast/pool"
+	"github.com/girino/nostr-brodcast-relay/crash"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/stats"
+	"github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// relayLookupTimeout bounds how long planning waits for the relay provider's ranking
+const relayLookupTimeout = 5 * time.Second
+
+// publishTimeout bounds one relay publish (shortened to what is left of the event's deadline)
+const publishTimeout = 10 * time.Second
+
+// errEventDeadline marks publishes cut short by the event's total broadcast deadline; like
+// budget errors they are a local limit and not tracked against the relay
+const errEventDeadline = "deadline: event broadcast deadline exceeded"
+
+// BroadcasterStats represents broadcaster statistics
+type BroadcasterStats struct {
+	MandatoryRelays int        `json:"mandatory_relays"`
+	Queue           QueueStats `json:"queue"`
+	Cache           CacheStats `json:"cache"`
+}
+
+// QueueStats represents queue statistics
+type QueueStats struct {
+	WorkerCount        int     `json:"worker_count"`
+	ChannelSize        int     `json:"channel_size"`
+	ChannelCapacity    int     `json:"channel_capacity"`
+	ChannelUtilization float64 `json:"channel_utilization"`
+	OverflowSize       int     `json:"overflow_size"`
+	OverflowBytes      int64   `json:"overflow_bytes"`
+	TotalQueued        int64   `json:"total_queued"`
+	PeakSize           int64   `json:"peak_size"`
+	SaturationCount    int64   `json:"saturation_count"`
+	IsSaturated        bool    `json:"is_saturated"`
+	LastSaturation     string  `json:"last_saturation"`
+}
+
+// CacheStats represents cache statistics
+type CacheStats struct {
+	Size           int     `json:"size"`
+	MaxSize        int     `json:"max_size"`
+	UtilizationPct float64 `json:"utilization_pct"`
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	HitRatePct     float64 `json:"hit_rate_pct"`
+}
+
+// RelayResult is the outcome of publishing one event to one relay
+type RelayResult struct {
+	URL          string
+	Success      bool
+	ResponseTime time.Duration
+	Error        string
+	At           time.Time // when the publish finished
+	Attempts     int       // publishes made, retries included
+	Duplicate    bool      // the relay already had the event (counted as delivered)
+}
+
+// Local reports whether the publish failed on a local limit (outbound budget or the event's
+// deadline) rather than on the relay
+func (r RelayResult) Local() bool {
+	return !r.Success && localFailure(r.Error)
+}
+
+func localFailure(errMsg string) bool {
+	return errMsg == errEventDeadline || strings.HasPrefix(errMsg, "budget:")
+}
+
+// BroadcastReport summarizes the delivery of one event to all of its target relays
+type BroadcastReport struct {
+	Event    *nostr.Event
+	Results  []RelayResult // in the order the publishes finished
+	Queued   time.Time     // when the event was accepted for broadcasting
+	Started  time.Time
+	Finished time.Time
+}
+
+// KindTTL overrides the dedup cache TTL for kinds MinKind..MaxKind (inclusive)
+type KindTTL struct {
+	MinKind int
+	MaxKind int
+	TTL     time.Duration
+}
+
+type Broadcaster struct {
+	relayProvider   RelayProvider
+	resultTracker   PublishResultTracker
+	mandatoryRelays []string
+	eventQueue      chan *nostr.Event
+	overflowQueue   []*nostr.Event
+	overflowMutex   sync.Mutex
+	// Approximate size of the overflow queue, its cap (0 = none) and the events dropped over it
+	overflowBytes     int64
+	maxOverflowBytes  int64
+	peakOverflowBytes int64
+	overflowDropped   int64
+	overflowDroppedB  int64
+	channelCapacity   int
+	totalQueued       int64
+	peakQueueSize     int64
+	saturationCount   int64
+	lastSaturation    time.Time
+	workerCount       int64 // target size of the worker pool (see SetWorkers)
+	ctx               context.Context
+	cancel            context.CancelFunc
+	wg                sync.WaitGroup
+	// Event deduplication cache
+	eventCache  dedupCache
+	cacheTTL    time.Duration
+	cacheHits   int64
+	cacheMisses int64
+	// Per-kind dedup windows (first match wins) and ephemeral exclusion
+	kindTTLs         []KindTTL
+	excludeEphemeral bool
+	cacheSkipped     int64
+	// Per-event delivery reporting
+	reporters   []BroadcastReporter
+	reportersMu sync.RWMutex
+	// Per-event relay selection policies
+	relayFilters []RelayFilter
+	// Pooled relay connections; events are serialized once and written as raw frames
+	connPool  *pool.Pool
+	publisher Publisher
+	// Outbound concurrency shared with health probes (nil = unlimited)
+	budget *budget.Budget
+	// Per-relay events-per-minute ceilings (nil = unlimited)
+	throttle *politeness.Throttle
+	// Per-event relay-set size overrides (event ID -> top N), consumed when the event is broadcast
+	fanout sync.Map
+	// Acceptance times (event ID -> time.Time), consumed when the event is broadcast
+	queuedAt sync.Map
+	// Global pause: workers hold events (they stay queued) until resumed
+	pauseMu     sync.Mutex
+	resumed     chan struct{} // non-nil while paused, closed on resume
+	pausedAt    time.Time
+	pauseReason string
+	// Late OKs: event ID -> channel closed once its broadcast is fully reported, so corrections
+	// never race the original (timed-out) result
+	inflight       sync.Map
+	lateOKWindow   time.Duration
+	lateConfirmed  int64
+	lateRejected   int64
+	lateCorrectErr int64
+	// Total time all publishes of one event may take, from the start of its broadcast (0 = none)
+	eventDeadline    time.Duration
+	deadlineExceeded int64
+	// Publishes answered with "duplicate:" (the relay already had the event)
+	duplicates int64
+	// Retries of transiently failed publishes, with per-relay dead-letter counts (see SetRetryPolicy)
+	retry retryState
+	// Events from bulk sources, drained by the workers at a lower weight than client events
+	lanes ingestLane
+	// Near-real-time kinds: no dedup cache, taken first, sent to the fastest relays (see SetRealtime)
+	realtime realtimeLane
+	// Worker pool sizing: retire tokens make idle workers exit, load counters feed Load
+	workersMu    sync.Mutex
+	nextWorkerID int
+	retire       chan struct{}
+	load         loadCounters
+	// Where Stop saves the events still queued and Start reloads them from ("" = not kept)
+	journal string
+}
+
+func NewBroadcaster(relayProvider RelayProvider, resultTracker PublishResultTracker, mandatoryRelays []string, workerCount int, cacheTTL time.Duration) *Broadcaster {
+	logging.DebugMethod("broadcaster", "NewBroadcaster", "Initializing broadcaster with %d workers", workerCount)
+	if len(mandatoryRelays) > 0 {
+		logging.Info("Broadcaster: Configured with %d mandatory relays", len(mandatoryRelays))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connPool := pool.New(5 * time.Minute)
+	channelCapacity := workerCount * 10
+	cacheMaxSize := 100000 // ~10MB: 100K event IDs @ ~100 bytes each
+
+	logging.Info("Broadcaster: Channel capacity set to %d (10 * %d workers)", channelCapacity, workerCount)
+	logging.Info("Broadcaster: Event cache initialized with max size %d (~10MB), TTL %v", cacheMaxSize, cacheTTL)
+
+	return &Broadcaster{
+		relayProvider:   relayProvider,
+		resultTracker:   resultTracker,
+		mandatoryRelays: mandatoryRelays,
+		eventQueue:      make(chan *nostr.Event, channelCapacity),
+		overflowQueue:   make([]*nostr.Event, 0),
+		channelCapacity: channelCapacity,
+		totalQueued:     0,
+		peakQueueSize:   0,
+		saturationCount: 0,
+		workerCount:     int64(workerCount),
+		retire:          make(chan struct{}, maxWorkers),
+		lanes:           newIngestLane(channelCapacity),
+		load:            loadCounters{since: time.Now()},
+		ctx:             ctx,
+		cancel:          cancel,
+		eventCache:      newDedupCache(cacheMaxSize),
+		cacheTTL:        cacheTTL,
+		cacheHits:       0,
+		cacheMisses:     0,
+		connPool:        connPool,
+		publisher:       connPool,
+	}
+}
+
+// Start initializes and starts the worker pool
+func (b *Broadcaster) Start() {
+	logging.Info("Broadcaster: Starting %d workers", b.Workers())
+	b.workersMu.Lock()
+	for i := 0; i < b.Workers(); i++ {
+		b.startWorkerLocked()
+	}
+	b.workersMu.Unlock()
+
+	// Start cache cleanup goroutine
+	b.wg.Add(1)
+	go b.cacheCleanup()
+
+	if b.journal != "" {
+		b.loadJournal()
+	}
+}
+
+// SetPublisher replaces the pooled relay connections as the publish target (e.g. the test sink).
+// Must be called before Start.
+func (b *Broadcaster) SetPublisher(publisher Publisher) {
+	b.publisher = publisher
+}
+
+// Publisher returns the current publish target, for wrapping with SetPublisher
+func (b *Broadcaster) Publisher() Publisher {
+	return b.publisher
+}
+
+// SetBudget makes publishes take priority slots from the outbound budget shared with probes.
+// Must be called before Start.
+func (b *Broadcaster) SetBudget(outbound *budget.Budget) {
+	b.budget = outbound
+}
+
+// SetBackoff makes pooled connections skip hosts backed off after answering 429/503 and report
+// such answers to tracker. Must be called before Start.
+func (b *Broadcaster) SetBackoff(tracker *backoff.Tracker) {
+	b.connPool.SetBackoff(tracker)
+}
+
+// SetOnionProxy makes connections to .onion relays go through torProxy. Must be called before Start.
+func (b *Broadcaster) SetOnionProxy(torProxy *onion.Proxy) {
+	b.connPool.SetOnionProxy(torProxy)
+}
+
+// OnDial calls fn with the outcome and duration of every connection opened to a destination
+// relay. fn must return quickly. Must be called before Start.
+func (b *Broadcaster) OnDial(fn func(url string, elapsed time.Duration, err error)) {
+	b.connPool.OnDial(fn)
+}
+
+// SetAuthKey makes pooled connections answer "auth-required:" rejections with NIP-42
+// authentication signed by secretKey (hex) and publish again. Must be called before Start.
+func (b *Broadcaster) SetAuthKey(secretKey string) {
+	b.connPool.SetAuthKey(secretKey)
+}
+
+// SetDialMode chooses the address family of new connections to destination relays: one of the
+// pool.Dial* modes, with fallbackDelay as the happy-eyeballs head start. Must be called before
+// Start.
+func (b *Broadcaster) SetDialMode(mode string, fallbackDelay time.Duration) {
+	b.connPool.SetDialConfig(pool.DialConfig{Mode: mode, FallbackDelay: fallbackDelay})
+}
+
+// SetLateOKWindow keeps listening for lateWindow after a publish times out; an OK arriving in
+// that window retroactively turns the failure into a success in the result tracker and for
+// reporters implementing DeliveryCorrector. Must be called before Start.
+func (b *Broadcaster) SetLateOKWindow(lateWindow time.Duration) {
+	b.lateOKWindow = lateWindow
+	b.connPool.WatchLateOKs(lateWindow, b.lateOK)
+}
+
+// KeepWarm keeps pooled connections to the broadcast relays (top N and mandatory) open between
+// publishes, pinging them every interval and redialing them when they drop. Not for the test
+// sink: it dials the real relays.
+func (b *Broadcaster) KeepWarm(interval time.Duration) {
+	b.connPool.KeepWarm(interval, func() []string {
+		relays, err := b.relayProvider.GetBroadcastRelays(b.ctx)
+		if err != nil {
+			logging.DebugMethod("broadcaster", "KeepWarm", "No relays to keep warm: %v", err)
+		}
+		seen := make(map[string]bool, len(relays))
+		for _, url := range relays {
+			seen[url] = true
+		}
+		for _, url := range b.getMandatoryRelays() {
+			if !seen[url] {
+				relays = append(relays, url)
+			}
+		}
+		return relays
+	})
+}
+
+// SetEventDeadline bounds the total time the publishes of one event may take: throttle waits and
+// per-relay timeouts are cut to what is left of it. Must be called before Start.
+func (b *Broadcaster) SetEventDeadline(deadline time.Duration) {
+	b.eventDeadline = deadline
+}
+
+// SetOverflowLimit caps the approximate bytes of the events waiting in the overflow queue (0 =
+// no cap); events that would exceed it are dropped. Must be called before Start.
+func (b *Broadcaster) SetOverflowLimit(maxBytes int64) {
+	b.maxOverflowBytes = maxBytes
+}
+
+// lateOK handles an OK that arrived after its publish timed out
+func (b *Broadcaster) lateOK(late pool.LateOK) {
+	if !late.OK {
+		// The failure stands, only its reason changes
+		atomic.AddInt64(&b.lateRejected, 1)
+		logging.DebugMethod("broadcaster", "lateOK", "Late rejection of %s by %s: %s", late.EventID, late.URL, late.Reason)
+		return
+	}
+	atomic.AddInt64(&b.lateConfirmed, 1)
+
+	go func() {
+		if done, ok := b.inflight.Load(late.EventID); ok {
+			<-done.(chan struct{})
+		}
+		logging.DebugMethod("broadcaster", "lateOK", "Event %s confirmed by %s %v after publish", late.EventID, late.URL, late.Delay)
+
+		if tracker, ok := b.resultTracker.(LateResultTracker); ok {
+			if err := tracker.TrackLateSuccess(b.ctx, late.URL, late.Delay); err != nil {
+				atomic.AddInt64(&b.lateCorrectErr, 1)
+				logging.DebugMethod("broadcaster", "lateOK", "Failed to correct result of %s: %v", late.URL, err)
+			}
+		}
+		result := RelayResult{URL: late.URL, Success: true, ResponseTime: late.Delay, At: time.Now()}
+		for _, reporter := range b.getReporters() {
+			if corrector, ok := reporter.(DeliveryCorrector); ok {
+				corrector.DeliveryCorrected(late.EventID, result)
+			}
+		}
+	}()
+}
+
+// SetThrottle applies per-relay politeness ceilings and rate-limited pauses to publishes. Must be
+// called before Start.
+func (b *Broadcaster) SetThrottle(throttle *politeness.Throttle) {
+	b.throttle = throttle
+}
+
+// SetCachePolicy sets per-kind dedup windows and whether ephemeral kinds (20000-29999) are
+// kept out of the cache entirely. Must be called before Start.
+func (b *Broadcaster) SetCachePolicy(kindTTLs []KindTTL, excludeEphemeral bool) {
+	b.kindTTLs = kindTTLs
+	b.excludeEphemeral = excludeEphemeral
+	for _, kt := range kindTTLs {
+		logging.Info("Broadcaster: Cache TTL for kinds %d-%d: %v", kt.MinKind, kt.MaxKind, kt.TTL)
+	}
+	if excludeEphemeral {
+		logging.Info("Broadcaster: Ephemeral events excluded from the cache")
+	}
+}
+
+// cacheTTLForKind returns the dedup window for kind, or 0 if it is not cached at all
+func (b *Broadcaster) cacheTTLForKind(kind int) time.Duration {
+	if b.excludeEphemeral && nostr.IsEphemeralKind(kind) {
+		return 0
+	}
+	for _, kt := range b.kindTTLs {
+		if kind >= kt.MinKind && kind <= kt.MaxKind {
+			return kt.TTL
+		}
+	}
+	return b.cacheTTL
+}
+
+// Stop gracefully shuts down the worker pool
+func (b *Broadcaster) Stop() {
+	logging.Info("Broadcaster: Stopping worker pool")
+	b.cancel()
+	close(b.eventQueue)
+	b.wg.Wait()
+	if b.journal != "" {
+		b.saveJournal()
+	}
+	b.connPool.Close()
+	logging.Info("Broadcaster: All workers stopped")
+}
+
+// AddReporter registers a reporter that receives per-event delivery results
+func (b *Broadcaster) AddReporter(reporter BroadcastReporter) {
+	b.reportersMu.Lock()
+	defer b.reportersMu.Unlock()
+	b.reporters = append(b.reporters, reporter)
+}
+
+// AddRelayFilter registers a policy that can narrow the relay set of each event
+func (b *Broadcaster) AddRelayFilter(filter RelayFilter) {
+	b.reportersMu.Lock()
+	defer b.reportersMu.Unlock()
+	b.relayFilters = append(b.relayFilters, filter)
+}
+
+func (b *Broadcaster) getRelayFilters() []RelayFilter {
+	b.reportersMu.RLock()
+	defer b.reportersMu.RUnlock()
+	return b.relayFilters
+}
+
+func (b *Broadcaster) getReporters() []BroadcastReporter {
+	b.reportersMu.RLock()
+	defer b.reportersMu.RUnlock()
+	return b.reporters
+}
+
+// AddMandatoryRelay makes url receive every event from now on, like the configured mandatory
+// relays; false if it already does
+func (b *Broadcaster) AddMandatoryRelay(url string) bool {
+	b.reportersMu.Lock()
+	defer b.reportersMu.Unlock()
+	for _, existing := range b.mandatoryRelays {
+		if existing == url {
+			return false
+		}
+	}
+	// Copy on write: plans hold on to the previous slice
+	b.mandatoryRelays = append(append([]string{}, b.mandatoryRelays...), url)
+	logging.Info("Broadcaster: Added mandatory relay %s (%d mandatory relays)", url, len(b.mandatoryRelays))
+	return true
+}
+
+// MandatoryRelays returns the relays that get every event
+func (b *Broadcaster) MandatoryRelays() []string {
+	return b.getMandatoryRelays()
+}
+
+func (b *Broadcaster) getMandatoryRelays() []string {
+	b.reportersMu.RLock()
+	defer b.reportersMu.RUnlock()
+	return b.mandatoryRelays
+}
+
+// Replay publishes events, one at a time, to url alone (e.g. a backfill for a relay added at
+// runtime), honoring its politeness ceiling and the outbound budget and yielding to queued
+// client events. Results are tracked like any
+// publish but reporters are not notified. Stops early if the broadcaster is stopped.
+func (b *Broadcaster) Replay(url string, events []*nostr.Event) (delivered, failed int) {
+	for _, event := range events {
+		if b.ctx.Err() != nil {
+			break
+		}
+		b.yieldToLive()
+		frame, err := pool.EventFrame(event)
+		if err != nil {
+			failed++
+			continue
+		}
+		if result := b.publishToRelay(url, event, frame, time.Time{}); result.Success {
+			delivered++
+		} else {
+			failed++
+		}
+	}
+	return delivered, failed
+}
+
+// Pause stops outbound publishing; events keep being accepted into the queue until Resume.
+// Publishes already in flight finish. Returns false if already paused.
+func (b *Broadcaster) Pause(reason string) bool {
+	b.pauseMu.Lock()
+	defer b.pauseMu.Unlock()
+	if b.resumed != nil {
+		return false
+	}
+	b.resumed = make(chan struct{})
+	b.pausedAt = time.Now()
+	b.pauseReason = reason
+	logging.Warn("Broadcaster: Broadcasting paused (%s)", reason)
+	return true
+}
+
+// Resume restarts outbound publishing, draining the queued events. Returns false if not paused.
+func (b *Broadcaster) Resume() bool {
+	b.pauseMu.Lock()
+	defer b.pauseMu.Unlock()
+	if b.resumed == nil {
+		return false
+	}
+	close(b.resumed)
+	logging.Info("Broadcaster: Broadcasting resumed after %v, %d events queued",
+		time.Since(b.pausedAt).Round(time.Second), atomic.LoadInt64(&b.totalQueued))
+	b.resumed = nil
+	b.pausedAt = time.Time{}
+	b.pauseReason = ""
+	return true
+}
+
+// PauseState reports whether broadcasting is paused, since when and why
+func (b *Broadcaster) PauseState() (paused bool, since time.Time, reason string) {
+	b.pauseMu.Lock()
+	defer b.pauseMu.Unlock()
+	return b.resumed != nil, b.pausedAt, b.pauseReason
+}
+
+// waitWhilePaused blocks while broadcasting is paused; false means the broadcaster is stopping
+func (b *Broadcaster) waitWhilePaused() bool {
+	b.pauseMu.Lock()
+	resumed := b.resumed
+	b.pauseMu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-b.ctx.Done():
+		return false
+	}
+}
+
+// worker processes events from the queue
+func (b *Broadcaster) worker(id int) {
+	defer b.wg.Done()
+	logging.DebugMethod("broadcaster", "worker", "Worker %d started", id)
+
+	for {
+		if b.ctx.Err() != nil {
+			logging.DebugMethod("broadcaster", "worker", "Worker %d shutting down (context cancelled)", id)
+			return
+		}
+		// Fast-path events first, then the lanes by weight; block only when all are empty
+		event := b.nextRealtime()
+		if event == nil {
+			event = b.nextEvent()
+		}
+		if event == nil {
+			select {
+			case <-b.ctx.Done():
+				logging.DebugMethod("broadcaster", "worker", "Worker %d shutting down (context cancelled)", id)
+				return
+			case <-b.retire:
+				logging.DebugMethod("broadcaster", "worker", "Worker %d retired (pool shrunk)", id)
+				return
+			case <-b.lanes.wake:
+				continue
+			case queued := <-b.realtime.queue:
+				atomic.AddInt64(&b.realtime.dispatched, 1)
+				event = queued
+			case queued, ok := <-b.eventQueue:
+				if !ok {
+					logging.DebugMethod("broadcaster", "worker", "Worker %d shutting down (queue closed)", id)
+					return
+				}
+				b.lanes.tookLive()
+				event = queued
+			}
+		}
+
+		// Hold the event while paused; it still counts as queued
+		if !b.waitWhilePaused() {
+			logging.DebugMethod("broadcaster", "worker", "Worker %d shutting down while paused", id)
+			if b.journal != "" {
+				b.hold(event)
+			}
+			return
+		}
+
+		// Decrement total queued count
+		atomic.AddInt64(&b.totalQueued, -1)
+
+		// Try to backfill from overflow
+		b.backfillChannel()
+
+		// Broadcast the event
+		if queued, ok := b.queuedAt.Load(event.ID); ok {
+			b.load.waited(time.Since(queued.(time.Time)))
+		}
+		b.broadcastSafely(event)
+	}
+}
+
+// broadcastSafely broadcasts event, reporting a panic instead of letting it kill the worker
+func (b *Broadcaster) broadcastSafely(event *nostr.Event) {
+	defer crash.Recover("broadcaster.worker", "event", event.ID, "kind", strconv.Itoa(event.Kind))
+	b.broadcastEvent(event)
+}
+
+// backfillChannel attempts to move events from overflow queue to channel
+func (b *Broadcaster) backfillChannel() {
+	b.overflowMutex.Lock()
+	defer b.overflowMutex.Unlock()
+
+	// Move events from overflow to channel while there's space and overflow has events
+	for len(b.overflowQueue) > 0 {
+		select {
+		case b.eventQueue <- b.overflowQueue[0]:
+			// Successfully moved to channel, remove from overflow
+			b.overflowBytes -= eventSize(b.overflowQueue[0])
+			b.overflowQueue = b.overflowQueue[1:]
+		default:
+			// Channel is full, stop trying
+			return
+		}
+	}
+}
+
+// isEventCached checks if an event has already been broadcast and not expired
+func (b *Broadcaster) isEventCached(eventID string) bool {
+	if !b.eventCache.contains(eventID) {
+		atomic.AddInt64(&b.cacheMisses, 1)
+		return false
+	}
+	atomic.AddInt64(&b.cacheHits, 1)
+	return true
+}
+
+// IsEventCached checks if an event ID is in the cache (public method for relay)
+func (b *Broadcaster) IsEventCached(eventID string) bool {
+	return b.isEventCached(eventID)
+}
+
+// cacheCleanup periodically removes expired entries from the cache
+func (b *Broadcaster) cacheCleanup() {
+	defer b.wg.Done()
+
+	// Run cleanup every 1/10th of the TTL or every 5 minutes, whichever is less
+	cleanupInterval := b.cacheTTL / 10
+	if cleanupInterval > 5*time.Minute {
+		cleanupInterval = 5 * time.Minute
+	}
+	if cleanupInterval < 30*time.Second {
+		cleanupInterval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	logging.DebugMethod("broadcaster", "cacheCleanup", "Cache cleanup started, interval: %v", cleanupInterval)
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			logging.DebugMethod("broadcaster", "cacheCleanup", "Cache cleanup shutting down")
+			return
+		case <-ticker.C:
+			if removed := b.eventCache.expire(time.Now()); removed > 0 {
+				size, _ := b.eventCache.size()
+				logging.DebugMethod("broadcaster", "cacheCleanup", "Removed %d expired entries (cache size: %d)", removed, size)
+			}
+		}
+	}
+}
+
+// addEventToCache adds an event ID to the cache with current timestamp and its kind's TTL
+func (b *Broadcaster) addEventToCache(eventID string, kind int) {
+	ttl := b.cacheTTLForKind(kind)
+	if ttl <= 0 {
+		atomic.AddInt64(&b.cacheSkipped, 1)
+		return
+	}
+
+	logging.DebugMethod("broadcaster", "addEventToCache", "Adding event %s to cache", eventID)
+	// When full, the oldest entry makes room
+	b.eventCache.add(eventID, ttl)
+}
+
+// removeFromCache forgets an event ID that was never broadcast
+func (b *Broadcaster) removeFromCache(eventID string) {
+	b.eventCache.remove(eventID)
+}
+
+// eventSize approximates the memory an event holds: its content and tags plus the fixed-size
+// hex fields and JSON framing
+func eventSize(event *nostr.Event) int64 {
+	size := int64(len(event.Content)) + 64 + 64 + 128 + 100
+	for _, tag := range event.Tags {
+		for _, item := range tag {
+			size += int64(len(item)) + 3
+		}
+	}
+	return size
+}
+
+// Broadcast enqueues an event for broadcasting
+func (b *Broadcaster) Broadcast(event *nostr.Event) {
+	// Check if shutting down
+	select {
+	case <-b.ctx.Done():
+		logging.Warn("Broadcaster: Cannot queue event %s, broadcaster is shutting down", event.ID)
+		return
+	default:
+	}
+
+	if b.isRealtime(event.Kind) {
+		b.broadcastRealtime(event)
+		return
+	}
+
+	// Add to cache (should not be cached yet since relay rejects duplicates)
+	b.addEventToCache(event.ID, event.Kind)
+	b.enqueue(event)
+}
+
+// enqueue puts an event that is already in the dedup cache on the queue
+func (b *Broadcaster) enqueue(event *nostr.Event) {
+	b.queuedAt.Store(event.ID, time.Now())
+
+	// Try to add to channel first (fast path)
+	select {
+	case b.eventQueue <- event:
+		// Successfully queued to channel
+		newTotal := atomic.AddInt64(&b.totalQueued, 1)
+		logging.DebugMethod("broadcaster", "Broadcast", "Event %s (kind %d) queued to channel (total: %d)",
+			event.ID, event.Kind, newTotal)
+
+		// Update peak size
+		for {
+			peak := atomic.LoadInt64(&b.peakQueueSize)
+			if newTotal <= peak || atomic.CompareAndSwapInt64(&b.peakQueueSize, peak, newTotal) {
+				break
+			}
+		}
+		return
+	default:
+		// Channel is full, add to overflow queue (slow path)
+		b.overflowMutex.Lock()
+		defer b.overflowMutex.Unlock()
+
+		size := eventSize(event)
+		if b.maxOverflowBytes > 0 && b.overflowBytes+size > b.maxOverflowBytes {
+			// Over the memory cap: drop the event and forget it, so a client retry is accepted
+			b.overflowDropped++
+			b.overflowDroppedB += size
+			b.queuedAt.Delete(event.ID)
+			b.removeFromCache(event.ID)
+			logging.Warn("Broadcaster: Overflow queue full (%d bytes, cap %d), dropping event %s (kind %d, %d bytes)",
+				b.overflowBytes, b.maxOverflowBytes, event.ID, event.Kind, size)
+			return
+		}
+
+		b.overflowQueue = append(b.overflowQueue, event)
+		b.overflowBytes += size
+		if b.overflowBytes > b.peakOverflowBytes {
+			b.peakOverflowBytes = b.overflowBytes
+		}
+		newTotal := atomic.AddInt64(&b.totalQueued, 1)
+
+		// Track saturation
+		if len(b.overflowQueue) == 1 {
+			// First overflow, log warning
+			atomic.AddInt64(&b.saturationCount, 1)
+			b.lastSaturation = time.Now()
+			logging.Warn("Broadcaster: Channel saturated (%d/%d), using overflow queue",
+				len(b.eventQueue), b.channelCapacity)
+		}
+
+		logging.DebugMethod("broadcaster", "Broadcast", "Event %s (kind %d) queued to overflow (overflow: %d, total: %d)",
+			event.ID, event.Kind, len(b.overflowQueue), newTotal)
+
+		// Update peak size
+		for {
+			peak := atomic.LoadInt64(&b.peakQueueSize)
+			if newTotal <= peak || atomic.CompareAndSwapInt64(&b.peakQueueSize, peak, newTotal) {
+				break
+			}
+		}
+	}
+}
+
+// BroadcastWithFanout enqueues event to be sent to the best topN relays (plus mandatory relays)
+// instead of the configured top N
+func (b *Broadcaster) BroadcastWithFanout(event *nostr.Event, topN int) {
+	if topN > 0 {
+		b.fanout.Store(event.ID, topN)
+	}
+	b.Broadcast(event)
+}
+
+// BatchEvent is one event of a batch handed over together, with its fan-out override (0 = top N)
+type BatchEvent struct {
+	Event *nostr.Event
+	TopN  int
+}
+
+// BroadcastBatch enqueues events accepted together, e.g. one client's bulk publish. Their IDs
+// enter the dedup cache under a single lock instead of one lock per event, and events already
+// cached (another copy got in while the batch was building) are skipped. It returns how many
+// events were queued.
+func (b *Broadcaster) BroadcastBatch(batch []BatchEvent) int {
+	select {
+	case <-b.ctx.Done():
+		logging.Warn("Broadcaster: Cannot queue a batch of %d events, broadcaster is shutting down", len(batch))
+		return 0
+	default:
+	}
+
+	// Fast-path kinds skip the cache and the batch
+	regular := batch[:0:0]
+	realtimeQueued := 0
+	for _, item := range batch {
+		if !b.isRealtime(item.Event.Kind) {
+			regular = append(regular, item)
+			continue
+		}
+		if item.TopN > 0 {
+			b.fanout.Store(item.Event.ID, item.TopN)
+		}
+		if b.broadcastRealtime(item.Event) {
+			realtimeQueued++
+		}
+	}
+	if len(regular) < len(batch) {
+		return realtimeQueued + b.BroadcastBatch(regular)
+	}
+
+	ids := make([]string, len(batch))
+	ttls := make([]time.Duration, len(batch))
+	for i, item := range batch {
+		ids[i] = item.Event.ID
+		ttls[i] = b.cacheTTLForKind(item.Event.Kind)
+		if ttls[i] <= 0 {
+			atomic.AddInt64(&b.cacheSkipped, 1)
+		}
+	}
+	added := b.eventCache.addNew(ids, ttls)
+
+	queued := 0
+	for i, item := range batch {
+		if !added[i] {
+			atomic.AddInt64(&b.cacheHits, 1)
+			logging.DebugMethod("broadcaster", "BroadcastBatch", "Skipping event %s, already cached", item.Event.ID)
+			continue
+		}
+		if item.TopN > 0 {
+			b.fanout.Store(item.Event.ID, item.TopN)
+		}
+		b.enqueue(item.Event)
+		queued++
+	}
+	logging.DebugMethod("broadcaster", "BroadcastBatch", "Queued %d of a batch of %d events", queued, len(batch))
+	return queued
+}
+
+// RelayPlan is the relay set chosen for one event and how it was assembled
+type RelayPlan struct {
+	Mandatory []string // configured mandatory relays
+	Top       []string // current top-N (plus regional picks)
+	Excluded  []string // dropped by per-event relay filters (routing, abuse policy)
+	Relays    []string // final target set
+}
+
+// planRelays builds the target set for event: mandatory + top N (deduplicated), then relay filters
+func (b *Broadcaster) planRelays(event *nostr.Event, dryRun bool) RelayPlan {
+	topRelayURLs := b.topRelays(event)
+	if b.isRealtime(event.Kind) {
+		topRelayURLs = b.fastestRelays(topRelayURLs)
+	}
+
+	// Build complete relay list: mandatory + top N (deduplicated)
+	relayURLs := make(map[string]bool)
+
+	// Add mandatory relays first
+	mandatory := b.getMandatoryRelays()
+	for _, url := range mandatory {
+		relayURLs[url] = true
+	}
+
+	// Add top N relays
+	for _, url := range topRelayURLs {
+		relayURLs[url] = true
+	}
+
+	// Convert to slice
+	broadcastRelays := make([]string, 0, len(relayURLs))
+	for url := range relayURLs {
+		broadcastRelays = append(broadcastRelays, url)
+	}
+
+	// Apply per-event relay policies; a dry run leaves their counters and holds untouched
+	for _, filter := range b.getRelayFilters() {
+		if planner, ok := filter.(PlanFilter); ok && dryRun {
+			broadcastRelays = planner.PlanRelays(event, broadcastRelays)
+		} else {
+			broadcastRelays = filter.FilterRelays(event, broadcastRelays)
+		}
+	}
+
+	kept := make(map[string]bool, len(broadcastRelays))
+	for _, url := range broadcastRelays {
+		kept[url] = true
+	}
+	excluded := []string{}
+	for url := range relayURLs {
+		if !kept[url] {
+			excluded = append(excluded, url)
+		}
+	}
+
+	return RelayPlan{
+		Mandatory: mandatory,
+		Top:       topRelayURLs,
+		Excluded:  excluded,
+		Relays:    broadcastRelays,
+	}
+}
+
+// topRelays returns the provider's relays, sized by the event's fan-out override if it has one
+func (b *Broadcaster) topRelays(event *nostr.Event) []string {
+	ctx, cancel := context.WithTimeout(b.ctx, relayLookupTimeout)
+	defer cancel()
+
+	var relays []string
+	var err error
+	value, ok := b.fanout.Load(event.ID)
+	if !ok {
+		relays, err = b.relayProvider.GetBroadcastRelays(ctx)
+	} else if sized, isSized := b.relayProvider.(SizedRelayProvider); isSized {
+		relays, err = sized.GetBroadcastRelaysN(ctx, value.(int))
+	} else {
+		relays, err = b.relayProvider.GetBroadcastRelays(ctx)
+		if topN := value.(int); len(relays) > topN {
+			relays = relays[:topN]
+		}
+	}
+	if err != nil {
+		// Mandatory relays still get the event
+		logging.Warn("Broadcaster: Failed to get top relays for event %s: %v", event.ID, err)
+		return nil
+	}
+	return relays
+}
+
+// Plan returns the relay set event would be broadcast to right now, without broadcasting it
+func (b *Broadcaster) Plan(event *nostr.Event) RelayPlan {
+	plan := b.planRelays(event, true)
+	sort.Strings(plan.Excluded)
+	sort.Strings(plan.Relays)
+	return plan
+}
+
+// broadcastEvent sends an event to the top N relays concurrently
+func (b *Broadcaster) broadcastEvent(event *nostr.Event) {
+	plan := b.planRelays(event, false)
+	b.fanout.Delete(event.ID)
+	queued, _ := b.queuedAt.LoadAndDelete(event.ID)
+	broadcastRelays := plan.Relays
+
+	if len(broadcastRelays) == 0 {
+		logging.Warn("Broadcaster: No relays available for broadcasting event %s (kind %d)", event.ID, event.Kind)
+		return
+	}
+
+	logging.DebugMethod("broadcaster", "broadcastEvent", "Broadcasting event %s (kind %d) to %d relays (%d mandatory + %d top)",
+		event.ID, event.Kind, len(broadcastRelays), len(plan.Mandatory), len(plan.Top))
+
+	// Serialize once; every relay gets the same frame
+	frame, err := pool.EventFrame(event)
+	if err != nil {
+		logging.Error("Broadcaster: Failed to serialize event %s: %v", event.ID, err)
+		return
+	}
+
+	reporters := b.getReporters()
+	for _, reporter := range reporters {
+		reporter.BroadcastPlanned(event, broadcastRelays)
+	}
+
+	done := make(chan struct{})
+	b.inflight.Store(event.ID, done)
+
+	var wg sync.WaitGroup
+	successCount := 0
+	failCount := 0
+	var mu sync.Mutex
+	report := BroadcastReport{
+		Event:   event,
+		Results: make([]RelayResult, 0, len(broadcastRelays)),
+		Started: time.Now(),
+	}
+	report.Queued = report.Started
+	if queuedAt, ok := queued.(time.Time); ok {
+		report.Queued = queuedAt
+	}
+	var deadline time.Time
+	if b.eventDeadline > 0 {
+		deadline = report.Started.Add(b.eventDeadline)
+	}
+
+	b.load.publishing(1)
+	for _, url := range broadcastRelays {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			result := b.publishSafely(u, event, frame, deadline)
+			result.At = time.Now()
+			mu.Lock()
+			if result.Success {
+				successCount++
+			} else {
+				failCount++
+			}
+			report.Results = append(report.Results, result)
+			mu.Unlock()
+		}(url)
+	}
+
+	// Track results in background
+	go func() {
+		defer func() {
+			b.inflight.Delete(event.ID)
+			close(done)
+		}()
+		defer crash.Recover("broadcaster.report", "event", event.ID)
+		wg.Wait()
+		b.load.publishing(-1)
+		logging.DebugMethod("broadcaster", "broadcastEvent", "Broadcast complete for event %s | success=%d, failed=%d, total=%d",
+			event.ID, successCount, failCount, len(broadcastRelays))
+		report.Finished = time.Now()
+		for _, reporter := range reporters {
+			reporter.BroadcastCompleted(report)
+		}
+	}()
+}
+
+// publishSafely publishes to one relay; a panic is reported and counts as a failed publish
+func (b *Broadcaster) publishSafely(url string, event *nostr.Event, frame []byte, deadline time.Time) (result RelayResult) {
+	defer func() {
+		if value := recover(); value != nil {
+			crash.Default().Record("broadcaster.publish", value, debug.Stack(), "event", event.ID, "relay", url)
+			result = RelayResult{URL: url, Error: fmt.Sprintf("internal error: %v", value)}
+		}
+	}()
+	return b.publishWithRetry(url, event, frame, deadline)
+}
+
+// publishToRelay writes the pre-serialized event frame to a single relay and tracks the result.
+// A non-zero deadline is the event's total broadcast deadline.
+func (b *Broadcaster) publishToRelay(url string, event *nostr.Event, frame []byte, deadline time.Time) RelayResult {
+	// Queue behind earlier publishes if the relay's politeness ceiling is reached; the publish
+	// deadline only starts once it is this publish's turn
+	queuedAt := time.Now()
+	waitCtx := b.ctx
+	if !deadline.IsZero() {
+		var cancelWait context.CancelFunc
+		waitCtx, cancelWait = context.WithDeadline(b.ctx, deadline)
+		defer cancelWait()
+	}
+	if err := b.throttle.Wait(waitCtx, url); err != nil {
+		if b.ctx.Err() == nil && waitCtx.Err() != nil {
+			return b.deadlineExceededResult(url, event, queuedAt)
+		}
+		logging.DebugMethod("broadcaster", "publishToRelay", "Not publishing event %s to %s: %v", event.ID, url, err)
+		return RelayResult{URL: url, Success: false, ResponseTime: time.Since(queuedAt), Error: err.Error()}
+	}
+
+	timeout := publishTimeout
+	cut := false
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return b.deadlineExceededResult(url, event, queuedAt)
+		}
+		if remaining < timeout {
+			timeout, cut = remaining, true
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	if err := b.budget.Acquire(ctx, budget.Publish); err != nil {
+		// Local saturation, not the relay's fault: don't track it against the relay
+		logging.Warn("Broadcaster: No outbound slot for %s within deadline (event %s)", url, event.ID)
+		return RelayResult{URL: url, Success: false, ResponseTime: time.Since(start), Error: "budget: " + err.Error()}
+	}
+	err := b.publisher.Publish(ctx, url, event.ID, frame)
+	b.budget.Release(budget.Publish)
+	elapsed := time.Since(start)
+
+	success := err == nil
+	if !success && cut && ctx.Err() != nil {
+		// The relay might have answered within its full timeout: the event ran out of time, not the relay
+		atomic.AddInt64(&b.deadlineExceeded, 1)
+		logging.DebugMethod("broadcaster", "publishToRelay", "Event %s ran out of its broadcast deadline publishing to %s", event.ID, url)
+		return RelayResult{URL: url, Success: false, ResponseTime: elapsed, Error: errEventDeadline}
+	}
+
+	if errors.Is(err, pool.ErrDuplicate) {
+		// The event reached the relay through another path: coverage, not a publish outcome
+		atomic.AddInt64(&b.duplicates, 1)
+		if tracker, ok := b.resultTracker.(CoverageTracker); ok {
+			if trackErr := tracker.TrackDuplicate(b.ctx, url, elapsed); trackErr != nil {
+				logging.DebugMethod("broadcaster", "publishToRelay", "Failed to track duplicate of %s: %v", url, trackErr)
+			}
+		}
+		logging.DebugMethod("broadcaster", "publishToRelay", "Relay %s already had event %s (%.2fms)",
+			url, event.ID, elapsed.Seconds()*1000)
+		return RelayResult{URL: url, Success: true, ResponseTime: elapsed, Duplicate: true}
+	}
+
+	// Track publish result
+	if b.resultTracker != nil {
+		if trackErr := b.resultTracker.TrackPublishResult(b.ctx, url, success, elapsed, err); trackErr != nil {
+			logging.DebugMethod("broadcaster", "publishToRelay", "Failed to track result of %s: %v", url, trackErr)
+		}
+	}
+
+	result := RelayResult{URL: url, Success: success, ResponseTime: elapsed}
+	if success {
+		logging.DebugMethod("broadcaster", "publishToRelay", "Published event %s to %s (%.2fms)",
+			event.ID, url, elapsed.Seconds()*1000)
+	} else {
+		result.Error = err.Error()
+		logging.DebugMethod("broadcaster", "publishToRelay", "Failed to publish to %s: %v (%.2fms)",
+			url, err, elapsed.Seconds()*1000)
+		if netdiag.Classify(err) == netdiag.ClassRateLimited {
+			// Hold the next publishes to this relay back instead of collecting more of the same answer
+			b.throttle.RateLimited(url)
+		}
+	}
+
+	return result
+}
+
+// deadlineExceededResult is the result of a publish skipped because its event's deadline passed
+func (b *Broadcaster) deadlineExceededResult(url string, event *nostr.Event, queuedAt time.Time) RelayResult {
+	atomic.AddInt64(&b.deadlineExceeded, 1)
+	logging.DebugMethod("broadcaster", "publishToRelay", "Not publishing event %s to %s: broadcast deadline of %v exceeded", event.ID, url, b.eventDeadline)
+	return RelayResult{URL: url, Success: false, ResponseTime: time.Since(queuedAt), Error: errEventDeadline}
+}
+
+// QueueDepth returns the number of events waiting to be broadcast (channel plus overflow)
+func (b *Broadcaster) QueueDepth() int64 {
+	return atomic.LoadInt64(&b.totalQueued)
+}
+
+// ResetCounters clears the cumulative queue and cache counters (current queue contents are kept)
+func (b *Broadcaster) ResetCounters() {
+	atomic.StoreInt64(&b.peakQueueSize, atomic.LoadInt64(&b.totalQueued))
+	atomic.StoreInt64(&b.saturationCount, 0)
+	atomic.StoreInt64(&b.cacheHits, 0)
+	atomic.StoreInt64(&b.cacheMisses, 0)
+	atomic.StoreInt64(&b.cacheSkipped, 0)
+	atomic.StoreInt64(&b.lateConfirmed, 0)
+	atomic.StoreInt64(&b.lateRejected, 0)
+	atomic.StoreInt64(&b.lateCorrectErr, 0)
+	atomic.StoreInt64(&b.deadlineExceeded, 0)
+	atomic.StoreInt64(&b.duplicates, 0)
+	atomic.StoreInt64(&b.retry.retries, 0)
+	atomic.StoreInt64(&b.retry.recovered, 0)
+	atomic.StoreInt64(&b.retry.deadLettered, 0)
+	b.retry.mu.Lock()
+	b.retry.deadLetters = make(map[string]*deadLetter)
+	b.retry.mu.Unlock()
+	b.overflowMutex.Lock()
+	b.lastSaturation = time.Time{}
+	b.peakOverflowBytes = b.overflowBytes
+	b.overflowDropped = 0
+	b.overflowDroppedB = 0
+	b.overflowMutex.Unlock()
+	b.resetLaneCounters()
+	b.resetRealtimeCounters()
+	logging.Info("Broadcaster: Counters reset")
+}
+
+// GetStatsName returns the name for this stats provider
+func (b *Broadcaster) GetStatsName() string {
+	return "broadcaster"
+}
+
+// GetStats returns the broadcaster's own statistics as a JsonEntity; the queue, cache, late OK
+// and deadline sections are separate providers (see RegisterStats)
+func (b *Broadcaster) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+
+	// Add mandatory relays
+	obj.Set("mandatory_relays", json.NewJsonValue(len(b.getMandatoryRelays())))
+
+	// Add pause state
+	paused, pausedAt, pauseReason := b.PauseState()
+	obj.Set("paused", json.NewJsonValue(paused))
+	if paused {
+		obj.Set("paused_since", json.NewJsonValue(pausedAt.Format(time.RFC3339)))
+		obj.Set("pause_reason", json.NewJsonValue(pauseReason))
+	}
+	return obj
+}
+
+// RegisterStats registers the broadcaster and its queue, lanes, realtime, cache, late OK, deadline and retry sections
+func (b *Broadcaster) RegisterStats(reg stats.Registrar) {
+	reg.Register(b)
+	reg.RegisterIn(b.GetStatsName(), stats.Func("queue", b.queueStats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("lanes", b.laneStats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("realtime", b.realtimeStats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("cache", b.cacheStats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("late_ok", b.lateOKStats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("event_deadline", b.deadlineStats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("coverage", b.coverageStats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("connections", b.connPool.Stats))
+	reg.RegisterIn(b.GetStatsName(), stats.Func("retry", b.retryStats))
+}
+
+func (b *Broadcaster) queueStats() json.JsonEntity {
+	b.overflowMutex.Lock()
+	overflowSize := len(b.overflowQueue)
+	overflowBytes, peakOverflowBytes := b.overflowBytes, b.peakOverflowBytes
+	overflowDropped, overflowDroppedB := b.overflowDropped, b.overflowDroppedB
+	b.overflowMutex.Unlock()
+	channelSize := len(b.eventQueue)
+
+	queueObj := json.NewJsonObject()
+	queueObj.Set("worker_count", json.NewJsonValue(b.Workers()))
+	queueObj.Set("channel_size", json.NewJsonValue(channelSize))
+	queueObj.Set("channel_capacity", json.NewJsonValue(b.channelCapacity))
+	queueObj.Set("channel_utilization", json.NewJsonValue(float64(channelSize)/float64(b.channelCapacity)*100.0))
+	queueObj.Set("overflow_size", json.NewJsonValue(overflowSize))
+	queueObj.Set("overflow_bytes", json.NewJsonValue(overflowBytes))
+	queueObj.Set("overflow_peak_bytes", json.NewJsonValue(peakOverflowBytes))
+	queueObj.Set("overflow_max_bytes", json.NewJsonValue(b.maxOverflowBytes))
+	queueObj.Set("overflow_dropped", json.NewJsonValue(overflowDropped))
+	queueObj.Set("overflow_dropped_bytes", json.NewJsonValue(overflowDroppedB))
+	queueObj.Set("total_queued", json.NewJsonValue(atomic.LoadInt64(&b.totalQueued)))
+	queueObj.Set("peak_size", json.NewJsonValue(atomic.LoadInt64(&b.peakQueueSize)))
+	queueObj.Set("saturation_count", json.NewJsonValue(atomic.LoadInt64(&b.saturationCount)))
+	queueObj.Set("is_saturated", json.NewJsonValue(overflowSize > 0))
+	queueObj.Set("last_saturation", json.NewJsonValue(b.lastSaturation.Format(time.RFC3339)))
+	return queueObj
+}
+
+func (b *Broadcaster) cacheStats() json.JsonEntity {
+	cacheSize, evicted := b.eventCache.size()
+	maxSize := b.eventCache.maxSize
+	cacheHits := atomic.LoadInt64(&b.cacheHits)
+	cacheMisses := atomic.LoadInt64(&b.cacheMisses)
+	cacheHitRate := 0.0
+	if total := cacheHits + cacheMisses; total > 0 {
+		cacheHitRate = float64(cacheHits) / float64(total) * 100.0
+	}
+
+	cacheObj := json.NewJsonObject()
+	cacheObj.Set("size", json.NewJsonValue(cacheSize))
+	cacheObj.Set("max_size", json.NewJsonValue(maxSize))
+	cacheObj.Set("utilization_pct", json.NewJsonValue(float64(cacheSize)/float64(maxSize)*100.0))
+	cacheObj.Set("evicted", json.NewJsonValue(evicted))
+	cacheObj.Set("hits", json.NewJsonValue(cacheHits))
+	cacheObj.Set("misses", json.NewJsonValue(cacheMisses))
+	cacheObj.Set("hit_rate_pct", json.NewJsonValue(cacheHitRate))
+	cacheObj.Set("kind_ttl_overrides", json.NewJsonValue(len(b.kindTTLs)))
+	cacheObj.Set("ephemeral_excluded", json.NewJsonValue(b.excludeEphemeral))
+	cacheObj.Set("skipped", json.NewJsonValue(atomic.LoadInt64(&b.cacheSkipped)))
+	return cacheObj
+}
+
+func (b *Broadcaster) lateOKStats() json.JsonEntity {
+	lateObj := json.NewJsonObject()
+	lateObj.Set("window_seconds", json.NewJsonValue(b.lateOKWindow.Seconds()))
+	lateObj.Set("confirmed", json.NewJsonValue(atomic.LoadInt64(&b.lateConfirmed)))
+	lateObj.Set("rejected", json.NewJsonValue(atomic.LoadInt64(&b.lateRejected)))
+	lateObj.Set("correction_errors", json.NewJsonValue(atomic.LoadInt64(&b.lateCorrectErr)))
+	return lateObj
+}
+
+func (b *Broadcaster) deadlineStats() json.JsonEntity {
+	deadlineObj := json.NewJsonObject()
+	deadlineObj.Set("seconds", json.NewJsonValue(b.eventDeadline.Seconds()))
+	deadlineObj.Set("exceeded", json.NewJsonValue(atomic.LoadInt64(&b.deadlineExceeded)))
+	return deadlineObj
+}
+
+func (b *Broadcaster) coverageStats() json.JsonEntity {
+	coverageObj := json.NewJsonObject()
+	coverageObj.Set("duplicates", json.NewJsonValue(atomic.LoadInt64(&b.duplicates)))
+	return coverageObj
+}
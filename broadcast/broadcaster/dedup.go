@@ -0,0 +1,140 @@
+package broadcaster
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheEntry is one event ID in the dedup cache
+type cacheEntry struct {
+	eventID   string
+	timestamp time.Time
+	ttl       time.Duration
+}
+
+// dedupCache remembers recently broadcast event IDs in least-recently-used order, so that when
+// it is full the entry seen longest ago is evicted in O(1) instead of an arbitrary one
+type dedupCache struct {
+	mu      sync.RWMutex
+	entries map[string]*list.Element // event ID -> element of order
+	order   *list.List               // *cacheEntry, least recently used first
+	maxSize int
+	evicted int64 // entries dropped to make room before they expired
+}
+
+func newDedupCache(maxSize int) dedupCache {
+	return dedupCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		maxSize: maxSize,
+	}
+}
+
+// add records eventID as seen now for ttl, evicting the least recently used entry if the cache
+// is full.
+// Adding a known ID refreshes it.
+func (c *dedupCache) add(eventID string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[eventID]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.timestamp, entry.ttl = time.Now(), ttl
+		c.order.MoveToBack(elem)
+		return
+	}
+	if c.order.Len() >= c.maxSize {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).eventID)
+		c.evicted++
+	}
+	c.entries[eventID] = c.order.PushBack(&cacheEntry{eventID: eventID, timestamp: time.Now(), ttl: ttl})
+}
+
+// addNew records each of eventIDs that is not cached yet (or expired) under one lock, as add
+// would, and reports which ones were new. A zero TTL keeps that ID out of the cache but still
+// counts it as new.
+func (c *dedupCache) addNew(eventIDs []string, ttls []time.Duration) []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	added := make([]bool, len(eventIDs))
+	for i, eventID := range eventIDs {
+		if elem, ok := c.entries[eventID]; ok {
+			entry := elem.Value.(*cacheEntry)
+			if now.Sub(entry.timestamp) <= entry.ttl {
+				c.order.MoveToBack(elem)
+				continue
+			}
+			c.order.Remove(elem)
+			delete(c.entries, eventID)
+		}
+		added[i] = true
+		if ttls[i] <= 0 {
+			continue
+		}
+		if c.order.Len() >= c.maxSize {
+			oldest := c.order.Front()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).eventID)
+			c.evicted++
+		}
+		c.entries[eventID] = c.order.PushBack(&cacheEntry{eventID: eventID, timestamp: now, ttl: ttls[i]})
+	}
+	return added
+}
+
+// contains reports whether eventID was added and has not expired. A hit marks the entry as
+// recently used so duplicates that keep arriving are the last to be evicted; its TTL still
+// counts from when it was added.
+func (c *dedupCache) contains(eventID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[eventID]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Since(entry.timestamp) > entry.ttl {
+		return false
+	}
+	c.order.MoveToBack(elem)
+	return true
+}
+
+// remove forgets eventID
+func (c *dedupCache) remove(eventID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[eventID]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, eventID)
+	}
+}
+
+// expire drops the entries whose TTL passed and returns how many. TTLs differ per kind, so an
+// expired entry may sit behind a live one and the whole list is walked.
+func (c *dedupCache) expire(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*cacheEntry)
+		if now.Sub(entry.timestamp) > entry.ttl {
+			c.order.Remove(elem)
+			delete(c.entries, entry.eventID)
+			removed++
+		}
+		elem = next
+	}
+	return removed
+}
+
+// size returns the number of entries and how many were evicted so far
+func (c *dedupCache) size() (int, int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.order.Len(), c.evicted
+}
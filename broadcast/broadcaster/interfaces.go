@@ -0,0 +1,64 @@
+package broadcaster
+
+import (
+	"context"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RelayProvider provides relay URLs for broadcasting
+type RelayProvider interface {
+	GetBroadcastRelays(ctx context.Context) ([]string, error)
+}
+
+// SizedRelayProvider can return a relay set of a given size instead of its default top N
+type SizedRelayProvider interface {
+	GetBroadcastRelaysN(ctx context.Context, n int) ([]string, error)
+}
+
+// PublishResultTracker tracks results of publish operations
+type PublishResultTracker interface {
+	TrackPublishResult(ctx context.Context, url string, success bool, responseTime time.Duration, err error) error
+}
+
+// LateResultTracker is a PublishResultTracker that can turn a timed-out publish into a success
+// once the relay's OK arrives late
+type LateResultTracker interface {
+	TrackLateSuccess(ctx context.Context, url string, responseTime time.Duration) error
+}
+
+// CoverageTracker is a PublishResultTracker that records publishes answered with "duplicate:",
+// which are neither successes nor failures of the relay
+type CoverageTracker interface {
+	TrackDuplicate(ctx context.Context, url string, responseTime time.Duration) error
+}
+
+// BroadcastReporter is notified before an event is published (write-ahead) and once all
+// relay publishes for it have finished
+type BroadcastReporter interface {
+	BroadcastPlanned(event *nostr.Event, relays []string)
+	BroadcastCompleted(report BroadcastReport)
+}
+
+// DeliveryCorrector is a BroadcastReporter that amends a completed report when a relay that
+// timed out confirms the event late; result carries the delay since the event was written
+type DeliveryCorrector interface {
+	DeliveryCorrected(eventID string, result RelayResult)
+}
+
+// RelayFilter narrows the relay set chosen for one event (e.g. routing or abuse policy)
+type RelayFilter interface {
+	FilterRelays(event *nostr.Event, relays []string) []string
+}
+
+// PlanFilter is a RelayFilter that can also narrow the relay set without side effects (no
+// counters, no held events), for dry-run plans
+type PlanFilter interface {
+	PlanRelays(event *nostr.Event, relays []string) []string
+}
+
+// Publisher delivers a pre-serialized EVENT frame to one relay and waits for its OK
+type Publisher interface {
+	Publish(ctx context.Context, url string, eventID string, frame []byte) error
+}
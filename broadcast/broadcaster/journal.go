@@ -0,0 +1,112 @@
+package broadcaster
+
+import (
+	"errors"
+	"os"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/persist"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// journalEntry is one event still queued at shutdown
+type journalEntry struct {
+	Event  *nostr.Event `json:"event"`
+	TopN   int          `json:"top_n,omitempty"`  // fan-out override (0 = top N)
+	Ingest bool         `json:"ingest,omitempty"` // queued in the ingest lane
+}
+
+// SetJournal makes Stop save the events still queued (channel, overflow queue and ingest lane) to
+// path, and Start queue them again and remove the file, so a restart during a burst does not lose
+// them. Must be called before Start.
+func (b *Broadcaster) SetJournal(path string) {
+	b.journal = path
+	logging.Info("Broadcaster: Events queued at shutdown are journaled to %s", path)
+}
+
+// loadJournal queues the events saved by the last Stop and removes the journal
+func (b *Broadcaster) loadJournal() {
+	var entries []journalEntry
+	found, err := persist.ReadJSON(b.journal, &entries)
+	if err != nil {
+		logging.Error("Broadcaster: Cannot read queue journal %s, leaving it in place: %v", b.journal, err)
+		return
+	}
+	if !found {
+		return
+	}
+	live, ingest := 0, 0
+	for _, entry := range entries {
+		if entry.Event == nil {
+			continue
+		}
+		if entry.Ingest {
+			if b.BroadcastIngest(entry.Event) {
+				ingest++
+			}
+			continue
+		}
+		b.BroadcastWithFanout(entry.Event, entry.TopN)
+		live++
+	}
+	if err := os.Remove(b.journal); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.Warn("Broadcaster: Cannot remove queue journal %s, its events may be queued again: %v", b.journal, err)
+	}
+	logging.Info("Broadcaster: Requeued %d live and %d ingest events from %s", live, ingest, b.journal)
+}
+
+// hold puts an event a worker took but did not broadcast (it was stopped while paused) back on
+// the overflow queue, so the journal keeps it
+func (b *Broadcaster) hold(event *nostr.Event) {
+	b.overflowMutex.Lock()
+	defer b.overflowMutex.Unlock()
+	b.overflowQueue = append([]*nostr.Event{event}, b.overflowQueue...)
+	b.overflowBytes += eventSize(event)
+}
+
+// saveJournal writes the events left in the queues to the journal. The workers must have stopped
+// and eventQueue must be closed.
+func (b *Broadcaster) saveJournal() {
+	var entries []journalEntry
+	add := func(event *nostr.Event, ingest bool) {
+		entry := journalEntry{Event: event, Ingest: ingest}
+		if topN, ok := b.fanout.Load(event.ID); ok {
+			entry.TopN = topN.(int)
+		}
+		entries = append(entries, entry)
+	}
+
+	b.overflowMutex.Lock()
+	overflow := b.overflowQueue
+	b.overflowQueue = nil
+	b.overflowBytes = 0
+	b.overflowMutex.Unlock()
+	// Channel events were queued before the overflow ones
+	for event := range b.eventQueue {
+		add(event, false)
+	}
+	for _, event := range overflow {
+		add(event, false)
+	}
+
+	b.lanes.mu.Lock()
+	ingest := b.lanes.queue
+	b.lanes.queue = nil
+	b.lanes.mu.Unlock()
+	for _, event := range ingest {
+		add(event, true)
+	}
+
+	if len(entries) == 0 {
+		if err := os.Remove(b.journal); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logging.Warn("Broadcaster: Cannot remove queue journal %s: %v", b.journal, err)
+		}
+		return
+	}
+	if err := persist.WriteJSON(b.journal, entries); err != nil {
+		logging.Error("Broadcaster: Failed to journal %d queued events to %s, they are lost: %v", len(entries), b.journal, err)
+		return
+	}
+	logging.Info("Broadcaster: Journaled %d queued events (%d live, %d ingest) to %s",
+		len(entries), len(entries)-len(ingest), len(ingest), b.journal)
+}
@@ -0,0 +1,188 @@
+package broadcaster
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// defaultLiveWeight is how many live events are dispatched per ingest event while both lanes wait
+	defaultLiveWeight = 4
+	// defaultIngestQueue bounds the ingest lane
+	defaultIngestQueue = 10000
+	// replayYieldMax is the longest a replayed publish waits for the live lane to drain
+	replayYieldMax = time.Second
+)
+
+// ingestLane holds events fed in by bulk sources (pull mode, mirror) apart from the live lane of
+// client publishes (eventQueue plus overflow). Workers drain both, taking weight live events per
+// ingest event while both have work, so a bulk source cannot starve clients nor be starved.
+type ingestLane struct {
+	weight    int
+	maxQueued int
+	wake      chan struct{} // signaled on every ingest push, so idle workers notice
+
+	mu         sync.Mutex
+	queue      []*nostr.Event
+	peak       int
+	liveStreak int // live events dispatched since the last ingest event
+
+	liveTaken    int64
+	ingestTaken  int64
+	dropped      int64
+	replayed     int64
+	replayYields int64
+}
+
+func newIngestLane(wakeCapacity int) ingestLane {
+	return ingestLane{
+		weight:    defaultLiveWeight,
+		maxQueued: defaultIngestQueue,
+		wake:      make(chan struct{}, wakeCapacity),
+	}
+}
+
+// SetLanes sets how many live events are dispatched per ingest event while both lanes have work,
+// and how many events the ingest lane holds before new ones are dropped. Must be called before Start.
+func (b *Broadcaster) SetLanes(liveWeight, ingestQueue int) {
+	if liveWeight > 0 {
+		b.lanes.weight = liveWeight
+	}
+	if ingestQueue > 0 {
+		b.lanes.maxQueued = ingestQueue
+	}
+	logging.Info("Broadcaster: Ingest lane holds %d events, %d live events dispatched per ingest event",
+		b.lanes.maxQueued, b.lanes.weight)
+}
+
+// BroadcastIngest queues an event from a bulk source (pull mode, mirror) in the ingest lane.
+// Returns false if the lane is full and the event was dropped.
+func (b *Broadcaster) BroadcastIngest(event *nostr.Event) bool {
+	if b.ctx.Err() != nil {
+		logging.Warn("Broadcaster: Cannot queue event %s, broadcaster is shutting down", event.ID)
+		return false
+	}
+
+	l := &b.lanes
+	l.mu.Lock()
+	if len(l.queue) >= l.maxQueued {
+		l.dropped++
+		l.mu.Unlock()
+		logging.DebugMethod("broadcaster", "BroadcastIngest", "Ingest lane full (%d), dropping event %s", l.maxQueued, event.ID)
+		return false
+	}
+	b.addEventToCache(event.ID, event.Kind)
+	b.queuedAt.Store(event.ID, time.Now())
+	l.queue = append(l.queue, event)
+	l.peak = max(l.peak, len(l.queue))
+	l.mu.Unlock()
+
+	atomic.AddInt64(&b.totalQueued, 1)
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// nextEvent takes the next event without blocking: from the ingest lane once the live lane had
+// its weight turns in a row, from the live lane otherwise, from whichever has one if the other
+// is empty. Returns nil if both are empty.
+func (b *Broadcaster) nextEvent() *nostr.Event {
+	l := &b.lanes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) > 0 && l.liveStreak >= l.weight {
+		return l.popLocked()
+	}
+	select {
+	case event, ok := <-b.eventQueue:
+		if ok {
+			l.liveStreak++
+			l.liveTaken++
+			return event
+		}
+	default:
+	}
+	if len(l.queue) > 0 {
+		return l.popLocked()
+	}
+	return nil
+}
+
+func (l *ingestLane) popLocked() *nostr.Event {
+	event := l.queue[0]
+	l.queue[0] = nil
+	l.queue = l.queue[1:]
+	l.liveStreak = 0
+	l.ingestTaken++
+	return event
+}
+
+// tookLive counts a live event a worker received while blocked
+func (l *ingestLane) tookLive() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.liveStreak++
+	l.liveTaken++
+}
+
+// yieldToLive holds a replayed publish back (up to replayYieldMax) while client events are
+// waiting, so a backfill does not take outbound slots from live traffic
+func (b *Broadcaster) yieldToLive() {
+	atomic.AddInt64(&b.lanes.replayed, 1)
+	if len(b.eventQueue) == 0 {
+		return
+	}
+	atomic.AddInt64(&b.lanes.replayYields, 1)
+	deadline := time.Now().Add(replayYieldMax)
+	for len(b.eventQueue) > 0 && time.Now().Before(deadline) && b.ctx.Err() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (b *Broadcaster) resetLaneCounters() {
+	l := &b.lanes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peak = len(l.queue)
+	l.liveTaken, l.ingestTaken, l.dropped = 0, 0, 0
+	atomic.StoreInt64(&l.replayed, 0)
+	atomic.StoreInt64(&l.replayYields, 0)
+}
+
+func (b *Broadcaster) laneStats() json.JsonEntity {
+	l := &b.lanes
+	l.mu.Lock()
+	queued, peak := len(l.queue), l.peak
+	liveTaken, ingestTaken, dropped := l.liveTaken, l.ingestTaken, l.dropped
+	l.mu.Unlock()
+
+	live := json.NewJsonObject()
+	live.Set("weight", json.NewJsonValue(l.weight))
+	live.Set("queued", json.NewJsonValue(len(b.eventQueue)))
+	live.Set("dispatched", json.NewJsonValue(liveTaken))
+
+	ingest := json.NewJsonObject()
+	ingest.Set("weight", json.NewJsonValue(1))
+	ingest.Set("queued", json.NewJsonValue(queued))
+	ingest.Set("capacity", json.NewJsonValue(l.maxQueued))
+	ingest.Set("peak", json.NewJsonValue(peak))
+	ingest.Set("dispatched", json.NewJsonValue(ingestTaken))
+	ingest.Set("dropped", json.NewJsonValue(dropped))
+
+	replay := json.NewJsonObject()
+	replay.Set("published", json.NewJsonValue(atomic.LoadInt64(&l.replayed)))
+	replay.Set("yields", json.NewJsonValue(atomic.LoadInt64(&l.replayYields)))
+
+	obj := json.NewJsonObject()
+	obj.Set("live", live)
+	obj.Set("ingest", ingest)
+	obj.Set("replay", replay)
+	return obj
+}
@@ -0,0 +1,160 @@
+package broadcaster
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	defaultRealtimeRelays = 5
+	defaultRealtimeQueue  = 1000
+)
+
+// RealtimeConfig sets up the fast path for near-real-time kinds (e.g. NIP-38 user statuses,
+// kind 30315): they skip the dedup cache and the regular queues, are taken by workers before
+// anything else and go only to the fastest relays of the top N (plus mandatory relays). A status
+// is superseded within minutes, so being first matters more than reaching every relay.
+type RealtimeConfig struct {
+	Kinds  []int
+	Relays int // fastest relays of the top N targeted (default 5)
+	Queue  int // events waiting in the fast path before new ones are dropped (default 1000)
+	// Latency returns a relay's average response time, false if unknown (unknown relays rank last)
+	Latency func(url string) (time.Duration, bool)
+}
+
+// realtimeLane is the queue and counters of the fast path
+type realtimeLane struct {
+	kinds   map[int]bool
+	relays  int
+	latency func(url string) (time.Duration, bool)
+	queue   chan *nostr.Event // nil when disabled: never ready in the workers' select
+
+	queued     int64
+	dropped    int64
+	dispatched int64
+}
+
+// SetRealtime enables the fast path for cfg.Kinds. Must be called before Start.
+func (b *Broadcaster) SetRealtime(cfg RealtimeConfig) {
+	if len(cfg.Kinds) == 0 {
+		return
+	}
+	if cfg.Relays <= 0 {
+		cfg.Relays = defaultRealtimeRelays
+	}
+	if cfg.Queue <= 0 {
+		cfg.Queue = defaultRealtimeQueue
+	}
+	kinds := make(map[int]bool, len(cfg.Kinds))
+	for _, kind := range cfg.Kinds {
+		kinds[kind] = true
+	}
+	b.realtime = realtimeLane{
+		kinds:   kinds,
+		relays:  cfg.Relays,
+		latency: cfg.Latency,
+		queue:   make(chan *nostr.Event, cfg.Queue),
+	}
+	logging.Info("Broadcaster: Fast path for kinds %v to the %d fastest relays (queue %d)", cfg.Kinds, cfg.Relays, cfg.Queue)
+}
+
+func (b *Broadcaster) isRealtime(kind int) bool {
+	return b.realtime.kinds[kind]
+}
+
+// broadcastRealtime queues a fast-path event without touching the dedup cache. Returns false if
+// the fast path is full and the event was dropped.
+func (b *Broadcaster) broadcastRealtime(event *nostr.Event) bool {
+	b.queuedAt.Store(event.ID, time.Now())
+	select {
+	case b.realtime.queue <- event:
+		atomic.AddInt64(&b.realtime.queued, 1)
+		atomic.AddInt64(&b.totalQueued, 1)
+		logging.DebugMethod("broadcaster", "broadcastRealtime", "Event %s (kind %d) queued to the fast path", event.ID, event.Kind)
+		return true
+	default:
+		b.queuedAt.Delete(event.ID)
+		b.fanout.Delete(event.ID)
+		atomic.AddInt64(&b.realtime.dropped, 1)
+		logging.DebugMethod("broadcaster", "broadcastRealtime", "Fast path full, dropping event %s (kind %d)", event.ID, event.Kind)
+		return false
+	}
+}
+
+// nextRealtime takes a fast-path event without blocking, nil if there is none
+func (b *Broadcaster) nextRealtime() *nostr.Event {
+	select {
+	case event := <-b.realtime.queue:
+		atomic.AddInt64(&b.realtime.dispatched, 1)
+		return event
+	default:
+		return nil
+	}
+}
+
+// fastestRelays keeps the realtime.relays relays of urls with the lowest average response time
+func (b *Broadcaster) fastestRelays(urls []string) []string {
+	if len(urls) <= b.realtime.relays || b.realtime.latency == nil {
+		if len(urls) > b.realtime.relays {
+			urls = urls[:b.realtime.relays]
+		}
+		return urls
+	}
+	type ranked struct {
+		url     string
+		latency time.Duration
+		known   bool
+	}
+	relays := make([]ranked, len(urls))
+	for i, url := range urls {
+		latency, known := b.realtime.latency(url)
+		relays[i] = ranked{url: url, latency: latency, known: known}
+	}
+	sort.SliceStable(relays, func(i, j int) bool {
+		if relays[i].known != relays[j].known {
+			return relays[i].known
+		}
+		return relays[i].latency < relays[j].latency
+	})
+	fastest := make([]string, b.realtime.relays)
+	for i := range fastest {
+		fastest[i] = relays[i].url
+	}
+	return fastest
+}
+
+func (b *Broadcaster) resetRealtimeCounters() {
+	atomic.StoreInt64(&b.realtime.queued, 0)
+	atomic.StoreInt64(&b.realtime.dropped, 0)
+	atomic.StoreInt64(&b.realtime.dispatched, 0)
+}
+
+func (b *Broadcaster) realtimeStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("enabled", json.NewJsonValue(b.realtime.queue != nil))
+	if b.realtime.queue == nil {
+		return obj
+	}
+	kinds := make([]int, 0, len(b.realtime.kinds))
+	for kind := range b.realtime.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Ints(kinds)
+	kindList := json.NewJsonList()
+	for _, kind := range kinds {
+		kindList.Append(json.NewJsonValue(kind))
+	}
+	obj.Set("kinds", kindList)
+	obj.Set("relays", json.NewJsonValue(b.realtime.relays))
+	obj.Set("waiting", json.NewJsonValue(len(b.realtime.queue)))
+	obj.Set("capacity", json.NewJsonValue(cap(b.realtime.queue)))
+	obj.Set("queued", json.NewJsonValue(atomic.LoadInt64(&b.realtime.queued)))
+	obj.Set("dispatched", json.NewJsonValue(atomic.LoadInt64(&b.realtime.dispatched)))
+	obj.Set("dropped", json.NewJsonValue(atomic.LoadInt64(&b.realtime.dropped)))
+	return obj
+}
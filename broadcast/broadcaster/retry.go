@@ -0,0 +1,180 @@
+package broadcaster
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/netdiag"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxDeadLetterRelays bounds the per-relay dead-letter counters shown in the stats
+const maxDeadLetterRelays = 50
+
+// RetryPolicy re-publishes events whose publish failed transiently (timeouts, dropped or refused
+// connections) up to MaxAttempts times in total, waiting BaseDelay, 2x, 4x... (capped at
+// MaxDelay, with jitter) in between. Rejections and throttling are not retried.
+type RetryPolicy struct {
+	MaxAttempts int           // publishes per relay and event, first one included (<= 1 = no retries)
+	BaseDelay   time.Duration // wait before the first retry (default 1s)
+	MaxDelay    time.Duration // cap of the exponential wait (default 30s)
+}
+
+// retryState holds the retry policy and counters
+type retryState struct {
+	policy RetryPolicy
+
+	retries      int64 // re-publishes made
+	recovered    int64 // publishes that succeeded on a retry
+	deadLettered int64 // publishes that failed transiently on every attempt
+
+	mu          sync.Mutex
+	deadLetters map[string]*deadLetter // relay URL -> its exhausted publishes
+}
+
+// deadLetter counts one relay's publishes that ran out of attempts
+type deadLetter struct {
+	count     int64
+	lastEvent string
+	lastError string
+	lastAt    time.Time
+}
+
+// SetRetryPolicy enables retries of transiently failed publishes. Must be called before Start.
+func (b *Broadcaster) SetRetryPolicy(policy RetryPolicy) {
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = time.Second
+	}
+	if policy.MaxDelay < policy.BaseDelay {
+		policy.MaxDelay = max(30*time.Second, policy.BaseDelay)
+	}
+	b.retry.policy = policy
+	b.retry.deadLetters = make(map[string]*deadLetter)
+}
+
+// retryable reports whether a failed publish may succeed if simply tried again: timeouts and
+// connections that dropped or were refused, but not relay answers (OK false), throttling, DNS or
+// TLS failures, local saturation or an exhausted event deadline
+func retryable(errMsg string) bool {
+	if localFailure(errMsg) {
+		return false
+	}
+	if strings.Contains(errMsg, "context deadline exceeded") {
+		return true
+	}
+	switch netdiag.Classify(errors.New(errMsg)) {
+	case netdiag.ClassTimeout, netdiag.ClassTCP, netdiag.ClassOther:
+		return true
+	case netdiag.ClassProtocol:
+		return !strings.HasPrefix(errMsg, "msg:")
+	}
+	return false
+}
+
+// retryDelay is the wait before retry n (1-based): exponential, capped, with +-50% jitter
+func (p RetryPolicy) retryDelay(n int) time.Duration {
+	delay := p.BaseDelay << (n - 1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	return delay/2 + rand.N(delay)
+}
+
+// publishWithRetry publishes to url, retrying transient failures per the retry policy as long as
+// the event's deadline (if any) leaves room for another attempt
+func (b *Broadcaster) publishWithRetry(url string, event *nostr.Event, frame []byte, deadline time.Time) RelayResult {
+	result := b.publishToRelay(url, event, frame, deadline)
+	result.Attempts = 1
+	policy := b.retry.policy
+	if result.Success || policy.MaxAttempts <= 1 || !retryable(result.Error) {
+		return result
+	}
+
+	for result.Attempts < policy.MaxAttempts {
+		delay := policy.retryDelay(result.Attempts)
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			break
+		}
+		select {
+		case <-b.ctx.Done():
+			return result
+		case <-time.After(delay):
+		}
+
+		atomic.AddInt64(&b.retry.retries, 1)
+		logging.DebugMethod("broadcaster", "publishWithRetry", "Retrying event %s on %s (attempt %d/%d) after %v: %s",
+			event.ID, url, result.Attempts+1, policy.MaxAttempts, delay, result.Error)
+		attempts := result.Attempts + 1
+		result = b.publishToRelay(url, event, frame, deadline)
+		result.Attempts = attempts
+		if result.Success {
+			atomic.AddInt64(&b.retry.recovered, 1)
+			return result
+		}
+		if !retryable(result.Error) {
+			return result
+		}
+	}
+
+	b.deadLetter(url, event.ID, result.Error)
+	return result
+}
+
+// deadLetter records a publish that failed on every attempt
+func (b *Broadcaster) deadLetter(url, eventID, errMsg string) {
+	atomic.AddInt64(&b.retry.deadLettered, 1)
+	b.retry.mu.Lock()
+	defer b.retry.mu.Unlock()
+	dl, ok := b.retry.deadLetters[url]
+	if !ok {
+		dl = &deadLetter{}
+		b.retry.deadLetters[url] = dl
+	}
+	dl.count++
+	dl.lastEvent, dl.lastError, dl.lastAt = eventID, errMsg, time.Now()
+	logging.DebugMethod("broadcaster", "deadLetter", "Giving up on event %s for %s after %d attempts: %s",
+		eventID, url, b.retry.policy.MaxAttempts, errMsg)
+}
+
+func (b *Broadcaster) retryStats() json.JsonEntity {
+	b.retry.mu.Lock()
+	urls := make([]string, 0, len(b.retry.deadLetters))
+	for url := range b.retry.deadLetters {
+		urls = append(urls, url)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		return b.retry.deadLetters[urls[i]].count > b.retry.deadLetters[urls[j]].count
+	})
+	if len(urls) > maxDeadLetterRelays {
+		urls = urls[:maxDeadLetterRelays]
+	}
+	relays := json.NewJsonList()
+	for _, url := range urls {
+		dl := b.retry.deadLetters[url]
+		entry := json.NewJsonObject()
+		entry.Set("url", json.NewJsonValue(url))
+		entry.Set("dead_lettered", json.NewJsonValue(dl.count))
+		entry.Set("last_event", json.NewJsonValue(dl.lastEvent))
+		entry.Set("last_error", json.NewJsonValue(dl.lastError))
+		entry.Set("last_at", json.NewJsonValue(dl.lastAt.Format(time.RFC3339)))
+		relays.Append(entry)
+	}
+	b.retry.mu.Unlock()
+
+	retryObj := json.NewJsonObject()
+	retryObj.Set("max_attempts", json.NewJsonValue(max(b.retry.policy.MaxAttempts, 1)))
+	retryObj.Set("base_delay_ms", json.NewJsonValue(b.retry.policy.BaseDelay.Milliseconds()))
+	retryObj.Set("max_delay_ms", json.NewJsonValue(b.retry.policy.MaxDelay.Milliseconds()))
+	retryObj.Set("retries", json.NewJsonValue(atomic.LoadInt64(&b.retry.retries)))
+	retryObj.Set("recovered", json.NewJsonValue(atomic.LoadInt64(&b.retry.recovered)))
+	retryObj.Set("dead_lettered", json.NewJsonValue(atomic.LoadInt64(&b.retry.deadLettered)))
+	retryObj.Set("dead_letters", relays)
+	return retryObj
+}
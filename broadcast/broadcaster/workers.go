@@ -0,0 +1,127 @@
+package broadcaster
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// maxWorkers bounds the worker pool, whatever SetWorkers is asked for
+const maxWorkers = 4096
+
+// Load is the worker pool's load since the previous Load call
+type Load struct {
+	Workers     int
+	Utilization float64       // events with publishes in flight per worker (0..1)
+	QueueWait   time.Duration // mean time events waited in the queue
+	MaxWait     time.Duration
+	Events      int64 // events dequeued
+	QueueDepth  int64
+	Paused      bool
+}
+
+// loadCounters accumulate what Load reports
+type loadCounters struct {
+	mu      sync.Mutex
+	since   time.Time
+	busy    time.Duration // event time with relay publishes in flight, summed over events
+	active  int64         // events with relay publishes in flight
+	mark    time.Time     // when busy was last brought up to date
+	events  int64
+	waitSum time.Duration
+	waitMax time.Duration
+}
+
+// publishing adds delta to the events with publishes in flight. Publishing is network wait, so a
+// worker's load is its event's publishes, not the dispatch it returns from right away.
+func (l *loadCounters) publishing(delta int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advanceLocked(time.Now())
+	l.active += delta
+}
+
+// advanceLocked adds the in-flight time up to now to busy; mu must be held
+func (l *loadCounters) advanceLocked(now time.Time) {
+	if !l.mark.IsZero() {
+		l.busy += time.Duration(l.active) * now.Sub(l.mark)
+	}
+	l.mark = now
+}
+
+func (l *loadCounters) waited(wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events++
+	l.waitSum += wait
+	if wait > l.waitMax {
+		l.waitMax = wait
+	}
+}
+
+// Workers returns the target size of the worker pool
+func (b *Broadcaster) Workers() int {
+	return int(atomic.LoadInt64(&b.workerCount))
+}
+
+// SetWorkers resizes the worker pool to n (at least 1). New workers start right away; surplus
+// workers exit once they are idle, so no broadcast is interrupted.
+func (b *Broadcaster) SetWorkers(n int) {
+	n = min(max(n, 1), maxWorkers)
+	b.workersMu.Lock()
+	defer b.workersMu.Unlock()
+
+	current := b.Workers()
+	for ; current < n; current++ {
+		select {
+		case <-b.retire:
+			// A worker told to retire has not yet: keep it instead
+		default:
+			b.startWorkerLocked()
+		}
+	}
+	for ; current > n; current-- {
+		b.retire <- struct{}{}
+	}
+	if old := b.Workers(); old != n {
+		atomic.StoreInt64(&b.workerCount, int64(n))
+		logging.Info("Broadcaster: Worker pool resized from %d to %d workers", old, n)
+	}
+}
+
+// startWorkerLocked starts one worker; workersMu must be held
+func (b *Broadcaster) startWorkerLocked() {
+	b.wg.Add(1)
+	go b.worker(b.nextWorkerID)
+	b.nextWorkerID++
+}
+
+// Load returns the pool's load since the previous call and starts a new measurement
+func (b *Broadcaster) Load() Load {
+	l := &b.load
+	l.mu.Lock()
+	now := time.Now()
+	elapsed := now.Sub(l.since)
+	l.advanceLocked(now)
+	events, waitSum, waitMax, busy := l.events, l.waitSum, l.waitMax, l.busy
+	l.since, l.events, l.waitSum, l.waitMax, l.busy = now, 0, 0, 0, 0
+	l.mu.Unlock()
+
+	workers := b.Workers()
+	load := Load{
+		Workers:    workers,
+		Events:     events,
+		MaxWait:    waitMax,
+		QueueDepth: b.QueueDepth(),
+	}
+	load.Paused, _, _ = b.PauseState()
+	if events > 0 {
+		load.QueueWait = waitSum / time.Duration(events)
+	}
+	if capacity := elapsed * time.Duration(workers); capacity > 0 {
+		load.Utilization = min(float64(busy)/float64(capacity), 1)
+	}
+	return load
+}
@@ -0,0 +1,159 @@
+// Package budget shares a concurrency budget for outbound relay connections between live
+// broadcast traffic and background work (health probes during discovery refresh). Publishes
+// always have priority: probes only start while no publish is waiting and some headroom is
+// left, so a heavy refresh cannot starve broadcasts of sockets and bandwidth.
+package budget
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Priority of a budget slot
+type Priority int
+
+const (
+	Publish Priority = iota // live broadcast traffic
+	Probe                   // background health probes; yield to Publish
+)
+
+// Budget is a priority-aware counting semaphore. A nil *Budget never blocks.
+type Budget struct {
+	capacity   int
+	probeLimit int
+	headroom   int // slots probes leave free for publishes
+
+	mu             sync.Mutex
+	publishInUse   int
+	probeInUse     int
+	publishWaiting int
+	changed        chan struct{} // closed and replaced on every release
+
+	publishWaits   int64
+	probeDeferrals int64
+}
+
+// New returns a Budget of capacity slots, of which probes may hold at most probeLimit
+func New(capacity, probeLimit int) *Budget {
+	if probeLimit <= 0 || probeLimit > capacity {
+		probeLimit = capacity / 4
+	}
+	if probeLimit < 1 {
+		probeLimit = 1
+	}
+	logging.DebugMethod("budget", "New", "Initializing outbound budget: capacity=%d, probes=%d", capacity, probeLimit)
+	return &Budget{
+		capacity:   capacity,
+		probeLimit: probeLimit,
+		headroom:   capacity / 4,
+		changed:    make(chan struct{}),
+	}
+}
+
+// canAcquireLocked reports whether a slot of priority p is available now
+func (b *Budget) canAcquireLocked(p Priority) bool {
+	inUse := b.publishInUse + b.probeInUse
+	if p == Publish {
+		return inUse < b.capacity
+	}
+	return b.publishWaiting == 0 && b.probeInUse < b.probeLimit && inUse < b.capacity-b.headroom
+}
+
+// Acquire blocks until a slot of priority p is free or ctx is done
+func (b *Budget) Acquire(ctx context.Context, p Priority) error {
+	if b == nil {
+		return nil
+	}
+
+	waited := false
+	for {
+		b.mu.Lock()
+		if b.canAcquireLocked(p) {
+			if p == Publish {
+				b.publishInUse++
+			} else {
+				b.probeInUse++
+			}
+			b.mu.Unlock()
+			return nil
+		}
+		if !waited {
+			waited = true
+			if p == Publish {
+				atomic.AddInt64(&b.publishWaits, 1)
+			} else {
+				atomic.AddInt64(&b.probeDeferrals, 1)
+			}
+		}
+		if p == Publish {
+			b.publishWaiting++
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		var err error
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if p == Publish {
+			b.mu.Lock()
+			b.publishWaiting--
+			if b.publishWaiting == 0 {
+				b.notifyLocked() // waiting probes may proceed now
+			}
+			b.mu.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Release returns a slot of priority p
+func (b *Budget) Release(p Priority) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p == Publish {
+		b.publishInUse--
+	} else {
+		b.probeInUse--
+	}
+	b.notifyLocked()
+}
+
+func (b *Budget) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// GetStatsName returns the name for this stats provider
+func (b *Budget) GetStatsName() string {
+	return "outbound_budget"
+}
+
+// GetStats returns budget usage as a JsonEntity
+func (b *Budget) GetStats() json.JsonEntity {
+	b.mu.Lock()
+	publishInUse, probeInUse, publishWaiting := b.publishInUse, b.probeInUse, b.publishWaiting
+	b.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("capacity", json.NewJsonValue(b.capacity))
+	obj.Set("probe_limit", json.NewJsonValue(b.probeLimit))
+	obj.Set("publish_in_use", json.NewJsonValue(publishInUse))
+	obj.Set("probe_in_use", json.NewJsonValue(probeInUse))
+	obj.Set("publish_waiting", json.NewJsonValue(publishWaiting))
+	obj.Set("publish_waits", json.NewJsonValue(atomic.LoadInt64(&b.publishWaits)))
+	obj.Set("probe_deferrals", json.NewJsonValue(atomic.LoadInt64(&b.probeDeferrals)))
+	return obj
+}
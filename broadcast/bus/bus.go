@@ -0,0 +1,191 @@
+// Package bus fans out relay health-check and publish results to in-process subscribers
+// (alerting, dashboards, exporters), so they can react to relay state changes without
+// polling the manager. Subscribers get either a buffered channel or a callback.
+package bus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Type of a bus event
+type Type int
+
+const (
+	HealthCheck   Type = iota // a probe connected to (or failed to reach) a relay
+	PublishResult             // a relay answered (or failed) one publish
+	RelayUp                   // a relay succeeded after its previous result failed (or on its first result)
+	RelayDown                 // a relay failed after its previous result succeeded (or on its first result)
+	Handshake                 // a publish connection to a relay was opened (or failed to open)
+)
+
+func (t Type) String() string {
+	switch t {
+	case HealthCheck:
+		return "health_check"
+	case PublishResult:
+		return "publish_result"
+	case RelayUp:
+		return "relay_up"
+	case RelayDown:
+		return "relay_down"
+	case Handshake:
+		return "handshake"
+	}
+	return "unknown"
+}
+
+// Event is one result or state change of a relay
+type Event struct {
+	Type         Type
+	URL          string
+	Success      bool
+	ResponseTime time.Duration
+	Err          error // nil on success
+	At           time.Time
+}
+
+// subscriber receives events on ch; events are dropped (not queued) when ch is full
+type subscriber struct {
+	ch chan Event
+}
+
+// Bus delivers events to subscribers. A nil *Bus discards everything.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers map[*subscriber]struct{}
+	callbacks   []func(Event)
+
+	stateMu sync.Mutex
+	up      map[string]bool // last known outcome per relay
+
+	published   int64
+	transitions int64
+	dropped     int64
+}
+
+// New returns an empty Bus
+func New() *Bus {
+	return &Bus{
+		subscribers: make(map[*subscriber]struct{}),
+		up:          make(map[string]bool),
+	}
+}
+
+// Subscribe returns a channel of events buffered to buffer entries and a function that
+// unsubscribes and closes it. A subscriber that falls behind loses events instead of
+// slowing down publishing.
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = 100
+	}
+	sub := &subscriber{ch: make(chan Event, buffer)}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// OnEvent registers fn to be called for every event. fn runs on the publishing goroutine
+// (a health probe or relay publish), so it must return quickly.
+func (b *Bus) OnEvent(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.callbacks = append(b.callbacks, fn)
+}
+
+// Report publishes a health-check or publish result and, if the relay's outcome flipped,
+// a RelayUp or RelayDown event
+func (b *Bus) Report(t Type, url string, success bool, responseTime time.Duration, err error) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	b.publish(Event{Type: t, URL: url, Success: success, ResponseTime: responseTime, Err: err, At: now})
+
+	b.stateMu.Lock()
+	previous, known := b.up[url]
+	b.up[url] = success
+	b.stateMu.Unlock()
+	if known && previous == success {
+		return
+	}
+
+	atomic.AddInt64(&b.transitions, 1)
+	change := Event{Type: RelayDown, URL: url, Success: success, ResponseTime: responseTime, Err: err, At: now}
+	if success {
+		change.Type = RelayUp
+	}
+	logging.DebugMethod("bus", "Report", "%s is now %s", url, change.Type)
+	b.publish(change)
+}
+
+// ReportHandshake publishes the outcome of opening a publish connection. Handshakes don't move
+// a relay up or down: the publish on the connection is what counts.
+func (b *Bus) ReportHandshake(url string, elapsed time.Duration, err error) {
+	if b == nil {
+		return
+	}
+	b.publish(Event{Type: Handshake, URL: url, Success: err == nil, ResponseTime: elapsed, Err: err, At: time.Now()})
+}
+
+func (b *Bus) publish(e Event) {
+	atomic.AddInt64(&b.published, 1)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddInt64(&b.dropped, 1)
+		}
+	}
+	for _, fn := range b.callbacks {
+		fn(e)
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (b *Bus) GetStatsName() string {
+	return "bus"
+}
+
+// GetStats returns bus statistics as a JsonEntity
+func (b *Bus) GetStats() json.JsonEntity {
+	b.mu.RLock()
+	subscribers, callbacks := len(b.subscribers), len(b.callbacks)
+	b.mu.RUnlock()
+
+	b.stateMu.Lock()
+	down := 0
+	for _, up := range b.up {
+		if !up {
+			down++
+		}
+	}
+	b.stateMu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("subscribers", json.NewJsonValue(subscribers))
+	obj.Set("callbacks", json.NewJsonValue(callbacks))
+	obj.Set("published", json.NewJsonValue(atomic.LoadInt64(&b.published)))
+	obj.Set("state_changes", json.NewJsonValue(atomic.LoadInt64(&b.transitions)))
+	obj.Set("relays_down", json.NewJsonValue(down))
+	obj.Set("dropped", json.NewJsonValue(atomic.LoadInt64(&b.dropped)))
+	return obj
+}
@@ -0,0 +1,81 @@
+package broadcast
+
+import (
+	"context"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/lifecycle"
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+const (
+	// maxHealthChecks caps the relays re-checked in one round of the health loop
+	maxHealthChecks = 200
+	// healthBatch is how many of them are checked at once
+	healthBatch = 20
+)
+
+// Components returns the background loops of the broadcast system, for the supervisor to start
+// after Start and stop before Stop, so none of them outlives the broadcaster
+func (bs *BroadcastSystem) Components() []lifecycle.Component {
+	var components []lifecycle.Component
+	if bs.healthInterval > 0 && bs.testSink == nil {
+		components = append(components, lifecycle.Loop("health", bs.healthLoop))
+	}
+	if bs.federation != nil {
+		components = append(components, lifecycle.Loop("federation", bs.federation.Run))
+	}
+	if bs.autoscaler != nil {
+		components = append(components, lifecycle.Loop("autoscaler", bs.autoscaler.Run))
+	}
+	if bs.kindSchema != nil {
+		components = append(components, lifecycle.Loop("kind-schema", func(ctx context.Context) {
+			bs.kindSchema.Run(ctx, time.Minute)
+		}))
+	}
+	if bs.maintenance != nil {
+		components = append(components, lifecycle.Loop("maintenance", bs.maintenance.Run))
+	}
+	if bs.snapshots != nil {
+		components = append(components, lifecycle.Loop("score-snapshots", bs.saveScores))
+	}
+	if bs.consistency != nil {
+		components = append(components, lifecycle.Loop("consistency", bs.consistency.Run))
+	}
+	return components
+}
+
+// healthLoop re-checks, every healthInterval, the relays that were neither checked nor published
+// to for that long, so relays out of the top N get the chance to recover
+func (bs *BroadcastSystem) healthLoop(ctx context.Context) {
+	ticker := time.NewTicker(bs.healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		urls, err := bs.manager.GetAllRelays(ctx)
+		if err != nil {
+			logging.Error("BroadcastSystem: Failed to list relays for health checks: %v", err)
+			continue
+		}
+		cutoff := time.Now().Add(-bs.healthInterval)
+		var stale []string
+		for _, url := range urls {
+			info, err := bs.manager.GetRelayInfo(ctx, url)
+			if err != nil || info.LastChecked.After(cutoff) {
+				continue
+			}
+			stale = append(stale, url)
+			if len(stale) == maxHealthChecks {
+				break
+			}
+		}
+		// In batches, so a stop does not wait for the whole round
+		for start := 0; start < len(stale) && ctx.Err() == nil; start += healthBatch {
+			bs.healthChecker.CheckBatchContext(ctx, stale[start:min(start+healthBatch, len(stale))])
+		}
+	}
+}
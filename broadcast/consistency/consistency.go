@@ -0,0 +1,417 @@
+// Package consistency checks what destination relays claim in their NIP-11 document against how
+// they behave. Publishes are observed as they complete (EVENT): a relay claiming no auth that
+// answers "auth-required:", or claiming a 256 KB limit that rejects a 10 KB event as too large,
+// contradicts its claims. Relays in the top N are also probed with a REQ at an interval: an AUTH
+// challenge or an auth-required CLOSED from a relay claiming no auth, or a served REQ from one
+// claiming auth_required, are contradictions too. Each relay gets a decaying consistency score
+// (share of observations matching its claims); inconsistent relays are listed in a report and,
+// with a penalty weight, ranked lower.
+package consistency
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/requirements"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// Claims that are checked against behavior
+const (
+	ClaimAuth    = "auth"
+	ClaimSize    = "size"
+	ClaimPow     = "pow"
+	ClaimPayment = "payment"
+)
+
+const (
+	// decay weighs past observations down on each new one, so a relay that fixed its document
+	// (or its behavior) recovers
+	decay = 0.98
+	// probeTimeout bounds one REQ probe, connection included
+	probeTimeout = 10 * time.Second
+	// maxProbesPerRound caps the REQ probes of one round
+	maxProbesPerRound = 50
+)
+
+// ClaimSource returns the NIP-11 claims of a relay; implemented by *requirements.Checker
+type ClaimSource interface {
+	Get(url string) (requirements.Requirements, bool)
+}
+
+// ScoreSink receives the consistency of a relay (1 = behaves as claimed) for ranking
+type ScoreSink interface {
+	SetConsistency(ctx context.Context, url string, consistency float64) error
+}
+
+// Config controls consistency checks
+type Config struct {
+	Claims          ClaimSource
+	Sink            ScoreSink       // nil = report only
+	Targets         func() []string // relays probed with a REQ each round (nil = publishes only)
+	ProbeInterval   time.Duration   // between REQ probe rounds (0 = publishes only)
+	Threshold       float64         // relays scoring below it are reported as inconsistent (default 0.8)
+	MinObservations int             // observations before a relay is scored (default 5)
+}
+
+// relayRecord is what was observed about one relay
+type relayRecord struct {
+	consistent   float64 // decayed observations matching the claims
+	contradicted float64 // decayed observations contradicting them
+	observations int64
+	byClaim      map[string]int64 // contradictions per claim
+	lastDetail   string
+	lastAt       time.Time
+}
+
+func (rec *relayRecord) score() float64 {
+	total := rec.consistent + rec.contradicted
+	if total == 0 {
+		return 1
+	}
+	return rec.consistent / total
+}
+
+// Tracker scores relays on how well their behavior matches their NIP-11 claims
+type Tracker struct {
+	cfg Config
+
+	mu     sync.Mutex
+	relays map[string]*relayRecord
+
+	observed       int64
+	contradictions int64
+	probes         int64
+	probeFailures  int64 // probes that could not reach the relay (not held against it)
+}
+
+// New returns a Tracker, or nil without a claim source
+func New(cfg Config) *Tracker {
+	if cfg.Claims == nil {
+		return nil
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 0.8
+	}
+	if cfg.MinObservations <= 0 {
+		cfg.MinObservations = 5
+	}
+	logging.DebugMethod("consistency", "New", "Initializing NIP-11 consistency checks: threshold=%.2f, probe interval=%v", cfg.Threshold, cfg.ProbeInterval)
+	return &Tracker{cfg: cfg, relays: make(map[string]*relayRecord)}
+}
+
+// BroadcastPlanned is part of broadcaster.BroadcastReporter; nothing is learned before publishing
+func (t *Tracker) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted checks each publish outcome of the event against the relay's claims
+func (t *Tracker) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	frame := len(report.Event.String()) + len(`["EVENT",]`)
+	difficulty := -1 // computed on first need
+	for _, result := range report.Results {
+		if result.Local() {
+			continue
+		}
+		claims, ok := t.cfg.Claims.Get(result.URL)
+		if !ok || claims.Err != "" {
+			continue
+		}
+		if difficulty < 0 {
+			difficulty = nip13.Difficulty(report.Event.ID)
+		}
+		claim, detail, consistent := checkPublish(claims, result, frame, difficulty)
+		if claim == "" {
+			continue
+		}
+		t.observe(result.URL, claim, consistent, detail)
+	}
+}
+
+// checkPublish compares one publish outcome with claims. It returns the claim the outcome says
+// something about ("" = nothing), a description and whether the two agree.
+func checkPublish(claims requirements.Requirements, result broadcaster.RelayResult, frame, difficulty int) (string, string, bool) {
+	reason := strings.ToLower(result.Error)
+	if result.Success {
+		switch {
+		case claims.MaxMessageLength > 0 && frame > claims.MaxMessageLength:
+			return ClaimSize, "accepted a " + strconv.Itoa(frame) + " byte event over its max_message_length of " + strconv.Itoa(claims.MaxMessageLength), false
+		case claims.MinPow > 0 && difficulty < claims.MinPow:
+			return ClaimPow, "accepted an event of difficulty " + strconv.Itoa(difficulty) + " under its min_pow_difficulty of " + strconv.Itoa(claims.MinPow), false
+		}
+		return ClaimAuth, "", true
+	}
+	switch {
+	case strings.HasPrefix(reason, "auth-required:") && !claims.AuthRequired:
+		return ClaimAuth, "answered an EVENT with " + result.Error + " while claiming auth_required=false", false
+	case isSizeRejection(reason) && (claims.MaxMessageLength == 0 || frame <= claims.MaxMessageLength):
+		return ClaimSize, "rejected a " + strconv.Itoa(frame) + " byte event as too large while claiming max_message_length=" + strconv.Itoa(claims.MaxMessageLength), false
+	case strings.HasPrefix(reason, "pow:") && difficulty >= claims.MinPow:
+		return ClaimPow, "rejected an event of difficulty " + strconv.Itoa(difficulty) + " for proof of work while claiming min_pow_difficulty=" + strconv.Itoa(claims.MinPow), false
+	case strings.HasPrefix(reason, "restricted:") && !claims.PaymentRequired && (strings.Contains(reason, "pay") || strings.Contains(reason, "paid")):
+		return ClaimPayment, "asked for payment (" + result.Error + ") while claiming payment_required=false", false
+	}
+	return "", "", true
+}
+
+func isSizeRejection(reason string) bool {
+	return strings.Contains(reason, "too large") || strings.Contains(reason, "too big") ||
+		strings.Contains(reason, "message length") || strings.Contains(reason, "status = 1009")
+}
+
+// observe records one observation about url
+func (t *Tracker) observe(url, claim string, consistent bool, detail string) {
+	atomic.AddInt64(&t.observed, 1)
+	t.mu.Lock()
+	rec, ok := t.relays[url]
+	if !ok {
+		rec = &relayRecord{byClaim: make(map[string]int64)}
+		t.relays[url] = rec
+	}
+	rec.consistent *= decay
+	rec.contradicted *= decay
+	if consistent {
+		rec.consistent++
+	} else {
+		rec.contradicted++
+		rec.byClaim[claim]++
+		rec.lastDetail = detail
+		rec.lastAt = time.Now()
+	}
+	rec.observations++
+	score, scored := rec.score(), rec.observations >= int64(t.cfg.MinObservations)
+	t.mu.Unlock()
+
+	if !consistent {
+		atomic.AddInt64(&t.contradictions, 1)
+		logging.DebugMethod("consistency", "observe", "%s contradicts its NIP-11 %s claim: %s", url, claim, detail)
+	}
+	if scored && t.cfg.Sink != nil {
+		if err := t.cfg.Sink.SetConsistency(context.Background(), url, score); err != nil {
+			logging.DebugMethod("consistency", "observe", "Cannot record the consistency of %s: %v", url, err)
+		}
+	}
+}
+
+// Run probes the target relays with a REQ every ProbeInterval until ctx is canceled
+func (t *Tracker) Run(ctx context.Context) {
+	if t.cfg.ProbeInterval <= 0 || t.cfg.Targets == nil {
+		return
+	}
+	ticker := time.NewTicker(t.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			targets := t.cfg.Targets()
+			if len(targets) > maxProbesPerRound {
+				targets = targets[:maxProbesPerRound]
+			}
+			for _, url := range targets {
+				if ctx.Err() != nil {
+					return
+				}
+				t.probe(ctx, url)
+			}
+		}
+	}
+}
+
+// probe sends one REQ to url and compares the answer with its auth claim
+func (t *Tracker) probe(ctx context.Context, url string) {
+	claims, ok := t.cfg.Claims.Get(url)
+	if !ok || claims.Err != "" {
+		return
+	}
+	atomic.AddInt64(&t.probes, 1)
+	answer, err := requestProbe(ctx, url)
+	if err != nil {
+		atomic.AddInt64(&t.probeFailures, 1)
+		logging.DebugMethod("consistency", "probe", "REQ probe of %s failed: %v", url, err)
+		return
+	}
+	switch {
+	case answer.challenged && !claims.AuthRequired:
+		t.observe(url, ClaimAuth, false, "sent an AUTH challenge on a REQ while claiming auth_required=false")
+	case strings.HasPrefix(answer.closed, "auth-required:") && !claims.AuthRequired:
+		t.observe(url, ClaimAuth, false, "closed a REQ with "+answer.closed+" while claiming auth_required=false")
+	case answer.eose && claims.AuthRequired:
+		t.observe(url, ClaimAuth, false, "served a REQ without authentication while claiming auth_required=true")
+	case answer.eose || answer.closed != "":
+		t.observe(url, ClaimAuth, true, "")
+	}
+}
+
+// reqAnswer is how a relay answered a REQ probe
+type reqAnswer struct {
+	eose       bool
+	closed     string // CLOSED message, if closed
+	challenged bool   // sent an AUTH challenge
+}
+
+// requestProbe subscribes to one recent event on url and reads frames until EOSE or CLOSED
+func requestProbe(ctx context.Context, url string) (reqAnswer, error) {
+	var answer reqAnswer
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	conn, _, err := ws.Dial(ctx, url, nil)
+	if err != nil {
+		return answer, err
+	}
+	defer conn.Close(ws.StatusNormalClosure, "")
+	conn.SetReadLimit(1 << 20)
+
+	if err := conn.Write(ctx, ws.MessageText, []byte(`["REQ","consistency",{"kinds":[1],"limit":1}]`)); err != nil {
+		return answer, err
+	}
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			if answer.challenged {
+				return answer, nil // the challenge alone is an answer
+			}
+			return answer, err
+		}
+		var frame []stdjson.RawMessage
+		if stdjson.Unmarshal(data, &frame) != nil || len(frame) == 0 {
+			continue
+		}
+		var label string
+		stdjson.Unmarshal(frame[0], &label)
+		switch label {
+		case "AUTH":
+			answer.challenged = true
+		case "EOSE":
+			answer.eose = true
+			return answer, nil
+		case "CLOSED":
+			if len(frame) > 2 {
+				stdjson.Unmarshal(frame[2], &answer.closed)
+			}
+			if answer.closed == "" {
+				answer.closed = "closed"
+			}
+			return answer, nil
+		}
+	}
+}
+
+// Consistency returns the score of url and whether it has enough observations to be scored
+func (t *Tracker) Consistency(url string) (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec, ok := t.relays[url]
+	if !ok {
+		return 1, false
+	}
+	return rec.score(), rec.observations >= int64(t.cfg.MinObservations)
+}
+
+// Report lists the scored relays below the threshold, least consistent first, with their claims
+// and the contradictions observed
+func (t *Tracker) Report() *json.JsonObject {
+	type entry struct {
+		url string
+		rec relayRecord
+	}
+	t.mu.Lock()
+	var inconsistent []entry
+	scored := 0
+	for url, rec := range t.relays {
+		if rec.observations < int64(t.cfg.MinObservations) {
+			continue
+		}
+		scored++
+		if rec.score() < t.cfg.Threshold {
+			copied := *rec
+			copied.byClaim = make(map[string]int64, len(rec.byClaim))
+			for claim, n := range rec.byClaim {
+				copied.byClaim[claim] = n
+			}
+			inconsistent = append(inconsistent, entry{url: url, rec: copied})
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(inconsistent, func(i, j int) bool {
+		if si, sj := inconsistent[i].rec.score(), inconsistent[j].rec.score(); si != sj {
+			return si < sj
+		}
+		return inconsistent[i].url < inconsistent[j].url
+	})
+
+	relays := json.NewJsonList()
+	for _, e := range inconsistent {
+		obj := json.NewJsonObject()
+		obj.Set("url", json.NewJsonValue(e.url))
+		obj.Set("consistency", json.NewJsonValue(e.rec.score()))
+		obj.Set("observations", json.NewJsonValue(e.rec.observations))
+		byClaim := json.NewJsonObject()
+		claims := make([]string, 0, len(e.rec.byClaim))
+		for claim := range e.rec.byClaim {
+			claims = append(claims, claim)
+		}
+		sort.Strings(claims)
+		for _, claim := range claims {
+			byClaim.Set(claim, json.NewJsonValue(e.rec.byClaim[claim]))
+		}
+		obj.Set("contradictions", byClaim)
+		if claimed, ok := t.cfg.Claims.Get(e.url); ok {
+			claimsObj := json.NewJsonObject()
+			claimsObj.Set("auth_required", json.NewJsonValue(claimed.AuthRequired))
+			claimsObj.Set("payment_required", json.NewJsonValue(claimed.PaymentRequired))
+			claimsObj.Set("min_pow", json.NewJsonValue(claimed.MinPow))
+			claimsObj.Set("max_message_length", json.NewJsonValue(claimed.MaxMessageLength))
+			obj.Set("claims", claimsObj)
+		}
+		if e.rec.lastDetail != "" {
+			obj.Set("last_contradiction", json.NewJsonValue(e.rec.lastDetail))
+			obj.Set("last_contradiction_at", json.NewJsonValue(e.rec.lastAt.Unix()))
+		}
+		relays.Append(obj)
+	}
+
+	report := json.NewJsonObject()
+	report.Set("threshold", json.NewJsonValue(t.cfg.Threshold))
+	report.Set("scored_relays", json.NewJsonValue(scored))
+	report.Set("inconsistent_relays", json.NewJsonValue(len(inconsistent)))
+	report.Set("relays", relays)
+	return report
+}
+
+// GetStatsName returns the name for this stats provider
+func (t *Tracker) GetStatsName() string {
+	return "consistency"
+}
+
+// GetStats returns observation and probe counters as a JsonEntity
+func (t *Tracker) GetStats() json.JsonEntity {
+	t.mu.Lock()
+	tracked := len(t.relays)
+	inconsistent := 0
+	for _, rec := range t.relays {
+		if rec.observations >= int64(t.cfg.MinObservations) && rec.score() < t.cfg.Threshold {
+			inconsistent++
+		}
+	}
+	t.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("tracked_relays", json.NewJsonValue(tracked))
+	obj.Set("inconsistent_relays", json.NewJsonValue(inconsistent))
+	obj.Set("observations", json.NewJsonValue(atomic.LoadInt64(&t.observed)))
+	obj.Set("contradictions", json.NewJsonValue(atomic.LoadInt64(&t.contradictions)))
+	obj.Set("req_probes", json.NewJsonValue(atomic.LoadInt64(&t.probes)))
+	obj.Set("req_probe_failures", json.NewJsonValue(atomic.LoadInt64(&t.probeFailures)))
+	return obj
+}
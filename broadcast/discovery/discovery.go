@@ -0,0 +1,389 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/broadcast/onion"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type Discovery struct {
+	registry RelayRegistry
+	checker  RelayHealthChecker
+
+	evictionPolicy EvictionPolicy
+	evicted        evictions
+	extraction     extraction
+
+	// .onion relays are not added when they cannot be reached (see SetSkipOnion)
+	skipOnion    bool
+	onionSkipped int64
+}
+
+func NewDiscovery(registry RelayRegistry, checker RelayHealthChecker) *Discovery {
+	logging.Debug("Discovery: Initializing discovery module")
+	return &Discovery{
+		registry: registry,
+		checker:  checker,
+	}
+}
+
+// DiscoverFromSeeds performs initial relay discovery from seed relays
+func (d *Discovery) DiscoverFromSeeds(ctx context.Context, seedRelays []string) {
+	logging.Debug("Discovery: Starting seed discovery")
+	logging.Info("Discovery: Using %d seed relays", len(seedRelays))
+
+	// First, add seed relays to registry
+	for _, seed := range seedRelays {
+		logging.Debug("Discovery: Adding seed relay: %s", seed)
+		d.addRelay(ctx, seed, manager.SourceSeed)
+	}
+
+	// Discover more relays from seeds
+	relayURLs := make(map[string]bool)
+
+	for i, seedURL := range seedRelays {
+		logging.Debug("Discovery: Fetching relay lists from seed %d/%d: %s", i+1, len(seedRelays), seedURL)
+		relays := d.fetchRelaysFromRelay(ctx, seedURL)
+		for _, relay := range relays {
+			relayURLs[relay] = true
+		}
+	}
+
+	logging.Debug("Discovery: Found %d unique relay URLs from seeds", len(relayURLs))
+
+	// Add discovered relays
+	newRelays := []string{}
+	for url := range relayURLs {
+		if !d.isAlreadyKnown(ctx, url) && d.addRelay(ctx, url, manager.SourceRelayList) {
+			newRelays = append(newRelays, url)
+		}
+	}
+
+	logging.Info("Discovery: Added %d new relays from discovery", len(newRelays))
+
+	// Test all relays (seeds + discovered)
+	allRelays, err := d.registry.GetAllRelays(registryContext(ctx))
+	if err != nil {
+		logging.Error("Discovery: Failed to list relays for testing: %v", err)
+		return
+	}
+	d.checker.CheckBatch(allRelays)
+}
+
+// fetchRelaysFromRelay fetches relay lists from a specific relay
+func (d *Discovery) fetchRelaysFromRelay(ctx context.Context, relayURL string) []string {
+	relaySet := make(map[string]bool)
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		logging.Debug("Discovery: Failed to connect to seed relay %s: %v", relayURL, err)
+		return []string{}
+	}
+	defer relay.Close()
+
+	// Fetch kind 3 (contact lists) and kind 10002 (relay lists)
+	filters := []nostr.Filter{
+		{
+			Kinds: []int{3, 10002},
+			Limit: 100,
+		},
+	}
+
+	sub, err := relay.Subscribe(ctx, filters)
+	if err != nil {
+		logging.Debug("Discovery: Failed to subscribe to %s: %v", relayURL, err)
+		return []string{}
+	}
+
+	// Collect events with timeout
+	timeout := time.After(10 * time.Second)
+
+	for {
+		select {
+		case event := <-sub.Events:
+			if event == nil {
+				continue
+			}
+			relays := d.extractRelaysFromEvent(event)
+			for _, r := range relays {
+				relaySet[r] = true
+			}
+		case <-sub.EndOfStoredEvents:
+			// Got all stored events
+			goto done
+		case <-timeout:
+			// Timeout reached
+			goto done
+		case <-ctx.Done():
+			goto done
+		}
+	}
+
+done:
+	sub.Unsub()
+
+	result := make([]string, 0, len(relaySet))
+	for relay := range relaySet {
+		result = append(result, relay)
+	}
+
+	logging.Debug("Discovery: Fetched %d relay URLs from %s", len(result), relayURL)
+	return result
+}
+
+// ExtractRelaysFromEvent extracts relay URLs from a Nostr event
+func (d *Discovery) ExtractRelaysFromEvent(event *nostr.Event) []string {
+	return d.extractRelaysFromEvent(event)
+}
+
+func (d *Discovery) extractRelaysFromEvent(event *nostr.Event) []string {
+	relays := []string{}
+
+	switch event.Kind {
+	case 3: // Contact list
+		// Relays might be in content (old format) or tags
+		if event.Content != "" {
+			relays = append(relays, d.parseContactListContent(event.Content)...)
+		}
+
+	case 10002: // Relay list metadata (NIP-65)
+		// Format: ["r", "<relay-url>", "<read|write>"]
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "r" {
+				relay := normalizeRelayURL(tag[1])
+				if relay != "" {
+					relays = append(relays, relay)
+				}
+			}
+		}
+	}
+
+	// Extract relay hints from all events (relay hints in tags)
+	for _, tag := range event.Tags {
+		// Check for relay hints in 'e' and 'p' tags
+		// Format: ["e", "<event-id>", "<relay-url>"]
+		// Format: ["p", "<pubkey>", "<relay-url>"]
+		if len(tag) >= 3 && (tag[0] == "e" || tag[0] == "p") {
+			relay := normalizeRelayURL(tag[2])
+			if relay != "" {
+				relays = append(relays, relay)
+			}
+		}
+	}
+
+	return d.capRelays(event.ID, relays)
+}
+
+// parseContactListContent parses relay URLs from kind 3 content
+func (d *Discovery) parseContactListContent(content string) []string {
+	relays := []string{}
+
+	// Content is typically a JSON object with relay URLs as keys
+	var relayMap map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &relayMap); err != nil {
+		return relays
+	}
+
+	for relayURL := range relayMap {
+		relay := normalizeRelayURL(relayURL)
+		if relay != "" {
+			relays = append(relays, relay)
+		}
+	}
+
+	return relays
+}
+
+// normalizeRelayURL normalizes and validates a relay URL
+func normalizeRelayURL(url string) string {
+	url = strings.TrimSpace(url)
+
+	if url == "" {
+		return ""
+	}
+
+	// Must start with ws:// or wss://
+	if !strings.HasPrefix(url, "ws://") && !strings.HasPrefix(url, "wss://") {
+		return ""
+	}
+
+	// Remove trailing slash
+	url = strings.TrimSuffix(url, "/")
+
+	return url
+}
+
+// registryContext keeps ctx's values but not its deadline: the deadline bounds fetching from
+// the network, and relays found before it passed must still be recorded and tested
+func registryContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// isAlreadyKnown checks if a relay is already tracked. Lookup errors count as known, so a
+// failing registry is not flooded with additions.
+func (d *Discovery) isAlreadyKnown(ctx context.Context, url string) bool {
+	_, err := d.registry.GetRelayInfo(registryContext(ctx), url)
+	if errors.Is(err, manager.ErrRelayNotFound) {
+		return false
+	}
+	if err != nil {
+		logging.Warn("Discovery: Failed to look up relay %s: %v", url, err)
+	}
+	return true
+}
+
+// addRelay adds url, discovered through source, to the registry, logging failures; false if it
+// was not added
+func (d *Discovery) addRelay(ctx context.Context, url string, source string) bool {
+	if d.recentlyEvicted(url, source) {
+		return false
+	}
+	if d.skipOnion && onion.IsOnion(url) {
+		atomic.AddInt64(&d.onionSkipped, 1)
+		logging.DebugMethod("discovery", "addRelay", "Skipping onion relay %s: no Tor proxy configured", url)
+		return false
+	}
+	if err := d.registry.AddRelay(registryContext(ctx), url, source); err != nil {
+		logging.Warn("Discovery: Failed to add relay %s: %v", url, err)
+		return false
+	}
+	return true
+}
+
+// SetSkipOnion keeps .onion relays out of the registry, for instances without a Tor proxy where
+// every connection to them would fail
+func (d *Discovery) SetSkipOnion(skip bool) {
+	d.skipOnion = skip
+}
+
+// AddRelayIfNew adds a relay discovered through source if it's not already known and tests it
+func (d *Discovery) AddRelayIfNew(url string, source string) {
+	url = normalizeRelayURL(url)
+	if url == "" {
+		return
+	}
+
+	ctx := context.Background()
+	if !d.isAlreadyKnown(ctx, url) && d.addRelay(ctx, url, source) {
+		logging.Debug("Discovery: New relay discovered: %s (testing...)", url)
+		// Test the new relay
+		go d.checker.CheckInitial(url)
+	}
+}
+
+// DiscoverFromFollows walks the follow list (kind 3) of pubkey, fetches each followee's NIP-65
+// relay list (kind 10002) from the seed relays and adds their write relays to the registry,
+// most used first, up to maxRelays new relays (0 = no cap). Returns the number of relays added.
+func (d *Discovery) DiscoverFromFollows(ctx context.Context, seedRelays []string, pubkey string, maxRelays int) int {
+	logging.Info("Discovery: Walking follow graph of %s", pubkey)
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	pool := nostr.NewSimplePool(ctx)
+	defer pool.Close("follow discovery done")
+
+	// Latest contact list of the operator
+	var contactList *nostr.Event
+	for ie := range pool.FetchMany(ctx, seedRelays, nostr.Filter{Kinds: []int{3}, Authors: []string{pubkey}, Limit: 1}) {
+		if contactList == nil || ie.CreatedAt > contactList.CreatedAt {
+			contactList = ie.Event
+		}
+	}
+	if contactList == nil {
+		logging.Warn("Discovery: No contact list found for %s on seed relays", pubkey)
+		return 0
+	}
+
+	follows := make([]string, 0, len(contactList.Tags))
+	for _, tag := range contactList.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) {
+			follows = append(follows, tag[1])
+		}
+	}
+	logging.Debug("Discovery: %s follows %d pubkeys", pubkey, len(follows))
+
+	// Latest relay list per followee, fetched in chunks to keep filters reasonable
+	latest := make(map[string]*nostr.Event)
+	const chunkSize = 250
+	for i := 0; i < len(follows); i += chunkSize {
+		end := i + chunkSize
+		if end > len(follows) {
+			end = len(follows)
+		}
+		filter := nostr.Filter{Kinds: []int{10002}, Authors: follows[i:end]}
+		for ie := range pool.FetchMany(ctx, seedRelays, filter) {
+			if prev, ok := latest[ie.PubKey]; !ok || ie.CreatedAt > prev.CreatedAt {
+				latest[ie.PubKey] = ie.Event
+			}
+		}
+	}
+
+	// Count how many followees write to each relay
+	usage := make(map[string]int)
+	for _, event := range latest {
+		for _, relay := range writeRelaysFromList(event) {
+			usage[relay]++
+		}
+	}
+
+	candidates := make([]string, 0, len(usage))
+	for url := range usage {
+		if !d.isAlreadyKnown(ctx, url) {
+			candidates = append(candidates, url)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if usage[candidates[i]] != usage[candidates[j]] {
+			return usage[candidates[i]] > usage[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	if maxRelays > 0 && len(candidates) > maxRelays {
+		candidates = candidates[:maxRelays]
+	}
+
+	added := candidates[:0]
+	for _, url := range candidates {
+		if d.addRelay(ctx, url, manager.SourceNIP65) {
+			added = append(added, url)
+		}
+	}
+	candidates = added
+	logging.Info("Discovery: Follow graph yielded %d relay lists, %d distinct write relays, %d new relays added",
+		len(latest), len(usage), len(candidates))
+
+	if len(candidates) > 0 {
+		d.checker.CheckBatch(candidates)
+	}
+	return len(candidates)
+}
+
+// writeRelaysFromList returns the write relays of a NIP-65 list (r tags without marker or marked "write")
+func writeRelaysFromList(event *nostr.Event) []string {
+	relays := []string{}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		if len(tag) >= 3 && tag[2] == "read" {
+			continue
+		}
+		if relay := normalizeRelayURL(tag[1]); relay != "" {
+			relays = append(relays, relay)
+		}
+	}
+	return relays
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// EvictionPolicy drops relays from less trusted discovery sources that never proved useful:
+// a relay from a source in MaxAge that has gone that long without a successful publish (or since
+// it was first seen) and is below MinSuccessRate is removed. It is not rediscovered through the
+// same untrusted sources for MaxAge either, so refreshes do not keep re-adding it.
+type EvictionPolicy struct {
+	MaxAge         map[string]time.Duration // discovery source -> max time without a successful publish
+	MinSuccessRate float64
+}
+
+// evictions remembers evicted relays until they may be rediscovered
+type evictions struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// SetEvictionPolicy enables EvictRelays
+func (d *Discovery) SetEvictionPolicy(policy EvictionPolicy) {
+	d.evictionPolicy = policy
+}
+
+// EvictRelays removes the relays the eviction policy condemns and returns how many were removed
+func (d *Discovery) EvictRelays(ctx context.Context) int {
+	if len(d.evictionPolicy.MaxAge) == 0 {
+		return 0
+	}
+	urls, err := d.registry.GetAllRelays(registryContext(ctx))
+	if err != nil {
+		logging.Warn("Discovery: Eviction skipped, failed to list relays: %v", err)
+		return 0
+	}
+
+	now := time.Now()
+	evicted := 0
+	for _, url := range urls {
+		info, err := d.registry.GetRelayInfo(registryContext(ctx), url)
+		if err != nil || !manager.Evictable(info, d.evictionPolicy.MaxAge, d.evictionPolicy.MinSuccessRate, now) {
+			continue
+		}
+		if err := d.registry.RemoveRelay(registryContext(ctx), url); err != nil {
+			logging.Warn("Discovery: Failed to evict relay %s: %v", url, err)
+			continue
+		}
+		d.evicted.mu.Lock()
+		if d.evicted.until == nil {
+			d.evicted.until = make(map[string]time.Time)
+		}
+		d.evicted.until[url] = now.Add(d.evictionPolicy.MaxAge[info.Source])
+		d.evicted.mu.Unlock()
+		logging.Debug("Discovery: Evicted relay %s (source %s, success rate %.2f, last success %v)",
+			url, info.Source, info.SuccessRate, info.LastSuccess)
+		evicted++
+	}
+	if evicted > 0 {
+		logging.Info("Discovery: Evicted %d relays under the discovery source policy", evicted)
+	}
+	return evicted
+}
+
+// recentlyEvicted reports whether url was evicted and source is not trusted enough to bring it
+// back yet (sources without an eviction policy always may)
+func (d *Discovery) recentlyEvicted(url string, source string) bool {
+	if _, untrusted := d.evictionPolicy.MaxAge[source]; !untrusted {
+		return false
+	}
+	d.evicted.mu.Lock()
+	defer d.evicted.mu.Unlock()
+	until, ok := d.evicted.until[url]
+	if ok && time.Now().After(until) {
+		delete(d.evicted.until, url)
+		return false
+	}
+	return ok
+}
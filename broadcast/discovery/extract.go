@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// extraction counts what events contributed to discovery
+type extraction struct {
+	maxPerEvent     int   // relay URLs taken from one event (0 = all)
+	events          int64 // events that yielded relay URLs
+	extracted       int64 // URLs taken
+	malformed       int64 // URLs dropped as malformed
+	truncatedEvents int64 // events with more URLs than maxPerEvent
+	truncatedURLs   int64 // URLs dropped by the cap
+}
+
+// SetMaxRelaysPerEvent caps how many relay URLs one event may contribute, so an event with
+// hundreds of r tags cannot flood the pool (0 = no cap)
+func (d *Discovery) SetMaxRelaysPerEvent(n int) {
+	d.extraction.maxPerEvent = n
+}
+
+// relayQuality ranks a relay URL: lower is better, -1 is unusable. A bare wss:// host beats one
+// with a path, which beats plain ws://.
+func relayQuality(raw string) int {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return -1
+	}
+	host := u.Hostname()
+	if host == "" || strings.ContainsAny(host, " _") {
+		return -1
+	}
+	if net.ParseIP(host) == nil && !strings.Contains(host, ".") {
+		return -1 // no TLD: localhost, internal names, typos
+	}
+	if port := u.Port(); port != "" && strings.Trim(port, "0123456789") != "" {
+		return -1
+	}
+	quality := 0
+	if u.Path != "" {
+		quality++
+	}
+	if u.Scheme == "ws" {
+		quality += 2
+	}
+	return quality
+}
+
+// capRelays drops duplicates and malformed URLs, then keeps the best maxPerEvent of them (in
+// their original order within a quality level: explicit relay lists come before hints)
+func (d *Discovery) capRelays(eventID string, relays []string) []string {
+	seen := make(map[string]bool, len(relays))
+	type candidate struct {
+		url     string
+		quality int
+	}
+	candidates := make([]candidate, 0, len(relays))
+	for _, relay := range relays {
+		if seen[relay] {
+			continue
+		}
+		seen[relay] = true
+		quality := relayQuality(relay)
+		if quality < 0 {
+			atomic.AddInt64(&d.extraction.malformed, 1)
+			continue
+		}
+		candidates = append(candidates, candidate{relay, quality})
+	}
+
+	if limit := d.extraction.maxPerEvent; limit > 0 && len(candidates) > limit {
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].quality < candidates[j].quality })
+		dropped := len(candidates) - limit
+		candidates = candidates[:limit]
+		atomic.AddInt64(&d.extraction.truncatedEvents, 1)
+		atomic.AddInt64(&d.extraction.truncatedURLs, int64(dropped))
+		logging.Debug("Discovery: Event %s carries %d more relay URLs than the cap of %d, ignoring them", eventID, dropped, limit)
+	}
+
+	result := make([]string, len(candidates))
+	for i, c := range candidates {
+		result[i] = c.url
+	}
+	if len(result) > 0 {
+		atomic.AddInt64(&d.extraction.events, 1)
+		atomic.AddInt64(&d.extraction.extracted, int64(len(result)))
+	}
+	return result
+}
+
+// GetStatsName returns the name for this stats provider
+func (d *Discovery) GetStatsName() string {
+	return "discovery"
+}
+
+// GetStats returns the relay extraction counters as a JsonEntity
+func (d *Discovery) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("max_relays_per_event", json.NewJsonValue(d.extraction.maxPerEvent))
+	obj.Set("events_with_relays", json.NewJsonValue(atomic.LoadInt64(&d.extraction.events)))
+	obj.Set("relays_extracted", json.NewJsonValue(atomic.LoadInt64(&d.extraction.extracted)))
+	obj.Set("malformed_dropped", json.NewJsonValue(atomic.LoadInt64(&d.extraction.malformed)))
+	obj.Set("truncated_events", json.NewJsonValue(atomic.LoadInt64(&d.extraction.truncatedEvents)))
+	obj.Set("truncated_relays", json.NewJsonValue(atomic.LoadInt64(&d.extraction.truncatedURLs)))
+	obj.Set("onion_skipped", json.NewJsonValue(atomic.LoadInt64(&d.onionSkipped)))
+	return obj
+}
@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// maxImportSize caps a downloaded or read relay list
+const maxImportSize = 10 << 20
+
+// ImportFromList pre-populates the registry from a curated relay list (an http(s) URL such as
+// a nostr.watch or registry export, or a local file) and tests the new relays. It accepts a
+// JSON array of URLs, a JSON array of objects with a "url" (or "relay") field, or plain text
+// with one URL per line. At most maxRelays new relays are added (0 = all). Returns the number
+// of relays added.
+func (d *Discovery) ImportFromList(ctx context.Context, source string, maxRelays int) (int, error) {
+	logging.Info("Discovery: Importing relay list from %s", source)
+
+	data, err := readRelayList(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+	urls, err := parseRelayList(data)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", source, err)
+	}
+
+	newRelays := []string{}
+	seen := make(map[string]bool)
+	for _, raw := range urls {
+		url := normalizeRelayURL(raw)
+		if url == "" || seen[url] || d.isAlreadyKnown(ctx, url) {
+			continue
+		}
+		seen[url] = true
+		newRelays = append(newRelays, url)
+		if maxRelays > 0 && len(newRelays) >= maxRelays {
+			break
+		}
+	}
+
+	added := newRelays[:0]
+	for _, url := range newRelays {
+		if d.addRelay(ctx, url, manager.SourceImport) {
+			added = append(added, url)
+		}
+	}
+	newRelays = added
+	logging.Info("Discovery: Imported %d new relays (%d entries in list)", len(newRelays), len(urls))
+
+	if len(newRelays) > 0 {
+		d.checker.CheckBatch(newRelays)
+	}
+	return len(newRelays), nil
+}
+
+// readRelayList downloads source if it is an http(s) URL, otherwise reads it as a file
+func readRelayList(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, maxImportSize))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", source, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxImportSize))
+}
+
+// parseRelayList extracts relay URLs from a JSON list or a plain-text list
+func parseRelayList(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		urls := make([]string, 0, len(items))
+		for _, item := range items {
+			var url string
+			if err := json.Unmarshal(item, &url); err == nil {
+				urls = append(urls, url)
+				continue
+			}
+			var obj struct {
+				URL   string `json:"url"`
+				Relay string `json:"relay"`
+			}
+			if err := json.Unmarshal(item, &obj); err == nil {
+				if obj.URL != "" {
+					urls = append(urls, obj.URL)
+				} else if obj.Relay != "" {
+					urls = append(urls, obj.Relay)
+				}
+			}
+		}
+		return urls, nil
+	}
+
+	// Plain text: one URL per line, # starts a comment
+	urls := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
@@ -0,0 +1,21 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+)
+
+// RelayRegistry manages relay information
+type RelayRegistry interface {
+	AddRelay(ctx context.Context, url string, source string) error
+	RemoveRelay(ctx context.Context, url string) error
+	GetAllRelays(ctx context.Context) ([]string, error)
+	GetRelayInfo(ctx context.Context, url string) (*manager.RelayInfo, error) // manager.ErrRelayNotFound if not found
+}
+
+// RelayHealthChecker performs health checks on relays
+type RelayHealthChecker interface {
+	CheckBatch(urls []string)
+	CheckInitial(url string) bool
+}
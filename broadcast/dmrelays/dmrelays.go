@@ -0,0 +1,312 @@
+// Package dmrelays routes NIP-17 private messages: a gift wrap (kind 1059) is only useful on the
+// relays its recipient reads DMs from, which they publish as a kind 10050 list and which are often
+// not the general-purpose relays of the top N. The Router replaces the planned relay set of a
+// gift wrap with its recipients' DM relays (plus the mandatory relays), looking lists up on the
+// lookup relays and caching them; kind 10050 events passing through the broadcaster refresh the
+// cache for free.
+package dmrelays
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Event kinds involved in NIP-17 routing
+const (
+	KindGiftWrap     = 1059
+	KindDMRelayList  = 10050
+	maxRelaysPerList = 20 // a longer list is truncated; nobody reads DMs from more relays than that
+)
+
+// What to do with a gift wrap when none of its recipients has a DM relay list
+const (
+	FallbackTop       = "top"       // broadcast as planned (top N + mandatory)
+	FallbackMandatory = "mandatory" // mandatory relays only
+	FallbackNone      = "none"      // don't broadcast it
+)
+
+// Config controls the routing
+type Config struct {
+	LookupRelays []string        // where kind 10050 lists are fetched (none = learned from passing events only)
+	CacheTTL     time.Duration   // how long a found list is trusted (default 6h)
+	MissTTL      time.Duration   // how soon a recipient without a list is looked up again (default 15m)
+	Timeout      time.Duration   // one lookup (default 5s); the event's broadcast waits for it
+	Fallback     string          // FallbackTop, FallbackMandatory or FallbackNone (default top)
+	Mandatory    func() []string // relays that get every event, kept in routed sets
+}
+
+// entry is the cached DM relay list of one pubkey
+type entry struct {
+	relays    []string // nil = no list found
+	createdAt nostr.Timestamp
+	fetchedAt time.Time
+	ready     chan struct{} // closed once the lookup finished
+}
+
+// Router implements broadcaster.RelayFilter and broadcaster.BroadcastReporter
+type Router struct {
+	cfg Config
+
+	mu      sync.Mutex
+	entries map[string]*entry
+
+	routed     int64 // gift wraps sent to DM relays
+	fallbacks  int64 // gift wraps without any recipient list
+	lookups    int64
+	lookupMiss int64
+	learned    int64 // lists taken from passing kind 10050 events
+}
+
+// New returns a Router for cfg
+func New(cfg Config) *Router {
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 6 * time.Hour
+	}
+	if cfg.MissTTL <= 0 {
+		cfg.MissTTL = 15 * time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	switch cfg.Fallback {
+	case FallbackTop, FallbackMandatory, FallbackNone:
+	default:
+		if cfg.Fallback != "" {
+			logging.Warn("DMRelays: Unknown fallback %q, using %s", cfg.Fallback, FallbackTop)
+		}
+		cfg.Fallback = FallbackTop
+	}
+	logging.DebugMethod("dmrelays", "New", "Routing gift wraps to kind 10050 lists from %d lookup relays (fallback %s)",
+		len(cfg.LookupRelays), cfg.Fallback)
+	return &Router{cfg: cfg, entries: make(map[string]*entry)}
+}
+
+// FilterRelays replaces the relays of a gift wrap with its recipients' DM relays
+func (r *Router) FilterRelays(event *nostr.Event, relays []string) []string {
+	return r.filterRelays(event, relays, true)
+}
+
+// PlanRelays is FilterRelays for a dry run: routed gift wraps and fallbacks are not counted
+func (r *Router) PlanRelays(event *nostr.Event, relays []string) []string {
+	return r.filterRelays(event, relays, false)
+}
+
+func (r *Router) filterRelays(event *nostr.Event, relays []string, count bool) []string {
+	if event.Kind != KindGiftWrap {
+		return relays
+	}
+
+	set := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" || !nostr.IsValidPublicKey(tag[1]) {
+			continue
+		}
+		for _, url := range r.lookup(tag[1]) {
+			set[url] = true
+		}
+	}
+
+	if len(set) == 0 {
+		if count {
+			atomic.AddInt64(&r.fallbacks, 1)
+		}
+		logging.DebugMethod("dmrelays", "FilterRelays", "No DM relay list for the recipients of %s, fallback %s", event.ID, r.cfg.Fallback)
+		switch r.cfg.Fallback {
+		case FallbackMandatory:
+			return r.mandatory()
+		case FallbackNone:
+			return []string{}
+		default:
+			return relays
+		}
+	}
+
+	for _, url := range r.mandatory() {
+		set[url] = true
+	}
+	routed := make([]string, 0, len(set))
+	for url := range set {
+		routed = append(routed, url)
+	}
+	if count {
+		atomic.AddInt64(&r.routed, 1)
+	}
+	logging.DebugMethod("dmrelays", "FilterRelays", "Routing gift wrap %s to %d DM relays", event.ID, len(routed))
+	return routed
+}
+
+func (r *Router) mandatory() []string {
+	if r.cfg.Mandatory == nil {
+		return []string{}
+	}
+	return append([]string{}, r.cfg.Mandatory()...)
+}
+
+// lookup returns pubkey's DM relays, fetching them if the cache has nothing fresh. Concurrent
+// lookups of one pubkey share a fetch.
+func (r *Router) lookup(pubkey string) []string {
+	r.mu.Lock()
+	e, ok := r.entries[pubkey]
+	if ok {
+		select {
+		case <-e.ready:
+			if time.Since(e.fetchedAt) < r.ttl(e) {
+				r.mu.Unlock()
+				return e.relays
+			}
+		default:
+			// Someone else is fetching it
+			r.mu.Unlock()
+			<-e.ready
+			return e.relays
+		}
+	}
+	next := &entry{ready: make(chan struct{})}
+	if ok {
+		// Keep serving the stale list if the refresh finds nothing newer
+		next.relays, next.createdAt = e.relays, e.createdAt
+	}
+	r.entries[pubkey] = next
+	r.mu.Unlock()
+
+	relays, createdAt := r.fetch(pubkey)
+	r.mu.Lock()
+	if relays != nil && createdAt >= next.createdAt {
+		next.relays, next.createdAt = relays, createdAt
+	}
+	next.fetchedAt = time.Now()
+	close(next.ready)
+	r.mu.Unlock()
+	return next.relays
+}
+
+func (r *Router) ttl(e *entry) time.Duration {
+	if e.relays == nil {
+		return r.cfg.MissTTL
+	}
+	return r.cfg.CacheTTL
+}
+
+// fetch queries the lookup relays for pubkey's latest kind 10050 list
+func (r *Router) fetch(pubkey string) ([]string, nostr.Timestamp) {
+	if len(r.cfg.LookupRelays) == 0 {
+		return nil, 0
+	}
+	atomic.AddInt64(&r.lookups, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+	pool := nostr.NewSimplePool(ctx)
+	defer pool.Close("dm relay lookup done")
+
+	var latest *nostr.Event
+	filter := nostr.Filter{Kinds: []int{KindDMRelayList}, Authors: []string{pubkey}, Limit: 1}
+	for ie := range pool.FetchMany(ctx, r.cfg.LookupRelays, filter) {
+		if latest == nil || ie.CreatedAt > latest.CreatedAt {
+			latest = ie.Event
+		}
+	}
+	if latest == nil {
+		atomic.AddInt64(&r.lookupMiss, 1)
+		logging.DebugMethod("dmrelays", "fetch", "No DM relay list found for %s", pubkey)
+		return nil, 0
+	}
+	relays := relaysFromList(latest)
+	logging.DebugMethod("dmrelays", "fetch", "DM relays of %s: %v", pubkey, relays)
+	return relays, latest.CreatedAt
+}
+
+// relaysFromList returns the relay tags of a kind 10050 event (nil if there are none)
+func relaysFromList(event *nostr.Event) []string {
+	var relays []string
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "relay" {
+			continue
+		}
+		url := strings.TrimSuffix(strings.TrimSpace(tag[1]), "/")
+		if !strings.HasPrefix(url, "wss://") && !strings.HasPrefix(url, "ws://") || seen[url] {
+			continue
+		}
+		seen[url] = true
+		relays = append(relays, url)
+		if len(relays) == maxRelaysPerList {
+			break
+		}
+	}
+	return relays
+}
+
+// BroadcastPlanned learns DM relay lists from kind 10050 events being broadcast
+func (r *Router) BroadcastPlanned(event *nostr.Event, relays []string) {
+	if event.Kind != KindDMRelayList {
+		return
+	}
+	list := relaysFromList(event)
+	if list == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[event.PubKey]; ok {
+		select {
+		case <-e.ready:
+			if e.relays != nil && e.createdAt > event.CreatedAt {
+				return // we already know a newer list
+			}
+		default:
+			return // a lookup is in flight and will fill the entry
+		}
+	}
+	ready := make(chan struct{})
+	close(ready)
+	r.entries[event.PubKey] = &entry{relays: list, createdAt: event.CreatedAt, fetchedAt: time.Now(), ready: ready}
+	atomic.AddInt64(&r.learned, 1)
+}
+
+// BroadcastCompleted does nothing: lists are learned when planned
+func (r *Router) BroadcastCompleted(report broadcaster.BroadcastReport) {}
+
+// GetStatsName returns the name for this stats provider
+func (r *Router) GetStatsName() string {
+	return "dm_routing"
+}
+
+// GetStats returns routing and cache counters as a JsonEntity
+func (r *Router) GetStats() json.JsonEntity {
+	r.mu.Lock()
+	known, missing := 0, 0
+	for _, e := range r.entries {
+		select {
+		case <-e.ready:
+			if e.relays != nil {
+				known++
+			} else {
+				missing++
+			}
+		default:
+		}
+	}
+	r.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("fallback", json.NewJsonValue(r.cfg.Fallback))
+	obj.Set("lookup_relays", json.NewJsonValue(len(r.cfg.LookupRelays)))
+	obj.Set("routed", json.NewJsonValue(atomic.LoadInt64(&r.routed)))
+	obj.Set("fallbacks", json.NewJsonValue(atomic.LoadInt64(&r.fallbacks)))
+	obj.Set("lookups", json.NewJsonValue(atomic.LoadInt64(&r.lookups)))
+	obj.Set("lookup_misses", json.NewJsonValue(atomic.LoadInt64(&r.lookupMiss)))
+	obj.Set("learned", json.NewJsonValue(atomic.LoadInt64(&r.learned)))
+	obj.Set("cached_lists", json.NewJsonValue(known))
+	obj.Set("cached_misses", json.NewJsonValue(missing))
+	return obj
+}
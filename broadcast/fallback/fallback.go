@@ -0,0 +1,186 @@
+// Package fallback retries publishes that could not reach a relay over alternate endpoints of
+// the same relay: configured alternates (another port, a plain ws:// listener, an onion
+// address) and, optionally, plain ws:// on the same host when a wss:// frontend fails at the
+// TLS level. Results stay attributed to the relay's primary URL, so a relay with a flaky TLS
+// frontend keeps its place in the ranking as long as one of its endpoints delivers.
+package fallback
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/netdiag"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Config controls fallback publishing
+type Config struct {
+	// Alternates lists alternate endpoints per primary relay URL, tried in order
+	Alternates map[string][]string
+	// PlainWS also tries ws://<same host and path> when a wss:// relay fails below the protocol
+	PlainWS bool
+	// Sticky is how long an alternate that delivered is tried first (default 10m)
+	Sticky time.Duration
+}
+
+// unreachable reports whether err means the endpoint could not be reached at all, as opposed
+// to a relay that answered (rejections, throttling) or a publish that ran out of time
+func unreachable(err error) bool {
+	switch netdiag.Classify(err) {
+	case netdiag.ClassDNS, netdiag.ClassTCP, netdiag.ClassTLS, netdiag.ClassCertExpired,
+		netdiag.ClassCertInvalid, netdiag.ClassWebSocket, netdiag.ClassTimeout:
+		return true
+	}
+	return false
+}
+
+// tlsLevel reports whether err happened before a plain connection would have been different
+func tlsLevel(err error) bool {
+	switch netdiag.Classify(err) {
+	case netdiag.ClassTCP, netdiag.ClassTLS, netdiag.ClassCertExpired, netdiag.ClassCertInvalid, netdiag.ClassWebSocket:
+		return true
+	}
+	return false
+}
+
+type preference struct {
+	endpoint string
+	until    time.Time
+}
+
+// Publisher wraps a broadcaster.Publisher with fallback endpoints
+type Publisher struct {
+	cfg   Config
+	inner broadcaster.Publisher
+
+	mu        sync.Mutex
+	preferred map[string]preference // primary URL -> alternate that delivered last
+	delivered map[string]int64      // primary URL -> publishes delivered over an alternate
+
+	attempts  int64
+	successes int64
+}
+
+// New returns a Publisher falling back from inner's failures, or nil if nothing is configured
+func New(cfg Config, inner broadcaster.Publisher) *Publisher {
+	if len(cfg.Alternates) == 0 && !cfg.PlainWS {
+		return nil
+	}
+	if cfg.Sticky <= 0 {
+		cfg.Sticky = 10 * time.Minute
+	}
+	logging.DebugMethod("fallback", "New", "Initializing fallback publishing: %d relays with alternates, plain ws=%v",
+		len(cfg.Alternates), cfg.PlainWS)
+	return &Publisher{
+		cfg:       cfg,
+		inner:     inner,
+		preferred: make(map[string]preference),
+		delivered: make(map[string]int64),
+	}
+}
+
+// endpoints returns the alternates of url worth trying after err
+func (p *Publisher) endpoints(url string, err error) []string {
+	endpoints := append([]string{}, p.cfg.Alternates[strings.TrimSuffix(url, "/")]...)
+	if p.cfg.PlainWS && strings.HasPrefix(url, "wss://") && tlsLevel(err) {
+		endpoints = append(endpoints, "ws://"+strings.TrimPrefix(url, "wss://"))
+	}
+	return endpoints
+}
+
+// Publish publishes to url, an alternate that recently delivered first; when url cannot be
+// reached, its alternates are tried in order within the same ctx
+func (p *Publisher) Publish(ctx context.Context, url string, eventID string, frame []byte) error {
+	p.mu.Lock()
+	pref, sticky := p.preferred[url]
+	if sticky && time.Now().After(pref.until) {
+		delete(p.preferred, url)
+		sticky = false
+	}
+	p.mu.Unlock()
+
+	if sticky {
+		err := p.inner.Publish(ctx, pref.endpoint, eventID, frame)
+		if err == nil {
+			p.recordDelivery(url, pref.endpoint)
+			return nil
+		}
+		if !unreachable(err) || ctx.Err() != nil {
+			return err
+		}
+		p.mu.Lock()
+		delete(p.preferred, url)
+		p.mu.Unlock()
+	}
+
+	err := p.inner.Publish(ctx, url, eventID, frame)
+	if err == nil || !unreachable(err) || ctx.Err() != nil {
+		return err
+	}
+
+	for _, endpoint := range p.endpoints(url, err) {
+		if sticky && endpoint == pref.endpoint {
+			continue
+		}
+		atomic.AddInt64(&p.attempts, 1)
+		altErr := p.inner.Publish(ctx, endpoint, eventID, frame)
+		if altErr == nil {
+			logging.DebugMethod("fallback", "Publish", "Published event %s to %s over %s after: %v", eventID, url, endpoint, err)
+			p.recordDelivery(url, endpoint)
+			return nil
+		}
+		logging.DebugMethod("fallback", "Publish", "Alternate %s of %s failed too: %v", endpoint, url, altErr)
+		if !unreachable(altErr) || ctx.Err() != nil {
+			// The relay answered (e.g. rejected the event) or time is up: that is the result
+			return altErr
+		}
+	}
+	return err
+}
+
+func (p *Publisher) recordDelivery(url, endpoint string) {
+	atomic.AddInt64(&p.successes, 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.preferred[url]; !ok {
+		logging.Info("Fallback: %s reachable over %s only, preferring it for %v", url, endpoint, p.cfg.Sticky)
+	}
+	p.preferred[url] = preference{endpoint: endpoint, until: time.Now().Add(p.cfg.Sticky)}
+	p.delivered[url]++
+}
+
+// GetStatsName returns the name for this stats provider
+func (p *Publisher) GetStatsName() string {
+	return "fallback"
+}
+
+// GetStats returns fallback counters and the alternates currently preferred as a JsonEntity
+func (p *Publisher) GetStats() json.JsonEntity {
+	now := time.Now()
+	preferred := json.NewJsonObject()
+	delivered := json.NewJsonObject()
+	p.mu.Lock()
+	for url, pref := range p.preferred {
+		if now.Before(pref.until) {
+			preferred.Set(url, json.NewJsonValue(pref.endpoint))
+		}
+	}
+	for url, count := range p.delivered {
+		delivered.Set(url, json.NewJsonValue(count))
+	}
+	p.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("relays_with_alternates", json.NewJsonValue(len(p.cfg.Alternates)))
+	obj.Set("plain_ws", json.NewJsonValue(p.cfg.PlainWS))
+	obj.Set("attempts", json.NewJsonValue(atomic.LoadInt64(&p.attempts)))
+	obj.Set("delivered", json.NewJsonValue(atomic.LoadInt64(&p.successes)))
+	obj.Set("preferred", preferred)
+	obj.Set("delivered_per_relay", delivered)
+	return obj
+}
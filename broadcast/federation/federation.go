@@ -0,0 +1,653 @@
+// Package federation lets several broadcast-relay instances behind one ingest point share the
+// destination relay set instead of each publishing every event to every relay. Members are
+// configured as peers; every interval each member pulls the others' gossip (their node ID and
+// the success rate and latency of their top relays), ranks the union of all members' top
+// relays by the reported success rates, and then partitions that set with rendezvous hashing:
+// every relay is owned by exactly one live member, which is the only one publishing to it.
+// A member that stops answering drops out of the partition and its relays move to the others.
+// The member receiving an event from a client publishes it to the relays it owns and hands each
+// other member its share (POST ForwardPath), publishing the share itself if the owner cannot be
+// reached; behind a load balancer every event still reaches every relay exactly once.
+// While a live peer misses exchanges, members may disagree on who owns a relay, so a member with
+// a stale view publishes to all relays: duplicates rather than lost events.
+package federation
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	stdjson "encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// GossipPath is where members serve their gossip
+const GossipPath = "/federation/gossip"
+
+// ForwardPath is where members receive the events handed to them
+const ForwardPath = "/federation/events"
+
+const (
+	// fetchTimeout bounds one gossip request
+	fetchTimeout = 10 * time.Second
+	// forwardTimeout bounds handing one event to a peer
+	forwardTimeout = 5 * time.Second
+	// handoffTTL is how long a handed-off event may wait in the queue for its relays
+	handoffTTL = 10 * time.Minute
+	// peerTTL is how many missed intervals take a peer out of the partition
+	peerTTL = 3
+)
+
+// Config controls federation
+type Config struct {
+	NodeID   string        // this member's ID, unique within the federation
+	Peers    []string      // base URLs (http(s)://host:port) of the other members
+	Secret   string        // bearer token members present to each other (optional)
+	Interval time.Duration // gossip interval (default 30s)
+}
+
+// RelayScore is one relay as seen by one member
+type RelayScore struct {
+	URL           string  `json:"url"`
+	SuccessRate   float64 `json:"success_rate"`
+	AvgResponseMs int64   `json:"avg_response_ms"`
+}
+
+// Gossip is what a member tells its peers
+type Gossip struct {
+	Node   string       `json:"node"`
+	At     int64        `json:"at"`
+	Relays []RelayScore `json:"relays"` // its top relays, best first
+}
+
+// Forward is an event handed to the member owning some of its relays
+type Forward struct {
+	Node   string       `json:"node"`
+	Event  *nostr.Event `json:"event"`
+	Relays []string     `json:"relays"` // the relays the receiving member publishes it to
+}
+
+// Queue is where events handed over by peers are broadcast from (implemented by
+// *broadcaster.Broadcaster)
+type Queue interface {
+	IsEventCached(eventID string) bool
+	BroadcastBatch(batch []broadcaster.BatchEvent) int
+}
+
+// handoff is the share of an event a peer handed to this member
+type handoff struct {
+	relays []string
+	at     time.Time
+}
+
+type peer struct {
+	url      string
+	node     string
+	gossip   *Gossip
+	lastSeen time.Time
+	lastErr  string
+}
+
+// Federation wraps the broadcaster's relay provider with the federation-wide top set and
+// implements broadcaster.RelayFilter to keep only the relays this member owns
+type Federation struct {
+	cfg     Config
+	inner   broadcaster.RelayProvider
+	manager manager.RelayManager
+	client  *http.Client
+
+	mu    sync.RWMutex
+	peers []*peer
+
+	queue    Queue
+	handoffs sync.Map // event ID -> handoff
+
+	kept            int64 // relay publishes this member kept
+	handedOff       int64 // relay publishes left to other members
+	fallbacks       int64 // events published to every relay while the view was stale
+	forwards        int64 // shares of events handed to a peer
+	forwardFailures int64 // hand-offs that failed, their relays published here instead
+	received        int64 // events peers handed to this member
+	exchanges       int64
+	failures        int64
+}
+
+// New returns a Federation ranking with mgr's scores and choosing from inner's relays; Run
+// gossips with the peers. nil if no peers are configured
+func New(cfg Config, inner broadcaster.RelayProvider, mgr manager.RelayManager) *Federation {
+	if len(cfg.Peers) == 0 {
+		return nil
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	logging.DebugMethod("federation", "New", "Initializing federation: node=%s, %d peers, interval=%v",
+		cfg.NodeID, len(cfg.Peers), cfg.Interval)
+
+	f := &Federation{
+		cfg:     cfg,
+		inner:   inner,
+		manager: mgr,
+		client:  &http.Client{Timeout: fetchTimeout},
+	}
+	for _, url := range cfg.Peers {
+		f.peers = append(f.peers, &peer{url: strings.TrimRight(url, "/")})
+	}
+	return f
+}
+
+// SetQueue sets where events handed over by peers are broadcast from
+func (f *Federation) SetQueue(queue Queue) {
+	f.queue = queue
+}
+
+// Run pulls the gossip of the peers every interval until ctx is canceled
+func (f *Federation) Run(ctx context.Context) {
+	f.exchange()
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.exchange()
+			f.pruneHandoffs()
+		}
+	}
+}
+
+// pruneHandoffs forgets the hand-offs of events that never reached the relay filters
+func (f *Federation) pruneHandoffs() {
+	cutoff := time.Now().Add(-handoffTTL)
+	f.handoffs.Range(func(id, value any) bool {
+		if value.(handoff).at.Before(cutoff) {
+			f.handoffs.Delete(id)
+		}
+		return true
+	})
+}
+
+// exchange pulls the gossip of every peer concurrently
+func (f *Federation) exchange() {
+	var wg sync.WaitGroup
+	for _, p := range f.peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			gossip, err := f.fetch(p.url)
+			atomic.AddInt64(&f.exchanges, 1)
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if err != nil {
+				atomic.AddInt64(&f.failures, 1)
+				if p.lastErr == "" {
+					logging.Warn("Federation: Peer %s unreachable: %v", p.url, err)
+				}
+				p.lastErr = err.Error()
+				return
+			}
+			if gossip.Node == f.cfg.NodeID {
+				p.lastErr = "peer uses our node ID " + gossip.Node
+				logging.Error("Federation: Peer %s has the same node ID %q, ignoring it", p.url, gossip.Node)
+				return
+			}
+			if p.lastSeen.IsZero() || p.lastErr != "" {
+				logging.Info("Federation: Peer %s (node %s) joined with %d relays", p.url, gossip.Node, len(gossip.Relays))
+			}
+			p.node, p.gossip, p.lastSeen, p.lastErr = gossip.Node, gossip, time.Now(), ""
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (f *Federation) fetch(url string) (*Gossip, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+GossipPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.cfg.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+f.cfg.Secret)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gossip answered %s", resp.Status)
+	}
+	var gossip Gossip
+	if err := stdjson.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&gossip); err != nil {
+		return nil, fmt.Errorf("invalid gossip: %w", err)
+	}
+	if gossip.Node == "" {
+		return nil, fmt.Errorf("gossip without node ID")
+	}
+	return &gossip, nil
+}
+
+// livePeers returns the gossip of the peers heard from within peerTTL intervals
+func (f *Federation) livePeers() []*Gossip {
+	cutoff := time.Now().Add(-peerTTL * f.cfg.Interval)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	live := make([]*Gossip, 0, len(f.peers))
+	for _, p := range f.peers {
+		if p.gossip != nil && p.lastSeen.After(cutoff) {
+			live = append(live, p.gossip)
+		}
+	}
+	return live
+}
+
+// members returns the node IDs of this member and its live peers
+func (f *Federation) members() []string {
+	members := []string{f.cfg.NodeID}
+	for _, gossip := range f.livePeers() {
+		members = append(members, gossip.Node)
+	}
+	return members
+}
+
+// stale reports whether a peer still in the partition missed its last exchange: members may then
+// own relays differently than this one. Peers past peerTTL have departed and do not count.
+func (f *Federation) stale() bool {
+	now := time.Now()
+	departed := now.Add(-peerTTL * f.cfg.Interval)
+	fresh := now.Add(-2 * f.cfg.Interval)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range f.peers {
+		if p.gossip == nil || !p.lastSeen.After(departed) {
+			continue
+		}
+		if p.lastErr != "" || p.lastSeen.Before(fresh) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerURL returns the base URL of the live peer with node ID node, "" if there is none
+func (f *Federation) peerURL(node string) string {
+	cutoff := time.Now().Add(-peerTTL * f.cfg.Interval)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range f.peers {
+		if p.node == node && p.gossip != nil && p.lastSeen.After(cutoff) {
+			return p.url
+		}
+	}
+	return ""
+}
+
+// owner picks the member responsible for url: the highest hash of member and URL (rendezvous
+// hashing), so members joining or leaving only move the relays they gain or lose
+func owner(members []string, url string) string {
+	var best string
+	var bestHash uint64
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(member))
+		h.Write([]byte{0})
+		h.Write([]byte(url))
+		if sum := h.Sum64(); best == "" || sum > bestHash {
+			best, bestHash = member, sum
+		}
+	}
+	return best
+}
+
+// Owns reports whether this member publishes to url
+func (f *Federation) Owns(url string) bool {
+	return owner(f.members(), url) == f.cfg.NodeID
+}
+
+// localScores returns the scores of this member's relays, in the inner provider's order
+func (f *Federation) localScores(ctx context.Context, urls []string) []RelayScore {
+	scores := make([]RelayScore, 0, len(urls))
+	for _, url := range urls {
+		score := RelayScore{URL: url}
+		if info, err := f.manager.GetRelayInfo(ctx, url); err == nil {
+			score.SuccessRate = info.SuccessRate
+			score.AvgResponseMs = info.AvgResponseTime.Milliseconds()
+		}
+		scores = append(scores, score)
+	}
+	return scores
+}
+
+// GetBroadcastRelays returns the federation-wide top set, sized like the inner provider's
+func (f *Federation) GetBroadcastRelays(ctx context.Context) ([]string, error) {
+	local, err := f.inner.GetBroadcastRelays(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.merge(ctx, local, len(local)), nil
+}
+
+// GetBroadcastRelaysN returns the federation-wide best n relays
+func (f *Federation) GetBroadcastRelaysN(ctx context.Context, n int) ([]string, error) {
+	var local []string
+	var err error
+	if sized, ok := f.inner.(broadcaster.SizedRelayProvider); ok {
+		local, err = sized.GetBroadcastRelaysN(ctx, n)
+	} else {
+		local, err = f.inner.GetBroadcastRelays(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.merge(ctx, local, n), nil
+}
+
+// merge ranks the union of the local top set and every live peer's by mean reported success
+// rate (then mean latency) and returns the best n, so all members converge on the same set
+func (f *Federation) merge(ctx context.Context, local []string, n int) []string {
+	peers := f.livePeers()
+	if len(peers) == 0 {
+		return local
+	}
+
+	type merged struct {
+		url     string
+		rate    float64
+		latency int64
+		reports int
+	}
+	byURL := make(map[string]*merged)
+	add := func(scores []RelayScore) {
+		for _, s := range scores {
+			m := byURL[s.URL]
+			if m == nil {
+				m = &merged{url: s.URL}
+				byURL[s.URL] = m
+			}
+			m.rate += s.SuccessRate
+			m.latency += s.AvgResponseMs
+			m.reports++
+		}
+	}
+	add(f.localScores(ctx, local))
+	for _, gossip := range peers {
+		add(gossip.Relays)
+	}
+
+	ranked := make([]*merged, 0, len(byURL))
+	for _, m := range byURL {
+		m.rate /= float64(m.reports)
+		m.latency /= int64(m.reports)
+		ranked = append(ranked, m)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].rate != ranked[j].rate {
+			return ranked[i].rate > ranked[j].rate
+		}
+		if ranked[i].latency != ranked[j].latency {
+			return ranked[i].latency < ranked[j].latency
+		}
+		return ranked[i].url < ranked[j].url
+	})
+	if n > 0 && len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	urls := make([]string, len(ranked))
+	for i, m := range ranked {
+		urls[i] = m.url
+	}
+	return urls
+}
+
+// FilterRelays keeps the relays this member owns, mandatory ones included, and hands every other
+// member its share; a share whose owner cannot be reached is kept. An event a peer handed over
+// goes to the relays it was handed with. With a stale view all relays are kept.
+func (f *Federation) FilterRelays(event *nostr.Event, relays []string) []string {
+	if value, ok := f.handoffs.LoadAndDelete(event.ID); ok {
+		kept := value.(handoff).relays
+		atomic.AddInt64(&f.kept, int64(len(kept)))
+		return kept
+	}
+
+	shares, stale := f.partition(relays)
+	if stale {
+		atomic.AddInt64(&f.fallbacks, 1)
+		logging.DebugMethod("federation", "FilterRelays", "Stale federation view, publishing event %s to all %d relays",
+			event.ID, len(relays))
+	}
+	kept := append(shares[f.cfg.NodeID], f.handOff(event, shares)...)
+	atomic.AddInt64(&f.kept, int64(len(kept)))
+	atomic.AddInt64(&f.handedOff, int64(len(relays)-len(kept)))
+	return kept
+}
+
+// PlanRelays is FilterRelays for a dry run: nothing is handed over or counted
+func (f *Federation) PlanRelays(event *nostr.Event, relays []string) []string {
+	if value, ok := f.handoffs.Load(event.ID); ok {
+		return value.(handoff).relays
+	}
+	shares, _ := f.partition(relays)
+	return shares[f.cfg.NodeID]
+}
+
+// partition splits relays by owning member; with a stale view this member owns them all
+func (f *Federation) partition(relays []string) (map[string][]string, bool) {
+	if f.stale() {
+		return map[string][]string{f.cfg.NodeID: relays}, true
+	}
+	members := f.members()
+	if len(members) == 1 {
+		return map[string][]string{f.cfg.NodeID: relays}, false
+	}
+	shares := make(map[string][]string, len(members))
+	for _, url := range relays {
+		node := owner(members, url)
+		shares[node] = append(shares[node], url)
+	}
+	return shares, false
+}
+
+// handOff sends every other member its share of event concurrently and returns the relays of
+// the members that could not be reached
+func (f *Federation) handOff(event *nostr.Event, shares map[string][]string) []string {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unreached []string
+	for node, relays := range shares {
+		if node == f.cfg.NodeID {
+			continue
+		}
+		wg.Add(1)
+		go func(node string, relays []string) {
+			defer wg.Done()
+			atomic.AddInt64(&f.forwards, 1)
+			if err := f.forward(node, event, relays); err != nil {
+				atomic.AddInt64(&f.forwardFailures, 1)
+				logging.Warn("Federation: Failed to hand event %s to node %s, publishing its %d relays here: %v",
+					event.ID, node, len(relays), err)
+				mu.Lock()
+				unreached = append(unreached, relays...)
+				mu.Unlock()
+			}
+		}(node, relays)
+	}
+	wg.Wait()
+	return unreached
+}
+
+// forward hands event to node for relays
+func (f *Federation) forward(node string, event *nostr.Event, relays []string) error {
+	url := f.peerURL(node)
+	if url == "" {
+		return fmt.Errorf("node is not live")
+	}
+	body, err := stdjson.Marshal(Forward{Node: f.cfg.NodeID, Event: event, Relays: relays})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+ForwardPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.cfg.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+f.cfg.Secret)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hand-off answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Gossip returns what this member tells its peers: its own (not federation-wide) top relays
+func (f *Federation) Gossip(ctx context.Context) *Gossip {
+	local, err := f.inner.GetBroadcastRelays(ctx)
+	if err != nil {
+		logging.Warn("Federation: Failed to list top relays for gossip: %v", err)
+	}
+	return &Gossip{Node: f.cfg.NodeID, At: time.Now().Unix(), Relays: f.localScores(ctx, local)}
+}
+
+// ServeHTTP answers peers' gossip requests (GET GossipPath) and hand-offs (POST ForwardPath)
+func (f *Federation) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	method := http.MethodGet
+	if req.URL.Path == ForwardPath {
+		method = http.MethodPost
+	}
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if f.cfg.Secret != "" {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(f.cfg.Secret)) != 1 {
+			logging.Warn("Federation: Unauthorized %s request from %s", req.URL.Path, req.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if req.URL.Path == ForwardPath {
+		f.serveForward(w, req)
+		return
+	}
+	body, err := stdjson.Marshal(f.Gossip(req.Context()))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// serveForward queues an event a peer handed over for the relays it came with
+func (f *Federation) serveForward(w http.ResponseWriter, req *http.Request) {
+	if f.queue == nil {
+		http.Error(w, "Not accepting events", http.StatusServiceUnavailable)
+		return
+	}
+	var fwd Forward
+	if err := stdjson.NewDecoder(io.LimitReader(req.Body, 4<<20)).Decode(&fwd); err != nil || fwd.Event == nil {
+		http.Error(w, "Invalid hand-off", http.StatusBadRequest)
+		return
+	}
+	if ok, err := fwd.Event.CheckSignature(); !fwd.Event.CheckID() || !ok || err != nil {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	// Already broadcast from here (this member got it too), its relays partitioned with the rest
+	if f.queue.IsEventCached(fwd.Event.ID) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"queued":false}`)
+		return
+	}
+
+	// Stored before queueing, so the relay filters find it
+	f.handoffs.Store(fwd.Event.ID, handoff{relays: fwd.Relays, at: time.Now()})
+	if f.queue.BroadcastBatch([]broadcaster.BatchEvent{{Event: fwd.Event}}) == 0 {
+		// Shutting down, fast path full or queued meanwhile: the sender publishes the share itself
+		f.handoffs.Delete(fwd.Event.ID)
+		http.Error(w, "Queue full", http.StatusServiceUnavailable)
+		return
+	}
+	atomic.AddInt64(&f.received, 1)
+	logging.DebugMethod("federation", "serveForward", "Node %s handed over event %s for %d relays",
+		fwd.Node, fwd.Event.ID, len(fwd.Relays))
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"queued":true}`)
+}
+
+// GetStatsName returns the name for this stats provider
+func (f *Federation) GetStatsName() string {
+	return "federation"
+}
+
+// GetStats returns membership and partition counters as a JsonEntity
+func (f *Federation) GetStats() json.JsonEntity {
+	cutoff := time.Now().Add(-peerTTL * f.cfg.Interval)
+	peers := json.NewJsonList()
+	live := 1
+	f.mu.RLock()
+	for _, p := range f.peers {
+		obj := json.NewJsonObject()
+		obj.Set("url", json.NewJsonValue(p.url))
+		obj.Set("node", json.NewJsonValue(p.node))
+		isLive := p.gossip != nil && p.lastSeen.After(cutoff)
+		if isLive {
+			live++
+		}
+		obj.Set("live", json.NewJsonValue(isLive))
+		if !p.lastSeen.IsZero() {
+			obj.Set("last_seen", json.NewJsonValue(p.lastSeen.Unix()))
+		}
+		if p.gossip != nil {
+			obj.Set("relays", json.NewJsonValue(len(p.gossip.Relays)))
+		}
+		if p.lastErr != "" {
+			obj.Set("error", json.NewJsonValue(p.lastErr))
+		}
+		peers.Append(obj)
+	}
+	f.mu.RUnlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("node", json.NewJsonValue(f.cfg.NodeID))
+	obj.Set("members", json.NewJsonValue(live))
+	obj.Set("stale", json.NewJsonValue(f.stale()))
+	obj.Set("interval_seconds", json.NewJsonValue(f.cfg.Interval.Seconds()))
+	obj.Set("peers", peers)
+	obj.Set("publishes_kept", json.NewJsonValue(atomic.LoadInt64(&f.kept)))
+	obj.Set("publishes_handed_off", json.NewJsonValue(atomic.LoadInt64(&f.handedOff)))
+	obj.Set("stale_fallbacks", json.NewJsonValue(atomic.LoadInt64(&f.fallbacks)))
+	obj.Set("hand_offs", json.NewJsonValue(atomic.LoadInt64(&f.forwards)))
+	obj.Set("hand_off_failures", json.NewJsonValue(atomic.LoadInt64(&f.forwardFailures)))
+	obj.Set("hand_offs_received", json.NewJsonValue(atomic.LoadInt64(&f.received)))
+	obj.Set("exchanges", json.NewJsonValue(atomic.LoadInt64(&f.exchanges)))
+	obj.Set("exchange_failures", json.NewJsonValue(atomic.LoadInt64(&f.failures)))
+	return obj
+}
@@ -0,0 +1,253 @@
+// Package feedback records destination relays rejecting an author's events as "blocked" and,
+// depending on policy, stops sending that author's events to those relays or anywhere at all,
+// so one spammer cannot ruin the broadcaster's reputation with the big relays.
+package feedback
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Policies for authors that destination relays block
+const (
+	PolicyRecord = "record" // only record and expose counts
+	PolicyRelay  = "relay"  // stop sending the author's events to relays that block them
+	PolicyGlobal = "global" // additionally reject the author at ingest once enough relays block them
+)
+
+// Config controls the feedback loop
+type Config struct {
+	Policy          string
+	Threshold       int           // "blocked" rejections from one relay before that author/relay pair is suppressed
+	GlobalThreshold int           // distinct blocking relays before the author is rejected entirely (PolicyGlobal)
+	Expiry          time.Duration // how long a block record lasts after the last rejection
+}
+
+// pruneInterval is how often recording a rejection also drops the expired block records
+const pruneInterval = time.Minute
+
+type blockRecord struct {
+	count int
+	last  time.Time
+}
+
+// Tracker implements broadcaster.BroadcastReporter and broadcaster.RelayFilter
+type Tracker struct {
+	cfg Config
+
+	mu       sync.RWMutex
+	byAuthor map[string]map[string]*blockRecord // author -> relay URL -> record
+	pruned   time.Time                          // last pruneLocked
+
+	blockedResponses int64
+	skippedPublishes int64
+	rejectedEvents   int64
+}
+
+// New returns a Tracker for cfg; zero values take the defaults (3, 3, 24h), unknown policies
+// and negative values are an error
+func New(cfg Config) (*Tracker, error) {
+	switch cfg.Policy {
+	case PolicyRecord, PolicyRelay, PolicyGlobal:
+	default:
+		return nil, fmt.Errorf("unknown policy %q (expected %s, %s or %s)", cfg.Policy, PolicyRecord, PolicyRelay, PolicyGlobal)
+	}
+	if cfg.Threshold < 0 || cfg.GlobalThreshold < 0 || cfg.Expiry < 0 {
+		return nil, fmt.Errorf("negative threshold (%d), global threshold (%d) or expiry (%v)", cfg.Threshold, cfg.GlobalThreshold, cfg.Expiry)
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = 3
+	}
+	if cfg.GlobalThreshold == 0 {
+		cfg.GlobalThreshold = 3
+	}
+	if cfg.Expiry == 0 {
+		cfg.Expiry = 24 * time.Hour
+	}
+	logging.DebugMethod("feedback", "New", "Initializing abuse feedback: policy=%s, threshold=%d, global=%d, expiry=%v",
+		cfg.Policy, cfg.Threshold, cfg.GlobalThreshold, cfg.Expiry)
+	return &Tracker{
+		cfg:      cfg,
+		byAuthor: make(map[string]map[string]*blockRecord),
+		pruned:   time.Now(),
+	}, nil
+}
+
+// isBlockedResponse reports whether a publish error is a NIP-01 "blocked:" rejection
+func isBlockedResponse(errMsg string) bool {
+	return strings.Contains(strings.ToLower(errMsg), "blocked:")
+}
+
+// BroadcastPlanned is a no-op; only results matter
+func (t *Tracker) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted records "blocked" rejections for the event's author
+func (t *Tracker) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	author := report.Event.PubKey
+	now := time.Now()
+	for _, res := range report.Results {
+		if res.Success || !isBlockedResponse(res.Error) {
+			continue
+		}
+		atomic.AddInt64(&t.blockedResponses, 1)
+
+		t.mu.Lock()
+		relays, ok := t.byAuthor[author]
+		if !ok {
+			relays = make(map[string]*blockRecord)
+			t.byAuthor[author] = relays
+		}
+		rec, ok := relays[res.URL]
+		if !ok || now.Sub(rec.last) > t.cfg.Expiry {
+			rec = &blockRecord{}
+			relays[res.URL] = rec
+		}
+		rec.count++
+		rec.last = now
+		count := rec.count
+		if now.Sub(t.pruned) >= pruneInterval {
+			t.pruneLocked(now)
+		}
+		t.mu.Unlock()
+
+		if count == t.cfg.Threshold {
+			logging.Warn("Feedback: %s blocked author %s %d times (%s)", res.URL, author, count, res.Error)
+		}
+	}
+}
+
+// pruneLocked drops the block records that expired, and authors left without any
+func (t *Tracker) pruneLocked(now time.Time) {
+	for author, relays := range t.byAuthor {
+		for url, rec := range relays {
+			if now.Sub(rec.last) > t.cfg.Expiry {
+				delete(relays, url)
+			}
+		}
+		if len(relays) == 0 {
+			delete(t.byAuthor, author)
+		}
+	}
+	t.pruned = now
+}
+
+// suppressedLocked reports whether rec is over threshold and not expired
+func (t *Tracker) suppressedLocked(rec *blockRecord, now time.Time) bool {
+	return rec.count >= t.cfg.Threshold && now.Sub(rec.last) <= t.cfg.Expiry
+}
+
+// FilterRelays drops relays that keep blocking the event's author (PolicyRelay and PolicyGlobal)
+func (t *Tracker) FilterRelays(event *nostr.Event, relays []string) []string {
+	return t.filterRelays(event, relays, true)
+}
+
+// PlanRelays is FilterRelays for a dry run: skipped publishes are not counted
+func (t *Tracker) PlanRelays(event *nostr.Event, relays []string) []string {
+	return t.filterRelays(event, relays, false)
+}
+
+func (t *Tracker) filterRelays(event *nostr.Event, relays []string, count bool) []string {
+	if t.cfg.Policy != PolicyRelay && t.cfg.Policy != PolicyGlobal {
+		return relays
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	blocked, ok := t.byAuthor[event.PubKey]
+	if !ok {
+		return relays
+	}
+
+	now := time.Now()
+	result := make([]string, 0, len(relays))
+	for _, url := range relays {
+		if rec, ok := blocked[url]; ok && t.suppressedLocked(rec, now) {
+			if count {
+				atomic.AddInt64(&t.skippedPublishes, 1)
+			}
+			continue
+		}
+		result = append(result, url)
+	}
+	if len(result) < len(relays) {
+		logging.DebugMethod("feedback", "FilterRelays", "Skipping %d relays that block author %s for event %s",
+			len(relays)-len(result), event.PubKey, event.ID)
+	}
+	return result
+}
+
+// IsAuthorBlocked reports whether enough relays block pubkey to reject it at ingest (PolicyGlobal only)
+func (t *Tracker) IsAuthorBlocked(pubkey string) bool {
+	if t.cfg.Policy != PolicyGlobal {
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now()
+	blockingRelays := 0
+	for _, rec := range t.byAuthor[pubkey] {
+		if t.suppressedLocked(rec, now) {
+			blockingRelays++
+		}
+	}
+	if blockingRelays >= t.cfg.GlobalThreshold {
+		atomic.AddInt64(&t.rejectedEvents, 1)
+		return true
+	}
+	return false
+}
+
+// GetStatsName returns the name for this stats provider
+func (t *Tracker) GetStatsName() string {
+	return "feedback"
+}
+
+// GetStats returns abuse feedback statistics as a JsonEntity
+func (t *Tracker) GetStats() json.JsonEntity {
+	t.mu.RLock()
+	now := time.Now()
+	suppressedPairs := 0
+	globallyBlocked := 0
+	trackedAuthors := 0
+	for _, relays := range t.byAuthor {
+		blocking, live := 0, 0
+		for _, rec := range relays {
+			if now.Sub(rec.last) > t.cfg.Expiry {
+				continue // pruned on a later rejection
+			}
+			live++
+			if t.suppressedLocked(rec, now) {
+				blocking++
+			}
+		}
+		if live > 0 {
+			trackedAuthors++
+		}
+		suppressedPairs += blocking
+		if blocking >= t.cfg.GlobalThreshold {
+			globallyBlocked++
+		}
+	}
+	t.mu.RUnlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("policy", json.NewJsonValue(t.cfg.Policy))
+	obj.Set("tracked_authors", json.NewJsonValue(trackedAuthors))
+	obj.Set("suppressed_author_relay_pairs", json.NewJsonValue(suppressedPairs))
+	obj.Set("authors_over_global_threshold", json.NewJsonValue(globallyBlocked))
+	obj.Set("blocked_responses", json.NewJsonValue(atomic.LoadInt64(&t.blockedResponses)))
+	obj.Set("skipped_publishes", json.NewJsonValue(atomic.LoadInt64(&t.skippedPublishes)))
+	obj.Set("rejected_events", json.NewJsonValue(atomic.LoadInt64(&t.rejectedEvents)))
+	return obj
+}
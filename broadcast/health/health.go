@@ -0,0 +1,312 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/girino/nostr-brodcast-relay/broadcast/backoff"
+	"github.com/girino/nostr-brodcast-relay/broadcast/budget"
+	"github.com/girino/nostr-brodcast-relay/broadcast/bus"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/broadcast/netdiag"
+	"github.com/girino/nostr-brodcast-relay/broadcast/onion"
+	"github.com/girino/nostr-brodcast-relay/broadcast/requirements"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// onionProbeTimeout is the shortest time a probe of a .onion relay gets
+const onionProbeTimeout = 30 * time.Second
+
+type Checker struct {
+	manager        manager.RelayManager
+	initialTimeout time.Duration
+	offline        bool             // TEST_MODE: mark relays healthy without connecting
+	budget         *budget.Budget   // probes yield to publishes (nil = unlimited)
+	results        *bus.Bus         // probe results for in-process subscribers (nil = none)
+	backoff        *backoff.Tracker // hosts throttling us over HTTP are not probed (nil = none)
+	capabilities   CapabilityProbe  // NIP-11 limitations of reachable relays (nil = not fetched)
+	onion          *onion.Proxy     // .onion relays are probed through it (nil = direct)
+
+	// Probe counters
+	checks    int64
+	succeeded int64
+	failed    int64
+	skipped   int64 // hosts backed off
+	batches   int64
+	unusable  int64 // checks finding a relay whose NIP-11 limitations rule out our events
+}
+
+func NewChecker(mgr manager.RelayManager, initialTimeout time.Duration) *Checker {
+	logging.DebugMethod("health", "NewChecker", "Initializing health checker with timeout=%v", initialTimeout)
+	return &Checker{
+		manager:        mgr,
+		initialTimeout: initialTimeout,
+	}
+}
+
+// SetOffline makes checks succeed without touching the network (TEST_MODE)
+func (c *Checker) SetOffline(offline bool) {
+	c.offline = offline
+}
+
+// SetBudget makes probes take low-priority slots from the outbound budget shared with publishes
+func (c *Checker) SetBudget(outbound *budget.Budget) {
+	c.budget = outbound
+}
+
+// SetBus publishes every probe result on results
+func (c *Checker) SetBus(results *bus.Bus) {
+	c.results = results
+}
+
+// SetBackoff skips probes to hosts backed off in tracker and backs off hosts answering a probe
+// with 429/503
+func (c *Checker) SetBackoff(tracker *backoff.Tracker) {
+	c.backoff = tracker
+}
+
+// SetOnionProxy makes checks of .onion relays go through torProxy, allowing them at least
+// onionProbeTimeout since Tor circuits take a while to build
+func (c *Checker) SetOnionProxy(torProxy *onion.Proxy) {
+	c.onion = torProxy
+}
+
+// CapabilityProbe fetches a relay's NIP-11 limitations; implemented by *requirements.Checker
+type CapabilityProbe interface {
+	// Probe returns url's requirements and why it would reject every event we publish ("" if it
+	// may accept some)
+	Probe(url string) (requirements.Requirements, string)
+}
+
+// SetCapabilities makes successful initial checks also fetch the relay's NIP-11 document and
+// record its limitations in the manager, which keeps relays that would never accept our events
+// out of the top N
+func (c *Checker) SetCapabilities(probe CapabilityProbe) {
+	c.capabilities = probe
+}
+
+// CheckInitial performs initial timeout-based health check on a relay
+func (c *Checker) CheckInitial(url string) bool {
+	return c.Check(context.Background(), url)
+}
+
+// Check tests a relay like CheckInitial. A check canceled through ctx, while waiting for the
+// outbound budget or connecting, is skipped without recording anything against the relay.
+func (c *Checker) Check(ctx context.Context, url string) bool {
+	logging.DebugMethod("health", "CheckInitial", "Testing relay: %s", url)
+
+	if c.offline {
+		c.record(url, true, 0, nil)
+		return true
+	}
+
+	// A probe now would only be throttled again and tell us nothing new
+	if err := c.backoff.Check(url); err != nil {
+		logging.DebugMethod("health", "CheckInitial", "Skipping %s: %v", url, err)
+		atomic.AddInt64(&c.skipped, 1)
+		return false
+	}
+
+	// Wait for live broadcast traffic to leave room; the timeout only starts once we probe
+	if err := c.budget.Acquire(ctx, budget.Probe); err != nil {
+		logging.DebugMethod("health", "CheckInitial", "Skipping %s: %v", url, err)
+		atomic.AddInt64(&c.skipped, 1)
+		return false
+	}
+	defer c.budget.Release(budget.Probe)
+
+	timeout := c.initialTimeout
+	if c.onion != nil && onion.IsOnion(url) {
+		timeout = max(timeout, onionProbeTimeout)
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	disconnect, err := c.connect(checkCtx, url)
+	if err != nil && ctx.Err() != nil {
+		atomic.AddInt64(&c.skipped, 1)
+		return false
+	}
+	if err != nil {
+		elapsed := time.Since(start)
+		if throttled := backoff.FromError(url, err); throttled != nil {
+			// go-nostr drops the upgrade response, so there is no Retry-After to honor here
+			err = c.backoff.Throttle(throttled)
+		}
+		logging.DebugMethod("health", "CheckInitial", "Failed to connect to %s | error=%v | time=%.2fms", url, err, elapsed.Seconds()*1000)
+		c.record(url, false, elapsed, err)
+		return false
+	}
+	defer disconnect()
+
+	elapsed := time.Since(start)
+	c.backoff.Succeeded(url)
+
+	// Consider it successful if we connected
+	c.record(url, true, elapsed, nil)
+	logging.DebugMethod("health", "CheckInitial", "Connected successfully to %s | time=%.2fms", url, elapsed.Seconds()*1000)
+	c.probeCapabilities(url)
+	return true
+}
+
+// probeCapabilities records the NIP-11 limitations of a relay that just answered a check
+func (c *Checker) probeCapabilities(url string) {
+	if c.capabilities == nil {
+		return
+	}
+	req, excluded := c.capabilities.Probe(url)
+	if req.Err != "" {
+		return // no document: nothing learned, the relay is judged by its publishes
+	}
+	caps := manager.Capabilities{
+		PaymentRequired:  req.PaymentRequired,
+		AuthRequired:     req.AuthRequired,
+		MinPow:           req.MinPow,
+		MaxMessageLength: req.MaxMessageLength,
+		SupportedNIPs:    req.SupportedNIPs,
+		FetchedAt:        req.FetchedAt,
+		Excluded:         excluded,
+	}
+	if err := c.manager.SetCapabilities(context.Background(), url, caps); err != nil {
+		logging.Warn("Health: Failed to record capabilities of %s: %v", url, err)
+		return
+	}
+	if excluded != "" {
+		atomic.AddInt64(&c.unusable, 1)
+		logging.DebugMethod("health", "probeCapabilities", "%s would reject every event (%s), keeping it out of the top relays", url, excluded)
+	}
+}
+
+// connect opens a connection to url, through the Tor proxy for .onion relays, and returns how
+// to close it
+func (c *Checker) connect(ctx context.Context, url string) (func(), error) {
+	if c.onion != nil && onion.IsOnion(url) {
+		conn, err := c.onion.Dial(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return func() { conn.Close(ws.StatusNormalClosure, "") }, nil
+	}
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return func() { relay.Close() }, nil
+}
+
+// record stores a probe outcome in the manager and publishes it on the bus. Failed probes
+// don't count towards the average response time; throttled probes only show up in the
+// failure breakdown, since the relay is up and merely asked us to slow down.
+func (c *Checker) record(url string, success bool, elapsed time.Duration, err error) {
+	// Not the probe's context: it may have expired with the probe itself
+	ctx := context.Background()
+	responseTime := elapsed
+	atomic.AddInt64(&c.checks, 1)
+	if success {
+		atomic.AddInt64(&c.succeeded, 1)
+	} else {
+		responseTime = 0
+		atomic.AddInt64(&c.failed, 1)
+	}
+	if !success && netdiag.Soft(netdiag.Classify(err)) {
+		if recordErr := c.manager.RecordFailure(ctx, url, err); recordErr != nil {
+			logging.Warn("Health: Failed to record failure of %s: %v", url, recordErr)
+		}
+	} else if updateErr := c.manager.UpdateHealth(ctx, url, success, responseTime); updateErr != nil {
+		logging.Warn("Health: Failed to record check of %s: %v", url, updateErr)
+	} else if !success {
+		if recordErr := c.manager.RecordFailure(ctx, url, err); recordErr != nil {
+			logging.Warn("Health: Failed to record failure of %s: %v", url, recordErr)
+		}
+	}
+	c.results.Report(bus.HealthCheck, url, success, elapsed, err)
+}
+
+// CheckBatch performs initial checks on multiple relays concurrently
+func (c *Checker) CheckBatch(urls []string) {
+	c.CheckBatchContext(context.Background(), urls)
+}
+
+// CheckBatchContext is CheckBatch with the checks skipped once ctx is canceled
+func (c *Checker) CheckBatchContext(ctx context.Context, urls []string) {
+	logging.DebugMethod("health", "CheckBatch", "Starting batch health check of %d relays (max 20 concurrent)", len(urls))
+	atomic.AddInt64(&c.batches, 1)
+
+	sem := make(chan struct{}, 20) // Limit concurrent checks
+	var wg sync.WaitGroup
+	successCount := 0
+	failCount := 0
+	var mu sync.Mutex
+
+	start := time.Now()
+
+	for _, url := range urls {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			sem <- struct{}{}        // Acquire semaphore
+			defer func() { <-sem }() // Release semaphore
+
+			success := c.Check(ctx, u)
+			mu.Lock()
+			if success {
+				successCount++
+			} else {
+				failCount++
+			}
+			mu.Unlock()
+		}(url)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Always log the summary
+	logging.Info("Health: Batch check complete - %d success, %d failed out of %d total (%.2fs)",
+		successCount, failCount, len(urls), elapsed.Seconds())
+}
+
+// GetStatsName returns the name for this stats provider
+func (c *Checker) GetStatsName() string {
+	return "health"
+}
+
+// GetStats returns probe counters as a JsonEntity
+func (c *Checker) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("checks", json.NewJsonValue(atomic.LoadInt64(&c.checks)))
+	obj.Set("succeeded", json.NewJsonValue(atomic.LoadInt64(&c.succeeded)))
+	obj.Set("failed", json.NewJsonValue(atomic.LoadInt64(&c.failed)))
+	obj.Set("skipped_backoff", json.NewJsonValue(atomic.LoadInt64(&c.skipped)))
+	obj.Set("batches", json.NewJsonValue(atomic.LoadInt64(&c.batches)))
+	obj.Set("unusable", json.NewJsonValue(atomic.LoadInt64(&c.unusable)))
+	obj.Set("initial_timeout_ms", json.NewJsonValue(c.initialTimeout.Milliseconds()))
+	obj.Set("offline", json.NewJsonValue(c.offline))
+	return obj
+}
+
+// PublishResult tracks the result of a publish attempt
+type PublishResult struct {
+	URL          string
+	Success      bool
+	ResponseTime time.Duration
+	Error        error
+}
+
+// TrackPublishResult updates relay health based on publish results
+func (c *Checker) TrackPublishResult(result PublishResult) {
+	err := c.manager.TrackPublishResult(context.Background(), result.URL, result.Success, result.ResponseTime, result.Error)
+	if err != nil {
+		logging.Warn("Health: Failed to track publish result of %s: %v", result.URL, err)
+	}
+
+	if !result.Success && result.Error != nil {
+		logging.DebugMethod("health", "TrackPublishResult", "Publish to %s failed: %v", result.URL, result.Error)
+	}
+}
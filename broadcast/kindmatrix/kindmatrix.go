@@ -0,0 +1,217 @@
+// Package kindmatrix keeps a kind x relay success-rate matrix of the publishes of a rolling
+// window, so an operator can see at a glance that a relay silently drops one kind while
+// accepting others. The window is split in slots; each relay/kind cell counts attempts and
+// successes per slot, and slots older than the window are dropped.
+package kindmatrix
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// slotCount is the number of slots the window is split in
+const slotCount = 12
+
+// cell counts the publishes of one kind to one relay per slot
+type cell struct {
+	slot      [slotCount]int64 // slot number each entry counts, to recognize stale entries
+	attempts  [slotCount]int64
+	successes [slotCount]int64
+}
+
+// totals returns the counts of the slots still in the window ending at slot now
+func (c *cell) totals(now int64) (attempts, successes int64) {
+	for i := range c.slot {
+		if c.slot[i] > now-slotCount {
+			attempts += c.attempts[i]
+			successes += c.successes[i]
+		}
+	}
+	return attempts, successes
+}
+
+// Query selects part of the matrix
+type Query struct {
+	Relay       string // only this relay ("" = all)
+	Kind        int    // only this kind (-1 = all)
+	MinAttempts int64  // leave out cells with fewer attempts
+}
+
+// Matrix implements broadcaster.BroadcastReporter
+type Matrix struct {
+	window   time.Duration
+	slotSize time.Duration
+
+	mu        sync.Mutex
+	cells     map[string]map[int]*cell // relay URL -> kind -> counts
+	lastPrune int64
+}
+
+// New returns a matrix over window (default 24h)
+func New(window time.Duration) *Matrix {
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	return &Matrix{
+		window:   window,
+		slotSize: window / slotCount,
+		cells:    make(map[string]map[int]*cell),
+	}
+}
+
+func (m *Matrix) slotAt(t time.Time) int64 {
+	return t.UnixNano() / int64(m.slotSize)
+}
+
+// BroadcastPlanned does nothing
+func (m *Matrix) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted counts the publishes of one event; failures on local limits (outbound
+// budget, event deadline) say nothing about the relay and are left out
+func (m *Matrix) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	kind := report.Event.Kind
+	now := m.slotAt(time.Now())
+	i := now % slotCount
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, res := range report.Results {
+		if res.Local() {
+			continue
+		}
+		kinds := m.cells[res.URL]
+		if kinds == nil {
+			kinds = make(map[int]*cell)
+			m.cells[res.URL] = kinds
+		}
+		c := kinds[kind]
+		if c == nil {
+			c = &cell{}
+			kinds[kind] = c
+		}
+		if c.slot[i] != now {
+			c.slot[i], c.attempts[i], c.successes[i] = now, 0, 0
+		}
+		c.attempts[i]++
+		if res.Success {
+			c.successes[i]++
+		}
+	}
+	if now != m.lastPrune {
+		m.pruneLocked(now)
+	}
+}
+
+// pruneLocked drops the cells without publishes in the window
+func (m *Matrix) pruneLocked(now int64) {
+	m.lastPrune = now
+	for url, kinds := range m.cells {
+		for kind, c := range kinds {
+			if attempts, _ := c.totals(now); attempts == 0 {
+				delete(kinds, kind)
+			}
+		}
+		if len(kinds) == 0 {
+			delete(m.cells, url)
+		}
+	}
+}
+
+// Matrix renders the selected cells: for each relay, the attempts, successes and success rate
+// of each kind, plus the relay's overall rate and the kinds it was sent
+func (m *Matrix) Matrix(q Query) *json.JsonObject {
+	now := m.slotAt(time.Now())
+
+	m.mu.Lock()
+	urls := make([]string, 0, len(m.cells))
+	for url := range m.cells {
+		if q.Relay == "" || url == q.Relay {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+
+	allKinds := make(map[int]bool)
+	relays := json.NewJsonObject()
+	for _, url := range urls {
+		kinds := make([]int, 0, len(m.cells[url]))
+		for kind := range m.cells[url] {
+			if q.Kind < 0 || kind == q.Kind {
+				kinds = append(kinds, kind)
+			}
+		}
+		sort.Ints(kinds)
+
+		var relayAttempts, relaySuccesses int64
+		kindsObj := json.NewJsonObject()
+		for _, kind := range kinds {
+			attempts, successes := m.cells[url][kind].totals(now)
+			if attempts == 0 || attempts < q.MinAttempts {
+				continue
+			}
+			allKinds[kind] = true
+			relayAttempts += attempts
+			relaySuccesses += successes
+			kindsObj.Set(strconv.Itoa(kind), rateObject(attempts, successes))
+		}
+		if relayAttempts == 0 {
+			continue
+		}
+		relayObj := rateObject(relayAttempts, relaySuccesses)
+		relayObj.Set("kinds", kindsObj)
+		relays.Set(url, relayObj)
+	}
+	m.mu.Unlock()
+
+	kindList := make([]int, 0, len(allKinds))
+	for kind := range allKinds {
+		kindList = append(kindList, kind)
+	}
+	sort.Ints(kindList)
+	kindsJSON := json.NewJsonList()
+	for _, kind := range kindList {
+		kindsJSON.Append(json.NewJsonValue(kind))
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("window_seconds", json.NewJsonValue(int64(m.window.Seconds())))
+	obj.Set("kinds", kindsJSON)
+	obj.Set("relays", relays)
+	return obj
+}
+
+func rateObject(attempts, successes int64) *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("attempts", json.NewJsonValue(attempts))
+	obj.Set("successes", json.NewJsonValue(successes))
+	obj.Set("success_rate", json.NewJsonValue(float64(successes)/float64(attempts)))
+	return obj
+}
+
+// GetStatsName returns the name for this stats provider
+func (m *Matrix) GetStatsName() string {
+	return "kind_matrix"
+}
+
+// GetStats returns the size of the matrix as a JsonEntity
+func (m *Matrix) GetStats() json.JsonEntity {
+	m.mu.Lock()
+	cells := 0
+	for _, kinds := range m.cells {
+		cells += len(kinds)
+	}
+	relays := len(m.cells)
+	m.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("window_seconds", json.NewJsonValue(int64(m.window.Seconds())))
+	obj.Set("relays", json.NewJsonValue(relays))
+	obj.Set("cells", json.NewJsonValue(cells))
+	return obj
+}
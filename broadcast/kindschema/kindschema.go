@@ -0,0 +1,320 @@
+// Package kindschema learns which event kinds each destination relay refuses. Many relays only
+// take a few kinds and answer everything else with "blocked: kind not allowed"; after Threshold
+// such rejections of one kind in a row the pair is learned and that kind is no longer sent there,
+// which saves the publish and keeps pointless rejections out of the relay's score. A learned
+// pair is retried after Expiry, in case the relay's policy changed, and forgotten on a success.
+// The matrix survives restarts in State.
+package kindschema
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/kv"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Config controls the learning
+type Config struct {
+	Threshold int             // kind rejections in a row before a relay/kind pair is learned (default 3)
+	Expiry    time.Duration   // how long a learned pair is honored before the kind is tried again (default 7 days)
+	State     kv.Target       // where the matrix is persisted (nil = memory only)
+	Mandatory func() []string // relays that get every event regardless
+}
+
+// record is what is known about one relay/kind pair
+type record struct {
+	Rejections int       `json:"rejections"` // in a row
+	LearnedAt  time.Time `json:"learned_at,omitempty"`
+	Reason     string    `json:"reason"`
+}
+
+// Schema implements broadcaster.RelayFilter and broadcaster.BroadcastReporter
+type Schema struct {
+	cfg Config
+
+	mu      sync.RWMutex
+	records map[string]map[int]*record // relay URL -> kind -> record
+	dirty   bool
+
+	kindRejections int64
+	skipped        int64
+	learned        int64
+	forgotten      int64
+	saveErrors     int64
+}
+
+// New returns a Schema for cfg, loading the persisted matrix if there is one
+func New(cfg Config) *Schema {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 3
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = 7 * 24 * time.Hour
+	}
+	s := &Schema{cfg: cfg, records: make(map[string]map[int]*record)}
+	if cfg.State != nil {
+		s.load()
+	}
+	logging.DebugMethod("kindschema", "New", "Learning refused kinds after %d rejections, retried after %v (state %v)",
+		cfg.Threshold, cfg.Expiry, cfg.State)
+	return s
+}
+
+// IsKindRejection reports whether a publish error says the relay does not take the event's kind
+// (e.g. "blocked: kind 4 not allowed", "restricted: event kind not accepted")
+func IsKindRejection(errMsg string) bool {
+	msg := strings.ToLower(errMsg)
+	if !strings.Contains(msg, "kind") {
+		return false
+	}
+	for _, phrase := range []string{"not allowed", "not accepted", "not supported", "unsupported", "disallowed", "forbidden", "blocked:", "restricted:"} {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusedLocked reports whether rec is learned and not yet due for a retry
+func (s *Schema) refusedLocked(rec *record, now time.Time) bool {
+	return rec != nil && !rec.LearnedAt.IsZero() && now.Sub(rec.LearnedAt) < s.cfg.Expiry
+}
+
+// FilterRelays drops the relays known to refuse the event's kind; mandatory relays are kept
+func (s *Schema) FilterRelays(event *nostr.Event, relays []string) []string {
+	return s.filterRelays(event, relays, true)
+}
+
+// PlanRelays is FilterRelays for a dry run: skipped relays are not counted
+func (s *Schema) PlanRelays(event *nostr.Event, relays []string) []string {
+	return s.filterRelays(event, relays, false)
+}
+
+func (s *Schema) filterRelays(event *nostr.Event, relays []string, count bool) []string {
+	mandatory := make(map[string]bool)
+	if s.cfg.Mandatory != nil {
+		for _, url := range s.cfg.Mandatory() {
+			mandatory[url] = true
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	result := make([]string, 0, len(relays))
+	for _, url := range relays {
+		if !mandatory[url] && s.refusedLocked(s.records[url][event.Kind], now) {
+			if count {
+				atomic.AddInt64(&s.skipped, 1)
+			}
+			continue
+		}
+		result = append(result, url)
+	}
+	if len(result) < len(relays) {
+		logging.DebugMethod("kindschema", "FilterRelays", "Skipping %d relays that refuse kind %d for event %s",
+			len(relays)-len(result), event.Kind, event.ID)
+	}
+	return result
+}
+
+// BroadcastPlanned does nothing: only results teach anything
+func (s *Schema) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted counts kind rejections and forgets pairs the relay accepted after all
+func (s *Schema) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	kind := report.Event.Kind
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, res := range report.Results {
+		rec := s.records[res.URL][kind]
+		if res.Success {
+			if rec != nil {
+				if !rec.LearnedAt.IsZero() {
+					atomic.AddInt64(&s.forgotten, 1)
+					logging.Info("KindSchema: %s accepts kind %d again", res.URL, kind)
+				}
+				s.deleteLocked(res.URL, kind)
+			}
+			continue
+		}
+		if !IsKindRejection(res.Error) {
+			continue
+		}
+		atomic.AddInt64(&s.kindRejections, 1)
+		if rec == nil {
+			rec = &record{}
+			if s.records[res.URL] == nil {
+				s.records[res.URL] = make(map[int]*record)
+			}
+			s.records[res.URL][kind] = rec
+		}
+		rec.Rejections++
+		rec.Reason = res.Error
+		s.dirty = true
+		if rec.Rejections >= s.cfg.Threshold && !s.refusedLocked(rec, now) {
+			rec.LearnedAt = now
+			atomic.AddInt64(&s.learned, 1)
+			logging.Info("KindSchema: %s refuses kind %d (%s), not sending it there for %v", res.URL, kind, res.Error, s.cfg.Expiry)
+		}
+	}
+}
+
+func (s *Schema) deleteLocked(url string, kind int) {
+	delete(s.records[url], kind)
+	if len(s.records[url]) == 0 {
+		delete(s.records, url)
+	}
+	s.dirty = true
+}
+
+// Refused returns the kinds url is known to refuse, sorted
+func (s *Schema) Refused(url string) []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	kinds := []int{}
+	for kind, rec := range s.records[url] {
+		if s.refusedLocked(rec, now) {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Ints(kinds)
+	return kinds
+}
+
+// Run saves the matrix every interval until ctx is canceled
+func (s *Schema) Run(ctx context.Context, interval time.Duration) {
+	if s.cfg.State == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Save()
+		}
+	}
+}
+
+// load reads the persisted matrix; nothing saved is an empty matrix
+func (s *Schema) load() {
+	var stored map[string]map[string]*record
+	found, err := s.cfg.State.Load(&stored)
+	if err != nil {
+		logging.Warn("KindSchema: Ignoring unreadable %s: %v", s.cfg.State, err)
+		return
+	}
+	if !found {
+		return
+	}
+	pairs := 0
+	for url, kinds := range stored {
+		for k, rec := range kinds {
+			kind, err := strconv.Atoi(k)
+			if err != nil || rec == nil {
+				continue
+			}
+			if s.records[url] == nil {
+				s.records[url] = make(map[int]*record)
+			}
+			s.records[url][kind] = rec
+			pairs++
+		}
+	}
+	logging.Info("KindSchema: Loaded %d relay/kind records from %s", pairs, s.cfg.State)
+}
+
+// Save writes the matrix to State if it changed since the last save
+func (s *Schema) Save() {
+	if s.cfg.State == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	stored := make(map[string]map[string]record, len(s.records))
+	for url, kinds := range s.records {
+		stored[url] = make(map[string]record, len(kinds))
+		for kind, rec := range kinds {
+			stored[url][strconv.Itoa(kind)] = *rec
+		}
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err := s.cfg.State.Save(stored); err != nil {
+		atomic.AddInt64(&s.saveErrors, 1)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		logging.Error("KindSchema: Failed to save %s: %v", s.cfg.State, err)
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (s *Schema) GetStatsName() string {
+	return "kind_schema"
+}
+
+// GetStats returns the learned pairs and counters as a JsonEntity
+func (s *Schema) GetStats() json.JsonEntity {
+	s.mu.RLock()
+	now := time.Now()
+	urls := make([]string, 0, len(s.records))
+	refused := make(map[string][]int)
+	pairs := 0
+	for url, kinds := range s.records {
+		for kind, rec := range kinds {
+			if s.refusedLocked(rec, now) {
+				refused[url] = append(refused[url], kind)
+				pairs++
+			}
+		}
+		if len(refused[url]) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(urls)
+
+	matrix := json.NewJsonObject()
+	for _, url := range urls {
+		kinds := refused[url]
+		sort.Ints(kinds)
+		list := json.NewJsonList()
+		for _, kind := range kinds {
+			list.Append(json.NewJsonValue(kind))
+		}
+		matrix.Set(url, list)
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("threshold", json.NewJsonValue(s.cfg.Threshold))
+	obj.Set("expiry_hours", json.NewJsonValue(s.cfg.Expiry.Hours()))
+	obj.Set("persisted", json.NewJsonValue(s.cfg.State != nil))
+	obj.Set("refused_pairs", json.NewJsonValue(pairs))
+	obj.Set("kind_rejections", json.NewJsonValue(atomic.LoadInt64(&s.kindRejections)))
+	obj.Set("learned", json.NewJsonValue(atomic.LoadInt64(&s.learned)))
+	obj.Set("forgotten", json.NewJsonValue(atomic.LoadInt64(&s.forgotten)))
+	obj.Set("skipped_publishes", json.NewJsonValue(atomic.LoadInt64(&s.skipped)))
+	obj.Set("save_errors", json.NewJsonValue(atomic.LoadInt64(&s.saveErrors)))
+	obj.Set("refused", matrix)
+	return obj
+}
@@ -0,0 +1,238 @@
+// Package ledger keeps the most recently broadcast events, bounded by count and age, so they can
+// be replayed to a relay that joins later (e.g. a mandatory relay added at runtime catching up on
+// recent traffic), and so the per-relay outcome of a recent event can be looked up by ID.
+package ledger
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Config bounds the ledger
+type Config struct {
+	Size   int           // events kept; the oldest are overwritten (default 10000)
+	MaxAge time.Duration // events older than this are not replayed (default 24h)
+}
+
+type entry struct {
+	event   *nostr.Event
+	at      time.Time // broadcast completed
+	queued  time.Time
+	started time.Time
+	results []broadcaster.RelayResult
+}
+
+// pendingEntry is an event whose broadcast was planned but has not completed yet
+type pendingEntry struct {
+	relays  []string
+	planned time.Time
+}
+
+// Ledger records broadcast events in a ring buffer; it implements broadcaster.BroadcastReporter
+type Ledger struct {
+	cfg Config
+
+	mu      sync.Mutex
+	ring    []entry
+	next    int                     // slot the next event goes to
+	full    bool                    // ring wrapped at least once
+	byID    map[string]int          // event ID -> ring slot
+	pending map[string]pendingEntry // broadcasts in progress, at most Size
+
+	recorded int64
+	replayed int64
+}
+
+// New returns a Ledger for cfg
+func New(cfg Config) *Ledger {
+	if cfg.Size <= 0 {
+		cfg.Size = 10000
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 24 * time.Hour
+	}
+	logging.DebugMethod("ledger", "New", "Keeping the last %d broadcast events for up to %v", cfg.Size, cfg.MaxAge)
+	return &Ledger{
+		cfg:     cfg,
+		ring:    make([]entry, cfg.Size),
+		byID:    make(map[string]int, cfg.Size),
+		pending: make(map[string]pendingEntry),
+	}
+}
+
+// BroadcastPlanned remembers the relays an event is about to be sent to, so its outcome can be
+// looked up while the broadcast is still running
+func (l *Ledger) BroadcastPlanned(event *nostr.Event, relays []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) >= len(l.ring) {
+		return
+	}
+	l.pending[event.ID] = pendingEntry{relays: relays, planned: time.Now()}
+}
+
+// BroadcastCompleted records the event and its per-relay results
+func (l *Ledger) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	if report.Event == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.pending, report.Event.ID)
+	if old := l.ring[l.next].event; old != nil && l.byID[old.ID] == l.next {
+		delete(l.byID, old.ID)
+	}
+	l.ring[l.next] = entry{
+		event:   report.Event,
+		at:      report.Finished,
+		queued:  report.Queued,
+		started: report.Started,
+		results: report.Results,
+	}
+	l.byID[report.Event.ID] = l.next
+	l.next = (l.next + 1) % len(l.ring)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+	atomic.AddInt64(&l.recorded, 1)
+}
+
+// Since returns the events broadcast after since (and within MaxAge), oldest first
+func (l *Ledger) Since(since time.Time) []*nostr.Event {
+	if oldest := time.Now().Add(-l.cfg.MaxAge); since.Before(oldest) {
+		since = oldest
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.next
+	start := 0
+	if l.full {
+		count = len(l.ring)
+		start = l.next
+	}
+	events := []*nostr.Event{}
+	for i := 0; i < count; i++ {
+		e := l.ring[(start+i)%len(l.ring)]
+		if e.at.After(since) {
+			events = append(events, e.event)
+		}
+	}
+	return events
+}
+
+// DeliveryCorrected marks result's relay as accepted in the stored results of eventID, after the
+// relay confirmed the event past the publish timeout
+func (l *Ledger) DeliveryCorrected(eventID string, result broadcaster.RelayResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot, ok := l.byID[eventID]
+	if !ok {
+		return
+	}
+	results := l.ring[slot].results
+	for i := range results {
+		if results[i].URL == result.URL {
+			// copy on write: the report's slice is shared with the other reporters
+			corrected := append([]broadcaster.RelayResult(nil), results...)
+			corrected[i].Success = true
+			corrected[i].Error = ""
+			corrected[i].ResponseTime = result.ResponseTime
+			corrected[i].At = result.At
+			l.ring[slot].results = corrected
+			return
+		}
+	}
+}
+
+// Outcome returns the broadcast outcome of a recent event: the relays that accepted it, those
+// that failed and why, and when each publish finished; false if the event is not in the ledger
+func (l *Ledger) Outcome(eventID string) (*json.JsonObject, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("event_id", json.NewJsonValue(eventID))
+	if p, ok := l.pending[eventID]; ok {
+		relays := json.NewJsonList()
+		for _, url := range p.relays {
+			relays.Append(json.NewJsonValue(url))
+		}
+		obj.Set("status", json.NewJsonValue("pending"))
+		obj.Set("planned_at", json.NewJsonValue(p.planned.Unix()))
+		obj.Set("targets", json.NewJsonValue(len(p.relays)))
+		obj.Set("relays", relays)
+		return obj, true
+	}
+
+	slot, ok := l.byID[eventID]
+	if !ok || time.Since(l.ring[slot].at) > l.cfg.MaxAge {
+		return nil, false
+	}
+	e := l.ring[slot]
+	results := append([]broadcaster.RelayResult(nil), e.results...)
+	sort.Slice(results, func(i, j int) bool { return results[i].URL < results[j].URL })
+
+	accepted := json.NewJsonList()
+	failed := json.NewJsonList()
+	for _, res := range results {
+		r := json.NewJsonObject()
+		r.Set("url", json.NewJsonValue(res.URL))
+		r.Set("response_time_ms", json.NewJsonValue(res.ResponseTime.Milliseconds()))
+		r.Set("at", json.NewJsonValue(res.At.Unix()))
+		r.Set("attempts", json.NewJsonValue(res.Attempts))
+		if res.Success {
+			r.Set("duplicate", json.NewJsonValue(res.Duplicate))
+			accepted.Append(r)
+		} else {
+			r.Set("error", json.NewJsonValue(res.Error))
+			failed.Append(r)
+		}
+	}
+	obj.Set("status", json.NewJsonValue("complete"))
+	obj.Set("kind", json.NewJsonValue(e.event.Kind))
+	obj.Set("queued_at", json.NewJsonValue(e.queued.Unix()))
+	obj.Set("started_at", json.NewJsonValue(e.started.Unix()))
+	obj.Set("finished_at", json.NewJsonValue(e.at.Unix()))
+	obj.Set("targets", json.NewJsonValue(len(results)))
+	obj.Set("accepted", accepted)
+	obj.Set("failed", failed)
+	return obj, true
+}
+
+// CountReplayed adds n events replayed from the ledger to the stats
+func (l *Ledger) CountReplayed(n int) {
+	atomic.AddInt64(&l.replayed, int64(n))
+}
+
+// GetStatsName returns the name for this stats provider
+func (l *Ledger) GetStatsName() string {
+	return "ledger"
+}
+
+// GetStats returns the ledger's size and counters as a JsonEntity
+func (l *Ledger) GetStats() json.JsonEntity {
+	l.mu.Lock()
+	stored := l.next
+	if l.full {
+		stored = len(l.ring)
+	}
+	pending := len(l.pending)
+	l.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("capacity", json.NewJsonValue(l.cfg.Size))
+	obj.Set("max_age_seconds", json.NewJsonValue(int64(l.cfg.MaxAge.Seconds())))
+	obj.Set("stored", json.NewJsonValue(stored))
+	obj.Set("pending", json.NewJsonValue(pending))
+	obj.Set("recorded", json.NewJsonValue(atomic.LoadInt64(&l.recorded)))
+	obj.Set("replayed", json.NewJsonValue(atomic.LoadInt64(&l.replayed)))
+	return obj
+}
@@ -0,0 +1,478 @@
+// Package maintenance detects recurring daily maintenance windows of destination relays: many
+// relays restart or back up at the same time every night and fail everything for a few minutes.
+// The Detector keeps, per relay and per slot of the day (UTC), how many health-check and publish
+// results failed on each of the last Days days; a slot that was mostly failures on at least
+// MinDays of them, at a relay that works the rest of the day, is a maintenance window. During a
+// window the relay is left out of broadcasts and its events are held, then replayed to it once
+// the window is over, instead of being published into failures. The history survives restarts
+// in State.
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/bus"
+	"github.com/girino/nostr-brodcast-relay/kv"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	slotLength     = 15 * time.Minute
+	slotsPerDay    = int(24 * time.Hour / slotLength)
+	healthyOutside = 0.5 // success rate a relay needs outside its windows for them to count
+)
+
+// Config controls the detection
+type Config struct {
+	Days         int       // days of history kept (default 7)
+	MinDays      int       // days a slot must have failed on to be a window (default 3)
+	MinSamples   int       // results a slot needs on one day to be judged (default 2)
+	FailureRatio float64   // share of failed results that makes a slot bad on one day (default 0.8)
+	MaxDeferred  int       // events held per relay during its window; the oldest are dropped (default 500)
+	State        kv.Target // where the history is persisted (nil = memory only)
+	// Replay delivers the events held for a relay once its window is over
+	Replay func(url string, events []*nostr.Event) (delivered, failed int)
+}
+
+// day is one relay's results on one day, per slot
+type day struct {
+	Attempts []int32 `json:"attempts"`
+	Failures []int32 `json:"failures"`
+}
+
+// relayState is what is known about one relay
+type relayState struct {
+	days     map[int64]*day // day number (Unix days, UTC) -> results
+	window   []bool         // detected window slots (nil = none)
+	deferred []*nostr.Event
+}
+
+// pendingHold is an event left out of relays in their window, held once its broadcast is planned
+type pendingHold struct {
+	urls []string
+	at   time.Time
+}
+
+// Detector implements broadcaster.RelayFilter and broadcaster.BroadcastReporter
+type Detector struct {
+	cfg Config
+
+	mu      sync.Mutex
+	relays  map[string]*relayState
+	pending map[string]pendingHold // event ID -> relays it is to be held for
+	dirty   bool
+
+	deferredEvents int64
+	dropped        int64
+	replayed       int64
+	replayFailed   int64
+	saveErrors     int64
+}
+
+// New returns a Detector for cfg, loading the persisted history if there is one
+func New(cfg Config) *Detector {
+	if cfg.Days <= 0 {
+		cfg.Days = 7
+	}
+	if cfg.MinDays <= 0 {
+		cfg.MinDays = 3
+	}
+	if cfg.MinDays > cfg.Days {
+		cfg.MinDays = cfg.Days
+	}
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = 2
+	}
+	if cfg.FailureRatio <= 0 || cfg.FailureRatio > 1 {
+		cfg.FailureRatio = 0.8
+	}
+	if cfg.MaxDeferred <= 0 {
+		cfg.MaxDeferred = 500
+	}
+	d := &Detector{cfg: cfg, relays: make(map[string]*relayState), pending: make(map[string]pendingHold)}
+	if cfg.State != nil {
+		d.load()
+	}
+	d.detect(time.Now())
+	logging.DebugMethod("maintenance", "New", "Detecting maintenance windows failing on %d of the last %d days (state %v)",
+		cfg.MinDays, cfg.Days, cfg.State)
+	return d
+}
+
+// slotOf returns the day number and slot of t (UTC)
+func slotOf(t time.Time) (int64, int) {
+	t = t.UTC()
+	dayNumber := t.Unix() / 86400
+	return dayNumber, int(t.Sub(t.Truncate(24*time.Hour)) / slotLength)
+}
+
+// Record counts a health-check or publish result (subscribe it to the results bus)
+func (d *Detector) Record(e bus.Event) {
+	if e.Type != bus.HealthCheck && e.Type != bus.PublishResult {
+		return
+	}
+	dayNumber, slot := slotOf(e.At)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	relay := d.relayLocked(e.URL)
+	today, ok := relay.days[dayNumber]
+	if !ok {
+		today = &day{Attempts: make([]int32, slotsPerDay), Failures: make([]int32, slotsPerDay)}
+		relay.days[dayNumber] = today
+	}
+	today.Attempts[slot]++
+	if !e.Success {
+		today.Failures[slot]++
+	}
+	d.dirty = true
+}
+
+func (d *Detector) relayLocked(url string) *relayState {
+	relay, ok := d.relays[url]
+	if !ok {
+		relay = &relayState{days: make(map[int64]*day)}
+		d.relays[url] = relay
+	}
+	return relay
+}
+
+// detect drops history older than Days and recomputes every relay's window from the complete
+// days (today is still being recorded)
+func (d *Detector) detect(now time.Time) {
+	today, _ := slotOf(now)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for url, relay := range d.relays {
+		for dayNumber := range relay.days {
+			if dayNumber <= today-int64(d.cfg.Days) {
+				delete(relay.days, dayNumber)
+			}
+		}
+		if len(relay.days) == 0 && len(relay.deferred) == 0 {
+			delete(d.relays, url)
+			continue
+		}
+		previous := formatWindow(relay.window)
+		relay.window = d.windowOf(relay, today)
+		if current := formatWindow(relay.window); current != previous {
+			if current == "" {
+				logging.Info("Maintenance: %s no longer has a maintenance window", url)
+			} else {
+				logging.Info("Maintenance: %s has a daily maintenance window at %s UTC", url, current)
+			}
+		}
+	}
+}
+
+// windowOf returns the slots that were bad on at least MinDays past days, provided the relay is
+// healthy in the other slots (a relay failing all day is down, not in maintenance)
+func (d *Detector) windowOf(relay *relayState, today int64) []bool {
+	var window []bool
+	badDays := make([]int, slotsPerDay)
+	for dayNumber, results := range relay.days {
+		if dayNumber == today {
+			continue
+		}
+		for slot := 0; slot < slotsPerDay; slot++ {
+			attempts := results.Attempts[slot]
+			if attempts >= int32(d.cfg.MinSamples) && float64(results.Failures[slot]) >= d.cfg.FailureRatio*float64(attempts) {
+				badDays[slot]++
+			}
+		}
+	}
+	for slot, bad := range badDays {
+		if bad >= d.cfg.MinDays {
+			if window == nil {
+				window = make([]bool, slotsPerDay)
+			}
+			window[slot] = true
+		}
+	}
+	if window == nil {
+		return nil
+	}
+
+	var attempts, failures int64
+	for _, results := range relay.days {
+		for slot := 0; slot < slotsPerDay; slot++ {
+			if !window[slot] {
+				attempts += int64(results.Attempts[slot])
+				failures += int64(results.Failures[slot])
+			}
+		}
+	}
+	if attempts == 0 || float64(attempts-failures)/float64(attempts) < healthyOutside {
+		return nil
+	}
+	return window
+}
+
+// FilterRelays leaves out the relays in their maintenance window; the event is held for them once
+// its broadcast is planned
+func (d *Detector) FilterRelays(event *nostr.Event, relays []string) []string {
+	return d.filterRelays(event, relays, true)
+}
+
+// PlanRelays is FilterRelays for a dry run: the event is not held
+func (d *Detector) PlanRelays(event *nostr.Event, relays []string) []string {
+	return d.filterRelays(event, relays, false)
+}
+
+func (d *Detector) filterRelays(event *nostr.Event, relays []string, hold bool) []string {
+	_, slot := slotOf(time.Now())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := make([]string, 0, len(relays))
+	var held []string
+	for _, url := range relays {
+		relay, ok := d.relays[url]
+		if !ok || relay.window == nil || !relay.window[slot] {
+			result = append(result, url)
+			continue
+		}
+		held = append(held, url)
+	}
+	if len(held) > 0 && hold {
+		d.pending[event.ID] = pendingHold{urls: held, at: time.Now()}
+		logging.DebugMethod("maintenance", "FilterRelays", "Holding event %s for %d relays in their maintenance window",
+			event.ID, len(held))
+	}
+	return result
+}
+
+// BroadcastPlanned holds the event for the relays FilterRelays left out
+func (d *Detector) BroadcastPlanned(event *nostr.Event, relays []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hold, ok := d.pending[event.ID]
+	if !ok {
+		return
+	}
+	delete(d.pending, event.ID)
+	for _, url := range hold.urls {
+		relay := d.relayLocked(url)
+		if len(relay.deferred) >= d.cfg.MaxDeferred {
+			relay.deferred = relay.deferred[1:]
+			atomic.AddInt64(&d.dropped, 1)
+		}
+		relay.deferred = append(relay.deferred, event)
+		atomic.AddInt64(&d.deferredEvents, 1)
+	}
+}
+
+// BroadcastCompleted does nothing: held events are replayed when the window ends
+func (d *Detector) BroadcastCompleted(report broadcaster.BroadcastReport) {}
+
+// InWindow reports whether url is in its maintenance window right now
+func (d *Detector) InWindow(url string) bool {
+	_, slot := slotOf(time.Now())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	relay, ok := d.relays[url]
+	return ok && relay.window != nil && relay.window[slot]
+}
+
+// Run re-detects the windows every slot, replays held events once a relay's window is over and
+// saves the history, until ctx is canceled
+func (d *Detector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	lastDetect := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(lastDetect) >= slotLength {
+				d.detect(now)
+				lastDetect = now
+			}
+			d.release(now)
+			d.Save()
+		}
+	}
+}
+
+// release replays the events held for relays whose window is over
+func (d *Detector) release(now time.Time) {
+	_, slot := slotOf(now)
+	due := make(map[string][]*nostr.Event)
+	d.mu.Lock()
+	for id, hold := range d.pending {
+		if now.Sub(hold.at) > time.Minute {
+			delete(d.pending, id) // planned but never broadcast
+		}
+	}
+	for url, relay := range d.relays {
+		if len(relay.deferred) > 0 && (relay.window == nil || !relay.window[slot]) {
+			due[url] = relay.deferred
+			relay.deferred = nil
+		}
+	}
+	d.mu.Unlock()
+
+	for url, events := range due {
+		if d.cfg.Replay == nil {
+			continue
+		}
+		go func(url string, events []*nostr.Event) {
+			delivered, failed := d.cfg.Replay(url, events)
+			atomic.AddInt64(&d.replayed, int64(delivered))
+			atomic.AddInt64(&d.replayFailed, int64(failed))
+			logging.Info("Maintenance: %s is out of its maintenance window, replayed %d held events (%d failed)", url, delivered, failed)
+		}(url, events)
+	}
+}
+
+// load reads the persisted history; nothing saved is an empty history
+func (d *Detector) load() {
+	var stored map[string]map[string]*day
+	found, err := d.cfg.State.Load(&stored)
+	if err != nil {
+		logging.Warn("Maintenance: Ignoring unreadable %s: %v", d.cfg.State, err)
+		return
+	}
+	if !found {
+		return
+	}
+	for url, days := range stored {
+		for key, results := range days {
+			dayNumber, err := strconv.ParseInt(key, 10, 64)
+			if err != nil || results == nil || len(results.Attempts) != slotsPerDay || len(results.Failures) != slotsPerDay {
+				continue
+			}
+			d.relayLocked(url).days[dayNumber] = results
+		}
+	}
+	logging.Info("Maintenance: Loaded the result history of %d relays from %s", len(d.relays), d.cfg.State)
+}
+
+// Save writes the history to State if it changed since the last save
+func (d *Detector) Save() {
+	if d.cfg.State == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return
+	}
+	stored := make(map[string]map[string]day, len(d.relays))
+	for url, relay := range d.relays {
+		if len(relay.days) == 0 {
+			continue
+		}
+		days := make(map[string]day, len(relay.days))
+		for dayNumber, results := range relay.days {
+			days[strconv.FormatInt(dayNumber, 10)] = day{
+				Attempts: append([]int32(nil), results.Attempts...),
+				Failures: append([]int32(nil), results.Failures...),
+			}
+		}
+		stored[url] = days
+	}
+	d.dirty = false
+	d.mu.Unlock()
+
+	if err := d.cfg.State.Save(stored); err != nil {
+		atomic.AddInt64(&d.saveErrors, 1)
+		d.mu.Lock()
+		d.dirty = true
+		d.mu.Unlock()
+		logging.Error("Maintenance: Failed to save %s: %v", d.cfg.State, err)
+	}
+}
+
+// formatWindow renders window slots as "HH:MM-HH:MM" ranges, merging one that wraps midnight
+func formatWindow(window []bool) string {
+	if window == nil {
+		return ""
+	}
+	type span struct{ start, end int } // end exclusive
+	var spans []span
+	for slot := 0; slot < slotsPerDay; slot++ {
+		if !window[slot] {
+			continue
+		}
+		if n := len(spans); n > 0 && spans[n-1].end == slot {
+			spans[n-1].end = slot + 1
+		} else {
+			spans = append(spans, span{slot, slot + 1})
+		}
+	}
+	if n := len(spans); n > 1 && spans[0].start == 0 && spans[n-1].end == slotsPerDay {
+		spans[0].start = spans[n-1].start - slotsPerDay
+		spans = spans[:n-1]
+	}
+	clock := func(slot int) string {
+		minutes := (slot*int(slotLength/time.Minute) + 24*60) % (24 * 60)
+		return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+	}
+	result := ""
+	for i, s := range spans {
+		if i > 0 {
+			result += ","
+		}
+		result += clock(s.start) + "-" + clock(s.end)
+	}
+	return result
+}
+
+// GetStatsName returns the name for this stats provider
+func (d *Detector) GetStatsName() string {
+	return "maintenance"
+}
+
+// GetStats returns the detected windows and counters as a JsonEntity
+func (d *Detector) GetStats() json.JsonEntity {
+	_, slot := slotOf(time.Now())
+	d.mu.Lock()
+	urls := make([]string, 0)
+	for url, relay := range d.relays {
+		if relay.window != nil || len(relay.deferred) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+	windows := json.NewJsonList()
+	for _, url := range urls {
+		relay := d.relays[url]
+		entry := json.NewJsonObject()
+		entry.Set("url", json.NewJsonValue(url))
+		entry.Set("window_utc", json.NewJsonValue(formatWindow(relay.window)))
+		entry.Set("in_window", json.NewJsonValue(relay.window != nil && relay.window[slot]))
+		entry.Set("held_events", json.NewJsonValue(len(relay.deferred)))
+		windows.Append(entry)
+	}
+	tracked := len(d.relays)
+	d.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("history_days", json.NewJsonValue(d.cfg.Days))
+	obj.Set("min_days", json.NewJsonValue(d.cfg.MinDays))
+	obj.Set("slot_minutes", json.NewJsonValue(int(slotLength/time.Minute)))
+	obj.Set("persisted", json.NewJsonValue(d.cfg.State != nil))
+	obj.Set("tracked_relays", json.NewJsonValue(tracked))
+	obj.Set("events_held", json.NewJsonValue(atomic.LoadInt64(&d.deferredEvents)))
+	obj.Set("dropped_events", json.NewJsonValue(atomic.LoadInt64(&d.dropped)))
+	obj.Set("replayed", json.NewJsonValue(atomic.LoadInt64(&d.replayed)))
+	obj.Set("replay_failures", json.NewJsonValue(atomic.LoadInt64(&d.replayFailed)))
+	obj.Set("save_errors", json.NewJsonValue(atomic.LoadInt64(&d.saveErrors)))
+	obj.Set("windows", windows)
+	return obj
+}
+
+var (
+	_ broadcaster.RelayFilter       = (*Detector)(nil)
+	_ broadcaster.BroadcastReporter = (*Detector)(nil)
+)
@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-lib/json"
+)
+
+// SetCanaryWeight makes relays that accept the pipeline canaries quickly rank higher: up to weight
+// score points are added to a relay at a canary acceptance rate of 1, scaled down by its canary
+// response time. Canaries run under controlled conditions, so a relay proven reliable by them is
+// not pushed out of the top N by organic failures our own saturation caused. 0 disables it.
+func (m *Manager) SetCanaryWeight(weight float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.canaryWeight = weight
+}
+
+// RecordCanary records the outcome of a canary publish to url. It feeds the relay's canary rate
+// and canary response time only; organic publishes keep their own success rate.
+func (m *Manager) RecordCanary(ctx context.Context, url string, success bool, responseTime time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	relay, exists := m.relays[url]
+	if !exists {
+		return fmt.Errorf("record canary of %s: %w", url, ErrRelayNotFound)
+	}
+	successValue := 0.0
+	if success {
+		successValue = 1.0
+		if relay.CanaryResponseTime == 0 {
+			relay.CanaryResponseTime = responseTime
+		} else {
+			relay.CanaryResponseTime = time.Duration(float64(relay.CanaryResponseTime)*0.7 + float64(responseTime)*0.3)
+		}
+	}
+	if relay.CanaryChecks == 0 {
+		relay.CanaryRate = successValue
+	} else {
+		relay.CanaryRate = relay.CanaryRate*m.decay + successValue*(1-m.decay)
+	}
+	relay.CanaryChecks++
+	logging.DebugMethod("manager", "RecordCanary", "%s: canary success=%v after %v | canary rate %.4f",
+		url, success, responseTime, relay.CanaryRate)
+	return nil
+}
+
+// canaryBoost is the score a relay earns from its canary answers: the weight scaled by its canary
+// acceptance rate and divided by one plus its canary response time in seconds
+func (m *Manager) canaryBoost(relay *RelayInfo) float64 {
+	if m.canaryWeight == 0 || relay.CanaryChecks == 0 {
+		return 0
+	}
+	return m.canaryWeight * relay.CanaryRate / (1 + relay.CanaryResponseTime.Seconds())
+}
+
+// canaryStatsObject summarizes the canary answers across the pool
+func (m *Manager) canaryStatsObject() *json.JsonObject {
+	var checks int64
+	probed := 0
+	for _, relay := range m.relays {
+		if relay.CanaryChecks > 0 {
+			checks += relay.CanaryChecks
+			probed++
+		}
+	}
+	obj := json.NewJsonObject()
+	obj.Set("checks", json.NewJsonValue(checks))
+	obj.Set("probed_relays", json.NewJsonValue(probed))
+	obj.Set("weight", json.NewJsonValue(m.canaryWeight))
+	return obj
+}
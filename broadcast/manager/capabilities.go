@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Capabilities is what a relay's NIP-11 document says about who may publish there, as learned
+// by the health checker
+type Capabilities struct {
+	PaymentRequired  bool      `json:"payment_required,omitempty"`
+	AuthRequired     bool      `json:"auth_required,omitempty"`
+	MinPow           int       `json:"min_pow,omitempty"`
+	MaxMessageLength int       `json:"max_message_length,omitempty"`
+	SupportedNIPs    []int     `json:"supported_nips,omitempty"`
+	FetchedAt        time.Time `json:"fetched_at"`
+	// Excluded is why the relay would reject every event we publish ("" = usable); such relays
+	// are kept out of the top N
+	Excluded string `json:"excluded,omitempty"`
+}
+
+// SetCapabilities records the NIP-11 capabilities of a relay; ErrRelayNotFound if url is unknown
+func (m *Manager) SetCapabilities(ctx context.Context, url string, caps Capabilities) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	relay, exists := m.relays[url]
+	if !exists {
+		return ErrRelayNotFound
+	}
+	caps.SupportedNIPs = append([]int(nil), caps.SupportedNIPs...)
+	relay.Capabilities = &caps
+	return nil
+}
+
+// unusable reports whether relay's capabilities rule out every publish
+func unusable(relay *RelayInfo) bool {
+	return relay.Capabilities != nil && relay.Capabilities.Excluded != ""
+}
+
+// capabilitiesObject renders a relay's capabilities
+func capabilitiesObject(caps *Capabilities) *json.JsonObject {
+	nips := json.NewJsonList()
+	for _, nip := range caps.SupportedNIPs {
+		nips.Append(json.NewJsonValue(nip))
+	}
+	obj := json.NewJsonObject()
+	obj.Set("payment_required", json.NewJsonValue(caps.PaymentRequired))
+	obj.Set("auth_required", json.NewJsonValue(caps.AuthRequired))
+	obj.Set("min_pow", json.NewJsonValue(caps.MinPow))
+	obj.Set("max_message_length", json.NewJsonValue(caps.MaxMessageLength))
+	obj.Set("supported_nips", nips)
+	obj.Set("fetched_at", json.NewJsonValue(caps.FetchedAt.Format(time.RFC3339)))
+	if caps.Excluded != "" {
+		obj.Set("excluded", json.NewJsonValue(caps.Excluded))
+	}
+	return obj
+}
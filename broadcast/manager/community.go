@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"math"
+	"strings"
+
+	"github.com/girino/nostr-lib/json"
+)
+
+// CommunityFloor reserves part of the top-N set for relays of a curated community list, so small
+// independent relays keep receiving traffic even when larger relays outscore them. The best
+// community relays fill ceil(n x Fraction) slots; the rest of the set is ranked as usual.
+type CommunityFloor struct {
+	Relays         []string
+	Fraction       float64 // share of the top N reserved (0 = disabled, at most 1)
+	MinSuccessRate float64 // community relays below this success rate are not promoted
+}
+
+// SetCommunityFloor enables the community reservation for the top-N selection
+func (m *Manager) SetCommunityFloor(floor CommunityFloor) {
+	community := make(map[string]bool, len(floor.Relays))
+	for _, url := range floor.Relays {
+		community[strings.TrimSuffix(url, "/")] = true
+	}
+	floor.Fraction = math.Min(math.Max(floor.Fraction, 0), 1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.community = floor
+	m.communitySet = community
+}
+
+// reserveCommunity moves the community relays entitled to the reserved slots of a set of n to
+// the front of ranked (best first), keeping every other relay's order; it returns the reordered
+// list and how many relays were promoted that their score alone would have left out
+func (m *Manager) reserveCommunity(ranked []*RelayInfo, n int) ([]*RelayInfo, int) {
+	if m.community.Fraction <= 0 || len(m.communitySet) == 0 || n <= 0 {
+		return ranked, 0
+	}
+	reserved := int(math.Ceil(float64(n) * m.community.Fraction))
+
+	promoted := make([]*RelayInfo, 0, reserved)
+	rest := make([]*RelayInfo, 0, len(ranked))
+	lifted := 0
+	for i, relay := range ranked {
+		if len(promoted) < reserved && m.communitySet[relay.URL] && relay.SuccessRate >= m.community.MinSuccessRate {
+			promoted = append(promoted, relay)
+			if i >= n {
+				lifted++
+			}
+			continue
+		}
+		rest = append(rest, relay)
+	}
+	return append(promoted, rest...), lifted
+}
+
+// communityStatsObject reports the reservation and which community relays are in the top N
+func (m *Manager) communityStatsObject(top []*RelayInfo) *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("relays", json.NewJsonValue(len(m.communitySet)))
+	obj.Set("fraction", json.NewJsonValue(m.community.Fraction))
+	obj.Set("reserved_slots", json.NewJsonValue(int(math.Ceil(float64(m.topN)*m.community.Fraction))))
+	inTop := json.NewJsonList()
+	for _, relay := range top {
+		if m.communitySet[relay.URL] {
+			inTop.Append(json.NewJsonValue(relay.URL))
+		}
+	}
+	obj.Set("in_top", inTop)
+	return obj
+}
@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/girino/nostr-lib/json"
+)
+
+// SetConsistencyPenalty makes relays whose behavior contradicts their NIP-11 claims rank lower:
+// weight score points are taken off at a consistency of 0 (every observation a contradiction).
+// 0 disables it.
+func (m *Manager) SetConsistencyPenalty(weight float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consistencyPenalty = weight
+}
+
+// SetConsistency records how well url behaves as its NIP-11 document claims, from 0 (never) to
+// 1 (always), as scored by the consistency tracker
+func (m *Manager) SetConsistency(ctx context.Context, url string, consistency float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	relay, exists := m.relays[url]
+	if !exists {
+		return fmt.Errorf("set consistency of %s: %w", url, ErrRelayNotFound)
+	}
+	relay.Consistency = min(max(consistency, 0), 1)
+	relay.ConsistencyScored = true
+	return nil
+}
+
+// consistencyMalus is the score a relay loses for contradicting its claims
+func (m *Manager) consistencyMalus(relay *RelayInfo) float64 {
+	if m.consistencyPenalty == 0 || !relay.ConsistencyScored {
+		return 0
+	}
+	return m.consistencyPenalty * (1 - relay.Consistency)
+}
+
+// consistencyStatsObject summarizes the consistency scores across the pool
+func (m *Manager) consistencyStatsObject() *json.JsonObject {
+	scored, lowest := 0, 1.0
+	for _, relay := range m.relays {
+		if relay.ConsistencyScored {
+			scored++
+			lowest = min(lowest, relay.Consistency)
+		}
+	}
+	obj := json.NewJsonObject()
+	obj.Set("scored_relays", json.NewJsonValue(scored))
+	if scored > 0 {
+		obj.Set("lowest", json.NewJsonValue(lowest))
+	}
+	obj.Set("penalty", json.NewJsonValue(m.consistencyPenalty))
+	return obj
+}
@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-lib/json"
+)
+
+// SetCoveragePenalty makes relays that keep answering "duplicate:" rank lower: weight score points
+// are taken off at a coverage rate of 1 (every publish a duplicate). Such relays already receive
+// everything through other paths, so a top-N slot is better spent elsewhere. 0 disables it.
+func (m *Manager) SetCoveragePenalty(weight float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.coveragePenalty = weight
+}
+
+// RecordDuplicate records a publish the relay answered with "duplicate:". The relay is up and
+// has the event, so it counts as a sign of life, but neither for nor against its success rate.
+func (m *Manager) RecordDuplicate(ctx context.Context, url string, responseTime time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	relay, exists := m.relays[url]
+	if !exists {
+		return fmt.Errorf("record duplicate of %s: %w", url, ErrRelayNotFound)
+	}
+	now := time.Now()
+	relay.Duplicates++
+	relay.CoverageRate = relay.CoverageRate*m.decay + (1 - m.decay)
+	if now.After(relay.LastSuccess) {
+		relay.LastSuccess = now
+	}
+	logging.DebugMethod("manager", "RecordDuplicate", "%s: duplicate after %v | coverage rate %.4f",
+		url, responseTime, relay.CoverageRate)
+	return nil
+}
+
+// coverageStatsObject summarizes the duplicate answers across the pool
+func (m *Manager) coverageStatsObject() *json.JsonObject {
+	var duplicates int64
+	covered := 0
+	for _, relay := range m.relays {
+		duplicates += relay.Duplicates
+		if relay.CoverageRate >= 0.5 {
+			covered++
+		}
+	}
+	obj := json.NewJsonObject()
+	obj.Set("duplicates", json.NewJsonValue(duplicates))
+	obj.Set("mostly_covered_relays", json.NewJsonValue(covered))
+	obj.Set("penalty", json.NewJsonValue(m.coveragePenalty))
+	return obj
+}
@@ -0,0 +1,81 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/girino/nostr-lib/json"
+)
+
+// FlapDamping keeps relays that keep going up and down out of the top-N set. A relay whose
+// outcome flipped (success to failure or back) at least Threshold times within Window is
+// flapping; a flapping relay only re-enters the top N after staying healthy for HoldDown
+// since its last recovery.
+type FlapDamping struct {
+	Threshold int           // outcome flips within Window that make a relay flapping (0 = disabled)
+	Window    time.Duration // how far back flips are counted
+	HoldDown  time.Duration // healthy time required after a flapping relay recovers
+}
+
+// SetFlapDamping enables flap damping for the top-N selection
+func (m *Manager) SetFlapDamping(flap FlapDamping) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flap = flap
+}
+
+// recordOutcome updates relay's flap history with one check or publish outcome
+func (m *Manager) recordOutcome(relay *RelayInfo, success bool, now time.Time) {
+	first := relay.TotalAttempts == 0
+	previous := relay.LastUp
+	relay.LastUp = success
+	if first || previous == success {
+		return
+	}
+
+	if success {
+		relay.Flaps++
+		relay.RecoveredAt = now
+	}
+	if m.flap.Threshold <= 0 {
+		return
+	}
+	relay.flips = append(pruneFlips(relay.flips, now, m.flap.Window), now)
+}
+
+// pruneFlips drops flips older than window
+func pruneFlips(flips []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(flips) && now.Sub(flips[i]) > window {
+		i++
+	}
+	return flips[i:]
+}
+
+// heldDown reports whether relay is flapping and has not been healthy for the hold-down
+// period yet, and until when it is held (zero while it is still failing)
+func (m *Manager) heldDown(relay *RelayInfo, now time.Time) (bool, time.Time) {
+	if m.flap.Threshold <= 0 || len(pruneFlips(relay.flips, now, m.flap.Window)) < m.flap.Threshold {
+		return false, time.Time{}
+	}
+	if !relay.LastUp {
+		return true, time.Time{}
+	}
+	until := relay.RecoveredAt.Add(m.flap.HoldDown)
+	return now.Before(until), until
+}
+
+// flapStatsObject summarizes flap damping across the pool; callers hold m.mu
+func (m *Manager) flapStatsObject(now time.Time) *json.JsonObject {
+	held := 0
+	for _, relay := range m.relays {
+		if isHeld, _ := m.heldDown(relay, now); isHeld {
+			held++
+		}
+	}
+	obj := json.NewJsonObject()
+	obj.Set("threshold", json.NewJsonValue(m.flap.Threshold))
+	obj.Set("window_seconds", json.NewJsonValue(m.flap.Window.Seconds()))
+	obj.Set("hold_down_seconds", json.NewJsonValue(m.flap.HoldDown.Seconds()))
+	obj.Set("held_down", json.NewJsonValue(held))
+	return obj
+}
@@ -0,0 +1,135 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/girino/nostr-lib/json"
+)
+
+var (
+	// ErrRelayNotFound is returned for operations on a relay the manager does not track
+	ErrRelayNotFound = errors.New("relay not found")
+	// ErrReadOnly is returned by mutating operations of a read-only manager
+	ErrReadOnly = errors.New("relay manager is read-only")
+)
+
+// RelayManager tracks relays, their health and their ranking. Every operation takes a context
+// so implementations backed by a shared store can honor deadlines, and returns an error
+// instead of failing silently. *Manager is the in-memory implementation.
+type RelayManager interface {
+	AddRelay(ctx context.Context, url string, source string) error
+	AddMandatoryRelay(ctx context.Context, url string) error
+	RemoveRelay(ctx context.Context, url string) error
+
+	// UpdateHealth records one check or publish outcome; ErrRelayNotFound if url is unknown
+	UpdateHealth(ctx context.Context, url string, success bool, responseTime time.Duration) error
+	// RecordFailure adds err to the relay's failure breakdown (nil err is a no-op)
+	RecordFailure(ctx context.Context, url string, err error) error
+	// TrackPublishResult is UpdateHealth plus RecordFailure for failed publishes
+	TrackPublishResult(ctx context.Context, url string, success bool, responseTime time.Duration, err error) error
+	// RecordLateSuccess corrects a publish counted as a timeout whose OK arrived late
+	RecordLateSuccess(ctx context.Context, url string, responseTime time.Duration) error
+	// RecordDuplicate records a publish the relay answered with "duplicate:": it already had the
+	// event, which counts toward its coverage but neither for nor against its success rate
+	RecordDuplicate(ctx context.Context, url string, responseTime time.Duration) error
+	// RecordCanary records a pipeline canary publish, scored apart from organic publishes
+	RecordCanary(ctx context.Context, url string, success bool, responseTime time.Duration) error
+	// SetConsistency records how well a relay behaves as its NIP-11 document claims (0 to 1)
+	SetConsistency(ctx context.Context, url string, consistency float64) error
+	// SetCapabilities records a relay's NIP-11 limitations; ErrRelayNotFound if url is unknown
+	SetCapabilities(ctx context.Context, url string, caps Capabilities) error
+	// MarkInitialized switches success rates from simple averages to exponential decay
+	MarkInitialized(ctx context.Context) error
+
+	// GetRelayInfo returns a copy of one relay's state, or ErrRelayNotFound
+	GetRelayInfo(ctx context.Context, url string) (*RelayInfo, error)
+	GetAllRelays(ctx context.Context) ([]string, error)
+	GetRelayCount(ctx context.Context) (int, error)
+	GetTopRelays(ctx context.Context) ([]*RelayInfo, error)
+	GetTopRelaysN(ctx context.Context, n int) ([]*RelayInfo, error)
+	GetMandatoryRelays(ctx context.Context) ([]*RelayInfo, error)
+	GetBroadcastRelays(ctx context.Context) ([]string, error)
+	GetBroadcastRelaysN(ctx context.Context, n int) ([]string, error)
+
+	// ResetRelayStats clears one relay's health history; ErrRelayNotFound if url is unknown
+	ResetRelayStats(ctx context.Context, url string) error
+	// ResetAllRelayStats clears every relay's health history and returns how many were reset
+	ResetAllRelayStats(ctx context.Context) (int, error)
+
+	// RelayDetailObject renders one relay's statistics and recent errors for the API
+	RelayDetailObject(relay *RelayInfo) *json.JsonObject
+	GetStatsName() string
+	GetStats() json.JsonEntity
+}
+
+var _ RelayManager = (*Manager)(nil)
+var _ RelayManager = readOnly{}
+
+// readOnly serves the reads of a RelayManager and rejects every change
+type readOnly struct {
+	RelayManager
+}
+
+// ReadOnly wraps m so that rankings and stats can be served (e.g. by a replica sharing m's
+// store) while every mutating operation fails with ErrReadOnly
+func ReadOnly(m RelayManager) RelayManager {
+	return readOnly{RelayManager: m}
+}
+
+func (readOnly) AddRelay(ctx context.Context, url string, source string) error {
+	return ErrReadOnly
+}
+
+func (readOnly) AddMandatoryRelay(ctx context.Context, url string) error {
+	return ErrReadOnly
+}
+
+func (readOnly) RemoveRelay(ctx context.Context, url string) error {
+	return ErrReadOnly
+}
+
+func (readOnly) UpdateHealth(ctx context.Context, url string, success bool, responseTime time.Duration) error {
+	return ErrReadOnly
+}
+
+func (readOnly) RecordFailure(ctx context.Context, url string, err error) error {
+	return ErrReadOnly
+}
+
+func (readOnly) TrackPublishResult(ctx context.Context, url string, success bool, responseTime time.Duration, err error) error {
+	return ErrReadOnly
+}
+
+func (readOnly) RecordLateSuccess(ctx context.Context, url string, responseTime time.Duration) error {
+	return ErrReadOnly
+}
+
+func (readOnly) RecordDuplicate(ctx context.Context, url string, responseTime time.Duration) error {
+	return ErrReadOnly
+}
+
+func (readOnly) RecordCanary(ctx context.Context, url string, success bool, responseTime time.Duration) error {
+	return ErrReadOnly
+}
+
+func (readOnly) SetConsistency(ctx context.Context, url string, consistency float64) error {
+	return ErrReadOnly
+}
+
+func (readOnly) SetCapabilities(ctx context.Context, url string, caps Capabilities) error {
+	return ErrReadOnly
+}
+
+func (readOnly) MarkInitialized(ctx context.Context) error {
+	return ErrReadOnly
+}
+
+func (readOnly) ResetRelayStats(ctx context.Context, url string) error {
+	return ErrReadOnly
+}
+
+func (readOnly) ResetAllRelayStats(ctx context.Context) (int, error) {
+	return 0, ErrReadOnly
+}
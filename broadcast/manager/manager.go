@@ -0,0 +1,802 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/netdiag"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-lib/json"
+)
+
+type RelayInfo struct {
+	URL                string
+	AvgResponseTime    time.Duration
+	SuccessRate        float64
+	TotalAttempts      int64
+	SuccessfulAttempts int64
+	LastChecked        time.Time
+	IsMandatory        bool
+	// Provenance: discovery source (see Sources), when the URL was first seen, and the last
+	// publish the relay accepted
+	Source      string
+	FirstSeen   time.Time
+	LastSuccess time.Time
+	// Failure diagnostics: counts per netdiag class and the most recent error
+	FailureCounts map[string]int64
+	LastError     string
+	LastErrorAt   time.Time
+	RecentErrors  []RecentError // most recent last, at most maxRecentErrors
+	// Flap damping: last outcome, recoveries and recent outcome flips (see FlapDamping)
+	LastUp      bool
+	Flaps       int64 // failures followed by a success
+	RecoveredAt time.Time
+	flips       []time.Time
+	// Coverage: "duplicate:" answers, i.e. the event had already reached the relay another way
+	Duplicates   int64
+	CoverageRate float64 // decaying share of publishes answered as duplicates
+	// Canaries: pipeline canary publishes, scored apart from organic traffic (see SetCanaryWeight)
+	CanaryChecks       int64
+	CanaryRate         float64 // decaying share of canaries accepted
+	CanaryResponseTime time.Duration
+	// NIP-11 consistency: share of observations matching the relay's claims (see SetConsistencyPenalty)
+	Consistency       float64
+	ConsistencyScored bool
+	// NIP-11 limitations, nil until the health checker fetched them (see Capabilities)
+	Capabilities *Capabilities
+}
+
+// maxRecentErrors is the size of each relay's recent-errors ring buffer
+const maxRecentErrors = 10
+
+// RecentError is one failed check or publish with the relay's own explanation, if any
+type RecentError struct {
+	At      time.Time
+	Class   string
+	Message string   // exact error, including the OK reason for rejections
+	Notices []string // NOTICE frames the relay sent shortly before
+}
+
+// noticeCarrier is implemented by publish errors that captured the relay's recent NOTICEs
+type noticeCarrier interface {
+	RecentNotices() []string
+}
+
+type Manager struct {
+	relays      map[string]*RelayInfo
+	mu          sync.RWMutex
+	decay       float64
+	topN        int
+	initialized bool
+	flap        FlapDamping
+	// Per-operator cap on the top-N set (see OperatorLimit)
+	operatorLimit OperatorLimit
+	// Top-N slots reserved for community relays (see CommunityFloor)
+	community    CommunityFloor
+	communitySet map[string]bool
+	// Discovery sources allowed into the top N (nil = all)
+	topSources map[string]bool
+	// Score points taken off a relay that answers every publish as a duplicate (see SetCoveragePenalty)
+	coveragePenalty float64
+	// Score points added to a relay that accepts every canary instantly (see SetCanaryWeight)
+	canaryWeight float64
+	// Score points taken off a relay that always contradicts its NIP-11 claims (see SetConsistencyPenalty)
+	consistencyPenalty float64
+	// Base score of relays (see SetScoring; nil = balanced) and its name and weights for stats
+	scoreFunc      ScoreFunc
+	scoring        string
+	scoringWeights *ScoringWeights
+	// Score band around the last top-N slot shuffled by weight on each selection (see SetTieMargin)
+	tieMargin float64
+}
+
+func NewManager(topN int, decay float64) *Manager {
+	logging.Debug("Manager: Initializing manager: topN=%d, decay=%.2f", topN, decay)
+	return &Manager{
+		relays:      make(map[string]*RelayInfo),
+		decay:       decay,
+		topN:        topN,
+		initialized: false,
+	}
+}
+
+// AddRelay adds a new relay discovered through source (see Sources) to the manager; a known
+// relay keeps the source it was first seen through
+func (m *Manager) AddRelay(ctx context.Context, url string, source string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.relays[url]; !exists {
+		now := time.Now()
+		m.relays[url] = &RelayInfo{
+			URL:                url,
+			AvgResponseTime:    0,
+			SuccessRate:        1.0, // Start optimistic
+			TotalAttempts:      0,
+			SuccessfulAttempts: 0,
+			LastChecked:        now,
+			IsMandatory:        false,
+			Source:             source,
+			FirstSeen:          now,
+		}
+		logging.Debug("Manager: Added new relay: %s from %s (total relays: %d)", url, source, len(m.relays))
+	} else {
+		logging.Debug("Manager: Relay already exists: %s", url)
+	}
+	return nil
+}
+
+// AddMandatoryRelay adds a mandatory relay to the manager
+func (m *Manager) AddMandatoryRelay(ctx context.Context, url string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if relay, exists := m.relays[url]; exists {
+		relay.IsMandatory = true
+		logging.Debug("Manager: Marked relay as mandatory: %s", url)
+	} else {
+		now := time.Now()
+		m.relays[url] = &RelayInfo{
+			URL:                url,
+			AvgResponseTime:    0,
+			SuccessRate:        1.0, // Start optimistic
+			TotalAttempts:      0,
+			SuccessfulAttempts: 0,
+			LastChecked:        now,
+			IsMandatory:        true,
+			Source:             SourceManual,
+			FirstSeen:          now,
+		}
+		logging.Debug("Manager: Added new mandatory relay: %s (total relays: %d)", url, len(m.relays))
+	}
+	return nil
+}
+
+// UpdateHealth updates relay health after an initial check
+func (m *Manager) UpdateHealth(ctx context.Context, url string, success bool, responseTime time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	relay, exists := m.relays[url]
+	if !exists {
+		return fmt.Errorf("update health of %s: %w", url, ErrRelayNotFound)
+	}
+
+	oldSuccessRate := relay.SuccessRate
+	m.recordOutcome(relay, success, time.Now())
+	relay.TotalAttempts++
+
+	if success {
+		relay.SuccessfulAttempts++
+
+		// Update average response time using exponential moving average
+		if relay.AvgResponseTime == 0 {
+			relay.AvgResponseTime = responseTime
+		} else {
+			relay.AvgResponseTime = time.Duration(
+				float64(relay.AvgResponseTime)*0.7 + float64(responseTime)*0.3,
+			)
+		}
+
+		logging.Debug("Manager: Health update SUCCESS: %s | attempts=%d/%d | responseTime=%.2fms",
+			url, relay.SuccessfulAttempts, relay.TotalAttempts, responseTime.Seconds()*1000)
+	} else {
+		logging.Debug("Manager: Health update FAILED: %s | attempts=%d/%d",
+			url, relay.SuccessfulAttempts, relay.TotalAttempts)
+	}
+
+	relay.LastChecked = time.Now()
+
+	// After initialization, use exponential decay for success rate
+	if m.initialized {
+		successValue := 0.0
+		if success {
+			successValue = 1.0
+		}
+		relay.SuccessRate = relay.SuccessRate*m.decay + successValue*(1-m.decay)
+		logging.Debug("Manager: Success rate updated (exponential decay): %s | %.4f -> %.4f",
+			url, oldSuccessRate, relay.SuccessRate)
+	} else {
+		// During initialization, use simple success rate
+		if relay.TotalAttempts > 0 {
+			relay.SuccessRate = float64(relay.SuccessfulAttempts) / float64(relay.TotalAttempts)
+			logging.Debug("Manager: Success rate updated (simple): %s | %.4f -> %.4f",
+				url, oldSuccessRate, relay.SuccessRate)
+		}
+	}
+	return nil
+}
+
+// RecordFailure classifies a connection or publish error and adds it to the relay's failure breakdown
+func (m *Manager) RecordFailure(ctx context.Context, url string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	class := netdiag.Classify(err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	relay, exists := m.relays[url]
+	if !exists {
+		return fmt.Errorf("record failure of %s: %w", url, ErrRelayNotFound)
+	}
+	if relay.FailureCounts == nil {
+		relay.FailureCounts = make(map[string]int64)
+	}
+	relay.FailureCounts[class]++
+	relay.LastError = err.Error()
+	relay.LastErrorAt = time.Now()
+
+	recent := RecentError{At: relay.LastErrorAt, Class: class, Message: relay.LastError}
+	var carrier noticeCarrier
+	if errors.As(err, &carrier) {
+		recent.Notices = carrier.RecentNotices()
+	}
+	if len(relay.RecentErrors) >= maxRecentErrors {
+		relay.RecentErrors = relay.RecentErrors[1:]
+	}
+	relay.RecentErrors = append(relay.RecentErrors, recent)
+	logging.DebugMethod("manager", "RecordFailure", "%s failed with class=%s: %v", url, class, err)
+	return nil
+}
+
+// RecordLateSuccess turns a publish that was counted as a timeout into a success, after the
+// relay's OK arrived past the publish deadline: the attempt counts as successful, the timeout
+// leaves the failure breakdown and the success rate gets back the weight the failure took
+func (m *Manager) RecordLateSuccess(ctx context.Context, url string, responseTime time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	relay, exists := m.relays[url]
+	if !exists {
+		return fmt.Errorf("record late success of %s: %w", url, ErrRelayNotFound)
+	}
+	if relay.SuccessfulAttempts >= relay.TotalAttempts {
+		// Stats were reset since the publish: nothing left to correct
+		return nil
+	}
+
+	oldSuccessRate := relay.SuccessRate
+	relay.SuccessfulAttempts++
+	if m.initialized {
+		relay.SuccessRate += 1 - m.decay
+		if relay.SuccessRate > 1 {
+			relay.SuccessRate = 1
+		}
+	} else {
+		relay.SuccessRate = float64(relay.SuccessfulAttempts) / float64(relay.TotalAttempts)
+	}
+	if relay.AvgResponseTime == 0 {
+		relay.AvgResponseTime = responseTime
+	} else {
+		relay.AvgResponseTime = time.Duration(float64(relay.AvgResponseTime)*0.7 + float64(responseTime)*0.3)
+	}
+	if relay.FailureCounts[netdiag.ClassTimeout] > 0 {
+		relay.FailureCounts[netdiag.ClassTimeout]--
+	}
+	relay.LastSuccess = time.Now()
+	logging.DebugMethod("manager", "RecordLateSuccess", "%s: late OK after %v | success rate %.4f -> %.4f",
+		url, responseTime, oldSuccessRate, relay.SuccessRate)
+	return nil
+}
+
+// MarkInitialized marks the manager as initialized
+func (m *Manager) MarkInitialized(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initialized = true
+	logging.Info("Manager: Initialization complete - switching to exponential decay mode")
+	logging.Debug("Manager: Decay factor=%.2f, Total relays=%d", m.decay, len(m.relays))
+	return nil
+}
+
+// GetTopRelays returns the top N relays based on composite score
+func (m *Manager) GetTopRelays(ctx context.Context) ([]*RelayInfo, error) {
+	return m.GetTopRelaysN(ctx, m.topN)
+}
+
+// GetTopRelaysN returns the n best tested relays (by composite score)
+func (m *Manager) GetTopRelaysN(ctx context.Context, n int) ([]*RelayInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.topRelays(n), nil
+}
+
+func (m *Manager) topRelays(n int) []*RelayInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	relays := make([]*RelayInfo, 0, len(m.relays))
+	untested := 0
+	held := 0
+	excludedSource := 0
+	excludedCaps := 0
+	now := time.Now()
+	for _, relay := range m.relays {
+		// Only include relays that have been tested at least once
+		if relay.TotalAttempts == 0 {
+			untested++
+			continue
+		}
+		// Flapping relays wait out their hold-down before re-entering the set
+		if isHeld, _ := m.heldDown(relay, now); isHeld {
+			held++
+			continue
+		}
+		if !m.sourceAllowed(relay) {
+			excludedSource++
+			continue
+		}
+		// Relays whose NIP-11 limitations rule out our events would only fail every publish
+		if unusable(relay) {
+			excludedCaps++
+			continue
+		}
+		relays = append(relays, relay)
+	}
+
+	logging.Debug("Manager: GetTopRelays - %d tested relays, %d untested, %d held down (flapping), %d from excluded sources, %d unusable (NIP-11)",
+		len(relays), untested, held, excludedSource, excludedCaps)
+
+	// Sort by composite score, ties broken deterministically (see rankRelays)
+	m.rankRelays(relays, n)
+
+	// Log top 5 for visibility (in verbose mode)
+	if logging.VerboseEnabled() {
+		logCount := 5
+		if len(relays) < logCount {
+			logCount = len(relays)
+		}
+		for i := 0; i < logCount; i++ {
+			r := relays[i]
+			score := m.calculateScore(r)
+			logging.Debug("Manager:   Top #%d: %s | score=%.2f | success=%.2f%% | avg_time=%.2fms | attempts=%d",
+				i+1, r.URL, score, r.SuccessRate*100, r.AvgResponseTime.Seconds()*1000, r.TotalAttempts)
+		}
+	}
+
+	// Community relays entitled to the reserved slots go first, whatever their score
+	relays, lifted := m.reserveCommunity(relays, n)
+	if lifted > 0 {
+		logging.Debug("Manager: Promoted %d community relays into the reserved top-N slots", lifted)
+	}
+
+	// Return top N, at most MaxPerOperator of them run by the same operator
+	picked, capped := m.capOperators(relays, n)
+	if capped > 0 {
+		logging.Debug("Manager: Skipped %d relays over the per-operator cap of %d", capped, m.operatorLimit.MaxPerOperator)
+	}
+	if m.community.Fraction > 0 {
+		m.sortByScore(picked)
+	}
+	if len(relays) > n {
+		logging.Debug("Manager: Returning top %d out of %d tested relays", len(picked), len(relays))
+		return picked
+	}
+	logging.Debug("Manager: Returning all %d tested relays (less than topN=%d)", len(picked), n)
+	return picked
+}
+
+// CalculateScore computes a composite score for ranking: the scoring strategy's base score (see
+// SetScoring) with the coverage, canary and consistency adjustments. Higher is better
+func (m *Manager) CalculateScore(relay *RelayInfo) float64 {
+	score := m.baseScore(relay) - relay.CoverageRate*m.coveragePenalty + m.canaryBoost(relay) - m.consistencyMalus(relay)
+
+	// Penalize relays with very few attempts during initialization
+	if !m.initialized && relay.TotalAttempts < 3 {
+		score *= 0.5
+	}
+
+	return score
+}
+
+// calculateScore is the internal version
+func (m *Manager) calculateScore(relay *RelayInfo) float64 {
+	return m.CalculateScore(relay)
+}
+
+// GetAllRelays returns all relays (for discovery purposes)
+func (m *Manager) GetAllRelays(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	urls := make([]string, 0, len(m.relays))
+	for url := range m.relays {
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+// GetRelayCount returns the number of tracked relays
+func (m *Manager) GetRelayCount(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.relays), nil
+}
+
+// RemoveRelay removes a relay from the manager
+func (m *Manager) RemoveRelay(ctx context.Context, url string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.relays[url]; !exists {
+		return fmt.Errorf("remove %s: %w", url, ErrRelayNotFound)
+	}
+	delete(m.relays, url)
+	logging.Info("Manager: Removed relay: %s", url)
+	return nil
+}
+
+// GetRelayInfo returns info about a specific relay
+func (m *Manager) GetRelayInfo(ctx context.Context, url string) (*RelayInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if relay, exists := m.relays[url]; exists {
+		// Return a copy
+		relayCopy := *relay
+		relayCopy.FailureCounts = make(map[string]int64, len(relay.FailureCounts))
+		for class, count := range relay.FailureCounts {
+			relayCopy.FailureCounts[class] = count
+		}
+		relayCopy.RecentErrors = append([]RecentError(nil), relay.RecentErrors...)
+		relayCopy.flips = append([]time.Time(nil), relay.flips...)
+		return &relayCopy, nil
+	}
+	return nil, ErrRelayNotFound
+}
+
+// ResetRelayStats clears the health history of a relay so it is re-scored from scratch.
+// Returns ErrRelayNotFound if the relay is unknown.
+func (m *Manager) ResetRelayStats(ctx context.Context, url string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	relay, exists := m.relays[url]
+	if !exists {
+		return ErrRelayNotFound
+	}
+	resetRelayInfo(relay)
+	logging.Info("Manager: Reset stats for relay: %s", url)
+	return nil
+}
+
+// ResetAllRelayStats clears the health history of every relay and returns how many were reset
+func (m *Manager) ResetAllRelayStats(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, relay := range m.relays {
+		resetRelayInfo(relay)
+	}
+	logging.Info("Manager: Reset stats for all %d relays", len(m.relays))
+	return len(m.relays), nil
+}
+
+func resetRelayInfo(relay *RelayInfo) {
+	relay.AvgResponseTime = 0
+	relay.SuccessRate = 1.0 // Start optimistic, as for new relays
+	relay.TotalAttempts = 0
+	relay.SuccessfulAttempts = 0
+	relay.LastChecked = time.Now()
+	relay.FailureCounts = nil
+	relay.LastError = ""
+	relay.LastErrorAt = time.Time{}
+	relay.RecentErrors = nil
+	relay.LastUp = false
+	relay.Flaps = 0
+	relay.RecoveredAt = time.Time{}
+	relay.flips = nil
+	relay.Duplicates = 0
+	relay.CoverageRate = 0
+	relay.CanaryChecks = 0
+	relay.CanaryRate = 0
+	relay.Consistency = 0
+	relay.ConsistencyScored = false
+	relay.CanaryResponseTime = 0
+}
+
+// GetMandatoryRelays returns all mandatory relays
+func (m *Manager) GetMandatoryRelays(ctx context.Context) ([]*RelayInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.mandatoryRelays(), nil
+}
+
+func (m *Manager) mandatoryRelays() []*RelayInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	relays := make([]*RelayInfo, 0)
+	for _, relay := range m.relays {
+		if relay.IsMandatory {
+			relays = append(relays, relay)
+		}
+	}
+	return relays
+}
+
+// GetBroadcastRelays returns the top relays for broadcasting
+func (m *Manager) GetBroadcastRelays(ctx context.Context) ([]string, error) {
+	return m.GetBroadcastRelaysN(ctx, m.topN)
+}
+
+// GetBroadcastRelaysN returns the URLs of the n best relays (per-event fan-out override)
+func (m *Manager) GetBroadcastRelaysN(ctx context.Context, n int) ([]string, error) {
+	topRelays, err := m.GetTopRelaysN(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	relayURLs := make([]string, len(topRelays))
+	for i, relay := range topRelays {
+		relayURLs[i] = relay.URL
+	}
+	return relayURLs, nil
+}
+
+// TrackPublishResult tracks the result of a publish operation. Soft failures (HTTP throttling on
+// the upgrade, "rate-limited:" answers) go to the failure breakdown only: the relay is up, it just
+// asked us to back off. Hard rejects and unreachable relays count against the success rate.
+func (m *Manager) TrackPublishResult(ctx context.Context, url string, success bool, responseTime time.Duration, err error) error {
+	if !success && netdiag.Soft(netdiag.Classify(err)) {
+		return m.RecordFailure(ctx, url, err)
+	}
+	if updateErr := m.UpdateHealth(ctx, url, success, responseTime); updateErr != nil {
+		return updateErr
+	}
+	if !success {
+		return m.RecordFailure(ctx, url, err)
+	}
+	m.markPublished(url, time.Now())
+	return nil
+}
+
+// markPublished records a publish url accepted
+func (m *Manager) markPublished(url string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	relay, exists := m.relays[url]
+	if !exists {
+		return
+	}
+	if at.After(relay.LastSuccess) {
+		relay.LastSuccess = at
+	}
+	relay.CoverageRate *= m.decay // a new event for the relay: coverage fades
+}
+
+// CheckBatch performs health checks on multiple relays
+func (m *Manager) CheckBatch(urls []string) {
+	// This is a placeholder - the actual health checking logic
+	// would be implemented by the health package
+	logging.Debug("Manager: CheckBatch called with %d relays", len(urls))
+}
+
+// CheckInitial performs an initial health check on a relay
+func (m *Manager) CheckInitial(url string) bool {
+	// This is a placeholder - the actual health checking logic
+	// would be implemented by the health package
+	logging.Debug("Manager: CheckInitial called for relay %s", url)
+	return true
+}
+
+// ManagerStats represents manager statistics
+type ManagerStats struct {
+	MandatoryRelayList []RelayStats `json:"mandatory_relay_list"`
+	TopRelays          []RelayStats `json:"top_relays"`
+	TotalRelays        int          `json:"total_relays"`
+	TopN               int          `json:"top_n"`
+	Decay              float64      `json:"decay"`
+	Initialized        bool         `json:"initialized"`
+}
+
+// RelayStats represents individual relay statistics for JSON output
+type RelayStats struct {
+	URL           string  `json:"url"`
+	Score         float64 `json:"score"`
+	SuccessRate   float64 `json:"success_rate"`
+	AvgResponseMs int64   `json:"avg_response_ms"`
+	TotalAttempts int64   `json:"total_attempts"`
+	IsMandatory   bool    `json:"is_mandatory"`
+	LastChecked   string  `json:"last_checked"`
+}
+
+// GetStatsName returns the name for this stats provider
+func (m *Manager) GetStatsName() string {
+	return "manager"
+}
+
+// GetStats returns manager-specific statistics as a JsonEntity
+func (m *Manager) GetStats() json.JsonEntity {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj := json.NewJsonObject()
+
+	// Add basic stats
+	obj.Set("total_relays", json.NewJsonValue(len(m.relays)))
+	obj.Set("top_n", json.NewJsonValue(m.topN))
+	obj.Set("decay", json.NewJsonValue(m.decay))
+	obj.Set("initialized", json.NewJsonValue(m.initialized))
+
+	topRelays := m.topRelays(m.topN)
+	mandatoryRelays := m.mandatoryRelays()
+
+	// Convert top relays to JsonList
+	topRelayList := json.NewJsonList()
+	for _, relay := range topRelays {
+		topRelayList.Append(m.RelayStatsObject(relay))
+	}
+
+	// Convert mandatory relays to JsonList
+	mandatoryRelayList := json.NewJsonList()
+	for _, relay := range mandatoryRelays {
+		mandatoryRelayList.Append(m.RelayStatsObject(relay))
+	}
+
+	// Failure breakdown across the whole pool
+	failureTotals := make(map[string]int64)
+	var soft, hard int64
+	excluded := make(map[string]int)
+	for _, relay := range m.relays {
+		if unusable(relay) {
+			excluded[relay.Capabilities.Excluded]++
+		}
+		for class, count := range relay.FailureCounts {
+			failureTotals[class] += count
+			if netdiag.Soft(class) {
+				soft += count
+			} else {
+				hard += count
+			}
+		}
+	}
+
+	obj.Set("top_relays", topRelayList)
+	obj.Set("mandatory_relays", mandatoryRelayList)
+	obj.Set("failure_classes", failureCountsObject(failureTotals))
+	obj.Set("soft_failures", json.NewJsonValue(soft))
+	obj.Set("hard_failures", json.NewJsonValue(hard))
+	obj.Set("flap_damping", m.flapStatsObject(time.Now()))
+	obj.Set("coverage", m.coverageStatsObject())
+	obj.Set("canary", m.canaryStatsObject())
+	obj.Set("consistency", m.consistencyStatsObject())
+	obj.Set("ties", m.tieStatsObject())
+	obj.Set("scoring", m.scoringStatsObject())
+	reasons := make([]string, 0, len(excluded))
+	for reason := range excluded {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	excludedObj := json.NewJsonObject()
+	for _, reason := range reasons {
+		excludedObj.Set(reason, json.NewJsonValue(excluded[reason]))
+	}
+	obj.Set("capability_excluded", excludedObj)
+	if len(m.communitySet) > 0 {
+		obj.Set("community", m.communityStatsObject(topRelays))
+	}
+
+	return obj
+}
+
+// RelayStatsObject renders one relay's statistics, including its failure breakdown
+func (m *Manager) RelayStatsObject(relay *RelayInfo) *json.JsonObject {
+	relayObj := json.NewJsonObject()
+	score := m.CalculateScore(relay)
+	relayObj.Set("url", json.NewJsonValue(relay.URL))
+	relayObj.Set("score", json.NewJsonValue(score))
+	relayObj.Set("success_rate", json.NewJsonValue(relay.SuccessRate))
+	relayObj.Set("avg_response_ms", json.NewJsonValue(relay.AvgResponseTime.Milliseconds()))
+	relayObj.Set("total_attempts", json.NewJsonValue(relay.TotalAttempts))
+	relayObj.Set("is_mandatory", json.NewJsonValue(relay.IsMandatory))
+	relayObj.Set("last_checked", json.NewJsonValue(relay.LastChecked.Format(time.RFC3339)))
+	relayObj.Set("source", json.NewJsonValue(relay.Source))
+	if !relay.FirstSeen.IsZero() {
+		relayObj.Set("first_seen", json.NewJsonValue(relay.FirstSeen.Format(time.RFC3339)))
+	}
+	if !relay.LastSuccess.IsZero() {
+		relayObj.Set("last_success", json.NewJsonValue(relay.LastSuccess.Format(time.RFC3339)))
+	}
+	if len(relay.FailureCounts) > 0 {
+		relayObj.Set("failures", failureCountsObject(relay.FailureCounts))
+		relayObj.Set("last_error", json.NewJsonValue(relay.LastError))
+		relayObj.Set("last_error_at", json.NewJsonValue(relay.LastErrorAt.Format(time.RFC3339)))
+	}
+	relayObj.Set("flaps", json.NewJsonValue(relay.Flaps))
+	relayObj.Set("duplicates", json.NewJsonValue(relay.Duplicates))
+	relayObj.Set("coverage_rate", json.NewJsonValue(relay.CoverageRate))
+	if relay.ConsistencyScored {
+		relayObj.Set("consistency", json.NewJsonValue(relay.Consistency))
+	}
+	if relay.CanaryChecks > 0 {
+		relayObj.Set("canary_checks", json.NewJsonValue(relay.CanaryChecks))
+		relayObj.Set("canary_rate", json.NewJsonValue(relay.CanaryRate))
+		relayObj.Set("canary_response_ms", json.NewJsonValue(relay.CanaryResponseTime.Milliseconds()))
+	}
+	if relay.Capabilities != nil {
+		relayObj.Set("capabilities", capabilitiesObject(relay.Capabilities))
+	}
+	if isHeld, until := m.heldDown(relay, time.Now()); isHeld {
+		relayObj.Set("held_down", json.NewJsonValue(true))
+		if !until.IsZero() {
+			relayObj.Set("held_until", json.NewJsonValue(until.Format(time.RFC3339)))
+		}
+	}
+	return relayObj
+}
+
+// RelayDetailObject renders one relay's statistics plus its recent-errors ring buffer (relay detail API)
+func (m *Manager) RelayDetailObject(relay *RelayInfo) *json.JsonObject {
+	relayObj := m.RelayStatsObject(relay)
+	recentList := json.NewJsonList()
+	for i := len(relay.RecentErrors) - 1; i >= 0; i-- { // newest first
+		recent := relay.RecentErrors[i]
+		notices := json.NewJsonList()
+		for _, notice := range recent.Notices {
+			notices.Append(json.NewJsonValue(notice))
+		}
+		errObj := json.NewJsonObject()
+		errObj.Set("at", json.NewJsonValue(recent.At.Format(time.RFC3339)))
+		errObj.Set("class", json.NewJsonValue(recent.Class))
+		errObj.Set("message", json.NewJsonValue(recent.Message))
+		errObj.Set("notices", notices)
+		recentList.Append(errObj)
+	}
+	relayObj.Set("recent_errors", recentList)
+	return relayObj
+}
+
+// failureCountsObject renders failure counts in netdiag class order, omitting zero classes
+func failureCountsObject(counts map[string]int64) *json.JsonObject {
+	obj := json.NewJsonObject()
+	for _, class := range netdiag.Classes {
+		if count := counts[class]; count > 0 {
+			obj.Set(class, json.NewJsonValue(count))
+		}
+	}
+	return obj
+}
@@ -0,0 +1,45 @@
+package manager
+
+// OperatorLimit caps how many relays of one operator (as identified by OperatorOf, e.g. from
+// NIP-11 pubkey/contact) the top-N set may contain. Relays with an unknown operator are not
+// limited.
+type OperatorLimit struct {
+	MaxPerOperator int                     // 0 = unlimited
+	OperatorOf     func(url string) string // "" = unknown; must not block
+}
+
+// SetOperatorLimit enables the per-operator cap for the top-N selection
+func (m *Manager) SetOperatorLimit(limit OperatorLimit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.operatorLimit = limit
+}
+
+// capOperators picks up to n relays from ranked (best first), skipping relays whose operator
+// already has MaxPerOperator relays in the set; returns the pick and how many were skipped
+func (m *Manager) capOperators(ranked []*RelayInfo, n int) ([]*RelayInfo, int) {
+	if m.operatorLimit.MaxPerOperator <= 0 || m.operatorLimit.OperatorOf == nil {
+		if len(ranked) > n {
+			return ranked[:n], 0
+		}
+		return ranked, 0
+	}
+
+	picked := make([]*RelayInfo, 0, n)
+	perOperator := make(map[string]int)
+	skipped := 0
+	for _, relay := range ranked {
+		if len(picked) >= n {
+			break
+		}
+		if operator := m.operatorLimit.OperatorOf(relay.URL); operator != "" {
+			if perOperator[operator] >= m.operatorLimit.MaxPerOperator {
+				skipped++
+				continue
+			}
+			perOperator[operator]++
+		}
+		picked = append(picked, relay)
+	}
+	return picked, skipped
+}
@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/girino/nostr-lib/json"
+)
+
+// Scoring strategies (see StrategyWeights)
+const (
+	StrategyBalanced         = "balanced"
+	StrategyLatencyFirst     = "latency-first"
+	StrategyReliabilityFirst = "reliability-first"
+)
+
+const (
+	// recencyWindow is how long the recency bonus of a successful publish takes to run out
+	recencyWindow = time.Hour
+	// attemptsForConfidence is the number of attempts earning the full attempts bonus
+	attemptsForConfidence = 100
+)
+
+// ScoreFunc computes the base score of a relay, higher is better. The coverage, canary and
+// consistency adjustments and the initialization penalty are applied on top of it. Called with
+// the manager lock held: it must not call back into the manager.
+type ScoreFunc func(relay *RelayInfo, now time.Time) float64
+
+// ScoringWeights are the score points of each term of WeightedScore
+type ScoringWeights struct {
+	Success  float64 // per unit of success rate (0 to 1)
+	Latency  float64 // taken off per second of average response time
+	Recency  float64 // for a success just now, running out over an hour without one
+	Attempts float64 // for a well-known relay, reached at 100 attempts
+}
+
+// strategies are the weights of the named strategies; balanced is the historical formula
+var strategies = map[string]ScoringWeights{
+	StrategyBalanced:         {Success: 100, Latency: 10},
+	StrategyLatencyFirst:     {Success: 60, Latency: 40},
+	StrategyReliabilityFirst: {Success: 150, Latency: 2, Recency: 10, Attempts: 10},
+}
+
+// StrategyWeights returns the weights of a named strategy; false if there is no such strategy
+func StrategyWeights(strategy string) (ScoringWeights, bool) {
+	weights, ok := strategies[strategy]
+	return weights, ok
+}
+
+// WeightedScore scores relays on their success rate, average response time, time since the last
+// successful publish and number of attempts, weighted by w
+func WeightedScore(w ScoringWeights) ScoreFunc {
+	return func(relay *RelayInfo, now time.Time) float64 {
+		score := relay.SuccessRate * w.Success
+		if relay.AvgResponseTime > 0 {
+			score -= relay.AvgResponseTime.Seconds() * w.Latency
+		}
+		if w.Recency != 0 && !relay.LastSuccess.IsZero() {
+			if age := now.Sub(relay.LastSuccess); age < recencyWindow {
+				score += w.Recency * (1 - float64(max(age, 0))/float64(recencyWindow))
+			}
+		}
+		if w.Attempts != 0 {
+			score += w.Attempts * float64(min(relay.TotalAttempts, attemptsForConfidence)) / attemptsForConfidence
+		}
+		return score
+	}
+}
+
+// SetScoring replaces the base score of relays with fn, reported in stats as strategy. A nil fn
+// restores the balanced strategy.
+func (m *Manager) SetScoring(strategy string, fn ScoreFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fn == nil {
+		strategy, fn = StrategyBalanced, WeightedScore(strategies[StrategyBalanced])
+	}
+	m.scoring, m.scoreFunc, m.scoringWeights = strategy, fn, nil
+}
+
+// SetScoringWeights scores relays with WeightedScore(w), reported in stats as strategy
+func (m *Manager) SetScoringWeights(strategy string, w ScoringWeights) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scoring, m.scoreFunc, m.scoringWeights = strategy, WeightedScore(w), &w
+}
+
+// baseScore is the score of relay before the manager's own adjustments
+func (m *Manager) baseScore(relay *RelayInfo) float64 {
+	if m.scoreFunc == nil {
+		return WeightedScore(strategies[StrategyBalanced])(relay, time.Now())
+	}
+	return m.scoreFunc(relay, time.Now())
+}
+
+// scoringStatsObject describes the scoring in use
+func (m *Manager) scoringStatsObject() *json.JsonObject {
+	obj := json.NewJsonObject()
+	strategy, weights := m.scoring, m.scoringWeights
+	if m.scoreFunc == nil {
+		balanced := strategies[StrategyBalanced]
+		strategy, weights = StrategyBalanced, &balanced
+	}
+	obj.Set("strategy", json.NewJsonValue(strategy))
+	if weights != nil {
+		obj.Set("success_weight", json.NewJsonValue(weights.Success))
+		obj.Set("latency_weight", json.NewJsonValue(weights.Latency))
+		obj.Set("recency_weight", json.NewJsonValue(weights.Recency))
+		obj.Set("attempts_weight", json.NewJsonValue(weights.Attempts))
+	}
+	return obj
+}
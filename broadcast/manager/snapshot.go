@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/kv"
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// RelaySnapshot is the persisted state of one relay: its score inputs and health history
+type RelaySnapshot struct {
+	URL                string           `json:"url"`
+	AvgResponseTime    time.Duration    `json:"avg_response_time"`
+	SuccessRate        float64          `json:"success_rate"`
+	TotalAttempts      int64            `json:"total_attempts"`
+	SuccessfulAttempts int64            `json:"successful_attempts"`
+	LastChecked        time.Time        `json:"last_checked"`
+	Source             string           `json:"source"`
+	FirstSeen          time.Time        `json:"first_seen"`
+	LastSuccess        time.Time        `json:"last_success,omitempty"`
+	FailureCounts      map[string]int64 `json:"failure_counts,omitempty"`
+	LastError          string           `json:"last_error,omitempty"`
+	LastErrorAt        time.Time        `json:"last_error_at,omitempty"`
+	RecentErrors       []RecentError    `json:"recent_errors,omitempty"`
+	LastUp             bool             `json:"last_up"`
+	Flaps              int64            `json:"flaps"`
+	RecoveredAt        time.Time        `json:"recovered_at,omitempty"`
+	Duplicates         int64            `json:"duplicates,omitempty"`
+	CoverageRate       float64          `json:"coverage_rate,omitempty"`
+	CanaryChecks       int64            `json:"canary_checks,omitempty"`
+	CanaryRate         float64          `json:"canary_rate,omitempty"`
+	CanaryResponseTime time.Duration    `json:"canary_response_time,omitempty"`
+	Capabilities       *Capabilities    `json:"capabilities,omitempty"`
+}
+
+// snapshotFile is the on-disk format of a manager snapshot
+type snapshotFile struct {
+	SavedAt time.Time       `json:"saved_at"`
+	Relays  []RelaySnapshot `json:"relays"`
+}
+
+// Snapshot returns the state of every relay
+func (m *Manager) Snapshot() []RelaySnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make([]RelaySnapshot, 0, len(m.relays))
+	for _, relay := range m.relays {
+		snap := RelaySnapshot{
+			URL:                relay.URL,
+			AvgResponseTime:    relay.AvgResponseTime,
+			SuccessRate:        relay.SuccessRate,
+			TotalAttempts:      relay.TotalAttempts,
+			SuccessfulAttempts: relay.SuccessfulAttempts,
+			LastChecked:        relay.LastChecked,
+			Source:             relay.Source,
+			FirstSeen:          relay.FirstSeen,
+			LastSuccess:        relay.LastSuccess,
+			LastError:          relay.LastError,
+			LastErrorAt:        relay.LastErrorAt,
+			RecentErrors:       append([]RecentError(nil), relay.RecentErrors...),
+			LastUp:             relay.LastUp,
+			Flaps:              relay.Flaps,
+			RecoveredAt:        relay.RecoveredAt,
+			Duplicates:         relay.Duplicates,
+			CoverageRate:       relay.CoverageRate,
+			CanaryChecks:       relay.CanaryChecks,
+			CanaryRate:         relay.CanaryRate,
+			CanaryResponseTime: relay.CanaryResponseTime,
+			Capabilities:       relay.Capabilities,
+		}
+		if len(relay.FailureCounts) > 0 {
+			snap.FailureCounts = make(map[string]int64, len(relay.FailureCounts))
+			for class, n := range relay.FailureCounts {
+				snap.FailureCounts[class] = n
+			}
+		}
+		result = append(result, snap)
+	}
+	return result
+}
+
+// Restore loads relay states from a snapshot: unknown relays are added, known ones (e.g. the
+// mandatory relays) take over the saved scores but keep their mandatory flag. It returns the
+// number of relays restored.
+func (m *Manager) Restore(relays []RelaySnapshot) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	restored := 0
+	for _, snap := range relays {
+		if snap.URL == "" {
+			continue
+		}
+		relay, exists := m.relays[snap.URL]
+		if !exists {
+			relay = &RelayInfo{URL: snap.URL}
+			m.relays[snap.URL] = relay
+		}
+		relay.AvgResponseTime = snap.AvgResponseTime
+		relay.SuccessRate = snap.SuccessRate
+		relay.TotalAttempts = snap.TotalAttempts
+		relay.SuccessfulAttempts = snap.SuccessfulAttempts
+		relay.LastChecked = snap.LastChecked
+		relay.Source = snap.Source
+		relay.FirstSeen = snap.FirstSeen
+		relay.LastSuccess = snap.LastSuccess
+		relay.FailureCounts = snap.FailureCounts
+		relay.LastError = snap.LastError
+		relay.LastErrorAt = snap.LastErrorAt
+		relay.RecentErrors = snap.RecentErrors
+		relay.LastUp = snap.LastUp
+		relay.Flaps = snap.Flaps
+		relay.RecoveredAt = snap.RecoveredAt
+		relay.Duplicates = snap.Duplicates
+		relay.CoverageRate = snap.CoverageRate
+		relay.CanaryChecks = snap.CanaryChecks
+		relay.CanaryRate = snap.CanaryRate
+		relay.CanaryResponseTime = snap.CanaryResponseTime
+		relay.Capabilities = snap.Capabilities
+		if !ValidSource(relay.Source) {
+			relay.Source = SourceSeed
+		}
+		restored++
+	}
+	logging.Debug("Manager: Restored %d relays (total relays: %d)", restored, len(m.relays))
+	return restored
+}
+
+// SaveSnapshot writes the state of every relay to target
+func (m *Manager) SaveSnapshot(target kv.Target) error {
+	return target.Save(snapshotFile{SavedAt: time.Now(), Relays: m.Snapshot()})
+}
+
+// LoadSnapshot restores the relays saved in target unless the snapshot is older than maxAge (0 =
+// any age). Nothing saved restores nothing.
+func (m *Manager) LoadSnapshot(target kv.Target, maxAge time.Duration) (int, error) {
+	var file snapshotFile
+	found, err := target.Load(&file)
+	if err != nil || !found {
+		return 0, err
+	}
+	if maxAge > 0 && time.Since(file.SavedAt) > maxAge {
+		logging.Info("Manager: Ignoring relay snapshot %s from %s (older than %v)", target, file.SavedAt.Format(time.RFC3339), maxAge)
+		return 0, nil
+	}
+	return m.Restore(file.Relays), nil
+}
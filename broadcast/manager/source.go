@@ -0,0 +1,65 @@
+package manager
+
+import (
+	"strings"
+	"time"
+)
+
+// Discovery sources: where a relay URL was first learned
+const (
+	SourceSeed      = "seed"       // configured seed relay
+	SourceRelayList = "relay_list" // kind 3 / 10002 lists fetched from the seeds
+	SourceNIP65     = "nip65"      // write relays of the operator's follows
+	SourceEventTag  = "event_tag"  // relay hints in events passing through this relay
+	SourceImport    = "import"     // curated list (RELAY_IMPORT_URL/FILE)
+	SourceManual    = "manual"     // configured or added by an operator (mandatory, regional, community)
+)
+
+// Sources lists the discovery sources, most trusted first
+var Sources = []string{SourceManual, SourceSeed, SourceImport, SourceNIP65, SourceRelayList, SourceEventTag}
+
+// ValidSource reports whether source is one of Sources
+func ValidSource(source string) bool {
+	for _, s := range Sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTopSources limits the top-N selection to relays discovered through sources; relays from
+// other sources stay in the pool (tested, listed) but are never broadcast to unless mandatory.
+// Empty allows every source.
+func (m *Manager) SetTopSources(sources []string) {
+	allowed := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		allowed[strings.ToLower(strings.TrimSpace(source))] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(allowed) == 0 {
+		allowed = nil
+	}
+	m.topSources = allowed
+}
+
+// sourceAllowed reports whether relay may enter the top N by its discovery source
+func (m *Manager) sourceAllowed(relay *RelayInfo) bool {
+	return m.topSources == nil || m.topSources[relay.Source]
+}
+
+// Evictable reports whether relay should be dropped under an eviction policy (source -> maximum
+// time without a successful publish): it is not mandatory, came from a source with a policy,
+// has been known that long without a successful publish in it, and is failing its checks
+func Evictable(relay *RelayInfo, policy map[string]time.Duration, minSuccessRate float64, now time.Time) bool {
+	maxAge, ok := policy[relay.Source]
+	if !ok || maxAge <= 0 || relay.IsMandatory {
+		return false
+	}
+	lastGood := relay.FirstSeen
+	if relay.LastSuccess.After(lastGood) {
+		lastGood = relay.LastSuccess
+	}
+	return now.Sub(lastGood) > maxAge && relay.SuccessRate < minSuccessRate
+}
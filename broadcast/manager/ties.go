@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/girino/nostr-lib/json"
+)
+
+// SetTieMargin spreads load over the relays competing for the last top-N slots: relays scoring
+// within margin points of the one in the last slot are put in a weighted-random order (higher
+// score, better odds) on each selection instead of always the same ones winning. 0 keeps the
+// deterministic order.
+func (m *Manager) SetTieMargin(margin float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tieMargin = max(margin, 0)
+}
+
+// rankRelays sorts relays best first: by score, then by attempts (the better-known relay wins a
+// tie), then by URL, so equal scores do not reshuffle the top N between refreshes. With a tie
+// margin, the relays around the n-th slot are then shuffled by weight.
+func (m *Manager) rankRelays(relays []*RelayInfo, n int) {
+	scores := make(map[*RelayInfo]float64, len(relays))
+	for _, relay := range relays {
+		scores[relay] = m.calculateScore(relay)
+	}
+	sort.SliceStable(relays, func(i, j int) bool {
+		return rankedBefore(relays[i], relays[j], scores)
+	})
+	if m.tieMargin > 0 && n > 0 && n < len(relays) {
+		m.shuffleMargin(relays, n, scores)
+	}
+}
+
+// sortByScore restores rank order after reserveCommunity moved community relays forward
+func (m *Manager) sortByScore(relays []*RelayInfo) {
+	scores := make(map[*RelayInfo]float64, len(relays))
+	for _, relay := range relays {
+		scores[relay] = m.calculateScore(relay)
+	}
+	sort.SliceStable(relays, func(i, j int) bool {
+		return rankedBefore(relays[i], relays[j], scores)
+	})
+}
+
+func rankedBefore(a, b *RelayInfo, scores map[*RelayInfo]float64) bool {
+	if scores[a] != scores[b] {
+		return scores[a] > scores[b]
+	}
+	if a.TotalAttempts != b.TotalAttempts {
+		return a.TotalAttempts > b.TotalAttempts
+	}
+	return a.URL < b.URL
+}
+
+// shuffleMargin reorders the relays scoring within the tie margin of the n-th one by weighted
+// random sampling (Efraimidis-Spirakis: key u^(1/weight), largest first). The band is
+// contiguous in the ranked slice, so relays outside it keep their places.
+func (m *Manager) shuffleMargin(relays []*RelayInfo, n int, scores map[*RelayInfo]float64) {
+	boundary := scores[relays[n-1]]
+	first, last := n-1, n-1
+	for first > 0 && boundary-scores[relays[first-1]] >= -m.tieMargin {
+		first--
+	}
+	for last < len(relays)-1 && boundary-scores[relays[last+1]] <= m.tieMargin {
+		last++
+	}
+	if first == last {
+		return
+	}
+	band := relays[first : last+1]
+	keys := make(map[*RelayInfo]float64, len(band))
+	for _, relay := range band {
+		weight := math.Max(scores[relay], 1e-6)
+		keys[relay] = math.Pow(rand.Float64(), 1/weight)
+	}
+	sort.SliceStable(band, func(i, j int) bool {
+		return keys[band[i]] > keys[band[j]]
+	})
+}
+
+// tieStatsObject reports the tie-breaking settings
+func (m *Manager) tieStatsObject() *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("order", json.NewJsonValue("score, attempts, url"))
+	obj.Set("margin", json.NewJsonValue(m.tieMargin))
+	return obj
+}
@@ -0,0 +1,147 @@
+// Package netdiag classifies relay connection and publish errors into failure classes
+// (DNS, TCP, TLS, certificate, WebSocket upgrade, HTTP throttling, protocol) and relay rejections
+// (the machine-readable prefix of an OK false reason) for health diagnostics and scoring.
+package netdiag
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Failure classes, from the lowest network layer up to the relay's answer
+const (
+	ClassDNS         = "dns"
+	ClassTCP         = "tcp"
+	ClassTLS         = "tls"
+	ClassCertExpired = "certificate_expired"
+	ClassCertInvalid = "certificate_invalid"
+	ClassWebSocket   = "websocket_upgrade"
+	ClassThrottled   = "throttled" // 429/503 on the upgrade: the relay is up but asks us to slow down
+	ClassTimeout     = "timeout"
+	ClassProtocol    = "protocol"
+
+	// Rejections: the relay answered OK false with one of these prefixes
+	ClassAuthRequired    = "auth_required"    // auth-required:
+	ClassRateLimited     = "rate_limited"     // rate-limited:
+	ClassPaymentRequired = "payment_required" // payment-required:, or restricted: mentioning payment
+	ClassBlocked         = "blocked"          // blocked:, restricted:, mute:
+	ClassInvalid         = "invalid"          // invalid:, pow:
+
+	ClassOther = "other"
+)
+
+// Classes lists all failure classes in display order
+var Classes = []string{
+	ClassDNS, ClassTCP, ClassTLS, ClassCertExpired, ClassCertInvalid,
+	ClassWebSocket, ClassThrottled, ClassTimeout, ClassProtocol,
+	ClassAuthRequired, ClassRateLimited, ClassPaymentRequired, ClassBlocked, ClassInvalid,
+	ClassOther,
+}
+
+// Soft reports whether a failure of class says the relay is up and would take events if we
+// slowed down, rather than that it is unreachable or rejects what we send
+func Soft(class string) bool {
+	return class == ClassThrottled || class == ClassRateLimited
+}
+
+// classifyRejection returns the class of an OK false reason (lowercased, "msg: " stripped), or
+// ClassProtocol when it has no recognized prefix
+func classifyRejection(reason string) string {
+	prefix, _, _ := strings.Cut(reason, ":")
+	switch strings.TrimSpace(prefix) {
+	case "auth-required":
+		return ClassAuthRequired
+	case "rate-limited":
+		return ClassRateLimited
+	case "payment-required":
+		return ClassPaymentRequired
+	case "restricted":
+		if strings.Contains(reason, "pay") {
+			return ClassPaymentRequired
+		}
+		return ClassBlocked
+	case "blocked", "mute":
+		return ClassBlocked
+	case "invalid", "pow":
+		return ClassInvalid
+	}
+	return ClassProtocol
+}
+
+// Classify returns the failure class of err, or "" for a nil error
+func Classify(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var throttled interface{ Throttled() bool }
+	if errors.As(err, &throttled) && throttled.Throttled() {
+		return ClassThrottled
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ClassDNS
+	}
+
+	var certInvalid x509.CertificateInvalidError
+	if errors.As(err, &certInvalid) {
+		if certInvalid.Reason == x509.Expired {
+			return ClassCertExpired
+		}
+		return ClassCertInvalid
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) || errors.As(err, &verifyErr) {
+		return ClassCertInvalid
+	}
+
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) {
+		return ClassTLS
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		if opErr.Timeout() {
+			return ClassTimeout
+		}
+		return ClassTCP
+	}
+
+	msg := strings.ToLower(err.Error())
+	if reason, ok := strings.CutPrefix(msg, "msg:"); ok {
+		return classifyRejection(strings.TrimSpace(reason))
+	}
+	switch {
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "handshake failure"):
+		return ClassTLS
+	case strings.Contains(msg, "but got 429") || strings.Contains(msg, "but got 503"):
+		return ClassThrottled
+	case strings.Contains(msg, "websocket dial") || strings.Contains(msg, "handshake response status"):
+		return ClassWebSocket
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || strings.Contains(msg, "timeout") || strings.Contains(msg, "took too long") {
+		return ClassTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ClassTimeout
+	}
+
+	// The connection worked but broke mid-exchange (closed, bad frames)
+	if strings.Contains(msg, "failed to read") || strings.Contains(msg, "failed to write") {
+		return ClassProtocol
+	}
+
+	return ClassOther
+}
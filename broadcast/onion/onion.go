@@ -0,0 +1,123 @@
+// Package onion reaches Tor hidden services: relay URLs on .onion hosts are dialed through a SOCKS5
+// proxy (typically a local Tor daemon), which also resolves the onion address. Without a proxy
+// such relays cannot be reached at all.
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"golang.org/x/net/proxy"
+)
+
+// IsOnion reports whether a relay URL points at a Tor hidden service
+func IsOnion(relayURL string) bool {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Hostname()), ".onion")
+}
+
+// ParseAddr validates a proxy address: host:port, optionally as socks5:// or socks5h:// URL
+func ParseAddr(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if rest, ok := strings.CutPrefix(raw, "socks5h://"); ok {
+		raw = rest
+	} else if rest, ok := strings.CutPrefix(raw, "socks5://"); ok {
+		raw = rest
+	} else if strings.Contains(raw, "://") {
+		return "", fmt.Errorf("only SOCKS5 proxies are supported, got %q", raw)
+	}
+	raw = strings.TrimSuffix(raw, "/")
+	host, port, err := net.SplitHostPort(raw)
+	if err != nil || host == "" || port == "" {
+		return "", fmt.Errorf("expected host:port, got %q", raw)
+	}
+	return raw, nil
+}
+
+// Proxy dials onion relays through a SOCKS5 proxy
+type Proxy struct {
+	addr   string
+	socks  proxy.ContextDialer
+	client *http.Client
+
+	dials     int64
+	failures  int64
+	totalTime int64 // nanoseconds spent in successful dials
+}
+
+// New returns a Proxy for a SOCKS5 proxy at addr (see ParseAddr). Nothing is dialed until a
+// connection is needed.
+func New(addr string) (*Proxy, error) {
+	addr, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{addr: addr, socks: dialer.(proxy.ContextDialer)}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = p.DialContext
+	p.client = &http.Client{Transport: transport}
+	logging.Info("Onion: Reaching .onion relays through SOCKS5 proxy %s", addr)
+	return p, nil
+}
+
+// DialContext connects to addr through the proxy; host names are resolved by the proxy
+func (p *Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt64(&p.dials, 1)
+	start := time.Now()
+	conn, err := p.socks.DialContext(ctx, network, addr)
+	if err != nil {
+		atomic.AddInt64(&p.failures, 1)
+		logging.DebugMethod("onion", "DialContext", "Dial of %s through %s failed: %v", addr, p.addr, err)
+		return nil, err
+	}
+	atomic.AddInt64(&p.totalTime, int64(time.Since(start)))
+	return conn, nil
+}
+
+// HTTPClient returns a client whose connections go through the proxy, for WebSocket dial options
+func (p *Proxy) HTTPClient() *http.Client {
+	return p.client
+}
+
+// Dial opens a WebSocket connection to an onion relay through the proxy
+func (p *Proxy) Dial(ctx context.Context, relayURL string) (*ws.Conn, error) {
+	conn, _, err := ws.Dial(ctx, relayURL, &ws.DialOptions{HTTPClient: p.client})
+	return conn, err
+}
+
+// GetStatsName returns the name for this stats provider
+func (p *Proxy) GetStatsName() string {
+	return "onion"
+}
+
+// GetStats returns proxy dial counters as a JsonEntity
+func (p *Proxy) GetStats() json.JsonEntity {
+	dials, failures := atomic.LoadInt64(&p.dials), atomic.LoadInt64(&p.failures)
+	avg := int64(0)
+	if ok := dials - failures; ok > 0 {
+		avg = time.Duration(atomic.LoadInt64(&p.totalTime) / ok).Milliseconds()
+	}
+	obj := json.NewJsonObject()
+	obj.Set("proxy", json.NewJsonValue(p.addr))
+	obj.Set("dials", json.NewJsonValue(dials))
+	obj.Set("failures", json.NewJsonValue(failures))
+	obj.Set("avg_dial_ms", json.NewJsonValue(avg))
+	return obj
+}
@@ -0,0 +1,224 @@
+// Package operators groups relays by the entity running them, as announced in their NIP-11
+// document (pubkey, or contact when no pubkey is given). The manager uses it to cap how many of
+// the top-N relays one operator may hold, so a single operator cannot silently drop most of an
+// event's fan-out.
+package operators
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+const (
+	// fetchTimeout bounds one NIP-11 request
+	fetchTimeout = 10 * time.Second
+	// retryAfterFailure is how soon a relay whose document could not be fetched is asked again
+	retryAfterFailure = time.Hour
+)
+
+// Config controls the operator directory
+type Config struct {
+	Refresh time.Duration // how long a fetched document is trusted (default 24h)
+	Workers int           // concurrent NIP-11 fetches (default 4)
+}
+
+type record struct {
+	operator  string // "" = unknown or not announced
+	fetchedAt time.Time
+	failed    bool
+}
+
+// Directory maps relay URLs to operator identities, fetching NIP-11 documents in the background
+type Directory struct {
+	cfg   Config
+	queue chan string
+
+	mu      sync.RWMutex
+	records map[string]*record
+	pending map[string]bool
+
+	fetched     int64
+	fetchFailed int64
+	dropped     int64 // fetches not queued because the queue was full
+}
+
+// New returns a Directory and starts its fetchers
+func New(cfg Config) *Directory {
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = 24 * time.Hour
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	logging.DebugMethod("operators", "New", "Initializing operator directory: refresh=%v, workers=%d", cfg.Refresh, cfg.Workers)
+
+	d := &Directory{
+		cfg:     cfg,
+		queue:   make(chan string, 1000),
+		records: make(map[string]*record),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// Operator returns the operator of url, or "" while it is unknown; a missing or stale entry
+// queues a fetch. Never blocks on the network.
+func (d *Directory) Operator(url string) string {
+	d.mu.RLock()
+	rec := d.records[url]
+	stale := rec == nil || time.Since(rec.fetchedAt) > d.refreshFor(rec)
+	queued := d.pending[url]
+	d.mu.RUnlock()
+
+	if stale && !queued {
+		d.mu.Lock()
+		if !d.pending[url] {
+			select {
+			case d.queue <- url:
+				d.pending[url] = true
+			default:
+				atomic.AddInt64(&d.dropped, 1)
+			}
+		}
+		d.mu.Unlock()
+	}
+	if rec == nil {
+		return ""
+	}
+	return rec.operator
+}
+
+func (d *Directory) refreshFor(rec *record) time.Duration {
+	if rec != nil && rec.failed {
+		return retryAfterFailure
+	}
+	return d.cfg.Refresh
+}
+
+func (d *Directory) worker() {
+	for url := range d.queue {
+		d.fetch(url)
+	}
+}
+
+// fetch reads url's NIP-11 document and stores its operator
+func (d *Directory) fetch(url string) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	rec := &record{fetchedAt: time.Now()}
+	info, err := nip11.Fetch(ctx, url)
+	if err != nil {
+		atomic.AddInt64(&d.fetchFailed, 1)
+		rec.failed = true
+		logging.DebugMethod("operators", "fetch", "NIP-11 of %s unavailable: %v", url, err)
+	} else {
+		atomic.AddInt64(&d.fetched, 1)
+		rec.operator = Identity(info.PubKey, info.Contact)
+	}
+
+	d.mu.Lock()
+	previous := d.records[url]
+	// Keep a known operator through a failed refresh
+	if rec.failed && previous != nil {
+		rec.operator = previous.operator
+	}
+	d.records[url] = rec
+	delete(d.pending, url)
+	d.mu.Unlock()
+
+	if rec.operator != "" && (previous == nil || previous.operator != rec.operator) {
+		logging.DebugMethod("operators", "fetch", "%s is operated by %s", url, rec.operator)
+	}
+}
+
+// Identity normalizes a NIP-11 pubkey/contact pair into an operator identity: the pubkey if
+// present, otherwise the contact (lowercased, without a mailto: scheme); "" if neither is set
+func Identity(pubkey, contact string) string {
+	if pubkey = strings.ToLower(strings.TrimSpace(pubkey)); pubkey != "" {
+		return "pubkey:" + pubkey
+	}
+	contact = strings.ToLower(strings.TrimSpace(contact))
+	contact = strings.TrimPrefix(contact, "mailto:")
+	if contact == "" {
+		return ""
+	}
+	return "contact:" + contact
+}
+
+// Clusters returns the relays of every operator running more than one known relay
+func (d *Directory) Clusters() map[string][]string {
+	d.mu.RLock()
+	byOperator := make(map[string][]string)
+	for url, rec := range d.records {
+		if rec.operator != "" {
+			byOperator[rec.operator] = append(byOperator[rec.operator], url)
+		}
+	}
+	d.mu.RUnlock()
+
+	for operator, urls := range byOperator {
+		if len(urls) < 2 {
+			delete(byOperator, operator)
+			continue
+		}
+		sort.Strings(urls)
+	}
+	return byOperator
+}
+
+// GetStatsName returns the name for this stats provider
+func (d *Directory) GetStatsName() string {
+	return "operators"
+}
+
+// GetStats returns fetch counters and multi-relay operators as a JsonEntity
+func (d *Directory) GetStats() json.JsonEntity {
+	d.mu.RLock()
+	known := 0
+	identified := 0
+	for _, rec := range d.records {
+		known++
+		if rec.operator != "" {
+			identified++
+		}
+	}
+	pending := len(d.pending)
+	d.mu.RUnlock()
+
+	clusters := d.Clusters()
+	operators := make([]string, 0, len(clusters))
+	for operator := range clusters {
+		operators = append(operators, operator)
+	}
+	sort.Strings(operators)
+	clustersObj := json.NewJsonObject()
+	for _, operator := range operators {
+		list := json.NewJsonList()
+		for _, url := range clusters[operator] {
+			list.Append(json.NewJsonValue(url))
+		}
+		clustersObj.Set(operator, list)
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("known", json.NewJsonValue(known))
+	obj.Set("identified", json.NewJsonValue(identified))
+	obj.Set("pending", json.NewJsonValue(pending))
+	obj.Set("fetched", json.NewJsonValue(atomic.LoadInt64(&d.fetched)))
+	obj.Set("fetch_failed", json.NewJsonValue(atomic.LoadInt64(&d.fetchFailed)))
+	obj.Set("fetch_dropped", json.NewJsonValue(atomic.LoadInt64(&d.dropped)))
+	obj.Set("clusters", clustersObj)
+	return obj
+}
@@ -0,0 +1,285 @@
+// Package outbox implements NIP-65 outbox routing: besides the top N, every event goes to the
+// write relays its author lists in a kind 10002 event, which is where that author's followers
+// look for it. Lists are looked up on the relays of the discovered pool (the current top set
+// plus the configured lookup relays) and cached; kind 10002 events passing through the
+// broadcaster refresh the cache for free.
+package outbox
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-65 relay list kind and lookup fan-out
+const (
+	KindRelayList   = 10002
+	maxLookupRelays = 10 // a list is asked for on at most this many relays
+)
+
+// Config controls the routing
+type Config struct {
+	Lookup    func() []string // relays kind 10002 lists are fetched from (nil = learned from passing events only)
+	MaxRelays int             // write relays of one author added to an event (default 5)
+	CacheTTL  time.Duration   // how long a found list is trusted (default 6h)
+	MissTTL   time.Duration   // how soon an author without a list is looked up again (default 15m)
+	Timeout   time.Duration   // one lookup (default 3s); the event's broadcast waits for it
+}
+
+// entry is the cached write relay list of one pubkey
+type entry struct {
+	relays    []string // nil = no list found
+	createdAt nostr.Timestamp
+	fetchedAt time.Time
+	ready     chan struct{} // closed once the lookup finished
+}
+
+// Router implements broadcaster.RelayFilter and broadcaster.BroadcastReporter
+type Router struct {
+	cfg Config
+
+	mu      sync.Mutex
+	entries map[string]*entry
+
+	routed     int64 // events that got their author's write relays
+	added      int64 // write relays added that were not in the planned set
+	noList     int64 // events whose author has no list
+	lookups    int64
+	lookupMiss int64
+	learned    int64 // lists taken from passing kind 10002 events
+}
+
+// New returns a Router for cfg
+func New(cfg Config) *Router {
+	if cfg.MaxRelays <= 0 {
+		cfg.MaxRelays = 5
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 6 * time.Hour
+	}
+	if cfg.MissTTL <= 0 {
+		cfg.MissTTL = 15 * time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 3 * time.Second
+	}
+	logging.DebugMethod("outbox", "New", "Adding up to %d write relays of each author (cache %v)", cfg.MaxRelays, cfg.CacheTTL)
+	return &Router{cfg: cfg, entries: make(map[string]*entry)}
+}
+
+// FilterRelays adds the author's write relays to the planned set
+func (r *Router) FilterRelays(event *nostr.Event, relays []string) []string {
+	write := r.lookup(event.PubKey)
+	if len(write) == 0 {
+		atomic.AddInt64(&r.noList, 1)
+		return relays
+	}
+	result, added := addRelays(relays, write)
+	atomic.AddInt64(&r.routed, 1)
+	atomic.AddInt64(&r.added, int64(added))
+	if added > 0 {
+		logging.DebugMethod("outbox", "FilterRelays", "Adding %d write relays of %s for event %s", added, event.PubKey, event.ID)
+	}
+	return result
+}
+
+// PlanRelays is FilterRelays for a dry run: routed events and added relays are not counted (a
+// lookup still fills the cache)
+func (r *Router) PlanRelays(event *nostr.Event, relays []string) []string {
+	result, _ := addRelays(relays, r.lookup(event.PubKey))
+	return result
+}
+
+// addRelays appends the write relays missing from relays, returning how many it added
+func addRelays(relays, write []string) ([]string, int) {
+	planned := make(map[string]bool, len(relays))
+	for _, url := range relays {
+		planned[url] = true
+	}
+	result := relays
+	added := 0
+	for _, url := range write {
+		if !planned[url] {
+			planned[url] = true
+			result = append(result, url)
+			added++
+		}
+	}
+	return result, added
+}
+
+// lookup returns pubkey's write relays, fetching them if the cache has nothing fresh. Concurrent
+// lookups of one pubkey share a fetch.
+func (r *Router) lookup(pubkey string) []string {
+	r.mu.Lock()
+	e, ok := r.entries[pubkey]
+	if ok {
+		select {
+		case <-e.ready:
+			if time.Since(e.fetchedAt) < r.ttl(e) {
+				r.mu.Unlock()
+				return e.relays
+			}
+		default:
+			// Someone else is fetching it
+			r.mu.Unlock()
+			<-e.ready
+			return e.relays
+		}
+	}
+	next := &entry{ready: make(chan struct{})}
+	if ok {
+		// Keep serving the stale list if the refresh finds nothing newer
+		next.relays, next.createdAt = e.relays, e.createdAt
+	}
+	r.entries[pubkey] = next
+	r.mu.Unlock()
+
+	relays, createdAt := r.fetch(pubkey)
+	r.mu.Lock()
+	if relays != nil && createdAt >= next.createdAt {
+		next.relays, next.createdAt = relays, createdAt
+	}
+	next.fetchedAt = time.Now()
+	close(next.ready)
+	r.mu.Unlock()
+	return next.relays
+}
+
+func (r *Router) ttl(e *entry) time.Duration {
+	if e.relays == nil {
+		return r.cfg.MissTTL
+	}
+	return r.cfg.CacheTTL
+}
+
+// fetch queries the lookup relays for pubkey's latest kind 10002 list
+func (r *Router) fetch(pubkey string) ([]string, nostr.Timestamp) {
+	if r.cfg.Lookup == nil {
+		return nil, 0
+	}
+	lookupRelays := r.cfg.Lookup()
+	if len(lookupRelays) == 0 {
+		return nil, 0
+	}
+	if len(lookupRelays) > maxLookupRelays {
+		lookupRelays = lookupRelays[:maxLookupRelays]
+	}
+	atomic.AddInt64(&r.lookups, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+	pool := nostr.NewSimplePool(ctx)
+	defer pool.Close("outbox lookup done")
+
+	var latest *nostr.Event
+	filter := nostr.Filter{Kinds: []int{KindRelayList}, Authors: []string{pubkey}, Limit: 1}
+	for ie := range pool.FetchMany(ctx, lookupRelays, filter) {
+		if latest == nil || ie.CreatedAt > latest.CreatedAt {
+			latest = ie.Event
+		}
+	}
+	if latest == nil {
+		atomic.AddInt64(&r.lookupMiss, 1)
+		logging.DebugMethod("outbox", "fetch", "No relay list found for %s", pubkey)
+		return nil, 0
+	}
+	relays := r.writeRelays(latest)
+	logging.DebugMethod("outbox", "fetch", "Write relays of %s: %v", pubkey, relays)
+	return relays, latest.CreatedAt
+}
+
+// writeRelays returns the write relays of a kind 10002 event: r tags without a marker or marked
+// "write" (nil if there are none)
+func (r *Router) writeRelays(event *nostr.Event) []string {
+	var relays []string
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "r" || len(tag) >= 3 && tag[2] != "" && tag[2] != "write" {
+			continue
+		}
+		url := strings.TrimSuffix(strings.TrimSpace(tag[1]), "/")
+		if !strings.HasPrefix(url, "wss://") && !strings.HasPrefix(url, "ws://") || seen[url] {
+			continue
+		}
+		seen[url] = true
+		relays = append(relays, url)
+		if len(relays) == r.cfg.MaxRelays {
+			break
+		}
+	}
+	return relays
+}
+
+// BroadcastPlanned learns relay lists from kind 10002 events being broadcast
+func (r *Router) BroadcastPlanned(event *nostr.Event, relays []string) {
+	if event.Kind != KindRelayList {
+		return
+	}
+	list := r.writeRelays(event)
+	if list == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[event.PubKey]; ok {
+		select {
+		case <-e.ready:
+			if e.relays != nil && e.createdAt > event.CreatedAt {
+				return // we already know a newer list
+			}
+		default:
+			return // a lookup is in flight and will fill the entry
+		}
+	}
+	ready := make(chan struct{})
+	close(ready)
+	r.entries[event.PubKey] = &entry{relays: list, createdAt: event.CreatedAt, fetchedAt: time.Now(), ready: ready}
+	atomic.AddInt64(&r.learned, 1)
+}
+
+// BroadcastCompleted does nothing: lists are learned when planned
+func (r *Router) BroadcastCompleted(report broadcaster.BroadcastReport) {}
+
+// GetStatsName returns the name for this stats provider
+func (r *Router) GetStatsName() string {
+	return "outbox_routing"
+}
+
+// GetStats returns routing and cache counters as a JsonEntity
+func (r *Router) GetStats() json.JsonEntity {
+	r.mu.Lock()
+	known, missing := 0, 0
+	for _, e := range r.entries {
+		select {
+		case <-e.ready:
+			if e.relays != nil {
+				known++
+			} else {
+				missing++
+			}
+		default:
+		}
+	}
+	r.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("max_relays_per_author", json.NewJsonValue(r.cfg.MaxRelays))
+	obj.Set("routed", json.NewJsonValue(atomic.LoadInt64(&r.routed)))
+	obj.Set("relays_added", json.NewJsonValue(atomic.LoadInt64(&r.added)))
+	obj.Set("without_list", json.NewJsonValue(atomic.LoadInt64(&r.noList)))
+	obj.Set("lookups", json.NewJsonValue(atomic.LoadInt64(&r.lookups)))
+	obj.Set("lookup_misses", json.NewJsonValue(atomic.LoadInt64(&r.lookupMiss)))
+	obj.Set("learned", json.NewJsonValue(atomic.LoadInt64(&r.learned)))
+	obj.Set("cached_lists", json.NewJsonValue(known))
+	obj.Set("cached_misses", json.NewJsonValue(missing))
+	return obj
+}
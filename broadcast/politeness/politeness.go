@@ -0,0 +1,227 @@
+// Package politeness keeps the broadcaster under each destination relay's published rate
+// limits. Publishes over a relay's events-per-minute ceiling are queued for that relay and
+// released evenly over time instead of being sent in a burst the relay would reject. A relay
+// that answers "rate-limited:" anyway is paused for a while, its publishes queued meanwhile.
+package politeness
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// ErrQueueFull is returned when a relay already has the maximum number of publishes waiting
+var ErrQueueFull = errors.New("throttled: politeness queue full")
+
+// Config sets the per-relay ceilings
+type Config struct {
+	DefaultPerMinute int            // 0 = no limit unless overridden
+	Overrides        map[string]int // relay URL -> events per minute (0 = unlimited for that relay)
+	MaxQueued        int            // publishes waiting per relay before new ones are dropped
+	RateLimitedPause time.Duration  // publishes to a relay wait this long after it answered "rate-limited:" (0 = off)
+}
+
+type relayState struct {
+	perMinute int
+	interval  time.Duration
+	tolerance time.Duration // burst allowance
+	tat       time.Time     // theoretical arrival time of the next publish (GCRA)
+	paused    time.Time     // no publishes before this, after a "rate-limited:" answer
+
+	queued    int
+	throttled int64 // publishes that had to wait
+	dropped   int64 // publishes dropped because the queue was full
+	limited   int64 // "rate-limited:" answers
+	maxWait   time.Duration
+}
+
+// Throttle schedules publishes per relay. A nil *Throttle never waits.
+type Throttle struct {
+	cfg Config
+
+	mu     sync.Mutex
+	relays map[string]*relayState
+}
+
+// New returns a Throttle for cfg, or nil if no relay has a ceiling and rate-limited answers are ignored
+func New(cfg Config) *Throttle {
+	if cfg.DefaultPerMinute <= 0 && len(cfg.Overrides) == 0 && cfg.RateLimitedPause <= 0 {
+		return nil
+	}
+	if cfg.MaxQueued <= 0 {
+		cfg.MaxQueued = 1000
+	}
+	logging.Info("Politeness: default %d events/min per relay, %d overrides, max %d queued per relay, %v pause after rate-limited",
+		cfg.DefaultPerMinute, len(cfg.Overrides), cfg.MaxQueued, cfg.RateLimitedPause)
+	return &Throttle{
+		cfg:    cfg,
+		relays: make(map[string]*relayState),
+	}
+}
+
+// limitFor returns the events-per-minute ceiling of url (0 = unlimited)
+func (t *Throttle) limitFor(url string) int {
+	if limit, ok := t.cfg.Overrides[url]; ok {
+		return limit
+	}
+	return t.cfg.DefaultPerMinute
+}
+
+func (t *Throttle) stateLocked(url string) *relayState {
+	st, ok := t.relays[url]
+	if !ok {
+		perMinute := t.limitFor(url)
+		st = &relayState{perMinute: perMinute}
+		if perMinute > 0 {
+			st.interval = time.Minute / time.Duration(perMinute)
+			burst := perMinute / 6 // up to 10 seconds' worth at once
+			if burst < 1 {
+				burst = 1
+			}
+			st.tolerance = time.Duration(burst-1) * st.interval
+		}
+		t.relays[url] = st
+	}
+	return st
+}
+
+// Wait blocks until a publish to url fits its ceiling and the relay is not paused. Waiting
+// publishes are released in order.
+func (t *Throttle) Wait(ctx context.Context, url string) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	st := t.stateLocked(url)
+	now := time.Now()
+	if st.perMinute <= 0 && !now.Before(st.paused) {
+		t.mu.Unlock()
+		return nil
+	}
+
+	var wait time.Duration
+	if st.perMinute > 0 {
+		if st.tat.Before(now) {
+			st.tat = now
+		}
+		wait = st.tat.Add(-st.tolerance).Sub(now)
+	}
+	if pause := st.paused.Sub(now); pause > wait {
+		wait = pause
+	}
+	if wait <= 0 {
+		st.tat = st.tat.Add(st.interval)
+		t.mu.Unlock()
+		return nil
+	}
+	if st.queued >= t.cfg.MaxQueued {
+		st.dropped++
+		t.mu.Unlock()
+		return ErrQueueFull
+	}
+	st.tat = st.tat.Add(st.interval)
+	st.queued++
+	st.throttled++
+	if wait > st.maxWait {
+		st.maxWait = wait
+	}
+	t.mu.Unlock()
+
+	logging.DebugMethod("politeness", "Wait", "Delaying publish to %s by %v", url, wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	t.mu.Lock()
+	st.queued--
+	t.mu.Unlock()
+	return err
+}
+
+// RateLimited pauses publishes to url for the configured window after the relay answered
+// "rate-limited:"; publishes meanwhile queue up (up to MaxQueued) instead of failing the same way
+func (t *Throttle) RateLimited(url string) {
+	if t == nil || t.cfg.RateLimitedPause <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.stateLocked(url)
+	st.limited++
+	if until := time.Now().Add(t.cfg.RateLimitedPause); until.After(st.paused) {
+		st.paused = until
+		logging.DebugMethod("politeness", "RateLimited", "%s answered rate-limited, pausing publishes until %s",
+			url, until.Format(time.RFC3339))
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (t *Throttle) GetStatsName() string {
+	return "politeness"
+}
+
+// GetStats returns per-relay throttle statistics for relays that have a ceiling, as a JsonEntity
+func (t *Throttle) GetStats() json.JsonEntity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Only relays with an override or that actually had to be throttled, to keep /stats short
+	now := time.Now()
+	urls := make([]string, 0, len(t.relays))
+	for url, st := range t.relays {
+		_, overridden := t.cfg.Overrides[url]
+		if (st.perMinute > 0 && overridden) || st.throttled > 0 || st.dropped > 0 || st.limited > 0 {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+
+	var totalQueued int
+	var totalThrottled, totalDropped, totalLimited int64
+	paused := 0
+	relaysObj := json.NewJsonObject()
+	for _, url := range urls {
+		st := t.relays[url]
+		totalQueued += st.queued
+		totalThrottled += st.throttled
+		totalDropped += st.dropped
+		totalLimited += st.limited
+
+		relayObj := json.NewJsonObject()
+		relayObj.Set("events_per_minute", json.NewJsonValue(st.perMinute))
+		relayObj.Set("queued", json.NewJsonValue(st.queued))
+		relayObj.Set("throttled", json.NewJsonValue(st.throttled))
+		relayObj.Set("dropped", json.NewJsonValue(st.dropped))
+		relayObj.Set("max_wait_ms", json.NewJsonValue(st.maxWait.Milliseconds()))
+		relayObj.Set("rate_limited", json.NewJsonValue(st.limited))
+		if now.Before(st.paused) {
+			paused++
+			relayObj.Set("paused_until", json.NewJsonValue(st.paused.Format(time.RFC3339)))
+		}
+		relaysObj.Set(url, relayObj)
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("default_events_per_minute", json.NewJsonValue(t.cfg.DefaultPerMinute))
+	obj.Set("overrides", json.NewJsonValue(len(t.cfg.Overrides)))
+	obj.Set("queued", json.NewJsonValue(totalQueued))
+	obj.Set("throttled", json.NewJsonValue(totalThrottled))
+	obj.Set("dropped", json.NewJsonValue(totalDropped))
+	obj.Set("rate_limited_pause_seconds", json.NewJsonValue(int64(t.cfg.RateLimitedPause.Seconds())))
+	obj.Set("rate_limited", json.NewJsonValue(totalLimited))
+	obj.Set("paused_relays", json.NewJsonValue(paused))
+	obj.Set("relays", relaysObj)
+	return obj
+}
@@ -0,0 +1,117 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// challengeWait is how long an authentication waits for a challenge the relay has not sent yet;
+// some relays only send it along with the auth-required rejection
+const challengeWait = 2 * time.Second
+
+// errNoChallenge is returned when a relay asks for authentication without sending a challenge
+var errNoChallenge = errors.New("no AUTH challenge received")
+
+// authState answers the NIP-42 challenges of relays that only accept events from authenticated
+// clients
+type authState struct {
+	secretKey string // hex; "" = never authenticate
+
+	attempts  int64
+	succeeded int64
+	failed    int64
+}
+
+// SetAuthKey makes publishes rejected with "auth-required:" authenticate with secretKey (hex)
+// and try once more. Must be called before the first Publish.
+func (p *Pool) SetAuthKey(secretKey string) {
+	p.auth.secretKey = secretKey
+}
+
+// wants reports whether res is a rejection authentication can fix
+func (a *authState) wants(res okResult) bool {
+	return a.secretKey != "" && !res.ok && !res.lost && strings.HasPrefix(res.reason, "auth-required:")
+}
+
+// setChallenge records a challenge from the relay
+func (c *Conn) setChallenge(challenge string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.challenge == "" {
+		close(c.challenged)
+	}
+	c.challenge = challenge
+	logging.DebugMethod("pool", "setChallenge", "AUTH challenge from %s", c.url)
+}
+
+// authenticate signs the connection's challenge and waits for the relay to accept it. Concurrent
+// publishers rejected on the same connection share one authentication.
+func (c *Conn) authenticate(ctx context.Context, auth *authState) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	select {
+	case <-c.challenged:
+	case <-time.After(challengeWait):
+		return errNoChallenge
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	challenge, authedFor := c.challenge, c.authedFor
+	c.mu.Unlock()
+	if challenge == authedFor {
+		return nil // another publisher authenticated while we waited
+	}
+
+	atomic.AddInt64(&auth.attempts, 1)
+	event := nostr.Event{
+		Kind:      nostr.KindClientAuthentication,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"relay", c.url}, {"challenge", challenge}},
+	}
+	if err := event.Sign(auth.secretKey); err != nil {
+		atomic.AddInt64(&auth.failed, 1)
+		return fmt.Errorf("sign AUTH event: %w", err)
+	}
+	frame, err := nostr.AuthEnvelope{Event: event}.MarshalJSON()
+	if err != nil {
+		atomic.AddInt64(&auth.failed, 1)
+		return fmt.Errorf("serialize AUTH event: %w", err)
+	}
+
+	res, _, err := c.send(ctx, event.ID, frame)
+	if err == nil && !res.ok {
+		err = fmt.Errorf("AUTH rejected: %s", res.reason)
+		if res.lost {
+			err = ErrConnectionClosed
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&auth.failed, 1)
+		return err
+	}
+	atomic.AddInt64(&auth.succeeded, 1)
+	c.mu.Lock()
+	c.authedFor = challenge
+	c.mu.Unlock()
+	logging.DebugMethod("pool", "authenticate", "Authenticated to %s", c.url)
+	return nil
+}
+
+// stats returns the authentication counters
+func (a *authState) stats() *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("attempts", json.NewJsonValue(atomic.LoadInt64(&a.attempts)))
+	obj.Set("succeeded", json.NewJsonValue(atomic.LoadInt64(&a.succeeded)))
+	obj.Set("failed", json.NewJsonValue(atomic.LoadInt64(&a.failed)))
+	return obj
+}
@@ -0,0 +1,322 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Address family policies for dialing destination relays
+const (
+	DialAuto          = "auto"           // Go's default: resolver order, the other family after 300ms
+	DialPreferIPv6    = "prefer-ipv6"    // IPv6 first, IPv4 only if IPv6 fails
+	DialPreferIPv4    = "prefer-ipv4"    // IPv4 first, IPv6 only if IPv4 fails
+	DialHappyEyeballs = "happy-eyeballs" // race both, IPv6 with a FallbackDelay head start
+)
+
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+
+	addrsPerFamily  = 2               // addresses of one family tried per dial
+	brokenFamilyTTL = time.Hour       // how long a host's failing family is tried last
+	firstFamilyMax  = 5 * time.Second // share of a sequential dial the first family may use without a deadline
+	maxLearnedHosts = 10000           // bound on the per-host memory
+	defaultFallback = 250 * time.Millisecond
+)
+
+// DialConfig chooses the address family of destination relay connections
+type DialConfig struct {
+	Mode          string        // DialAuto, DialPreferIPv6, DialPreferIPv4 or DialHappyEyeballs
+	FallbackDelay time.Duration // happy eyeballs: head start of the first family (default 250ms)
+}
+
+// familyStats counts the connection attempts of one address family
+type familyStats struct {
+	attempts  int64
+	successes int64
+	failures  int64
+}
+
+// familyAddrs are the resolved addresses of one family
+type familyAddrs struct {
+	name  string
+	ips   []net.IP
+	stats *familyStats
+}
+
+// dialer dials TCP for the WebSocket handshakes with the configured family policy, learning
+// hosts whose preferred family is broken (typically an AAAA record nobody answers on)
+type dialer struct {
+	mode  string
+	delay time.Duration
+	net   net.Dialer
+
+	mu     sync.Mutex
+	broken map[string]time.Time // host -> when its preferred family last failed or lost to the other
+
+	ipv4, ipv6 familyStats
+	fallbacks  int64 // dials that only succeeded on the second family
+}
+
+// SetDialConfig makes new connections pick their address family by cfg (DialAuto restores the
+// default dialer). Must be called before the first Publish.
+func (p *Pool) SetDialConfig(cfg DialConfig) {
+	switch cfg.Mode {
+	case DialPreferIPv6, DialPreferIPv4, DialHappyEyeballs:
+	default:
+		if cfg.Mode != DialAuto && cfg.Mode != "" {
+			logging.Warn("Pool: Unknown dial mode %q, using %s", cfg.Mode, DialAuto)
+		}
+		p.dialer = nil
+		p.dialOptions = defaultDialOptions
+		return
+	}
+	if cfg.FallbackDelay <= 0 {
+		cfg.FallbackDelay = defaultFallback
+	}
+	d := &dialer{
+		mode:   cfg.Mode,
+		delay:  cfg.FallbackDelay,
+		net:    net.Dialer{KeepAlive: 30 * time.Second},
+		broken: make(map[string]time.Time),
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = d.DialContext
+	p.dialer = d
+	p.dialOptions = &ws.DialOptions{
+		CompressionMode: defaultDialOptions.CompressionMode,
+		HTTPHeader:      defaultDialOptions.HTTPHeader,
+		HTTPClient:      &http.Client{Transport: transport},
+	}
+	logging.Info("Pool: Dialing destination relays with %s (fallback delay %v)", cfg.Mode, cfg.FallbackDelay)
+}
+
+// DialContext resolves addr and connects to it with the family policy
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.net.DialContext(ctx, network, addr)
+	}
+	resolved, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	v4 := familyAddrs{name: familyIPv4, stats: &d.ipv4}
+	v6 := familyAddrs{name: familyIPv6, stats: &d.ipv6}
+	for _, ip := range resolved {
+		if ip.IP.To4() != nil {
+			v4.ips = append(v4.ips, ip.IP)
+		} else {
+			v6.ips = append(v6.ips, ip.IP)
+		}
+	}
+
+	first, second := v6, v4
+	if d.mode == DialPreferIPv4 {
+		first, second = v4, v6
+	}
+	if d.isBroken(host) {
+		first, second = second, first
+	}
+	if len(first.ips) == 0 {
+		first, second = second, first
+	}
+	if len(second.ips) == 0 {
+		return d.dialFamily(ctx, port, first)
+	}
+	if d.mode == DialHappyEyeballs {
+		return d.race(ctx, host, port, first, second)
+	}
+	return d.sequential(ctx, host, port, first, second)
+}
+
+// sequential tries the second family only once the first failed; the first gets half of the
+// time left (or firstFamilyMax) so that a black-holed family cannot use up the whole dial
+func (d *dialer) sequential(ctx context.Context, host, port string, first, second familyAddrs) (net.Conn, error) {
+	budget := firstFamilyMax
+	if deadline, ok := ctx.Deadline(); ok {
+		budget = time.Until(deadline) / 2
+	}
+	firstCtx, cancel := context.WithTimeout(ctx, budget)
+	conn, firstErr := d.dialFamily(firstCtx, port, first)
+	cancel()
+	if firstErr == nil {
+		d.forget(host)
+		return conn, nil
+	}
+	conn, err := d.dialFamily(ctx, port, second)
+	if err != nil {
+		return nil, errors.Join(firstErr, err)
+	}
+	d.learn(host, first.name, firstErr)
+	return conn, nil
+}
+
+// race starts the first family, then the second after the fallback delay or as soon as the
+// first failed; the first connection wins and the other attempt is abandoned
+func (d *dialer) race(ctx context.Context, host, port string, first, second familyAddrs) (net.Conn, error) {
+	type result struct {
+		conn   net.Conn
+		err    error
+		family string
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	start := func(family familyAddrs) {
+		go func() {
+			conn, err := d.dialFamily(ctx, port, family)
+			results <- result{conn, err, family.name}
+		}()
+	}
+
+	start(first)
+	started, received := 1, 0
+	timer := time.NewTimer(d.delay)
+	defer timer.Stop()
+	var firstErr error
+	for received < started {
+		select {
+		case <-timer.C:
+			if started == 1 {
+				start(second)
+				started++
+			}
+		case res := <-results:
+			received++
+			if res.err == nil {
+				if pending := started - received; pending > 0 {
+					// Close the loser if it connects before noticing the cancellation
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				if res.family != first.name {
+					d.learn(host, first.name, firstErr)
+				} else {
+					d.forget(host)
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			} else {
+				firstErr = errors.Join(firstErr, res.err)
+			}
+			if started == 1 {
+				start(second)
+				started++
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// dialFamily tries the first addresses of one family in turn
+func (d *dialer) dialFamily(ctx context.Context, port string, family familyAddrs) (net.Conn, error) {
+	var lastErr error
+	for i, ip := range family.ips {
+		if i == addrsPerFamily {
+			break
+		}
+		atomic.AddInt64(&family.stats.attempts, 1)
+		conn, err := d.net.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			atomic.AddInt64(&family.stats.successes, 1)
+			return conn, nil
+		}
+		if ctx.Err() == nil || !errors.Is(ctx.Err(), context.Canceled) {
+			// A race the other family won is not this family's failure
+			atomic.AddInt64(&family.stats.failures, 1)
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// learn remembers that host's preferred family failed or lost the race to the other one, so the
+// next dials start with the family that worked
+func (d *dialer) learn(host, family string, err error) {
+	atomic.AddInt64(&d.fallbacks, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, known := d.broken[host]; !known && len(d.broken) >= maxLearnedHosts {
+		d.pruneLocked()
+	}
+	d.broken[host] = time.Now()
+	if err == nil {
+		err = errors.New("slower than the other family")
+	}
+	logging.DebugMethod("pool", "learn", "%s failed over %s, trying the other family first for %v: %v", host, family, brokenFamilyTTL, err)
+}
+
+func (d *dialer) forget(host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.broken, host)
+}
+
+func (d *dialer) isBroken(host string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	at, ok := d.broken[host]
+	if ok && time.Since(at) >= brokenFamilyTTL {
+		delete(d.broken, host)
+		return false
+	}
+	return ok
+}
+
+// pruneLocked drops expired entries, or everything if none expired
+func (d *dialer) pruneLocked() {
+	for host, at := range d.broken {
+		if time.Since(at) >= brokenFamilyTTL {
+			delete(d.broken, host)
+		}
+	}
+	if len(d.broken) >= maxLearnedHosts {
+		d.broken = make(map[string]time.Time)
+	}
+}
+
+// stats returns the per-family counters
+func (d *dialer) stats() json.JsonEntity {
+	d.mu.Lock()
+	broken := 0
+	for _, at := range d.broken {
+		if time.Since(at) < brokenFamilyTTL {
+			broken++
+		}
+	}
+	d.mu.Unlock()
+
+	family := func(s *familyStats) json.JsonEntity {
+		obj := json.NewJsonObject()
+		obj.Set("attempts", json.NewJsonValue(atomic.LoadInt64(&s.attempts)))
+		obj.Set("successes", json.NewJsonValue(atomic.LoadInt64(&s.successes)))
+		obj.Set("failures", json.NewJsonValue(atomic.LoadInt64(&s.failures)))
+		return obj
+	}
+	obj := json.NewJsonObject()
+	obj.Set("mode", json.NewJsonValue(d.mode))
+	obj.Set("fallback_delay_ms", json.NewJsonValue(d.delay.Milliseconds()))
+	obj.Set("ipv4", family(&d.ipv4))
+	obj.Set("ipv6", family(&d.ipv6))
+	obj.Set("family_fallbacks", json.NewJsonValue(atomic.LoadInt64(&d.fallbacks)))
+	obj.Set("hosts_preferring_other_family", json.NewJsonValue(broken))
+	return obj
+}
@@ -0,0 +1,562 @@
+// Package pool keeps reusable WebSocket connections to destination relays and publishes
+// pre-serialized EVENT frames over them, matching OK responses back to the waiting publisher.
+// An event is serialized once and the same frame is written to every relay.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/girino/nostr-brodcast-relay/broadcast/backoff"
+	"github.com/girino/nostr-brodcast-relay/broadcast/onion"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultDialOptions is how connections are opened unless SetDialConfig picked a family policy
+var defaultDialOptions = &ws.DialOptions{
+	CompressionMode: ws.CompressionContextTakeover,
+	HTTPHeader: http.Header{
+		textproto.CanonicalMIMEHeaderKey("User-Agent"): {"github.com/girino/nostr-brodcast-relay"},
+	},
+}
+
+// ErrConnectionClosed is returned to publishers waiting on a connection that went away
+var ErrConnectionClosed = errors.New("connection closed before OK")
+
+// ErrDuplicate is returned when the relay answered that it already has the event, whether the
+// OK was true or false: the event reached it through another path
+var ErrDuplicate = errors.New("duplicate")
+
+// maxNotices is how many recent NOTICE frames each connection keeps for failure reports
+const maxNotices = 5
+
+// writeTimeout bounds writing one frame. Writes are bounded by the connection, not by the
+// publisher: a canceled write closes the socket, and with it every other publish waiting on it.
+const writeTimeout = 10 * time.Second
+
+// Notice is a NOTICE frame received from a relay
+type Notice struct {
+	At      time.Time
+	Message string
+}
+
+// PublishError is a failed publish together with the NOTICEs the relay sent recently on that
+// connection, which often explain a rejection (policy, rate limits) better than the OK reason
+type PublishError struct {
+	Err     error
+	Notices []Notice
+}
+
+func (e *PublishError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// RecentNotices returns the NOTICE texts attached to the failure
+func (e *PublishError) RecentNotices() []string {
+	result := make([]string, len(e.Notices))
+	for i, n := range e.Notices {
+		result[i] = n.At.Format(time.RFC3339) + " " + n.Message
+	}
+	return result
+}
+
+// EventFrame serializes event once as an ["EVENT", ...] frame for every relay
+func EventFrame(event *nostr.Event) ([]byte, error) {
+	return nostr.EventEnvelope{Event: *event}.MarshalJSON()
+}
+
+// LateOK is an OK that arrived after its publisher gave up waiting
+type LateOK struct {
+	URL     string
+	EventID string
+	OK      bool
+	Reason  string
+	Delay   time.Duration // since the EVENT frame was written
+}
+
+type okResult struct {
+	ok     bool
+	reason string
+	lost   bool // the connection closed before the relay answered
+}
+
+// Conn is one WebSocket connection to a relay, shared by concurrent publishers
+type Conn struct {
+	url   string
+	ready chan struct{} // closed once dialing finished (dialErr tells how)
+
+	conn    *ws.Conn
+	dialErr error
+
+	writeMu sync.Mutex
+	// ctx lives as long as the connection; writes derive their timeout from it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lateWindow time.Duration
+	onLateOK   func(LateOK)
+	backoff    *backoff.Tracker
+
+	authMu sync.Mutex // one authentication at a time
+
+	mu       sync.Mutex
+	pending  map[string][]chan okResult // event ID -> waiters
+	late     map[string]time.Time       // event ID -> write time, for publishes that timed out
+	closed   bool
+	lastUsed time.Time
+	notices  []Notice // most recent last
+
+	challenge  string        // latest NIP-42 challenge ("" = none received)
+	challenged chan struct{} // closed when the first challenge arrives
+	authedFor  string        // challenge we authenticated for
+}
+
+// Pool holds at most one connection per relay URL
+type Pool struct {
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+
+	// Late OKs: publishes that time out keep listening on the connection for lateWindow
+	lateWindow time.Duration
+	onLateOK   func(LateOK)
+
+	// Hosts that answered the upgrade with 429/503 are not dialed until their backoff ends
+	backoff *backoff.Tracker
+
+	// .onion relays are dialed through a SOCKS5 proxy (see SetOnionProxy)
+	onionOptions *ws.DialOptions
+
+	// Called with the outcome of every dial (see OnDial)
+	onDial func(url string, elapsed time.Duration, err error)
+
+	// NIP-42 authentication to relays answering "auth-required:" (see SetAuthKey)
+	auth authState
+
+	// Connections to the top relays stay open between publishes (see KeepWarm)
+	warm warmState
+
+	// How sockets are opened (see SetDialConfig); dialer is nil with the default dialer
+	dialOptions *ws.DialOptions
+	dialer      *dialer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New returns a Pool closing connections unused for idleTimeout
+func New(idleTimeout time.Duration) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		idleTimeout: idleTimeout,
+		conns:       make(map[string]*Conn),
+		dialOptions: defaultDialOptions,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	go p.reapIdle()
+	return p
+}
+
+// Close closes every pooled connection
+func (p *Pool) Close() {
+	p.cancel()
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*Conn)
+	p.mu.Unlock()
+	for _, c := range conns {
+		c.close(ErrConnectionClosed)
+	}
+}
+
+// WatchLateOKs keeps listening for lateWindow after a publish times out and calls fn with the
+// relay's OK if it arrives in that window. fn runs on the connection's read loop, so it must
+// return quickly. Must be called before the first Publish.
+func (p *Pool) WatchLateOKs(lateWindow time.Duration, fn func(LateOK)) {
+	p.lateWindow = lateWindow
+	p.onLateOK = fn
+}
+
+// SetOnionProxy dials .onion relays through torProxy. Must be called before the first Publish.
+func (p *Pool) SetOnionProxy(torProxy *onion.Proxy) {
+	p.onionOptions = &ws.DialOptions{
+		CompressionMode: defaultDialOptions.CompressionMode,
+		HTTPHeader:      defaultDialOptions.HTTPHeader,
+		HTTPClient:      torProxy.HTTPClient(),
+	}
+}
+
+// OnDial calls fn with the outcome and duration of every connection the pool opens. fn runs on
+// the publishing goroutine, so it must return quickly. Must be called before the first Publish.
+func (p *Pool) OnDial(fn func(url string, elapsed time.Duration, err error)) {
+	p.onDial = fn
+}
+
+// SetBackoff makes dials skip hosts backed off in tracker and report throttling upgrade
+// responses to it. Must be called before the first Publish.
+func (p *Pool) SetBackoff(tracker *backoff.Tracker) {
+	p.backoff = tracker
+}
+
+// Publish writes a pre-serialized EVENT frame to url and waits for the relay's OK for eventID.
+// A rejection is returned as "msg: <reason>", like go-nostr's Relay.Publish. With an auth key
+// set, an "auth-required:" rejection is answered with NIP-42 authentication and one more try.
+func (p *Pool) Publish(ctx context.Context, url string, eventID string, frame []byte) error {
+	c, err := p.get(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	res, written, err := c.send(ctx, eventID, frame)
+	if err == nil && p.auth.wants(res) {
+		if authErr := c.authenticate(ctx, &p.auth); authErr != nil {
+			logging.DebugMethod("pool", "Publish", "Cannot authenticate to %s: %v", url, authErr)
+		} else {
+			res, written, err = c.send(ctx, eventID, frame)
+		}
+	}
+	if err != nil {
+		if p.onLateOK != nil && errors.Is(err, context.DeadlineExceeded) && !written.IsZero() {
+			c.watchLate(eventID, written)
+		}
+		return err
+	}
+
+	if res.lost {
+		return &PublishError{Err: ErrConnectionClosed, Notices: c.recentNotices()}
+	}
+	if strings.HasPrefix(res.reason, "duplicate:") {
+		return fmt.Errorf("%w: %s", ErrDuplicate, res.reason)
+	}
+	if !res.ok {
+		return &PublishError{Err: fmt.Errorf("msg: %s", res.reason), Notices: c.recentNotices()}
+	}
+	return nil
+}
+
+// send writes frame and waits for the relay's OK for eventID. written is zero if the frame
+// was not written.
+func (c *Conn) send(ctx context.Context, eventID string, frame []byte) (res okResult, written time.Time, err error) {
+	wait, conn := c.expect(eventID)
+	defer c.forget(eventID, wait)
+	if conn == nil {
+		return res, written, ErrConnectionClosed
+	}
+
+	c.writeMu.Lock()
+	if err = ctx.Err(); err != nil {
+		c.writeMu.Unlock()
+		return res, written, err // gave up while waiting for the socket
+	}
+	writeCtx, cancel := context.WithTimeout(c.ctx, writeTimeout)
+	err = conn.Write(writeCtx, ws.MessageText, frame)
+	cancel()
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return res, written, fmt.Errorf("failed to write message: %w", err)
+	}
+	written = time.Now()
+
+	select {
+	case res = <-wait:
+		return res, written, nil
+	case <-ctx.Done():
+		return res, written, ctx.Err()
+	}
+}
+
+// get returns a connected Conn for url, dialing once if needed; concurrent callers share the dial
+func (p *Pool) get(ctx context.Context, url string) (*Conn, error) {
+	p.mu.Lock()
+	c, ok := p.conns[url]
+	if ok && c.isClosed() {
+		delete(p.conns, url)
+		ok = false
+	}
+	if !ok {
+		if err := p.backoff.Check(url); err != nil {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("error opening websocket to '%s': %w", url, err)
+		}
+		connCtx, cancel := context.WithCancel(context.Background())
+		c = &Conn{
+			url:        url,
+			ctx:        connCtx,
+			cancel:     cancel,
+			ready:      make(chan struct{}),
+			pending:    make(map[string][]chan okResult),
+			late:       make(map[string]time.Time),
+			lateWindow: p.lateWindow,
+			onLateOK:   p.onLateOK,
+			backoff:    p.backoff,
+			lastUsed:   time.Now(),
+			challenged: make(chan struct{}),
+		}
+		p.conns[url] = c
+		p.mu.Unlock()
+
+		opts := p.dialOptions
+		if p.onionOptions != nil && onion.IsOnion(url) {
+			opts = p.onionOptions
+		}
+		start := time.Now()
+		conn, err := c.dial(ctx, opts)
+		if p.onDial != nil {
+			p.onDial(url, time.Since(start), err)
+		}
+		if err != nil {
+			p.remove(url, c)
+			return nil, err
+		}
+		go c.readLoop(conn, func() { p.remove(url, c) })
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if c.dialErr != nil {
+		return nil, c.dialErr
+	}
+	return c, nil
+}
+
+func (p *Pool) remove(url string, c *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[url] == c {
+		delete(p.conns, url)
+	}
+}
+
+// reapIdle closes connections nobody published on for idleTimeout, except warm ones
+func (p *Pool) reapIdle() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			for url, c := range p.conns {
+				c.expireLate()
+				if c.idleFor() > p.idleTimeout && !p.isWarm(url) {
+					delete(p.conns, url)
+					go c.close(ErrConnectionClosed)
+					logging.DebugMethod("pool", "reapIdle", "Closed idle connection to %s", url)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// dial connects the socket; waiters on ready see the outcome in dialErr
+func (c *Conn) dial(ctx context.Context, opts *ws.DialOptions) (*ws.Conn, error) {
+	defer close(c.ready)
+	conn, resp, err := ws.Dial(ctx, c.url, opts)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if throttled := backoff.FromResponse(c.url, resp); throttled != nil {
+			// The relay (or the proxy in front of it) is up but wants us to slow down
+			err = c.backoff.Throttle(throttled)
+		}
+		c.dialErr = fmt.Errorf("error opening websocket to '%s': %w", c.url, err)
+		c.closed = true
+		return nil, c.dialErr
+	}
+	if c.closed {
+		// the pool was closed while dialing
+		conn.Close(ws.StatusNormalClosure, "")
+		c.dialErr = ErrConnectionClosed
+		return nil, c.dialErr
+	}
+	conn.SetReadLimit(2 << 24)
+	c.backoff.Succeeded(c.url)
+	c.conn = conn
+	c.lastUsed = time.Now()
+	logging.DebugMethod("pool", "dial", "Connected to %s", c.url)
+	return conn, nil
+}
+
+// readLoop dispatches OK frames to waiting publishers until the connection fails
+func (c *Conn) readLoop(conn *ws.Conn, onClose func()) {
+	defer onClose()
+	for {
+		_, data, err := conn.Read(context.Background())
+		if err != nil {
+			c.close(err)
+			return
+		}
+		switch env := nostr.ParseMessage(string(data)).(type) {
+		case *nostr.OKEnvelope:
+			c.resolve(env.EventID, okResult{ok: env.OK, reason: env.Reason})
+		case *nostr.AuthEnvelope:
+			if env.Challenge != nil {
+				c.setChallenge(*env.Challenge)
+			}
+		case *nostr.NoticeEnvelope:
+			c.addNotice(string(*env))
+			logging.DebugMethod("pool", "readLoop", "NOTICE from %s: %s", c.url, string(*env))
+		}
+	}
+}
+
+// expect registers a waiter for eventID's OK and returns the socket to write on (nil once closed)
+func (c *Conn) expect(eventID string) (chan okResult, *ws.Conn) {
+	ch := make(chan okResult, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUsed = time.Now()
+	if c.closed {
+		return ch, nil
+	}
+	c.pending[eventID] = append(c.pending[eventID], ch)
+	return ch, c.conn
+}
+
+func (c *Conn) forget(eventID string, ch chan okResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiters := c.pending[eventID]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(c.pending, eventID)
+	} else {
+		c.pending[eventID] = waiters
+	}
+}
+
+func (c *Conn) resolve(eventID string, res okResult) {
+	c.mu.Lock()
+	for _, ch := range c.pending[eventID] {
+		select {
+		case ch <- res:
+		default:
+		}
+	}
+	delete(c.pending, eventID)
+	written, late := c.late[eventID]
+	delete(c.late, eventID)
+	c.mu.Unlock()
+
+	if !late {
+		return
+	}
+	delay := time.Since(written)
+	if delay > c.lateWindow {
+		return
+	}
+	logging.DebugMethod("pool", "resolve", "Late OK from %s for %s after %v (ok=%v)", c.url, eventID, delay, res.ok)
+	c.onLateOK(LateOK{URL: c.url, EventID: eventID, OK: res.ok, Reason: res.reason, Delay: delay})
+}
+
+// watchLate keeps expecting eventID's OK after its publisher timed out
+func (c *Conn) watchLate(eventID string, written time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.late[eventID] = written
+	}
+}
+
+// expireLate stops waiting for late OKs older than the window
+func (c *Conn) expireLate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for eventID, written := range c.late {
+		if time.Since(written) > c.lateWindow {
+			delete(c.late, eventID)
+		}
+	}
+}
+
+func (c *Conn) addNotice(message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.notices) >= maxNotices {
+		c.notices = c.notices[1:]
+	}
+	c.notices = append(c.notices, Notice{At: time.Now(), Message: message})
+}
+
+func (c *Conn) recentNotices() []Notice {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Notice(nil), c.notices...)
+}
+
+func (c *Conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Conn) idleFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) > 0 || len(c.late) > 0 {
+		return 0
+	}
+	return time.Since(c.lastUsed)
+}
+
+// close fails all waiting publishers and closes the socket
+func (c *Conn) close(reason error) {
+	c.mu.Lock()
+	if c.closed && c.conn == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.cancel()
+	conn := c.conn
+	c.conn = nil
+	pending := c.pending
+	c.pending = make(map[string][]chan okResult)
+	c.late = make(map[string]time.Time)
+	c.mu.Unlock()
+
+	for _, waiters := range pending {
+		for _, ch := range waiters {
+			select {
+			case ch <- okResult{lost: true}:
+			default:
+			}
+		}
+	}
+	if conn != nil {
+		conn.Close(ws.StatusNormalClosure, "")
+		logging.DebugMethod("pool", "close", "Connection to %s closed: %v", c.url, reason)
+	}
+}
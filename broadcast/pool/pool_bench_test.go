@@ -0,0 +1,122 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// okServer is a relay answering every EVENT with an OK true, at any path
+func okServer(b *testing.B) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := ws.Accept(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		conn.SetReadLimit(1 << 20)
+		for {
+			_, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if env, ok := nostr.ParseMessage(string(data)).(*nostr.EventEnvelope); ok {
+				reply, _ := nostr.OKEnvelope{EventID: env.Event.ID, OK: true}.MarshalJSON()
+				if conn.Write(context.Background(), ws.MessageText, reply) != nil {
+					return
+				}
+			}
+		}
+	}))
+}
+
+func benchEvent(b *testing.B, i int) *nostr.Event {
+	event := &nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"t", "bench"}, {"p", strings.Repeat("ab", 32)}},
+		Content:   fmt.Sprintf("%d %s", i, strings.Repeat("fan-out benchmark ", 40)),
+	}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		b.Fatal(err)
+	}
+	return event
+}
+
+// BenchmarkFanout publishes one event to n relays per iteration: through the pool (serialized
+// once, the same frame written to every connection) and through one go-nostr Relay per URL
+// (serialized again for every relay). Compare ns/op and B/op as n grows.
+func BenchmarkFanout(b *testing.B) {
+	for _, n := range []int{10, 50, 200} {
+		server := okServer(b)
+		base := "ws" + strings.TrimPrefix(server.URL, "http")
+		urls := make([]string, n)
+		for i := range urls {
+			urls[i] = fmt.Sprintf("%s/relay%d", base, i)
+		}
+		events := make([]*nostr.Event, 64)
+		for i := range events {
+			events[i] = benchEvent(b, i)
+		}
+
+		b.Run(fmt.Sprintf("pool/relays=%d", n), func(b *testing.B) {
+			p := New(time.Minute)
+			defer p.Close()
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				event := events[i%len(events)]
+				frame, err := EventFrame(event)
+				if err != nil {
+					b.Fatal(err)
+				}
+				publishAll(b, urls, func(url string) error {
+					return p.Publish(ctx, url, event.ID, frame)
+				})
+			}
+		})
+
+		b.Run(fmt.Sprintf("go-nostr/relays=%d", n), func(b *testing.B) {
+			ctx := context.Background()
+			relays := make(map[string]*nostr.Relay, n)
+			for _, url := range urls {
+				relay, err := nostr.RelayConnect(ctx, url)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer relay.Close()
+				relays[url] = relay
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				event := events[i%len(events)]
+				publishAll(b, urls, func(url string) error {
+					return relays[url].Publish(ctx, *event)
+				})
+			}
+		})
+		server.Close()
+	}
+}
+
+// publishAll runs publish for every URL concurrently, as the broadcaster does
+func publishAll(b *testing.B, urls []string, publish func(url string) error) {
+	errs := make(chan error, len(urls))
+	for _, url := range urls {
+		go func() { errs <- publish(url) }()
+	}
+	for range urls {
+		if err := <-errs; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
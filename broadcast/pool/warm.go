@@ -0,0 +1,192 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Redial delays of a warm relay whose connection keeps failing
+const (
+	minRedial = 5 * time.Second
+	maxRedial = 5 * time.Minute
+)
+
+// warmState tracks the relays kept connected between publishes
+type warmState struct {
+	mu      sync.Mutex
+	targets map[string]bool
+	retry   map[string]redial
+
+	dials      int64
+	dialErrors int64
+	pings      int64
+	pingErrors int64
+}
+
+// redial is when a failing warm relay may be dialed again
+type redial struct {
+	at    time.Time
+	delay time.Duration
+}
+
+// KeepWarm keeps connections to the relays returned by targets open: they are exempt from the
+// idle timeout, pinged every interval to catch dead sockets, and redialed (with backoff) when
+// they drop, so publishes to the top relays don't pay for a handshake. Call once.
+func (p *Pool) KeepWarm(interval time.Duration, targets func() []string) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	p.warm.mu.Lock()
+	p.warm.targets = make(map[string]bool)
+	p.warm.retry = make(map[string]redial)
+	p.warm.mu.Unlock()
+	go p.keepWarm(interval, targets)
+}
+
+func (p *Pool) keepWarm(interval time.Duration, targets func() []string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.warmRound(interval, targets())
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmRound pings the open warm connections and dials the missing ones
+func (p *Pool) warmRound(interval time.Duration, urls []string) {
+	targets := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		targets[url] = true
+	}
+	p.warm.mu.Lock()
+	p.warm.targets = targets
+	for url := range p.warm.retry {
+		if !targets[url] {
+			delete(p.warm.retry, url)
+		}
+	}
+	p.warm.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for url := range targets {
+		p.mu.Lock()
+		c, ok := p.conns[url]
+		p.mu.Unlock()
+
+		wg.Add(1)
+		go func(url string, c *Conn, ok bool) {
+			defer wg.Done()
+			if ok && !c.isClosed() {
+				p.ping(url, c, interval)
+			} else {
+				p.redial(url, interval)
+			}
+		}(url, c, ok)
+	}
+	wg.Wait()
+}
+
+// ping checks a warm connection nobody used within the interval; a dead one is closed and
+// redialed on the next round
+func (p *Pool) ping(url string, c *Conn, interval time.Duration) {
+	if c.idleFor() < interval {
+		return // publishes keep it alive and prove it works
+	}
+	select {
+	case <-c.ready:
+	default:
+		return // still dialing
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return
+	}
+
+	atomic.AddInt64(&p.warm.pings, 1)
+	ctx, cancel := context.WithTimeout(p.ctx, interval/2)
+	defer cancel()
+	if err := conn.Ping(ctx); err != nil {
+		atomic.AddInt64(&p.warm.pingErrors, 1)
+		logging.DebugMethod("pool", "ping", "Warm connection to %s failed its ping: %v", url, err)
+		c.close(err)
+		p.remove(url, c)
+	}
+}
+
+// redial connects a warm relay unless it failed recently
+func (p *Pool) redial(url string, interval time.Duration) {
+	p.warm.mu.Lock()
+	r := p.warm.retry[url]
+	p.warm.mu.Unlock()
+	if time.Now().Before(r.at) {
+		return
+	}
+
+	atomic.AddInt64(&p.warm.dials, 1)
+	ctx, cancel := context.WithTimeout(p.ctx, interval)
+	defer cancel()
+	_, err := p.get(ctx, url)
+
+	p.warm.mu.Lock()
+	defer p.warm.mu.Unlock()
+	if err == nil {
+		delete(p.warm.retry, url)
+		return
+	}
+	atomic.AddInt64(&p.warm.dialErrors, 1)
+	r.delay = min(max(r.delay*2, minRedial), maxRedial)
+	r.at = time.Now().Add(r.delay)
+	p.warm.retry[url] = r
+	logging.DebugMethod("pool", "redial", "Warm connection to %s failed, retrying in %v: %v", url, r.delay, err)
+}
+
+// isWarm reports whether url's connection is kept open regardless of idleness
+func (p *Pool) isWarm(url string) bool {
+	p.warm.mu.Lock()
+	defer p.warm.mu.Unlock()
+	return p.warm.targets[url]
+}
+
+// Stats returns the open connections and the keep-warm counters
+func (p *Pool) Stats() json.JsonEntity {
+	p.mu.Lock()
+	open := 0
+	for _, c := range p.conns {
+		if !c.isClosed() {
+			open++
+		}
+	}
+	p.mu.Unlock()
+
+	p.warm.mu.Lock()
+	targets, failing := len(p.warm.targets), len(p.warm.retry)
+	p.warm.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("open", json.NewJsonValue(open))
+	obj.Set("idle_timeout_seconds", json.NewJsonValue(p.idleTimeout.Seconds()))
+	obj.Set("warm_targets", json.NewJsonValue(targets))
+	obj.Set("warm_failing", json.NewJsonValue(failing))
+	obj.Set("warm_dials", json.NewJsonValue(atomic.LoadInt64(&p.warm.dials)))
+	obj.Set("warm_dial_errors", json.NewJsonValue(atomic.LoadInt64(&p.warm.dialErrors)))
+	obj.Set("pings", json.NewJsonValue(atomic.LoadInt64(&p.warm.pings)))
+	obj.Set("ping_errors", json.NewJsonValue(atomic.LoadInt64(&p.warm.pingErrors)))
+	if p.dialer != nil {
+		obj.Set("dial", p.dialer.stats())
+	}
+	if p.auth.secretKey != "" {
+		obj.Set("auth", p.auth.stats())
+	}
+	return obj
+}
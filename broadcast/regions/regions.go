@@ -0,0 +1,289 @@
+// Package regions adds region-aware relay selection on top of the manager's top-N.
+// Relays can be grouped into regions statically, and remote probe agents can report the
+// latency they see from their own vantage point, so each region keeps its best relays in
+// the broadcast set even when they are slow from where the broadcaster runs.
+package regions
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// RelaySource is the local relay ranking the regional selection extends
+type RelaySource interface {
+	GetBroadcastRelays(ctx context.Context) ([]string, error)
+	GetRelayInfo(ctx context.Context, url string) (*manager.RelayInfo, error)
+}
+
+// Config controls regional selection
+type Config struct {
+	Regions         map[string][]string // region name -> member relay URLs
+	RelaysPerRegion int                 // best relays of each region added to the top-N
+	ProbeMaxAge     time.Duration       // probe measurements older than this are ignored
+}
+
+// Measurement is one probe agent's view of one relay
+type Measurement struct {
+	URL       string  `json:"url"`
+	LatencyMs float64 `json:"latency_ms"`
+	Success   bool    `json:"success"`
+}
+
+type probeStat struct {
+	avgLatency  time.Duration
+	successRate float64
+	samples     int64
+	updated     time.Time
+}
+
+// Selector implements broadcaster.RelayProvider
+type Selector struct {
+	source RelaySource
+	cfg    Config
+
+	mu     sync.RWMutex
+	probes map[string]map[string]*probeStat // region -> relay URL -> stats
+	agents map[string]time.Time             // probe agent -> last report
+}
+
+// New returns a Selector extending source's top-N with the best relays of each region
+func New(source RelaySource, cfg Config) *Selector {
+	if cfg.RelaysPerRegion <= 0 {
+		cfg.RelaysPerRegion = 3
+	}
+	if cfg.ProbeMaxAge <= 0 {
+		cfg.ProbeMaxAge = time.Hour
+	}
+	logging.DebugMethod("regions", "New", "Initializing regional selection: %d static regions, %d relays per region",
+		len(cfg.Regions), cfg.RelaysPerRegion)
+	return &Selector{
+		source: source,
+		cfg:    cfg,
+		probes: make(map[string]map[string]*probeStat),
+		agents: make(map[string]time.Time),
+	}
+}
+
+// RecordProbe stores latency measurements reported by a remote probe agent for region
+func (s *Selector) RecordProbe(agent, region string, results []Measurement) int {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.agents[agent] = now
+	relays, ok := s.probes[region]
+	if !ok {
+		relays = make(map[string]*probeStat)
+		s.probes[region] = relays
+	}
+
+	recorded := 0
+	for _, m := range results {
+		url := strings.TrimSuffix(strings.TrimSpace(m.URL), "/")
+		if url == "" {
+			continue
+		}
+		stat, ok := relays[url]
+		if !ok || now.Sub(stat.updated) > s.cfg.ProbeMaxAge {
+			stat = &probeStat{successRate: 1.0}
+			relays[url] = stat
+		}
+		successValue := 0.0
+		if m.Success {
+			successValue = 1.0
+			latency := time.Duration(m.LatencyMs * float64(time.Millisecond))
+			if stat.avgLatency == 0 {
+				stat.avgLatency = latency
+			} else {
+				// Same moving average the manager uses for local response times
+				stat.avgLatency = time.Duration(float64(stat.avgLatency)*0.7 + float64(latency)*0.3)
+			}
+		}
+		if stat.samples == 0 {
+			stat.successRate = successValue
+		} else {
+			stat.successRate = stat.successRate*0.7 + successValue*0.3
+		}
+		stat.samples++
+		stat.updated = now
+		recorded++
+	}
+	logging.DebugMethod("regions", "RecordProbe", "Probe %s (region %s) reported %d relays", agent, region, recorded)
+	return recorded
+}
+
+// score ranks a relay like manager.CalculateScore: success rate minus a latency penalty
+func score(successRate float64, latency time.Duration) float64 {
+	return successRate*100.0 - latency.Seconds()*10.0
+}
+
+// localInfo returns the manager's view of url if it has been tested and is usable
+func (s *Selector) localInfo(ctx context.Context, url string) (*manager.RelayInfo, bool) {
+	info, err := s.source.GetRelayInfo(ctx, url)
+	if err != nil || info.TotalAttempts == 0 {
+		return nil, false
+	}
+	return info, true
+}
+
+// regionRanking returns the relays of one region, best first. Fresh probe measurements from
+// the region take precedence; static members without measurements fall back to local stats.
+func (s *Selector) regionRanking(ctx context.Context, region string, now time.Time) []string {
+	scores := make(map[string]float64)
+	for url, stat := range s.probes[region] {
+		if now.Sub(stat.updated) > s.cfg.ProbeMaxAge || stat.successRate <= 0 {
+			continue
+		}
+		if _, ok := s.localInfo(ctx, url); !ok {
+			continue // only relays the manager knows about and has tested
+		}
+		scores[url] = score(stat.successRate, stat.avgLatency)
+	}
+	for _, url := range s.cfg.Regions[region] {
+		if _, measured := scores[url]; measured {
+			continue
+		}
+		if info, ok := s.localInfo(ctx, url); ok && info.SuccessRate > 0 {
+			scores[url] = score(info.SuccessRate, info.AvgResponseTime)
+		}
+	}
+
+	ranked := make([]string, 0, len(scores))
+	for url := range scores {
+		ranked = append(ranked, url)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked
+}
+
+// regionNames returns configured and probed regions
+func (s *Selector) regionNames() []string {
+	names := make(map[string]bool)
+	for region := range s.cfg.Regions {
+		names[region] = true
+	}
+	for region := range s.probes {
+		names[region] = true
+	}
+	result := make([]string, 0, len(names))
+	for region := range names {
+		result = append(result, region)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// GetBroadcastRelays returns the local top-N plus the best relays of every region
+func (s *Selector) GetBroadcastRelays(ctx context.Context) ([]string, error) {
+	relays, err := s.source.GetBroadcastRelays(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.withRegions(ctx, relays), nil
+}
+
+// GetBroadcastRelaysN is GetBroadcastRelays with the local top N replaced by the n best relays
+// (when the source supports it), for per-event fan-out overrides
+func (s *Selector) GetBroadcastRelaysN(ctx context.Context, n int) ([]string, error) {
+	sized, ok := s.source.(interface {
+		GetBroadcastRelaysN(context.Context, int) ([]string, error)
+	})
+	if !ok {
+		return s.GetBroadcastRelays(ctx)
+	}
+	relays, err := sized.GetBroadcastRelaysN(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return s.withRegions(ctx, relays), nil
+}
+
+// withRegions appends the best relays of each region that are not already in relays
+func (s *Selector) withRegions(ctx context.Context, relays []string) []string {
+	seen := make(map[string]bool, len(relays))
+	for _, url := range relays {
+		seen[url] = true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, region := range s.regionNames() {
+		ranking := s.regionRanking(ctx, region, now)
+		if len(ranking) > s.cfg.RelaysPerRegion {
+			ranking = ranking[:s.cfg.RelaysPerRegion]
+		}
+		for _, url := range ranking {
+			if !seen[url] {
+				seen[url] = true
+				relays = append(relays, url)
+			}
+		}
+	}
+	return relays
+}
+
+// GetStatsName returns the name for this stats provider
+func (s *Selector) GetStatsName() string {
+	return "regions"
+}
+
+// GetStats returns each region's selected relays and the probe agents seen as a JsonEntity
+func (s *Selector) GetStats() json.JsonEntity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ctx := context.Background()
+	now := time.Now()
+	regionsObj := json.NewJsonObject()
+	for _, region := range s.regionNames() {
+		ranking := s.regionRanking(ctx, region, now)
+		if len(ranking) > s.cfg.RelaysPerRegion {
+			ranking = ranking[:s.cfg.RelaysPerRegion]
+		}
+		selected := json.NewJsonList()
+		for _, url := range ranking {
+			selected.Append(json.NewJsonValue(url))
+		}
+
+		measured := 0
+		for _, stat := range s.probes[region] {
+			if now.Sub(stat.updated) <= s.cfg.ProbeMaxAge {
+				measured++
+			}
+		}
+
+		regionObj := json.NewJsonObject()
+		regionObj.Set("static_members", json.NewJsonValue(len(s.cfg.Regions[region])))
+		regionObj.Set("measured_relays", json.NewJsonValue(measured))
+		regionObj.Set("selected", selected)
+		regionsObj.Set(region, regionObj)
+	}
+
+	activeAgents := 0
+	for _, last := range s.agents {
+		if now.Sub(last) <= s.cfg.ProbeMaxAge {
+			activeAgents++
+		}
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("relays_per_region", json.NewJsonValue(s.cfg.RelaysPerRegion))
+	obj.Set("active_probe_agents", json.NewJsonValue(activeAgents))
+	obj.Set("regions", regionsObj)
+	return obj
+}
@@ -0,0 +1,378 @@
+// Package requirements reads the NIP-11 limitation document of destination relays and keeps
+// events away from relays whose requirements the broadcaster cannot meet: payment_required,
+// auth_required (unless we answer NIP-42 challenges), a min_pow_difficulty above the event's
+// proof of work, or a max_message_length the event does not fit in. Such relays would only
+// reject every publish, wasting connections and dragging their stats down.
+package requirements
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// Policies for relays with requirements we cannot meet
+const (
+	PolicyOff     = "off"     // don't fetch NIP-11 documents
+	PolicyRecord  = "record"  // fetch and expose requirements, keep publishing
+	PolicyExclude = "exclude" // skip relays whose requirements an event does not meet
+)
+
+// Reasons a relay is skipped, as reported in stats
+const (
+	ReasonPayment = "payment"
+	ReasonAuth    = "auth"
+	ReasonPow     = "pow"
+	ReasonSize    = "size"
+)
+
+// reasons lists every exclusion reason, in stats order
+var reasons = []string{ReasonPayment, ReasonAuth, ReasonPow, ReasonSize}
+
+const (
+	// fetchTimeout bounds one NIP-11 request
+	fetchTimeout = 10 * time.Second
+	// retryAfterFailure is how soon a relay whose document could not be fetched is asked again
+	retryAfterFailure = time.Hour
+)
+
+// Config controls requirement checks
+type Config struct {
+	Policy  string
+	Refresh time.Duration // how long a fetched document is trusted (default 24h)
+	Allow   []string      // relays whose requirements we meet anyway (paid for, whitelisted, mandatory)
+	Workers int           // concurrent NIP-11 fetches (default 4)
+	CanAuth bool          // we authenticate to relays asking for it, so auth_required is no obstacle
+}
+
+// Requirements is what a relay's NIP-11 document demands from publishers
+type Requirements struct {
+	PaymentRequired  bool
+	AuthRequired     bool
+	MinPow           int
+	MaxMessageLength int   // bytes of the whole EVENT frame; 0 = no limit
+	SupportedNIPs    []int // as advertised, not verified
+	FetchedAt        time.Time
+	Err              string // fetch error; the relay is treated as having no requirements
+}
+
+func (r *Requirements) any() bool {
+	return r.PaymentRequired || r.AuthRequired || r.MinPow > 0
+}
+
+// Checker implements broadcaster.RelayFilter
+type Checker struct {
+	cfg   Config
+	queue chan string
+
+	mu      sync.RWMutex
+	allow   map[string]bool
+	docs    map[string]*Requirements
+	pending map[string]bool
+
+	fetched     int64
+	fetchFailed int64
+	dropped     int64    // fetches not queued because the queue was full
+	excluded    sync.Map // reason -> *int64
+}
+
+// New returns a Checker for cfg and starts its fetchers, or nil if the policy is off
+func New(cfg Config) *Checker {
+	if cfg.Policy == PolicyOff || cfg.Policy == "" {
+		return nil
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = 24 * time.Hour
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	logging.DebugMethod("requirements", "New", "Initializing NIP-11 requirement checks: policy=%s, refresh=%v, %d allowed relays",
+		cfg.Policy, cfg.Refresh, len(cfg.Allow))
+
+	c := &Checker{
+		cfg:     cfg,
+		allow:   make(map[string]bool, len(cfg.Allow)),
+		queue:   make(chan string, 1000),
+		docs:    make(map[string]*Requirements),
+		pending: make(map[string]bool),
+	}
+	for _, url := range cfg.Allow {
+		c.allow[url] = true
+	}
+	for _, reason := range reasons {
+		c.excluded.Store(reason, new(int64))
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go c.worker()
+	}
+	return c
+}
+
+// lookup returns the cached requirements of url, queueing a fetch if they are missing or stale;
+// nil until the first fetch finished
+func (c *Checker) lookup(url string) *Requirements {
+	c.mu.RLock()
+	req := c.docs[url]
+	stale := req == nil || time.Since(req.FetchedAt) > c.refreshFor(req)
+	queued := c.pending[url]
+	c.mu.RUnlock()
+
+	if stale && !queued {
+		c.mu.Lock()
+		if !c.pending[url] {
+			select {
+			case c.queue <- url:
+				c.pending[url] = true
+			default:
+				atomic.AddInt64(&c.dropped, 1)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return req
+}
+
+func (c *Checker) refreshFor(req *Requirements) time.Duration {
+	if req != nil && req.Err != "" {
+		return retryAfterFailure
+	}
+	return c.cfg.Refresh
+}
+
+func (c *Checker) worker() {
+	for url := range c.queue {
+		c.fetch(url)
+	}
+}
+
+// fetch reads url's NIP-11 document and stores its requirements
+func (c *Checker) fetch(url string) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	req := &Requirements{FetchedAt: time.Now()}
+	info, err := nip11.Fetch(ctx, url)
+	if err != nil {
+		atomic.AddInt64(&c.fetchFailed, 1)
+		req.Err = err.Error()
+		logging.DebugMethod("requirements", "fetch", "NIP-11 of %s unavailable: %v", url, err)
+	} else {
+		atomic.AddInt64(&c.fetched, 1)
+		if lim := info.Limitation; lim != nil {
+			req.PaymentRequired = lim.PaymentRequired
+			req.AuthRequired = lim.AuthRequired
+			req.MinPow = lim.MinPowDifficulty
+			req.MaxMessageLength = lim.MaxMessageLength
+		}
+		for _, nip := range info.SupportedNIPs {
+			if n, ok := nip.(float64); ok {
+				req.SupportedNIPs = append(req.SupportedNIPs, int(n))
+			}
+		}
+	}
+
+	c.mu.Lock()
+	previous := c.docs[url]
+	c.docs[url] = req
+	delete(c.pending, url)
+	c.mu.Unlock()
+
+	if req.any() && (previous == nil || !previous.any()) {
+		logging.Info("Requirements: %s requires payment=%v auth=%v min_pow=%d%s", url,
+			req.PaymentRequired, req.AuthRequired, req.MinPow, c.consequence(url))
+	}
+}
+
+// Probe returns the requirements of url, fetching its NIP-11 document first unless a fresh copy
+// is cached, together with the reason the relay would reject any event we publish ("" if it may
+// accept some, or if it is not to be excluded). Blocks for up to the NIP-11 fetch timeout.
+func (c *Checker) Probe(url string) (Requirements, string) {
+	c.mu.RLock()
+	req := c.docs[url]
+	c.mu.RUnlock()
+	if req == nil || time.Since(req.FetchedAt) > c.refreshFor(req) {
+		c.fetch(url)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	req = c.docs[url]
+	if c.cfg.Policy != PolicyExclude || c.allow[url] {
+		return *req, ""
+	}
+	return *req, c.rejectsAll(req)
+}
+
+// rejectsAll returns why a relay with req cannot take any event from us, or ""
+func (c *Checker) rejectsAll(req *Requirements) string {
+	switch {
+	case req.PaymentRequired:
+		return ReasonPayment
+	case req.AuthRequired && !c.cfg.CanAuth:
+		return ReasonAuth
+	}
+	return ""
+}
+
+// consequence describes what happens to a relay with requirements, for the log
+func (c *Checker) consequence(url string) string {
+	switch {
+	case c.allowed(url):
+		return " (allowed, still publishing)"
+	case c.cfg.Policy == PolicyExclude:
+		return " (skipped for events that don't meet them)"
+	default:
+		return " (recorded only)"
+	}
+}
+
+// unmet returns why event cannot be published to a relay with req, or "" if it can
+func (c *Checker) unmet(req *Requirements, event *nostr.Event) string {
+	if reason := c.rejectsAll(req); reason != "" {
+		return reason
+	}
+	switch {
+	case req.MinPow > 0 && nip13.Difficulty(event.ID) < req.MinPow:
+		return ReasonPow
+	case req.MaxMessageLength > 0 && frameSize(event) > req.MaxMessageLength:
+		return ReasonSize
+	}
+	return ""
+}
+
+// frameSize is the length of the ["EVENT",<event>] frame event is published in
+func frameSize(event *nostr.Event) int {
+	return len(event.String()) + len(`["EVENT",]`)
+}
+
+// FilterRelays drops relays whose NIP-11 requirements event does not meet (PolicyExclude only).
+// Relays whose document has not been fetched yet are kept.
+func (c *Checker) FilterRelays(event *nostr.Event, relays []string) []string {
+	return c.filterRelays(event, relays, true)
+}
+
+// PlanRelays is FilterRelays for a dry run: exclusions are not counted
+func (c *Checker) PlanRelays(event *nostr.Event, relays []string) []string {
+	return c.filterRelays(event, relays, false)
+}
+
+func (c *Checker) filterRelays(event *nostr.Event, relays []string, count bool) []string {
+	result := make([]string, 0, len(relays))
+	for _, url := range relays {
+		req := c.lookup(url)
+		if req == nil || c.allowed(url) || c.cfg.Policy != PolicyExclude {
+			result = append(result, url)
+			continue
+		}
+		if reason := c.unmet(req, event); reason != "" {
+			if counter, ok := c.excluded.Load(reason); ok && count {
+				atomic.AddInt64(counter.(*int64), 1)
+			}
+			continue
+		}
+		result = append(result, url)
+	}
+	if len(result) < len(relays) {
+		logging.DebugMethod("requirements", "FilterRelays", "Skipping %d relays with unmet NIP-11 requirements for event %s",
+			len(relays)-len(result), event.ID)
+	}
+	return result
+}
+
+// Allow exempts url from exclusion (e.g. a mandatory relay added at runtime)
+func (c *Checker) Allow(url string) {
+	c.mu.Lock()
+	c.allow[url] = true
+	c.mu.Unlock()
+}
+
+func (c *Checker) allowed(url string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.allow[url]
+}
+
+// Get returns the known requirements of url
+func (c *Checker) Get(url string) (Requirements, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	req, ok := c.docs[url]
+	if !ok {
+		return Requirements{}, false
+	}
+	return *req, true
+}
+
+// GetStatsName returns the name for this stats provider
+func (c *Checker) GetStatsName() string {
+	return "requirements"
+}
+
+// GetStats returns fetch counters, relays with requirements and exclusions as a JsonEntity
+func (c *Checker) GetStats() json.JsonEntity {
+	c.mu.RLock()
+	urls := make([]string, 0)
+	for url, req := range c.docs {
+		if req.any() {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+	requiring := map[string]int{ReasonPayment: 0, ReasonAuth: 0, ReasonPow: 0, ReasonSize: 0}
+	relaysObj := json.NewJsonObject()
+	for _, url := range urls {
+		req := c.docs[url]
+		if req.PaymentRequired {
+			requiring[ReasonPayment]++
+		}
+		if req.AuthRequired {
+			requiring[ReasonAuth]++
+		}
+		if req.MinPow > 0 {
+			requiring[ReasonPow]++
+		}
+		if req.MaxMessageLength > 0 {
+			requiring[ReasonSize]++
+		}
+		relayObj := json.NewJsonObject()
+		relayObj.Set("payment_required", json.NewJsonValue(req.PaymentRequired))
+		relayObj.Set("auth_required", json.NewJsonValue(req.AuthRequired))
+		relayObj.Set("min_pow", json.NewJsonValue(req.MinPow))
+		relayObj.Set("max_message_length", json.NewJsonValue(req.MaxMessageLength))
+		relayObj.Set("allowed", json.NewJsonValue(c.allow[url]))
+		relaysObj.Set(url, relayObj)
+	}
+	known := len(c.docs)
+	pending := len(c.pending)
+	c.mu.RUnlock()
+
+	requiringObj := json.NewJsonObject()
+	excludedObj := json.NewJsonObject()
+	for _, reason := range reasons {
+		requiringObj.Set(reason, json.NewJsonValue(requiring[reason]))
+		counter, _ := c.excluded.Load(reason)
+		excludedObj.Set(reason, json.NewJsonValue(atomic.LoadInt64(counter.(*int64))))
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("policy", json.NewJsonValue(c.cfg.Policy))
+	obj.Set("can_auth", json.NewJsonValue(c.cfg.CanAuth))
+	obj.Set("known", json.NewJsonValue(known))
+	obj.Set("pending", json.NewJsonValue(pending))
+	obj.Set("fetched", json.NewJsonValue(atomic.LoadInt64(&c.fetched)))
+	obj.Set("fetch_failed", json.NewJsonValue(atomic.LoadInt64(&c.fetchFailed)))
+	obj.Set("fetch_dropped", json.NewJsonValue(atomic.LoadInt64(&c.dropped)))
+	obj.Set("requiring", requiringObj)
+	obj.Set("excluded", excludedObj)
+	obj.Set("relays", relaysObj)
+	return obj
+}
@@ -0,0 +1,175 @@
+// Package resultlog logs a sample of publish outcomes at Info level. At thousands of events per
+// minute logging every publish is unreadable and logging none leaves an operator blind, so each
+// outcome class (ok, or the netdiag failure class) is logged once every N results of that class;
+// failures to mandatory relays, which should never be missed, are always logged.
+package resultlog
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/netdiag"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ClassOK is the outcome class of a successful publish; failures use the netdiag classes
+const ClassOK = "ok"
+
+// Config controls the sampling
+type Config struct {
+	DefaultRate int             // log 1 in DefaultRate results of a class without its own rate (0 = none)
+	Rates       map[string]int  // per outcome class: log 1 in N (0 = none)
+	Mandatory   func() []string // failures to these relays are always logged
+}
+
+// counter tracks one outcome class
+type counter struct {
+	seen   int64
+	logged int64
+}
+
+// Logger implements broadcaster.BroadcastReporter
+type Logger struct {
+	cfg Config
+
+	mu       sync.Mutex
+	counters map[string]*counter
+
+	mandatoryFailures int64
+}
+
+// New returns a Logger for cfg
+func New(cfg Config) *Logger {
+	if cfg.DefaultRate < 0 {
+		cfg.DefaultRate = 0
+	}
+	if cfg.Rates == nil {
+		cfg.Rates = make(map[string]int)
+	}
+	for class, rate := range cfg.Rates {
+		if class != ClassOK && !validClass(class) {
+			logging.Warn("ResultLog: Unknown outcome class %q, ignored", class)
+			delete(cfg.Rates, class)
+			continue
+		}
+		if rate < 0 {
+			cfg.Rates[class] = 0
+		}
+	}
+	logging.DebugMethod("resultlog", "New", "Sampling publish results 1 in %d (per class: %v)", cfg.DefaultRate, cfg.Rates)
+	return &Logger{cfg: cfg, counters: make(map[string]*counter)}
+}
+
+func validClass(class string) bool {
+	for _, c := range netdiag.Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Class returns the outcome class of a publish result
+func Class(result broadcaster.RelayResult) string {
+	if result.Success {
+		return ClassOK
+	}
+	return netdiag.Classify(errors.New(result.Error))
+}
+
+// rate returns the sample rate of class
+func (l *Logger) rate(class string) int {
+	if rate, ok := l.cfg.Rates[class]; ok {
+		return rate
+	}
+	return l.cfg.DefaultRate
+}
+
+// counter returns the counter of class, creating it on first use
+func (l *Logger) counter(class string) *counter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counters[class]
+	if !ok {
+		c = &counter{}
+		l.counters[class] = c
+	}
+	return c
+}
+
+// BroadcastPlanned does nothing: outcomes are logged when the broadcast completes
+func (l *Logger) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted logs the sampled results of one broadcast
+func (l *Logger) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	mandatory := make(map[string]bool)
+	if l.cfg.Mandatory != nil {
+		for _, url := range l.cfg.Mandatory() {
+			mandatory[url] = true
+		}
+	}
+
+	for _, result := range report.Results {
+		class := Class(result)
+		c := l.counter(class)
+		n := atomic.AddInt64(&c.seen, 1)
+
+		if !result.Success && mandatory[result.URL] {
+			atomic.AddInt64(&l.mandatoryFailures, 1)
+			atomic.AddInt64(&c.logged, 1)
+			logging.Warn("ResultLog: %s publishing %s to mandatory relay %s after %v: %s",
+				class, report.Event.ID, result.URL, result.ResponseTime, result.Error)
+			continue
+		}
+
+		rate := l.rate(class)
+		if rate <= 0 || n%int64(rate) != 0 {
+			continue
+		}
+		atomic.AddInt64(&c.logged, 1)
+		if result.Success {
+			logging.Info("ResultLog: ok publishing %s (kind %d) to %s in %v [1 in %d]",
+				report.Event.ID, report.Event.Kind, result.URL, result.ResponseTime, rate)
+		} else {
+			logging.Info("ResultLog: %s publishing %s (kind %d) to %s after %v: %s [1 in %d]",
+				class, report.Event.ID, report.Event.Kind, result.URL, result.ResponseTime, result.Error, rate)
+		}
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (l *Logger) GetStatsName() string {
+	return "result_log"
+}
+
+// GetStats returns the sample rates and per-class counts as a JsonEntity
+func (l *Logger) GetStats() json.JsonEntity {
+	l.mu.Lock()
+	classes := make([]string, 0, len(l.counters))
+	for class := range l.counters {
+		classes = append(classes, class)
+	}
+	l.mu.Unlock()
+	sort.Strings(classes)
+
+	perClass := json.NewJsonObject()
+	for _, class := range classes {
+		c := l.counter(class)
+		obj := json.NewJsonObject()
+		obj.Set("rate", json.NewJsonValue(l.rate(class)))
+		obj.Set("seen", json.NewJsonValue(atomic.LoadInt64(&c.seen)))
+		obj.Set("logged", json.NewJsonValue(atomic.LoadInt64(&c.logged)))
+		perClass.Set(class, obj)
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("default_rate", json.NewJsonValue(l.cfg.DefaultRate))
+	obj.Set("mandatory_failures", json.NewJsonValue(atomic.LoadInt64(&l.mandatoryFailures)))
+	obj.Set("classes", perClass)
+	return obj
+}
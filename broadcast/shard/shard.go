@@ -0,0 +1,151 @@
+// Package shard splits the broadcast work of several broadcast-relay instances by event ID: with
+// Count instances, each owns the events whose ID hashes to its Index and only those are fanned
+// out by it, so adding instances adds throughput without publishing any event twice. Event IDs
+// are SHA-256 hashes, which makes the split even. Events reaching an instance that does not own
+// them are either forwarded to the owner (when the instances' WebSocket URLs are configured) or
+// dropped, which is only right when every instance receives every event (e.g. all pull the same
+// upstream relays).
+package shard
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// forwardTimeout bounds one forward to the owning instance, connection included
+const forwardTimeout = 10 * time.Second
+
+// Config controls sharding
+type Config struct {
+	Count int      // number of shards (instances)
+	Index int      // the shard this instance owns, 0..Count-1
+	Peers []string // WebSocket URL of each shard's instance, by index (empty = do not forward)
+}
+
+// Sharder decides which events this instance broadcasts and forwards the others
+type Sharder struct {
+	cfg Config
+
+	mu    sync.Mutex
+	conns map[int]*nostr.Relay // open connections to the other instances, by shard
+
+	owned     int64
+	forwarded int64
+	dropped   int64
+	failed    int64 // forwards the owner did not accept
+}
+
+// New returns a Sharder, or an error if the configuration is inconsistent
+func New(cfg Config) (*Sharder, error) {
+	if cfg.Count < 2 {
+		return nil, fmt.Errorf("shard count must be at least 2, got %d", cfg.Count)
+	}
+	if cfg.Index < 0 || cfg.Index >= cfg.Count {
+		return nil, fmt.Errorf("shard index %d out of range 0..%d", cfg.Index, cfg.Count-1)
+	}
+	if len(cfg.Peers) > 0 && len(cfg.Peers) != cfg.Count {
+		return nil, fmt.Errorf("%d shard peers configured for %d shards", len(cfg.Peers), cfg.Count)
+	}
+	logging.DebugMethod("shard", "New", "Initializing sharder: shard %d of %d, forwarding=%v", cfg.Index, cfg.Count, len(cfg.Peers) > 0)
+	return &Sharder{cfg: cfg, conns: make(map[int]*nostr.Relay)}, nil
+}
+
+// Shard returns the shard owning eventID: the first 64 bits of the (hex) ID modulo the shard
+// count, or an FNV hash of IDs that are not hex
+func (s *Sharder) Shard(eventID string) int {
+	if len(eventID) >= 16 {
+		if prefix, err := strconv.ParseUint(eventID[:16], 16, 64); err == nil {
+			return int(prefix % uint64(s.cfg.Count))
+		}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(eventID))
+	return int(h.Sum64() % uint64(s.cfg.Count))
+}
+
+// Owns reports whether this instance broadcasts event. Events it does not own are forwarded to
+// their owner in the background, or dropped if no peers are configured.
+func (s *Sharder) Owns(event *nostr.Event) bool {
+	shard := s.Shard(event.ID)
+	if shard == s.cfg.Index {
+		atomic.AddInt64(&s.owned, 1)
+		return true
+	}
+	if len(s.cfg.Peers) == 0 {
+		atomic.AddInt64(&s.dropped, 1)
+		logging.DebugMethod("shard", "Owns", "Event %s belongs to shard %d, not broadcasting it", event.ID, shard)
+		return false
+	}
+	go s.forward(shard, event)
+	return false
+}
+
+// forward publishes event to the instance owning shard
+func (s *Sharder) forward(shard int, event *nostr.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+
+	conn, err := s.conn(ctx, shard)
+	if err == nil {
+		err = conn.Publish(ctx, *event)
+	}
+	if err != nil {
+		atomic.AddInt64(&s.failed, 1)
+		logging.Warn("Shard: Failed to forward event %s to shard %d (%s): %v", event.ID, shard, s.cfg.Peers[shard], err)
+		return
+	}
+	atomic.AddInt64(&s.forwarded, 1)
+	logging.DebugMethod("shard", "forward", "Forwarded event %s to shard %d", event.ID, shard)
+}
+
+// conn returns an open connection to the instance owning shard, reconnecting if needed
+func (s *Sharder) conn(ctx context.Context, shard int) (*nostr.Relay, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.conns[shard]; ok && conn.IsConnected() {
+		return conn, nil
+	}
+	conn, err := nostr.RelayConnect(ctx, s.cfg.Peers[shard])
+	if err != nil {
+		return nil, err
+	}
+	s.conns[shard] = conn
+	return conn, nil
+}
+
+// Close closes the connections to the other instances
+func (s *Sharder) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for shard, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, shard)
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (s *Sharder) GetStatsName() string {
+	return "sharding"
+}
+
+// GetStats returns the shard assignment and counters as a JsonEntity
+func (s *Sharder) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("shard", json.NewJsonValue(s.cfg.Index))
+	obj.Set("shards", json.NewJsonValue(s.cfg.Count))
+	obj.Set("forwarding", json.NewJsonValue(len(s.cfg.Peers) > 0))
+	obj.Set("owned", json.NewJsonValue(atomic.LoadInt64(&s.owned)))
+	obj.Set("forwarded", json.NewJsonValue(atomic.LoadInt64(&s.forwarded)))
+	obj.Set("forward_failed", json.NewJsonValue(atomic.LoadInt64(&s.failed)))
+	obj.Set("dropped", json.NewJsonValue(atomic.LoadInt64(&s.dropped)))
+	return obj
+}
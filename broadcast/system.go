@@ -0,0 +1,73 @@
+package broadcast
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/bus"
+	"github.com/girino/nostr-brodcast-relay/broadcast/kindmatrix"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/broadcast/regions"
+	"github.com/girino/nostr-brodcast-relay/broadcast/testsink"
+	"github.com/girino/nostr-brodcast-relay/lifecycle"
+	"github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// System is the stable surface of the broadcast system used by the relay server and main.
+// It hides how the manager, health checker, discovery and broadcaster are wired together, so
+// those packages can change without touching their callers. *BroadcastSystem implements it.
+type System interface {
+	// Lifecycle
+	Start()
+	Stop()
+	MarkInitialized()
+
+	// Relay pool
+	DiscoverFromSeeds(ctx context.Context, seedRelays []string)
+	DiscoverFromFollows(ctx context.Context, seedRelays []string, pubkey string, maxRelays int) int
+	ImportRelays(ctx context.Context, source string, maxRelays int) (int, error)
+	AddMandatoryRelays(urls []string)
+	AddMandatoryRelay(url string, backfill time.Duration) (added bool, replaying int)
+	LedgerEnabled() bool
+	AddRelayIfNew(url string, source string)
+	EvictRelays(ctx context.Context) int
+	ExtractRelaysFromEvent(event *nostr.Event) []string
+	GetTopRelays() []*manager.RelayInfo
+	GetRelayCount() int
+	GetRelayStats(url string) (*json.JsonObject, bool)
+	EventOutcome(eventID string) (*json.JsonObject, bool)
+	KindMatrix(q kindmatrix.Query) (*json.JsonObject, bool)
+	ConsistencyReport() (*json.JsonObject, bool)
+	ResetRelayStats(url string) bool
+	ResetAllRelayStats() int
+	RecordProbe(agent, region string, results []regions.Measurement) (int, bool)
+	RecordCanary(ctx context.Context, url string, success bool, responseTime time.Duration) error
+	FederationHandler() http.Handler
+	Components() []lifecycle.Component
+
+	// Broadcasting
+	BroadcastEvent(event *nostr.Event)
+	BroadcastEventWithFanout(event *nostr.Event, topN int)
+	BroadcastBatch(batch []broadcaster.BatchEvent) int
+	IngestEvent(event *nostr.Event) bool
+	PlanBroadcast(event *nostr.Event) broadcaster.RelayPlan
+	IsEventCached(eventID string) bool
+	AddBroadcastReporter(reporter broadcaster.BroadcastReporter)
+	AddRelayFilter(filter broadcaster.RelayFilter)
+	Pause(reason string) bool
+	Resume() bool
+	PauseState() (bool, time.Time, string)
+
+	// Observability
+	SubscribeResults(buffer int) (<-chan bus.Event, func())
+	OnResult(fn func(bus.Event))
+	GetStats() json.JsonEntity
+	QueueDepth() int64
+	ResetCounters()
+	GetTestSink() *testsink.Sink
+}
+
+var _ System = (*BroadcastSystem)(nil)
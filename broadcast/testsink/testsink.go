@@ -0,0 +1,135 @@
+// Package testsink is an in-memory destination for TEST_MODE: instead of publishing to real
+// relays, the broadcaster records every frame it would have sent, so developers can run the
+// full relay locally and assert what would be broadcast where.
+package testsink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Entry is one publish the broadcaster attempted
+type Entry struct {
+	Relay      string
+	Event      nostr.Event
+	ReceivedAt time.Time
+}
+
+// Sink implements broadcaster.Publisher by recording publishes in memory; every publish succeeds
+type Sink struct {
+	mu         sync.RWMutex
+	entries    []Entry
+	maxEntries int
+	dropped    int64
+}
+
+// New returns a Sink keeping the most recent maxEntries publishes
+func New(maxEntries int) *Sink {
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	logging.DebugMethod("testsink", "New", "Initializing test sink with max %d entries", maxEntries)
+	return &Sink{maxEntries: maxEntries}
+}
+
+// Publish records the event frame as delivered to url
+func (s *Sink) Publish(ctx context.Context, url string, eventID string, frame []byte) error {
+	env, ok := nostr.ParseMessage(string(frame)).(*nostr.EventEnvelope)
+	if !ok {
+		return fmt.Errorf("msg: invalid: not an EVENT frame")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) >= s.maxEntries {
+		s.entries = s.entries[1:]
+		s.dropped++
+	}
+	s.entries = append(s.entries, Entry{Relay: url, Event: env.Event, ReceivedAt: time.Now()})
+	logging.DebugMethod("testsink", "Publish", "Recorded event %s for %s", eventID, url)
+	return nil
+}
+
+// Entries returns recorded publishes, oldest first; a non-empty eventID keeps only that event's
+func (s *Sink) Entries(eventID string) []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		if eventID == "" || e.Event.ID == eventID {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Reset clears all recorded publishes and returns how many were removed
+func (s *Sink) Reset() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := len(s.entries)
+	s.entries = nil
+	s.dropped = 0
+	return count
+}
+
+// EntriesJSON renders entries for the /api/testsink endpoint
+func EntriesJSON(entries []Entry) *json.JsonList {
+	list := json.NewJsonList()
+	for _, e := range entries {
+		tags := json.NewJsonList()
+		for _, tag := range e.Event.Tags {
+			tagList := json.NewJsonList()
+			for _, v := range tag {
+				tagList.Append(json.NewJsonValue(v))
+			}
+			tags.Append(tagList)
+		}
+
+		eventObj := json.NewJsonObject()
+		eventObj.Set("id", json.NewJsonValue(e.Event.ID))
+		eventObj.Set("pubkey", json.NewJsonValue(e.Event.PubKey))
+		eventObj.Set("created_at", json.NewJsonValue(int64(e.Event.CreatedAt)))
+		eventObj.Set("kind", json.NewJsonValue(e.Event.Kind))
+		eventObj.Set("tags", tags)
+		eventObj.Set("content", json.NewJsonValue(e.Event.Content))
+		eventObj.Set("sig", json.NewJsonValue(e.Event.Sig))
+
+		obj := json.NewJsonObject()
+		obj.Set("relay", json.NewJsonValue(e.Relay))
+		obj.Set("received_at", json.NewJsonValue(e.ReceivedAt.Format(time.RFC3339Nano)))
+		obj.Set("event", eventObj)
+		list.Append(obj)
+	}
+	return list
+}
+
+// GetStatsName returns the name for this stats provider
+func (s *Sink) GetStatsName() string {
+	return "testsink"
+}
+
+// GetStats returns test sink statistics as a JsonEntity
+func (s *Sink) GetStats() json.JsonEntity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	relays := make(map[string]bool)
+	for _, e := range s.entries {
+		relays[e.Relay] = true
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("recorded", json.NewJsonValue(len(s.entries)))
+	obj.Set("max_entries", json.NewJsonValue(s.maxEntries))
+	obj.Set("dropped", json.NewJsonValue(s.dropped))
+	obj.Set("relays", json.NewJsonValue(len(relays)))
+	return obj
+}
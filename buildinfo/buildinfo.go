@@ -0,0 +1,75 @@
+// Package buildinfo describes the running binary: the release version, git commit and build time
+// injected at build time with
+//
+//	go build -ldflags "-X github.com/girino/nostr-brodcast-relay/buildinfo.Version=v1.2.0 \
+//	  -X github.com/girino/nostr-brodcast-relay/buildinfo.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/girino/nostr-brodcast-relay/buildinfo.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them, Commit and BuildTime fall back to the VCS stamp the Go toolchain embeds when
+// building from a git checkout (the build time then being the commit time), so plain `go build`
+// binaries can still be told apart.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set with -ldflags "-X ..." (see the package comment)
+var (
+	Version   = "1.0.0"
+	Commit    = ""
+	BuildTime = "" // RFC 3339
+)
+
+// Info is the build information served at /api/version
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`   // built from a checkout with uncommitted changes
+	BuildTime string `json:"build_time,omitempty"` // RFC 3339
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build information
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// ShortVersion is Version plus the abbreviated commit, e.g. "1.2.0+3f2a9c1", for NIP-11
+func ShortVersion() string {
+	version := strings.TrimPrefix(Version, "v")
+	commit := Get().Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if commit == "" {
+		return version
+	}
+	return version + "+" + commit
+}
@@ -0,0 +1,330 @@
+// Package canary continuously verifies the broadcast pipeline end to end: every interval it signs
+// a synthetic ephemeral event with the relay key, injects it into the broadcast queue and checks
+// that it comes out the other side accepted by at least MinAccepted relays within Timeout. A
+// wedged queue, a stuck worker pool or an outbound path that silently stopped delivering all show
+// up as a failing canary, which degrades /readyz and fires an alert.
+package canary
+
+import (
+	"bytes"
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultKind is an ephemeral kind (NIP-01 20000-29999): relays forward but never store canaries
+const DefaultKind = 20888
+
+// Pipeline is where canaries are injected
+type Pipeline interface {
+	BroadcastEvent(event *nostr.Event)
+	PauseState() (bool, time.Time, string)
+}
+
+// ScoreRecorder scores relays on their canary answers, apart from organic publishes
+type ScoreRecorder interface {
+	RecordCanary(ctx context.Context, url string, success bool, responseTime time.Duration) error
+}
+
+// Config controls the canary
+type Config struct {
+	Interval    time.Duration // time between canaries (default 5m)
+	Timeout     time.Duration // how long a canary may take to be broadcast (default 1m)
+	MinAccepted int           // relays that must accept it (default 1)
+	Kind        int           // event kind (default DefaultKind)
+	Webhook     string        // optional URL receiving a JSON POST when the canary fails or recovers
+	Name        string        // relay name, included in alerts
+}
+
+// Result is the outcome of one canary
+type Result struct {
+	EventID  string
+	At       time.Time
+	OK       bool
+	Accepted int
+	Targets  int
+	Latency  time.Duration // from injection to the end of its broadcast
+	Reason   string        // why it failed
+}
+
+// Canary injects canaries and implements broadcaster.BroadcastReporter to see them come back
+type Canary struct {
+	cfg       Config
+	secretKey string
+	pipeline  Pipeline
+	client    *http.Client
+	scores    ScoreRecorder // nil unless SetScoreRecorder was called
+
+	mu       sync.Mutex
+	inflight map[string]chan broadcaster.BroadcastReport
+	last     *Result
+	healthy  bool // false after a failed canary until one succeeds
+	failing  int  // consecutive failures
+
+	sent    int64
+	passed  int64
+	failed  int64
+	skipped int64 // not sent while broadcasting was paused
+	alerts  int64
+}
+
+// New returns a Canary signing with secretKey (hex) and injecting into pipeline
+func New(cfg Config, secretKey string, pipeline Pipeline) *Canary {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Minute
+	}
+	if cfg.MinAccepted <= 0 {
+		cfg.MinAccepted = 1
+	}
+	if cfg.Kind <= 0 {
+		cfg.Kind = DefaultKind
+	}
+	logging.DebugMethod("canary", "New", "Initializing canary: interval=%v, timeout=%v, min accepted=%d, kind=%d, webhook=%v",
+		cfg.Interval, cfg.Timeout, cfg.MinAccepted, cfg.Kind, cfg.Webhook != "")
+	return &Canary{
+		cfg:       cfg,
+		secretKey: secretKey,
+		pipeline:  pipeline,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		inflight:  make(map[string]chan broadcaster.BroadcastReport),
+		healthy:   true,
+	}
+}
+
+// SetScoreRecorder feeds the per-relay outcome of every canary to scores
+func (c *Canary) SetScoreRecorder(scores ScoreRecorder) {
+	c.scores = scores
+}
+
+// BroadcastPlanned does nothing: the canary waits for the outcome
+func (c *Canary) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted hands the report of an in-flight canary to its waiter
+func (c *Canary) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	if report.Event == nil || report.Event.Kind != c.cfg.Kind {
+		return
+	}
+	c.mu.Lock()
+	done, ok := c.inflight[report.Event.ID]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case done <- report:
+		default:
+		}
+	}
+}
+
+// Run sends a canary every interval until ctx is canceled
+func (c *Canary) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Check(ctx)
+		}
+	}
+}
+
+// Check sends one canary and waits for its outcome. Nothing is sent while broadcasting is paused.
+func (c *Canary) Check(ctx context.Context) *Result {
+	if paused, _, _ := c.pipeline.PauseState(); paused {
+		atomic.AddInt64(&c.skipped, 1)
+		logging.DebugMethod("canary", "Check", "Broadcasting paused, skipping canary")
+		return nil
+	}
+
+	event := nostr.Event{
+		Kind:      c.cfg.Kind,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"t", "canary"}},
+		Content:   "broadcast pipeline canary",
+	}
+	if err := event.Sign(c.secretKey); err != nil {
+		logging.Error("Canary: Failed to sign canary: %v", err)
+		return nil
+	}
+
+	done := make(chan broadcaster.BroadcastReport, 1)
+	c.mu.Lock()
+	c.inflight[event.ID] = done
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, event.ID)
+		c.mu.Unlock()
+	}()
+
+	start := time.Now()
+	atomic.AddInt64(&c.sent, 1)
+	c.pipeline.BroadcastEvent(&event)
+
+	result := &Result{EventID: event.ID, At: start}
+	timer := time.NewTimer(c.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-timer.C:
+		result.Latency = time.Since(start)
+		result.Reason = fmt.Sprintf("not broadcast within %v (queue or workers stuck?)", c.cfg.Timeout)
+	case report := <-done:
+		result.Latency = time.Since(start)
+		result.Targets = len(report.Results)
+		for _, r := range report.Results {
+			if r.Success {
+				result.Accepted++
+			}
+		}
+		result.OK = result.Accepted >= c.cfg.MinAccepted
+		if !result.OK {
+			result.Reason = fmt.Sprintf("accepted by %d of %d relays, need %d", result.Accepted, result.Targets, c.cfg.MinAccepted)
+		}
+		c.score(ctx, report)
+	}
+	c.record(result)
+	return result
+}
+
+// score hands each relay's answer to the canary to the score recorder. Publishes that failed on
+// a local limit say nothing about the relay and are left out.
+func (c *Canary) score(ctx context.Context, report broadcaster.BroadcastReport) {
+	if c.scores == nil {
+		return
+	}
+	for _, r := range report.Results {
+		if !r.Success && r.Local() {
+			continue
+		}
+		if err := c.scores.RecordCanary(ctx, r.URL, r.Success, r.ResponseTime); err != nil {
+			logging.DebugMethod("canary", "score", "Failed to record canary result of %s: %v", r.URL, err)
+		}
+	}
+}
+
+// record stores result and alerts when the canary starts failing or recovers
+func (c *Canary) record(result *Result) {
+	c.mu.Lock()
+	wasHealthy := c.healthy
+	c.last = result
+	c.healthy = result.OK
+	if result.OK {
+		c.failing = 0
+	} else {
+		c.failing++
+	}
+	c.mu.Unlock()
+
+	if result.OK {
+		atomic.AddInt64(&c.passed, 1)
+		logging.DebugMethod("canary", "record", "Canary %s accepted by %d/%d relays in %v",
+			result.EventID, result.Accepted, result.Targets, result.Latency.Round(time.Millisecond))
+	} else {
+		atomic.AddInt64(&c.failed, 1)
+	}
+
+	switch {
+	case wasHealthy && !result.OK:
+		logging.Error("Canary: Broadcast pipeline check FAILED: %s", result.Reason)
+		go c.alert("failing", result)
+	case !wasHealthy && result.OK:
+		logging.Info("Canary: Broadcast pipeline recovered (accepted by %d/%d relays)", result.Accepted, result.Targets)
+		go c.alert("recovered", result)
+	case !result.OK:
+		logging.Warn("Canary: Broadcast pipeline check still failing: %s", result.Reason)
+	}
+}
+
+// alert posts a state change to the webhook, if one is configured
+func (c *Canary) alert(status string, result *Result) {
+	if c.cfg.Webhook == "" {
+		return
+	}
+	atomic.AddInt64(&c.alerts, 1)
+	body, err := stdjson.Marshal(map[string]any{
+		"relay":    c.cfg.Name,
+		"check":    "canary",
+		"status":   status,
+		"reason":   result.Reason,
+		"event_id": result.EventID,
+		"accepted": result.Accepted,
+		"targets":  result.Targets,
+		"at":       result.At.Unix(),
+	})
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Post(c.cfg.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logging.Warn("Canary: Alert webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logging.Warn("Canary: Alert webhook answered %s", resp.Status)
+	}
+}
+
+// Healthy reports whether the last canary passed (true before the first one), and why not
+func (c *Canary) Healthy() (bool, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.healthy || c.last == nil {
+		return true, ""
+	}
+	return false, c.last.Reason
+}
+
+// GetStatsName returns the name for this stats provider
+func (c *Canary) GetStatsName() string {
+	return "canary"
+}
+
+// GetStats returns canary counters and the last result as a JsonEntity
+func (c *Canary) GetStats() json.JsonEntity {
+	c.mu.Lock()
+	last := c.last
+	healthy := c.healthy
+	failing := c.failing
+	c.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("healthy", json.NewJsonValue(healthy))
+	obj.Set("interval_seconds", json.NewJsonValue(c.cfg.Interval.Seconds()))
+	obj.Set("min_accepted", json.NewJsonValue(c.cfg.MinAccepted))
+	obj.Set("sent", json.NewJsonValue(atomic.LoadInt64(&c.sent)))
+	obj.Set("passed", json.NewJsonValue(atomic.LoadInt64(&c.passed)))
+	obj.Set("failed", json.NewJsonValue(atomic.LoadInt64(&c.failed)))
+	obj.Set("skipped_paused", json.NewJsonValue(atomic.LoadInt64(&c.skipped)))
+	obj.Set("consecutive_failures", json.NewJsonValue(failing))
+	obj.Set("alerts", json.NewJsonValue(atomic.LoadInt64(&c.alerts)))
+	if last != nil {
+		lastObj := json.NewJsonObject()
+		lastObj.Set("event_id", json.NewJsonValue(last.EventID))
+		lastObj.Set("at", json.NewJsonValue(last.At.Unix()))
+		lastObj.Set("ok", json.NewJsonValue(last.OK))
+		lastObj.Set("accepted", json.NewJsonValue(last.Accepted))
+		lastObj.Set("targets", json.NewJsonValue(last.Targets))
+		lastObj.Set("latency_ms", json.NewJsonValue(last.Latency.Milliseconds()))
+		if last.Reason != "" {
+			lastObj.Set("reason", json.NewJsonValue(last.Reason))
+		}
+		obj.Set("last", lastObj)
+	}
+	return obj
+}
@@ -2,12 +2,15 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/girino/nostr-lib/logging"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
 // RateLimitConfig holds token-bucket parameters: tokens per interval, refill interval, max burst.
@@ -23,7 +26,15 @@ func (r *RateLimitConfig) Enabled() bool {
 	return r.Tokens > 0 && r.Interval > 0 && r.Max > 0
 }
 
+// KindTTL is a dedup cache TTL override for a kind range (inclusive)
+type KindTTL struct {
+	MinKind int
+	MaxKind int
+	TTL     time.Duration
+}
+
 type Config struct {
+	Profile             string // PROFILE bundle of defaults in use ("" = built-in defaults only)
 	SeedRelays          []string
 	MandatoryRelays     []string
 	TopNRelays          int
@@ -35,18 +46,205 @@ type Config struct {
 	WorkerCount         int
 	CacheTTL            time.Duration
 	Verbose             string
+	MaxStartupTime      time.Duration // 0 = no limit on initial discovery
+	TestMode            bool          // record publishes in memory (/api/testsink) instead of contacting relays
+	// Log file: the log goes to LogFile, rotated at LogMaxSize ("" = stderr only)
+	LogFile       string
+	LogMaxSize    int64
+	LogMaxBackups int
+	LogMaxAge     time.Duration
+	LogStderr     bool // also keep logging to stderr
+	// Outbound concurrency shared by publishes and health probes (0 disables); probes yield to publishes
+	OutboundConcurrency int
+	ProbeConcurrency    int
+	// Politeness: per-destination events-per-minute ceilings (0 = unlimited), per-URL overrides, queue size
+	RelayMaxPerMinute  int
+	RelayRateOverrides map[string]int
+	RelayThrottleQueue int
+	RateLimitedPause   time.Duration // publishes to a relay wait this long after it answered "rate-limited:"
+	// Ingest lanes: client events dispatched per pull/mirror event, and the ingest lane size
+	LiveLaneWeight  int
+	IngestQueueSize int
+	// Dedup cache policy: per-kind overrides of CacheTTL (first match wins), ephemeral kinds never cached
+	CacheKindTTLs         []KindTTL
+	CacheExcludeEphemeral bool
+	// Fast path: kinds skipping the dedup cache and queues, sent to the RealtimeRelays fastest top relays
+	RealtimeKinds  []int
+	RealtimeRelays int
+	RealtimeQueue  int
+	// Pause switch: start with outbound publishing paused; while paused, "queue" or "reject" new events
+	BroadcastPaused    bool
+	BroadcastPauseMode string
+	// Flap damping: outcome flips within FlapWindow that mark a relay flapping, and the healthy
+	// time it needs after recovering before re-entering the top N
+	FlapThreshold int
+	FlapWindow    time.Duration
+	FlapHoldDown  time.Duration
+	// Scoring: base score strategy (balanced, latency-first or reliability-first) and weights
+	// overriding the strategy's (negative = the strategy's)
+	ScoringStrategy     string
+	ScoreWeightSuccess  float64
+	ScoreWeightLatency  float64
+	ScoreWeightRecency  float64
+	ScoreWeightAttempts float64
+	// Coverage: score points taken off relays answering every publish "duplicate:" (0 = off)
+	CoveragePenalty float64
+	// Tie-breaking: relays within this many score points of the last top-N slot share it at random (0 = off)
+	TopTieMargin float64
+	// Late OKs: keep listening this long after a publish times out and correct its result (0 = off)
+	LateOKWindow time.Duration
+	// Refused kinds: relay/kind pairs rejected KindSchemaThreshold times in a row ("kind not
+	// allowed") are not sent for KindSchemaExpiry; the matrix persists in KindSchemaFile
+	KindSchema          bool
+	KindSchemaThreshold int
+	KindSchemaExpiry    time.Duration
+	KindSchemaFile      string
+	// Maintenance windows: daily 15-minute slots in which a relay failed on MaintenanceMinDays of
+	// the last MaintenanceHistoryDays days; its events are held then and replayed afterwards
+	MaintenanceWindows     bool
+	MaintenanceHistoryDays int
+	MaintenanceMinDays     int
+	MaintenanceFile        string
+	// Kind x relay success matrix at /api/matrix over this rolling window (0 = disabled)
+	KindMatrixWindow time.Duration
+	// Relay URLs taken from one event for discovery, best-formed first (0 = no cap)
+	MaxRelaysPerEvent int
+	// Score snapshots: relay scores and health history saved to ScoreSnapshotFile every
+	// ScoreSnapshotInterval and restored at startup unless older than ScoreSnapshotMaxAge
+	ScoreSnapshotFile     string
+	ScoreSnapshotInterval time.Duration
+	ScoreSnapshotMaxAge   time.Duration
+	// Shared key-value store replacing KindSchemaFile, MaintenanceFile and ScoreSnapshotFile
+	StateFile string
+	// Warm connections: pooled connections to the top and mandatory relays stay open, pinged and
+	// redialed every ConnectionKeepWarm (0 = connections close after 5m idle like any other)
+	ConnectionKeepWarm time.Duration
+	// Address family of relay connections: auto (Go's default), prefer-ipv6, prefer-ipv4 or
+	// happy-eyeballs (both raced, the first with a DialFallbackDelay head start)
+	DialMode          string
+	DialFallbackDelay time.Duration
+	// Tor: .onion relays are dialed through this SOCKS5 proxy (host:port); without one they are
+	// skipped entirely if SkipOnionRelays is set
+	TorProxy        string
+	SkipOnionRelays bool
+	// NIP-11 requirements: off, record or exclude relays demanding payment/auth/more PoW than an
+	// event has; allowed relays (and mandatory ones) are never excluded
+	RelayRequirements        string
+	RelayRequirementsRefresh time.Duration
+	RelayRequirementsAllow   []string
+	// NIP-11 consistency: score relays on how their behavior matches their NIP-11 claims, with a
+	// REQ probe every ConsistencyProbeInterval (0 = publishes only); ConsistencyPenalty score
+	// points are taken off a relay contradicting every claim (0 = report only)
+	ConsistencyCheck         bool
+	ConsistencyProbeInterval time.Duration
+	ConsistencyThreshold     float64
+	ConsistencyPenalty       float64
+	// Ledger of recently broadcast events, replayed to mandatory relays added at runtime (0 disables)
+	LedgerSize   int
+	LedgerMaxAge time.Duration
+	// Operator diversity: top-N relays allowed per NIP-11 operator (pubkey/contact), 0 = unlimited
+	MaxRelaysPerOperator int
+	// Total time all publishes of one event may take; per-relay timeouts shrink to fit (0 = none)
+	EventBroadcastDeadline time.Duration
+	// Publish retries: a publish failing transiently (timeout, dropped connection) is tried up to
+	// PublishMaxAttempts times, PublishRetryBaseDelay doubling up to PublishRetryMaxDelay in between
+	PublishMaxAttempts    int
+	PublishRetryBaseDelay time.Duration
+	PublishRetryMaxDelay  time.Duration
+	// Pipeline canary: a synthetic event every CanaryInterval must reach CanaryMinAccepted relays
+	// within CanaryTimeout, or /readyz turns degraded and CanaryWebhook is alerted (0 disables)
+	CanaryInterval    time.Duration
+	CanaryTimeout     time.Duration
+	CanaryMinAccepted int
+	CanaryWebhook     string
+	// Canary scoring: score points added to relays accepting every canary instantly (0 = off)
+	CanaryScoreWeight float64
+	// Crash reporting: URL receiving a JSON POST for recovered panics ("" = log only)
+	CrashWebhook string
+	// Greylist: IPs/pubkeys rejected GreylistThreshold times within GreylistWindow are refused for
+	// an escalating period (base x multiplier per repeat, up to max); 0 disables
+	GreylistThreshold    int
+	GreylistWindow       time.Duration
+	GreylistBaseDuration time.Duration
+	GreylistMultiplier   float64
+	GreylistMaxDuration  time.Duration
+	// IP reputation: clients whose IP is in IPBlocklistFile or listed by IPDNSBLThreshold of the
+	// IPDNSBLs are refused per IPReputationMode (block, publish, monitor); neither disables it
+	IPBlocklistFile      string
+	IPDNSBLs             []string
+	IPDNSBLThreshold     int
+	IPReputationMode     string
+	IPReputationCacheTTL time.Duration
+	IPDNSBLTimeout       time.Duration
+	// Federation: instances sharing one ingest point pull each other's gossip (relay scores) from
+	// FederationPeers every FederationInterval, split the relay set and hand each other their
+	// share of every event; no peers disables it
+	FederationNodeID   string
+	FederationPeers    []string
+	FederationSecret   string
+	FederationInterval time.Duration
+	// Fallback endpoints: relay URL -> alternates (other port, plain ws://, onion) tried when the
+	// relay cannot be reached, plus ws:// on the same host for wss:// relays failing at TLS level
+	RelayFallbacks  map[string][]string
+	FallbackPlainWS bool
+	// Community floor: share of the top N reserved for the best relays of a curated community list
+	// (small independent relays) with at least CommunityMinSuccessRate, whatever their score
+	CommunityRelays         []string
+	CommunityFloor          float64
+	CommunityMinSuccessRate float64
+	// Discovery sources (seed, relay_list, nip65, event_tag, import, manual): the sources whose
+	// relays may enter the top N (empty = all), and per source how long a relay may go without
+	// a successful publish before it is evicted if below RelayEvictMinSuccessRate
+	TopNSources              []string
+	RelayEvictSources        map[string]time.Duration
+	RelayEvictMinSuccessRate float64
+	// Adaptive worker pool: WORKER_COUNT is the starting size, adjusted between WorkerMin and
+	// WorkerMax (0 = 1 and 4x WORKER_COUNT) to keep the queue wait under WorkerTargetWait
+	WorkerAutoscale  bool
+	WorkerMin        int
+	WorkerMax        int
+	WorkerTargetWait time.Duration
+	// Overflow queue: cap on the approximate bytes of events waiting once the channel is full (0 = none)
+	MaxOverflowBytes int64
+	// Queue journal: events still queued at shutdown are saved here and queued again at startup ("" = lost)
+	QueueJournalFile string
+	// Sampled result logging: log 1 in ResultLogSample publish results of each outcome class (ok or
+	// a failure class), ResultLogRates overriding it per class; 0 = off
+	ResultLogSample int
+	ResultLogRates  map[string]int
+	// NIP-17 routing: gift wraps (kind 1059) go to their recipients' kind 10050 DM relays, looked
+	// up on DMLookupRelays (default: the seed relays); DMRelayFallback is top, mandatory or none
+	DMRouting       bool
+	DMLookupRelays  []string
+	DMRelayCacheTTL time.Duration
+	DMRelayFallback string
+	// NIP-65 outbox routing: events also go to up to OutboxMaxRelays write relays of their author's
+	// kind 10002 list, looked up on OutboxLookupRelays (default: the seed relays) and the top relays
+	OutboxRouting      bool
+	OutboxLookupRelays []string
+	OutboxMaxRelays    int
+	OutboxCacheTTL     time.Duration
+	// Latency SLIs: besides the first OK, the time until this many relays accepted an event
+	LatencyKthOK int
 	// Relay metadata
 	RelayName        string
 	RelayDescription string
 	RelayURL         string
 	ContactPubkey    string
-	RelayPrivkey     string
+	RelayPrivkey     string // hex; decoded from nsec, hex or NIP-49 ncryptsec at load
+	TargetAuth       bool   // authenticate (NIP-42, with RelayPrivkey) to relays requiring it
 	RelayIcon        string
+	TemplatesDir     string // main page templates; custom directories fall back to the shipped ones
 	RelayBanners     []string
+	RelayContacts    []string // extra operator contacts: npub/hex, email or URL
+	RelayCountries   []string // NIP-11 relay_countries (ISO 3166-1 alpha-2, "*" for global)
+	RelayLanguages   []string // NIP-11 language_tags (IETF, "*" for any)
+	RelayTags        []string // NIP-11 tags (e.g. "sfw-only", "bitcoin-only")
 	// Rate limiting (khatru policies): connection per IP, events per IP, filters (REQ) per IP
-	RateLimitConnection RateLimitConfig // e.g. 5 connections per 1m, burst 20
-	RateLimitEventIP    RateLimitConfig // e.g. 10 events per 1s per IP, burst 30
-	RateLimitFilterIP   RateLimitConfig // e.g. 20 REQ per 1m per IP, burst 100
+	RateLimitConnection  RateLimitConfig // e.g. 5 connections per 1m, burst 20
+	RateLimitEventIP     RateLimitConfig // e.g. 10 events per 1s per IP, burst 30
+	RateLimitEventPubkey RateLimitConfig // e.g. 10 events per 1m per author pubkey, burst 60
+	RateLimitFilterIP    RateLimitConfig // e.g. 20 REQ per 1m per IP, burst 100
 	// RateLimitBanBaseDuration: first ban after a forced close, and again after a clean probation. 0 disables banning.
 	RateLimitBanBaseDuration time.Duration
 	// RateLimitBanMaxDuration: cap for exponential bans (probation violation scales previous ban by Repeat multiplier up to this).
@@ -59,15 +257,128 @@ type Config struct {
 	RateLimitDisableDisconnect bool
 	// RateLimitLogFile: optional JSONL file path for detailed rate-limit audit logs.
 	RateLimitLogFile string
+	// Burst clamps: stricter per-IP/per-pubkey event limits while ingest runs at BurstFactor x its baseline (0 disables)
+	BurstFactor           float64
+	BurstBaseline         time.Duration
+	BurstMinRate          float64 // events/s
+	BurstCalm             time.Duration
+	BurstClampEventIP     RateLimitConfig
+	BurstClampEventPubkey RateLimitConfig
+	// Relay list import: one-shot pre-population from a curated list (URL and/or file) before seed discovery
+	RelayImportURL  string
+	RelayImportFile string
+	RelayImportMax  int  // 0 = import every listed relay
+	RelayImportOnly bool // skip seed discovery when the import added relays
+	// Per-event fan-out hints: ["fanout", "<level>"] tag from NIP-42-authenticated trusted pubkeys
+	FanoutTrustedPubkeys []string       // hex pubkeys (npub accepted in env); empty disables hints
+	FanoutLevels         map[string]int // level name -> relay-set size (top N)
+	// Follow-graph discovery (NIP-65): operator pubkey whose follows' write relays are added to the pool
+	DiscoveryFollowsPubkey    string
+	DiscoveryFollowsMaxRelays int
+	// Destination relay abuse feedback: off, record, relay, global
+	FeedbackPolicy          string
+	FeedbackThreshold       int
+	FeedbackGlobalThreshold int
+	FeedbackExpiry          time.Duration
+	// Session summaries: NOTICE publishing clients with their accepted/duplicate counts
+	SessionSummary         bool
+	SessionSummaryInterval time.Duration // 0 = only on disconnect
+	// Publish batching: accepted events of one connection reach the broadcast queue in batches of
+	// up to PublishBatchSize, at most PublishBatchDelay after the first (size <= 1 = off)
+	PublishBatchSize  int
+	PublishBatchDelay time.Duration
+	// Sharding: ShardCount instances split the events by ID, this one broadcasting shard
+	// ShardIndex; ShardPeers lists each shard's WebSocket URL to forward the others to
+	ShardCount int
+	ShardIndex int
+	ShardPeers []string
+	// Publisher restriction (NIP-42): clients must authenticate to publish; with an allowlist or an
+	// operator pubkey only those pubkeys (or the operator's follows) may
+	PublishAuthRequired   bool
+	PublishAllowedPubkeys []string // hex pubkeys (npub accepted in env)
+	PublishAllowFollowsOf string   // operator pubkey whose follow list (kind 3) may publish
+	PublishFollowsRefresh time.Duration
+	// MOTD is sent to each client as a NOTICE when it connects (empty = none; changeable at /admin/motd)
+	MOTD string
+	// AdminToken enables the /admin/ endpoints (Authorization: Bearer <token>); empty disables them
+	AdminToken string
+	// Named admin tokens by role (name -> token): readers only see state, operators can also
+	// change it; AdminToken is the operator token "admin". Mutating requests are audited by name.
+	AdminReaderTokens   map[string]string
+	AdminOperatorTokens map[string]string
+	AdminAuditLog       string // JSON-lines file of mutating admin requests (empty = process log only)
+	// Decision log: last verdict per event ID for /api/why/{id}, kept this long (0 = off)
+	DecisionRetention time.Duration
+	DecisionMaxEvents int
+	// Listener limits (khatru): 0 disables subscription/filter limits
+	MaxSubscriptions int
+	MaxFilterItems   int
+	MaxMessageSize   int64
+	// Event validation: per-kind structural checks before broadcasting (SkipKinds bypass their kind rule)
+	EventValidation          bool
+	EventValidationSkipKinds []int
+	// Pull mode: subscribe to upstream relays and broadcast what they send (disabled when PullRelays is empty)
+	PullRelays  []string
+	PullAuthors []string // hex pubkeys (npub accepted in env)
+	PullKinds   []int
+	// Mirror mode: follow these authors on their NIP-65 write relays (looked up on MirrorLookupRelays,
+	// default the seeds) and broadcast their events; MirrorOnly refuses events from clients
+	MirrorPubkeys      []string
+	MirrorKinds        []int
+	MirrorLookupRelays []string
+	MirrorRefresh      time.Duration
+	MirrorOnly         bool
+	// Regional selection: region -> relays, plus latency reports from remote probe agents (enabled by ProbeToken)
+	Regions         map[string][]string
+	RelaysPerRegion int
+	ProbeToken      string
+	ProbeMaxAge     time.Duration
+	// Broadcast receipts: relay-signed per-event delivery summaries
+	ReceiptsEnabled   bool
+	ReceiptKind       int
+	ReceiptRelays     []string
+	ReceiptStoreSize  int
+	ReceiptWriteAhead bool
+	// Daily self-report: NIP-23 long-form summary signed with the relay key (relays default to MandatoryRelays)
+	ReportEnabled bool
+	ReportTime    time.Duration // time of day (UTC) after midnight
+	ReportRelays  []string
+	// Own relay list: every RelayListInterval the top RelayListMax relays are published as the
+	// relay key's kind 10002 (and kind 3 content with RelayListContacts) when they changed
+	RelayListPublish  bool
+	RelayListInterval time.Duration
+	RelayListMax      int
+	RelayListContacts bool
+	// Media mirroring: hash-addressed blobs of these kinds are copied to Blossom/NIP-96 servers
+	MediaMirrorBlossom []string
+	MediaMirrorNIP96   []string
+	MediaMirrorKinds   []int
+	MediaMirrorMaxSize int64
+	MediaMirrorWorkers int
+	MediaMirrorPorts   []int // ports besides 80 and 443 blob downloads may connect to
+	// Event sampling: metadata of 1 in EventSampleRate broadcast events, for abuse forensics (0 disables)
+	EventSampleRate         int
+	EventSampleSize         int
+	EventSampleAuthorPrefix int // hex characters of the author pubkey kept
+	// Handshake audit: every outbound connection attempt as a JSON line in a rotated file ("" disables)
+	HandshakeLog          string
+	HandshakeLogMaxSize   int64
+	HandshakeLogFiles     int
+	HandshakeLogRetention time.Duration
+	// Events signed with the relay key that come back from clients or pull mode: skip, once or off
+	SelfEchoPolicy string
 }
 
 func Load() *Config {
+	profile := applyProfile(lookupEnv("PROFILE"))
+
 	workerCount := getEnvInt("WORKER_COUNT", 0)
 	if workerCount <= 0 {
 		workerCount = runtime.NumCPU() * 2
 	}
 
 	cfg := &Config{
+		Profile:             profile,
 		SeedRelays:          parseSeedRelays(getEnv("SEED_RELAYS", "ws://localhost:10547")),
 		MandatoryRelays:     parseSeedRelays(getEnv("MANDATORY_RELAYS", "")),
 		TopNRelays:          getEnvInt("TOP_N_RELAYS", 50),
@@ -79,24 +390,299 @@ func Load() *Config {
 		WorkerCount:         workerCount,
 		CacheTTL:            getEnvDuration("CACHE_TTL", 5*time.Minute),
 		Verbose:             getEnv("VERBOSE", ""),
+		MaxStartupTime:      getEnvDuration("MAX_STARTUP_TIME", 5*time.Minute),
+		TestMode:            getEnvBool("TEST_MODE", false),
+		// Log file
+		LogFile:       strings.TrimSpace(getEnv("LOG_FILE", "")),
+		LogMaxSize:    int64(getEnvInt("LOG_MAX_SIZE_MB", 100)) << 20,
+		LogMaxBackups: getEnvInt("LOG_MAX_BACKUPS", 5),
+		LogMaxAge:     getEnvDuration("LOG_MAX_AGE", 0),
+		LogStderr:     getEnvBool("LOG_STDERR", false),
+		// Outbound budget
+		OutboundConcurrency: getEnvInt("OUTBOUND_CONCURRENCY", 1000),
+		ProbeConcurrency:    getEnvInt("PROBE_CONCURRENCY", 20),
+		// Politeness
+		RelayMaxPerMinute:  getEnvInt("RELAY_MAX_EVENTS_PER_MINUTE", 0),
+		RelayRateOverrides: parseRelayRates(getEnv("RELAY_RATE_OVERRIDES", "")),
+		RelayThrottleQueue: getEnvInt("RELAY_THROTTLE_QUEUE", 1000),
+		RateLimitedPause:   getEnvDuration("RATE_LIMITED_PAUSE", time.Minute),
+		// Ingest lanes
+		LiveLaneWeight:  getEnvInt("LIVE_LANE_WEIGHT", 4),
+		IngestQueueSize: getEnvInt("INGEST_QUEUE_SIZE", 10000),
+		// Pause switch
+		BroadcastPaused:    getEnvBool("BROADCAST_PAUSED", false),
+		BroadcastPauseMode: parsePauseMode(getEnv("BROADCAST_PAUSE_MODE", "queue")),
+		// Flap damping
+		FlapThreshold: getEnvInt("FLAP_THRESHOLD", 4),
+		FlapWindow:    getEnvDuration("FLAP_WINDOW", 30*time.Minute),
+		FlapHoldDown:  getEnvDuration("FLAP_HOLD_DOWN", 10*time.Minute),
+		// Scoring
+		ScoringStrategy:     parseScoringStrategy(getEnv("SCORING_STRATEGY", "balanced")),
+		ScoreWeightSuccess:  getEnvFloat("SCORE_WEIGHT_SUCCESS", -1),
+		ScoreWeightLatency:  getEnvFloat("SCORE_WEIGHT_LATENCY", -1),
+		ScoreWeightRecency:  getEnvFloat("SCORE_WEIGHT_RECENCY", -1),
+		ScoreWeightAttempts: getEnvFloat("SCORE_WEIGHT_ATTEMPTS", -1),
+		// Coverage
+		CoveragePenalty: getEnvFloat("COVERAGE_PENALTY", 0),
+		// Tie-breaking
+		TopTieMargin: getEnvFloat("TOP_TIE_MARGIN", 0),
+		// Late OKs
+		LateOKWindow: getEnvDuration("LATE_OK_WINDOW", 2*time.Minute),
+		// Refused kinds
+		KindSchema:          getEnvBool("KIND_SCHEMA", true),
+		KindSchemaThreshold: getEnvInt("KIND_SCHEMA_THRESHOLD", 3),
+		KindSchemaExpiry:    getEnvDuration("KIND_SCHEMA_EXPIRY", 7*24*time.Hour),
+		KindSchemaFile:      strings.TrimSpace(getEnv("KIND_SCHEMA_FILE", "")),
+
+		MaintenanceWindows:     getEnvBool("MAINTENANCE_WINDOWS", true),
+		MaintenanceHistoryDays: getEnvInt("MAINTENANCE_HISTORY_DAYS", 7),
+		MaintenanceMinDays:     getEnvInt("MAINTENANCE_MIN_DAYS", 3),
+		MaintenanceFile:        strings.TrimSpace(getEnv("MAINTENANCE_FILE", "")),
+		// Kind success matrix
+		KindMatrixWindow: getEnvDuration("KIND_MATRIX_WINDOW", 24*time.Hour),
+		// Discovery cap per event
+		MaxRelaysPerEvent: getEnvInt("MAX_RELAYS_PER_EVENT", 20),
+		// Score snapshots
+		ScoreSnapshotFile:     strings.TrimSpace(getEnv("SCORE_SNAPSHOT_FILE", "")),
+		ScoreSnapshotInterval: getEnvDuration("SCORE_SNAPSHOT_INTERVAL", 5*time.Minute),
+		ScoreSnapshotMaxAge:   getEnvDuration("SCORE_SNAPSHOT_MAX_AGE", 7*24*time.Hour),
+
+		StateFile: strings.TrimSpace(getEnv("STATE_FILE", "")),
+		// Warm connections
+		ConnectionKeepWarm: getEnvDuration("CONNECTION_KEEP_WARM", 30*time.Second),
+		DialMode:           parseDialMode(getEnv("DIAL_MODE", "auto")),
+		DialFallbackDelay:  getEnvDuration("DIAL_FALLBACK_DELAY", 250*time.Millisecond),
+		TorProxy:           getEnv("TOR_PROXY", ""),
+		SkipOnionRelays:    getEnvBool("SKIP_ONION_RELAYS", true),
+		// NIP-11 requirements
+		RelayRequirements:        parseRequirementsPolicy(getEnv("RELAY_REQUIREMENTS", "exclude")),
+		RelayRequirementsRefresh: getEnvDuration("RELAY_REQUIREMENTS_REFRESH", 24*time.Hour),
+		RelayRequirementsAllow:   parseSeedRelays(getEnv("RELAY_REQUIREMENTS_ALLOW", "")),
+		// NIP-11 consistency
+		ConsistencyCheck:         getEnvBool("CONSISTENCY_CHECK", false),
+		ConsistencyProbeInterval: getEnvDuration("CONSISTENCY_PROBE_INTERVAL", 30*time.Minute),
+		ConsistencyThreshold:     getEnvFloat("CONSISTENCY_THRESHOLD", 0.8),
+		ConsistencyPenalty:       getEnvFloat("CONSISTENCY_PENALTY", 0),
+		// Recent event ledger
+		LedgerSize:   getEnvInt("LEDGER_SIZE", 10000),
+		LedgerMaxAge: getEnvDuration("LEDGER_MAX_AGE", 24*time.Hour),
+		// Operator diversity
+		MaxRelaysPerOperator: getEnvInt("MAX_RELAYS_PER_OPERATOR", 3),
+		// Per-event deadline
+		EventBroadcastDeadline: getEnvDuration("EVENT_BROADCAST_DEADLINE", 30*time.Second),
+		// Publish retries
+		PublishMaxAttempts:    getEnvInt("PUBLISH_MAX_ATTEMPTS", 3),
+		PublishRetryBaseDelay: getEnvDuration("PUBLISH_RETRY_BASE_DELAY", time.Second),
+		PublishRetryMaxDelay:  getEnvDuration("PUBLISH_RETRY_MAX_DELAY", 30*time.Second),
+		// Pipeline canary
+		CanaryInterval:    getEnvDuration("CANARY_INTERVAL", 5*time.Minute),
+		CanaryTimeout:     getEnvDuration("CANARY_TIMEOUT", time.Minute),
+		CanaryMinAccepted: getEnvInt("CANARY_MIN_ACCEPTED", 2),
+		CanaryWebhook:     getEnv("CANARY_WEBHOOK", ""),
+		CanaryScoreWeight: getEnvFloat("CANARY_SCORE_WEIGHT", 0),
+		// Crash reporting
+		CrashWebhook: getEnv("CRASH_WEBHOOK", ""),
+		// Greylist
+		GreylistThreshold:    getEnvInt("GREYLIST_THRESHOLD", 20),
+		GreylistWindow:       getEnvDuration("GREYLIST_WINDOW", 10*time.Minute),
+		GreylistBaseDuration: getEnvDuration("GREYLIST_BASE_DURATION", 5*time.Minute),
+		GreylistMultiplier:   getEnvFloat("GREYLIST_MULTIPLIER", 2),
+		GreylistMaxDuration:  getEnvDuration("GREYLIST_MAX_DURATION", 24*time.Hour),
+		// IP reputation
+		IPBlocklistFile:      getEnv("IP_BLOCKLIST_FILE", ""),
+		IPDNSBLs:             parseSeedRelays(getEnv("IP_DNSBLS", "")),
+		IPDNSBLThreshold:     getEnvInt("IP_DNSBL_THRESHOLD", 1),
+		IPReputationMode:     parseReputationMode(getEnv("IP_REPUTATION_MODE", "block")),
+		IPReputationCacheTTL: getEnvDuration("IP_REPUTATION_CACHE_TTL", time.Hour),
+		IPDNSBLTimeout:       getEnvDuration("IP_DNSBL_TIMEOUT", 2*time.Second),
+		// Federation
+		FederationPeers:    parseServerList(getEnv("FEDERATION_PEERS", "")),
+		FederationSecret:   strings.TrimSpace(getEnv("FEDERATION_SECRET", "")),
+		FederationInterval: getEnvDuration("FEDERATION_INTERVAL", 30*time.Second),
+		// Fallback endpoints
+		RelayFallbacks:  parseRelayFallbacks(getEnv("RELAY_FALLBACKS", "")),
+		FallbackPlainWS: getEnvBool("FALLBACK_PLAIN_WS", false),
+		// Community floor
+		CommunityRelays:         parseSeedRelays(getEnv("COMMUNITY_RELAYS", "")),
+		CommunityFloor:          getEnvFloat("COMMUNITY_FLOOR", 0.2),
+		CommunityMinSuccessRate: getEnvFloat("COMMUNITY_MIN_SUCCESS_RATE", 0.5),
+		// Discovery sources
+		TopNSources:              parseSeedRelays(getEnv("TOP_N_SOURCES", "")),
+		RelayEvictSources:        parseSourceDurations(getEnv("RELAY_EVICT_SOURCES", "")),
+		RelayEvictMinSuccessRate: getEnvFloat("RELAY_EVICT_MIN_SUCCESS_RATE", 0.5),
+		// Adaptive worker pool
+		WorkerAutoscale:  getEnvBool("WORKER_AUTOSCALE", false),
+		WorkerMin:        getEnvInt("WORKER_MIN", 0),
+		WorkerMax:        getEnvInt("WORKER_MAX", 0),
+		WorkerTargetWait: getEnvDuration("WORKER_TARGET_QUEUE_WAIT", time.Second),
+		// Overflow queue
+		MaxOverflowBytes: int64(getEnvInt("MAX_OVERFLOW_BYTES", 0)),
+		QueueJournalFile: strings.TrimSpace(getEnv("QUEUE_JOURNAL_FILE", "")),
+		// Sampled result logging
+		ResultLogSample: getEnvInt("RESULT_LOG_SAMPLE", 0),
+		ResultLogRates:  parseClassRates(getEnv("RESULT_LOG_RATES", "")),
+		// NIP-17 routing
+		DMRouting:       getEnvBool("DM_ROUTING", true),
+		DMLookupRelays:  parseSeedRelays(getEnv("DM_LOOKUP_RELAYS", "")),
+		DMRelayCacheTTL: getEnvDuration("DM_RELAY_CACHE_TTL", 6*time.Hour),
+		DMRelayFallback: parseDMRelayFallback(getEnv("DM_RELAY_FALLBACK", "top")),
+
+		OutboxRouting:      getEnvBool("OUTBOX_ROUTING", false),
+		OutboxLookupRelays: parseSeedRelays(getEnv("OUTBOX_LOOKUP_RELAYS", "")),
+		OutboxMaxRelays:    getEnvInt("OUTBOX_MAX_RELAYS", 5),
+		OutboxCacheTTL:     getEnvDuration("OUTBOX_CACHE_TTL", 6*time.Hour),
+		// Latency SLIs
+		LatencyKthOK: getEnvInt("LATENCY_KTH_OK", 3),
+		// Dedup cache policy
+		CacheKindTTLs:         parseKindTTLs(getEnv("CACHE_TTL_KINDS", "")),
+		CacheExcludeEphemeral: getEnvBool("CACHE_EXCLUDE_EPHEMERAL", false),
+		// Fast path
+		RealtimeKinds:  parseIntList(getEnv("REALTIME_KINDS", "")),
+		RealtimeRelays: getEnvInt("REALTIME_RELAYS", 5),
+		RealtimeQueue:  getEnvInt("REALTIME_QUEUE", 1000),
 		// Relay metadata
 		RelayName:        getEnv("RELAY_NAME", "Broadcast Relay"),
 		RelayDescription: getEnv("RELAY_DESCRIPTION", "A Nostr relay that broadcasts events to multiple relays"),
 		RelayURL:         getEnv("RELAY_URL", ""),
 		ContactPubkey:    getEnv("CONTACT_PUBKEY", ""),
-		RelayPrivkey:     getEnv("RELAY_PRIVKEY", ""),
+		RelayPrivkey:     loadRelayPrivkey(),
+		TargetAuth:       getEnvBool("TARGET_AUTH", true),
 		RelayIcon:        getEnv("RELAY_ICON", "/static/icon1.png"),
+		TemplatesDir:     getEnv("TEMPLATES_DIR", "templates"),
 		RelayBanners:     parseBannerList(getEnv("RELAY_BANNERS", "")),
+		RelayContacts:    parseSeedRelays(getEnv("RELAY_CONTACTS", "")),
+		RelayCountries:   parseSeedRelays(strings.ToUpper(getEnv("RELAY_COUNTRIES", ""))),
+		RelayLanguages:   parseSeedRelays(getEnv("RELAY_LANGUAGE_TAGS", "")),
+		RelayTags:        parseSeedRelays(getEnv("RELAY_TAGS", "")),
 		// Rate limits: enabled by default, matching khatru policies.ApplySaneDefaults. Format "tokens,interval,max". Use "0,0,0" or "off" to disable.
-		RateLimitConnection: parseRateLimitWithDefault(getEnv("RATE_LIMIT_CONNECTION", "1,5m,100"), "1,5m,100"),   // 1 connection per 5m per IP, burst 100
-		RateLimitEventIP:    parseRateLimitWithDefault(getEnv("RATE_LIMIT_EVENT_IP", "2,3m,10"), "2,3m,10"),     // 2 events per 3m per IP, burst 10
-		RateLimitFilterIP: parseRateLimitWithDefault(getEnv("RATE_LIMIT_FILTER_IP", "20,1m,100"), "20,1m,100"), // 20 REQ per 1m per IP, burst 100
-		RateLimitBanBaseDuration: loadRateLimitBanBase(),
-		RateLimitBanMaxDuration:  getEnvDuration("RATE_LIMIT_BAN_MAX", 24*time.Hour),
+		RateLimitConnection:             parseRateLimitWithDefault(getEnv("RATE_LIMIT_CONNECTION", "1,5m,100"), "1,5m,100"),   // 1 connection per 5m per IP, burst 100
+		RateLimitEventIP:                parseRateLimitWithDefault(getEnv("RATE_LIMIT_EVENT_IP", "2,3m,10"), "2,3m,10"),       // 2 events per 3m per IP, burst 10
+		RateLimitEventPubkey:            parseRateLimitWithDefault(getEnv("RATE_LIMIT_EVENT_PUBKEY", "10,1m,60"), "10,1m,60"), // 10 events per 1m per pubkey, burst 60
+		RateLimitFilterIP:               parseRateLimitWithDefault(getEnv("RATE_LIMIT_FILTER_IP", "20,1m,100"), "20,1m,100"),  // 20 REQ per 1m per IP, burst 100
+		RateLimitBanBaseDuration:        loadRateLimitBanBase(),
+		RateLimitBanMaxDuration:         getEnvDuration("RATE_LIMIT_BAN_MAX", 24*time.Hour),
 		RateLimitBanProbationMultiplier: getEnvFloat("RATE_LIMIT_BAN_PROBATION_MULTIPLIER", 1),
 		RateLimitBanRepeatMultiplier:    getEnvFloat("RATE_LIMIT_BAN_REPEAT_MULTIPLIER", 2),
 		RateLimitDisableDisconnect:      getEnvBool("RATE_LIMIT_DISABLE_DISCONNECT", false),
 		RateLimitLogFile:                strings.TrimSpace(getEnv("RATE_LIMIT_LOG_FILE", "")),
+		// Burst clamps
+		BurstFactor:           getEnvFloat("BURST_FACTOR", 10),
+		BurstBaseline:         getEnvDuration("BURST_BASELINE", time.Hour),
+		BurstMinRate:          getEnvFloat("BURST_MIN_RATE", 5),
+		BurstCalm:             getEnvDuration("BURST_CALM", 2*time.Minute),
+		BurstClampEventIP:     parseRateLimitWithDefault(getEnv("BURST_CLAMP_EVENT_IP", "1,5m,3"), "1,5m,3"),
+		BurstClampEventPubkey: parseRateLimitWithDefault(getEnv("BURST_CLAMP_EVENT_PUBKEY", "1,5m,3"), "1,5m,3"),
+		// Relay list import
+		RelayImportURL:  strings.TrimSpace(getEnv("RELAY_IMPORT_URL", "")),
+		RelayImportFile: strings.TrimSpace(getEnv("RELAY_IMPORT_FILE", "")),
+		RelayImportMax:  getEnvInt("RELAY_IMPORT_MAX", 0),
+		RelayImportOnly: getEnvBool("RELAY_IMPORT_ONLY", false),
+		// Per-event fan-out hints
+		FanoutTrustedPubkeys: parsePubkeyList(getEnv("FANOUT_TRUSTED_PUBKEYS", "")),
+		FanoutLevels:         parseFanoutLevels(getEnv("FANOUT_LEVELS", "narrow=10,wide=200")),
+		// Follow-graph discovery
+		DiscoveryFollowsPubkey:    parseSinglePubkey(getEnv("DISCOVERY_FOLLOWS_PUBKEY", "")),
+		DiscoveryFollowsMaxRelays: getEnvInt("DISCOVERY_FOLLOWS_MAX_RELAYS", 100),
+		// Destination relay abuse feedback
+		FeedbackPolicy:          strings.ToLower(strings.TrimSpace(getEnv("FEEDBACK_POLICY", "record"))),
+		FeedbackThreshold:       getEnvInt("FEEDBACK_THRESHOLD", 3),
+		FeedbackGlobalThreshold: getEnvInt("FEEDBACK_GLOBAL_THRESHOLD", 3),
+		FeedbackExpiry:          getEnvDuration("FEEDBACK_EXPIRY", 24*time.Hour),
+		// Session summaries
+		SessionSummary:         getEnvBool("SESSION_SUMMARY", false),
+		SessionSummaryInterval: getEnvDuration("SESSION_SUMMARY_INTERVAL", 0),
+		// Publish batching
+		PublishBatchSize:  getEnvInt("PUBLISH_BATCH_SIZE", 0),
+		PublishBatchDelay: getEnvDuration("PUBLISH_BATCH_DELAY", 25*time.Millisecond),
+		// Sharding
+		ShardCount: getEnvInt("SHARD_COUNT", 0),
+		ShardIndex: getEnvInt("SHARD_INDEX", 0),
+		ShardPeers: parseSeedRelays(getEnv("SHARD_PEERS", "")),
+		// Publisher restriction
+		PublishAuthRequired:   getEnvBool("PUBLISH_AUTH_REQUIRED", false),
+		PublishAllowedPubkeys: parsePubkeyList(getEnv("PUBLISH_ALLOWED_PUBKEYS", "")),
+		PublishAllowFollowsOf: parseSinglePubkey(getEnv("PUBLISH_ALLOW_FOLLOWS_OF", "")),
+		PublishFollowsRefresh: getEnvDuration("PUBLISH_FOLLOWS_REFRESH", time.Hour),
+		// Operator notices
+		MOTD: getEnv("MOTD", ""),
+		// Admin API
+		AdminToken:          strings.TrimSpace(getEnv("ADMIN_TOKEN", "")),
+		AdminReaderTokens:   parseNamedTokens(getEnv("ADMIN_READER_TOKENS", "")),
+		AdminOperatorTokens: parseNamedTokens(getEnv("ADMIN_OPERATOR_TOKENS", "")),
+		AdminAuditLog:       strings.TrimSpace(getEnv("ADMIN_AUDIT_LOG", "")),
+		// Decision log
+		DecisionRetention: getEnvDuration("DECISION_RETENTION", time.Hour),
+		DecisionMaxEvents: getEnvInt("DECISION_MAX_EVENTS", 50000),
+		// Listener limits
+		MaxSubscriptions: getEnvInt("MAX_SUBSCRIPTIONS", 20),
+		MaxFilterItems:   getEnvInt("MAX_FILTER_ITEMS", 500),
+		MaxMessageSize:   int64(getEnvInt("MAX_MESSAGE_SIZE", 512000)),
+		// Event validation
+		EventValidation:          getEnvBool("EVENT_VALIDATION", true),
+		EventValidationSkipKinds: parseIntList(getEnv("EVENT_VALIDATION_SKIP_KINDS", "")),
+		// Pull mode
+		PullRelays:  parseSeedRelays(getEnv("PULL_RELAYS", "")),
+		PullAuthors: parsePubkeyList(getEnv("PULL_AUTHORS", "")),
+		PullKinds:   parseIntList(getEnv("PULL_KINDS", "")),
+		// Mirror mode
+		MirrorPubkeys:      parsePubkeyList(getEnv("MIRROR_PUBKEYS", "")),
+		MirrorKinds:        parseIntList(getEnv("MIRROR_KINDS", "")),
+		MirrorLookupRelays: parseSeedRelays(getEnv("MIRROR_LOOKUP_RELAYS", "")),
+		MirrorRefresh:      getEnvDuration("MIRROR_REFRESH", 6*time.Hour),
+		MirrorOnly:         getEnvBool("MIRROR_ONLY", false),
+		// Regional selection
+		Regions:         parseRegions(getEnv("RELAY_REGIONS", "")),
+		RelaysPerRegion: getEnvInt("RELAYS_PER_REGION", 3),
+		ProbeToken:      strings.TrimSpace(getEnv("PROBE_TOKEN", "")),
+		ProbeMaxAge:     getEnvDuration("PROBE_MAX_AGE", time.Hour),
+		// Broadcast receipts
+		ReceiptsEnabled:   getEnvBool("RECEIPTS_ENABLED", false),
+		ReceiptKind:       getEnvInt("RECEIPT_KIND", 30078),
+		ReceiptRelays:     parseSeedRelays(getEnv("RECEIPT_RELAYS", "")),
+		ReceiptStoreSize:  getEnvInt("RECEIPT_STORE_SIZE", 1000),
+		ReceiptWriteAhead: getEnvBool("RECEIPT_WRITE_AHEAD", true),
+		// Daily self-report
+		ReportEnabled: getEnvBool("REPORT_ENABLED", false),
+		ReportTime:    parseTimeOfDay(getEnv("REPORT_TIME", "00:00")),
+		ReportRelays:  parseSeedRelays(getEnv("REPORT_RELAYS", "")),
+		// Own relay list
+		RelayListPublish:  getEnvBool("RELAY_LIST_PUBLISH", false),
+		RelayListInterval: getEnvDuration("RELAY_LIST_INTERVAL", 6*time.Hour),
+		RelayListMax:      getEnvInt("RELAY_LIST_MAX", 20),
+		RelayListContacts: getEnvBool("RELAY_LIST_CONTACTS", false),
+		// Media mirroring
+		MediaMirrorBlossom: parseServerList(getEnv("MEDIA_MIRROR_BLOSSOM", "")),
+		MediaMirrorNIP96:   parseServerList(getEnv("MEDIA_MIRROR_NIP96", "")),
+		MediaMirrorKinds:   parseIntList(getEnv("MEDIA_MIRROR_KINDS", "1,20,21,22,1063")),
+		MediaMirrorMaxSize: int64(getEnvInt("MEDIA_MIRROR_MAX_SIZE_MB", 50)) << 20,
+		MediaMirrorWorkers: getEnvInt("MEDIA_MIRROR_WORKERS", 2),
+		MediaMirrorPorts:   parseIntList(getEnv("MEDIA_MIRROR_ALLOWED_PORTS", "")),
+		// Event sampling
+		EventSampleRate:         getEnvInt("EVENT_SAMPLE_RATE", 0),
+		EventSampleSize:         getEnvInt("EVENT_SAMPLE_SIZE", 10000),
+		EventSampleAuthorPrefix: getEnvInt("EVENT_SAMPLE_AUTHOR_PREFIX", 8),
+		// Handshake audit
+		HandshakeLog:          getEnv("HANDSHAKE_LOG", ""),
+		HandshakeLogMaxSize:   int64(getEnvInt("HANDSHAKE_LOG_MAX_SIZE_MB", 10)) << 20,
+		HandshakeLogFiles:     getEnvInt("HANDSHAKE_LOG_FILES", 5),
+		HandshakeLogRetention: getEnvDuration("HANDSHAKE_LOG_RETENTION", 30*24*time.Hour),
+		// Self-echo suppression
+		SelfEchoPolicy: parseSelfEchoPolicy(getEnv("SELF_ECHO_POLICY", "skip")),
+	}
+
+	// Federation members need distinct IDs; the host name and port are unique per instance
+	cfg.FederationNodeID = strings.TrimSpace(getEnv("FEDERATION_NODE_ID", ""))
+	if cfg.FederationNodeID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		cfg.FederationNodeID = host + ":" + cfg.RelayPort
+	}
+
+	// Reports go to the mandatory relays unless dedicated report relays are configured
+	if len(cfg.ReportRelays) == 0 {
+		cfg.ReportRelays = cfg.MandatoryRelays
 	}
 
 	logging.DebugMethod("config", "Load", "Loaded configuration: SeedRelays=%d, MandatoryRelays=%d, TopN=%d, Port=%s, Workers=%d",
@@ -105,15 +691,53 @@ func Load() *Config {
 	return cfg
 }
 
-func getEnv(key, defaultValue string) string {
+// lookupEnv returns the value of setting key from, in order: the environment variable itself,
+// the file named by KEY_FILE (environment variables in the path are expanded, e.g.
+// ${CREDENTIALS_DIRECTORY}/privkey), or the file KEY (or key) in SECRETS_DIR (e.g. /run/secrets).
+// File contents are trimmed of surrounding whitespace. Settings found nowhere fall back to the
+// active PROFILE's defaults, and "" is returned when the profile does not set them either.
+func lookupEnv(key string) string {
 	if value := os.Getenv(key); value != "" {
+		if os.Getenv(key+"_FILE") != "" {
+			logging.Warn("Config: both %s and %s_FILE are set, using %s", key, key, key)
+		}
+		return value
+	}
+	if path := os.ExpandEnv(os.Getenv(key + "_FILE")); path != "" {
+		if value, ok := readSecretFile(path); ok {
+			logging.DebugMethod("config", "lookupEnv", "Read %s from %s_FILE", key, key)
+			return value
+		}
+		logging.Warn("Config: cannot read %s_FILE %q, ignoring it", key, path)
+	}
+	if dir := os.ExpandEnv(os.Getenv("SECRETS_DIR")); dir != "" {
+		for _, name := range []string{key, strings.ToLower(key)} {
+			if value, ok := readSecretFile(filepath.Join(dir, name)); ok {
+				logging.DebugMethod("config", "lookupEnv", "Read %s from %s", key, filepath.Join(dir, name))
+				return value
+			}
+		}
+	}
+	return profileDefaults[key]
+}
+
+func readSecretFile(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := lookupEnv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
 
 func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		if intVal, err := strconv.Atoi(value); err == nil {
 			return intVal
 		}
@@ -122,7 +746,7 @@ func getEnvInt(key string, defaultValue int) int {
 }
 
 func getEnvFloat(key string, defaultValue float64) float64 {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
 			return floatVal
 		}
@@ -131,7 +755,7 @@ func getEnvFloat(key string, defaultValue float64) float64 {
 }
 
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
 			return duration
 		}
@@ -140,7 +764,7 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 }
 
 func getEnvBool(key string, defaultValue bool) bool {
-	if value := strings.TrimSpace(strings.ToLower(os.Getenv(key))); value != "" {
+	if value := strings.TrimSpace(strings.ToLower(lookupEnv(key))); value != "" {
 		switch value {
 		case "1", "true", "yes", "on":
 			return true
@@ -180,6 +804,21 @@ func parseSeedRelays(seedStr string) []string {
 	return result
 }
 
+// parseServerList parses comma-separated http(s) base URLs, dropping trailing slashes and
+// anything that is not http(s)
+func parseServerList(s string) []string {
+	servers := []string{}
+	for _, server := range parseSeedRelays(s) {
+		server = strings.TrimRight(server, "/")
+		if !strings.HasPrefix(server, "https://") && !strings.HasPrefix(server, "http://") {
+			logging.Warn("Config: Ignoring media server %q: not an http(s) URL", server)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
 // parseRateLimit parses "tokens,interval,max" e.g. "5,1m,20". Returns zeroed config on parse error.
 func parseRateLimit(s string) RateLimitConfig {
 	s = strings.TrimSpace(s)
@@ -212,6 +851,282 @@ func parseRateLimitWithDefault(envValue, defaultStr string) RateLimitConfig {
 	return parseRateLimit(defaultStr)
 }
 
+// parsePubkeyList parses a comma-separated list of npub or hex pubkeys into hex. Invalid entries are skipped.
+func parsePubkeyList(s string) []string {
+	result := []string{}
+	for _, item := range parseSeedRelays(s) {
+		if strings.HasPrefix(item, "npub1") {
+			if _, decoded, err := nip19.Decode(item); err == nil {
+				if pk, ok := decoded.(string); ok {
+					result = append(result, pk)
+					continue
+				}
+			}
+		} else if nostr.IsValidPublicKey(item) {
+			result = append(result, item)
+			continue
+		}
+		logging.Warn("Config: ignoring invalid pubkey %q", item)
+	}
+	return result
+}
+
+// parseSinglePubkey parses one npub or hex pubkey into hex, or returns "" if empty/invalid
+func parseSinglePubkey(s string) string {
+	if pks := parsePubkeyList(s); len(pks) > 0 {
+		return pks[0]
+	}
+	return ""
+}
+
+// parsePauseMode accepts "queue" or "reject"; anything else falls back to "queue"
+func parsePauseMode(s string) string {
+	mode := strings.ToLower(strings.TrimSpace(s))
+	if mode != "queue" && mode != "reject" {
+		logging.Warn("Config: invalid BROADCAST_PAUSE_MODE %q, using queue", s)
+		return "queue"
+	}
+	return mode
+}
+
+// parseDMRelayFallback validates DM_RELAY_FALLBACK (top, mandatory or none), defaulting to top
+func parseDMRelayFallback(s string) string {
+	fallback := strings.ToLower(strings.TrimSpace(s))
+	if fallback != "top" && fallback != "mandatory" && fallback != "none" {
+		logging.Warn("Config: invalid DM_RELAY_FALLBACK %q, using top", s)
+		return "top"
+	}
+	return fallback
+}
+
+// parseReputationMode validates IP_REPUTATION_MODE (block, publish, monitor), defaulting to block
+func parseReputationMode(s string) string {
+	mode := strings.ToLower(strings.TrimSpace(s))
+	if mode != "block" && mode != "publish" && mode != "monitor" {
+		logging.Warn("Config: invalid IP_REPUTATION_MODE %q, using block", s)
+		return "block"
+	}
+	return mode
+}
+
+// parseDialMode validates DIAL_MODE (auto, prefer-ipv6, prefer-ipv4, happy-eyeballs)
+func parseDialMode(s string) string {
+	mode := strings.ToLower(strings.TrimSpace(s))
+	if mode != "auto" && mode != "prefer-ipv6" && mode != "prefer-ipv4" && mode != "happy-eyeballs" {
+		logging.Warn("Config: invalid DIAL_MODE %q, using auto", s)
+		return "auto"
+	}
+	return mode
+}
+
+// parseSelfEchoPolicy validates SELF_ECHO_POLICY (skip, once, off)
+func parseSelfEchoPolicy(s string) string {
+	policy := strings.ToLower(strings.TrimSpace(s))
+	if policy != "skip" && policy != "once" && policy != "off" {
+		logging.Warn("Config: invalid SELF_ECHO_POLICY %q, using skip", s)
+		return "skip"
+	}
+	return policy
+}
+
+// parseRequirementsPolicy validates RELAY_REQUIREMENTS (off, record, exclude)
+func parseRequirementsPolicy(s string) string {
+	policy := strings.ToLower(strings.TrimSpace(s))
+	if policy != "off" && policy != "record" && policy != "exclude" {
+		logging.Warn("Config: invalid RELAY_REQUIREMENTS %q, using exclude", s)
+		return "exclude"
+	}
+	return policy
+}
+
+// parseScoringStrategy validates SCORING_STRATEGY (balanced, latency-first, reliability-first)
+func parseScoringStrategy(s string) string {
+	strategy := strings.ToLower(strings.TrimSpace(s))
+	if strategy != "balanced" && strategy != "latency-first" && strategy != "reliability-first" {
+		logging.Warn("Config: invalid SCORING_STRATEGY %q, using balanced", s)
+		return "balanced"
+	}
+	return strategy
+}
+
+// parseTimeOfDay parses "HH:MM" into the offset from midnight; invalid values fall back to midnight
+func parseTimeOfDay(s string) time.Duration {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		logging.Warn("Config: invalid time of day %q (expected HH:MM), using 00:00", s)
+		return 0
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+// parseIntList parses a comma-separated list of integers (e.g. event kinds). Invalid entries are skipped.
+func parseIntList(s string) []int {
+	result := []int{}
+	for _, item := range parseSeedRelays(s) {
+		if n, err := strconv.Atoi(item); err == nil {
+			result = append(result, n)
+		} else {
+			logging.Warn("Config: ignoring invalid integer %q", item)
+		}
+	}
+	return result
+}
+
+// parseKindTTLs parses "7=1m,9735=1m,30000-39999=1h" (kind or kind range = TTL). Invalid entries are skipped.
+func parseKindTTLs(s string) []KindTTL {
+	result := []KindTTL{}
+	for _, item := range parseSeedRelays(s) {
+		kinds, ttlStr, ok := strings.Cut(item, "=")
+		ttl, err := time.ParseDuration(strings.TrimSpace(ttlStr))
+		if !ok || err != nil || ttl < 0 {
+			logging.Warn("Config: ignoring invalid cache TTL %q (expected kind=duration or min-max=duration)", item)
+			continue
+		}
+		minStr, maxStr, isRange := strings.Cut(kinds, "-")
+		if !isRange {
+			maxStr = minStr
+		}
+		minKind, err1 := strconv.Atoi(strings.TrimSpace(minStr))
+		maxKind, err2 := strconv.Atoi(strings.TrimSpace(maxStr))
+		if err1 != nil || err2 != nil || minKind > maxKind {
+			logging.Warn("Config: ignoring invalid cache TTL kinds %q", kinds)
+			continue
+		}
+		result = append(result, KindTTL{MinKind: minKind, MaxKind: maxKind, TTL: ttl})
+	}
+	return result
+}
+
+// parseRelayRates parses "wss://a=60,wss://b=120" into relay URL -> events per minute. Invalid entries are skipped.
+func parseRelayRates(s string) map[string]int {
+	result := make(map[string]int)
+	for _, item := range parseSeedRelays(s) {
+		idx := strings.LastIndex(item, "=")
+		if idx <= 0 {
+			logging.Warn("Config: ignoring invalid relay rate %q (expected url=events_per_minute)", item)
+			continue
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(item[idx+1:]))
+		if err != nil || rate < 0 {
+			logging.Warn("Config: ignoring invalid relay rate %q", item)
+			continue
+		}
+		result[strings.TrimSuffix(strings.TrimSpace(item[:idx]), "/")] = rate
+	}
+	return result
+}
+
+// parseSourceDurations parses "event_tag=24h,relay_list=168h" (discovery source = duration). Invalid entries are skipped.
+func parseSourceDurations(s string) map[string]time.Duration {
+	result := make(map[string]time.Duration)
+	for _, item := range parseSeedRelays(s) {
+		source, value, ok := strings.Cut(item, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		source = strings.ToLower(strings.TrimSpace(source))
+		if !ok || source == "" || err != nil || d <= 0 {
+			logging.Warn("Config: ignoring invalid source duration %q (expected source=duration)", item)
+			continue
+		}
+		result[source] = d
+	}
+	return result
+}
+
+// parseFanoutLevels parses "narrow=10,wide=200" (level name = relay-set size). Invalid entries are skipped.
+func parseFanoutLevels(s string) map[string]int {
+	result := make(map[string]int)
+	for _, item := range parseSeedRelays(s) {
+		name, value, ok := strings.Cut(item, "=")
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" || err != nil || size <= 0 {
+			logging.Warn("Config: ignoring invalid fan-out level %q (expected name=relays)", item)
+			continue
+		}
+		result[name] = size
+	}
+	return result
+}
+
+// parseClassRates parses "ok=1000,timeout=10" (outcome class = log 1 in N). Invalid entries are skipped.
+func parseClassRates(s string) map[string]int {
+	result := make(map[string]int)
+	for _, item := range parseSeedRelays(s) {
+		class, value, ok := strings.Cut(item, "=")
+		rate, err := strconv.Atoi(strings.TrimSpace(value))
+		class = strings.ToLower(strings.TrimSpace(class))
+		if !ok || class == "" || err != nil || rate < 0 {
+			logging.Warn("Config: ignoring invalid result log rate %q (expected class=n)", item)
+			continue
+		}
+		result[class] = rate
+	}
+	return result
+}
+
+// parseNamedTokens parses "grafana=secret1,alice=secret2" (name = bearer token). Invalid entries are skipped.
+func parseNamedTokens(s string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range parseSeedRelays(s) {
+		name, token, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		token = strings.TrimSpace(token)
+		if !ok || name == "" || token == "" {
+			logging.Warn("Config: ignoring invalid admin token entry for %q (expected name=token)", name)
+			continue
+		}
+		result[name] = token
+	}
+	return result
+}
+
+// parseRegions parses "eu=wss://a,wss://b;na=wss://c" into region -> relay URLs. Invalid groups are skipped.
+func parseRegions(s string) map[string][]string {
+	result := make(map[string][]string)
+	for _, group := range strings.Split(s, ";") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		name, relays, ok := strings.Cut(group, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			logging.Warn("Config: ignoring invalid region %q (expected name=relay,relay)", group)
+			continue
+		}
+		for _, relay := range parseSeedRelays(relays) {
+			result[name] = append(result[name], strings.TrimSuffix(relay, "/"))
+		}
+	}
+	return result
+}
+
+// parseRelayFallbacks parses "wss://relay=ws://relay:7777,ws://abc.onion;wss://other=..." (relay URL =
+// alternate endpoints in the order they are tried). Invalid entries are skipped.
+func parseRelayFallbacks(s string) map[string][]string {
+	result := make(map[string][]string)
+	for _, group := range strings.Split(s, ";") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		url, alternates, ok := strings.Cut(group, "=")
+		url = strings.TrimSuffix(strings.TrimSpace(url), "/")
+		if !ok || url == "" {
+			logging.Warn("Config: ignoring invalid relay fallback %q (expected url=alternate,alternate)", group)
+			continue
+		}
+		for _, alternate := range parseSeedRelays(alternates) {
+			if !strings.HasPrefix(alternate, "ws://") && !strings.HasPrefix(alternate, "wss://") {
+				logging.Warn("Config: ignoring relay fallback %q of %s (not a ws:// or wss:// URL)", alternate, url)
+				continue
+			}
+			result[url] = append(result[url], alternate)
+		}
+	}
+	return result
+}
+
 func parseBannerList(bannerStr string) []string {
 	if bannerStr == "" {
 		// Default to local static banners
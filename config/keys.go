@@ -0,0 +1,101 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip49"
+)
+
+// loadRelayPrivkey reads RELAY_PRIVKEY and returns it as hex ("" when unset, so a random key is
+// generated). An invalid key stops the relay: running with a different pubkey than the operator
+// configured would silently orphan receipts, relay lists and NIP-42 identities.
+func loadRelayPrivkey() string {
+	raw := getEnv("RELAY_PRIVKEY", "")
+	if raw == "" {
+		return ""
+	}
+	sk, err := parsePrivkey(raw, privkeyPassword)
+	if err != nil {
+		logging.Fatal("Config: invalid RELAY_PRIVKEY: %v", err)
+	}
+	return sk
+}
+
+// parsePrivkey decodes an nsec, a 64-char hex key or a NIP-49 ncryptsec (decrypted with the
+// password returned by password) into a hex private key
+func parsePrivkey(raw string, password func() (string, error)) (string, error) {
+	raw = strings.TrimSpace(raw)
+	var sk string
+	switch {
+	case strings.HasPrefix(raw, "nsec1"):
+		prefix, decoded, err := nip19.Decode(raw)
+		if err != nil {
+			return "", fmt.Errorf("cannot decode nsec: %w", err)
+		}
+		hex, ok := decoded.(string)
+		if prefix != "nsec" || !ok {
+			return "", fmt.Errorf("not an nsec")
+		}
+		sk = hex
+	case strings.HasPrefix(raw, "ncryptsec1"):
+		pass, err := password()
+		if err != nil {
+			return "", err
+		}
+		if sk, err = nip49.Decrypt(raw, pass); err != nil {
+			return "", fmt.Errorf("cannot decrypt ncryptsec (wrong RELAY_PRIVKEY_PASSWORD?): %w", err)
+		}
+	case strings.HasPrefix(raw, "npub1"):
+		return "", fmt.Errorf("got a public key (npub), expected nsec, ncryptsec or hex")
+	default:
+		sk = strings.ToLower(raw)
+	}
+	if !nostr.IsValid32ByteHex(sk) {
+		return "", fmt.Errorf("expected nsec, ncryptsec or 64 hex characters")
+	}
+	if _, err := nostr.GetPublicKey(sk); err != nil {
+		return "", fmt.Errorf("not a valid secp256k1 key: %w", err)
+	}
+	return sk, nil
+}
+
+// privkeyPassword returns RELAY_PRIVKEY_PASSWORD, or prompts for it when stdin is a terminal
+func privkeyPassword() (string, error) {
+	if pass := lookupEnv("RELAY_PRIVKEY_PASSWORD"); pass != "" {
+		return pass, nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return "", fmt.Errorf("ncryptsec key needs RELAY_PRIVKEY_PASSWORD (or RELAY_PRIVKEY_PASSWORD_FILE) when not run from a terminal")
+	}
+
+	fmt.Fprint(os.Stderr, "Password for RELAY_PRIVKEY: ")
+	// Hide the input where stty is available; the prompt still works without it
+	if setEcho(false) == nil {
+		defer func() {
+			setEcho(true)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("cannot read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func setEcho(on bool) error {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// profiles are bundles of defaults selected with PROFILE. A profile only replaces built-in
+// defaults: anything set in the environment (or through _FILE / SECRETS_DIR) still wins.
+var profiles = map[string]map[string]string{
+	// Local development: a local seed relay, a tiny pool refreshed often, nothing published
+	// for real and no client rate limits in the way
+	"dev": {
+		"SEED_RELAYS":           "ws://localhost:10547",
+		"TOP_N_RELAYS":          "5",
+		"REFRESH_INTERVAL":      "1h",
+		"HEALTH_CHECK_INTERVAL": "1m",
+		"MAX_STARTUP_TIME":      "10s",
+		"CACHE_TTL":             "30s",
+		"TEST_MODE":             "true",
+		"RATE_LIMIT_CONNECTION": "off",
+		"RATE_LIMIT_EVENT_IP":   "off",
+		"RATE_LIMIT_FILTER_IP":  "off",
+		"BURST_FACTOR":          "0",
+		"LATE_OK_WINDOW":        "30s",
+		"CANARY_MIN_ACCEPTED":   "1",
+	},
+	// Staging: real relays but a smaller pool, strict validation and generous sampling to
+	// catch problems before production
+	"staging": {
+		"SEED_RELAYS":       "wss://relay.damus.io,wss://nos.lol,wss://relay.primal.net",
+		"TOP_N_RELAYS":      "20",
+		"REFRESH_INTERVAL":  "6h",
+		"CACHE_TTL":         "2m",
+		"EVENT_VALIDATION":  "true",
+		"EVENT_SAMPLE_RATE": "10",
+	},
+	// Production: a broad seed list for a large pool, strict validation and the default
+	// protections
+	"prod": {
+		"SEED_RELAYS": "wss://relay.damus.io,wss://nos.lol,wss://relay.primal.net,wss://relay.nostr.band," +
+			"wss://relay.snort.social,wss://nostr.mom,wss://offchain.pub,wss://purplepag.es," +
+			"wss://relay.nostr.bg,wss://nostr.oxtr.dev",
+		"TOP_N_RELAYS":      "50",
+		"EVENT_VALIDATION":  "true",
+		"EVENT_SAMPLE_RATE": "100",
+	},
+}
+
+// profileDefaults holds the defaults of the active profile; lookupEnv falls back to them
+var profileDefaults map[string]string
+
+// applyProfile activates the named profile ("" for none) and returns its canonical name
+func applyProfile(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	profileDefaults = nil
+	if name == "" {
+		return ""
+	}
+	defaults, ok := profiles[name]
+	if !ok {
+		logging.Warn("Config: unknown PROFILE %q (known: %s), using built-in defaults", name, strings.Join(ProfileNames(), ", "))
+		return ""
+	}
+	profileDefaults = defaults
+	logging.Info("Config: Using profile %q (%d defaults; environment variables override them)", name, len(defaults))
+	return name
+}
+
+// ProfileNames lists the available profiles
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
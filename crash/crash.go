@@ -0,0 +1,248 @@
+// Package crash turns panics in long-lived goroutines and request handlers into crash reports
+// instead of process exits: the panic value, the stack and what was being processed (event ID,
+// relay URL, request path) are logged, counted per component, kept in a short history for
+// /stats and optionally posted to a webhook. A deferred Recover keeps one bad event from
+// silently taking down a broadcast worker or the whole relay.
+package crash
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+const (
+	// maxRecent is how many reports the stats keep
+	maxRecent = 10
+	// alertInterval is the minimum time between two webhook posts for the same component, so a
+	// panic on every event does not flood the webhook
+	alertInterval = time.Minute
+)
+
+// Config controls crash reporting
+type Config struct {
+	Webhook string // optional URL receiving a JSON POST per crash
+	Name    string // relay name, included in webhook posts
+}
+
+// Report is one recovered panic
+type Report struct {
+	At        time.Time         `json:"at"`
+	Component string            `json:"component"`
+	Panic     string            `json:"panic"`
+	Stack     string            `json:"stack"`
+	Context   map[string]string `json:"context,omitempty"`
+}
+
+// Reporter records recovered panics
+type Reporter struct {
+	mu         sync.Mutex
+	cfg        Config
+	client     *http.Client
+	counts     map[string]int64 // per component
+	recent     []Report         // most recent last, at most maxRecent
+	lastAlerts map[string]time.Time
+
+	total  int64
+	alerts int64
+}
+
+var defaultReporter = New(Config{})
+
+// New returns a Reporter
+func New(cfg Config) *Reporter {
+	return &Reporter{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		counts:     make(map[string]int64),
+		lastAlerts: make(map[string]time.Time),
+	}
+}
+
+// Default returns the process-wide reporter used by Recover, Go and Handler
+func Default() *Reporter {
+	return defaultReporter
+}
+
+// Configure sets the webhook and relay name of the default reporter
+func Configure(cfg Config) {
+	defaultReporter.mu.Lock()
+	defer defaultReporter.mu.Unlock()
+	defaultReporter.cfg = cfg
+}
+
+// Recover must be deferred directly: it stops a panic, if any, and reports it under component.
+// keyvals are pairs describing what was being processed, e.g. "event", id, "relay", url.
+func Recover(component string, keyvals ...string) {
+	if value := recover(); value != nil {
+		defaultReporter.Record(component, value, debug.Stack(), keyvals...)
+	}
+}
+
+// Go runs fn in a goroutine that reports a panic instead of crashing the process
+func Go(component string, fn func()) {
+	go func() {
+		defer Recover(component)
+		fn()
+	}()
+}
+
+// Handler reports panics of next under component and answers 500 instead of dropping the
+// connection. http.ErrAbortHandler, the deliberate way to abort a response, passes through.
+func Handler(component string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if err, ok := value.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(value)
+			}
+			defaultReporter.Record(component, value, debug.Stack(), "method", req.Method, "path", req.URL.Path)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Record logs and counts a recovered panic and alerts the webhook, if one is configured
+func (r *Reporter) Record(component string, value any, stack []byte, keyvals ...string) {
+	report := Report{
+		At:        time.Now(),
+		Component: component,
+		Panic:     fmt.Sprint(value),
+		Stack:     string(stack),
+	}
+	if len(keyvals) > 0 {
+		report.Context = make(map[string]string, len(keyvals)/2)
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			report.Context[keyvals[i]] = keyvals[i+1]
+		}
+	}
+
+	atomic.AddInt64(&r.total, 1)
+	r.mu.Lock()
+	r.counts[component]++
+	if len(r.recent) >= maxRecent {
+		r.recent = r.recent[1:]
+	}
+	r.recent = append(r.recent, report)
+	alert := r.cfg.Webhook != "" && time.Since(r.lastAlerts[component]) >= alertInterval
+	if alert {
+		r.lastAlerts[component] = report.At
+	}
+	r.mu.Unlock()
+
+	logging.Error("Crash: Recovered panic in %s: %s%s\n%s", component, report.Panic, contextString(report.Context), report.Stack)
+	if alert {
+		go r.alert(report)
+	}
+}
+
+// contextString renders a report's context as " [key=value ...]" in key order
+func contextString(context map[string]string) string {
+	if len(context) == 0 {
+		return ""
+	}
+	keys := sortedKeys(context)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + context[key]
+	}
+	return " [" + strings.Join(parts, " ") + "]"
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// alert posts a crash report to the webhook
+func (r *Reporter) alert(report Report) {
+	r.mu.Lock()
+	cfg := r.cfg
+	r.mu.Unlock()
+
+	atomic.AddInt64(&r.alerts, 1)
+	body, err := stdjson.Marshal(map[string]any{
+		"relay":     cfg.Name,
+		"check":     "crash",
+		"component": report.Component,
+		"panic":     report.Panic,
+		"context":   report.Context,
+		"stack":     report.Stack,
+		"at":        report.At.Unix(),
+	})
+	if err != nil {
+		return
+	}
+	resp, err := r.client.Post(cfg.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logging.Warn("Crash: Alert webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logging.Warn("Crash: Alert webhook answered %s", resp.Status)
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (r *Reporter) GetStatsName() string {
+	return "crashes"
+}
+
+// GetStats returns crash counters per component and the most recent reports as a JsonEntity
+func (r *Reporter) GetStats() json.JsonEntity {
+	r.mu.Lock()
+	components := make([]string, 0, len(r.counts))
+	for component := range r.counts {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	byComponent := json.NewJsonObject()
+	for _, component := range components {
+		byComponent.Set(component, json.NewJsonValue(r.counts[component]))
+	}
+	recent := json.NewJsonList()
+	for i := len(r.recent) - 1; i >= 0; i-- { // newest first
+		report := r.recent[i]
+		reportObj := json.NewJsonObject()
+		reportObj.Set("at", json.NewJsonValue(report.At.Format(time.RFC3339)))
+		reportObj.Set("component", json.NewJsonValue(report.Component))
+		reportObj.Set("panic", json.NewJsonValue(report.Panic))
+		if len(report.Context) > 0 {
+			contextObj := json.NewJsonObject()
+			for _, key := range sortedKeys(report.Context) {
+				contextObj.Set(key, json.NewJsonValue(report.Context[key]))
+			}
+			reportObj.Set("context", contextObj)
+		}
+		reportObj.Set("stack", json.NewJsonValue(report.Stack))
+		recent.Append(reportObj)
+	}
+	r.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("total", json.NewJsonValue(atomic.LoadInt64(&r.total)))
+	obj.Set("by_component", byComponent)
+	obj.Set("alerts", json.NewJsonValue(atomic.LoadInt64(&r.alerts)))
+	obj.Set("recent", recent)
+	return obj
+}
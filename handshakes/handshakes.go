@@ -0,0 +1,325 @@
+// Package handshakes keeps an audit trail of outbound connection attempts to destination relays:
+// publish connections and health probes, each as one JSON line with its time, relay, outcome class
+// and duration. The trail goes to a size-rotated file with a retention limit, so reliability can be
+// analyzed over weeks instead of the minutes in-memory stats cover, and is exported as NDJSON.
+package handshakes
+
+import (
+	"bufio"
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/bus"
+	"github.com/girino/nostr-brodcast-relay/broadcast/netdiag"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// ClassOK is the class of a successful attempt; failures use the netdiag classes
+const ClassOK = "ok"
+
+// Attempt kinds
+const (
+	KindPublish = "publish" // connection opened to publish events
+	KindProbe   = "probe"   // health check
+)
+
+const (
+	// queueSize bounds the entries waiting for the writer; more are dropped
+	queueSize = 4096
+	// pruneInterval is how often rotated files are checked against the retention limit
+	pruneInterval = time.Hour
+)
+
+// Config controls the audit file
+type Config struct {
+	Path      string        // current file; rotated ones get .1, .2, ... (older = higher)
+	MaxSize   int64         // bytes after which the file is rotated (default 10 MiB)
+	MaxFiles  int           // files kept, the current one included (default 5)
+	Retention time.Duration // rotated files older than this are deleted (0 = kept until MaxFiles)
+}
+
+// Entry is one connection attempt
+type Entry struct {
+	At         time.Time `json:"at"`
+	Relay      string    `json:"relay"`
+	Kind       string    `json:"kind"`
+	Class      string    `json:"class"`
+	DurationMs int64     `json:"ms"`
+}
+
+// Query selects exported entries; zero fields match everything
+type Query struct {
+	Since time.Time
+	Relay string
+}
+
+// Log appends connection attempts to the audit file
+type Log struct {
+	cfg   Config
+	queue chan Entry
+
+	mu     sync.Mutex // guards the file and rotation
+	file   *os.File
+	size   int64
+	closed bool // by Run on shutdown
+
+	written     int64
+	dropped     int64
+	writeErrors int64
+	rotations   int64
+	pruned      int64
+}
+
+// New opens (or creates) the audit file; Run writes it. Feed it with Record.
+func New(cfg Config) (*Log, error) {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 10 << 20
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = 5
+	}
+	l := &Log{cfg: cfg, queue: make(chan Entry, queueSize)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	l.prune()
+	logging.Info("Handshakes: Auditing outbound connections to %s (rotated at %d MiB, %d files, retention %v)",
+		cfg.Path, cfg.MaxSize>>20, cfg.MaxFiles, cfg.Retention)
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Record queues publish handshakes and health probes from the results bus; other events are
+// ignored. Never blocks: entries are dropped while the writer is behind.
+func (l *Log) Record(e bus.Event) {
+	kind := KindPublish
+	switch e.Type {
+	case bus.Handshake:
+	case bus.HealthCheck:
+		kind = KindProbe
+	default:
+		return
+	}
+	class := ClassOK
+	if !e.Success {
+		class = netdiag.Classify(e.Err)
+	}
+	entry := Entry{At: e.At.UTC(), Relay: e.URL, Kind: kind, Class: class, DurationMs: e.ResponseTime.Milliseconds()}
+	select {
+	case l.queue <- entry:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+// Run writes the queued entries until ctx is canceled, then writes what is still queued and
+// closes the file
+func (l *Log) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-l.queue:
+			l.write(entry)
+		case <-ticker.C:
+			l.prune()
+		case <-ctx.Done():
+			l.drain()
+			return
+		}
+	}
+}
+
+// drain writes the entries still queued and closes the file; later entries are counted as write
+// errors
+func (l *Log) drain() {
+	for {
+		select {
+		case entry := <-l.queue:
+			l.write(entry)
+		default:
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.closed = true
+			if l.file != nil {
+				if err := l.file.Close(); err != nil {
+					logging.Error("Handshakes: Failed to close %s: %v", l.cfg.Path, err)
+				}
+				l.file = nil
+			}
+			return
+		}
+	}
+}
+
+func (l *Log) write(entry Entry) {
+	line, err := stdjson.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		atomic.AddInt64(&l.writeErrors, 1)
+		return
+	}
+	if l.size+int64(len(line)) > l.cfg.MaxSize && l.size > 0 {
+		if err := l.rotateLocked(); err != nil {
+			atomic.AddInt64(&l.writeErrors, 1)
+			logging.Error("Handshakes: Failed to rotate %s: %v", l.cfg.Path, err)
+		}
+	}
+	if l.file == nil {
+		atomic.AddInt64(&l.writeErrors, 1)
+		return
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		atomic.AddInt64(&l.writeErrors, 1)
+		logging.Error("Handshakes: Failed to write %s: %v", l.cfg.Path, err)
+		return
+	}
+	atomic.AddInt64(&l.written, 1)
+}
+
+// rotated returns the path of the i-th rotated file (0 = the current one)
+func (l *Log) rotated(i int) string {
+	if i == 0 {
+		return l.cfg.Path
+	}
+	return fmt.Sprintf("%s.%d", l.cfg.Path, i)
+}
+
+// rotateLocked shifts every file one place up, dropping the oldest, and starts a new current file
+func (l *Log) rotateLocked() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	os.Remove(l.rotated(l.cfg.MaxFiles - 1))
+	for i := l.cfg.MaxFiles - 2; i >= 0; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	atomic.AddInt64(&l.rotations, 1)
+	return l.open()
+}
+
+// prune deletes rotated files last written before the retention limit
+func (l *Log) prune() {
+	if l.cfg.Retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-l.cfg.Retention)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 1; i < l.cfg.MaxFiles; i++ {
+		info, err := os.Stat(l.rotated(i))
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(l.rotated(i)); err == nil {
+			atomic.AddInt64(&l.pruned, 1)
+			logging.DebugMethod("handshakes", "prune", "Deleted %s, older than %v", l.rotated(i), l.cfg.Retention)
+		}
+	}
+}
+
+// Export writes the entries matching q to w as JSON lines, oldest first
+func (l *Log) Export(w io.Writer, q Query) error {
+	// Open every file under the lock; a rotation afterwards does not affect open handles
+	l.mu.Lock()
+	var files []*os.File
+	for i := l.cfg.MaxFiles - 1; i >= 0; i-- {
+		if f, err := os.Open(l.rotated(i)); err == nil {
+			files = append(files, f)
+		}
+	}
+	l.mu.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if q.Since.IsZero() && q.Relay == "" {
+				if _, err := w.Write(append(line, '\n')); err != nil {
+					return err
+				}
+				continue
+			}
+			var entry Entry
+			if stdjson.Unmarshal(line, &entry) != nil {
+				continue // torn by a crash
+			}
+			if entry.At.Before(q.Since) || q.Relay != "" && entry.Relay != q.Relay {
+				continue
+			}
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStatsName returns the name for this stats provider
+func (l *Log) GetStatsName() string {
+	return "handshakes"
+}
+
+// GetStats returns audit file counters as a JsonEntity
+func (l *Log) GetStats() json.JsonEntity {
+	l.mu.Lock()
+	size := l.size
+	files := 0
+	for i := 0; i < l.cfg.MaxFiles; i++ {
+		if _, err := os.Stat(l.rotated(i)); err == nil {
+			files++
+		}
+	}
+	l.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("path", json.NewJsonValue(l.cfg.Path))
+	obj.Set("written", json.NewJsonValue(atomic.LoadInt64(&l.written)))
+	obj.Set("dropped", json.NewJsonValue(atomic.LoadInt64(&l.dropped)))
+	obj.Set("write_errors", json.NewJsonValue(atomic.LoadInt64(&l.writeErrors)))
+	obj.Set("rotations", json.NewJsonValue(atomic.LoadInt64(&l.rotations)))
+	obj.Set("pruned_files", json.NewJsonValue(atomic.LoadInt64(&l.pruned)))
+	obj.Set("files", json.NewJsonValue(files))
+	obj.Set("current_bytes", json.NewJsonValue(size))
+	obj.Set("queued", json.NewJsonValue(len(l.queue)))
+	return obj
+}
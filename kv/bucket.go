@@ -0,0 +1,150 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/girino/nostr-brodcast-relay/persist"
+)
+
+// Target is where a subsystem keeps its state across restarts: a JSON file of its own or a bucket
+// of the shared Store. The state is a JSON object (a struct or a map).
+type Target interface {
+	Load(v any) (bool, error) // decodes the saved state into v; false if nothing was saved
+	Save(v any) error         // replaces the saved state with v
+	String() string           // where the state is kept, for logs
+}
+
+// TargetFor returns the bucket of store if there is a store, else the file at path (nil if path
+// is empty too, i.e. the state is not persisted)
+func TargetFor(store *Store, bucket, path string) Target {
+	if store != nil {
+		return store.Bucket(bucket)
+	}
+	if path != "" {
+		return File(path)
+	}
+	return nil
+}
+
+// File is a Target that keeps the state in its own JSON file, replaced atomically on each save
+type File string
+
+// Load decodes the file into v; a missing file is no state
+func (f File) Load(v any) (bool, error) {
+	return persist.ReadJSON(string(f), v)
+}
+
+// Save replaces the file with v
+func (f File) Save(v any) error {
+	return persist.WriteJSON(string(f), v)
+}
+
+func (f File) String() string {
+	return string(f)
+}
+
+// Bucket is a namespace of a Store. As a Target, the members of the saved JSON object are its
+// keys, and a save only writes the members that changed.
+type Bucket struct {
+	store *Store
+	name  string
+}
+
+// Get decodes the value of key into v; false if the key does not exist
+func (b *Bucket) Get(key string, v any) (bool, error) {
+	b.store.mu.Lock()
+	value, ok := b.store.buckets[b.name][key]
+	b.store.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, v)
+}
+
+// Put stores v as the value of key
+func (b *Bucket) Put(key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	return b.store.writeLocked([]record{{Bucket: b.name, Key: key, Value: value}})
+}
+
+// Delete removes key
+func (b *Bucket) Delete(key string) error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	if _, ok := b.store.buckets[b.name][key]; !ok {
+		return nil
+	}
+	return b.store.writeLocked([]record{{Bucket: b.name, Key: key}})
+}
+
+// Keys returns the keys of the bucket in order
+func (b *Bucket) Keys() []string {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	return sortedKeys(b.store.buckets[b.name])
+}
+
+// Len returns the number of keys
+func (b *Bucket) Len() int {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	return len(b.store.buckets[b.name])
+}
+
+// Load decodes the whole bucket, as a JSON object of its keys, into v; false if it is empty
+func (b *Bucket) Load(v any) (bool, error) {
+	b.store.mu.Lock()
+	entries := make(map[string]json.RawMessage, len(b.store.buckets[b.name]))
+	for key, value := range b.store.buckets[b.name] {
+		entries[key] = value
+	}
+	b.store.mu.Unlock()
+	if len(entries) == 0 {
+		return false, nil
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Save makes the bucket hold exactly the members of v, which must encode to a JSON object, in one
+// synced write: changed members are written and missing ones deleted. After a crash the bucket
+// holds either the previous state or v, never a mix.
+func (b *Bucket) Save(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil || members == nil {
+		return fmt.Errorf("kv: %T is not a JSON object", v)
+	}
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	current := b.store.buckets[b.name]
+	var recs []record
+	for _, key := range sortedKeys(members) {
+		if old, ok := current[key]; !ok || !bytes.Equal(old, members[key]) {
+			recs = append(recs, record{Bucket: b.name, Key: key, Value: members[key]})
+		}
+	}
+	for _, key := range sortedKeys(current) {
+		if _, ok := members[key]; !ok {
+			recs = append(recs, record{Bucket: b.name, Key: key})
+		}
+	}
+	return b.store.writeLocked(recs)
+}
+
+func (b *Bucket) String() string {
+	return b.store.path + "#" + b.name
+}
@@ -0,0 +1,330 @@
+// Package kv is the embedded key-value store shared by the subsystems that keep state across
+// restarts (learned kind matrices, maintenance histories, relay score snapshots). Values are JSON,
+// grouped in namespaced buckets and held in memory; every change is appended to a single log file
+// and synced before it is visible, and the log is compacted to the live entries once it is mostly
+// overwritten ones. A write of several records is one line of the log, so a crash keeps all of
+// them or none.
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/persist"
+	nljson "github.com/girino/nostr-lib/json"
+)
+
+const (
+	compactMinRecords = 1000 // log records below which the log is never compacted automatically
+	compactRatio      = 2    // compact once the log holds this many records per live entry
+)
+
+// ErrClosed is returned by writes after Close
+var ErrClosed = errors.New("kv: store is closed")
+
+// record is one change; a record without a value deletes the key
+type record struct {
+	Bucket string          `json:"b,omitempty"`
+	Key    string          `json:"k,omitempty"`
+	Value  json.RawMessage `json:"v,omitempty"`
+}
+
+// logLine is one line of the log: a single record, or a batch of records applied all or nothing
+type logLine struct {
+	record
+	Batch []record `json:"batch,omitempty"`
+}
+
+// Store is a log-structured key-value store in one file
+type Store struct {
+	path string
+
+	mu         sync.Mutex
+	file       *os.File
+	buckets    map[string]map[string]json.RawMessage
+	logRecords int   // records in the log, live or not
+	logBytes   int64 // size of the log
+	closed     bool
+
+	writes         int64
+	writeErrors    int64
+	compactions    int64
+	lastCompaction time.Time
+}
+
+// Open loads the store kept in path, creating it if it does not exist, and compacts its log
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, buckets: make(map[string]map[string]json.RawMessage)}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// Start from a compact log: drops the overwritten records and a last one torn by a crash
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	logging.Info("KV: Opened %s (%d entries in %d buckets)", path, s.liveLocked(), len(s.buckets))
+	return s, nil
+}
+
+// replay applies the records of the log to the in-memory buckets
+func (s *Store) replay() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var entry logLine
+			if err := json.Unmarshal(data, &entry); err != nil {
+				if readErr == io.EOF {
+					// Lines end with a newline, so this is a write cut short by a crash: none of
+					// its records were committed
+					logging.Warn("KV: Dropping the incomplete last write of %s", s.path)
+					return nil
+				}
+				return fmt.Errorf("%s line %d: %w", s.path, line, err)
+			}
+			if entry.Batch != nil {
+				for _, rec := range entry.Batch {
+					s.applyLocked(rec)
+				}
+			} else {
+				s.applyLocked(entry.record)
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+func (s *Store) applyLocked(rec record) {
+	bucket := s.buckets[rec.Bucket]
+	if rec.Value == nil {
+		delete(bucket, rec.Key)
+		if len(bucket) == 0 {
+			delete(s.buckets, rec.Bucket)
+		}
+		return
+	}
+	if bucket == nil {
+		bucket = make(map[string]json.RawMessage)
+		s.buckets[rec.Bucket] = bucket
+	}
+	bucket[rec.Key] = rec.Value
+}
+
+func (s *Store) liveLocked() int {
+	live := 0
+	for _, bucket := range s.buckets {
+		live += len(bucket)
+	}
+	return live
+}
+
+// writeLocked appends recs to the log as one synced line and only then applies them, so readers
+// never see a change that would not survive a crash, and a crash mid-write loses the whole batch
+func (s *Store) writeLocked(recs []record) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	entry := logLine{record: recs[0]}
+	if len(recs) > 1 {
+		entry = logLine{Batch: recs}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write(line)
+	buf.WriteByte('\n')
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		s.failLocked()
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		s.failLocked()
+		return err
+	}
+	s.logRecords += len(recs)
+	s.logBytes += int64(buf.Len())
+	for _, rec := range recs {
+		s.applyLocked(rec)
+	}
+	atomic.AddInt64(&s.writes, 1)
+
+	if s.logRecords >= compactMinRecords && s.logRecords > compactRatio*s.liveLocked() {
+		if err := s.compactLocked(); err != nil {
+			logging.Warn("KV: Failed to compact %s: %v", s.path, err)
+		}
+	}
+	return nil
+}
+
+// failLocked cuts off whatever part of a failed write reached the log, so the next record does
+// not follow half a line
+func (s *Store) failLocked() {
+	atomic.AddInt64(&s.writeErrors, 1)
+	if err := s.file.Truncate(s.logBytes); err != nil {
+		logging.Error("KV: Failed to roll back a partial write to %s: %v", s.path, err)
+	}
+}
+
+// encodeLocked returns the live entries as a log, ordered by bucket and key
+func (s *Store) encodeLocked() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, name := range sortedKeys(s.buckets) {
+		bucket := s.buckets[name]
+		for _, key := range sortedKeys(bucket) {
+			line, err := json.Marshal(record{Bucket: name, Key: key, Value: bucket[key]})
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// compactLocked atomically replaces the log with the live entries and reopens it for appending
+func (s *Store) compactLocked() error {
+	data, err := s.encodeLocked()
+	if err != nil {
+		return err
+	}
+	if err := persist.WriteFile(s.path, data); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		s.closed = true
+		return err
+	}
+	s.logRecords, s.logBytes = s.liveLocked(), int64(len(data))
+	s.compactions++
+	s.lastCompaction = time.Now()
+	return nil
+}
+
+// Compact rewrites the log with only the live entries
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.compactLocked()
+}
+
+// Snapshot returns a consistent copy of every bucket
+func (s *Store) Snapshot() map[string]map[string]json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]map[string]json.RawMessage, len(s.buckets))
+	for name, bucket := range s.buckets {
+		entries := make(map[string]json.RawMessage, len(bucket))
+		for key, value := range bucket {
+			entries[key] = value // values are replaced, never modified
+		}
+		snapshot[name] = entries
+	}
+	return snapshot
+}
+
+// Backup atomically writes a consistent, compacted copy of the store to path; the copy can be
+// opened with Open
+func (s *Store) Backup(path string) error {
+	s.mu.Lock()
+	data, err := s.encodeLocked()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return persist.WriteFile(path, data)
+}
+
+// Close closes the log; later writes fail with ErrClosed
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
+
+// Bucket returns the namespace name of the store; buckets need no creation
+func (s *Store) Bucket(name string) *Bucket {
+	return &Bucket{store: s, name: name}
+}
+
+// GetStatsName returns the name for this stats provider
+func (s *Store) GetStatsName() string {
+	return "kv"
+}
+
+// GetStats returns the store size and counters as a JsonEntity
+func (s *Store) GetStats() nljson.JsonEntity {
+	s.mu.Lock()
+	buckets := nljson.NewJsonObject()
+	for _, name := range sortedKeys(s.buckets) {
+		buckets.Set(name, nljson.NewJsonValue(len(s.buckets[name])))
+	}
+	live, logRecords, logBytes := s.liveLocked(), s.logRecords, s.logBytes
+	compactions, lastCompaction := s.compactions, s.lastCompaction
+	s.mu.Unlock()
+
+	obj := nljson.NewJsonObject()
+	obj.Set("path", nljson.NewJsonValue(s.path))
+	obj.Set("buckets", buckets)
+	obj.Set("live_entries", nljson.NewJsonValue(live))
+	obj.Set("log_records", nljson.NewJsonValue(logRecords))
+	obj.Set("log_bytes", nljson.NewJsonValue(logBytes))
+	obj.Set("writes", nljson.NewJsonValue(atomic.LoadInt64(&s.writes)))
+	obj.Set("write_errors", nljson.NewJsonValue(atomic.LoadInt64(&s.writeErrors)))
+	obj.Set("compactions", nljson.NewJsonValue(compactions))
+	obj.Set("last_compaction", nljson.NewJsonValue(lastCompaction.Unix()))
+	return obj
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
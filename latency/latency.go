@@ -0,0 +1,201 @@
+// Package latency measures how fast accepted events reach the network: for every broadcast
+// event, the time from its acceptance to the first relay OK and to the Kth relay OK, aggregated
+// into fixed-bucket histograms with percentile estimates. Both include queueing, so they are
+// what a user publishing through this relay actually experiences.
+package latency
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Buckets are the upper bounds of the histogram buckets; slower events land in the +Inf bucket
+var Buckets = []time.Duration{
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// Histogram counts durations per bucket
+type Histogram struct {
+	counts []int64 // len(Buckets)+1, the last one is +Inf
+	count  int64
+	sum    time.Duration
+	missed int64 // events that never got there
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, len(Buckets)+1)}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := sort.Search(len(Buckets), func(i int) bool { return d <= Buckets[i] })
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// Quantile estimates the q-quantile (0..1) by linear interpolation within its bucket; the +Inf
+// bucket reports the largest finite bound
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var seen float64
+	for i, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		if seen+float64(count) >= rank {
+			if i == len(Buckets) {
+				return Buckets[len(Buckets)-1]
+			}
+			lower := time.Duration(0)
+			if i > 0 {
+				lower = Buckets[i-1]
+			}
+			fraction := math.Max(rank-seen, 0) / float64(count)
+			return lower + time.Duration(fraction*float64(Buckets[i]-lower))
+		}
+		seen += float64(count)
+	}
+	return Buckets[len(Buckets)-1]
+}
+
+func (h *Histogram) object() *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("count", json.NewJsonValue(h.count))
+	obj.Set("missed", json.NewJsonValue(h.missed))
+	if h.count > 0 {
+		obj.Set("avg_ms", json.NewJsonValue(h.sum.Milliseconds()/h.count))
+	}
+	obj.Set("p50_ms", json.NewJsonValue(h.Quantile(0.50).Milliseconds()))
+	obj.Set("p90_ms", json.NewJsonValue(h.Quantile(0.90).Milliseconds()))
+	obj.Set("p99_ms", json.NewJsonValue(h.Quantile(0.99).Milliseconds()))
+
+	// Cumulative counts per upper bound, like a Prometheus histogram
+	buckets := json.NewJsonObject()
+	var cumulative int64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(Buckets) {
+			le = Buckets[i].String()
+		}
+		buckets.Set(le, json.NewJsonValue(cumulative))
+	}
+	obj.Set("buckets", buckets)
+	return obj
+}
+
+// Config controls the measurements
+type Config struct {
+	K           int   // the Kth OK is measured too (default 3)
+	IgnoreKinds []int // synthetic events (e.g. canaries) kept out of the histograms
+}
+
+// Recorder implements broadcaster.BroadcastReporter
+type Recorder struct {
+	cfg    Config
+	ignore map[int]bool
+
+	mu      sync.Mutex
+	first   *Histogram
+	kth     *Histogram
+	queue   *Histogram // acceptance to the start of the broadcast
+	since   time.Time
+	ignored int64
+}
+
+// New returns a Recorder for cfg
+func New(cfg Config) *Recorder {
+	if cfg.K <= 0 {
+		cfg.K = 3
+	}
+	ignore := make(map[int]bool, len(cfg.IgnoreKinds))
+	for _, kind := range cfg.IgnoreKinds {
+		ignore[kind] = true
+	}
+	logging.DebugMethod("latency", "New", "Measuring time to first and %dth OK (ignoring kinds %v)", cfg.K, cfg.IgnoreKinds)
+	return &Recorder{
+		cfg:    cfg,
+		ignore: ignore,
+		first:  newHistogram(),
+		kth:    newHistogram(),
+		queue:  newHistogram(),
+		since:  time.Now(),
+	}
+}
+
+// BroadcastPlanned does nothing: latencies are known once the broadcast completes
+func (r *Recorder) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted records the event's time to first and Kth OK
+func (r *Recorder) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	if report.Event == nil {
+		return
+	}
+
+	// Results are appended as publishes finish, but collect the OK times explicitly anyway
+	oks := make([]time.Time, 0, len(report.Results))
+	for _, result := range report.Results {
+		if result.Success && !result.At.IsZero() {
+			oks = append(oks, result.At)
+		}
+	}
+	sort.Slice(oks, func(i, j int) bool { return oks[i].Before(oks[j]) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ignore[report.Event.Kind] {
+		r.ignored++
+		return
+	}
+	r.queue.observe(report.Started.Sub(report.Queued))
+	if len(oks) == 0 {
+		r.first.missed++
+	} else {
+		r.first.observe(oks[0].Sub(report.Queued))
+	}
+	if len(oks) < r.cfg.K {
+		r.kth.missed++
+	} else {
+		r.kth.observe(oks[r.cfg.K-1].Sub(report.Queued))
+	}
+}
+
+// Reset clears the histograms
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.first, r.kth, r.queue = newHistogram(), newHistogram(), newHistogram()
+	r.since = time.Now()
+	r.ignored = 0
+}
+
+// GetStatsName returns the name for this stats provider
+func (r *Recorder) GetStatsName() string {
+	return "latency"
+}
+
+// GetStats returns the histograms as a JsonEntity
+func (r *Recorder) GetStats() json.JsonEntity {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("since", json.NewJsonValue(r.since.Unix()))
+	obj.Set("k", json.NewJsonValue(r.cfg.K))
+	obj.Set("first_ok", r.first.object())
+	obj.Set("kth_ok", r.kth.object())
+	obj.Set("queue_wait", r.queue.object())
+	obj.Set("ignored_events", json.NewJsonValue(r.ignored))
+	return obj
+}
@@ -0,0 +1,221 @@
+// Package lifecycle starts the long-running parts of the relay (broadcaster, discovery refresh,
+// pull subscriptions, HTTP server) in dependency order and stops them in reverse, each within its
+// own timeout, so a component is never stopped while something in front of it still feeds it.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// DefaultStopTimeout bounds a component's Stop when it was added without its own timeout
+const DefaultStopTimeout = 15 * time.Second
+
+// Component is one supervised part of the process
+type Component interface {
+	Name() string
+	// Start brings the component up; long-running work belongs in goroutines that end on Stop.
+	Start(ctx context.Context) error
+	// Stop shuts the component down; ctx carries its stop timeout.
+	Stop(ctx context.Context) error
+}
+
+// Func adapts a pair of functions to a Component; nil functions do nothing
+type Func struct {
+	ComponentName string
+	StartFunc     func(ctx context.Context) error
+	StopFunc      func(ctx context.Context) error
+}
+
+// Name returns the component name
+func (f Func) Name() string {
+	return f.ComponentName
+}
+
+// Start calls StartFunc
+func (f Func) Start(ctx context.Context) error {
+	if f.StartFunc == nil {
+		return nil
+	}
+	return f.StartFunc(ctx)
+}
+
+// Stop calls StopFunc
+func (f Func) Stop(ctx context.Context) error {
+	if f.StopFunc == nil {
+		return nil
+	}
+	return f.StopFunc(ctx)
+}
+
+// runner is a Component around a blocking function: Start runs it in the background, Stop
+// cancels its context and waits for it to return
+type runner struct {
+	name   string
+	run    func(ctx context.Context) error
+	failed func(name string, err error)
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Run returns a Component that runs fn until it is stopped (fn must return once its context is
+// canceled). An error returned before Stop is reported to the Supervisor as a failure.
+func Run(name string, fn func(ctx context.Context) error) Component {
+	return &runner{name: name, run: fn}
+}
+
+// Loop returns a Component running a background loop until it is stopped. Unlike Run, fn may
+// return early when it has nothing (left) to do, e.g. a disabled feature, without it counting as
+// a failure.
+func Loop(name string, fn func(ctx context.Context)) Component {
+	return Run(name, func(ctx context.Context) error {
+		fn(ctx)
+		<-ctx.Done()
+		return nil
+	})
+}
+
+func (r *runner) Name() string {
+	return r.name
+}
+
+func (r *runner) Start(ctx context.Context) error {
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		err := r.run(runCtx)
+		if runCtx.Err() == nil && r.failed != nil {
+			if err == nil {
+				err = errors.New("exited unexpectedly")
+			}
+			r.failed(r.name, err)
+		}
+	}()
+	return nil
+}
+
+func (r *runner) Stop(ctx context.Context) error {
+	r.cancel()
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopWithin runs a blocking stop function, giving up waiting for it once ctx is done
+func StopWithin(ctx context.Context, stop func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type entry struct {
+	component Component
+	timeout   time.Duration
+}
+
+// Supervisor starts components in the order they were added and stops them in reverse
+type Supervisor struct {
+	mu      sync.Mutex
+	entries []entry
+	started int // entries[:started] are running
+
+	failures chan error
+}
+
+// New returns an empty Supervisor
+func New() *Supervisor {
+	return &Supervisor{failures: make(chan error, 1)}
+}
+
+// Add appends a component; it starts after every component added before it and stops before
+// them. stopTimeout 0 uses DefaultStopTimeout.
+func (s *Supervisor) Add(component Component, stopTimeout time.Duration) {
+	if stopTimeout <= 0 {
+		stopTimeout = DefaultStopTimeout
+	}
+	if r, ok := component.(*runner); ok {
+		r.failed = s.fail
+	}
+	s.mu.Lock()
+	s.entries = append(s.entries, entry{component: component, timeout: stopTimeout})
+	s.mu.Unlock()
+}
+
+// fail records the first runtime failure of a component
+func (s *Supervisor) fail(name string, err error) {
+	select {
+	case s.failures <- fmt.Errorf("%s: %w", name, err):
+	default:
+	}
+}
+
+// Failed delivers the first component that failed after starting
+func (s *Supervisor) Failed() <-chan error {
+	return s.failures
+}
+
+// Start starts every component in order. If one fails to start, the ones already running are
+// stopped again and the error is returned.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	entries := s.entries
+	s.mu.Unlock()
+
+	for i, e := range entries {
+		name := e.component.Name()
+		logging.DebugMethod("lifecycle", "Start", "Starting %s", name)
+		if err := e.component.Start(ctx); err != nil {
+			logging.Error("Lifecycle: Failed to start %s: %v", name, err)
+			s.Stop()
+			return fmt.Errorf("starting %s: %w", name, err)
+		}
+		s.mu.Lock()
+		s.started = i + 1
+		s.mu.Unlock()
+	}
+	logging.Info("Lifecycle: Started %d components", len(entries))
+	return nil
+}
+
+// Stop stops the running components in reverse start order, each within its timeout. A component
+// that does not stop in time is logged and left behind so the others still get their turn.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	running := s.entries[:s.started]
+	s.started = 0
+	s.mu.Unlock()
+
+	for i := len(running) - 1; i >= 0; i-- {
+		e := running[i]
+		name := e.component.Name()
+		logging.Info("Lifecycle: Stopping %s (timeout %v)", name, e.timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+		start := time.Now()
+		err := e.component.Stop(ctx)
+		cancel()
+		if err != nil {
+			logging.Warn("Lifecycle: %s did not stop cleanly after %v: %v", name, time.Since(start).Round(time.Millisecond), err)
+			continue
+		}
+		logging.DebugMethod("lifecycle", "Stop", "Stopped %s in %v", name, time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,147 @@
+// Package limits enforces ingest-side listener limits on a khatru relay: maximum open subscriptions
+// per connection, maximum filter size and maximum WebSocket message size.
+//
+// Usage:
+//
+//	limits.New(limits.Config{
+//	    MaxSubscriptions: 20,
+//	    MaxFilterItems:   500,
+//	    MaxMessageSize:   512000,
+//	}).Apply(relay)
+package limits
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Config holds listener limits. Zero values disable the corresponding limit.
+type Config struct {
+	// MaxSubscriptions is the number of concurrently open subscription IDs per WebSocket connection.
+	MaxSubscriptions int
+	// MaxFilterItems caps ids + authors + kinds + tag values in a single filter.
+	MaxFilterItems int
+	// MaxMessageSize is the largest WebSocket frame accepted from a client, in bytes (khatru closes the connection above it).
+	MaxMessageSize int64
+
+	// LogDebug is optional (e.g. connect to verbose logging).
+	LogDebug func(format string, args ...any)
+}
+
+type connSubs struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+// Limiter holds per-connection subscription state. Create with New, then Apply.
+type Limiter struct {
+	cfg Config
+
+	conns sync.Map // *khatru.WebSocket -> *connSubs
+
+	rejectedSubscriptions int64
+	rejectedFilters       int64
+}
+
+// New returns a Limiter for cfg.
+func New(cfg Config) *Limiter {
+	return &Limiter{cfg: cfg}
+}
+
+func (l *Limiter) logf(format string, args ...any) {
+	if l.cfg.LogDebug != nil {
+		l.cfg.LogDebug(format, args...)
+	}
+}
+
+// Apply sets the message size and registers RejectFilter / OnDisconnect hooks on relay.
+func (l *Limiter) Apply(relay *khatru.Relay) {
+	if relay == nil {
+		return
+	}
+	if l.cfg.MaxMessageSize > 0 {
+		relay.MaxMessageSize = l.cfg.MaxMessageSize
+	}
+	if l.cfg.MaxFilterItems > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, l.rejectLargeFilter)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, l.rejectLargeFilter)
+	}
+	if l.cfg.MaxSubscriptions > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, l.rejectTooManySubscriptions)
+		relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+			if ws := khatru.GetConnection(ctx); ws != nil {
+				l.conns.Delete(ws)
+			}
+		})
+	}
+}
+
+func (l *Limiter) rejectLargeFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	items := len(filter.IDs) + len(filter.Authors) + len(filter.Kinds)
+	for _, values := range filter.Tags {
+		items += len(values)
+	}
+	if items > l.cfg.MaxFilterItems {
+		atomic.AddInt64(&l.rejectedFilters, 1)
+		l.logf("limits rejected filter with %d items (max %d) from %s", items, l.cfg.MaxFilterItems, khatru.GetIP(ctx))
+		return true, fmt.Sprintf("blocked: filter too large (%d items, max %d)", items, l.cfg.MaxFilterItems)
+	}
+	return false, ""
+}
+
+// rejectTooManySubscriptions counts distinct subscription IDs per connection. The REQ context is
+// canceled when the client CLOSEs the subscription or disconnects, which releases the slot.
+func (l *Limiter) rejectTooManySubscriptions(ctx context.Context, filter nostr.Filter) (bool, string) {
+	ws := khatru.GetConnection(ctx)
+	id := khatru.GetSubscriptionID(ctx)
+	if ws == nil || id == "" {
+		return false, ""
+	}
+
+	actual, _ := l.conns.LoadOrStore(ws, &connSubs{ids: make(map[string]struct{})})
+	cs := actual.(*connSubs)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, exists := cs.ids[id]; exists {
+		// another filter of the same REQ
+		return false, ""
+	}
+	if len(cs.ids) >= l.cfg.MaxSubscriptions {
+		atomic.AddInt64(&l.rejectedSubscriptions, 1)
+		l.logf("limits rejected subscription %q from %s: %d open (max %d)", id, khatru.GetIP(ctx), len(cs.ids), l.cfg.MaxSubscriptions)
+		return true, fmt.Sprintf("blocked: too many subscriptions (max %d per connection, close one first)", l.cfg.MaxSubscriptions)
+	}
+	cs.ids[id] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		cs.mu.Lock()
+		delete(cs.ids, id)
+		cs.mu.Unlock()
+	}()
+	return false, ""
+}
+
+// GetStatsName returns the name for this stats provider
+func (l *Limiter) GetStatsName() string {
+	return "limits"
+}
+
+// GetStats returns limit configuration and rejection counters as a JsonEntity
+func (l *Limiter) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("max_subscriptions", json.NewJsonValue(l.cfg.MaxSubscriptions))
+	obj.Set("max_filter_items", json.NewJsonValue(l.cfg.MaxFilterItems))
+	obj.Set("max_message_size", json.NewJsonValue(l.cfg.MaxMessageSize))
+	obj.Set("rejected_subscriptions", json.NewJsonValue(atomic.LoadInt64(&l.rejectedSubscriptions)))
+	obj.Set("rejected_filters", json.NewJsonValue(atomic.LoadInt64(&l.rejectedFilters)))
+	return obj
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileConfig sends the log to a size-rotated file
+type FileConfig struct {
+	Path       string        // current file; rotated ones get .1, .2, ... (older = higher)
+	MaxSize    int64         // bytes after which the file is rotated (default 100 MiB)
+	MaxBackups int           // rotated files kept besides the current one (default 5)
+	MaxAge     time.Duration // rotated files older than this are deleted on rotation (0 = kept until MaxBackups)
+	Stderr     bool          // keep writing to stderr as well
+}
+
+// rotatingFile is an io.Writer appending to a file that is rotated once it reaches MaxSize
+type rotatingFile struct {
+	cfg  FileConfig
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+var (
+	outputMu sync.Mutex
+	output   *rotatingFile
+)
+
+// SetFile writes the log to the file described by cfg (and to stderr if cfg.Stderr) from now on
+func SetFile(cfg FileConfig) error {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 100 << 20
+	}
+	if cfg.MaxBackups < 0 {
+		cfg.MaxBackups = 0
+	}
+	rf := &rotatingFile{cfg: cfg}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	outputMu.Lock()
+	previous := output
+	output = rf
+	if cfg.Stderr {
+		log.SetOutput(io.MultiWriter(os.Stderr, rf))
+	} else {
+		log.SetOutput(rf)
+	}
+	outputMu.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+	return nil
+}
+
+// CloseFile flushes and closes the log file, sending the log back to stderr
+func CloseFile() {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if output == nil {
+		return
+	}
+	log.SetOutput(os.Stderr)
+	output.close()
+	output = nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file, rf.size = f, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if it would take the file over MaxSize. A failed rotation
+// keeps appending to the current file rather than losing lines.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return os.Stderr.Write(p)
+	}
+	if rf.size+int64(len(p)) > rf.cfg.MaxSize && rf.size > 0 {
+		if err := rf.rotateLocked(); err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] Logging: Failed to rotate %s: %v\n", rf.cfg.Path, err)
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotated returns the path of the i-th rotated file (0 = the current one)
+func (rf *rotatingFile) rotated(i int) string {
+	if i == 0 {
+		return rf.cfg.Path
+	}
+	return fmt.Sprintf("%s.%d", rf.cfg.Path, i)
+}
+
+// rotateLocked shifts every file one place up, dropping the oldest and those past MaxAge, and
+// starts a new current file
+func (rf *rotatingFile) rotateLocked() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+	os.Remove(rf.rotated(rf.cfg.MaxBackups))
+	for i := rf.cfg.MaxBackups - 1; i >= 0; i-- {
+		if err := os.Rename(rf.rotated(i), rf.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			// Reopen (and keep appending to) the current file
+			if openErr := rf.open(); openErr != nil {
+				return openErr
+			}
+			return err
+		}
+	}
+	if rf.cfg.MaxAge > 0 {
+		cutoff := time.Now().Add(-rf.cfg.MaxAge)
+		for i := 1; i <= rf.cfg.MaxBackups; i++ {
+			if info, err := os.Stat(rf.rotated(i)); err == nil && info.ModTime().Before(cutoff) {
+				os.Remove(rf.rotated(i))
+			}
+		}
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) close() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file != nil {
+		rf.file.Sync()
+		rf.file.Close()
+		rf.file = nil
+	}
+}
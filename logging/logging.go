@@ -0,0 +1,172 @@
+// Package logging provides leveled logging with granular verbose filters by module and
+// method. Filters can be changed at runtime (see /admin/logging) and support negative
+// entries to silence a noisy module or method while everything else stays verbose.
+package logging
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// filterSet is an immutable snapshot of the verbose configuration
+type filterSet struct {
+	spec     string
+	all      bool
+	include  map[string]bool
+	exclude  map[string]bool
+	anyDebug bool // at least one include filter (or all)
+}
+
+var (
+	mu      sync.RWMutex
+	filters = &filterSet{include: map[string]bool{}, exclude: map[string]bool{}}
+)
+
+// SetVerbose sets the verbose logging mode with granular filtering
+// Examples:
+//   - "" or "false": disable all verbose logging
+//   - "true" or "all": enable all verbose logging
+//   - "config,health": enable verbose for config and health modules
+//   - "broadcaster.addEventToCache,main": enable broadcaster.addEventToCache method and all of main module
+//   - "all,-broadcaster.addEventToCache": everything except one noisy method
+//   - "broadcaster,-broadcaster.publishToRelay": a module except one of its methods
+//
+// It is safe to call at any time; the new filters apply to the next log line.
+func SetVerbose(verboseStr string) {
+	fs := parseFilters(verboseStr)
+	mu.Lock()
+	filters = fs
+	mu.Unlock()
+}
+
+// GetVerbose returns the current filter specification in canonical form ("" when disabled)
+func GetVerbose() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return filters.spec
+}
+
+func parseFilters(verboseStr string) *filterSet {
+	fs := &filterSet{include: map[string]bool{}, exclude: map[string]bool{}}
+	verboseStr = strings.TrimSpace(verboseStr)
+	if verboseStr == "" || verboseStr == "false" {
+		return fs
+	}
+
+	// Parse comma-separated filters; "-name" (or "!name") excludes
+	for _, filter := range strings.Split(verboseStr, ",") {
+		filter = strings.TrimSpace(filter)
+		switch {
+		case filter == "":
+		case filter == "true" || filter == "all":
+			fs.all = true
+		case strings.HasPrefix(filter, "-") || strings.HasPrefix(filter, "!"):
+			if name := strings.TrimSpace(filter[1:]); name != "" {
+				fs.exclude[name] = true
+			}
+		default:
+			fs.include[filter] = true
+		}
+	}
+	fs.anyDebug = fs.all || len(fs.include) > 0
+
+	parts := []string{}
+	if fs.all {
+		parts = append(parts, "all")
+	}
+	parts = append(parts, sortedKeys(fs.include, "")...)
+	parts = append(parts, sortedKeys(fs.exclude, "-")...)
+	fs.spec = strings.Join(parts, ",")
+	return fs
+}
+
+func sortedKeys(m map[string]bool, prefix string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, prefix+k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsVerbose checks if verbose logging is enabled for a specific module or method.
+// The most specific filter wins: module.method beats module, which beats "all".
+func IsVerbose(module string, method string) bool {
+	mu.RLock()
+	fs := filters
+	mu.RUnlock()
+
+	if !fs.anyDebug {
+		return false
+	}
+
+	// Check module.method first
+	if method != "" {
+		fullName := module + "." + method
+		if fs.exclude[fullName] {
+			return false
+		}
+		if fs.include[fullName] {
+			return true
+		}
+	}
+
+	// Then the whole module
+	if fs.exclude[module] {
+		return false
+	}
+	if fs.include[module] {
+		return true
+	}
+
+	return fs.all
+}
+
+// VerboseEnabled reports whether any verbose logging is on, to skip expensive debug-only work
+func VerboseEnabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return filters.anyDebug
+}
+
+// DebugMethod logs debug messages for a specific module.method (only in verbose mode)
+func DebugMethod(module string, method string, format string, v ...interface{}) {
+	if IsVerbose(module, method) {
+		log.Printf("[DEBUG] "+module+"."+method+": "+format, v...)
+	}
+}
+
+// Debug logs debug messages (only with "all", unless excluded with "-debug")
+// Use DebugMethod instead for better granular control
+func Debug(format string, v ...interface{}) {
+	mu.RLock()
+	fs := filters
+	mu.RUnlock()
+	if fs.all && !fs.exclude["debug"] {
+		log.Printf("[DEBUG] "+format, v...)
+	}
+}
+
+// Info logs informational messages (always shown)
+func Info(format string, v ...interface{}) {
+	log.Printf("[INFO] "+format, v...)
+}
+
+// Warn logs warning messages (always shown)
+func Warn(format string, v ...interface{}) {
+	log.Printf("[WARN] "+format, v...)
+}
+
+// Error logs error messages (always shown)
+func Error(format string, v ...interface{}) {
+	log.Printf("[ERROR] "+format, v...)
+}
+
+// Fatal logs error messages and exits with status code 1
+func Fatal(format string, v ...interface{}) {
+	log.Printf("[FATAL] "+format, v...)
+	os.Exit(1)
+}
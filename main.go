@@ -5,14 +5,22 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"runtime"
 	"syscall"
 	"time"
 
+	"github.com/girino/nostr-brodcast-relay/broadcast"
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/buildinfo"
 	"github.com/girino/nostr-brodcast-relay/config"
+	"github.com/girino/nostr-brodcast-relay/crash"
+	"github.com/girino/nostr-brodcast-relay/lifecycle"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/pull"
 	"github.com/girino/nostr-brodcast-relay/relay"
-	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-brodcast-relay/stats"
 	json "github.com/girino/nostr-lib/json"
-	"github.com/girino/nostr-lib/logging"
 )
 
 func main() {
@@ -32,9 +40,26 @@ func main() {
 
 	// Set verbose mode in logging package
 	logging.SetVerbose(verbose)
+	if cfg.LogFile != "" {
+		if err := logging.SetFile(logging.FileConfig{
+			Path:       cfg.LogFile,
+			MaxSize:    cfg.LogMaxSize,
+			MaxBackups: cfg.LogMaxBackups,
+			MaxAge:     cfg.LogMaxAge,
+			Stderr:     cfg.LogStderr,
+		}); err != nil {
+			logging.Fatal("Cannot open log file %s: %v", cfg.LogFile, err)
+		}
+		defer logging.CloseFile()
+	}
+
+	// Recovered panics are reported (and posted to CRASH_WEBHOOK, if set) instead of exiting
+	crash.Configure(crash.Config{Webhook: cfg.CrashWebhook, Name: cfg.RelayName})
+	stats.Default().Register(crash.Default())
 
 	logging.Info("==============================================================")
 	logging.Info("=== BROADCAST RELAY STARTING ===")
+	logging.Info("=== Version %s (%s) ===", buildinfo.ShortVersion(), runtime.Version())
 	logging.Info("==============================================================")
 	logging.Info("")
 	logging.Info("Configuration loaded:")
@@ -46,34 +71,194 @@ func main() {
 	for i, relay := range cfg.MandatoryRelays {
 		logging.Debug("    %d. %s", i+1, relay)
 	}
+	if cfg.RelayImportURL != "" || cfg.RelayImportFile != "" {
+		logging.Info("  - Relay list import: url=%q file=%q (max %d, import only: %v)", cfg.RelayImportURL, cfg.RelayImportFile, cfg.RelayImportMax, cfg.RelayImportOnly)
+	}
+	if cfg.DiscoveryFollowsPubkey != "" {
+		logging.Info("  - Follow-graph discovery: %s (max %d relays)", cfg.DiscoveryFollowsPubkey, cfg.DiscoveryFollowsMaxRelays)
+	}
+	if len(cfg.FederationPeers) > 0 {
+		logging.Info("  - Federation: node %s with %d peers", cfg.FederationNodeID, len(cfg.FederationPeers))
+	}
 	logging.Info("  - Top N relays: %d", cfg.TopNRelays)
 	logging.Info("  - Relay port: %s", cfg.RelayPort)
 	logging.Info("  - Worker count: %d", cfg.WorkerCount)
 	logging.Info("  - Cache TTL: %v", cfg.CacheTTL)
+	if len(cfg.PullRelays) > 0 {
+		logging.Info("  - Pull relays: %d (authors: %d, kinds: %v)", len(cfg.PullRelays), len(cfg.PullAuthors), cfg.PullKinds)
+	}
+	if len(cfg.MirrorPubkeys) > 0 {
+		logging.Info("  - Mirrored authors: %d (kinds: %v, mirror only: %v)", len(cfg.MirrorPubkeys), cfg.MirrorKinds, cfg.MirrorOnly)
+	}
 	logging.Debug("  - Refresh interval: %v", cfg.RefreshInterval)
 	logging.Debug("  - Health check interval: %v", cfg.HealthCheckInterval)
 	logging.Debug("  - Initial timeout: %v", cfg.InitialTimeout)
 	logging.Debug("  - Success rate decay: %.2f", cfg.SuccessRateDecay)
+	logging.Debug("  - Max startup time: %v", cfg.MaxStartupTime)
 	logging.Info("")
 
 	// Initialize components
 	logging.Info("Initializing components...")
 
+	// DM relay lists are looked up on the seed relays unless configured otherwise
+	dmLookupRelays := cfg.DMLookupRelays
+	if len(dmLookupRelays) == 0 {
+		dmLookupRelays = cfg.SeedRelays
+	}
+	outboxLookupRelays := cfg.OutboxLookupRelays
+	if len(outboxLookupRelays) == 0 {
+		outboxLookupRelays = cfg.SeedRelays
+	}
+
+	scoreSnapshotFile := cfg.ScoreSnapshotFile
+	if cfg.TestMode {
+		scoreSnapshotFile = ""
+	}
+
 	// Create broadcast system configuration
 	broadcastConfig := &broadcast.Config{
-		TopNRelays:       cfg.TopNRelays,
-		SuccessRateDecay: cfg.SuccessRateDecay,
-		MandatoryRelays:  cfg.MandatoryRelays,
-		WorkerCount:      cfg.WorkerCount,
-		CacheTTL:         cfg.CacheTTL,
-		InitialTimeout:   cfg.InitialTimeout,
+		TopNRelays:          cfg.TopNRelays,
+		SuccessRateDecay:    cfg.SuccessRateDecay,
+		MandatoryRelays:     cfg.MandatoryRelays,
+		HealthCheckInterval: cfg.HealthCheckInterval,
+		WorkerCount:         cfg.WorkerCount,
+		CacheTTL:            cfg.CacheTTL,
+		InitialTimeout:      cfg.InitialTimeout,
+		Regions:             cfg.Regions,
+		RelaysPerRegion:     cfg.RelaysPerRegion,
+		ProbesEnabled:       cfg.ProbeToken != "",
+		ProbeMaxAge:         cfg.ProbeMaxAge,
+		TestMode:            cfg.TestMode,
+		// Outbound budget
+		OutboundConcurrency: cfg.OutboundConcurrency,
+		ProbeConcurrency:    cfg.ProbeConcurrency,
+		// Politeness
+		RelayMaxPerMinute:  cfg.RelayMaxPerMinute,
+		RelayRateOverrides: cfg.RelayRateOverrides,
+		RelayThrottleQueue: cfg.RelayThrottleQueue,
+		RateLimitedPause:   cfg.RateLimitedPause,
+		// Ingest lanes
+		LiveLaneWeight:  cfg.LiveLaneWeight,
+		IngestQueueSize: cfg.IngestQueueSize,
+		// Dedup cache policy
+		CacheKindTTLs:         cacheKindTTLs(cfg.CacheKindTTLs),
+		CacheExcludeEphemeral: cfg.CacheExcludeEphemeral,
+		// Fast path
+		RealtimeKinds:  cfg.RealtimeKinds,
+		RealtimeRelays: cfg.RealtimeRelays,
+		RealtimeQueue:  cfg.RealtimeQueue,
+		// Pause switch
+		StartPaused: cfg.BroadcastPaused,
+		// Flap damping
+		FlapThreshold: cfg.FlapThreshold,
+		FlapWindow:    cfg.FlapWindow,
+		FlapHoldDown:  cfg.FlapHoldDown,
+		// Scoring
+		ScoringStrategy:     cfg.ScoringStrategy,
+		ScoreWeightSuccess:  cfg.ScoreWeightSuccess,
+		ScoreWeightLatency:  cfg.ScoreWeightLatency,
+		ScoreWeightRecency:  cfg.ScoreWeightRecency,
+		ScoreWeightAttempts: cfg.ScoreWeightAttempts,
+		// Coverage
+		CoveragePenalty: cfg.CoveragePenalty,
+		// Tie-breaking
+		TopTieMargin: cfg.TopTieMargin,
+		// Canary scoring
+		CanaryScoreWeight: cfg.CanaryScoreWeight,
+		// Late OKs
+		LateOKWindow: cfg.LateOKWindow,
+		// Refused kinds
+		KindSchema:          cfg.KindSchema,
+		KindSchemaThreshold: cfg.KindSchemaThreshold,
+		KindSchemaExpiry:    cfg.KindSchemaExpiry,
+		KindSchemaFile:      cfg.KindSchemaFile,
+		// Maintenance windows
+		MaintenanceWindows:     cfg.MaintenanceWindows,
+		MaintenanceHistoryDays: cfg.MaintenanceHistoryDays,
+		MaintenanceMinDays:     cfg.MaintenanceMinDays,
+		MaintenanceFile:        cfg.MaintenanceFile,
+		// Kind success matrix
+		KindMatrixWindow: cfg.KindMatrixWindow,
+		// Discovery cap per event
+		MaxRelaysPerEvent: cfg.MaxRelaysPerEvent,
+		// Score snapshots (not in TEST_MODE: its relays and results are synthetic)
+		ScoreSnapshotFile:     scoreSnapshotFile,
+		ScoreSnapshotInterval: cfg.ScoreSnapshotInterval,
+		ScoreSnapshotMaxAge:   cfg.ScoreSnapshotMaxAge,
+		// Shared state store
+		StateFile: cfg.StateFile,
+		// Warm connections
+		ConnectionKeepWarm: cfg.ConnectionKeepWarm,
+		DialMode:           cfg.DialMode,
+		DialFallbackDelay:  cfg.DialFallbackDelay,
+		TorProxy:           cfg.TorProxy,
+		SkipOnionRelays:    cfg.SkipOnionRelays,
+		// NIP-11 requirements
+		RequirementsPolicy:  cfg.RelayRequirements,
+		RequirementsRefresh: cfg.RelayRequirementsRefresh,
+		RequirementsAllow:   cfg.RelayRequirementsAllow,
+		// NIP-11 consistency
+		ConsistencyCheck:         cfg.ConsistencyCheck,
+		ConsistencyProbeInterval: cfg.ConsistencyProbeInterval,
+		ConsistencyThreshold:     cfg.ConsistencyThreshold,
+		ConsistencyPenalty:       cfg.ConsistencyPenalty,
+		// Recent event ledger
+		LedgerSize:   cfg.LedgerSize,
+		LedgerMaxAge: cfg.LedgerMaxAge,
+		// Operator diversity
+		MaxRelaysPerOperator: cfg.MaxRelaysPerOperator,
+		// Per-event deadline
+		EventDeadline: cfg.EventBroadcastDeadline,
+		// Publish retries
+		PublishMaxAttempts:    cfg.PublishMaxAttempts,
+		PublishRetryBaseDelay: cfg.PublishRetryBaseDelay,
+		PublishRetryMaxDelay:  cfg.PublishRetryMaxDelay,
+		// Federation
+		FederationNodeID:   cfg.FederationNodeID,
+		FederationPeers:    cfg.FederationPeers,
+		FederationSecret:   cfg.FederationSecret,
+		FederationInterval: cfg.FederationInterval,
+		// Fallback endpoints
+		RelayFallbacks:  cfg.RelayFallbacks,
+		FallbackPlainWS: cfg.FallbackPlainWS,
+		// Community floor
+		CommunityRelays:         cfg.CommunityRelays,
+		CommunityFloor:          cfg.CommunityFloor,
+		CommunityMinSuccessRate: cfg.CommunityMinSuccessRate,
+		// Discovery sources
+		TopNSources:         cfg.TopNSources,
+		EvictSources:        cfg.RelayEvictSources,
+		EvictMinSuccessRate: cfg.RelayEvictMinSuccessRate,
+		// Adaptive worker pool
+		WorkerAutoscale:  cfg.WorkerAutoscale,
+		WorkerMin:        cfg.WorkerMin,
+		WorkerMax:        cfg.WorkerMax,
+		WorkerTargetWait: cfg.WorkerTargetWait,
+		// Overflow queue
+		MaxOverflowBytes: cfg.MaxOverflowBytes,
+		QueueJournalFile: cfg.QueueJournalFile,
+		// Sampled result logging
+		ResultLogSample: cfg.ResultLogSample,
+		ResultLogRates:  cfg.ResultLogRates,
+		// NIP-17 routing
+		DMRouting:       cfg.DMRouting,
+		DMLookupRelays:  dmLookupRelays,
+		DMRelayCacheTTL: cfg.DMRelayCacheTTL,
+		DMRelayFallback: cfg.DMRelayFallback,
+		// NIP-65 outbox routing
+		OutboxRouting:      cfg.OutboxRouting,
+		OutboxLookupRelays: outboxLookupRelays,
+		OutboxMaxRelays:    cfg.OutboxMaxRelays,
+		OutboxCacheTTL:     cfg.OutboxCacheTTL,
+	}
+	// NIP-42 to target relays requires a stable identity: a random key would change every restart
+	if cfg.TargetAuth {
+		broadcastConfig.TargetAuthKey = cfg.RelayPrivkey
 	}
 
 	// Create unified broadcast system
 	broadcastSystem := broadcast.NewBroadcastSystem(broadcastConfig)
 
-	// Get health checker from broadcast system
-	checker := broadcastSystem.GetHealthChecker()
 	logging.Info("")
 
 	// Add mandatory relays to the manager for tracking
@@ -82,10 +267,58 @@ func main() {
 		broadcastSystem.AddMandatoryRelays(cfg.MandatoryRelays)
 	}
 
-	// Initial relay discovery and testing
+	// Add regional relays so they are tested and ranked like discovered ones
+	for region, urls := range cfg.Regions {
+		logging.Info("Adding %d relays of region %s...", len(urls), region)
+		for _, url := range urls {
+			broadcastSystem.AddRelayIfNew(url, manager.SourceManual)
+		}
+	}
+
+	// Add community relays so they are tested and ranked for their reserved slots
+	if len(cfg.CommunityRelays) > 0 {
+		logging.Info("Adding %d community relays...", len(cfg.CommunityRelays))
+		for _, url := range cfg.CommunityRelays {
+			broadcastSystem.AddRelayIfNew(url, manager.SourceManual)
+		}
+	}
+
+	// Root context: canceled on SIGINT/SIGTERM and propagated to every background task
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Initial relay discovery and testing, bounded by MAX_STARTUP_TIME
 	logging.Info("========== PHASE 1: DISCOVERY & TESTING ==========")
-	ctx := context.Background()
-	broadcastSystem.DiscoverFromSeeds(ctx, cfg.SeedRelays)
+	startupCtx, cancelStartup := startupContext(ctx, cfg.MaxStartupTime)
+	imported := 0
+	for _, source := range []string{cfg.RelayImportFile, cfg.RelayImportURL} {
+		if source == "" {
+			continue
+		}
+		n, err := broadcastSystem.ImportRelays(startupCtx, source, cfg.RelayImportMax)
+		if err != nil {
+			logging.Warn("Relay list import from %s failed: %v", source, err)
+		}
+		imported += n
+	}
+	if cfg.RelayImportOnly && imported > 0 {
+		logging.Info("Skipping seed discovery: %d relays imported (RELAY_IMPORT_ONLY)", imported)
+	} else {
+		broadcastSystem.DiscoverFromSeeds(startupCtx, cfg.SeedRelays)
+	}
+	if cfg.DiscoveryFollowsPubkey != "" {
+		broadcastSystem.DiscoverFromFollows(startupCtx, cfg.SeedRelays, cfg.DiscoveryFollowsPubkey, cfg.DiscoveryFollowsMaxRelays)
+	}
+	startupErr := startupCtx.Err()
+	cancelStartup()
+	if ctx.Err() != nil {
+		logging.Info("Shutdown requested during startup, exiting")
+		return
+	}
+	if startupErr == context.DeadlineExceeded {
+		logging.Warn("Startup discovery exceeded MAX_STARTUP_TIME (%v), continuing with %d known relays",
+			cfg.MaxStartupTime, broadcastSystem.GetRelayCount())
+	}
 	logging.Info("")
 
 	// Mark manager as initialized to switch to exponential decay
@@ -106,30 +339,88 @@ func main() {
 	}
 	logging.Info("")
 
-	// Start periodic refresh
-	logging.Info("Starting periodic refresh background task...")
-	go startPeriodicRefresh(ctx, cfg, broadcastSystem)
-
-	// Start the broadcast system
-	logging.Info("Starting broadcast system...")
-	broadcastSystem.Start()
-
-	// Start the relay server
 	logging.Info("")
 	logging.Info("========== PHASE 3: STARTING RELAY SERVER ==========")
-	relayServer := relay.NewRelay(cfg, broadcastSystem, checker)
+	relayServer := relay.NewRelay(cfg, broadcastSystem)
 
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	// Components start in dependency order and stop in reverse: the HTTP server drains before
+	// pull mode, the relay's loops (canary, reporter, relay list...), the refresh loop, the
+	// broadcast loops (health checks, federation...) and the broadcaster behind them are stopped.
+	// The output components (receipt publisher, handshake log, media mirror) go last, once the
+	// broadcaster drained its queue.
+	supervisor := lifecycle.New()
+	for _, component := range relayServer.OutputComponents() {
+		supervisor.Add(component, 15*time.Second)
+	}
+	supervisor.Add(lifecycle.Func{
+		ComponentName: "broadcast",
+		StartFunc: func(ctx context.Context) error {
+			broadcastSystem.Start()
+			return nil
+		},
+		StopFunc: func(ctx context.Context) error {
+			return lifecycle.StopWithin(ctx, broadcastSystem.Stop)
+		},
+	}, 30*time.Second)
+	for _, component := range broadcastSystem.Components() {
+		supervisor.Add(component, 5*time.Second)
+	}
+	supervisor.Add(lifecycle.Run("discovery", func(ctx context.Context) error {
+		startPeriodicRefresh(ctx, cfg, broadcastSystem)
+		return nil
+	}), 5*time.Second)
+	for _, component := range relayServer.Components() {
+		supervisor.Add(component, 5*time.Second)
+	}
 
-	// Start relay in goroutine
-	go func() {
-		if err := relayServer.Start(); err != nil {
-			logging.Error("Relay server error: %v", err)
-			os.Exit(1)
-		}
-	}()
+	// Pull mode (optional): mirror upstream relays into the broadcast pipeline
+	pullCfg := pull.Config{
+		Relays:  cfg.PullRelays,
+		Authors: cfg.PullAuthors,
+		Kinds:   cfg.PullKinds,
+	}
+	if pullCfg.Enabled() && cfg.TestMode {
+		logging.Warn("Pull mode disabled in TEST_MODE")
+	} else if pullCfg.Enabled() {
+		logging.Info("Starting pull mode from %d upstream relays...", len(pullCfg.Relays))
+		puller := pull.New(pullCfg, relayServer.Ingest)
+		stats.Default().Register(puller)
+		supervisor.Add(lifecycle.Run("pull", func(ctx context.Context) error {
+			puller.Start(ctx)
+			<-ctx.Done()
+			return nil
+		}), 5*time.Second)
+	}
+
+	// Mirror mode (optional): follow authors on their own write relays
+	mirrorCfg := pull.MirrorConfig{
+		Pubkeys: cfg.MirrorPubkeys,
+		Kinds:   cfg.MirrorKinds,
+		Lookup:  cfg.MirrorLookupRelays,
+		Refresh: cfg.MirrorRefresh,
+	}
+	if len(mirrorCfg.Lookup) == 0 {
+		mirrorCfg.Lookup = cfg.SeedRelays
+	}
+	if mirrorCfg.Enabled() && cfg.TestMode {
+		logging.Warn("Mirror mode disabled in TEST_MODE")
+	} else if mirrorCfg.Enabled() {
+		logging.Info("Starting mirror mode for %d authors...", len(mirrorCfg.Pubkeys))
+		mirror := pull.NewMirror(mirrorCfg, relayServer.Ingest)
+		stats.Default().Register(mirror)
+		supervisor.Add(lifecycle.Run("mirror", func(ctx context.Context) error {
+			mirror.Run(ctx)
+			return nil
+		}), 5*time.Second)
+	}
+
+	// The relay server shuts down gracefully (up to 10s) once stopped
+	supervisor.Add(lifecycle.Run("http", relayServer.Start), 15*time.Second)
+
+	if err := supervisor.Start(ctx); err != nil {
+		logging.Error("Startup failed: %v", err)
+		os.Exit(1)
+	}
 
 	logging.Info("")
 	logging.Info("==============================================================")
@@ -140,15 +431,21 @@ func main() {
 	logging.Info("==============================================================")
 	logging.Info("")
 
-	// Wait for interrupt signal
-	<-sigChan
+	// Wait for interrupt signal or a component failure (e.g. the server cannot listen)
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+	case err := <-supervisor.Failed():
+		logging.Error("Component failed: %v", err)
+		exitCode = 1
+	}
+	stop()
 	logging.Info("")
 	logging.Info("==============================================================")
 	logging.Info("=== SHUTTING DOWN GRACEFULLY ===")
 	logging.Info("==============================================================")
 
-	// Stop the broadcast system
-	broadcastSystem.Stop()
+	supervisor.Stop()
 
 	// Print final stats
 	finalStats := broadcastSystem.GetStats()
@@ -179,9 +476,30 @@ func main() {
 	}
 	logging.Info("")
 	logging.Info("Goodbye!")
+	if exitCode != 0 {
+		logging.CloseFile()
+		os.Exit(exitCode)
+	}
 }
 
-func startPeriodicRefresh(ctx context.Context, cfg *config.Config, broadcastSystem *broadcast.BroadcastSystem) {
+// cacheKindTTLs converts config kind TTL overrides to the broadcaster's type
+func cacheKindTTLs(kindTTLs []config.KindTTL) []broadcaster.KindTTL {
+	result := make([]broadcaster.KindTTL, len(kindTTLs))
+	for i, kt := range kindTTLs {
+		result[i] = broadcaster.KindTTL{MinKind: kt.MinKind, MaxKind: kt.MaxKind, TTL: kt.TTL}
+	}
+	return result
+}
+
+// startupContext derives the startup phase context; a zero limit means no deadline
+func startupContext(ctx context.Context, limit time.Duration) (context.Context, context.CancelFunc) {
+	if limit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, limit)
+}
+
+func startPeriodicRefresh(ctx context.Context, cfg *config.Config, broadcastSystem broadcast.System) {
 	ticker := time.NewTicker(cfg.RefreshInterval)
 	defer ticker.Stop()
 
@@ -194,6 +512,10 @@ func startPeriodicRefresh(ctx context.Context, cfg *config.Config, broadcastSyst
 			logging.Debug("==============================================================")
 
 			broadcastSystem.DiscoverFromSeeds(ctx, cfg.SeedRelays)
+			if cfg.DiscoveryFollowsPubkey != "" {
+				broadcastSystem.DiscoverFromFollows(ctx, cfg.SeedRelays, cfg.DiscoveryFollowsPubkey, cfg.DiscoveryFollowsMaxRelays)
+			}
+			broadcastSystem.EvictRelays(ctx)
 
 			topRelays := broadcastSystem.GetTopRelays()
 			logging.Info("Refresh complete: %d top relays from %d total relays", len(topRelays), broadcastSystem.GetRelayCount())
@@ -0,0 +1,108 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// errForbiddenDestination refuses a download whose URL (or a redirect) leads to a non-public
+// address or a port that is not allowed
+var errForbiddenDestination = errors.New("forbidden destination")
+
+// reservedPrefixes are the non-public ranges netip's predicates do not cover
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+}
+
+// publicAddr reports whether addr is a public unicast address: not loopback, link-local (cloud
+// metadata at 169.254.169.254 included), private, unique local (fc00::/7) or otherwise reserved
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowedPorts returns the ports downloads may connect to: 80 and 443 plus extra
+func allowedPorts(extra []int) map[int]bool {
+	ports := map[int]bool{80: true, 443: true}
+	for _, port := range extra {
+		ports[port] = true
+	}
+	return ports
+}
+
+// checkURL refuses URLs that are not http(s) or name a port that is not allowed. The address
+// itself is checked when connecting, once resolved.
+func checkURL(u *url.URL, ports map[int]bool) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", errForbiddenDestination, u.Scheme)
+	}
+	if raw := u.Port(); raw != "" {
+		if port, err := strconv.Atoi(raw); err != nil || !ports[port] {
+			return fmt.Errorf("%w: port %s", errForbiddenDestination, raw)
+		}
+	}
+	return nil
+}
+
+// newDownloadClient returns the client fetching blobs from the URLs events point to. Those URLs
+// are untrusted: every connection, redirects included, is refused unless it goes to a public
+// address on an allowed port, checked after DNS resolution so a name cannot be rebound to an
+// internal address. Proxies from the environment are not used, as they would hide the address.
+func newDownloadClient(extraPorts []int) *http.Client {
+	ports := allowedPorts(extraPorts)
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errForbiddenDestination, address)
+			}
+			if !publicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: non-public address %s", errForbiddenDestination, addrPort.Addr())
+			}
+			if !ports[int(addrPort.Port())] {
+				return fmt.Errorf("%w: port %d", errForbiddenDestination, addrPort.Port())
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: 2 * time.Minute,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          10,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("stopped after 5 redirects")
+			}
+			return checkURL(req.URL, ports)
+		},
+	}
+}
@@ -0,0 +1,506 @@
+// Package mirror copies the media an event references to configured Blossom and NIP-96
+// servers once the event has been broadcast, so the content the event points to survives
+// its origin server. Only hash-addressed blobs are mirrored (the SHA-256 is needed to ask a
+// Blossom server for a mirror and to verify downloads), and every request is authorized with
+// an event signed by the relay key.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// kindBlossomAuth authorizes Blossom requests (BUD-01)
+	kindBlossomAuth = 24242
+	// kindHTTPAuth authorizes NIP-96 uploads (NIP-98)
+	kindHTTPAuth = 27235
+	// maxSeen bounds the blob/server pairs remembered to avoid mirroring a blob twice
+	maxSeen = 10000
+)
+
+var (
+	urlPattern  = regexp.MustCompile(`https?://[^\s"'<>]+`)
+	hashPattern = regexp.MustCompile(`([0-9a-f]{64})(\.[A-Za-z0-9]+)?$`)
+)
+
+// Config controls media mirroring
+type Config struct {
+	Blossom []string // Blossom server base URLs, asked to mirror blobs (BUD-04 PUT /mirror)
+	NIP96   []string // NIP-96 server base URLs, blobs are downloaded and uploaded to them
+	Kinds   []int    // event kinds whose media is mirrored
+	MaxSize int64    // largest blob downloaded for NIP-96 uploads, in bytes
+	Workers int      // concurrent mirror requests
+	// Ports besides 80 and 443 that blob downloads may connect to; downloads never reach
+	// non-public addresses
+	AllowedPorts []int
+}
+
+// Blob is a hash-addressed media file referenced by an event
+type Blob struct {
+	URL      string
+	Hash     string // hex SHA-256
+	MimeType string // may be empty
+}
+
+type job struct {
+	blob    Blob
+	server  string
+	blossom bool // false: NIP-96
+}
+
+type serverCounts struct {
+	ok     int64
+	failed int64
+}
+
+// Mirror queues and performs mirror requests; it implements broadcaster.BroadcastReporter
+type Mirror struct {
+	cfg       Config
+	secretKey string
+	kinds     map[int]bool
+	client    *http.Client // configured servers (trusted)
+	downloads *http.Client // blob URLs taken from events (untrusted, see newDownloadClient)
+	queue     chan job
+
+	mu        sync.Mutex
+	seen      map[string]bool // hash + " " + server
+	seenOrder []string
+	servers   map[string]*serverCounts
+	nip96API  map[string]string // server -> api_url from its nip96.json
+
+	queued     int64
+	mirrored   int64
+	failed     int64
+	dropped    int64
+	duplicates int64
+}
+
+// New returns a Mirror signing requests with secretKey (hex); Run performs the mirrors
+func New(cfg Config, secretKey string) *Mirror {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 2
+	}
+	logging.DebugMethod("mirror", "New", "Initializing media mirror: blossom=%d, nip96=%d, kinds=%v, workers=%d",
+		len(cfg.Blossom), len(cfg.NIP96), cfg.Kinds, cfg.Workers)
+
+	m := &Mirror{
+		cfg:       cfg,
+		secretKey: secretKey,
+		kinds:     make(map[int]bool, len(cfg.Kinds)),
+		client:    &http.Client{Timeout: 2 * time.Minute},
+		downloads: newDownloadClient(cfg.AllowedPorts),
+		queue:     make(chan job, 1000),
+		seen:      make(map[string]bool),
+		servers:   make(map[string]*serverCounts),
+		nip96API:  make(map[string]string),
+	}
+	for _, kind := range cfg.Kinds {
+		m.kinds[kind] = true
+	}
+	return m
+}
+
+// Run performs the queued mirrors with cfg.Workers workers until ctx is canceled, then waits for
+// the mirrors in progress; the jobs still queued are dropped
+func (m *Mirror) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.worker(ctx)
+		}()
+	}
+	wg.Wait()
+	if left := len(m.queue); left > 0 {
+		atomic.AddInt64(&m.dropped, int64(left))
+		logging.Info("Mirror: Stopped with %d mirrors still queued", left)
+	}
+}
+
+// BroadcastPlanned is a no-op; media is mirrored once the event is out
+func (m *Mirror) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted queues the event's media for every mirror server
+func (m *Mirror) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	if !m.kinds[report.Event.Kind] {
+		return
+	}
+	for _, blob := range ExtractBlobs(report.Event) {
+		for _, server := range m.cfg.Blossom {
+			m.enqueue(job{blob: blob, server: server, blossom: true})
+		}
+		for _, server := range m.cfg.NIP96 {
+			m.enqueue(job{blob: blob, server: server})
+		}
+	}
+}
+
+func (m *Mirror) enqueue(j job) {
+	key := j.blob.Hash + " " + j.server
+	m.mu.Lock()
+	if m.seen[key] {
+		m.mu.Unlock()
+		atomic.AddInt64(&m.duplicates, 1)
+		return
+	}
+	m.seen[key] = true
+	m.seenOrder = append(m.seenOrder, key)
+	if len(m.seenOrder) > maxSeen {
+		delete(m.seen, m.seenOrder[0])
+		m.seenOrder = m.seenOrder[1:]
+	}
+	m.mu.Unlock()
+
+	select {
+	case m.queue <- j:
+		atomic.AddInt64(&m.queued, 1)
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+		logging.DebugMethod("mirror", "enqueue", "Queue full, dropping mirror of %s to %s", j.blob.Hash, j.server)
+	}
+}
+
+// ExtractBlobs returns the hash-addressed media referenced by event: NIP-92 imeta tags,
+// NIP-94 url/x tags and Blossom-style URLs (ending in the blob's SHA-256) in the content
+func ExtractBlobs(event *nostr.Event) []Blob {
+	blobs := []Blob{}
+	seen := make(map[string]bool)
+	add := func(blob Blob) {
+		if blob.Hash == "" {
+			blob.Hash = hashFromURL(blob.URL)
+		}
+		if blob.URL == "" || blob.Hash == "" || seen[blob.Hash] {
+			return
+		}
+		seen[blob.Hash] = true
+		blobs = append(blobs, blob)
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "imeta" {
+			blob := Blob{}
+			for _, entry := range tag[1:] {
+				key, value, _ := strings.Cut(entry, " ")
+				switch key {
+				case "url":
+					blob.URL = value
+				case "x":
+					blob.Hash = strings.ToLower(value)
+				case "m":
+					blob.MimeType = value
+				}
+			}
+			add(blob)
+		}
+	}
+
+	if event.Kind == 1063 {
+		blob := Blob{}
+		if tag := event.Tags.GetFirst([]string{"url", ""}); tag != nil {
+			blob.URL = (*tag)[1]
+		}
+		if tag := event.Tags.GetFirst([]string{"x", ""}); tag != nil {
+			blob.Hash = strings.ToLower((*tag)[1])
+		}
+		if tag := event.Tags.GetFirst([]string{"m", ""}); tag != nil {
+			blob.MimeType = (*tag)[1]
+		}
+		add(blob)
+	}
+
+	for _, url := range urlPattern.FindAllString(event.Content, -1) {
+		add(Blob{URL: strings.TrimRight(url, ".,;:!?)")})
+	}
+	return blobs
+}
+
+// hashFromURL returns the SHA-256 a Blossom-style URL ends with, or ""
+func hashFromURL(url string) string {
+	url, _, _ = strings.Cut(url, "?")
+	match := hashPattern.FindStringSubmatch(strings.ToLower(path.Base(url)))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+func (m *Mirror) worker(ctx context.Context) {
+	for ctx.Err() == nil {
+		var j job
+		select {
+		case <-ctx.Done():
+			return
+		case j = <-m.queue:
+		}
+
+		var err error
+		if j.blossom {
+			err = m.mirrorBlossom(j.blob, j.server)
+		} else {
+			err = m.mirrorNIP96(j.blob, j.server)
+		}
+
+		m.mu.Lock()
+		counts, ok := m.servers[j.server]
+		if !ok {
+			counts = &serverCounts{}
+			m.servers[j.server] = counts
+		}
+		if err == nil {
+			counts.ok++
+		} else {
+			counts.failed++
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			atomic.AddInt64(&m.failed, 1)
+			logging.DebugMethod("mirror", "worker", "Failed to mirror %s to %s: %v", j.blob.URL, j.server, err)
+			continue
+		}
+		atomic.AddInt64(&m.mirrored, 1)
+		logging.DebugMethod("mirror", "worker", "Mirrored %s to %s", j.blob.Hash, j.server)
+	}
+}
+
+// authHeader signs an authorization event and encodes it as a "Nostr <base64>" header value
+func (m *Mirror) authHeader(kind int, content string, tags nostr.Tags) (string, error) {
+	auth := &nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: content, Tags: tags}
+	if err := auth.Sign(m.secretKey); err != nil {
+		return "", err
+	}
+	raw, err := auth.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// mirrorBlossom asks server to fetch the blob itself (BUD-04)
+func (m *Mirror) mirrorBlossom(blob Blob, server string) error {
+	expiration := strconv.FormatInt(time.Now().Add(5*time.Minute).Unix(), 10)
+	auth, err := m.authHeader(kindBlossomAuth, "Mirror "+blob.Hash, nostr.Tags{
+		{"t", "upload"},
+		{"x", blob.Hash},
+		{"expiration", expiration},
+	})
+	if err != nil {
+		return err
+	}
+	body, err := stdjson.Marshal(map[string]string{"url": blob.URL})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, server+"/mirror", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", auth)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, resp.Header.Get("X-Reason"))
+	}
+
+	var descriptor struct {
+		SHA256 string `json:"sha256"`
+	}
+	if err := stdjson.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&descriptor); err == nil &&
+		descriptor.SHA256 != "" && descriptor.SHA256 != blob.Hash {
+		return fmt.Errorf("server stored %s, expected %s", descriptor.SHA256, blob.Hash)
+	}
+	return nil
+}
+
+// mirrorNIP96 downloads the blob, verifies its hash and uploads it to server's NIP-96 API
+func (m *Mirror) mirrorNIP96(blob Blob, server string) error {
+	apiURL, err := m.nip96APIURL(server)
+	if err != nil {
+		return err
+	}
+	data, mimeType, err := m.download(blob)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("size", strconv.Itoa(len(data)))
+	form.WriteField("content_type", mimeType)
+	part, err := form.CreateFormFile("file", blob.Hash+path.Ext(stripQuery(blob.URL)))
+	if err != nil {
+		return err
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	payload := sha256.Sum256(body.Bytes())
+	auth, err := m.authHeader(kindHTTPAuth, "", nostr.Tags{
+		{"u", apiURL},
+		{"method", http.MethodPost},
+		{"payload", hex.EncodeToString(payload[:])},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, apiURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", auth)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// stripQuery drops the query string so path.Ext sees the file name
+func stripQuery(url string) string {
+	url, _, _ = strings.Cut(url, "?")
+	return url
+}
+
+// nip96APIURL resolves (once) the upload endpoint a NIP-96 server advertises
+func (m *Mirror) nip96APIURL(server string) (string, error) {
+	m.mu.Lock()
+	apiURL, ok := m.nip96API[server]
+	m.mu.Unlock()
+	if ok {
+		return apiURL, nil
+	}
+
+	resp, err := m.client.Get(server + "/.well-known/nostr/nip96.json")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("nip96.json: %s", resp.Status)
+	}
+	var info struct {
+		APIURL string `json:"api_url"`
+	}
+	if err := stdjson.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info); err != nil {
+		return "", fmt.Errorf("nip96.json: %w", err)
+	}
+	if info.APIURL == "" {
+		return "", fmt.Errorf("nip96.json: no api_url")
+	}
+
+	m.mu.Lock()
+	m.nip96API[server] = info.APIURL
+	m.mu.Unlock()
+	return info.APIURL, nil
+}
+
+// download fetches blob up to MaxSize and checks it against its hash. Only public addresses on
+// allowed ports are reached, redirects included.
+func (m *Mirror) download(blob Blob) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blob.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkURL(req.URL, allowedPorts(m.cfg.AllowedPorts)); err != nil {
+		return nil, "", err
+	}
+	resp, err := m.downloads.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, m.cfg.MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > m.cfg.MaxSize {
+		return nil, "", fmt.Errorf("blob larger than %d bytes", m.cfg.MaxSize)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != blob.Hash {
+		return nil, "", fmt.Errorf("download does not match hash %s", blob.Hash)
+	}
+
+	mimeType := blob.MimeType
+	if mimeType == "" {
+		mimeType = resp.Header.Get("Content-Type")
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	return data, mimeType, nil
+}
+
+// GetStatsName returns the name for this stats provider
+func (m *Mirror) GetStatsName() string {
+	return "mirror"
+}
+
+// GetStats returns mirror statistics as a JsonEntity
+func (m *Mirror) GetStats() json.JsonEntity {
+	serversObj := json.NewJsonObject()
+	m.mu.Lock()
+	for _, server := range append(append([]string{}, m.cfg.Blossom...), m.cfg.NIP96...) {
+		counts := m.servers[server]
+		if counts == nil {
+			counts = &serverCounts{}
+		}
+		serverObj := json.NewJsonObject()
+		serverObj.Set("ok", json.NewJsonValue(counts.ok))
+		serverObj.Set("failed", json.NewJsonValue(counts.failed))
+		serversObj.Set(server, serverObj)
+	}
+	m.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("queued", json.NewJsonValue(atomic.LoadInt64(&m.queued)))
+	obj.Set("queue_size", json.NewJsonValue(len(m.queue)))
+	obj.Set("mirrored", json.NewJsonValue(atomic.LoadInt64(&m.mirrored)))
+	obj.Set("failed", json.NewJsonValue(atomic.LoadInt64(&m.failed)))
+	obj.Set("dropped", json.NewJsonValue(atomic.LoadInt64(&m.dropped)))
+	obj.Set("duplicates", json.NewJsonValue(atomic.LoadInt64(&m.duplicates)))
+	obj.Set("servers", serversObj)
+	return obj
+}
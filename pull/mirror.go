@@ -0,0 +1,225 @@
+package pull
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// kindRelayList is the NIP-65 relay list kind
+const kindRelayList = 10002
+
+// mirrorLookupTimeout bounds one fetch of the mirrored authors' relay lists
+const mirrorLookupTimeout = 30 * time.Second
+
+// MirrorConfig selects the authors to mirror from their own write relays
+type MirrorConfig struct {
+	Pubkeys   []string      // hex pubkeys whose events are mirrored
+	Kinds     []int         // empty means any kind
+	Lookup    []string      // relays the NIP-65 lists are fetched from, and used for authors without one
+	MaxRelays int           // write relays subscribed per author (default 8)
+	Refresh   time.Duration // how often lists are re-fetched and subscriptions renewed (default 6h)
+}
+
+// Enabled reports whether there is anyone to mirror
+func (c MirrorConfig) Enabled() bool {
+	return len(c.Pubkeys) > 0 && len(c.Lookup) > 0
+}
+
+// Mirror follows a set of authors on the write relays of their NIP-65 lists (the outbox model)
+// and hands their live events to Handler, so the relay rebroadcasts them even if they never
+// publish here. Subscriptions are grouped per relay, asking each only for the authors writing there.
+type Mirror struct {
+	cfg     MirrorConfig
+	puller  *Puller // verification, handler and counters shared with pull mode
+	authors map[string]bool
+
+	mu          sync.Mutex
+	writeRelays map[string][]string // pubkey -> write relays of its latest list
+	plan        map[string][]string // relay URL -> authors subscribed there
+	refreshedAt time.Time
+
+	refreshes   int64
+	lookupFails int64
+}
+
+// NewMirror returns a Mirror. Call Run to begin subscribing.
+func NewMirror(cfg MirrorConfig, handler Handler) *Mirror {
+	if cfg.MaxRelays <= 0 {
+		cfg.MaxRelays = 8
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = 6 * time.Hour
+	}
+	logging.DebugMethod("pull", "NewMirror", "Initializing mirror: authors=%d, kinds=%v, lookup relays=%d",
+		len(cfg.Pubkeys), cfg.Kinds, len(cfg.Lookup))
+	authors := make(map[string]bool, len(cfg.Pubkeys))
+	for _, pk := range cfg.Pubkeys {
+		authors[pk] = true
+	}
+	return &Mirror{
+		cfg:         cfg,
+		authors:     authors,
+		puller:      New(Config{Authors: cfg.Pubkeys, Kinds: cfg.Kinds}, handler),
+		writeRelays: make(map[string][]string),
+	}
+}
+
+// Run subscribes to the authors' write relays and renews the subscriptions with fresh relay
+// lists every Refresh, until ctx is canceled
+func (m *Mirror) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.Refresh)
+	defer ticker.Stop()
+	for {
+		plan := m.refresh(ctx)
+		subCtx, cancel := context.WithCancel(ctx)
+		m.subscribe(subCtx, plan)
+
+		select {
+		case <-ctx.Done():
+			cancel()
+			logging.DebugMethod("pull", "Mirror.Run", "Mirror subscriptions stopped")
+			return
+		case <-ticker.C:
+			cancel()
+		}
+	}
+}
+
+// refresh fetches the authors' latest relay lists and returns relay -> authors. Authors whose
+// list cannot be found keep the relays last seen, or fall back to the lookup relays.
+func (m *Mirror) refresh(ctx context.Context) map[string][]string {
+	lists := m.fetchLists(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pubkey, relays := range lists {
+		m.writeRelays[pubkey] = relays
+	}
+	plan := make(map[string][]string)
+	for _, pubkey := range m.cfg.Pubkeys {
+		relays := m.writeRelays[pubkey]
+		if len(relays) == 0 {
+			relays = m.cfg.Lookup
+		}
+		for _, url := range relays {
+			plan[url] = append(plan[url], pubkey)
+		}
+	}
+	m.plan = plan
+	m.refreshedAt = time.Now()
+	atomic.AddInt64(&m.refreshes, 1)
+	logging.Info("Mirror: Following %d authors on %d relays (%d with a relay list)", len(m.cfg.Pubkeys), len(plan), len(m.writeRelays))
+	return plan
+}
+
+// fetchLists returns the write relays of the latest kind 10002 event of each author found
+func (m *Mirror) fetchLists(ctx context.Context) map[string][]string {
+	ctx, cancel := context.WithTimeout(ctx, mirrorLookupTimeout)
+	defer cancel()
+	pool := nostr.NewSimplePool(ctx)
+	defer pool.Close("mirror lookup done")
+
+	latest := make(map[string]*nostr.Event)
+	filter := nostr.Filter{Kinds: []int{kindRelayList}, Authors: m.cfg.Pubkeys}
+	for ie := range pool.FetchMany(ctx, m.cfg.Lookup, filter) {
+		if prev := latest[ie.PubKey]; prev == nil || ie.CreatedAt > prev.CreatedAt {
+			latest[ie.PubKey] = ie.Event
+		}
+	}
+	if len(latest) == 0 {
+		atomic.AddInt64(&m.lookupFails, 1)
+		logging.Warn("Mirror: No relay list found for any of the %d mirrored authors", len(m.cfg.Pubkeys))
+	}
+
+	lists := make(map[string][]string, len(latest))
+	for pubkey, event := range latest {
+		if relays := m.writeRelaysOf(event); len(relays) > 0 {
+			lists[pubkey] = relays
+		}
+	}
+	return lists
+}
+
+// writeRelaysOf returns the write relays of a kind 10002 event: r tags without a marker or
+// marked "write", at most MaxRelays
+func (m *Mirror) writeRelaysOf(event *nostr.Event) []string {
+	var relays []string
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "r" || len(tag) >= 3 && tag[2] != "" && tag[2] != "write" {
+			continue
+		}
+		url := strings.TrimSuffix(strings.TrimSpace(tag[1]), "/")
+		if !strings.HasPrefix(url, "wss://") && !strings.HasPrefix(url, "ws://") || seen[url] {
+			continue
+		}
+		seen[url] = true
+		relays = append(relays, url)
+		if len(relays) == m.cfg.MaxRelays {
+			break
+		}
+	}
+	return relays
+}
+
+// subscribe opens one live subscription per relay for the authors writing there; they close
+// when ctx is canceled
+func (m *Mirror) subscribe(ctx context.Context, plan map[string][]string) {
+	pool := nostr.NewSimplePool(ctx)
+	since := nostr.Now() // live events only, history is not re-amplified
+	for url, authors := range plan {
+		filter := nostr.Filter{Authors: authors, Kinds: m.cfg.Kinds, Since: &since}
+		events := pool.SubscribeMany(ctx, []string{url}, filter)
+		go func() {
+			for ie := range events {
+				if !m.authors[ie.PubKey] {
+					continue // the relay ignored the filter
+				}
+				m.puller.handle(ctx, ie)
+			}
+		}()
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (m *Mirror) GetStatsName() string {
+	return "mirror"
+}
+
+// GetStats returns mirror statistics as a JsonEntity
+func (m *Mirror) GetStats() json.JsonEntity {
+	m.mu.Lock()
+	urls := make([]string, 0, len(m.plan))
+	for url := range m.plan {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	relaysObj := json.NewJsonObject()
+	for _, url := range urls {
+		relaysObj.Set(url, json.NewJsonValue(len(m.plan[url])))
+	}
+	withList, refreshedAt := len(m.writeRelays), m.refreshedAt
+	m.mu.Unlock()
+
+	p := m.puller
+	obj := json.NewJsonObject()
+	obj.Set("authors", json.NewJsonValue(len(m.cfg.Pubkeys)))
+	obj.Set("authors_with_relay_list", json.NewJsonValue(withList))
+	obj.Set("refreshes", json.NewJsonValue(atomic.LoadInt64(&m.refreshes)))
+	obj.Set("lookup_failures", json.NewJsonValue(atomic.LoadInt64(&m.lookupFails)))
+	obj.Set("refreshed_at", json.NewJsonValue(refreshedAt.Unix()))
+	obj.Set("received", json.NewJsonValue(atomic.LoadInt64(&p.received)))
+	obj.Set("accepted", json.NewJsonValue(atomic.LoadInt64(&p.accepted)))
+	obj.Set("rejected", json.NewJsonValue(atomic.LoadInt64(&p.rejected)))
+	obj.Set("invalid_signature", json.NewJsonValue(atomic.LoadInt64(&p.badSigned)))
+	obj.Set("relays", relaysObj)
+	return obj
+}
@@ -0,0 +1,118 @@
+// Package pull subscribes to upstream relays and feeds the events it receives into the
+// broadcast pipeline, turning the relay into a mirror/repeater for a configured filter, or
+// (Mirror) for a set of authors followed on their own NIP-65 write relays.
+package pull
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Config selects which upstream relays to subscribe to and what to ask them for.
+type Config struct {
+	Relays  []string
+	Authors []string // hex pubkeys; empty means any author
+	Kinds   []int    // empty means any kind
+}
+
+// Enabled reports whether pull mode has something to subscribe to.
+func (c Config) Enabled() bool {
+	return len(c.Relays) > 0
+}
+
+// Handler receives each verified upstream event; it returns false if the event was not accepted (e.g. duplicate).
+type Handler func(ctx context.Context, event *nostr.Event) bool
+
+// Puller keeps a live subscription open on the upstream relays and hands events to Handler.
+type Puller struct {
+	cfg     Config
+	handler Handler
+
+	received  int64
+	accepted  int64
+	rejected  int64
+	badSigned int64
+}
+
+// New returns a Puller. Call Start to begin subscribing.
+func New(cfg Config, handler Handler) *Puller {
+	logging.DebugMethod("pull", "New", "Initializing pull mode: relays=%d, authors=%d, kinds=%v", len(cfg.Relays), len(cfg.Authors), cfg.Kinds)
+	return &Puller{
+		cfg:     cfg,
+		handler: handler,
+	}
+}
+
+// Start opens the upstream subscription in the background; it stops when ctx is canceled.
+func (p *Puller) Start(ctx context.Context) {
+	filter := nostr.Filter{
+		Authors: p.cfg.Authors,
+		Kinds:   p.cfg.Kinds,
+		Since:   ptrTimestamp(nostr.Now()), // live events only, history is not re-amplified
+	}
+
+	pool := nostr.NewSimplePool(ctx)
+	events := pool.SubscribeMany(ctx, append([]string(nil), p.cfg.Relays...), filter)
+	logging.Info("Pull: Subscribed to %d upstream relays", len(p.cfg.Relays))
+
+	go p.run(ctx, events)
+}
+
+func (p *Puller) run(ctx context.Context, events chan nostr.RelayEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			logging.DebugMethod("pull", "run", "Pull subscription stopped")
+			return
+		case ie, ok := <-events:
+			if !ok {
+				logging.Warn("Pull: Upstream subscription closed by all relays")
+				return
+			}
+			p.handle(ctx, ie)
+		}
+	}
+}
+
+func (p *Puller) handle(ctx context.Context, ie nostr.RelayEvent) {
+	atomic.AddInt64(&p.received, 1)
+	event := ie.Event
+
+	// Upstream relays are not trusted: verify before we amplify anything
+	if ok, err := event.CheckSignature(); !ok || err != nil {
+		atomic.AddInt64(&p.badSigned, 1)
+		logging.DebugMethod("pull", "handle", "Dropping event %s from %s: invalid signature", event.ID, ie.Relay.URL)
+		return
+	}
+
+	if p.handler(ctx, event) {
+		atomic.AddInt64(&p.accepted, 1)
+		logging.DebugMethod("pull", "handle", "Pulled event %s (kind %d) from %s", event.ID, event.Kind, ie.Relay.URL)
+	} else {
+		atomic.AddInt64(&p.rejected, 1)
+	}
+}
+
+func ptrTimestamp(t nostr.Timestamp) *nostr.Timestamp {
+	return &t
+}
+
+// GetStatsName returns the name for this stats provider
+func (p *Puller) GetStatsName() string {
+	return "pull"
+}
+
+// GetStats returns pull-mode statistics as a JsonEntity
+func (p *Puller) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("upstream_relays", json.NewJsonValue(len(p.cfg.Relays)))
+	obj.Set("received", json.NewJsonValue(atomic.LoadInt64(&p.received)))
+	obj.Set("accepted", json.NewJsonValue(atomic.LoadInt64(&p.accepted)))
+	obj.Set("rejected", json.NewJsonValue(atomic.LoadInt64(&p.rejected)))
+	obj.Set("invalid_signature", json.NewJsonValue(atomic.LoadInt64(&p.badSigned)))
+	return obj
+}
@@ -0,0 +1,222 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/policies"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// burstTick is how often the ingest rate is measured and compared with the baseline
+	burstTick = 10 * time.Second
+	// burstWarmupTicks is how many measurements the baseline needs before bursts are declared
+	burstWarmupTicks = 30
+)
+
+// BurstConfig drives a BurstClamp. Factor 0 disables it.
+type BurstConfig struct {
+	// Factor is the current/baseline ingest rate ratio that starts a clamp (e.g. 10).
+	Factor float64
+	// Baseline is the horizon of the rolling (exponentially weighted) baseline rate. Default 1h.
+	Baseline time.Duration
+	// MinRate is the ingest rate, in events per second, below which no burst is declared, so a
+	// quiet relay is not clamped over a handful of events.
+	MinRate float64
+	// Calm is how long the rate must stay within 2x the baseline before the clamp is lifted. Default 2m.
+	Calm time.Duration
+
+	// Stricter limits applied while clamped; disabled buckets are not applied.
+	EventIP     Bucket
+	EventPubKey Bucket
+
+	// OnClamp is called when a clamp starts or ends, with the rates (events/s) that decided it; optional.
+	OnClamp func(active bool, rate, baseline float64)
+	// LogDebug is optional (e.g. connect to verbose logging).
+	LogDebug func(format string, args ...any)
+}
+
+// BurstClamp compares the event ingest rate with its rolling baseline and, during bursts of
+// Factor times the baseline or more, applies temporary stricter per-IP and per-pubkey event
+// limits, lifting them once traffic has been back to normal for Calm. Create with NewBurstClamp,
+// then Apply.
+type BurstClamp struct {
+	cfg BurstConfig
+
+	ipLimiter     func(ctx context.Context, event *nostr.Event) (bool, string)
+	pubkeyLimiter func(ctx context.Context, event *nostr.Event) (bool, string)
+
+	events  int64 // received since the last tick
+	active  atomic.Bool
+	clamped int64 // events rejected by the clamp
+
+	mu          sync.Mutex
+	rate        float64 // events/s over the last tick
+	baseline    float64 // events/s, frozen while clamped
+	samples     int
+	since       time.Time // clamp start
+	calmSince   time.Time
+	clamps      int64
+	lastStarted time.Time
+	lastEnded   time.Time
+	peakRate    float64 // highest rate of the current or last clamp
+}
+
+// NewBurstClamp returns a BurstClamp, or nil if cfg.Factor is not positive
+func NewBurstClamp(cfg BurstConfig) *BurstClamp {
+	if cfg.Factor <= 0 {
+		return nil
+	}
+	if cfg.Baseline <= 0 {
+		cfg.Baseline = time.Hour
+	}
+	if cfg.Calm <= 0 {
+		cfg.Calm = 2 * time.Minute
+	}
+	b := &BurstClamp{cfg: cfg}
+	if cfg.EventIP.Enabled() {
+		b.ipLimiter = policies.EventIPRateLimiter(cfg.EventIP.Tokens, cfg.EventIP.Interval, cfg.EventIP.Max)
+	}
+	if cfg.EventPubKey.Enabled() {
+		b.pubkeyLimiter = policies.EventPubKeyRateLimiter(cfg.EventPubKey.Tokens, cfg.EventPubKey.Interval, cfg.EventPubKey.Max)
+	}
+	return b
+}
+
+func (b *BurstClamp) logf(format string, args ...any) {
+	if b.cfg.LogDebug != nil {
+		b.cfg.LogDebug(format, args...)
+	}
+}
+
+// Apply counts every event offered to relay (ahead of the other RejectEvent hooks) and starts
+// the rate measurement. Safe to call once per relay; a nil BurstClamp does nothing.
+func (b *BurstClamp) Apply(relay *khatru.Relay) {
+	if b == nil || relay == nil {
+		return
+	}
+	relay.RejectEvent = append([]func(context.Context, *nostr.Event) (bool, string){b.rejectEvent}, relay.RejectEvent...)
+	go b.measure()
+}
+
+func (b *BurstClamp) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	atomic.AddInt64(&b.events, 1)
+	if !b.active.Load() {
+		return false, ""
+	}
+	for _, limiter := range []func(context.Context, *nostr.Event) (bool, string){b.ipLimiter, b.pubkeyLimiter} {
+		if limiter == nil {
+			continue
+		}
+		if reject, _ := limiter(ctx, event); reject {
+			atomic.AddInt64(&b.clamped, 1)
+			b.logf("burst clamp rejected event %s from IP %s pubkey %s", event.ID, ipLog(khatru.GetIP(ctx)), event.PubKey)
+			return true, "rate-limited: traffic burst in progress, slow down"
+		}
+	}
+	return false, ""
+}
+
+func (b *BurstClamp) measure() {
+	ticker := time.NewTicker(burstTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		rate := float64(atomic.SwapInt64(&b.events, 0)) / burstTick.Seconds()
+		b.evaluate(rate, now)
+	}
+}
+
+// evaluate folds one measurement into the baseline and starts or lifts the clamp
+func (b *BurstClamp) evaluate(rate float64, now time.Time) {
+	b.mu.Lock()
+	b.rate = rate
+
+	if b.active.Load() {
+		if rate > b.peakRate {
+			b.peakRate = rate
+		}
+		if rate > 2*b.baseline && rate >= b.cfg.MinRate {
+			b.calmSince = time.Time{}
+			b.mu.Unlock()
+			return
+		}
+		if b.calmSince.IsZero() {
+			b.calmSince = now
+		}
+		if now.Sub(b.calmSince) < b.cfg.Calm {
+			b.mu.Unlock()
+			return
+		}
+		b.active.Store(false)
+		b.lastEnded = now
+		baseline := b.baseline
+		b.mu.Unlock()
+		b.logf("burst clamp lifted: %.2f events/s, baseline %.2f events/s", rate, baseline)
+		if b.cfg.OnClamp != nil {
+			b.cfg.OnClamp(false, rate, baseline)
+		}
+		return
+	}
+
+	if b.samples >= burstWarmupTicks && rate >= b.cfg.MinRate && rate >= b.cfg.Factor*b.baseline {
+		// The baseline stays frozen during the clamp so the burst cannot become the new normal
+		b.active.Store(true)
+		b.since = now
+		b.calmSince = time.Time{}
+		b.clamps++
+		b.lastStarted = now
+		b.peakRate = rate
+		baseline := b.baseline
+		b.mu.Unlock()
+		b.logf("burst clamp applied: %.2f events/s, baseline %.2f events/s", rate, baseline)
+		if b.cfg.OnClamp != nil {
+			b.cfg.OnClamp(true, rate, baseline)
+		}
+		return
+	}
+
+	alpha := burstTick.Seconds() / b.cfg.Baseline.Seconds()
+	if b.samples == 0 || alpha >= 1 {
+		b.baseline = rate
+	} else {
+		b.baseline = b.baseline*(1-alpha) + rate*alpha
+	}
+	b.samples++
+	b.mu.Unlock()
+}
+
+// GetStatsName returns the name for this stats provider
+func (b *BurstClamp) GetStatsName() string {
+	return "burst_clamp"
+}
+
+// GetStats returns the current rate, baseline and clamp history as a JsonEntity
+func (b *BurstClamp) GetStats() json.JsonEntity {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("active", json.NewJsonValue(b.active.Load()))
+	obj.Set("factor", json.NewJsonValue(b.cfg.Factor))
+	obj.Set("rate_per_second", json.NewJsonValue(b.rate))
+	obj.Set("baseline_per_second", json.NewJsonValue(b.baseline))
+	obj.Set("warmed_up", json.NewJsonValue(b.samples >= burstWarmupTicks))
+	obj.Set("clamps", json.NewJsonValue(b.clamps))
+	obj.Set("clamped_events", json.NewJsonValue(atomic.LoadInt64(&b.clamped)))
+	if b.active.Load() {
+		obj.Set("active_since", json.NewJsonValue(b.since.Unix()))
+	}
+	if !b.lastStarted.IsZero() {
+		obj.Set("last_started", json.NewJsonValue(b.lastStarted.Unix()))
+		obj.Set("peak_rate_per_second", json.NewJsonValue(b.peakRate))
+	}
+	if !b.lastEnded.IsZero() {
+		obj.Set("last_ended", json.NewJsonValue(b.lastEnded.Unix()))
+	}
+	return obj
+}
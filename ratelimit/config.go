@@ -18,7 +18,9 @@ func (b Bucket) Enabled() bool {
 type Config struct {
 	Connection Bucket
 	EventIP    Bucket
-	FilterIP   Bucket
+	// EventPubKey limits events per author pubkey, whichever IPs they come from
+	EventPubKey Bucket
+	FilterIP    Bucket
 
 	// SoftRejectCount is how many rate-limit rejects per client IP only add a warning suffix before the next
 	// reject also closes the WebSocket and may ban. Default 3 → strikes 1–3 soft, 4th closes.
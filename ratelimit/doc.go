@@ -1,5 +1,6 @@
 // Package ratelimit provides khatru relay hooks for per-IP token-bucket limits (connection, event, filter),
-// progressive warnings, forced WebSocket close, and optional temporary IP ban on new upgrades.
+// per-pubkey event limits, progressive warnings, forced WebSocket close, and optional temporary IP ban on
+// new upgrades.
 //
 // Usage:
 //
@@ -0,0 +1,329 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Greylist key prefixes: a source is a client IP or an event author
+const (
+	GreylistIP     = "ip"
+	GreylistPubKey = "pubkey"
+)
+
+// GreylistConfig drives a Greylist. Threshold 0 disables it.
+type GreylistConfig struct {
+	// Threshold rejections of one IP or pubkey within Window greylist it.
+	Threshold int
+	Window    time.Duration // default 10m
+	// BaseDuration is the first greylisting; each repeat within Forget multiplies the previous one
+	// by Multiplier, up to MaxDuration. Defaults 5m, x2, 24h.
+	BaseDuration time.Duration
+	Multiplier   float64
+	MaxDuration  time.Duration
+	// Forget is how long after a greylisting expires a source starts over at BaseDuration. Default 24h.
+	Forget time.Duration
+
+	// Ignore reports rejections that say nothing about the source (e.g. duplicates); optional.
+	Ignore func(reason string) bool
+	// OnGreylist is called when a source is greylisted automatically; optional.
+	OnGreylist func(key string, duration time.Duration, reason string)
+	// LogDebug is optional (e.g. connect to verbose logging).
+	LogDebug func(format string, args ...any)
+}
+
+// GreylistEntry is one greylisted (or recently greylisted) source
+type GreylistEntry struct {
+	Key    string // "ip:<address>" or "pubkey:<hex>"
+	Until  time.Time
+	Level  int    // greylistings in a row; the next one lasts BaseDuration x Multiplier^Level
+	Reason string // last rejection that led to it, or "manual"
+	Manual bool
+}
+
+type greylistSource struct {
+	strikes []time.Time // rejections within Window
+	entry   GreylistEntry
+}
+
+// Greylist temporarily rejects every event of IPs and pubkeys that keep triggering rejections, for
+// escalating durations that expire by themselves. Unlike the hard limits it sees every other
+// RejectEvent hook's verdict: Apply wraps the hooks attached before it. Create with NewGreylist.
+type Greylist struct {
+	cfg GreylistConfig
+
+	mu      sync.Mutex
+	sources map[string]*greylistSource
+
+	greylisted int64 // automatic greylistings
+	rejected   int64 // events rejected while greylisted
+}
+
+// NewGreylist returns a Greylist, or nil if cfg.Threshold is not positive
+func NewGreylist(cfg GreylistConfig) *Greylist {
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Minute
+	}
+	if cfg.BaseDuration <= 0 {
+		cfg.BaseDuration = 5 * time.Minute
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = 2
+	}
+	if cfg.MaxDuration < cfg.BaseDuration {
+		cfg.MaxDuration = 24 * time.Hour
+	}
+	if cfg.Forget <= 0 {
+		cfg.Forget = 24 * time.Hour
+	}
+	return &Greylist{cfg: cfg, sources: make(map[string]*greylistSource)}
+}
+
+func (g *Greylist) logf(format string, args ...any) {
+	if g.cfg.LogDebug != nil {
+		g.cfg.LogDebug(format, args...)
+	}
+}
+
+// GreylistKey builds the key of a source, e.g. GreylistKey(GreylistIP, "203.0.113.7")
+func GreylistKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// Apply replaces relay.RejectEvent with one hook that rejects greylisted sources and otherwise runs
+// the hooks attached so far, counting their rejections. Call it after every RejectEvent hook whose
+// rejections should count; hooks appended later are not seen. A nil Greylist does nothing.
+func (g *Greylist) Apply(relay *khatru.Relay) {
+	if g == nil || relay == nil {
+		return
+	}
+	hooks := relay.RejectEvent
+	relay.RejectEvent = []func(context.Context, *nostr.Event) (bool, string){
+		func(ctx context.Context, event *nostr.Event) (bool, string) {
+			keys := g.keys(ctx, event)
+			if until, ok := g.greylistedUntil(keys, time.Now()); ok {
+				atomic.AddInt64(&g.rejected, 1)
+				wait := time.Until(until).Round(time.Second)
+				return true, fmt.Sprintf("rate-limited: temporarily greylisted, retry after %ds", int(wait.Seconds()))
+			}
+			for _, hook := range hooks {
+				if reject, msg := hook(ctx, event); reject {
+					if g.cfg.Ignore == nil || !g.cfg.Ignore(msg) {
+						g.strike(keys, msg)
+					}
+					return true, msg
+				}
+			}
+			return false, ""
+		},
+	}
+	go g.cleanup()
+}
+
+func (g *Greylist) keys(ctx context.Context, event *nostr.Event) []string {
+	keys := make([]string, 0, 2)
+	if ip := khatru.GetIP(ctx); ip != "" {
+		keys = append(keys, GreylistKey(GreylistIP, ip))
+	}
+	if event.PubKey != "" {
+		keys = append(keys, GreylistKey(GreylistPubKey, event.PubKey))
+	}
+	return keys
+}
+
+// greylistedUntil returns the latest expiry among the greylisted keys
+func (g *Greylist) greylistedUntil(keys []string, now time.Time) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var until time.Time
+	for _, key := range keys {
+		if src := g.sources[key]; src != nil && src.entry.Until.After(now) && src.entry.Until.After(until) {
+			until = src.entry.Until
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// strike records one rejection of each key and greylists those reaching the threshold
+func (g *Greylist) strike(keys []string, reason string) {
+	now := time.Now()
+	type listed struct {
+		key      string
+		duration time.Duration
+	}
+	var newly []listed
+
+	g.mu.Lock()
+	for _, key := range keys {
+		src := g.sources[key]
+		if src == nil {
+			src = &greylistSource{}
+			g.sources[key] = src
+		}
+		src.strikes = append(pruneStrikes(src.strikes, now, g.cfg.Window), now)
+		if len(src.strikes) < g.cfg.Threshold {
+			continue
+		}
+		duration := g.escalate(src, now)
+		src.strikes = nil
+		src.entry = GreylistEntry{Key: key, Until: now.Add(duration), Level: src.entry.Level + 1, Reason: reason}
+		newly = append(newly, listed{key, duration})
+	}
+	g.mu.Unlock()
+
+	for _, l := range newly {
+		atomic.AddInt64(&g.greylisted, 1)
+		g.logf("greylisted %s for %v after %d rejections within %v (last: %s)", l.key, l.duration, g.cfg.Threshold, g.cfg.Window, reason)
+		if g.cfg.OnGreylist != nil {
+			g.cfg.OnGreylist(l.key, l.duration, reason)
+		}
+	}
+}
+
+// escalate returns the next greylisting duration of src; the level starts over once a previous
+// greylisting expired more than Forget ago
+func (g *Greylist) escalate(src *greylistSource, now time.Time) time.Duration {
+	if src.entry.Level > 0 && now.Sub(src.entry.Until) > g.cfg.Forget {
+		src.entry.Level = 0
+	}
+	duration := float64(g.cfg.BaseDuration)
+	for i := 0; i < src.entry.Level; i++ {
+		duration *= g.cfg.Multiplier
+		if duration >= float64(g.cfg.MaxDuration) {
+			return g.cfg.MaxDuration
+		}
+	}
+	return time.Duration(duration)
+}
+
+func pruneStrikes(strikes []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(strikes) && now.Sub(strikes[i]) > window {
+		i++
+	}
+	return strikes[i:]
+}
+
+// cleanup forgets sources with no recent strikes whose greylisting (if any) expired over Forget ago
+func (g *Greylist) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		g.mu.Lock()
+		for key, src := range g.sources {
+			src.strikes = pruneStrikes(src.strikes, now, g.cfg.Window)
+			if len(src.strikes) == 0 && now.Sub(src.entry.Until) > g.cfg.Forget {
+				delete(g.sources, key)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// Add greylists key for duration by hand (escalation level unchanged); a key that is already
+// greylisted gets the new expiry
+func (g *Greylist) Add(key string, duration time.Duration) GreylistEntry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	src := g.sources[key]
+	if src == nil {
+		src = &greylistSource{}
+		g.sources[key] = src
+	}
+	src.entry.Key = key
+	src.entry.Until = time.Now().Add(duration)
+	src.entry.Reason = "manual"
+	src.entry.Manual = true
+	return src.entry
+}
+
+// Remove lifts the greylisting of key and forgets its strikes and escalation; false if it was unknown
+func (g *Greylist) Remove(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.sources[key]; !ok {
+		return false
+	}
+	delete(g.sources, key)
+	return true
+}
+
+// Entries returns the currently greylisted sources, soonest expiry first
+func (g *Greylist) Entries() []GreylistEntry {
+	now := time.Now()
+	g.mu.Lock()
+	entries := []GreylistEntry{}
+	for _, src := range g.sources {
+		if src.entry.Until.After(now) {
+			entries = append(entries, src.entry)
+		}
+	}
+	g.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Until.Before(entries[j].Until) })
+	return entries
+}
+
+// ParseGreylistKey validates an admin-supplied source ("ip" or "pubkey" and its value)
+func ParseGreylistKey(kind, value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch {
+	case value == "":
+		return "", fmt.Errorf("empty %s", kind)
+	case kind == GreylistPubKey && !nostr.IsValid32ByteHex(value):
+		return "", fmt.Errorf("pubkey must be 64 hex characters")
+	case kind != GreylistIP && kind != GreylistPubKey:
+		return "", fmt.Errorf("unknown source %q", kind)
+	}
+	return GreylistKey(kind, value), nil
+}
+
+// EntryObject converts an entry for the admin API
+func (e GreylistEntry) EntryObject() *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("key", json.NewJsonValue(e.Key))
+	obj.Set("until", json.NewJsonValue(e.Until.Unix()))
+	obj.Set("remaining_seconds", json.NewJsonValue(int64(time.Until(e.Until).Seconds())))
+	obj.Set("level", json.NewJsonValue(e.Level))
+	obj.Set("reason", json.NewJsonValue(e.Reason))
+	obj.Set("manual", json.NewJsonValue(e.Manual))
+	return obj
+}
+
+// GetStatsName returns the name for this stats provider
+func (g *Greylist) GetStatsName() string {
+	return "greylist"
+}
+
+// GetStats returns greylist counters as a JsonEntity
+func (g *Greylist) GetStats() json.JsonEntity {
+	now := time.Now()
+	g.mu.Lock()
+	active, tracked := 0, len(g.sources)
+	for _, src := range g.sources {
+		if src.entry.Until.After(now) {
+			active++
+		}
+	}
+	g.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("threshold", json.NewJsonValue(g.cfg.Threshold))
+	obj.Set("window_seconds", json.NewJsonValue(g.cfg.Window.Seconds()))
+	obj.Set("active", json.NewJsonValue(active))
+	obj.Set("tracked_sources", json.NewJsonValue(tracked))
+	obj.Set("greylisted", json.NewJsonValue(atomic.LoadInt64(&g.greylisted)))
+	obj.Set("rejected_events", json.NewJsonValue(atomic.LoadInt64(&g.rejected)))
+	return obj
+}
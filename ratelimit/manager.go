@@ -16,6 +16,9 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 )
 
+// PubKeyRateLimitReason is the reject message for events over the per-pubkey limit
+const PubKeyRateLimitReason = "rate-limited: too many events from this pubkey, slow down"
+
 type strikeCounter struct{ n int32 }
 
 // ipBanState tracks active ban, post-ban probation, and escalation (last ban length).
@@ -201,6 +204,15 @@ func (m *Manager) Apply(relay *khatru.Relay) {
 			return reject, msg
 		})
 	}
+	if m.cfg.EventPubKey.Enabled() {
+		limiter := policies.EventPubKeyRateLimiter(m.cfg.EventPubKey.Tokens, m.cfg.EventPubKey.Interval, m.cfg.EventPubKey.Max)
+		relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if reject, _ := limiter(ctx, event); reject {
+				return m.handleEventOrFilterReject(ctx, PubKeyRateLimitReason, "event", event, nil)
+			}
+			return false, ""
+		})
+	}
 	if m.cfg.FilterIP.Enabled() {
 		limiter := policies.FilterIPRateLimiter(m.cfg.FilterIP.Tokens, m.cfg.FilterIP.Interval, m.cfg.FilterIP.Max)
 		relay.RejectFilter = append(relay.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
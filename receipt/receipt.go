@@ -0,0 +1,293 @@
+// Package receipt produces relay-signed receipt events describing what the broadcaster did with
+// each event: a write-ahead "pending" receipt listing the target relays, replaced by a "complete"
+// receipt with per-relay results once every publish has finished.
+package receipt
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultKind is NIP-78 application-specific data (addressable), so the complete receipt replaces the pending one.
+const DefaultKind = 30078
+
+// dTagPrefix namespaces receipts among other kind 30078 data of the relay key
+const dTagPrefix = "broadcast-receipt:"
+
+// publishTimeout bounds the publication of one receipt to the audit relays
+const publishTimeout = 10 * time.Second
+
+// Config controls receipt generation
+type Config struct {
+	Kind       int      // receipt event kind (addressable kinds make the final receipt replace the pending one)
+	Relays     []string // audit relays receipts are published to; empty keeps receipts API-only
+	MaxStored  int      // receipts kept in memory for the API
+	WriteAhead bool     // publish a pending receipt before the event is broadcast
+}
+
+// Summary is the JSON content of a receipt event
+type Summary struct {
+	EventID    string `json:"event_id"`
+	Status     string `json:"status"`
+	Targets    int    `json:"targets"`
+	Success    int    `json:"success"`
+	Failed     int    `json:"failed"`
+	StartedAt  int64  `json:"started_at,omitempty"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+}
+
+// Receipts signs and stores receipts; it implements broadcaster.BroadcastReporter
+type Receipts struct {
+	cfg       Config
+	secretKey string
+	pool      *nostr.SimplePool
+
+	mu      sync.RWMutex
+	byEvent map[string]*nostr.Event
+	order   []string // insertion order for eviction
+
+	queue chan *nostr.Event
+
+	signed    int64
+	published int64
+	failed    int64
+	dropped   int64
+}
+
+// New returns a Receipts signing with secretKey (hex); Run publishes them to the audit relays
+func New(cfg Config, secretKey string) *Receipts {
+	if cfg.Kind <= 0 {
+		cfg.Kind = DefaultKind
+	}
+	if cfg.MaxStored <= 0 {
+		cfg.MaxStored = 1000
+	}
+	logging.DebugMethod("receipt", "New", "Initializing receipts: kind=%d, audit relays=%d, stored=%d, write-ahead=%v",
+		cfg.Kind, len(cfg.Relays), cfg.MaxStored, cfg.WriteAhead)
+
+	r := &Receipts{
+		cfg:       cfg,
+		secretKey: secretKey,
+		byEvent:   make(map[string]*nostr.Event),
+		queue:     make(chan *nostr.Event, 1000),
+	}
+	if len(cfg.Relays) > 0 {
+		r.pool = nostr.NewSimplePool(context.Background())
+	}
+	return r
+}
+
+// BroadcastPlanned records a write-ahead receipt listing the relays about to receive event. It
+// is published to the audit relays before returning, so it is out before the broadcast starts.
+func (r *Receipts) BroadcastPlanned(event *nostr.Event, relays []string) {
+	if !r.cfg.WriteAhead {
+		return
+	}
+	tags := r.baseTags(event, "pending")
+	for _, url := range relays {
+		tags = append(tags, nostr.Tag{"relay", url, "pending"})
+	}
+	receipt := r.sign(event.ID, tags, Summary{
+		EventID: event.ID,
+		Status:  "pending",
+		Targets: len(relays),
+	})
+	if receipt != nil && r.pool != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		r.publish(ctx, receipt)
+		cancel()
+	}
+}
+
+// BroadcastCompleted records the final receipt with per-relay delivery results
+func (r *Receipts) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	tags := r.baseTags(report.Event, "complete")
+	summary := Summary{
+		EventID:    report.Event.ID,
+		Status:     "complete",
+		Targets:    len(report.Results),
+		StartedAt:  report.Started.Unix(),
+		FinishedAt: report.Finished.Unix(),
+	}
+	for _, res := range report.Results {
+		ms := strconv.FormatInt(res.ResponseTime.Milliseconds(), 10)
+		if res.Success {
+			summary.Success++
+			tags = append(tags, nostr.Tag{"relay", res.URL, "ok", ms})
+		} else {
+			summary.Failed++
+			tags = append(tags, nostr.Tag{"relay", res.URL, "failed", ms, res.Error})
+		}
+	}
+	r.enqueue(report.Event.ID, r.sign(report.Event.ID, tags, summary))
+}
+
+// DeliveryCorrected re-issues the stored complete receipt of eventID with result's relay
+// marked ok, after the relay confirmed the event past the publish timeout
+func (r *Receipts) DeliveryCorrected(eventID string, result broadcaster.RelayResult) {
+	previous := r.Get(eventID)
+	if previous == nil || previous.Tags.GetFirst([]string{"status", "complete"}) == nil {
+		return
+	}
+	var summary Summary
+	if err := stdjson.Unmarshal([]byte(previous.Content), &summary); err != nil {
+		logging.Error("Receipt: Failed to parse stored receipt for %s: %v", eventID, err)
+		return
+	}
+
+	tags := make(nostr.Tags, 0, len(previous.Tags))
+	corrected := false
+	for _, tag := range previous.Tags {
+		if !corrected && len(tag) >= 3 && tag[0] == "relay" && tag[1] == result.URL && tag[2] == "failed" {
+			tag = nostr.Tag{"relay", result.URL, "ok", strconv.FormatInt(result.ResponseTime.Milliseconds(), 10), "late"}
+			corrected = true
+		}
+		tags = append(tags, tag)
+	}
+	if !corrected {
+		return
+	}
+	summary.Success++
+	summary.Failed--
+	r.enqueue(eventID, r.sign(eventID, tags, summary))
+}
+
+func (r *Receipts) baseTags(event *nostr.Event, status string) nostr.Tags {
+	return nostr.Tags{
+		{"d", dTagPrefix + event.ID},
+		{"e", event.ID},
+		{"p", event.PubKey},
+		{"k", strconv.Itoa(event.Kind)},
+		{"status", status},
+	}
+}
+
+// sign signs and stores a receipt for eventID, nil on failure. A receipt replacing a stored one
+// is dated at least a second after it: addressable events of the same second are ordered by ID,
+// so the complete receipt could otherwise lose to the pending one.
+func (r *Receipts) sign(eventID string, tags nostr.Tags, summary Summary) *nostr.Event {
+	content, err := stdjson.Marshal(summary)
+	if err != nil {
+		logging.Error("Receipt: Failed to marshal summary for %s: %v", eventID, err)
+		return nil
+	}
+
+	createdAt := nostr.Now()
+	if previous := r.Get(eventID); previous != nil && previous.CreatedAt >= createdAt {
+		createdAt = previous.CreatedAt + 1
+	}
+	receipt := &nostr.Event{
+		Kind:      r.cfg.Kind,
+		CreatedAt: createdAt,
+		Tags:      tags,
+		Content:   string(content),
+	}
+	if err := receipt.Sign(r.secretKey); err != nil {
+		logging.Error("Receipt: Failed to sign receipt for %s: %v", eventID, err)
+		return nil
+	}
+	atomic.AddInt64(&r.signed, 1)
+
+	r.store(eventID, receipt)
+	return receipt
+}
+
+// enqueue hands receipt to Run for the audit relays, dropping it if the queue is full
+func (r *Receipts) enqueue(eventID string, receipt *nostr.Event) {
+	if receipt == nil || r.pool == nil {
+		return
+	}
+	select {
+	case r.queue <- receipt:
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+		logging.DebugMethod("receipt", "enqueue", "Publish queue full, dropping receipt for %s", eventID)
+	}
+}
+
+func (r *Receipts) store(eventID string, receipt *nostr.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.byEvent[eventID]; !exists {
+		r.order = append(r.order, eventID)
+		if len(r.order) > r.cfg.MaxStored {
+			delete(r.byEvent, r.order[0])
+			r.order = r.order[1:]
+		}
+	}
+	r.byEvent[eventID] = receipt
+}
+
+// Get returns the latest receipt for eventID, or nil if none is stored
+func (r *Receipts) Get(eventID string) *nostr.Event {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byEvent[eventID]
+}
+
+// Run sends queued receipts to the audit relays one at a time until ctx is canceled
+func (r *Receipts) Run(ctx context.Context) error {
+	if r.pool == nil {
+		<-ctx.Done() // API-only receipts: nothing to publish
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case receipt := <-r.queue:
+			publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+			r.publish(publishCtx, receipt)
+			cancel()
+		}
+	}
+}
+
+// publish sends receipt to every audit relay; it counts as published if one accepted it
+func (r *Receipts) publish(ctx context.Context, receipt *nostr.Event) {
+	ok := false
+	for res := range r.pool.PublishMany(ctx, r.cfg.Relays, *receipt) {
+		if res.Error == nil {
+			ok = true
+		} else {
+			logging.DebugMethod("receipt", "publish", "Failed to publish receipt %s to %s: %v", receipt.ID, res.RelayURL, res.Error)
+		}
+	}
+	if ok {
+		atomic.AddInt64(&r.published, 1)
+	} else {
+		atomic.AddInt64(&r.failed, 1)
+	}
+}
+
+// GetStatsName returns the name for this stats provider
+func (r *Receipts) GetStatsName() string {
+	return "receipts"
+}
+
+// GetStats returns receipt statistics as a JsonEntity
+func (r *Receipts) GetStats() json.JsonEntity {
+	r.mu.RLock()
+	stored := len(r.byEvent)
+	r.mu.RUnlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("kind", json.NewJsonValue(r.cfg.Kind))
+	obj.Set("audit_relays", json.NewJsonValue(len(r.cfg.Relays)))
+	obj.Set("stored", json.NewJsonValue(stored))
+	obj.Set("signed", json.NewJsonValue(atomic.LoadInt64(&r.signed)))
+	obj.Set("published", json.NewJsonValue(atomic.LoadInt64(&r.published)))
+	obj.Set("publish_failed", json.NewJsonValue(atomic.LoadInt64(&r.failed)))
+	obj.Set("dropped", json.NewJsonValue(atomic.LoadInt64(&r.dropped)))
+	return obj
+}
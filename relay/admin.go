@@ -0,0 +1,509 @@
+package relay
+
+import (
+	stdjson "encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/handshakes"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/ratelimit"
+	"github.com/girino/nostr-brodcast-relay/sampling"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// planBodyLimit caps a POSTed /api/plan event when MAX_MESSAGE_SIZE sets no limit
+const planBodyLimit = 512000
+
+// requireAdmin guards an admin handler with a bearer token of at least role (see
+// adminauth.go); every mutating request is audited under the token's name, denied or not.
+// Admin endpoints are not registered at all when no token is configured.
+func (r *Relay) requireAdmin(role adminRole, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, ok := r.authenticate(req)
+		if !ok {
+			logging.Warn("Relay: Unauthorized admin request %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req = withAdminToken(req, token)
+
+		serve := func(w http.ResponseWriter, req *http.Request) {
+			if allowRole(w, req, role) {
+				handler(w, req)
+			}
+		}
+		if isMutating(req) {
+			serve = r.audited(token, serve)
+		}
+		serve(w, req)
+	}
+}
+
+// requirePost rejects anything but POST for mutating admin actions
+func requirePost(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// registerAdminHandlers adds the /admin/ endpoints to mux
+func (r *Relay) registerAdminHandlers(mux *apiMux) {
+	r.adminTokens = r.loadAdminTokens()
+	if len(r.adminTokens) == 0 {
+		logging.Debug("Relay: Admin endpoints disabled (no admin tokens set)")
+		return
+	}
+	r.audit = newAuditLog(r.config.AdminAuditLog)
+
+	// Reset one relay's stats: POST /admin/relays/reset?url=wss://...
+	mux.HandleFunc("/admin/relays/reset", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		url := req.URL.Query().Get("url")
+		if url == "" {
+			http.Error(w, "Missing url parameter", http.StatusBadRequest)
+			return
+		}
+		if !r.broadcastSystem.ResetRelayStats(url) {
+			http.Error(w, "Relay not found", http.StatusNotFound)
+			return
+		}
+		logging.Info("Relay: Admin reset stats for relay %s", url)
+
+		resp := json.NewJsonObject()
+		resp.Set("reset", json.NewJsonValue(url))
+		writeJSON(w, http.StatusOK, resp)
+	})))
+
+	// Reset every relay's stats: POST /admin/relays/reset-all
+	mux.HandleFunc("/admin/relays/reset-all", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		count := r.broadcastSystem.ResetAllRelayStats()
+		logging.Info("Relay: Admin reset stats for all %d relays", count)
+
+		resp := json.NewJsonObject()
+		resp.Set("reset_relays", json.NewJsonValue(count))
+		writeJSON(w, http.StatusOK, resp)
+	})))
+
+	// Reset global broadcaster counters: POST /admin/stats/reset
+	mux.HandleFunc("/admin/stats/reset", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		r.broadcastSystem.ResetCounters()
+		r.latency.Reset()
+		logging.Info("Relay: Admin reset global counters")
+
+		resp := json.NewJsonObject()
+		resp.Set("reset", json.NewJsonValue("counters"))
+		resp.Set("timestamp", json.NewJsonValue(time.Now().Unix()))
+		writeJSON(w, http.StatusOK, resp)
+	})))
+
+	// Pause all outbound publishing: POST /admin/pause?reason=...
+	mux.HandleFunc("/admin/pause", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		reason := strings.TrimSpace(req.URL.Query().Get("reason"))
+		if reason == "" {
+			reason = "paused by admin"
+		}
+		changed := r.broadcastSystem.Pause(reason)
+		logging.Info("Relay: Admin paused broadcasting from %s (changed=%v, mode=%s)", req.RemoteAddr, changed, r.config.BroadcastPauseMode)
+		writeJSON(w, http.StatusOK, r.pauseStateObject(changed))
+	})))
+
+	// Resume outbound publishing and drain the queue: POST /admin/resume
+	mux.HandleFunc("/admin/resume", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		changed := r.broadcastSystem.Resume()
+		logging.Info("Relay: Admin resumed broadcasting from %s (changed=%v)", req.RemoteAddr, changed)
+		writeJSON(w, http.StatusOK, r.pauseStateObject(changed))
+	})))
+
+	// Add a mandatory relay at runtime, optionally replaying recent events to it:
+	// POST /admin/mandatory?url=wss://...&backfill=6h
+	mux.HandleFunc("/admin/mandatory", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		url := strings.TrimSpace(req.URL.Query().Get("url"))
+		if url == "" {
+			http.Error(w, "Missing url parameter", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(url, "ws://") && !strings.HasPrefix(url, "wss://") {
+			http.Error(w, "url must be a ws:// or wss:// relay URL", http.StatusBadRequest)
+			return
+		}
+		var backfill time.Duration
+		if raw := req.URL.Query().Get("backfill"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed < 0 {
+				http.Error(w, "Invalid backfill duration", http.StatusBadRequest)
+				return
+			}
+			if parsed > 0 && !r.broadcastSystem.LedgerEnabled() {
+				http.Error(w, "Backfill unavailable: event ledger disabled (LEDGER_SIZE=0)", http.StatusServiceUnavailable)
+				return
+			}
+			backfill = parsed
+		}
+		added, replaying := r.broadcastSystem.AddMandatoryRelay(url, backfill)
+		logging.Info("Relay: Admin added mandatory relay %s (added=%v, backfill=%v, replaying=%d)", url, added, backfill, replaying)
+
+		resp := json.NewJsonObject()
+		resp.Set("url", json.NewJsonValue(url))
+		resp.Set("added", json.NewJsonValue(added))
+		resp.Set("backfill_seconds", json.NewJsonValue(int64(backfill.Seconds())))
+		resp.Set("replaying", json.NewJsonValue(replaying))
+		writeJSON(w, http.StatusOK, resp)
+	})))
+
+	// Greylist: GET /admin/greylist lists it, POST /admin/greylist?ip=|pubkey=&duration=1h adds a
+	// source, DELETE /admin/greylist?ip=|pubkey= lifts one (and forgets its escalation)
+	mux.HandleFunc("/admin/greylist", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		if r.greylist == nil {
+			http.Error(w, "Greylist disabled (GREYLIST_THRESHOLD=0)", http.StatusServiceUnavailable)
+			return
+		}
+		if req.Method == http.MethodGet {
+			list := json.NewJsonList()
+			for _, entry := range r.greylist.Entries() {
+				list.Append(entry.EntryObject())
+			}
+			resp := json.NewJsonObject()
+			resp.Set("count", json.NewJsonValue(list.Length()))
+			resp.Set("entries", list)
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !allowRole(w, req, roleOperator) {
+			return
+		}
+
+		query := req.URL.Query()
+		kind, value := ratelimit.GreylistIP, query.Get("ip")
+		if value == "" {
+			kind, value = ratelimit.GreylistPubKey, query.Get("pubkey")
+		}
+		key, err := ratelimit.ParseGreylistKey(kind, value)
+		if err != nil {
+			http.Error(w, "Need ip or pubkey: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := json.NewJsonObject()
+		if req.Method == http.MethodDelete {
+			removed := r.greylist.Remove(key)
+			logging.Info("Relay: Admin removed %s from the greylist (was listed: %v)", key, removed)
+			resp.Set("key", json.NewJsonValue(key))
+			resp.Set("removed", json.NewJsonValue(removed))
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		duration := time.Hour
+		if raw := query.Get("duration"); raw != "" {
+			if duration, err = time.ParseDuration(raw); err != nil || duration <= 0 {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		entry := r.greylist.Add(key, duration)
+		logging.Info("Relay: Admin greylisted %s for %v", key, duration)
+		writeJSON(w, http.StatusOK, entry.EntryObject())
+	}))
+
+	// Close the current report period and publish its report now: POST /admin/report/publish
+	mux.HandleFunc("/admin/report/publish", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		if r.reporter == nil {
+			http.Error(w, "Daily report disabled", http.StatusServiceUnavailable)
+			return
+		}
+		event := r.reporter.Publish(req.Context())
+		if event == nil {
+			http.Error(w, "Failed to sign report", http.StatusInternalServerError)
+			return
+		}
+		logging.Info("Relay: Admin published report %s", event.ID)
+
+		resp := json.NewJsonObject()
+		resp.Set("id", json.NewJsonValue(event.ID))
+		resp.Set("kind", json.NewJsonValue(event.Kind))
+		writeJSON(w, http.StatusOK, resp)
+	})))
+
+	// Recompute and return the top-N set: POST /admin/topn/recompute
+	mux.HandleFunc("/admin/topn/recompute", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		topRelays := r.broadcastSystem.GetTopRelays()
+		logging.Info("Relay: Admin recomputed top relays: %d of %d", len(topRelays), r.broadcastSystem.GetRelayCount())
+
+		list := json.NewJsonList()
+		for _, relay := range topRelays {
+			list.Append(json.NewJsonValue(relay.URL))
+		}
+		resp := json.NewJsonObject()
+		resp.Set("total_relays", json.NewJsonValue(r.broadcastSystem.GetRelayCount()))
+		resp.Set("top_relays", list)
+		writeJSON(w, http.StatusOK, resp)
+	})))
+
+	// Verbose filters at runtime: GET /admin/logging, POST /admin/logging?verbose=all,-broadcaster.addEventToCache
+	mux.HandleFunc("/admin/logging", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !allowRole(w, req, roleOperator) {
+				return
+			}
+			if err := req.ParseForm(); err != nil {
+				http.Error(w, "Invalid form", http.StatusBadRequest)
+				return
+			}
+			spec, ok := req.Form["verbose"]
+			if !ok {
+				http.Error(w, "Missing verbose parameter (empty disables verbose logging)", http.StatusBadRequest)
+				return
+			}
+			previous := logging.GetVerbose()
+			logging.SetVerbose(strings.Join(spec, ","))
+			logging.Info("Relay: Admin changed verbose filters from %q to %q", previous, logging.GetVerbose())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp := json.NewJsonObject()
+		resp.Set("verbose", json.NewJsonValue(logging.GetVerbose()))
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	// Announce to every connected client: POST /admin/notice?message=maintenance+in+10+minutes
+	mux.HandleFunc("/admin/notice", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		message, ok := noticeMessage(w, req)
+		if !ok {
+			return
+		}
+		if message == "" {
+			http.Error(w, "Missing message parameter", http.StatusBadRequest)
+			return
+		}
+		delivered, failed := r.notices.Announce(message)
+		logging.Info("Relay: Admin announced %q to %d clients (%d failed)", message, delivered, failed)
+
+		resp := json.NewJsonObject()
+		resp.Set("message", json.NewJsonValue(message))
+		resp.Set("delivered", json.NewJsonValue(delivered))
+		resp.Set("failed", json.NewJsonValue(failed))
+		writeJSON(w, http.StatusOK, resp)
+	})))
+
+	// Message of the day sent to clients on connect: GET /admin/motd, POST /admin/motd?message=...,
+	// DELETE /admin/motd
+	mux.HandleFunc("/admin/motd", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodDelete:
+			if !allowRole(w, req, roleOperator) {
+				return
+			}
+			message := ""
+			if req.Method == http.MethodPost {
+				var ok bool
+				if message, ok = noticeMessage(w, req); !ok {
+					return
+				}
+			}
+			previous := r.notices.MOTD()
+			r.notices.SetMOTD(message)
+			logging.Info("Relay: Admin changed the MOTD from %q to %q", previous, message)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp := json.NewJsonObject()
+		resp.Set("motd", json.NewJsonValue(r.notices.MOTD()))
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	// Dry-run routing: GET /api/plan?eventJSON={...} (or POST the event as the body)
+	mux.HandleFunc("/api/plan", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		var raw []byte
+		switch req.Method {
+		case http.MethodGet:
+			raw = []byte(req.URL.Query().Get("eventJSON"))
+		case http.MethodPost:
+			limit := r.config.MaxMessageSize
+			if limit <= 0 {
+				limit = planBodyLimit
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, limit))
+			if err != nil {
+				http.Error(w, "Event too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			raw = body
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var event nostr.Event
+		if len(raw) == 0 || stdjson.Unmarshal(raw, &event) != nil {
+			http.Error(w, "Missing or invalid eventJSON", http.StatusBadRequest)
+			return
+		}
+
+		plan := r.broadcastSystem.PlanBroadcast(&event)
+		resp := json.NewJsonObject()
+		resp.Set("event_id", json.NewJsonValue(event.ID))
+		resp.Set("kind", json.NewJsonValue(event.Kind))
+		resp.Set("duplicate", json.NewJsonValue(event.ID != "" && r.broadcastSystem.IsEventCached(event.ID)))
+		resp.Set("mandatory", stringList(plan.Mandatory))
+		resp.Set("top", stringList(plan.Top))
+		resp.Set("excluded_by_policy", stringList(plan.Excluded))
+		resp.Set("relays", stringList(plan.Relays))
+		resp.Set("total", json.NewJsonValue(len(plan.Relays)))
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	// Last decision on an event: GET /api/why/{id}
+	mux.HandleFunc("/api/why/{id}", r.requireAdmin(roleReader, r.serveWhy))
+
+	// Sampled event metadata, newest first: GET /admin/samples?kind=1&author=<hex prefix>&since=<unix>&limit=100
+	mux.HandleFunc("/admin/samples", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		if r.sampler == nil {
+			http.Error(w, "Event sampling disabled", http.StatusServiceUnavailable)
+			return
+		}
+		q := sampling.Query{
+			AuthorPrefix: strings.ToLower(req.URL.Query().Get("author")),
+			Limit:        100,
+		}
+		if raw := req.URL.Query().Get("kind"); raw != "" {
+			kind, err := strconv.Atoi(raw)
+			if err != nil {
+				http.Error(w, "Invalid kind", http.StatusBadRequest)
+				return
+			}
+			q.Kind = &kind
+		}
+		if raw := req.URL.Query().Get("since"); raw != "" {
+			since, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid since (unix seconds)", http.StatusBadRequest)
+				return
+			}
+			q.Since = time.Unix(since, 0)
+		}
+		if raw := req.URL.Query().Get("limit"); raw != "" {
+			limit, err := strconv.Atoi(raw)
+			if err != nil || limit < 0 {
+				http.Error(w, "Invalid limit (0 = all)", http.StatusBadRequest)
+				return
+			}
+			q.Limit = limit
+		}
+
+		samples := r.sampler.Samples(q)
+		list := json.NewJsonList()
+		for _, sample := range samples {
+			list.Append(sampling.SampleObject(sample))
+		}
+		resp := json.NewJsonObject()
+		resp.Set("count", json.NewJsonValue(len(samples)))
+		resp.Set("samples", list)
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	// Outbound connection audit trail as JSON lines: GET /admin/handshakes?since=<unix>&relay=wss://...
+	mux.HandleFunc("/admin/handshakes", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		if r.handshakes == nil {
+			http.Error(w, "Handshake audit disabled", http.StatusServiceUnavailable)
+			return
+		}
+		q := handshakes.Query{Relay: req.URL.Query().Get("relay")}
+		if raw := req.URL.Query().Get("since"); raw != "" {
+			since, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid since (unix seconds)", http.StatusBadRequest)
+				return
+			}
+			q.Since = time.Unix(since, 0)
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := r.handshakes.Export(w, q); err != nil {
+			logging.Warn("Relay: Handshake export interrupted: %v", err)
+		}
+	}))
+
+	// Recent mutating admin requests, newest first: GET /admin/audit
+	mux.HandleFunc("/admin/audit", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		resp := json.NewJsonObject()
+		resp.Set("entries", r.audit.recentObject())
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	r.registerDebugHandlers(mux)
+
+	logging.Debug("Relay: Admin endpoints ready (%d tokens)", len(r.adminTokens))
+}
+
+// stringList converts a string slice to a JsonList
+func stringList(items []string) *json.JsonList {
+	list := json.NewJsonList()
+	for _, item := range items {
+		list.Append(json.NewJsonValue(item))
+	}
+	return list
+}
+
+// writeJSON marshals entity and writes it with statusCode
+func writeJSON(w http.ResponseWriter, statusCode int, entity json.JsonEntity) {
+	jsonData, err := json.MarshalIndent(entity, "", "  ")
+	if err != nil {
+		logging.Error("Failed to marshal response to JSON: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(jsonData)
+}
+
+// pauseStateObject describes the pause switch for /admin/pause and /admin/resume
+func (r *Relay) pauseStateObject(changed bool) *json.JsonObject {
+	paused, since, reason := r.broadcastSystem.PauseState()
+	resp := json.NewJsonObject()
+	resp.Set("paused", json.NewJsonValue(paused))
+	resp.Set("changed", json.NewJsonValue(changed))
+	resp.Set("mode", json.NewJsonValue(r.config.BroadcastPauseMode))
+	if paused {
+		resp.Set("paused_since", json.NewJsonValue(since.Unix()))
+		resp.Set("reason", json.NewJsonValue(reason))
+	}
+	return resp
+}
+
+// noticeMessage reads the message parameter (query or form) of a NOTICE endpoint; false if the
+// request was answered with an error
+func noticeMessage(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return "", false
+	}
+	message := strings.TrimSpace(req.Form.Get("message"))
+	if len(message) > maxNoticeLength {
+		http.Error(w, "Message too long", http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+	return message, true
+}
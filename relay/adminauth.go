@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	stdjson "encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// adminRole is what an admin token may do: readers only look (stats, relay lists, dry runs),
+// operators can also change state (resets, pause, logging, traces)
+type adminRole int
+
+const (
+	roleReader adminRole = iota
+	roleOperator
+)
+
+func (role adminRole) String() string {
+	if role == roleOperator {
+		return "operator"
+	}
+	return "reader"
+}
+
+// adminToken is one named bearer token; the name identifies it in the audit log
+type adminToken struct {
+	name  string
+	token string
+	role  adminRole
+}
+
+type adminTokenKey struct{}
+
+// maxAuditEntries is how many recent mutating requests GET /admin/audit returns
+const maxAuditEntries = 200
+
+// auditEntry is one mutating admin request
+type auditEntry struct {
+	At     time.Time `json:"at"`
+	Token  string    `json:"token"`
+	Role   string    `json:"role"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Query  string    `json:"query,omitempty"`
+	Remote string    `json:"remote"`
+	Status int       `json:"status"`
+}
+
+// auditLog keeps the recent mutating admin requests and appends each one to an optional
+// JSON-lines file
+type auditLog struct {
+	mu      sync.Mutex
+	entries []auditEntry // most recent last
+	file    *os.File     // nil = process log only
+}
+
+func newAuditLog(path string) *auditLog {
+	a := &auditLog{}
+	if path == "" {
+		return a
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		logging.Error("Relay: Failed to open admin audit log %s: %v (auditing to the process log only)", path, err)
+		return a
+	}
+	a.file = file
+	logging.Info("Relay: Auditing mutating admin requests to %s", path)
+	return a
+}
+
+func (a *auditLog) record(entry auditEntry) {
+	target := entry.Path
+	if entry.Query != "" {
+		target += "?" + entry.Query
+	}
+	logging.Info("Audit: %s (%s) %s %s from %s -> %d",
+		entry.Token, entry.Role, entry.Method, target, entry.Remote, entry.Status)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) >= maxAuditEntries {
+		a.entries = a.entries[1:]
+	}
+	a.entries = append(a.entries, entry)
+	if a.file == nil {
+		return
+	}
+	line, err := stdjson.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logging.Error("Relay: Failed to write admin audit log: %v", err)
+	}
+}
+
+// recentObject lists the recent entries, newest first
+func (a *auditLog) recentObject() *json.JsonList {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := json.NewJsonList()
+	for i := len(a.entries) - 1; i >= 0; i-- {
+		e := a.entries[i]
+		obj := json.NewJsonObject()
+		obj.Set("at", json.NewJsonValue(e.At.Format(time.RFC3339)))
+		obj.Set("token", json.NewJsonValue(e.Token))
+		obj.Set("role", json.NewJsonValue(e.Role))
+		obj.Set("method", json.NewJsonValue(e.Method))
+		obj.Set("path", json.NewJsonValue(e.Path))
+		if e.Query != "" {
+			obj.Set("query", json.NewJsonValue(e.Query))
+		}
+		obj.Set("remote", json.NewJsonValue(e.Remote))
+		obj.Set("status", json.NewJsonValue(e.Status))
+		list.Append(obj)
+	}
+	return list
+}
+
+// statusRecorder remembers the status code written by an audited handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming handlers working behind the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// loadAdminTokens collects ADMIN_TOKEN (operator "admin") and the named reader and operator
+// tokens, sorted by name for stable logs
+func (r *Relay) loadAdminTokens() []adminToken {
+	tokens := []adminToken{}
+	if r.config.AdminToken != "" {
+		tokens = append(tokens, adminToken{name: "admin", token: r.config.AdminToken, role: roleOperator})
+	}
+	for name, token := range r.config.AdminOperatorTokens {
+		tokens = append(tokens, adminToken{name: name, token: token, role: roleOperator})
+	}
+	for name, token := range r.config.AdminReaderTokens {
+		tokens = append(tokens, adminToken{name: name, token: token, role: roleReader})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].name < tokens[j].name })
+	return tokens
+}
+
+// authenticate returns the admin token presented by req, if any. Every configured token is
+// compared so the timing does not depend on which one matched.
+func (r *Relay) authenticate(req *http.Request) (adminToken, bool) {
+	presented := []byte(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	var match adminToken
+	found := false
+	for _, candidate := range r.adminTokens {
+		if subtle.ConstantTimeCompare(presented, []byte(candidate.token)) == 1 && !found {
+			match = candidate
+			found = true
+		}
+	}
+	return match, found
+}
+
+// allowRole checks that the authenticated token of req has role, answering 403 otherwise;
+// for handlers that only need operator rights on some methods
+func allowRole(w http.ResponseWriter, req *http.Request, role adminRole) bool {
+	token, _ := req.Context().Value(adminTokenKey{}).(adminToken)
+	if token.role >= role {
+		return true
+	}
+	logging.Warn("Relay: Admin token %q (%s) denied %s %s: needs %s", token.name, token.role, req.Method, req.URL.Path, role)
+	http.Error(w, "Forbidden: "+role.String()+" token required", http.StatusForbidden)
+	return false
+}
+
+// isMutating reports whether req is audited: anything but reads
+func isMutating(req *http.Request) bool {
+	return req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodOptions
+}
+
+// audited runs handler and records the request in the audit log with the token that made it
+func (r *Relay) audited(token adminToken, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, req)
+		r.audit.record(auditEntry{
+			At:     time.Now(),
+			Token:  token.name,
+			Role:   token.role.String(),
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Query:  req.URL.RawQuery,
+			Remote: req.RemoteAddr,
+			Status: rec.status,
+		})
+	}
+}
+
+// withAdminToken makes the authenticated token available to allowRole
+func withAdminToken(req *http.Request, token adminToken) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), adminTokenKey{}, token))
+}
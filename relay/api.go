@@ -0,0 +1,205 @@
+package relay
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/federation"
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// apiPrefix is the versioned root of the HTTP API. Endpoints are also served at their original
+// unversioned paths (/stats, /admin/pause, /api/relay...), which stay for existing clients.
+const apiPrefix = "/api/v1"
+
+// Who may call an endpoint
+const (
+	authNone       = ""
+	authReader     = "reader"     // admin token of any role
+	authOperator   = "operator"   // admin token with the operator role
+	authProbe      = "probe"      // PROBE_TOKEN
+	authFederation = "federation" // FEDERATION_SECRET, if set
+)
+
+// apiParam is a query or path parameter of an endpoint
+type apiParam struct {
+	name        string
+	in          string // "query" or "path"
+	typ         string // OpenAPI type: string, integer, boolean
+	description string
+	required    bool
+}
+
+// apiEndpoint describes one endpoint for routing and the OpenAPI document
+type apiEndpoint struct {
+	pattern     string // as registered, unversioned; {name} segments are path parameters
+	methods     []string
+	summary     string
+	auth        string
+	params      []apiParam
+	body        string // schema of the request body ("" = none)
+	response    string // schema of a successful answer ("" = Object)
+	produces    string // content type of a successful answer (default application/json)
+	unversioned bool   // served only at pattern (pprof needs its own prefix, peers their own path)
+}
+
+func queryParam(name, typ, description string) apiParam {
+	return apiParam{name: name, in: "query", typ: typ, description: description}
+}
+
+func requiredQuery(name, typ, description string) apiParam {
+	return apiParam{name: name, in: "query", typ: typ, description: description, required: true}
+}
+
+// apiEndpoints is the contract of the HTTP API; registering a pattern that is not listed here
+// serves it unversioned and undocumented
+var apiEndpoints = []apiEndpoint{
+	{pattern: "/api/openapi.json", methods: []string{http.MethodGet}, summary: "This OpenAPI document"},
+	{pattern: "/stats", methods: []string{http.MethodGet}, summary: "Statistics of every module, as JSON, Prometheus text or a plain-text outline",
+		params:   []apiParam{queryParam("format", "string", "json, prometheus or text; overrides the Accept header")},
+		response: "StatsDocument", produces: "application/json, application/openmetrics-text, text/plain"},
+	{pattern: "/stats/stream", methods: []string{http.MethodGet}, summary: "Server-Sent Events: a stats snapshot, then incremental updates",
+		params: []apiParam{
+			queryParam("interval", "string", "update interval, 1s to 1m (default 5s)"),
+			queryParam("snapshot", "string", "0 skips the initial snapshot event"),
+		}, produces: "text/event-stream", response: "String"},
+	{pattern: "/health", methods: []string{http.MethodGet}, summary: "Relay pool health; 503 when unhealthy", response: "Health"},
+	{pattern: "/readyz", methods: []string{http.MethodGet}, summary: "Readiness; 503 while the pipeline canary fails", response: "Readiness"},
+	{pattern: "/api/version", methods: []string{http.MethodGet}, summary: "Build version, commit and build time, Go version and process uptime", response: "Version"},
+	{pattern: "/api/relay", methods: []string{http.MethodGet}, summary: "Stats, failure breakdown and recent errors of one destination relay",
+		params: []apiParam{requiredQuery("url", "string", "relay URL")}, response: "RelayStats"},
+	{pattern: "/api/matrix", methods: []string{http.MethodGet}, summary: "Success rate per relay and event kind over a rolling window",
+		params: []apiParam{
+			queryParam("relay", "string", "only this relay URL"),
+			queryParam("kind", "integer", "only this event kind"),
+			queryParam("min_attempts", "integer", "leave out relay/kind pairs with fewer publishes"),
+		}, response: "KindMatrix"},
+	{pattern: "/api/consistency", methods: []string{http.MethodGet}, summary: "Relays whose behavior contradicts their NIP-11 claims (auth, size, PoW, payment)",
+		response: "ConsistencyReport"},
+	{pattern: "/api/event/{id}", methods: []string{http.MethodGet}, summary: "Broadcast outcome of a recent event: relays that accepted it, failures and timestamps",
+		params: []apiParam{{name: "id", in: "path", typ: "string", description: "event ID", required: true}}, response: "EventOutcome"},
+	{pattern: "/api/plan", methods: []string{http.MethodGet, http.MethodPost}, summary: "Dry run: the relays an event would be broadcast to",
+		auth: authReader, params: []apiParam{queryParam("eventJSON", "string", "the event (GET); POST sends it as the body")},
+		body: "NostrEvent", response: "Plan"},
+	{pattern: "/api/why/{id}", methods: []string{http.MethodGet}, summary: "Last decision on a recent event: accepted, rejected (with the rule or policy) or not broadcast, and why",
+		auth: authReader, params: []apiParam{{name: "id", in: "path", typ: "string", description: "event ID", required: true}}, response: "Decision"},
+	{pattern: "/api/receipts/{id}", methods: []string{http.MethodGet}, summary: "Latest signed broadcast receipt of an event",
+		params: []apiParam{{name: "id", in: "path", typ: "string", description: "event ID", required: true}}, response: "NostrEvent"},
+	{pattern: "/api/report", methods: []string{http.MethodGet}, summary: "Latest signed daily report", response: "NostrEvent"},
+	{pattern: "/api/probe", methods: []string{http.MethodPost}, summary: "Latency measurements from a remote probe agent",
+		auth: authProbe, body: "ProbeReport", response: "ProbeResult"},
+	{pattern: "/api/testsink", methods: []string{http.MethodGet, http.MethodDelete}, summary: "TEST_MODE: recorded publishes (GET) or clear them (DELETE)",
+		params: []apiParam{queryParam("id", "string", "only the publishes of this event")}},
+	{pattern: "/admin/relays/reset", methods: []string{http.MethodPost}, summary: "Reset one relay's stats",
+		auth: authOperator, params: []apiParam{requiredQuery("url", "string", "relay URL")}},
+	{pattern: "/admin/relays/reset-all", methods: []string{http.MethodPost}, summary: "Reset every relay's stats", auth: authOperator},
+	{pattern: "/admin/stats/reset", methods: []string{http.MethodPost}, summary: "Reset the global broadcaster counters", auth: authOperator},
+	{pattern: "/admin/pause", methods: []string{http.MethodPost}, summary: "Pause all outbound publishing",
+		auth: authOperator, params: []apiParam{queryParam("reason", "string", "shown in /health")}, response: "PauseState"},
+	{pattern: "/admin/resume", methods: []string{http.MethodPost}, summary: "Resume publishing and drain the queue", auth: authOperator, response: "PauseState"},
+	{pattern: "/admin/mandatory", methods: []string{http.MethodPost}, summary: "Add a mandatory relay, optionally replaying recent events to it",
+		auth: authOperator, params: []apiParam{
+			requiredQuery("url", "string", "ws:// or wss:// relay URL"),
+			queryParam("backfill", "string", "replay the events of this last duration, e.g. 6h"),
+		}},
+	{pattern: "/admin/greylist", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+		summary: "List greylisted sources (GET, reader), add one (POST) or lift one (DELETE, operator)",
+		auth:    authReader, params: []apiParam{
+			queryParam("ip", "string", "client IP (POST, DELETE)"),
+			queryParam("pubkey", "string", "author pubkey (POST, DELETE)"),
+			queryParam("duration", "string", "how long, e.g. 1h (POST)"),
+		}},
+	{pattern: "/admin/report/publish", methods: []string{http.MethodPost}, summary: "Close the report period and publish its report now", auth: authOperator, response: "NostrEvent"},
+	{pattern: "/admin/topn/recompute", methods: []string{http.MethodPost}, summary: "Recompute and return the top-N set", auth: authOperator},
+	{pattern: "/admin/logging", methods: []string{http.MethodGet, http.MethodPost}, summary: "Verbose log filters (GET, reader) or set them (POST, operator)",
+		auth: authReader, params: []apiParam{queryParam("verbose", "string", "filters, e.g. all,-broadcaster.addEventToCache (POST)")}},
+	{pattern: "/admin/notice", methods: []string{http.MethodPost}, summary: "Send a NOTICE to every connected WebSocket client",
+		auth: authOperator, params: []apiParam{requiredQuery("message", "string", "the announcement (also accepted as a form field)")},
+		response: "NoticeResult"},
+	{pattern: "/admin/motd", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+		summary: "Message of the day sent on connect (GET, reader), set it (POST) or clear it (DELETE, operator)",
+		auth:    authReader, params: []apiParam{queryParam("message", "string", "the MOTD (POST; also accepted as a form field)")},
+		response: "MOTD"},
+	{pattern: "/admin/samples", methods: []string{http.MethodGet}, summary: "Sampled event metadata, newest first",
+		auth: authReader, params: []apiParam{
+			queryParam("kind", "integer", "event kind"),
+			queryParam("author", "string", "author pubkey hex prefix"),
+			queryParam("since", "integer", "unix time"),
+			queryParam("limit", "integer", "at most this many (default 100)"),
+		}},
+	{pattern: "/admin/handshakes", methods: []string{http.MethodGet}, summary: "Export the outbound connection audit trail as JSON lines, oldest first",
+		auth: authReader, params: []apiParam{
+			queryParam("since", "integer", "unix time"),
+			queryParam("relay", "string", "relay URL"),
+		}, produces: "application/x-ndjson", response: "String"},
+	{pattern: "/admin/audit", methods: []string{http.MethodGet}, summary: "Recent mutating admin requests, newest first", auth: authReader},
+	{pattern: "/admin/trace/start", methods: []string{http.MethodPost}, summary: "Start an open-ended runtime trace",
+		auth: authOperator, params: []apiParam{queryParam("max", "string", "stop after this duration at the latest")}, response: "TraceState"},
+	{pattern: "/admin/trace/stop", methods: []string{http.MethodPost}, summary: "Stop the runtime trace", auth: authOperator, response: "TraceState"},
+	{pattern: "/admin/trace", methods: []string{http.MethodGet}, summary: "State of the current or last runtime trace", auth: authReader, response: "TraceState"},
+	{pattern: "/admin/trace/download", methods: []string{http.MethodGet}, summary: "Download the last finished trace (go tool trace)",
+		auth: authReader, produces: "application/octet-stream", response: "Binary"},
+	{pattern: "/debug/pprof/", methods: []string{http.MethodGet}, summary: "pprof index and named profiles", auth: authOperator,
+		produces: "text/plain", response: "String", unversioned: true},
+	{pattern: "/debug/pprof/cmdline", methods: []string{http.MethodGet}, summary: "pprof command line", auth: authOperator,
+		produces: "text/plain", response: "String", unversioned: true},
+	{pattern: "/debug/pprof/profile", methods: []string{http.MethodGet}, summary: "pprof CPU profile",
+		auth: authOperator, params: []apiParam{queryParam("seconds", "integer", "duration (default 30)")},
+		produces: "application/octet-stream", response: "Binary", unversioned: true},
+	{pattern: "/debug/pprof/symbol", methods: []string{http.MethodGet, http.MethodPost}, summary: "pprof symbol lookup", auth: authOperator,
+		produces: "text/plain", response: "String", unversioned: true},
+	{pattern: "/debug/pprof/trace", methods: []string{http.MethodGet}, summary: "Fixed-length execution trace",
+		auth: authOperator, params: []apiParam{queryParam("seconds", "integer", "duration (default 1)")},
+		produces: "application/octet-stream", response: "Binary", unversioned: true},
+	{pattern: federation.GossipPath, methods: []string{http.MethodGet}, summary: "Federation gossip pulled by peer instances",
+		auth: authFederation, unversioned: true},
+	{pattern: federation.ForwardPath, methods: []string{http.MethodPost}, summary: "An event a peer instance hands over for the relays this one owns",
+		auth: authFederation, body: "FederationHandoff", response: "HandoffResult", unversioned: true},
+}
+
+// apiMux registers the endpoints of apiEndpoints at their unversioned path and under apiPrefix,
+// and remembers which ones this instance serves for the OpenAPI document
+type apiMux struct {
+	*http.ServeMux
+	registered map[string]bool
+}
+
+func newAPIMux() *apiMux {
+	return &apiMux{ServeMux: http.NewServeMux(), registered: make(map[string]bool)}
+}
+
+// Handle registers handler for pattern and its versioned path
+func (m *apiMux) Handle(pattern string, handler http.Handler) {
+	m.ServeMux.Handle(pattern, handler)
+	endpoint := findEndpoint(pattern)
+	if endpoint == nil {
+		if strings.HasPrefix(pattern, "/api/") || strings.HasPrefix(pattern, "/admin/") {
+			logging.DebugMethod("relay", "apiMux", "Endpoint %s is not in the API description", pattern)
+		}
+		return
+	}
+	m.registered[pattern] = true
+	if !endpoint.unversioned {
+		m.ServeMux.Handle(versionedPath(pattern), handler)
+	}
+}
+
+// HandleFunc registers handler for pattern and its versioned path
+func (m *apiMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// versionedPath maps an unversioned path to its place under apiPrefix: /stats -> /api/v1/stats,
+// /api/relay -> /api/v1/relay, /admin/pause -> /api/v1/admin/pause
+func versionedPath(pattern string) string {
+	return apiPrefix + strings.TrimPrefix(pattern, "/api")
+}
+
+func findEndpoint(pattern string) *apiEndpoint {
+	for i := range apiEndpoints {
+		if apiEndpoints[i].pattern == pattern {
+			return &apiEndpoints[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/crash"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// publishBatch holds the events one connection published since its last flush
+type publishBatch struct {
+	mu     sync.Mutex
+	events []broadcaster.BatchEvent
+	timer  *time.Timer // pending delayed flush, nil when the batch is empty
+}
+
+// publishBatcher coalesces the accepted events of each client connection and hands them to the
+// broadcaster together: a bulk importer's hundreds of events cost one dedup-cache update per
+// batch instead of one per event. Every event still gets its own OK as soon as it is accepted;
+// only the hand-off to the broadcast queue is delayed, by at most delay.
+type publishBatcher struct {
+	r       *Relay
+	size    int           // flush as soon as a batch reaches this many events
+	delay   time.Duration // flush a smaller batch this long after its first event
+	batches sync.Map      // *khatru.WebSocket -> *publishBatch
+
+	flushes int64
+	events  int64
+	skipped int64 // already cached when the batch was flushed
+}
+
+func newPublishBatcher(r *Relay, size int, delay time.Duration) *publishBatcher {
+	if delay <= 0 {
+		delay = 25 * time.Millisecond
+	}
+	return &publishBatcher{r: r, size: size, delay: delay}
+}
+
+// apply flushes a connection's batch when it closes
+func (pb *publishBatcher) apply(relay *khatru.Relay) {
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return
+		}
+		if v, ok := pb.batches.LoadAndDelete(ws); ok {
+			pb.flush(v.(*publishBatch))
+		}
+	})
+}
+
+// add queues an accepted event on its connection's batch. Events without a connection (e.g.
+// injected internally) are broadcast right away.
+func (pb *publishBatcher) add(ctx context.Context, event *nostr.Event, topN int) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		pb.r.handleEvent(event, topN)
+		return
+	}
+	actual, _ := pb.batches.LoadOrStore(ws, &publishBatch{})
+	batch := actual.(*publishBatch)
+
+	batch.mu.Lock()
+	batch.events = append(batch.events, broadcaster.BatchEvent{Event: event, TopN: topN})
+	full := len(batch.events) >= pb.size
+	if !full && batch.timer == nil {
+		batch.timer = time.AfterFunc(pb.delay, func() { pb.flush(batch) })
+	}
+	batch.mu.Unlock()
+
+	if full {
+		pb.flush(batch)
+	}
+}
+
+// flush hands the batch's events to the broadcaster
+func (pb *publishBatcher) flush(batch *publishBatch) {
+	defer crash.Recover("relay.batch")
+	batch.mu.Lock()
+	events := batch.events
+	batch.events = nil
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+	batch.mu.Unlock()
+
+	ready := events[:0]
+	for _, item := range events {
+		if pb.r.prepareEvent(item.Event) {
+			ready = append(ready, item)
+		}
+	}
+	if len(ready) == 0 {
+		return
+	}
+	queued := pb.r.broadcastSystem.BroadcastBatch(ready)
+	atomic.AddInt64(&pb.flushes, 1)
+	atomic.AddInt64(&pb.events, int64(len(ready)))
+	atomic.AddInt64(&pb.skipped, int64(len(ready)-queued))
+	logging.DebugMethod("relay", "publishBatch", "Flushed a batch of %d events (%d queued)", len(ready), queued)
+}
+
+// GetStatsName returns the name for this stats provider
+func (pb *publishBatcher) GetStatsName() string {
+	return "publish_batching"
+}
+
+// GetStats returns the batching counters as a JsonEntity
+func (pb *publishBatcher) GetStats() json.JsonEntity {
+	flushes := atomic.LoadInt64(&pb.flushes)
+	events := atomic.LoadInt64(&pb.events)
+	avg := 0.0
+	if flushes > 0 {
+		avg = float64(events) / float64(flushes)
+	}
+	obj := json.NewJsonObject()
+	obj.Set("max_batch", json.NewJsonValue(pb.size))
+	obj.Set("delay_ms", json.NewJsonValue(pb.delay.Milliseconds()))
+	obj.Set("flushes", json.NewJsonValue(flushes))
+	obj.Set("events", json.NewJsonValue(events))
+	obj.Set("avg_batch", json.NewJsonValue(avg))
+	obj.Set("skipped_cached", json.NewJsonValue(atomic.LoadInt64(&pb.skipped)))
+	return obj
+}
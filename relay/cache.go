@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Cache-Control policies of the HTTP endpoints
+const (
+	cacheMainPage = "public, max-age=60"
+	cacheNIP11    = "public, max-age=300"
+	cacheStatic   = "public, max-age=86400"
+	cacheStats    = "no-cache" // always revalidated, answered 304 while nothing changed
+)
+
+// cacheable sets cacheControl on the responses of h and gives successful ones an ETag, answering
+// 304 Not Modified when it matches the request's If-None-Match. The response is buffered to hash
+// it, so h must not stream. A handler that knows a cheaper validator sets ETag itself.
+func cacheable(cacheControl string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			h.ServeHTTP(w, req)
+			return
+		}
+		rec := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+		h.ServeHTTP(rec, req)
+
+		if rec.status == http.StatusOK {
+			w.Header().Set("Cache-Control", cacheControl)
+			etag := w.Header().Get("ETag")
+			if etag == "" {
+				etag = bodyETag(rec.body.Bytes())
+				w.Header().Set("ETag", etag)
+			}
+			if etagMatches(req.Header.Get("If-None-Match"), etag) {
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// bodyETag is a strong validator for body
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// etagMatches implements the weak comparison of If-None-Match: "*" or any listed tag equal to
+// etag once W/ prefixes are ignored
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedResponse collects a response so it can be validated before it is sent
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wrote {
+		b.status = status
+		b.wrote = true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wrote = true
+	return b.body.Write(p)
+}
+
+// staticCache marks static assets (icons, banners) as cacheable for a day; the file server
+// handles revalidation through Last-Modified
+func staticCache(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", cacheStatic)
+		h.ServeHTTP(w, req)
+	})
+}
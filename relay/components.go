@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"github.com/girino/nostr-brodcast-relay/lifecycle"
+)
+
+// OutputComponents returns the loops consuming what the broadcaster produces (the receipt
+// publisher, the handshake log, the media mirror), for the supervisor to start before the
+// broadcast system and stop after it, so the receipts, handshakes and mirrors of the events
+// drained on shutdown still go out
+func (r *Relay) OutputComponents() []lifecycle.Component {
+	var components []lifecycle.Component
+	if r.receipts != nil {
+		components = append(components, lifecycle.Run("receipts", r.receipts.Run))
+	}
+	if r.handshakes != nil {
+		components = append(components, lifecycle.Loop("handshakes", r.handshakes.Run))
+	}
+	if r.mediaMirror != nil {
+		components = append(components, lifecycle.Loop("media-mirror", r.mediaMirror.Run))
+	}
+	return components
+}
+
+// Components returns the background loops of the relay server, for the supervisor to start after
+// the broadcast system and stop before it: the canary and the relay list publish through it
+func (r *Relay) Components() []lifecycle.Component {
+	var components []lifecycle.Component
+	if r.sessions != nil {
+		components = append(components, lifecycle.Loop("session-summaries", r.sessions.run))
+	}
+	if r.reputation != nil {
+		components = append(components, lifecycle.Loop("reputation", r.reputation.Run))
+	}
+	if r.publishAuth != nil {
+		components = append(components, lifecycle.Loop("publish-auth", r.publishAuth.run))
+	}
+	if r.reporter != nil {
+		components = append(components, lifecycle.Loop("reporter", r.reporter.Run))
+	}
+	if r.canary != nil {
+		components = append(components, lifecycle.Loop("canary", r.canary.Run))
+	}
+	if r.relayList != nil {
+		components = append(components, lifecycle.Loop("relay-list", r.relayList.Run))
+	}
+	return components
+}
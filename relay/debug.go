@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/trace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// maxTraceDuration stops a runtime trace nobody stopped, so a forgotten capture cannot grow
+// without bound
+const maxTraceDuration = 5 * time.Minute
+
+// traceCapture holds at most one runtime execution trace, running or finished, in memory
+type traceCapture struct {
+	mu       sync.Mutex
+	running  bool
+	buf      *bytes.Buffer
+	started  time.Time
+	stopped  time.Time
+	autoStop *time.Timer
+}
+
+// start begins a trace that stops by itself after limit; false if one is already running
+func (tc *traceCapture) start(limit time.Duration) (bool, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.running {
+		return false, nil
+	}
+	buf := &bytes.Buffer{}
+	if err := trace.Start(buf); err != nil {
+		return false, err
+	}
+	tc.running = true
+	tc.buf = buf
+	tc.started = time.Now()
+	tc.stopped = time.Time{}
+	tc.autoStop = time.AfterFunc(limit, func() {
+		if tc.stop() {
+			logging.Warn("Relay: Runtime trace stopped after its %v limit", limit)
+		}
+	})
+	return true, nil
+}
+
+// stop ends the running trace; false if none was running
+func (tc *traceCapture) stop() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if !tc.running {
+		return false
+	}
+	trace.Stop()
+	tc.autoStop.Stop()
+	tc.running = false
+	tc.stopped = time.Now()
+	return true
+}
+
+// stateObject describes the current or last trace
+func (tc *traceCapture) stateObject() *json.JsonObject {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("running", json.NewJsonValue(tc.running))
+	if !tc.started.IsZero() {
+		obj.Set("started", json.NewJsonValue(tc.started.Format(time.RFC3339)))
+	}
+	if !tc.stopped.IsZero() {
+		obj.Set("stopped", json.NewJsonValue(tc.stopped.Format(time.RFC3339)))
+		obj.Set("bytes", json.NewJsonValue(tc.buf.Len()))
+	}
+	obj.Set("goroutines", json.NewJsonValue(runtime.NumGoroutine()))
+	return obj
+}
+
+// registerDebugHandlers adds net/http/pprof under /debug/pprof/ and runtime trace capture
+// under /admin/trace/, behind admin tokens: profiles and trace capture need an operator token,
+// the trace state and download a reader token
+func (r *Relay) registerDebugHandlers(mux *apiMux) {
+	// Index and named profiles (goroutine, heap, allocs, block, mutex, threadcreate):
+	// GET /debug/pprof/, GET /debug/pprof/goroutine?debug=2
+	mux.HandleFunc("/debug/pprof/", r.requireAdmin(roleOperator, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", r.requireAdmin(roleOperator, pprof.Cmdline))
+	// CPU profile: GET /debug/pprof/profile?seconds=30
+	mux.HandleFunc("/debug/pprof/profile", r.requireAdmin(roleOperator, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", r.requireAdmin(roleOperator, pprof.Symbol))
+	// Fixed-length execution trace: GET /debug/pprof/trace?seconds=5
+	mux.HandleFunc("/debug/pprof/trace", r.requireAdmin(roleOperator, pprof.Trace))
+
+	// Open-ended execution trace: POST /admin/trace/start?max=2m
+	mux.HandleFunc("/admin/trace/start", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		limit := maxTraceDuration
+		if raw := req.URL.Query().Get("max"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 || d > maxTraceDuration {
+				http.Error(w, fmt.Sprintf("Invalid max duration (up to %v)", maxTraceDuration), http.StatusBadRequest)
+				return
+			}
+			limit = d
+		}
+		started, err := r.trace.start(limit)
+		if err != nil {
+			// e.g. a /debug/pprof/trace capture is in progress
+			http.Error(w, "Failed to start trace: "+err.Error(), http.StatusConflict)
+			return
+		}
+		if !started {
+			http.Error(w, "Trace already running", http.StatusConflict)
+			return
+		}
+		logging.Info("Relay: Admin started runtime trace from %s (max %v)", req.RemoteAddr, limit)
+		writeJSON(w, http.StatusOK, r.trace.stateObject())
+	})))
+
+	// POST /admin/trace/stop
+	mux.HandleFunc("/admin/trace/stop", r.requireAdmin(roleOperator, requirePost(func(w http.ResponseWriter, req *http.Request) {
+		if !r.trace.stop() {
+			http.Error(w, "No trace running", http.StatusConflict)
+			return
+		}
+		logging.Info("Relay: Admin stopped runtime trace from %s", req.RemoteAddr)
+		writeJSON(w, http.StatusOK, r.trace.stateObject())
+	})))
+
+	// State of the current or last trace: GET /admin/trace
+	// Download the last finished trace (go tool trace <file>): GET /admin/trace/download
+	mux.HandleFunc("/admin/trace", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.trace.stateObject())
+	}))
+	mux.HandleFunc("/admin/trace/download", r.requireAdmin(roleReader, func(w http.ResponseWriter, req *http.Request) {
+		r.trace.mu.Lock()
+		defer r.trace.mu.Unlock()
+		if r.trace.running {
+			http.Error(w, "Trace still running, stop it first", http.StatusConflict)
+			return
+		}
+		if r.trace.buf == nil {
+			http.Error(w, "No trace captured", http.StatusNotFound)
+			return
+		}
+		name := "broadcast-relay-" + r.trace.started.UTC().Format("20060102-150405") + ".trace"
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(r.trace.buf.Len()))
+		w.Write(r.trace.buf.Bytes())
+	}))
+
+	logging.Debug("Relay: Debug endpoints ready")
+}
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fanoutTag is the event tag a trusted client uses to pick the broadcast breadth: ["fanout", "wide"]
+const fanoutTag = "fanout"
+
+// fanoutHints maps per-event breadth hints from NIP-42-authenticated trusted clients to relay-set sizes
+type fanoutHints struct {
+	trusted map[string]bool
+	levels  map[string]int
+}
+
+func newFanoutHints(trustedPubkeys []string, levels map[string]int) *fanoutHints {
+	trusted := make(map[string]bool, len(trustedPubkeys))
+	for _, pk := range trustedPubkeys {
+		trusted[pk] = true
+	}
+	return &fanoutHints{trusted: trusted, levels: levels}
+}
+
+// apply asks clients sending a hint without being authenticated to AUTH first, so the hint is
+// never silently dropped because of a missing handshake
+func (fh *fanoutHints) apply(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if hintLevel(event) == "" || khatru.GetConnection(ctx) == nil || khatru.GetAuthed(ctx) != "" {
+			return false, ""
+		}
+		khatru.RequestAuth(ctx)
+		return true, "auth-required: fanout hints require NIP-42 authentication"
+	})
+}
+
+// topN returns the relay-set size requested by event, or 0 for the default breadth. Hints from
+// unauthenticated or untrusted connections and unknown levels are ignored.
+func (fh *fanoutHints) topN(ctx context.Context, event *nostr.Event) int {
+	if fh == nil {
+		return 0
+	}
+	level := hintLevel(event)
+	if level == "" {
+		return 0
+	}
+	authed := khatru.GetAuthed(ctx)
+	if !fh.trusted[authed] {
+		logging.DebugMethod("relay", "fanout", "Ignoring fanout hint %q on event %s: %q is not trusted", level, event.ID, authed)
+		return 0
+	}
+	size, ok := fh.levels[level]
+	if !ok {
+		logging.DebugMethod("relay", "fanout", "Ignoring unknown fanout level %q on event %s", level, event.ID)
+		return 0
+	}
+	logging.DebugMethod("relay", "fanout", "Event %s fanout %q (%d relays) requested by %s", event.ID, level, size, authed)
+	return size
+}
+
+func hintLevel(event *nostr.Event) string {
+	tag := event.Tags.GetFirst([]string{fanoutTag, ""})
+	if tag == nil || len(*tag) < 2 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace((*tag)[1]))
+}
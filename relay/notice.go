@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxNoticeLength bounds operator announcements and the MOTD
+const maxNoticeLength = 1000
+
+// announcer sends operator NOTICEs to WebSocket clients: announcements to everyone connected, and
+// the message of the day to each client as it connects
+type announcer struct {
+	conns sync.Map // *khatru.WebSocket -> struct{}, the connected clients
+
+	mu   sync.Mutex
+	motd string // "" = none
+
+	connected     int64
+	announcements int64 // announcements pushed
+	delivered     int64 // announcement NOTICEs written
+	failed        int64 // announcement NOTICEs that could not be written
+	motdSent      int64
+}
+
+func newAnnouncer(motd string) *announcer {
+	return &announcer{motd: motd}
+}
+
+// apply registers the hooks tracking the connected clients and sending the MOTD
+func (a *announcer) apply(relay *khatru.Relay) {
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return
+		}
+		a.conns.Store(ws, struct{}{})
+		atomic.AddInt64(&a.connected, 1)
+		if motd := a.MOTD(); motd != "" {
+			if err := ws.WriteJSON(nostr.NoticeEnvelope(motd)); err != nil {
+				logging.DebugMethod("relay", "motd", "Failed to send MOTD: %v", err)
+				return
+			}
+			atomic.AddInt64(&a.motdSent, 1)
+		}
+	})
+
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			if _, ok := a.conns.LoadAndDelete(ws); ok {
+				atomic.AddInt64(&a.connected, -1)
+			}
+		}
+	})
+}
+
+// Announce sends message as a NOTICE to every connected client and returns to how many it was
+// written and for how many that failed
+func (a *announcer) Announce(message string) (delivered, failed int) {
+	a.conns.Range(func(key, value any) bool {
+		if err := key.(*khatru.WebSocket).WriteJSON(nostr.NoticeEnvelope(message)); err != nil {
+			failed++
+		} else {
+			delivered++
+		}
+		return true
+	})
+	atomic.AddInt64(&a.announcements, 1)
+	atomic.AddInt64(&a.delivered, int64(delivered))
+	atomic.AddInt64(&a.failed, int64(failed))
+	return delivered, failed
+}
+
+// MOTD returns the message of the day ("" = none)
+func (a *announcer) MOTD() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.motd
+}
+
+// SetMOTD replaces the message of the day; "" stops sending one
+func (a *announcer) SetMOTD(motd string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.motd = motd
+}
+
+// GetStatsName returns the name for this stats provider
+func (a *announcer) GetStatsName() string {
+	return "notices"
+}
+
+// GetStats returns the announcement counters as a JsonEntity
+func (a *announcer) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("connected_clients", json.NewJsonValue(atomic.LoadInt64(&a.connected)))
+	obj.Set("motd", json.NewJsonValue(a.MOTD()))
+	obj.Set("motd_sent", json.NewJsonValue(atomic.LoadInt64(&a.motdSent)))
+	obj.Set("announcements", json.NewJsonValue(atomic.LoadInt64(&a.announcements)))
+	obj.Set("delivered", json.NewJsonValue(atomic.LoadInt64(&a.delivered)))
+	obj.Set("failed", json.NewJsonValue(atomic.LoadInt64(&a.failed)))
+	return obj
+}
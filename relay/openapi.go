@@ -0,0 +1,379 @@
+package relay
+
+import (
+	stdjson "encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// object and the other helpers below keep the schema table readable
+type object = map[string]any
+
+func schemaRef(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func integerProp(description string) object {
+	return object{"type": "integer", "description": description}
+}
+
+func stringProp(description string) object {
+	return object{"type": "string", "description": description}
+}
+
+func boolProp(description string) object {
+	return object{"type": "boolean", "description": description}
+}
+
+func stringListProp(description string) object {
+	return object{"type": "array", "items": object{"type": "string"}, "description": description}
+}
+
+// apiSchemas are the bodies the endpoints take and return
+var apiSchemas = object{
+	"Object": object{"type": "object", "additionalProperties": true},
+	"String": object{"type": "string"},
+	"Binary": object{"type": "string", "format": "binary"},
+	"Error":  object{"type": "string", "description": "plain-text error message"},
+	"StatsDocument": object{
+		"type":                 "object",
+		"description":          "one section per module (queue, cache, manager, broadcaster...), in registration order",
+		"properties":           object{"timestamp": integerProp("unix time")},
+		"additionalProperties": true,
+	},
+	"Health": object{
+		"type": "object",
+		"properties": object{
+			"status":        object{"type": "string", "enum": []string{"healthy", "degraded", "unhealthy", "paused"}},
+			"color":         object{"type": "string", "enum": []string{"green", "yellow", "red"}},
+			"total_relays":  integerProp("relays known"),
+			"active_relays": integerProp("relays in the top N set"),
+			"max_relays":    integerProp("size of the top N set"),
+			"paused":        boolProp("outbound publishing is paused"),
+			"paused_since":  integerProp("unix time (while paused)"),
+			"pause_reason":  stringProp("while paused"),
+			"pause_mode":    stringProp("while paused: queue or reject"),
+			"timestamp":     integerProp("unix time"),
+		},
+	},
+	"Readiness": object{
+		"type": "object",
+		"properties": object{
+			"status":    object{"type": "string", "enum": []string{"ready", "degraded"}},
+			"reason":    stringProp("why the instance is degraded"),
+			"canary":    object{"type": "object", "additionalProperties": true, "description": "pipeline canary stats"},
+			"timestamp": integerProp("unix time"),
+		},
+	},
+	"Version": object{
+		"type": "object",
+		"properties": object{
+			"version":        stringProp("release version"),
+			"commit":         stringProp("git commit the binary was built from"),
+			"modified":       boolProp("built from a checkout with uncommitted changes"),
+			"build_time":     stringProp("RFC 3339 (the commit time when not set at build time)"),
+			"go_version":     stringProp("Go toolchain"),
+			"platform":       stringProp("GOOS/GOARCH"),
+			"started_at":     integerProp("unix time the process started"),
+			"uptime_seconds": integerProp("process uptime"),
+			"nip11_version":  stringProp("version advertised in NIP-11"),
+		},
+	},
+	"RelayStats": object{
+		"type":                 "object",
+		"description":          "score, success rate, response time, failure classes and recent errors of one relay",
+		"properties":           object{"url": stringProp("relay URL")},
+		"additionalProperties": true,
+	},
+	"KindMatrix": object{
+		"type": "object",
+		"properties": object{
+			"window_seconds": integerProp("rolling window"),
+			"kinds":          object{"type": "array", "items": object{"type": "integer"}, "description": "kinds present in the matrix"},
+			"relays": object{
+				"type":                 "object",
+				"description":          "relay URL -> attempts, successes, success_rate and kinds (kind -> attempts, successes, success_rate)",
+				"additionalProperties": object{"type": "object", "additionalProperties": true},
+			},
+		},
+	},
+	"ConsistencyReport": object{
+		"type": "object",
+		"properties": object{
+			"threshold":           object{"type": "number", "description": "consistency below which a relay is listed"},
+			"scored_relays":       integerProp("relays with enough observations to be scored"),
+			"inconsistent_relays": integerProp("relays listed"),
+			"relays": object{"type": "array",
+				"description": "url, consistency, observations, contradictions (claim -> count), claims, last_contradiction, last_contradiction_at; least consistent first",
+				"items":       object{"type": "object", "additionalProperties": true}},
+		},
+	},
+	"EventOutcome": object{
+		"type": "object",
+		"properties": object{
+			"event_id":    stringProp("event ID"),
+			"status":      object{"type": "string", "enum": []string{"pending", "complete"}},
+			"kind":        integerProp("event kind"),
+			"targets":     integerProp("relays the event was sent to"),
+			"relays":      stringListProp("relays the event is being sent to (pending)"),
+			"planned_at":  integerProp("unix time the broadcast was planned (pending)"),
+			"queued_at":   integerProp("unix time the event was accepted"),
+			"started_at":  integerProp("unix time the broadcast started"),
+			"finished_at": integerProp("unix time the last publish finished"),
+			"accepted": object{"type": "array", "description": "url, response_time_ms, at, attempts, duplicate",
+				"items": object{"type": "object", "additionalProperties": true}},
+			"failed": object{"type": "array", "description": "url, response_time_ms, at, attempts, error",
+				"items": object{"type": "object", "additionalProperties": true}},
+		},
+	},
+	"Decision": object{
+		"type": "object",
+		"properties": object{
+			"event_id": stringProp("event ID"),
+			"kind":     integerProp("event kind"),
+			"pubkey":   stringProp("author pubkey"),
+			"decision": object{"type": "string", "enum": []string{"accepted", "rejected", "skipped"}},
+			"category": stringProp("machine-readable prefix of the reason, e.g. duplicate, rate-limited, blocked"),
+			"reason":   stringProp("the OK message sent to the client, or why the event was not broadcast"),
+			"source":   object{"type": "string", "enum": []string{"client", "ingest"}},
+			"ip":       stringProp("client IP (client events)"),
+			"at":       integerProp("unix time of the decision"),
+			"attempts": integerProp("times the event reached the relay within the retention window"),
+		},
+	},
+	"Plan": object{
+		"type": "object",
+		"properties": object{
+			"event_id":           stringProp("event ID"),
+			"kind":               integerProp("event kind"),
+			"duplicate":          boolProp("the event was already broadcast"),
+			"mandatory":          stringListProp("mandatory relays"),
+			"top":                stringListProp("top N relays"),
+			"excluded_by_policy": stringListProp("relays left out by the relay filters"),
+			"relays":             stringListProp("the relays the event would be sent to"),
+			"total":              integerProp("number of relays"),
+		},
+	},
+	"NostrEvent": object{
+		"type": "object",
+		"properties": object{
+			"id":         stringProp("hex event ID"),
+			"pubkey":     stringProp("hex author pubkey"),
+			"created_at": integerProp("unix time"),
+			"kind":       integerProp("event kind"),
+			"tags":       object{"type": "array", "items": object{"type": "array", "items": object{"type": "string"}}},
+			"content":    object{"type": "string"},
+			"sig":        stringProp("hex Schnorr signature"),
+		},
+	},
+	"ProbeReport": object{
+		"type":     "object",
+		"required": []string{"probe", "region"},
+		"properties": object{
+			"probe":  stringProp("agent name"),
+			"region": stringProp("region the agent measures from"),
+			"results": object{"type": "array", "items": object{
+				"type": "object",
+				"properties": object{
+					"url":        stringProp("relay URL"),
+					"latency_ms": object{"type": "number"},
+					"success":    object{"type": "boolean"},
+				},
+			}},
+		},
+	},
+	"FederationHandoff": object{
+		"type":     "object",
+		"required": []string{"node", "event", "relays"},
+		"properties": object{
+			"node":   stringProp("node ID of the sending instance"),
+			"event":  schemaRef("NostrEvent"),
+			"relays": stringListProp("the relays to publish the event to"),
+		},
+	},
+	"HandoffResult": object{
+		"type":       "object",
+		"properties": object{"queued": boolProp("false if this instance already had the event")},
+	},
+	"ProbeResult": object{
+		"type":       "object",
+		"properties": object{"recorded": integerProp("measurements recorded")},
+	},
+	"PauseState": object{
+		"type": "object",
+		"properties": object{
+			"paused":       boolProp("outbound publishing is paused"),
+			"changed":      boolProp("this request changed the state"),
+			"mode":         stringProp("queue or reject"),
+			"paused_since": integerProp("unix time (while paused)"),
+			"reason":       stringProp("while paused"),
+		},
+	},
+	"NoticeResult": object{
+		"type": "object",
+		"properties": object{
+			"message":   stringProp("the announcement"),
+			"delivered": integerProp("clients it was written to"),
+			"failed":    integerProp("clients it could not be written to"),
+		},
+	},
+	"MOTD": object{
+		"type":       "object",
+		"properties": object{"motd": stringProp("message of the day (empty = none)")},
+	},
+	"TraceState": object{
+		"type":                 "object",
+		"description":          "whether a runtime trace is running, when it started and how large it is",
+		"additionalProperties": true,
+	},
+}
+
+// apiSecuritySchemes are the bearer tokens of the protected endpoints
+var apiSecuritySchemes = object{
+	"adminToken": object{"type": "http", "scheme": "bearer",
+		"description": "ADMIN_TOKENS: reader tokens call the GET endpoints, operator tokens all of them"},
+	"probeToken":       object{"type": "http", "scheme": "bearer", "description": "PROBE_TOKEN"},
+	"federationSecret": object{"type": "http", "scheme": "bearer", "description": "FEDERATION_SECRET, if set"},
+}
+
+// openAPIDocument describes the endpoints this instance serves (disabled features are left out)
+func (r *Relay) openAPIDocument(mux *apiMux) object {
+	paths := object{}
+	for _, endpoint := range apiEndpoints {
+		if !mux.registered[endpoint.pattern] {
+			continue
+		}
+		path := endpoint.pattern
+		description := ""
+		if !endpoint.unversioned {
+			path = versionedPath(endpoint.pattern)
+			description = "Also served at " + endpoint.pattern + "."
+		}
+		operations := object{}
+		for _, method := range endpoint.methods {
+			operations[strings.ToLower(method)] = endpoint.operation(method, path, description)
+		}
+		paths[path] = operations
+	}
+
+	title := r.config.RelayName
+	if title == "" {
+		title = "Broadcast relay"
+	}
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       title + " HTTP API",
+			"version":     r.khatru.Info.Version,
+			"description": "HTTP API of the broadcast relay. Endpoints are versioned under " + apiPrefix + "; the original unversioned paths keep working.",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas":         apiSchemas,
+			"securitySchemes": apiSecuritySchemes,
+		},
+	}
+}
+
+// operation is the OpenAPI operation of one method of the endpoint
+func (e apiEndpoint) operation(method, path, description string) object {
+	op := object{
+		"operationId": operationID(method, path),
+		"summary":     e.summary,
+	}
+	if description != "" {
+		op["description"] = description
+	}
+
+	if len(e.params) > 0 {
+		params := make([]object, 0, len(e.params))
+		for _, p := range e.params {
+			param := object{"name": p.name, "in": p.in, "schema": object{"type": p.typ}}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			if p.required {
+				param["required"] = true
+			}
+			params = append(params, param)
+		}
+		op["parameters"] = params
+	}
+
+	if e.body != "" && (method == http.MethodPost || method == http.MethodPut) {
+		op["requestBody"] = object{
+			"required": true,
+			"content":  object{"application/json": object{"schema": schemaRef(e.body)}},
+		}
+	}
+
+	response := e.response
+	if response == "" {
+		response = "Object"
+	}
+	produces := e.produces
+	if produces == "" {
+		produces = "application/json"
+	}
+	content := object{}
+	for _, contentType := range strings.Split(produces, ", ") {
+		schema := schemaRef("String")
+		if contentType == "application/json" || contentType == "application/octet-stream" {
+			schema = schemaRef(response)
+		}
+		content[contentType] = object{"schema": schema}
+	}
+	errorBody := object{"text/plain": object{"schema": schemaRef("Error")}}
+	responses := object{
+		"200":     object{"description": "Success", "content": content},
+		"default": object{"description": "Error", "content": errorBody},
+	}
+
+	switch e.auth {
+	case authReader, authOperator:
+		op["security"] = []object{{"adminToken": []string{}}}
+		responses["401"] = object{"description": "Missing or unknown token", "content": errorBody}
+		responses["403"] = object{"description": "The token's role is not allowed", "content": errorBody}
+		if e.auth == authOperator {
+			op["x-required-role"] = authOperator
+		}
+	case authProbe:
+		op["security"] = []object{{"probeToken": []string{}}}
+		responses["401"] = object{"description": "Wrong token", "content": errorBody}
+	case authFederation:
+		op["security"] = []object{{"federationSecret": []string{}}}
+	}
+	op["responses"] = responses
+	return op
+}
+
+// operationID derives a stable ID from the method and path: GET /api/v1/admin/trace/download ->
+// getAdminTraceDownload
+func operationID(method, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+	path = strings.TrimPrefix(path, apiPrefix)
+	for _, word := range strings.FieldsFunc(path, func(c rune) bool {
+		return c == '/' || c == '-' || c == '.' || c == '{' || c == '}'
+	}) {
+		sb.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return sb.String()
+}
+
+// serveOpenAPI returns the OpenAPI document of mux
+func (r *Relay) serveOpenAPI(mux *apiMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		jsonData, err := stdjson.MarshalIndent(r.openAPIDocument(mux), "", "  ")
+		if err != nil {
+			logging.Error("Failed to marshal the OpenAPI document: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonData)
+	}
+}
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"crypto/subtle"
+	stdjson "encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/regions"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// probeReport is what a remote probe agent POSTs to /api/probe
+type probeReport struct {
+	Probe   string                `json:"probe"`  // agent name
+	Region  string                `json:"region"` // region the agent measures from
+	Results []regions.Measurement `json:"results"`
+}
+
+// registerProbeHandler adds POST /api/probe for remote latency probes (requires PROBE_TOKEN)
+func (r *Relay) registerProbeHandler(mux *apiMux) {
+	if r.config.ProbeToken == "" {
+		return
+	}
+
+	mux.HandleFunc("/api/probe", requirePost(func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(r.config.ProbeToken)) != 1 {
+			logging.Warn("Relay: Unauthorized probe report from %s", req.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var report probeReport
+		if err := stdjson.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&report); err != nil {
+			http.Error(w, "Invalid probe report", http.StatusBadRequest)
+			return
+		}
+		report.Region = strings.TrimSpace(report.Region)
+		if report.Probe == "" || report.Region == "" {
+			http.Error(w, "Missing probe or region", http.StatusBadRequest)
+			return
+		}
+
+		recorded, ok := r.broadcastSystem.RecordProbe(report.Probe, report.Region, report.Results)
+		if !ok {
+			http.Error(w, "Regional selection disabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		resp := json.NewJsonObject()
+		resp.Set("recorded", json.NewJsonValue(recorded))
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	logging.Debug("Relay: Probe endpoint ready")
+}
@@ -0,0 +1,176 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// followsFetchTimeout bounds one fetch of the operator's contact list
+const followsFetchTimeout = 30 * time.Second
+
+// publishAuth restricts who may publish through the relay (NIP-42): clients must authenticate,
+// and with an allowlist or an operator follow list only those pubkeys are let through. Without
+// it the public endpoint amplifies anyone's spam to hundreds of relays.
+type publishAuth struct {
+	allowed   map[string]bool // static allowlist (empty = any authenticated pubkey, unless followsOf is set)
+	followsOf string          // operator pubkey whose follows may publish ("" = none)
+	seeds     []string        // relays the contact list is fetched from
+	refresh   time.Duration
+
+	mu        sync.RWMutex
+	follows   map[string]bool
+	fetchedAt time.Time
+
+	challenged int64 // events rejected because the client was not authenticated
+	denied     int64 // events rejected because the authenticated pubkey is not allowed
+	allowedN   int64
+}
+
+func newPublishAuth(allowed []string, followsOf string, seeds []string, refresh time.Duration) *publishAuth {
+	pa := &publishAuth{
+		allowed:   make(map[string]bool, len(allowed)),
+		followsOf: followsOf,
+		seeds:     seeds,
+		refresh:   refresh,
+		follows:   make(map[string]bool),
+	}
+	for _, pk := range allowed {
+		pa.allowed[pk] = true
+	}
+	return pa
+}
+
+// restricted reports whether only some authenticated pubkeys may publish
+func (pa *publishAuth) restricted() bool {
+	return len(pa.allowed) > 0 || pa.followsOf != ""
+}
+
+// apply challenges clients on connect and rejects events from unauthenticated or disallowed
+// connections. Events that do not come from a WebSocket client (pull mode, own events) pass.
+func (pa *publishAuth) apply(relay *khatru.Relay) {
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		if khatru.GetConnection(ctx) != nil {
+			khatru.RequestAuth(ctx)
+		}
+	})
+
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if khatru.GetConnection(ctx) == nil {
+			return false, ""
+		}
+		authed := khatru.GetAuthed(ctx)
+		if authed == "" {
+			atomic.AddInt64(&pa.challenged, 1)
+			khatru.RequestAuth(ctx)
+			return true, "auth-required: publishing requires NIP-42 authentication"
+		}
+		if !pa.allows(authed) {
+			atomic.AddInt64(&pa.denied, 1)
+			logging.DebugMethod("relay", "publishAuth", "Rejecting event %s: %s may not publish", event.ID, authed)
+			return true, "restricted: this pubkey may not publish through this relay"
+		}
+		atomic.AddInt64(&pa.allowedN, 1)
+		return false, ""
+	})
+}
+
+// allows reports whether the authenticated pubkey may publish
+func (pa *publishAuth) allows(pubkey string) bool {
+	if !pa.restricted() || pa.allowed[pubkey] || pubkey == pa.followsOf {
+		return true
+	}
+	pa.mu.RLock()
+	defer pa.mu.RUnlock()
+	return pa.follows[pubkey]
+}
+
+// run keeps the operator's follow list current until ctx is canceled
+func (pa *publishAuth) run(ctx context.Context) {
+	if pa.followsOf == "" {
+		return
+	}
+	pa.fetchFollows(ctx)
+	if pa.refresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pa.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pa.fetchFollows(ctx)
+		}
+	}
+}
+
+// fetchFollows replaces the follow list with the latest contact list (kind 3) found on the seed
+// relays; when none is found the previous list is kept
+func (pa *publishAuth) fetchFollows(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, followsFetchTimeout)
+	defer cancel()
+	pool := nostr.NewSimplePool(ctx)
+	defer pool.Close("publish follows fetched")
+
+	var contactList *nostr.Event
+	for ie := range pool.FetchMany(ctx, pa.seeds, nostr.Filter{Kinds: []int{3}, Authors: []string{pa.followsOf}, Limit: 1}) {
+		if contactList == nil || ie.CreatedAt > contactList.CreatedAt {
+			contactList = ie.Event
+		}
+	}
+	if contactList == nil {
+		logging.Warn("Relay: No contact list of %s found; keeping %d allowed follows", pa.followsOf, pa.followCount())
+		return
+	}
+
+	follows := make(map[string]bool, len(contactList.Tags))
+	for _, tag := range contactList.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) {
+			follows[tag[1]] = true
+		}
+	}
+	pa.mu.Lock()
+	pa.follows = follows
+	pa.fetchedAt = time.Now()
+	pa.mu.Unlock()
+	logging.Info("Relay: %d follows of %s may publish", len(follows), pa.followsOf)
+}
+
+func (pa *publishAuth) followCount() int {
+	pa.mu.RLock()
+	defer pa.mu.RUnlock()
+	return len(pa.follows)
+}
+
+// GetStatsName returns the name for this stats provider
+func (pa *publishAuth) GetStatsName() string {
+	return "publish_auth"
+}
+
+// GetStats returns the publisher restriction counters as a JsonEntity
+func (pa *publishAuth) GetStats() json.JsonEntity {
+	pa.mu.RLock()
+	follows, fetchedAt := len(pa.follows), pa.fetchedAt
+	pa.mu.RUnlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("restricted", json.NewJsonValue(pa.restricted()))
+	obj.Set("allowed_pubkeys", json.NewJsonValue(len(pa.allowed)))
+	if pa.followsOf != "" {
+		obj.Set("follows_of", json.NewJsonValue(pa.followsOf))
+		obj.Set("follows", json.NewJsonValue(follows))
+		obj.Set("follows_fetched_at", json.NewJsonValue(fetchedAt.Unix()))
+	}
+	obj.Set("auth_challenged", json.NewJsonValue(atomic.LoadInt64(&pa.challenged)))
+	obj.Set("denied", json.NewJsonValue(atomic.LoadInt64(&pa.denied)))
+	obj.Set("allowed", json.NewJsonValue(atomic.LoadInt64(&pa.allowedN)))
+	return obj
+}
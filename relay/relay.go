@@ -2,39 +2,86 @@ package relay
 
 import (
 	"context"
+	stdjson "encoding/json"
 	"fmt"
 	"html/template"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/fiatjaf/khatru"
+	"github.com/girino/nostr-brodcast-relay/broadcast"
+	"github.com/girino/nostr-brodcast-relay/broadcast/federation"
+	"github.com/girino/nostr-brodcast-relay/broadcast/feedback"
+	"github.com/girino/nostr-brodcast-relay/broadcast/kindmatrix"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/broadcast/shard"
+	"github.com/girino/nostr-brodcast-relay/broadcast/testsink"
+	"github.com/girino/nostr-brodcast-relay/buildinfo"
+	"github.com/girino/nostr-brodcast-relay/canary"
 	"github.com/girino/nostr-brodcast-relay/config"
+	"github.com/girino/nostr-brodcast-relay/crash"
+	"github.com/girino/nostr-brodcast-relay/handshakes"
+	"github.com/girino/nostr-brodcast-relay/latency"
+	"github.com/girino/nostr-brodcast-relay/limits"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/mirror"
 	"github.com/girino/nostr-brodcast-relay/ratelimit"
-	"github.com/girino/nostr-lib/broadcast"
-	"github.com/girino/nostr-lib/broadcast/health"
+	"github.com/girino/nostr-brodcast-relay/receipt"
+	"github.com/girino/nostr-brodcast-relay/relaylist"
+	"github.com/girino/nostr-brodcast-relay/report"
+	"github.com/girino/nostr-brodcast-relay/reputation"
+	"github.com/girino/nostr-brodcast-relay/sampling"
+	"github.com/girino/nostr-brodcast-relay/stats"
+	"github.com/girino/nostr-brodcast-relay/validation"
 	json "github.com/girino/nostr-lib/json"
-	"github.com/girino/nostr-lib/logging"
-	"github.com/girino/nostr-lib/stats"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
 type Relay struct {
 	khatru          *khatru.Relay
-	broadcastSystem *broadcast.BroadcastSystem
-	healthChecker   *health.Checker
+	broadcastSystem broadcast.System
 	config          *config.Config
 	port            string
+	receipts        *receipt.Receipts
+	mediaMirror     *mirror.Mirror       // nil unless mirror servers are set (never in TEST_MODE)
+	reporter        *report.Reporter     // nil unless REPORT_ENABLED
+	relayList       *relaylist.Publisher // nil unless RELAY_LIST_PUBLISH
+	sampler         *sampling.Sampler    // nil unless EVENT_SAMPLE_RATE is set
+	handshakes      *handshakes.Log      // nil unless HANDSHAKE_LOG is set
+	sessions        *sessionTracker
+	batcher         *publishBatcher // nil unless PUBLISH_BATCH_SIZE > 1
+	sharder         *shard.Sharder  // nil unless SHARD_COUNT > 1
+	publishAuth     *publishAuth    // nil unless PUBLISH_AUTH_REQUIRED or an allowlist is set
+	notices         *announcer      // operator announcements and the MOTD
+	feedback        *feedback.Tracker
+	validator       *validation.Validator
+	fanout          *fanoutHints // nil unless FANOUT_TRUSTED_PUBKEYS is set
+	trace           traceCapture // runtime trace started from the admin API
+	adminTokens     []adminToken // empty = admin API disabled
+	audit           *auditLog    // mutating admin requests
+	streamCounter   *broadcastCounter
+	canary          *canary.Canary      // nil unless CANARY_INTERVAL is set
+	reputation      *reputation.Checker // nil unless a blocklist file or DNSBLs are set
+	greylist        *ratelimit.Greylist // nil unless GREYLIST_THRESHOLD is set
+	latency         *latency.Recorder
+	selfEcho        *selfEcho          // nil if SELF_ECHO_POLICY=off
+	mainPage        *template.Template // validated at startup
+	decisions       *decisionLog       // nil unless DECISION_RETENTION is set
+	serverStats     *serverStats
 }
 
-func NewRelay(cfg *config.Config, broadcastSystem *broadcast.BroadcastSystem, healthChecker *health.Checker) *Relay {
+func NewRelay(cfg *config.Config, broadcastSystem broadcast.System) *Relay {
 	r := &Relay{
 		khatru:          khatru.NewRelay(),
 		broadcastSystem: broadcastSystem,
-		healthChecker:   healthChecker,
 		config:          cfg,
 		port:            cfg.RelayPort,
+		serverStats:     &serverStats{startedAt: time.Now()},
 	}
 
 	r.setupRelay()
@@ -49,15 +96,10 @@ func (r *Relay) setupRelay() {
 	relayPubkey := ""
 
 	if relayPrivkey != "" {
-		// Decode provided nsec to get private key
-		if _, decoded, err := nip19.Decode(relayPrivkey); err == nil {
-			if sk, ok := decoded.(string); ok {
-				relayPrivkey = sk
-				if pk, err := nostr.GetPublicKey(sk); err == nil {
-					relayPubkey = pk
-					logging.DebugMethod("relay", "setupRelay", "Using provided relay key, pubkey: %s", pk)
-				}
-			}
+		// Validated and decoded to hex by config.Load
+		if pk, err := nostr.GetPublicKey(relayPrivkey); err == nil {
+			relayPubkey = pk
+			logging.Info("Relay: Using configured relay key, pubkey: %s", pk)
 		}
 	} else {
 		// Generate a random key
@@ -75,8 +117,11 @@ func (r *Relay) setupRelay() {
 		logging.DebugMethod("relay", "setupRelay", "Using default relay URL: %s", relayURL)
 	}
 
-	// Set default contact to relay pubkey if not configured
+	// Set default contact to the first extra contact, or the relay pubkey if none is configured
 	contactPubkey := r.config.ContactPubkey
+	if contactPubkey == "" && len(r.config.RelayContacts) > 0 {
+		contactPubkey = r.config.RelayContacts[0]
+	}
 	if contactPubkey == "" {
 		contactPubkey = relayPubkey
 		logging.DebugMethod("relay", "setupRelay", "Using relay pubkey as contact (not configured separately)")
@@ -93,15 +138,178 @@ func (r *Relay) setupRelay() {
 	relay.Info.Contact = contactPubkey
 	relay.Info.SupportedNIPs = []any{1, 11}
 	relay.Info.Software = "https://gitworkshop.dev/girino@girino.org/broadcast-relay"
-	relay.Info.Version = "1.0.0"
+	relay.Info.Version = buildinfo.ShortVersion()
 	relay.Info.Icon = r.config.RelayIcon
+	relay.Info.RelayCountries = r.config.RelayCountries
+	relay.Info.LanguageTags = r.config.RelayLanguages
+	relay.Info.Tags = r.config.RelayTags
+
+	stats.Default().Register(r.serverStats)
+
+	// Own events (reports, relay lists, canaries...) coming back are not re-amplified in a loop
+	if r.selfEcho = newSelfEcho(relayPubkey, r.config.SelfEchoPolicy); r.selfEcho != nil {
+		r.broadcastSystem.AddBroadcastReporter(r.selfEcho)
+		stats.Default().Register(r.selfEcho)
+	}
+
+	// Daily self-report (optional)
+	if r.config.ReportEnabled {
+		reportRelays := r.config.ReportRelays
+		if r.config.TestMode {
+			reportRelays = nil // API only: TEST_MODE stays off the network
+		}
+		r.reporter = report.New(report.Config{
+			Name:   r.config.RelayName,
+			Relays: reportRelays,
+			At:     r.config.ReportTime,
+		}, relayPrivkey, r.broadcastSystem)
+		r.broadcastSystem.AddBroadcastReporter(r.reporter)
+		stats.Default().Register(r.reporter)
+		logging.Info("Relay: Daily report enabled (%d report relays)", len(reportRelays))
+	}
+
+	// The relay key's own kind 10002 listing the measured top relays (optional)
+	if r.config.RelayListPublish {
+		r.relayList = relaylist.New(relaylist.Config{
+			Interval: r.config.RelayListInterval,
+			Max:      r.config.RelayListMax,
+			Contacts: r.config.RelayListContacts,
+		}, relayPrivkey, r.broadcastSystem)
+		r.broadcastSystem.AddBroadcastReporter(r.relayList)
+		stats.Default().Register(r.relayList)
+		logging.Info("Relay: Publishing the top %d relays as kind 10002 of %s every %v", r.config.RelayListMax, relayPubkey, r.config.RelayListInterval)
+	}
 
 	// Note: Banner is shown on main page but not in NIP-11 (not a standard field)
 
+	// Signed broadcast receipts (optional)
+	if r.config.ReceiptsEnabled {
+		receiptRelays := r.config.ReceiptRelays
+		if r.config.TestMode {
+			receiptRelays = nil // API only: TEST_MODE stays off the network
+		}
+		r.receipts = receipt.New(receipt.Config{
+			Kind:       r.config.ReceiptKind,
+			Relays:     receiptRelays,
+			MaxStored:  r.config.ReceiptStoreSize,
+			WriteAhead: r.config.ReceiptWriteAhead,
+		}, relayPrivkey)
+		r.broadcastSystem.AddBroadcastReporter(r.receipts)
+		stats.Default().Register(r.receipts)
+		logging.Info("Relay: Broadcast receipts enabled (kind %d, %d audit relays)", r.config.ReceiptKind, len(receiptRelays))
+	}
+
+	// Media mirroring to Blossom/NIP-96 servers (optional)
+	if len(r.config.MediaMirrorBlossom)+len(r.config.MediaMirrorNIP96) > 0 {
+		if r.config.TestMode {
+			logging.Info("Relay: Media mirroring disabled in TEST_MODE")
+		} else {
+			mediaMirror := mirror.New(mirror.Config{
+				Blossom:      r.config.MediaMirrorBlossom,
+				NIP96:        r.config.MediaMirrorNIP96,
+				Kinds:        r.config.MediaMirrorKinds,
+				MaxSize:      r.config.MediaMirrorMaxSize,
+				Workers:      r.config.MediaMirrorWorkers,
+				AllowedPorts: r.config.MediaMirrorPorts,
+			}, relayPrivkey)
+			r.mediaMirror = mediaMirror
+			r.broadcastSystem.AddBroadcastReporter(mediaMirror)
+			stats.Default().Register(mediaMirror)
+			logging.Info("Relay: Media mirroring enabled (%d Blossom, %d NIP-96 servers, kinds %v)",
+				len(r.config.MediaMirrorBlossom), len(r.config.MediaMirrorNIP96), r.config.MediaMirrorKinds)
+		}
+	}
+
+	// Pipeline canary (optional): synthetic events verifying the queue and outbound path
+	if r.config.CanaryInterval > 0 {
+		r.canary = canary.New(canary.Config{
+			Interval:    r.config.CanaryInterval,
+			Timeout:     r.config.CanaryTimeout,
+			MinAccepted: r.config.CanaryMinAccepted,
+			Webhook:     r.config.CanaryWebhook,
+			Name:        r.config.RelayName,
+		}, relayPrivkey, r.broadcastSystem)
+		if r.config.CanaryScoreWeight != 0 {
+			r.canary.SetScoreRecorder(r.broadcastSystem)
+		}
+		r.broadcastSystem.AddBroadcastReporter(r.canary)
+		stats.Default().Register(r.canary)
+		logging.Info("Relay: Pipeline canary enabled (every %v, %d relays must accept)", r.config.CanaryInterval, r.config.CanaryMinAccepted)
+	}
+
+	// Time from acceptance to the first and Kth relay OK, canaries excluded
+	latencyConfig := latency.Config{K: r.config.LatencyKthOK}
+	if r.canary != nil {
+		latencyConfig.IgnoreKinds = []int{canary.DefaultKind}
+	}
+	r.latency = latency.New(latencyConfig)
+	r.broadcastSystem.AddBroadcastReporter(r.latency)
+	stats.Default().Register(r.latency)
+
+	// Completed broadcasts, for the events/s of /stats/stream
+	r.streamCounter = &broadcastCounter{}
+	r.broadcastSystem.AddBroadcastReporter(r.streamCounter)
+
+	// Event metadata sampling for abuse forensics (optional)
+	if r.config.EventSampleRate > 0 {
+		r.sampler = sampling.New(sampling.Config{
+			Rate:         r.config.EventSampleRate,
+			Size:         r.config.EventSampleSize,
+			AuthorPrefix: r.config.EventSampleAuthorPrefix,
+		})
+		r.broadcastSystem.AddBroadcastReporter(r.sampler)
+		stats.Default().Register(r.sampler)
+		logging.Info("Relay: Event sampling enabled (1 in %d events, %d kept)", r.config.EventSampleRate, r.config.EventSampleSize)
+	}
+
+	// Outbound connection audit trail (optional)
+	if r.config.HandshakeLog != "" {
+		audit, err := handshakes.New(handshakes.Config{
+			Path:      r.config.HandshakeLog,
+			MaxSize:   r.config.HandshakeLogMaxSize,
+			MaxFiles:  r.config.HandshakeLogFiles,
+			Retention: r.config.HandshakeLogRetention,
+		})
+		if err != nil {
+			logging.Error("Relay: Failed to open handshake audit log %s: %v (audit disabled)", r.config.HandshakeLog, err)
+		} else {
+			r.handshakes = audit
+			r.broadcastSystem.OnResult(audit.Record)
+			stats.Default().Register(audit)
+		}
+	}
+
+	// IP reputation (optional): blocklist file and DNSBLs, checked before the rate limits
+	dnsbls := r.config.IPDNSBLs
+	if r.config.TestMode {
+		dnsbls = nil // TEST_MODE stays off the network
+	}
+	if checker := reputation.New(reputation.Config{
+		BlocklistFile: r.config.IPBlocklistFile,
+		DNSBLs:        dnsbls,
+		Threshold:     r.config.IPDNSBLThreshold,
+		Mode:          r.config.IPReputationMode,
+		CacheTTL:      r.config.IPReputationCacheTTL,
+		Timeout:       r.config.IPDNSBLTimeout,
+		OnListed: func(ip string, sources []string) {
+			logging.Info("Relay: Client %s listed by %v (mode %s)", ip, sources, r.config.IPReputationMode)
+		},
+		LogDebug: func(format string, args ...any) {
+			logging.DebugMethod("relay", "reputation", format, args...)
+		},
+	}); checker != nil {
+		r.reputation = checker
+		checker.Apply(relay)
+		stats.Default().Register(checker)
+		logging.Info("Relay: IP reputation enabled (blocklist %q, %d DNSBLs, mode %s)",
+			r.config.IPBlocklistFile, len(dnsbls), r.config.IPReputationMode)
+	}
+
 	// Rate limits + optional IP ban: github.com/girino/nostr-brodcast-relay/ratelimit
 	ratelimit.New(ratelimit.Config{
 		Connection:               rateLimitBucket(r.config.RateLimitConnection),
 		EventIP:                  rateLimitBucket(r.config.RateLimitEventIP),
+		EventPubKey:              rateLimitBucket(r.config.RateLimitEventPubkey),
 		FilterIP:                 rateLimitBucket(r.config.RateLimitFilterIP),
 		SoftRejectCount:          3,
 		DisableDisconnect:        r.config.RateLimitDisableDisconnect,
@@ -118,32 +326,221 @@ func (r *Relay) setupRelay() {
 		},
 	}).Apply(relay)
 
+	// Burst clamps: stricter per-IP/per-pubkey event limits during 10x+ ingest bursts
+	if burstClamp := ratelimit.NewBurstClamp(ratelimit.BurstConfig{
+		Factor:      r.config.BurstFactor,
+		Baseline:    r.config.BurstBaseline,
+		MinRate:     r.config.BurstMinRate,
+		Calm:        r.config.BurstCalm,
+		EventIP:     rateLimitBucket(r.config.BurstClampEventIP),
+		EventPubKey: rateLimitBucket(r.config.BurstClampEventPubkey),
+		OnClamp: func(active bool, rate, baseline float64) {
+			if active {
+				logging.Warn("Relay: Ingest burst (%.1f events/s vs baseline %.1f), clamping per-IP and per-pubkey event limits", rate, baseline)
+			} else {
+				logging.Info("Relay: Ingest back to normal (%.1f events/s vs baseline %.1f), burst clamp lifted", rate, baseline)
+			}
+		},
+		LogDebug: func(format string, args ...any) {
+			logging.DebugMethod("relay", "burstClamp", format, args...)
+		},
+	}); burstClamp != nil {
+		burstClamp.Apply(relay)
+		stats.Default().Register(burstClamp)
+	}
+
+	// Listener limits: subscriptions per connection, filter size, message size
+	listenerLimits := limits.New(limits.Config{
+		MaxSubscriptions: r.config.MaxSubscriptions,
+		MaxFilterItems:   r.config.MaxFilterItems,
+		MaxMessageSize:   r.config.MaxMessageSize,
+		LogDebug: func(format string, args ...any) {
+			logging.DebugMethod("relay", "limits", format, args...)
+		},
+	})
+	listenerLimits.Apply(relay)
+	stats.Default().Register(listenerLimits)
+
+	// Per-kind structural validation, so malformed events are not amplified
+	if r.config.EventValidation {
+		r.validator = validation.New(validation.Config{
+			SkipKinds: r.config.EventValidationSkipKinds,
+			LogDebug: func(format string, args ...any) {
+				logging.DebugMethod("relay", "validation", format, args...)
+			},
+		})
+		r.validator.Apply(relay)
+		stats.Default().Register(r.validator)
+	}
+
+	// Destination relay abuse feedback (optional)
+	if r.config.FeedbackPolicy != "" && r.config.FeedbackPolicy != "off" {
+		tracker, err := feedback.New(feedback.Config{
+			Policy:          r.config.FeedbackPolicy,
+			Threshold:       r.config.FeedbackThreshold,
+			GlobalThreshold: r.config.FeedbackGlobalThreshold,
+			Expiry:          r.config.FeedbackExpiry,
+		})
+		if err != nil {
+			logging.Fatal("Relay: Invalid abuse feedback configuration: %v", err)
+		}
+		r.feedback = tracker
+		r.broadcastSystem.AddBroadcastReporter(r.feedback)
+		r.broadcastSystem.AddRelayFilter(r.feedback)
+		stats.Default().Register(r.feedback)
+		logging.Info("Relay: Destination abuse feedback enabled (policy %s)", r.config.FeedbackPolicy)
+	}
+
+	// Per-event fan-out hints from NIP-42-authenticated trusted clients (optional)
+	if len(r.config.FanoutTrustedPubkeys) > 0 {
+		r.fanout = newFanoutHints(r.config.FanoutTrustedPubkeys, r.config.FanoutLevels)
+		r.fanout.apply(relay)
+		supportNIP(relay, 42)
+		logging.Info("Relay: Fan-out hints enabled for %d trusted pubkeys (%d levels)", len(r.config.FanoutTrustedPubkeys), len(r.config.FanoutLevels))
+	}
+
+	// Per-connection session summary NOTICEs (optional); registered first so it counts every submitted event
+	if r.config.SessionSummary {
+		r.sessions = newSessionTracker(r.config.SessionSummaryInterval)
+		r.sessions.apply(relay)
+	}
+
+	// Event ID sharding across instances (optional): only events of this instance's shard are broadcast
+	if r.config.ShardCount > 1 {
+		sharder, err := shard.New(shard.Config{
+			Count: r.config.ShardCount,
+			Index: r.config.ShardIndex,
+			Peers: r.config.ShardPeers,
+		})
+		if err != nil {
+			logging.Fatal("Relay: Invalid sharding configuration: %v", err)
+		}
+		r.sharder = sharder
+		stats.Default().Register(sharder)
+		logging.Info("Relay: Sharding enabled, broadcasting shard %d of %d (%d peers to forward to)",
+			r.config.ShardIndex, r.config.ShardCount, len(r.config.ShardPeers))
+	}
+
+	// Per-connection batching of accepted events before they reach the broadcast queue (optional)
+	if r.config.PublishBatchSize > 1 {
+		r.batcher = newPublishBatcher(r, r.config.PublishBatchSize, r.config.PublishBatchDelay)
+		r.batcher.apply(relay)
+		stats.Default().Register(r.batcher)
+		logging.Info("Relay: Publish batching enabled (up to %d events or %v per connection)", r.batcher.size, r.batcher.delay)
+	}
+
+	// NIP-42 authentication required to publish, optionally restricted to an allowlist or the
+	// operator's follows
+	if r.config.PublishAuthRequired || len(r.config.PublishAllowedPubkeys) > 0 || r.config.PublishAllowFollowsOf != "" {
+		r.publishAuth = newPublishAuth(r.config.PublishAllowedPubkeys, r.config.PublishAllowFollowsOf,
+			r.config.SeedRelays, r.config.PublishFollowsRefresh)
+		r.publishAuth.apply(relay)
+		supportNIP(relay, 42)
+		stats.Default().Register(r.publishAuth)
+		logging.Info("Relay: Publishing requires NIP-42 authentication (%d allowed pubkeys, follows of %q)",
+			len(r.config.PublishAllowedPubkeys), r.config.PublishAllowFollowsOf)
+	}
+
+	// Mirror-only: the relay broadcasts what it mirrors, clients cannot publish
+	if r.config.MirrorOnly {
+		relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if khatru.GetConnection(ctx) == nil {
+				return false, ""
+			}
+			return true, "restricted: this relay only mirrors configured authors"
+		})
+		logging.Info("Relay: Mirror only, events from clients are refused")
+	}
+
+	// Operator announcements to connected clients and the MOTD sent on connect
+	r.notices = newAnnouncer(r.config.MOTD)
+	r.notices.apply(relay)
+	stats.Default().Register(r.notices)
+
 	// Reject cached events (duplicates)
 	relay.RejectEvent = append(relay.RejectEvent,
 		func(ctx context.Context, event *nostr.Event) (bool, string) {
 			// Check if event was already broadcast
 			if r.broadcastSystem.IsEventCached(event.ID) {
 				logging.DebugMethod("relay", "RejectEvent", "Rejecting duplicate event %s (kind %d)", event.ID, event.Kind)
+				atomic.AddInt64(&r.serverStats.duplicates, 1)
+				if r.sessions != nil {
+					r.sessions.countDuplicate(ctx)
+				}
 				return true, "duplicate: event already broadcast"
 			}
+			// While paused in reject mode, tell clients to retry elsewhere instead of queueing
+			if r.rejectWhilePaused() {
+				logging.DebugMethod("relay", "RejectEvent", "Rejecting event %s: broadcasting paused", event.ID)
+				return true, "blocked: broadcasting is paused, try again later"
+			}
+			// Authors blocked by many destination relays are not amplified at all
+			if r.feedback != nil && r.feedback.IsAuthorBlocked(event.PubKey) {
+				logging.DebugMethod("relay", "RejectEvent", "Rejecting event %s: author %s blocked by destination relays", event.ID, event.PubKey)
+				return true, "blocked: author is rejected by destination relays"
+			}
 			return false, ""
 		},
 	)
 
+	// Greylist: sources that keep getting rejected are refused for escalating periods. Applied
+	// after every other RejectEvent hook so it sees all their verdicts.
+	r.greylist = ratelimit.NewGreylist(ratelimit.GreylistConfig{
+		Threshold:    r.config.GreylistThreshold,
+		Window:       r.config.GreylistWindow,
+		BaseDuration: r.config.GreylistBaseDuration,
+		Multiplier:   r.config.GreylistMultiplier,
+		MaxDuration:  r.config.GreylistMaxDuration,
+		Ignore: func(reason string) bool {
+			// Duplicates and pause rejections say nothing about the client
+			return strings.HasPrefix(reason, "duplicate:") || strings.HasPrefix(reason, "blocked: broadcasting is paused")
+		},
+		OnGreylist: func(key string, duration time.Duration, reason string) {
+			logging.Info("Relay: Greylisted %s for %v (last rejection: %s)", key, duration, reason)
+		},
+		LogDebug: func(format string, args ...any) {
+			logging.DebugMethod("relay", "greylist", format, args...)
+		},
+	})
+	if r.greylist != nil {
+		r.greylist.Apply(relay)
+		stats.Default().Register(r.greylist)
+	}
+
+	// Last decision per event ID for /api/why/{id}; wraps every hook above, greylist included
+	if r.config.DecisionRetention > 0 {
+		r.decisions = newDecisionLog(r.config.DecisionRetention, r.config.DecisionMaxEvents)
+		r.decisions.apply(relay)
+		stats.Default().Register(r.decisions)
+	}
+
 	// Handle incoming events (both regular and ephemeral)
 	relay.OnEventSaved = append(relay.OnEventSaved,
 		func(ctx context.Context, event *nostr.Event) {
-			r.handleEvent(event)
+			if r.sessions != nil {
+				r.sessions.countAccepted(ctx)
+			}
+			atomic.AddInt64(&r.serverStats.accepted, 1)
+			r.recordDecision(ctx, event, decisionAccepted, "")
+			r.acceptEvent(ctx, event)
 		},
 	)
 
 	// Handle ephemeral events (kinds 20000-29999) with the same handler
 	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent,
 		func(ctx context.Context, event *nostr.Event) {
-			r.handleEvent(event)
+			if r.sessions != nil {
+				r.sessions.countAccepted(ctx)
+			}
+			atomic.AddInt64(&r.serverStats.accepted, 1)
+			r.recordDecision(ctx, event, decisionAccepted, "")
+			r.acceptEvent(ctx, event)
 		},
 	)
 
+	// Main page template, checked against this relay's data so a broken file fails at startup
+	r.mainPage = loadTemplates(r.config.TemplatesDir, r.mainPageData())
+
 	// Don't store events - override the store handler
 	relay.StoreEvent = append(relay.StoreEvent,
 		func(ctx context.Context, event *nostr.Event) error {
@@ -184,30 +581,113 @@ func rateLimitBucket(c config.RateLimitConfig) ratelimit.Bucket {
 	return ratelimit.Bucket{Tokens: c.Tokens, Interval: c.Interval, Max: c.Max}
 }
 
-func (r *Relay) handleEvent(event *nostr.Event) {
+// acceptEvent hands an event a client published to the broadcaster, through the connection's
+// batch when batching is enabled
+func (r *Relay) acceptEvent(ctx context.Context, event *nostr.Event) {
+	defer crash.Recover("relay.accept", "event", event.ID)
+	if r.batcher != nil {
+		r.batcher.add(ctx, event, r.fanout.topN(ctx, event))
+		return
+	}
+	r.handleEvent(event, r.fanout.topN(ctx, event))
+}
+
+func (r *Relay) handleEvent(event *nostr.Event, fanout int) {
 	logging.Debug("Relay: Received event id=%s, kind=%d, author=%s", event.ID, event.Kind, event.PubKey[:16]+"...")
 
+	if !r.prepareEvent(event) {
+		return
+	}
+
+	// Broadcast the event to top N relays (or the breadth a trusted client asked for)
+	if fanout > 0 {
+		r.broadcastSystem.BroadcastEventWithFanout(event, fanout)
+		return
+	}
+	r.broadcastSystem.BroadcastEvent(event)
+}
+
+// prepareEvent learns the relays event mentions; false if it must not be broadcast here (an echo
+// of the relay's own event, or an event another shard owns)
+func (r *Relay) prepareEvent(event *nostr.Event) bool {
+	// Accepted, but our own events are not sent out again
+	if r.selfEcho.suppress(event) {
+		logging.DebugMethod("relay", "prepareEvent", "Not rebroadcasting echo %s (kind %d) of the relay's own event (policy %s)", event.ID, event.Kind, r.selfEcho.policy)
+		r.amendDecision(event, decisionSkipped, "echo of the relay's own event (SELF_ECHO_POLICY="+r.selfEcho.policy+")")
+		return false
+	}
+
 	// Extract relay URLs from the event (works for all event kinds)
 	relays := r.broadcastSystem.ExtractRelaysFromEvent(event)
 
 	if len(relays) > 0 {
 		logging.Debug("Relay: Extracted %d relay URLs from event %s (kind %d)", len(relays), event.ID, event.Kind)
 		for _, relayURL := range relays {
-			r.broadcastSystem.AddRelayIfNew(relayURL)
+			r.broadcastSystem.AddRelayIfNew(relayURL, manager.SourceEventTag)
 		}
 	}
 
-	// Broadcast the event to top N relays
-	r.broadcastSystem.BroadcastEvent(event)
+	// With sharding, only the owning instance fans the event out
+	if r.sharder != nil && !r.sharder.Owns(event) {
+		r.amendDecision(event, decisionSkipped, fmt.Sprintf("owned by shard %d, broadcast by that instance", r.sharder.Shard(event.ID)))
+		return false
+	}
+	return true
+}
+
+// Ingest feeds an event that did not come from a WebSocket client (pull or mirror mode) into the
+// ingest lane of the broadcast pipeline. Returns false if the event was already broadcast or the
+// lane is full.
+func (r *Relay) Ingest(ctx context.Context, event *nostr.Event) bool {
+	if r.broadcastSystem.IsEventCached(event.ID) {
+		logging.DebugMethod("relay", "Ingest", "Skipping duplicate event %s (kind %d)", event.ID, event.Kind)
+		r.recordDecision(ctx, event, decisionSkipped, "duplicate: event already broadcast")
+		return false
+	}
+	if r.rejectWhilePaused() {
+		logging.DebugMethod("relay", "Ingest", "Skipping event %s: broadcasting paused", event.ID)
+		r.recordDecision(ctx, event, decisionSkipped, "blocked: broadcasting is paused")
+		return false
+	}
+	if r.validator != nil {
+		if err := r.validator.Check(event); err != nil {
+			logging.DebugMethod("relay", "Ingest", "Skipping invalid event %s (kind %d): %v", event.ID, event.Kind, err)
+			r.recordDecision(ctx, event, decisionSkipped, "invalid: "+err.Error())
+			return false
+		}
+	}
+	r.recordDecision(ctx, event, decisionAccepted, "")
+	if !r.prepareEvent(event) {
+		return true
+	}
+	if !r.broadcastSystem.IngestEvent(event) {
+		r.amendDecision(event, decisionSkipped, "ingest lane full")
+		return false
+	}
+	atomic.AddInt64(&r.serverStats.ingested, 1)
+	return true
 }
 
-// Start starts the relay server
-func (r *Relay) Start() error {
-	mux := http.NewServeMux()
+// rejectWhilePaused reports whether new events must be refused (paused with BROADCAST_PAUSE_MODE=reject)
+func (r *Relay) rejectWhilePaused() bool {
+	if r.config.BroadcastPauseMode != "reject" {
+		return false
+	}
+	paused, _, _ := r.broadcastSystem.PauseState()
+	return paused
+}
+
+// Start starts the relay server and blocks until ctx is canceled (graceful shutdown) or the listener fails
+func (r *Relay) Start(ctx context.Context) error {
+	mux := newAPIMux()
 
 	// Serve static files (icons, banners)
 	fileServer := http.FileServer(http.Dir("."))
-	mux.Handle("/static/", fileServer)
+	mux.Handle("/static/", staticCache(fileServer))
+
+	// NIP-11 document and main page change rarely: cached by clients and revalidated by ETag
+	nip11 := cacheable(cacheNIP11, r.khatru)
+	mainPage := cacheable(cacheMainPage, http.HandlerFunc(r.serveMainPage))
 
 	// Main page handler (HTTP) and WebSocket relay (WS)
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
@@ -219,47 +699,36 @@ func (r *Relay) Start() error {
 		}
 
 		// Check if this is a NIP-11 request (Accept: application/nostr+json)
+		w.Header().Add("Vary", "Accept") // same URL, two documents: keep caches from mixing them up
 		accept := req.Header.Get("Accept")
 		if accept == "application/nostr+json" {
 			// Let khatru handle NIP-11 relay information document
-			r.khatru.ServeHTTP(w, req)
+			nip11.ServeHTTP(w, req)
 			return
 		}
 
 		// Serve HTML main page for regular HTTP requests
-		r.serveMainPage(w, req)
+		mainPage.ServeHTTP(w, req)
 	})
 
-	// Add a stats endpoint
-	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
-		// Use the global stats collector
-		allStats := stats.GetCollector().GetAllStats()
+	// Machine-readable description of the endpoints below: GET /api/openapi.json
+	mux.HandleFunc("/api/openapi.json", r.serveOpenAPI(mux))
 
-		// Add timestamp
-		allStats.Set("timestamp", json.NewJsonValue(time.Now().Unix()))
+	// Stats endpoint: JSON, Prometheus text or a plain-text outline, by Accept or ?format=
+	mux.Handle("/stats", cacheable(cacheStats, http.HandlerFunc(r.serveStats)))
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
-		// Marshal to JSON
-		jsonData, err := json.MarshalIndent(allStats, "", "  ")
-		if err != nil {
-			logging.Error("Failed to marshal stats to JSON: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	// Incremental stats as Server-Sent Events, for dashboards that would otherwise poll /stats
+	mux.HandleFunc("/stats/stream", r.serveStatsStream)
 
-		w.Write(jsonData)
-	})
+	// Readiness: degraded while the pipeline canary fails
+	mux.HandleFunc("/readyz", r.serveReadyz)
+	mux.HandleFunc("/api/version", r.serveVersion)
 
 	// Add a health endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
-		// Get basic health information from global stats
-		statsObj := stats.GetCollector().GetAllStats()
-
-		// Extract health information from stats
-		managerObj, exists := statsObj.Get("manager")
-		if !exists {
+		// Get basic health information from the manager's stats
+		managerObj := stats.Default().Section("manager")
+		if managerObj == nil {
 			logging.Error("Manager stats not found")
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
@@ -340,12 +809,26 @@ func (r *Relay) Start() error {
 			statusReason = fmt.Sprintf("max relays unavailable fallback: total_relays=%d active_relays=%d", totalRelays, activeRelays)
 		}
 
+		// A deliberate pause overrides relay health: nothing is being published
+		paused, pausedAt, pauseReason := r.broadcastSystem.PauseState()
+		if paused {
+			status = "paused"
+			color = "yellow"
+			statusReason = fmt.Sprintf("broadcasting paused since %s: %s", pausedAt.Format(time.RFC3339), pauseReason)
+		}
+
 		healthResponse := json.NewJsonObject()
 		healthResponse.Set("status", json.NewJsonValue(status))
 		healthResponse.Set("color", json.NewJsonValue(color))
 		healthResponse.Set("total_relays", json.NewJsonValue(totalRelays))
 		healthResponse.Set("active_relays", json.NewJsonValue(activeRelays))
 		healthResponse.Set("max_relays", json.NewJsonValue(maxRelays))
+		healthResponse.Set("paused", json.NewJsonValue(paused))
+		if paused {
+			healthResponse.Set("paused_since", json.NewJsonValue(pausedAt.Unix()))
+			healthResponse.Set("pause_reason", json.NewJsonValue(pauseReason))
+			healthResponse.Set("pause_mode", json.NewJsonValue(r.config.BroadcastPauseMode))
+		}
 		healthResponse.Set("timestamp", json.NewJsonValue(time.Now().Unix()))
 
 		// Marshal to JSON
@@ -365,6 +848,118 @@ func (r *Relay) Start() error {
 		w.Write(jsonData)
 	})
 
+	// Relay detail: GET /api/relay?url=wss://... (stats, failure breakdown and recent errors of one destination relay)
+	mux.HandleFunc("/api/relay", func(w http.ResponseWriter, req *http.Request) {
+		url := req.URL.Query().Get("url")
+		if url == "" {
+			http.Error(w, "Missing url parameter", http.StatusBadRequest)
+			return
+		}
+		relayStats, ok := r.broadcastSystem.GetRelayStats(url)
+		if !ok {
+			http.Error(w, "Relay not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, relayStats)
+	})
+
+	// Kind x relay success rates: GET /api/matrix[?relay=<url>&kind=<n>&min_attempts=<n>]
+	mux.HandleFunc("/api/matrix", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		q := kindmatrix.Query{Relay: query.Get("relay"), Kind: -1}
+		if raw := query.Get("kind"); raw != "" {
+			kind, err := strconv.Atoi(raw)
+			if err != nil || kind < 0 {
+				http.Error(w, "Invalid kind", http.StatusBadRequest)
+				return
+			}
+			q.Kind = kind
+		}
+		if raw := query.Get("min_attempts"); raw != "" {
+			minAttempts, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || minAttempts < 0 {
+				http.Error(w, "Invalid min_attempts", http.StatusBadRequest)
+				return
+			}
+			q.MinAttempts = minAttempts
+		}
+		matrix, ok := r.broadcastSystem.KindMatrix(q)
+		if !ok {
+			http.Error(w, "Kind matrix disabled (KIND_MATRIX_WINDOW=0)", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, matrix)
+	})
+
+	// Relays behaving against their NIP-11 claims: GET /api/consistency
+	mux.HandleFunc("/api/consistency", func(w http.ResponseWriter, req *http.Request) {
+		report, ok := r.broadcastSystem.ConsistencyReport()
+		if !ok {
+			http.Error(w, "Consistency checks disabled (CONSISTENCY_CHECK=false)", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+
+	// Broadcast outcome of a recent event: GET /api/event/{id}
+	mux.HandleFunc("/api/event/{id}", func(w http.ResponseWriter, req *http.Request) {
+		eventID := req.PathValue("id")
+		if !nostr.IsValid32ByteHex(eventID) {
+			http.Error(w, "Invalid event ID", http.StatusBadRequest)
+			return
+		}
+		outcome, ok := r.broadcastSystem.EventOutcome(eventID)
+		if !ok {
+			http.Error(w, "Event not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, outcome)
+	})
+
+	// Admin endpoints (require ADMIN_TOKEN)
+	r.registerAdminHandlers(mux)
+
+	// Remote latency probe reports (require PROBE_TOKEN)
+	r.registerProbeHandler(mux)
+
+	// Federation gossip pulled by peer instances and events they hand over (FEDERATION_SECRET as
+	// bearer token, if set)
+	if handler := r.broadcastSystem.FederationHandler(); handler != nil {
+		mux.Handle(federation.GossipPath, handler)
+		mux.Handle(federation.ForwardPath, handler)
+		logging.Debug("Relay: Federation endpoints ready")
+	}
+
+	// TEST_MODE publish sink: GET /api/testsink[?id=<event id>], DELETE to clear
+	if sink := r.broadcastSystem.GetTestSink(); sink != nil {
+		mux.HandleFunc("/api/testsink", func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case http.MethodGet:
+				entries := sink.Entries(req.URL.Query().Get("id"))
+				resp := json.NewJsonObject()
+				resp.Set("count", json.NewJsonValue(len(entries)))
+				resp.Set("publishes", testsink.EntriesJSON(entries))
+				writeJSON(w, http.StatusOK, resp)
+			case http.MethodDelete:
+				resp := json.NewJsonObject()
+				resp.Set("cleared", json.NewJsonValue(sink.Reset()))
+				writeJSON(w, http.StatusOK, resp)
+			default:
+				w.Header().Set("Allow", "GET, DELETE")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			}
+		})
+		logging.Debug("Relay: Test sink endpoint ready")
+	}
+
+	// Broadcast receipt lookup by event ID
+	if r.receipts != nil {
+		mux.HandleFunc("/api/receipts/{id}", r.serveReceipt)
+	}
+	if r.reporter != nil {
+		mux.HandleFunc("/api/report", r.serveReport)
+	}
+
 	addr := fmt.Sprintf(":%s", r.port)
 	logging.Info("Relay: Starting relay server on %s", addr)
 	logging.Debug("Relay: WebSocket endpoint ready")
@@ -372,14 +967,118 @@ func (r *Relay) Start() error {
 	logging.Debug("Relay: Health endpoint ready")
 	logging.Debug("Relay: Main page endpoint ready")
 
-	return http.ListenAndServe(addr, mux)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: compress(crash.Handler("http", mux)), // gzip for clients accepting it; WebSocket upgrades pass through
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		logging.Info("Relay: Shutting down relay server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logging.Warn("Relay: Graceful shutdown incomplete: %v", err)
+		}
+		if r.sharder != nil {
+			r.sharder.Close()
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdownDone
+	return nil
+}
+
+// serveReceipt returns the latest signed receipt for /api/receipts/{eventID}
+func (r *Relay) serveReceipt(w http.ResponseWriter, req *http.Request) {
+	eventID := req.PathValue("id")
+	rcpt := r.receipts.Get(eventID)
+	if rcpt == nil {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	jsonData, err := stdjson.Marshal(rcpt)
+	if err != nil {
+		logging.Error("Failed to marshal receipt to JSON: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// serveReport returns the latest signed daily report for /api/report
+func (r *Relay) serveReport(w http.ResponseWriter, req *http.Request) {
+	latest := r.reporter.Latest()
+	if latest == nil {
+		http.Error(w, "No report published yet", http.StatusNotFound)
+		return
+	}
+
+	jsonData, err := stdjson.Marshal(latest)
+	if err != nil {
+		logging.Error("Failed to marshal report to JSON: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// serveReadyz answers 200 "ready" while the broadcast pipeline works, and 503 "degraded" while
+// the pipeline canary fails, so orchestrators and load balancers stop routing to a wedged instance
+func (r *Relay) serveReadyz(w http.ResponseWriter, req *http.Request) {
+	resp := json.NewJsonObject()
+	status, code := "ready", http.StatusOK
+	if r.canary != nil {
+		if healthy, reason := r.canary.Healthy(); !healthy {
+			status, code = "degraded", http.StatusServiceUnavailable
+			resp.Set("reason", json.NewJsonValue("canary: "+reason))
+		}
+		resp.Set("canary", r.canary.GetStats())
+	}
+	resp.Set("status", json.NewJsonValue(status))
+	resp.Set("timestamp", json.NewJsonValue(time.Now().Unix()))
+	writeJSON(w, code, resp)
+}
+
+// serveVersion returns the build version, commit and build time, the Go version and the process
+// uptime, so operators can tell which build each instance of a fleet runs
+func (r *Relay) serveVersion(w http.ResponseWriter, req *http.Request) {
+	info := buildinfo.Get()
+	resp := json.NewJsonObject()
+	resp.Set("version", json.NewJsonValue(info.Version))
+	resp.Set("commit", json.NewJsonValue(info.Commit))
+	resp.Set("modified", json.NewJsonValue(info.Modified))
+	resp.Set("build_time", json.NewJsonValue(info.BuildTime))
+	resp.Set("go_version", json.NewJsonValue(info.GoVersion))
+	resp.Set("platform", json.NewJsonValue(info.Platform))
+	resp.Set("started_at", json.NewJsonValue(r.serverStats.startedAt.Unix()))
+	resp.Set("uptime_seconds", json.NewJsonValue(int64(time.Since(r.serverStats.startedAt).Seconds())))
+	resp.Set("nip11_version", json.NewJsonValue(r.khatru.Info.Version))
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // serveMainPage serves the HTML main page with relay information
 func (r *Relay) serveMainPage(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	data := r.mainPageData()
+	logging.DebugMethod("relay", "serveMainPage", "Rendering main page: URL=%s, RelayNpub=%s, ContactNpub=%s, Icon=%s, Banner=%s",
+		r.config.RelayURL, data["RelayNpub"], data["ContactNpub"], r.config.RelayIcon, data["Banner"])
+	writePage(w, r.mainPage, data)
+}
 
+// mainPageData returns the data the main page template is rendered with
+func (r *Relay) mainPageData() map[string]interface{} {
 	// Get relay pubkey for display
 	relayPubkey := r.khatru.Info.PubKey
 	relayNpub := ""
@@ -401,29 +1100,76 @@ func (r *Relay) serveMainPage(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	// All operator contacts, primary first
+	contacts := []contactLink{}
+	seen := make(map[string]bool)
+	for _, contact := range append([]string{r.config.ContactPubkey}, r.config.RelayContacts...) {
+		link := newContactLink(contact)
+		if link.Label == "" || seen[link.Label] {
+			continue
+		}
+		seen[link.Label] = true
+		contacts = append(contacts, link)
+	}
+
 	// Select random banner from list
 	randomBanner := ""
 	if len(r.config.RelayBanners) > 0 {
 		randomBanner = r.config.RelayBanners[rand.Intn(len(r.config.RelayBanners))]
 	}
 
-	// Prepare template data
-	data := map[string]interface{}{
+	return map[string]interface{}{
 		"Name":        r.config.RelayName,
 		"Description": r.config.RelayDescription,
 		"URL":         r.config.RelayURL,
 		"RelayPubkey": relayPubkey,
 		"RelayNpub":   relayNpub,
 		"ContactNpub": contactNpub,
+		"Contacts":    contacts,
+		"Countries":   r.config.RelayCountries,
+		"Languages":   r.config.RelayLanguages,
+		"Tags":        r.config.RelayTags,
 		"Icon":        r.config.RelayIcon,
 		"Banner":      randomBanner,
 		"Version":     r.khatru.Info.Version,
 		"Software":    r.khatru.Info.Software,
 	}
+}
 
-	logging.DebugMethod("relay", "serveMainPage", "Rendering main page: URL=%s, RelayNpub=%s, ContactNpub=%s, Icon=%s, Banner=%s",
-		r.config.RelayURL, relayNpub, contactNpub, r.config.RelayIcon, randomBanner)
+// contactLink is an operator contact rendered on the main page
+type contactLink struct {
+	Label string
+	Href  string
+}
+
+// newContactLink links npub/hex pubkeys to njump, emails to mailto and keeps URLs as they are
+func newContactLink(contact string) contactLink {
+	contact = strings.TrimSpace(contact)
+	switch {
+	case contact == "":
+		return contactLink{}
+	case nostr.IsValidPublicKey(contact):
+		if npub, err := nip19.EncodePublicKey(contact); err == nil {
+			return contactLink{Label: npub, Href: "https://njump.me/" + npub}
+		}
+	case strings.HasPrefix(contact, "npub1"):
+		return contactLink{Label: contact, Href: "https://njump.me/" + contact}
+	case strings.HasPrefix(contact, "http://") || strings.HasPrefix(contact, "https://"):
+		return contactLink{Label: contact, Href: contact}
+	case strings.HasPrefix(contact, "mailto:"):
+		return contactLink{Label: strings.TrimPrefix(contact, "mailto:"), Href: contact}
+	case strings.Contains(contact, "@"):
+		return contactLink{Label: contact, Href: "mailto:" + contact}
+	}
+	return contactLink{Label: contact}
+}
 
-	tmpl := template.Must(template.ParseFiles("templates/main.html"))
-	tmpl.Execute(w, data)
+// supportNIP advertises nip in the NIP-11 document, once
+func supportNIP(relay *khatru.Relay, nip int) {
+	for _, supported := range relay.Info.SupportedNIPs {
+		if supported == nip {
+			return
+		}
+	}
+	relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, nip)
 }
@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Policies for events signed with the relay key that come back from clients or pull mode
+const (
+	selfEchoSkip = "skip" // never rebroadcast them: the relay already sent its own events out
+	selfEchoOnce = "once" // rebroadcast each one at most once, however often it comes back
+	selfEchoOff  = "off"  // treat them like any other event
+)
+
+// maxSelfEchoIDs bounds the IDs of own events remembered by the once policy
+const maxSelfEchoIDs = 10000
+
+// selfEcho keeps the relay's own status events (reports, relay lists, canaries, receipts) from
+// being re-amplified in a loop when discovery or pull mode brings them back
+type selfEcho struct {
+	pubkey string
+	policy string
+
+	mu    sync.Mutex
+	seen  map[string]struct{} // once: IDs of own events already broadcast
+	order []string            // seen in insertion order, oldest first
+
+	own         int64 // own events broadcast by the relay itself
+	suppressed  int64 // echoes not rebroadcast
+	rebroadcast int64 // echoes broadcast under the once policy
+}
+
+// newSelfEcho returns the echo filter for pubkey, or nil if the policy is off
+func newSelfEcho(pubkey, policy string) *selfEcho {
+	if pubkey == "" || policy == selfEchoOff {
+		return nil
+	}
+	return &selfEcho{pubkey: pubkey, policy: policy, seen: make(map[string]struct{})}
+}
+
+// suppress reports whether an incoming event is an echo of the relay's own that must not be
+// broadcast again; under the once policy the first sighting is let through and remembered
+func (se *selfEcho) suppress(event *nostr.Event) bool {
+	if se == nil || event.PubKey != se.pubkey {
+		return false
+	}
+	if se.policy == selfEchoOnce && se.remember(event.ID) {
+		atomic.AddInt64(&se.rebroadcast, 1)
+		return false
+	}
+	atomic.AddInt64(&se.suppressed, 1)
+	return true
+}
+
+// remember records id as broadcast; false if it already was
+func (se *selfEcho) remember(id string) bool {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if _, ok := se.seen[id]; ok {
+		return false
+	}
+	if len(se.order) >= maxSelfEchoIDs {
+		delete(se.seen, se.order[0])
+		se.order = se.order[1:]
+	}
+	se.seen[id] = struct{}{}
+	se.order = append(se.order, id)
+	return true
+}
+
+// BroadcastPlanned remembers the own events the relay publishes, so their echoes are recognized
+func (se *selfEcho) BroadcastPlanned(event *nostr.Event, relays []string) {
+	if event.PubKey != se.pubkey {
+		return
+	}
+	if se.policy == selfEchoSkip || se.remember(event.ID) {
+		atomic.AddInt64(&se.own, 1)
+	}
+}
+
+// BroadcastCompleted does nothing
+func (se *selfEcho) BroadcastCompleted(report broadcaster.BroadcastReport) {}
+
+// GetStatsName returns the name for this stats provider
+func (se *selfEcho) GetStatsName() string {
+	return "self_echo"
+}
+
+// GetStats returns the echo counters as a JsonEntity
+func (se *selfEcho) GetStats() json.JsonEntity {
+	se.mu.Lock()
+	remembered := len(se.seen)
+	se.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("policy", json.NewJsonValue(se.policy))
+	obj.Set("own_events_broadcast", json.NewJsonValue(atomic.LoadInt64(&se.own)))
+	obj.Set("echoes_suppressed", json.NewJsonValue(atomic.LoadInt64(&se.suppressed)))
+	obj.Set("echoes_rebroadcast", json.NewJsonValue(atomic.LoadInt64(&se.rebroadcast)))
+	obj.Set("remembered_ids", json.NewJsonValue(remembered))
+	return obj
+}
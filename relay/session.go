@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// sessionCounts tracks what happened to the events one client connection published
+type sessionCounts struct {
+	received   int64
+	accepted   int64
+	duplicates int64
+	reported   int64 // received count at the last summary, to skip idle connections
+}
+
+// sessionTracker sends publishing clients NOTICE summaries of their session (periodically and on disconnect)
+type sessionTracker struct {
+	sessions sync.Map // *khatru.WebSocket -> *sessionCounts
+	interval time.Duration
+}
+
+func newSessionTracker(interval time.Duration) *sessionTracker {
+	return &sessionTracker{interval: interval}
+}
+
+// apply registers the counting hooks; the received counter must run before other RejectEvent hooks
+func (st *sessionTracker) apply(relay *khatru.Relay) {
+	relay.RejectEvent = append([]func(context.Context, *nostr.Event) (bool, string){
+		func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if sc := st.get(ctx); sc != nil {
+				atomic.AddInt64(&sc.received, 1)
+			}
+			return false, ""
+		},
+	}, relay.RejectEvent...)
+
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return
+		}
+		if v, ok := st.sessions.LoadAndDelete(ws); ok {
+			// best effort: the client may already be gone
+			st.notify(ws, v.(*sessionCounts), "session summary")
+		}
+	})
+}
+
+func (st *sessionTracker) get(ctx context.Context) *sessionCounts {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return nil
+	}
+	actual, _ := st.sessions.LoadOrStore(ws, &sessionCounts{})
+	return actual.(*sessionCounts)
+}
+
+func (st *sessionTracker) countAccepted(ctx context.Context) {
+	if sc := st.get(ctx); sc != nil {
+		atomic.AddInt64(&sc.accepted, 1)
+	}
+}
+
+func (st *sessionTracker) countDuplicate(ctx context.Context) {
+	if sc := st.get(ctx); sc != nil {
+		atomic.AddInt64(&sc.duplicates, 1)
+	}
+}
+
+// notify sends the summary NOTICE if the connection published anything since the last one
+func (st *sessionTracker) notify(ws *khatru.WebSocket, sc *sessionCounts, label string) {
+	received := atomic.LoadInt64(&sc.received)
+	if received == atomic.SwapInt64(&sc.reported, received) {
+		return
+	}
+	accepted := atomic.LoadInt64(&sc.accepted)
+	duplicates := atomic.LoadInt64(&sc.duplicates)
+	rejected := received - accepted - duplicates
+	if rejected < 0 {
+		rejected = 0
+	}
+	msg := fmt.Sprintf("%s: %d events received, %d accepted and queued for broadcast, %d duplicates, %d rejected",
+		label, received, accepted, duplicates, rejected)
+	if err := ws.WriteJSON(nostr.NoticeEnvelope(msg)); err != nil {
+		logging.DebugMethod("relay", "sessionSummary", "Failed to send session summary: %v", err)
+	}
+}
+
+// run sends periodic summaries until ctx is canceled; a zero interval disables periodic summaries
+func (st *sessionTracker) run(ctx context.Context) {
+	if st.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(st.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			st.sessions.Range(func(key, value any) bool {
+				st.notify(key.(*khatru.WebSocket), value.(*sessionCounts), "session so far")
+				return true
+			})
+		}
+	}
+}
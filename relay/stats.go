@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/stats"
+	json "github.com/girino/nostr-lib/json"
+)
+
+// statsMetricPrefix prefixes the metric names of the Prometheus output of /stats
+const statsMetricPrefix = "broadcast_relay"
+
+// serverStats counts what the relay server itself sees, before the broadcast pipeline
+type serverStats struct {
+	startedAt  time.Time
+	accepted   int64 // events accepted from WebSocket clients
+	ingested   int64 // events fed in by Ingest (pull mode)
+	duplicates int64 // events rejected as already broadcast
+}
+
+// GetStatsName returns the name for this stats provider
+func (s *serverStats) GetStatsName() string {
+	return "relay"
+}
+
+// GetStats returns the server counters as a JsonEntity
+func (s *serverStats) GetStats() json.JsonEntity {
+	obj := json.NewJsonObject()
+	obj.Set("started_at", json.NewJsonValue(s.startedAt.Unix()))
+	obj.Set("uptime_seconds", json.NewJsonValue(int64(time.Since(s.startedAt).Seconds())))
+	obj.Set("events_accepted", json.NewJsonValue(atomic.LoadInt64(&s.accepted)))
+	obj.Set("events_ingested", json.NewJsonValue(atomic.LoadInt64(&s.ingested)))
+	obj.Set("duplicates_rejected", json.NewJsonValue(atomic.LoadInt64(&s.duplicates)))
+	return obj
+}
+
+// serveStats serves the stats document as JSON (the default), Prometheus text for scrapers or a
+// plain-text outline for people with curl, chosen by ?format= or else the Accept header
+func (r *Relay) serveStats(w http.ResponseWriter, req *http.Request) {
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = negotiateStatsFormat(req.Header.Get("Accept"))
+	case stats.FormatJSON, stats.FormatPrometheus, stats.FormatText:
+	default:
+		http.Error(w, "Unknown format (json, prometheus or text)", http.StatusBadRequest)
+		return
+	}
+
+	// Every registered module's section, in registration order
+	allStats := stats.Default().Snapshot()
+	allStats.Set("timestamp", json.NewJsonValue(time.Now().Unix()))
+	w.Header().Set("Vary", "Accept")
+
+	switch format {
+	case stats.FormatPrometheus:
+		w.Header().Set("Content-Type", stats.ContentTypePrometheus)
+		if err := stats.WritePrometheus(w, allStats, statsMetricPrefix); err != nil {
+			logging.Debug("Failed to write Prometheus stats: %v", err)
+		}
+	case stats.FormatText:
+		w.Header().Set("Content-Type", stats.ContentTypeText)
+		if err := stats.WriteText(w, allStats); err != nil {
+			logging.Debug("Failed to write text stats: %v", err)
+		}
+	default:
+		jsonData, err := json.MarshalIndent(allStats, "", "  ")
+		if err != nil {
+			logging.Error("Failed to marshal stats to JSON: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", stats.ContentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonData)
+	}
+}
+
+// negotiateStatsFormat picks the stats format an Accept header prefers: OpenMetrics or
+// text/plain with a version parameter is what Prometheus sends, a bare text/plain is a person;
+// anything else, including */* and no header, gets JSON
+func negotiateStatsFormat(accept string) string {
+	best, bestQ := stats.FormatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(raw, 64); err == nil {
+				q = parsed
+			}
+		}
+		var format string
+		switch {
+		case mediaType == "application/openmetrics-text":
+			format = stats.FormatPrometheus
+		case mediaType == "text/plain" && params["version"] != "":
+			format = stats.FormatPrometheus
+		case mediaType == "text/plain":
+			format = stats.FormatText
+		case mediaType == "application/json":
+			format = stats.FormatJSON
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
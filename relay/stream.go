@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/bus"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	"github.com/girino/nostr-brodcast-relay/stats"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// Update interval of /stats/stream, overridable per client with ?interval= within the bounds
+	streamDefaultInterval = 5 * time.Second
+	streamMinInterval     = time.Second
+	streamMaxInterval     = time.Minute
+	// streamMaxFailures bounds the publish failures listed in one update (all are counted)
+	streamMaxFailures = 20
+	// streamBuffer is each client's results bus buffer; a client too slow to keep up loses results
+	streamBuffer = 1024
+)
+
+// broadcastCounter counts completed broadcasts for the events/s of /stats/stream
+type broadcastCounter struct {
+	completed int64
+}
+
+func (c *broadcastCounter) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+func (c *broadcastCounter) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	atomic.AddInt64(&c.completed, 1)
+}
+
+// serveStatsStream pushes Server-Sent Events: one "snapshot" with the full stats document (skip
+// with ?snapshot=0), then an "update" every interval with the queue depth, events and publishes
+// per second, and the publish failures and relay up/down changes since the previous update
+func (r *Relay) serveStatsStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	interval := streamDefaultInterval
+	if raw := req.URL.Query().Get("interval"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			if seconds, convErr := strconv.Atoi(raw); convErr == nil {
+				parsed, err = time.Duration(seconds)*time.Second, nil
+			}
+		}
+		if err != nil {
+			http.Error(w, "Invalid interval", http.StatusBadRequest)
+			return
+		}
+		interval = min(max(parsed, streamMinInterval), streamMaxInterval)
+	}
+
+	results, unsubscribe := r.broadcastSystem.SubscribeResults(streamBuffer)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would buffer the stream otherwise
+	w.WriteHeader(http.StatusOK)
+	logging.DebugMethod("relay", "serveStatsStream", "Stats stream opened by %s (interval %v)", req.RemoteAddr, interval)
+
+	if req.URL.Query().Get("snapshot") != "0" {
+		snapshot := stats.Default().Snapshot()
+		snapshot.Set("timestamp", json.NewJsonValue(time.Now().Unix()))
+		if !writeSSE(w, "snapshot", snapshot) {
+			return
+		}
+		flusher.Flush()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastTick := time.Now()
+	lastCompleted := atomic.LoadInt64(&r.streamCounter.completed)
+	publishes, failed := 0, 0
+	failures := json.NewJsonList()
+	up, down := json.NewJsonList(), json.NewJsonList()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			logging.DebugMethod("relay", "serveStatsStream", "Stats stream closed by %s", req.RemoteAddr)
+			return
+
+		case event, ok := <-results:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case bus.PublishResult:
+				publishes++
+				if !event.Success {
+					failed++
+					if failures.Length() < streamMaxFailures {
+						failure := json.NewJsonObject()
+						failure.Set("url", json.NewJsonValue(event.URL))
+						if event.Err != nil {
+							failure.Set("error", json.NewJsonValue(event.Err.Error()))
+						}
+						failure.Set("at", json.NewJsonValue(event.At.Unix()))
+						failures.Append(failure)
+					}
+				}
+			case bus.RelayUp:
+				up.Append(json.NewJsonValue(event.URL))
+			case bus.RelayDown:
+				down.Append(json.NewJsonValue(event.URL))
+			}
+
+		case now := <-ticker.C:
+			elapsed := now.Sub(lastTick).Seconds()
+			completed := atomic.LoadInt64(&r.streamCounter.completed)
+
+			update := json.NewJsonObject()
+			update.Set("timestamp", json.NewJsonValue(now.Unix()))
+			update.Set("interval_seconds", json.NewJsonValue(elapsed))
+			update.Set("queue_depth", json.NewJsonValue(r.broadcastSystem.QueueDepth()))
+			update.Set("events_per_second", json.NewJsonValue(float64(completed-lastCompleted)/elapsed))
+			update.Set("publishes_per_second", json.NewJsonValue(float64(publishes)/elapsed))
+			update.Set("publish_failures", json.NewJsonValue(failed))
+			update.Set("recent_failures", failures)
+			update.Set("relays_up", up)
+			update.Set("relays_down", down)
+			if !writeSSE(w, "update", update) {
+				return
+			}
+			flusher.Flush()
+
+			lastTick, lastCompleted = now, completed
+			publishes, failed = 0, 0
+			failures = json.NewJsonList()
+			up, down = json.NewJsonList(), json.NewJsonList()
+		}
+	}
+}
+
+// writeSSE writes one Server-Sent Event; false once the client is gone
+func writeSSE(w http.ResponseWriter, name string, data json.JsonEntity) bool {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logging.Error("Relay: Failed to marshal %s stream event: %v", name, err)
+		return true
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+	return err == nil
+}
@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/girino/nostr-brodcast-relay/logging"
+)
+
+// defaultTemplatesDir holds the templates shipped with the relay
+const defaultTemplatesDir = "templates"
+
+// mainTemplate is the page template every templates directory must provide; other *.html files
+// in the directory are parsed alongside it, so it can use them as partials
+const mainTemplate = "main.html"
+
+// maxPageSize caps a rendered page, so a runaway template cannot exhaust memory
+const maxPageSize = 1 << 20
+
+var errPageTooLarge = errors.New("rendered page exceeds the size limit")
+
+// fallbackPage is served when no templates directory yields a working main page, and with a 500
+// when rendering fails at request time
+var fallbackPage = template.Must(template.New("fallback").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Name}}</title>
+</head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 3em auto; padding: 0 1em;">
+    <h1>{{.Name}}</h1>
+    <p>{{.Description}}</p>
+    <p>Connect your Nostr client to <code>{{.URL}}</code>.</p>
+    <p><a href="/stats">Statistics</a></p>
+</body>
+</html>
+`))
+
+// loadTemplates parses and validates the main page template from dir, falling back to the
+// shipped templates and then to the built-in page. data is sample page data: a template that
+// fails to render it is rejected at startup instead of failing on every request.
+func loadTemplates(dir string, data map[string]interface{}) *template.Template {
+	dirs := []string{dir}
+	if filepath.Clean(dir) != defaultTemplatesDir {
+		dirs = append(dirs, defaultTemplatesDir)
+	}
+	for _, candidate := range dirs {
+		tmpl, err := parseTemplates(candidate)
+		if err == nil {
+			_, err = renderPage(tmpl, data)
+		}
+		if err != nil {
+			logging.Error("Relay: Templates in %s unusable: %v", candidate, err)
+			continue
+		}
+		logging.Info("Relay: Main page template loaded from %s", candidate)
+		return tmpl
+	}
+	logging.Warn("Relay: Serving the built-in fallback main page")
+	return fallbackPage
+}
+
+// parseTemplates parses every *.html file of dir and returns the main template
+func parseTemplates(dir string) (*template.Template, error) {
+	if _, err := os.Stat(filepath.Join(dir, mainTemplate)); err != nil {
+		return nil, err
+	}
+	tmpl, err := template.ParseGlob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Lookup(mainTemplate), nil
+}
+
+// limitedBuffer is a bytes.Buffer refusing writes beyond maxPageSize
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxPageSize {
+		return 0, errPageTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// renderPage executes tmpl into memory, so nothing is sent if it fails halfway
+func renderPage(tmpl *template.Template, data map[string]interface{}) ([]byte, error) {
+	var buf limitedBuffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("render %s: %w", tmpl.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writePage renders tmpl and sends it; on failure it answers 500 with the built-in page
+func writePage(w http.ResponseWriter, tmpl *template.Template, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page, err := renderPage(tmpl, data)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(page)
+		return
+	}
+
+	logging.Error("Relay: Failed to render main page: %v", err)
+	page, fallbackErr := renderPage(fallbackPage, data)
+	if fallbackErr != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(page)
+}
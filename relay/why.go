@@ -0,0 +1,228 @@
+package relay
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Outcomes of an event reaching the relay
+const (
+	decisionAccepted = "accepted" // queued for broadcast
+	decisionRejected = "rejected" // refused with an OK false
+	decisionSkipped  = "skipped"  // accepted (or ingested) but not broadcast by this instance
+)
+
+// decision is the last verdict on one event ID
+type decision struct {
+	eventID  string
+	kind     int
+	pubkey   string
+	outcome  string
+	reason   string // the OK message or why the event was not broadcast
+	source   string // "client" or "ingest"
+	ip       string
+	at       time.Time
+	attempts int // times the event reached the relay within the retention window
+}
+
+// decisionLog remembers, for each recent event ID, the last decision made about it, so support
+// requests ("my note disappeared") can be answered from /api/why/{id}. Entries older than
+// retention or beyond maxEntries are pruned on every record. Events khatru refuses before the
+// policy hooks (bad ID or signature) never get here.
+type decisionLog struct {
+	retention  time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // event ID -> *decision, oldest record first
+	order   *list.List
+}
+
+func newDecisionLog(retention time.Duration, maxEntries int) *decisionLog {
+	if maxEntries <= 0 {
+		maxEntries = 50000
+	}
+	return &decisionLog{
+		retention:  retention,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// apply records the rejections of every RejectEvent hook registered so far, greylist included.
+// Must be called after the other hooks are in place.
+func (d *decisionLog) apply(relay *khatru.Relay) {
+	hooks := relay.RejectEvent
+	relay.RejectEvent = []func(context.Context, *nostr.Event) (bool, string){
+		func(ctx context.Context, event *nostr.Event) (bool, string) {
+			for _, hook := range hooks {
+				if reject, msg := hook(ctx, event); reject {
+					d.record(event, decisionRejected, msg, "client", khatru.GetIP(ctx))
+					return true, msg
+				}
+			}
+			return false, ""
+		},
+	}
+}
+
+// record stores the decision on event, replacing the previous one
+func (d *decisionLog) record(event *nostr.Event, outcome, reason, source, ip string) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	attempts := 1
+	if elem, ok := d.entries[event.ID]; ok {
+		attempts += elem.Value.(*decision).attempts
+		d.order.Remove(elem)
+	}
+	d.entries[event.ID] = d.order.PushBack(&decision{
+		eventID:  event.ID,
+		kind:     event.Kind,
+		pubkey:   event.PubKey,
+		outcome:  outcome,
+		reason:   reason,
+		source:   source,
+		ip:       ip,
+		at:       now,
+		attempts: attempts,
+	})
+
+	// Prune from the oldest end: expired entries, then any over the cap
+	cutoff := now.Add(-d.retention)
+	for elem := d.order.Front(); elem != nil; elem = d.order.Front() {
+		entry := elem.Value.(*decision)
+		if d.order.Len() <= d.maxEntries && !entry.at.Before(cutoff) {
+			break
+		}
+		d.order.Remove(elem)
+		delete(d.entries, entry.eventID)
+	}
+}
+
+// amend changes the outcome of the decision just recorded on event (e.g. accepted, then not
+// broadcast by this instance), keeping where it came from
+func (d *decisionLog) amend(event *nostr.Event, outcome, reason string) {
+	d.mu.Lock()
+	elem, ok := d.entries[event.ID]
+	if ok {
+		entry := elem.Value.(*decision)
+		entry.outcome, entry.reason = outcome, reason
+	}
+	d.mu.Unlock()
+	if !ok {
+		d.record(event, outcome, reason, "ingest", "")
+	}
+}
+
+// get returns a copy of the last decision on eventID, if still retained
+func (d *decisionLog) get(eventID string) (decision, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.entries[eventID]
+	if !ok {
+		return decision{}, false
+	}
+	entry := *elem.Value.(*decision)
+	if time.Since(entry.at) > d.retention {
+		return decision{}, false
+	}
+	return entry, true
+}
+
+// category is the machine-readable prefix of an OK message (NIP-01), e.g. "rate-limited"
+func (dec decision) category() string {
+	if prefix, _, found := strings.Cut(dec.reason, ":"); found && !strings.Contains(prefix, " ") {
+		return prefix
+	}
+	return ""
+}
+
+func (dec decision) object() *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("event_id", json.NewJsonValue(dec.eventID))
+	obj.Set("kind", json.NewJsonValue(dec.kind))
+	obj.Set("pubkey", json.NewJsonValue(dec.pubkey))
+	obj.Set("decision", json.NewJsonValue(dec.outcome))
+	if category := dec.category(); category != "" {
+		obj.Set("category", json.NewJsonValue(category))
+	}
+	if dec.reason != "" {
+		obj.Set("reason", json.NewJsonValue(dec.reason))
+	}
+	obj.Set("source", json.NewJsonValue(dec.source))
+	if dec.ip != "" {
+		obj.Set("ip", json.NewJsonValue(dec.ip))
+	}
+	obj.Set("at", json.NewJsonValue(dec.at.Unix()))
+	obj.Set("attempts", json.NewJsonValue(dec.attempts))
+	return obj
+}
+
+// GetStatsName returns the name for this stats provider
+func (d *decisionLog) GetStatsName() string {
+	return "decisions"
+}
+
+// GetStats returns the retained decisions by outcome as a JsonEntity
+func (d *decisionLog) GetStats() json.JsonEntity {
+	counts := map[string]int{decisionAccepted: 0, decisionRejected: 0, decisionSkipped: 0}
+	d.mu.Lock()
+	retained := d.order.Len()
+	for elem := d.order.Front(); elem != nil; elem = elem.Next() {
+		counts[elem.Value.(*decision).outcome]++
+	}
+	d.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("retention_seconds", json.NewJsonValue(int64(d.retention.Seconds())))
+	obj.Set("max_events", json.NewJsonValue(d.maxEntries))
+	obj.Set("retained", json.NewJsonValue(retained))
+	obj.Set("accepted", json.NewJsonValue(counts[decisionAccepted]))
+	obj.Set("rejected", json.NewJsonValue(counts[decisionRejected]))
+	obj.Set("skipped", json.NewJsonValue(counts[decisionSkipped]))
+	return obj
+}
+
+// recordDecision notes a decision on event, if decisions are kept
+func (r *Relay) recordDecision(ctx context.Context, event *nostr.Event, outcome, reason string) {
+	if r.decisions == nil {
+		return
+	}
+	source, ip := "ingest", ""
+	if ctx != nil && khatru.GetConnection(ctx) != nil {
+		source, ip = "client", khatru.GetIP(ctx)
+	}
+	r.decisions.record(event, outcome, reason, source, ip)
+}
+
+// amendDecision changes the last decision on event, if decisions are kept
+func (r *Relay) amendDecision(event *nostr.Event, outcome, reason string) {
+	if r.decisions != nil {
+		r.decisions.amend(event, outcome, reason)
+	}
+}
+
+// serveWhy returns the last decision on an event for /api/why/{id}
+func (r *Relay) serveWhy(w http.ResponseWriter, req *http.Request) {
+	if r.decisions == nil {
+		http.Error(w, "Decision log disabled", http.StatusServiceUnavailable)
+		return
+	}
+	entry, ok := r.decisions.get(req.PathValue("id"))
+	if !ok {
+		http.Error(w, "No decision recorded for this event (unknown, or older than the retention window)", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry.object())
+}
@@ -0,0 +1,249 @@
+// Package relaylist publishes the broadcaster's measured top relays as the relay key's own NIP-65
+// relay list (kind 10002) and, optionally, as the relay section of its kind 3 contact list, so
+// clients following the relay's pubkey pick up a relay set curated from real publish results.
+// Lists go through the broadcast pipeline like any other event, reaching the top and mandatory
+// relays.
+package relaylist
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Event kinds published
+const (
+	KindRelayList = 10002
+	KindContacts  = 3
+)
+
+// republishAfter refreshes an unchanged list, in case relays dropped it
+const republishAfter = 24 * time.Hour
+
+// Source provides the relays to recommend and carries the signed lists out
+type Source interface {
+	GetTopRelays() []*manager.RelayInfo
+	BroadcastEvent(event *nostr.Event)
+}
+
+// Config controls publishing
+type Config struct {
+	Interval time.Duration // how often the top relays are checked for changes (default 6h)
+	Max      int           // relays listed (default 20)
+	// Contacts also publishes a kind 3 whose content lists the relays. It replaces the relay
+	// key's contact list: follows are kept only from a kind 3 of the relay key seen passing
+	// through the broadcaster since startup.
+	Contacts bool
+}
+
+// Publisher publishes the relay lists; it implements broadcaster.BroadcastReporter to learn the
+// relay key's follows
+type Publisher struct {
+	cfg       Config
+	secretKey string
+	pubkey    string
+	source    Source
+
+	mu          sync.Mutex
+	follows     nostr.Tags // p tags of the latest kind 3 of the relay key
+	followsAt   nostr.Timestamp
+	listed      []string
+	publishedAt time.Time
+	latest      *nostr.Event
+
+	published int64
+	unchanged int64
+}
+
+// New returns a Publisher signing with secretKey (hex) and recommending source's top relays
+func New(cfg Config, secretKey string, source Source) *Publisher {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 6 * time.Hour
+	}
+	if cfg.Max <= 0 {
+		cfg.Max = 20
+	}
+	pubkey, _ := nostr.GetPublicKey(secretKey)
+	logging.DebugMethod("relaylist", "New", "Publishing up to %d top relays as the relay list of %s every %v (kind 3: %v)",
+		cfg.Max, pubkey, cfg.Interval, cfg.Contacts)
+	return &Publisher{cfg: cfg, secretKey: secretKey, pubkey: pubkey, source: source}
+}
+
+// BroadcastPlanned remembers the follows of a kind 3 published with the relay key
+func (p *Publisher) BroadcastPlanned(event *nostr.Event, relays []string) {
+	if event.Kind != KindContacts || event.PubKey != p.pubkey {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if event.CreatedAt < p.followsAt {
+		return
+	}
+	follows := nostr.Tags{}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			follows = append(follows, tag)
+		}
+	}
+	p.follows, p.followsAt = follows, event.CreatedAt
+}
+
+// BroadcastCompleted does nothing: lists are published fire-and-forget
+func (p *Publisher) BroadcastCompleted(report broadcaster.BroadcastReport) {}
+
+// Run publishes the lists every interval until ctx is canceled. The first check waits for one
+// interval (at most 10 minutes) so the scores have settled.
+func (p *Publisher) Run(ctx context.Context) {
+	timer := time.NewTimer(min(p.cfg.Interval, 10*time.Minute))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		p.Publish(false)
+		timer.Reset(p.cfg.Interval)
+	}
+}
+
+// Publish signs and broadcasts the lists if the top relays changed since the last publish (or
+// it is older than a day), or always with force. It returns the kind 10002 event, or nil.
+func (p *Publisher) Publish(force bool) *nostr.Event {
+	urls := p.topURLs()
+	if len(urls) == 0 {
+		logging.DebugMethod("relaylist", "Publish", "No top relays yet, nothing to publish")
+		return nil
+	}
+
+	p.mu.Lock()
+	if !force && sameRelays(urls, p.listed) && time.Since(p.publishedAt) < republishAfter {
+		p.mu.Unlock()
+		atomic.AddInt64(&p.unchanged, 1)
+		logging.DebugMethod("relaylist", "Publish", "Top relays unchanged, not republishing")
+		return nil
+	}
+	follows := p.follows
+	p.mu.Unlock()
+
+	now := nostr.Now()
+	relayList := &nostr.Event{Kind: KindRelayList, CreatedAt: now, Tags: nostr.Tags{}}
+	for _, url := range urls {
+		relayList.Tags = append(relayList.Tags, nostr.Tag{"r", url})
+	}
+	if err := relayList.Sign(p.secretKey); err != nil {
+		logging.Error("RelayList: Failed to sign relay list: %v", err)
+		return nil
+	}
+	events := []*nostr.Event{relayList}
+
+	if p.cfg.Contacts {
+		contacts, err := composeContacts(urls, follows, now)
+		if err == nil {
+			err = contacts.Sign(p.secretKey)
+		}
+		if err != nil {
+			logging.Error("RelayList: Failed to compose contact list: %v", err)
+		} else {
+			events = append(events, contacts)
+		}
+	}
+
+	p.mu.Lock()
+	p.listed, p.publishedAt, p.latest = urls, time.Now(), relayList
+	p.mu.Unlock()
+	for _, event := range events {
+		p.source.BroadcastEvent(event)
+	}
+	atomic.AddInt64(&p.published, 1)
+	logging.Info("RelayList: Published relay list %s with %d relays", relayList.ID, len(urls))
+	return relayList
+}
+
+// composeContacts builds an unsigned kind 3 keeping follows and listing urls as read/write relays
+func composeContacts(urls []string, follows nostr.Tags, at nostr.Timestamp) (*nostr.Event, error) {
+	type usage struct {
+		Read  bool `json:"read"`
+		Write bool `json:"write"`
+	}
+	relays := make(map[string]usage, len(urls))
+	for _, url := range urls {
+		relays[url] = usage{Read: true, Write: true}
+	}
+	content, err := stdjson.Marshal(relays)
+	if err != nil {
+		return nil, err
+	}
+	tags := append(nostr.Tags{}, follows...)
+	return &nostr.Event{Kind: KindContacts, CreatedAt: at, Tags: tags, Content: string(content)}, nil
+}
+
+func (p *Publisher) topURLs() []string {
+	top := p.source.GetTopRelays()
+	urls := make([]string, 0, min(len(top), p.cfg.Max))
+	for _, relay := range top {
+		if len(urls) == p.cfg.Max {
+			break
+		}
+		urls = append(urls, relay.URL)
+	}
+	return urls
+}
+
+// sameRelays reports whether a and b list the same relays, in any order
+func sameRelays(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, url := range a {
+		set[url] = true
+	}
+	for _, url := range b {
+		if !set[url] {
+			return false
+		}
+	}
+	return true
+}
+
+// Latest returns the last published kind 10002 event, or nil
+func (p *Publisher) Latest() *nostr.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latest
+}
+
+// GetStatsName returns the name for this stats provider
+func (p *Publisher) GetStatsName() string {
+	return "relay_list"
+}
+
+// GetStats returns the publishing state as a JsonEntity
+func (p *Publisher) GetStats() json.JsonEntity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("pubkey", json.NewJsonValue(p.pubkey))
+	obj.Set("interval_seconds", json.NewJsonValue(p.cfg.Interval.Seconds()))
+	obj.Set("max_relays", json.NewJsonValue(p.cfg.Max))
+	obj.Set("contacts", json.NewJsonValue(p.cfg.Contacts))
+	obj.Set("known_follows", json.NewJsonValue(len(p.follows)))
+	obj.Set("listed_relays", json.NewJsonValue(len(p.listed)))
+	if p.latest != nil {
+		obj.Set("last_event_id", json.NewJsonValue(p.latest.ID))
+		obj.Set("last_published_at", json.NewJsonValue(p.publishedAt.Unix()))
+	}
+	obj.Set("published", json.NewJsonValue(atomic.LoadInt64(&p.published)))
+	obj.Set("unchanged", json.NewJsonValue(atomic.LoadInt64(&p.unchanged)))
+	return obj
+}
@@ -0,0 +1,356 @@
+// Package report composes a daily self-report of the broadcaster's operation (events broadcast,
+// busiest destination relays and their success rates, pool changes) as a NIP-23 long-form
+// article signed with the relay key, so the relay's behaviour is publicly auditable.
+package report
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/broadcast/manager"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Kind is NIP-23 long-form content
+const Kind = 30023
+
+// dTagPrefix namespaces reports among other long-form posts of the relay key
+const dTagPrefix = "broadcast-report:"
+
+// maxRelayRows limits the destination relay table
+const maxRelayRows = 20
+
+// PoolSource is the relay pool the report describes
+type PoolSource interface {
+	GetRelayCount() int
+	GetTopRelays() []*manager.RelayInfo
+}
+
+// Config controls report generation
+type Config struct {
+	Name   string        // relay name used in the title
+	Relays []string      // relays reports are published to; empty keeps them API-only
+	At     time.Duration // time of day (UTC) the report is published, e.g. 0 for midnight
+}
+
+type relayCounts struct {
+	ok      int64
+	failed  int64
+	latency time.Duration // sum over successful publishes
+}
+
+// period accumulates what happened since the last report
+type period struct {
+	start      time.Time
+	events     int64
+	byKind     map[int]int64
+	relays     map[string]*relayCounts
+	relayCount int
+	top        map[string]bool
+}
+
+// Reporter accumulates broadcast results and publishes a daily report; it implements
+// broadcaster.BroadcastReporter
+type Reporter struct {
+	cfg       Config
+	secretKey string
+	source    PoolSource
+
+	mu      sync.Mutex
+	current *period
+	latest  *nostr.Event
+
+	published int64
+	failed    int64
+}
+
+// New returns a Reporter signing with secretKey (hex) that describes source
+func New(cfg Config, secretKey string, source PoolSource) *Reporter {
+	logging.DebugMethod("report", "New", "Initializing daily report: relays=%d, at=%v UTC", len(cfg.Relays), cfg.At)
+	r := &Reporter{cfg: cfg, secretKey: secretKey, source: source}
+	r.current = r.newPeriod(time.Now())
+	return r
+}
+
+func (r *Reporter) newPeriod(start time.Time) *period {
+	top := make(map[string]bool)
+	for _, relay := range r.source.GetTopRelays() {
+		top[relay.URL] = true
+	}
+	return &period{
+		start:      start,
+		byKind:     make(map[int]int64),
+		relays:     make(map[string]*relayCounts),
+		relayCount: r.source.GetRelayCount(),
+		top:        top,
+	}
+}
+
+// BroadcastPlanned is a no-op; only completed broadcasts are reported
+func (r *Reporter) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted adds one event's delivery results to the current period
+func (r *Reporter) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.current
+	p.events++
+	p.byKind[report.Event.Kind]++
+	for _, res := range report.Results {
+		rc, ok := p.relays[res.URL]
+		if !ok {
+			rc = &relayCounts{}
+			p.relays[res.URL] = rc
+		}
+		if res.Success {
+			rc.ok++
+			rc.latency += res.ResponseTime
+		} else {
+			rc.failed++
+		}
+	}
+}
+
+// DeliveryCorrected moves a late-confirmed publish from failed to ok in the current period
+func (r *Reporter) DeliveryCorrected(eventID string, result broadcaster.RelayResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rc, ok := r.current.relays[result.URL]
+	if !ok || rc.failed == 0 {
+		return // the failure was counted in an earlier period
+	}
+	rc.failed--
+	rc.ok++
+	rc.latency += result.ResponseTime
+}
+
+// Run publishes a report every day at the configured time until ctx is canceled
+func (r *Reporter) Run(ctx context.Context) {
+	for {
+		next := nextRun(time.Now().UTC(), r.cfg.At)
+		logging.DebugMethod("report", "Run", "Next daily report at %s", next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		r.Publish(ctx)
+	}
+}
+
+// nextRun returns the first time after now at offset at into a UTC day
+func nextRun(now time.Time, at time.Duration) time.Time {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	next := day.Add(at)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
+
+// Publish closes the current period, signs its report and sends it to the report relays
+func (r *Reporter) Publish(ctx context.Context) *nostr.Event {
+	now := time.Now()
+	next := r.newPeriod(now)
+	r.mu.Lock()
+	p := r.current
+	r.current = next
+	r.mu.Unlock()
+
+	event := r.compose(p, now)
+	if err := event.Sign(r.secretKey); err != nil {
+		logging.Error("Report: Failed to sign daily report: %v", err)
+		return nil
+	}
+
+	r.mu.Lock()
+	r.latest = event
+	r.mu.Unlock()
+
+	if len(r.cfg.Relays) == 0 {
+		logging.Info("Report: Daily report %s composed (not published: no report relays)", event.ID)
+		return event
+	}
+
+	pool := nostr.NewSimplePool(ctx)
+	defer pool.Close("report published")
+	publishCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	ok := 0
+	for res := range pool.PublishMany(publishCtx, r.cfg.Relays, *event) {
+		if res.Error == nil {
+			ok++
+		} else {
+			logging.DebugMethod("report", "Publish", "Failed to publish report to %s: %v", res.RelayURL, res.Error)
+		}
+	}
+	if ok > 0 {
+		atomic.AddInt64(&r.published, 1)
+	} else {
+		atomic.AddInt64(&r.failed, 1)
+	}
+	logging.Info("Report: Daily report %s published to %d/%d relays", event.ID, ok, len(r.cfg.Relays))
+	return event
+}
+
+// Latest returns the last composed report, or nil if none has been made yet
+func (r *Reporter) Latest() *nostr.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latest
+}
+
+// compose renders period p as an unsigned kind 30023 event
+func (r *Reporter) compose(p *period, end time.Time) *nostr.Event {
+	date := end.UTC().Format("2006-01-02")
+	title := fmt.Sprintf("%s daily broadcast report, %s", r.cfg.Name, date)
+
+	var okTotal, failedTotal int64
+	for _, rc := range p.relays {
+		okTotal += rc.ok
+		failedTotal += rc.failed
+	}
+	summary := fmt.Sprintf("%d events broadcast, %d publishes (%s succeeded) to %d relays",
+		p.events, okTotal+failedTotal, percent(okTotal, okTotal+failedTotal), len(p.relays))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s\n\n", title)
+	fmt.Fprintf(&sb, "Period: %s to %s (UTC)\n\n", p.start.UTC().Format("2006-01-02 15:04"), end.UTC().Format("2006-01-02 15:04"))
+
+	sb.WriteString("## Summary\n\n")
+	fmt.Fprintf(&sb, "- Events broadcast: %d\n", p.events)
+	fmt.Fprintf(&sb, "- Publishes: %d succeeded, %d failed (%s success)\n", okTotal, failedTotal, percent(okTotal, okTotal+failedTotal))
+	fmt.Fprintf(&sb, "- Destination relays used: %d\n", len(p.relays))
+	fmt.Fprintf(&sb, "- Relays known: %d (was %d)\n\n", r.source.GetRelayCount(), p.relayCount)
+
+	if len(p.byKind) > 0 {
+		sb.WriteString("## Events by kind\n\n| Kind | Events |\n|---:|---:|\n")
+		kinds := make([]int, 0, len(p.byKind))
+		for k := range p.byKind {
+			kinds = append(kinds, k)
+		}
+		sort.Slice(kinds, func(i, j int) bool {
+			if p.byKind[kinds[i]] != p.byKind[kinds[j]] {
+				return p.byKind[kinds[i]] > p.byKind[kinds[j]]
+			}
+			return kinds[i] < kinds[j]
+		})
+		for _, k := range kinds {
+			fmt.Fprintf(&sb, "| %d | %d |\n", k, p.byKind[k])
+		}
+		sb.WriteString("\n")
+	}
+
+	if len(p.relays) > 0 {
+		urls := make([]string, 0, len(p.relays))
+		for url := range p.relays {
+			urls = append(urls, url)
+		}
+		sort.Slice(urls, func(i, j int) bool {
+			a, b := p.relays[urls[i]], p.relays[urls[j]]
+			if a.ok+a.failed != b.ok+b.failed {
+				return a.ok+a.failed > b.ok+b.failed
+			}
+			return urls[i] < urls[j]
+		})
+		if len(urls) > maxRelayRows {
+			urls = urls[:maxRelayRows]
+		}
+		sb.WriteString("## Top destination relays\n\n| Relay | Publishes | Success | Avg latency |\n|---|---:|---:|---:|\n")
+		for _, url := range urls {
+			rc := p.relays[url]
+			avg := "-"
+			if rc.ok > 0 {
+				avg = fmt.Sprintf("%d ms", (rc.latency / time.Duration(rc.ok)).Milliseconds())
+			}
+			fmt.Fprintf(&sb, "| %s | %d | %s | %s |\n", url, rc.ok+rc.failed, percent(rc.ok, rc.ok+rc.failed), avg)
+		}
+		sb.WriteString("\n")
+	}
+
+	joined, left := []string{}, []string{}
+	nowTop := make(map[string]bool)
+	for _, relay := range r.source.GetTopRelays() {
+		nowTop[relay.URL] = true
+		if !p.top[relay.URL] {
+			joined = append(joined, relay.URL)
+		}
+	}
+	for url := range p.top {
+		if !nowTop[url] {
+			left = append(left, url)
+		}
+	}
+	sort.Strings(joined)
+	sort.Strings(left)
+	sb.WriteString("## Pool changes\n\n")
+	if len(joined) == 0 && len(left) == 0 {
+		sb.WriteString("The top relay set did not change.\n")
+	}
+	for _, url := range joined {
+		fmt.Fprintf(&sb, "- Joined the top set: %s\n", url)
+	}
+	for _, url := range left {
+		fmt.Fprintf(&sb, "- Left the top set: %s\n", url)
+	}
+
+	return &nostr.Event{
+		Kind:      Kind,
+		CreatedAt: nostr.Timestamp(end.Unix()),
+		Content:   sb.String(),
+		Tags: nostr.Tags{
+			{"d", dTagPrefix + date},
+			{"title", title},
+			{"summary", summary},
+			{"published_at", strconv.FormatInt(end.Unix(), 10)},
+			{"t", "broadcast-relay"},
+		},
+	}
+}
+
+func percent(part, total int64) string {
+	if total == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)/float64(total)*100)
+}
+
+// GetStatsName returns the name for this stats provider
+func (r *Reporter) GetStatsName() string {
+	return "report"
+}
+
+// GetStats returns report statistics as a JsonEntity
+func (r *Reporter) GetStats() json.JsonEntity {
+	r.mu.Lock()
+	periodStart := r.current.start
+	periodEvents := r.current.events
+	latest := r.latest
+	r.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("report_relays", json.NewJsonValue(len(r.cfg.Relays)))
+	obj.Set("next_report", json.NewJsonValue(nextRun(time.Now().UTC(), r.cfg.At).Format(time.RFC3339)))
+	obj.Set("period_start", json.NewJsonValue(periodStart.Format(time.RFC3339)))
+	obj.Set("period_events", json.NewJsonValue(periodEvents))
+	obj.Set("published", json.NewJsonValue(atomic.LoadInt64(&r.published)))
+	obj.Set("publish_failed", json.NewJsonValue(atomic.LoadInt64(&r.failed)))
+	if latest != nil {
+		obj.Set("latest_id", json.NewJsonValue(latest.ID))
+	}
+	return obj
+}
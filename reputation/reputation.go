@@ -0,0 +1,426 @@
+// Package reputation rejects inbound clients whose IP is a known abuse source, before they can
+// publish: IPs and CIDR ranges of a local blocklist file (reloaded when it changes), and IPs
+// listed by DNS blocklists (DNSBLs such as zen.spamhaus.org). DNSBL answers are cached, listed
+// or not, so a reconnecting client costs one lookup per CacheTTL.
+//
+// Usage:
+//
+//	reputation.New(reputation.Config{
+//	    BlocklistFile: "blocklist.txt",
+//	    DNSBLs:        []string{"zen.spamhaus.org"},
+//	    Mode:          reputation.ModeBlock,
+//	}).Apply(relay)
+package reputation
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Strictness modes: what happens to a listed client
+const (
+	ModeBlock   = "block"   // the WebSocket upgrade is refused
+	ModePublish = "publish" // the client may connect and read, but its events are rejected
+	ModeMonitor = "monitor" // nothing is rejected; listings are only counted and logged
+)
+
+// SourceBlocklist names the blocklist file in listings; DNSBLs are named by their zone
+const SourceBlocklist = "blocklist"
+
+// Config drives a Checker. Without a blocklist file and DNSBLs it does nothing.
+type Config struct {
+	// BlocklistFile holds one IP or CIDR range per line (# comments); it is re-read when its
+	// modification time changes, checked every ReloadInterval (default 1m)
+	BlocklistFile  string
+	ReloadInterval time.Duration
+	// DNSBLs are the blocklist zones queried for each client IP; Threshold is how many must list
+	// an IP before it counts as listed (default 1). The blocklist file always counts as listed.
+	DNSBLs    []string
+	Threshold int
+	// Mode is ModeBlock, ModePublish or ModeMonitor (default ModeBlock)
+	Mode string
+	// CacheTTL is how long a DNSBL verdict is kept (default 1h); Timeout bounds one lookup of all
+	// zones (default 2s). A lookup that fails or times out lets the client in.
+	CacheTTL time.Duration
+	Timeout  time.Duration
+
+	// OnListed is called when a client is found listed; optional.
+	OnListed func(ip string, sources []string)
+	// LogDebug is optional (e.g. connect to verbose logging).
+	LogDebug func(format string, args ...any)
+}
+
+// verdict is the cached DNSBL result of one IP
+type verdict struct {
+	zones []string // zones listing the IP
+	until time.Time
+}
+
+// Checker looks client IPs up on the blocklist and the DNSBLs. Create with New, then Apply.
+type Checker struct {
+	cfg      Config
+	resolver *net.Resolver
+
+	mu        sync.RWMutex
+	ips       map[string]bool
+	networks  []*net.IPNet
+	modTime   time.Time
+	loadError string
+
+	cacheMu sync.Mutex
+	cache   map[string]verdict
+
+	checks              int64
+	cacheHits           int64
+	lookups             int64
+	lookupErrors        int64
+	listed              int64
+	rejectedConnections int64
+	rejectedEvents      int64
+	sourceHits          sync.Map // source -> *int64
+}
+
+// New returns a Checker for cfg, or nil if it has neither a blocklist file nor DNSBLs
+func New(cfg Config) *Checker {
+	if cfg.BlocklistFile == "" && len(cfg.DNSBLs) == 0 {
+		return nil
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = time.Minute
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 1
+	}
+	switch cfg.Mode {
+	case ModeBlock, ModePublish, ModeMonitor:
+	default:
+		cfg.Mode = ModeBlock
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = time.Hour
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	for i, zone := range cfg.DNSBLs {
+		cfg.DNSBLs[i] = strings.Trim(strings.ToLower(strings.TrimSpace(zone)), ".")
+	}
+
+	c := &Checker{
+		cfg:      cfg,
+		resolver: net.DefaultResolver,
+		ips:      make(map[string]bool),
+		cache:    make(map[string]verdict),
+	}
+	if cfg.BlocklistFile != "" {
+		c.reload()
+	}
+	return c
+}
+
+func (c *Checker) logf(format string, args ...any) {
+	if c.cfg.LogDebug != nil {
+		c.cfg.LogDebug(format, args...)
+	}
+}
+
+// Apply registers the hooks of the configured mode on relay; Run reloads the blocklist and
+// cleans the cache. A nil Checker does nothing.
+func (c *Checker) Apply(relay *khatru.Relay) {
+	if c == nil || relay == nil {
+		return
+	}
+	switch c.cfg.Mode {
+	case ModePublish:
+		relay.RejectEvent = append([]func(context.Context, *nostr.Event) (bool, string){c.rejectEvent}, relay.RejectEvent...)
+	default:
+		// Runs first: a listed client should not even count against the rate limits
+		relay.RejectConnection = append([]func(*http.Request) bool{c.rejectConnection}, relay.RejectConnection...)
+	}
+}
+
+func (c *Checker) rejectConnection(req *http.Request) bool {
+	sources := c.Check(khatru.GetIPFromRequest(req))
+	if len(sources) == 0 || c.cfg.Mode == ModeMonitor {
+		return false
+	}
+	atomic.AddInt64(&c.rejectedConnections, 1)
+	return true
+}
+
+func (c *Checker) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if len(c.Check(khatru.GetIP(ctx))) == 0 {
+		return false, ""
+	}
+	atomic.AddInt64(&c.rejectedEvents, 1)
+	return true, "blocked: your IP address is listed as an abuse source"
+}
+
+// Check returns the sources listing ip (the blocklist and/or DNSBL zones), or nil if it is not
+// listed. Only DNSBL listings reaching the threshold are returned.
+func (c *Checker) Check(ip string) []string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	atomic.AddInt64(&c.checks, 1)
+
+	var sources []string
+	if c.inBlocklist(parsed) {
+		sources = append(sources, SourceBlocklist)
+	}
+	if zones := c.dnsblListings(parsed); len(zones) >= c.cfg.Threshold {
+		sources = append(sources, zones...)
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&c.listed, 1)
+	for _, source := range sources {
+		counter, _ := c.sourceHits.LoadOrStore(source, new(int64))
+		atomic.AddInt64(counter.(*int64), 1)
+	}
+	c.logf("%s listed by %v (mode %s)", ip, sources, c.cfg.Mode)
+	if c.cfg.OnListed != nil {
+		c.cfg.OnListed(ip, sources)
+	}
+	return sources
+}
+
+func (c *Checker) inBlocklist(ip net.IP) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.ips[ip.String()] {
+		return true
+	}
+	for _, network := range c.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsblListings returns the zones listing ip, from the cache or by querying all zones in parallel
+func (c *Checker) dnsblListings(ip net.IP) []string {
+	if len(c.cfg.DNSBLs) == 0 || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+	key := ip.String()
+	now := time.Now()
+
+	c.cacheMu.Lock()
+	if v, ok := c.cache[key]; ok && now.Before(v.until) {
+		c.cacheMu.Unlock()
+		atomic.AddInt64(&c.cacheHits, 1)
+		return v.zones
+	}
+	c.cacheMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+	name := reverse(ip)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		zones  []string
+		failed bool
+	)
+	for _, zone := range c.cfg.DNSBLs {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+			atomic.AddInt64(&c.lookups, 1)
+			addrs, err := c.resolver.LookupHost(ctx, name+"."+zone)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+					// Not an answer: don't cache it, let the client in
+					atomic.AddInt64(&c.lookupErrors, 1)
+					failed = true
+					c.logf("DNSBL %s lookup of %s failed: %v", zone, key, err)
+				}
+				return
+			}
+			// Listings answer 127.0.0.x; anything else is an error response (e.g. a blocked resolver)
+			for _, addr := range addrs {
+				if strings.HasPrefix(addr, "127.") {
+					zones = append(zones, zone)
+					return
+				}
+			}
+		}(zone)
+	}
+	wg.Wait()
+	sort.Strings(zones)
+
+	if !failed || len(zones) > 0 {
+		c.cacheMu.Lock()
+		c.cache[key] = verdict{zones: zones, until: now.Add(c.cfg.CacheTTL)}
+		c.cacheMu.Unlock()
+	}
+	return zones
+}
+
+// reverse returns the DNSBL query label of ip: reversed octets for IPv4, reversed nibbles for IPv6
+func reverse(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	v6 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(v6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", v6[i]&0x0f), fmt.Sprintf("%x", v6[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// Run reloads the blocklist file when it changes and drops expired DNSBL verdicts until ctx is
+// canceled
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if c.cfg.BlocklistFile != "" {
+			c.reload()
+		}
+		now := time.Now()
+		c.cacheMu.Lock()
+		for ip, v := range c.cache {
+			if now.After(v.until) {
+				delete(c.cache, ip)
+			}
+		}
+		c.cacheMu.Unlock()
+	}
+}
+
+// reload reads the blocklist file if it changed since the last load; a file that cannot be read
+// keeps the previous list
+func (c *Checker) reload() {
+	info, err := os.Stat(c.cfg.BlocklistFile)
+	if err != nil {
+		c.setLoadError(err)
+		return
+	}
+	c.mu.RLock()
+	unchanged := info.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	f, err := os.Open(c.cfg.BlocklistFile)
+	if err != nil {
+		c.setLoadError(err)
+		return
+	}
+	defer f.Close()
+
+	ips := make(map[string]bool)
+	var networks []*net.IPNet
+	invalid := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(line); err == nil {
+			networks = append(networks, network)
+		} else if ip := net.ParseIP(line); ip != nil {
+			ips[ip.String()] = true
+		} else {
+			invalid++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		c.setLoadError(err)
+		return
+	}
+
+	c.mu.Lock()
+	c.ips, c.networks, c.modTime, c.loadError = ips, networks, info.ModTime(), ""
+	c.mu.Unlock()
+	c.logf("loaded blocklist %s: %d IPs, %d ranges, %d invalid lines", c.cfg.BlocklistFile, len(ips), len(networks), invalid)
+}
+
+func (c *Checker) setLoadError(err error) {
+	c.mu.Lock()
+	c.loadError = err.Error()
+	c.mu.Unlock()
+	c.logf("blocklist %s not loaded: %v", c.cfg.BlocklistFile, err)
+}
+
+// GetStatsName returns the name for this stats provider
+func (c *Checker) GetStatsName() string {
+	return "reputation"
+}
+
+// GetStats returns the lists, lookups and rejections as a JsonEntity
+func (c *Checker) GetStats() json.JsonEntity {
+	c.mu.RLock()
+	ips, networks, loadError := len(c.ips), len(c.networks), c.loadError
+	c.mu.RUnlock()
+	c.cacheMu.Lock()
+	cached := len(c.cache)
+	c.cacheMu.Unlock()
+
+	hits := make(map[string]int64)
+	var sources []string
+	c.sourceHits.Range(func(key, value any) bool {
+		sources = append(sources, key.(string))
+		hits[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	sort.Strings(sources)
+	bySource := json.NewJsonObject()
+	for _, source := range sources {
+		bySource.Set(source, json.NewJsonValue(hits[source]))
+	}
+
+	obj := json.NewJsonObject()
+	obj.Set("mode", json.NewJsonValue(c.cfg.Mode))
+	obj.Set("blocklist_ips", json.NewJsonValue(ips))
+	obj.Set("blocklist_ranges", json.NewJsonValue(networks))
+	if loadError != "" {
+		obj.Set("blocklist_error", json.NewJsonValue(loadError))
+	}
+	obj.Set("dnsbls", json.NewJsonValue(len(c.cfg.DNSBLs)))
+	obj.Set("threshold", json.NewJsonValue(c.cfg.Threshold))
+	obj.Set("checks", json.NewJsonValue(atomic.LoadInt64(&c.checks)))
+	obj.Set("cache_hits", json.NewJsonValue(atomic.LoadInt64(&c.cacheHits)))
+	obj.Set("cached_verdicts", json.NewJsonValue(cached))
+	obj.Set("dnsbl_lookups", json.NewJsonValue(atomic.LoadInt64(&c.lookups)))
+	obj.Set("dnsbl_errors", json.NewJsonValue(atomic.LoadInt64(&c.lookupErrors)))
+	obj.Set("listed", json.NewJsonValue(atomic.LoadInt64(&c.listed)))
+	obj.Set("listed_by_source", bySource)
+	obj.Set("rejected_connections", json.NewJsonValue(atomic.LoadInt64(&c.rejectedConnections)))
+	obj.Set("rejected_events", json.NewJsonValue(atomic.LoadInt64(&c.rejectedEvents)))
+	return obj
+}
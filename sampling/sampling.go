@@ -0,0 +1,199 @@
+// Package sampling keeps a privacy-preserving sample of broadcast event metadata for abuse
+// forensics. One event in N is picked by its ID (a hash, so the choice is uniform and the same
+// events are picked on every instance) and only its metadata is kept: ID, kind, a prefix of the
+// author's pubkey, serialized size and how many relays it went to. Content, tags and signatures
+// are never stored.
+package sampling
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-brodcast-relay/broadcast/broadcaster"
+	"github.com/girino/nostr-brodcast-relay/logging"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Config controls the sample
+type Config struct {
+	Rate         int // keep 1 in Rate events (1 = every event)
+	Size         int // samples kept; the oldest are overwritten
+	AuthorPrefix int // hex characters of the author pubkey kept (0 = none)
+}
+
+// Sample is the metadata kept for one broadcast event
+type Sample struct {
+	ID           string
+	Kind         int
+	AuthorPrefix string
+	Size         int // bytes of the serialized event
+	Targets      int // relays the event was sent to
+	Delivered    int // relays that accepted it
+	CreatedAt    time.Time
+	BroadcastAt  time.Time
+}
+
+// Query selects samples; zero fields match everything
+type Query struct {
+	Kind         *int
+	AuthorPrefix string // matches samples whose prefix starts with it, or that it starts with
+	Since        time.Time
+	Limit        int
+}
+
+// Sampler records samples in a ring buffer; it implements broadcaster.BroadcastReporter
+type Sampler struct {
+	cfg Config
+
+	mu   sync.Mutex
+	ring []Sample
+	next int  // slot the next sample goes to
+	full bool // ring wrapped at least once
+
+	seen    int64
+	sampled int64
+}
+
+// New returns a Sampler for cfg
+func New(cfg Config) *Sampler {
+	if cfg.Rate < 1 {
+		cfg.Rate = 1
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = 10000
+	}
+	if cfg.AuthorPrefix < 0 || cfg.AuthorPrefix > 64 {
+		cfg.AuthorPrefix = 8
+	}
+	logging.DebugMethod("sampling", "New", "Sampling 1 in %d broadcast events, keeping %d (author prefix %d chars)",
+		cfg.Rate, cfg.Size, cfg.AuthorPrefix)
+	return &Sampler{
+		cfg:  cfg,
+		ring: make([]Sample, cfg.Size),
+	}
+}
+
+// Picked reports whether the event with id belongs to the sample: the first 8 bytes of the ID
+// taken as a number, modulo the rate
+func (s *Sampler) Picked(id string) bool {
+	if s.cfg.Rate == 1 {
+		return true
+	}
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) < 8 {
+		return false
+	}
+	return binary.BigEndian.Uint64(raw[:8])%uint64(s.cfg.Rate) == 0
+}
+
+// BroadcastPlanned does nothing: samples are taken once the outcome is known
+func (s *Sampler) BroadcastPlanned(event *nostr.Event, relays []string) {}
+
+// BroadcastCompleted samples the event if its ID is picked
+func (s *Sampler) BroadcastCompleted(report broadcaster.BroadcastReport) {
+	atomic.AddInt64(&s.seen, 1)
+	event := report.Event
+	if event == nil || !s.Picked(event.ID) {
+		return
+	}
+
+	delivered := 0
+	for _, result := range report.Results {
+		if result.Success {
+			delivered++
+		}
+	}
+	sample := Sample{
+		ID:          event.ID,
+		Kind:        event.Kind,
+		Size:        len(event.String()),
+		Targets:     len(report.Results),
+		Delivered:   delivered,
+		CreatedAt:   event.CreatedAt.Time(),
+		BroadcastAt: report.Finished,
+	}
+	if s.cfg.AuthorPrefix > 0 {
+		sample.AuthorPrefix = event.PubKey[:min(s.cfg.AuthorPrefix, len(event.PubKey))]
+	}
+
+	s.mu.Lock()
+	s.ring[s.next] = sample
+	s.next = (s.next + 1) % len(s.ring)
+	if s.next == 0 {
+		s.full = true
+	}
+	s.mu.Unlock()
+	atomic.AddInt64(&s.sampled, 1)
+}
+
+// Samples returns the samples matching q, newest first
+func (s *Sampler) Samples(q Query) []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.next
+	if s.full {
+		count = len(s.ring)
+	}
+	result := []Sample{}
+	for i := 0; i < count; i++ {
+		sample := s.ring[(s.next-1-i+len(s.ring))%len(s.ring)]
+		if q.Kind != nil && sample.Kind != *q.Kind {
+			continue
+		}
+		if q.AuthorPrefix != "" && !strings.HasPrefix(sample.AuthorPrefix, q.AuthorPrefix) && !strings.HasPrefix(q.AuthorPrefix, sample.AuthorPrefix) {
+			continue
+		}
+		if !q.Since.IsZero() && sample.BroadcastAt.Before(q.Since) {
+			// Newest first: everything after this is older still
+			break
+		}
+		result = append(result, sample)
+		if q.Limit > 0 && len(result) >= q.Limit {
+			break
+		}
+	}
+	return result
+}
+
+// SampleObject converts a sample for the admin API
+func SampleObject(sample Sample) *json.JsonObject {
+	obj := json.NewJsonObject()
+	obj.Set("id", json.NewJsonValue(sample.ID))
+	obj.Set("kind", json.NewJsonValue(sample.Kind))
+	obj.Set("author_prefix", json.NewJsonValue(sample.AuthorPrefix))
+	obj.Set("size", json.NewJsonValue(sample.Size))
+	obj.Set("targets", json.NewJsonValue(sample.Targets))
+	obj.Set("delivered", json.NewJsonValue(sample.Delivered))
+	obj.Set("created_at", json.NewJsonValue(sample.CreatedAt.Unix()))
+	obj.Set("broadcast_at", json.NewJsonValue(sample.BroadcastAt.Unix()))
+	return obj
+}
+
+// GetStatsName returns the name for this stats provider
+func (s *Sampler) GetStatsName() string {
+	return "sampling"
+}
+
+// GetStats returns sampling statistics as a JsonEntity
+func (s *Sampler) GetStats() json.JsonEntity {
+	s.mu.Lock()
+	stored := s.next
+	if s.full {
+		stored = len(s.ring)
+	}
+	s.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("rate", json.NewJsonValue(s.cfg.Rate))
+	obj.Set("capacity", json.NewJsonValue(s.cfg.Size))
+	obj.Set("stored", json.NewJsonValue(stored))
+	obj.Set("seen", json.NewJsonValue(atomic.LoadInt64(&s.seen)))
+	obj.Set("sampled", json.NewJsonValue(atomic.LoadInt64(&s.sampled)))
+	return obj
+}
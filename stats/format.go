@@ -0,0 +1,266 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Output formats of the stats document
+const (
+	FormatJSON       = "json"
+	FormatPrometheus = "prometheus"
+	FormatText       = "text"
+)
+
+// Content types of the formats
+const (
+	ContentTypeJSON       = "application/json"
+	ContentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+	ContentTypeText       = "text/plain; charset=utf-8"
+)
+
+// labelFields are the fields that name the elements of a list of objects (e.g. the top relays),
+// in order of preference; the first one an element has becomes its label
+var labelFields = []string{"url", "relay", "name", "class", "kind", "id"}
+
+// labelEscaper escapes label values as the exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample is one Prometheus sample
+type sample struct {
+	labels string // rendered {..} or ""
+	value  float64
+}
+
+// label is a Prometheus label
+type label struct {
+	name, value string
+}
+
+// prometheus flattens a document into metric families, in the order they first appear
+type prometheus struct {
+	order    []string
+	families map[string][]sample
+}
+
+// WritePrometheus writes doc in the Prometheus text exposition format. Numbers and booleans
+// become one metric per path (prefix + the keys joined by "_"); strings are left out. Keys that
+// are not metric names (relay URLs, kinds) and the elements of lists become labels.
+func WritePrometheus(w io.Writer, doc *json.JsonObject, prefix string) error {
+	p := &prometheus{families: make(map[string][]sample)}
+	p.walk(sanitizeName(prefix), nil, doc)
+
+	out := bufio.NewWriter(w)
+	for _, name := range p.order {
+		fmt.Fprintf(out, "# TYPE %s untyped\n", name)
+		for _, s := range p.families[name] {
+			fmt.Fprintf(out, "%s%s %s\n", name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	return out.Flush()
+}
+
+func (p *prometheus) walk(name string, labels []label, entity json.JsonEntity) {
+	switch v := entity.(type) {
+	case *json.JsonObject:
+		v.ForEach(func(key string, value json.JsonEntity) bool {
+			if isMetricName(key) {
+				p.walk(joinName(name, key), labels, value)
+			} else {
+				p.walk(name, withLabel(labels, "key", key), value)
+			}
+			return true
+		})
+	case *json.JsonList:
+		for i, item := range v.ToSlice() {
+			field, value := listLabel(item, i)
+			p.walk(name, withLabel(labels, field, value), item)
+		}
+	case *json.JsonValue:
+		value, ok := numeric(v)
+		if !ok || name == "" {
+			return
+		}
+		if _, seen := p.families[name]; !seen {
+			p.order = append(p.order, name)
+		}
+		p.families[name] = append(p.families[name], sample{labels: renderLabels(labels), value: value})
+	}
+}
+
+// listLabel names a list element: by its identifying field if it is an object that has one,
+// by its position otherwise
+func listLabel(item json.JsonEntity, index int) (string, string) {
+	if obj, ok := item.(*json.JsonObject); ok {
+		for _, field := range labelFields {
+			if value, ok := obj.Get(field); ok {
+				if jv, ok := value.(*json.JsonValue); ok && !jv.IsNull() {
+					return field, jv.String()
+				}
+			}
+		}
+	}
+	return "index", strconv.Itoa(index)
+}
+
+// withLabel returns labels plus name=value, suffixing name if an outer level already uses it
+func withLabel(labels []label, name, value string) []label {
+	unique := name
+	for n := 2; hasLabel(labels, unique); n++ {
+		unique = name + strconv.Itoa(n)
+	}
+	return append(append([]label{}, labels...), label{unique, value})
+}
+
+func hasLabel(labels []label, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func renderLabels(labels []label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.name + `="` + labelEscaper.Replace(l.value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// numeric returns a value as a sample value: numbers as they are, booleans as 0 or 1
+func numeric(v *json.JsonValue) (float64, bool) {
+	if n, ok := v.GetInt(); ok {
+		return float64(n), true
+	}
+	if f, ok := v.GetFloat(); ok {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false
+		}
+		return f, true
+	}
+	if b, ok := v.GetBool(); ok {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// isMetricName reports whether key can be part of a metric name: letters, digits and
+// underscores, not starting with a digit
+func isMetricName(key string) bool {
+	if key == "" || key[0] >= '0' && key[0] <= '9' {
+		return false
+	}
+	for _, c := range key {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func joinName(name, key string) string {
+	if name == "" {
+		return strings.ToLower(key)
+	}
+	return name + "_" + strings.ToLower(key)
+}
+
+// sanitizeName replaces the characters a metric name cannot have with underscores
+func sanitizeName(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// WriteText writes doc as an indented plain-text outline for people reading it in a terminal:
+// one "key: value" line per field, lists of plain values on one line, lists of objects as
+// items titled by their identifying field
+func WriteText(w io.Writer, doc *json.JsonObject) error {
+	out := bufio.NewWriter(w)
+	writeTextObject(out, doc, 0)
+	return out.Flush()
+}
+
+func writeTextObject(out *bufio.Writer, obj *json.JsonObject, depth int) {
+	indent := strings.Repeat("  ", depth)
+	obj.ForEach(func(key string, value json.JsonEntity) bool {
+		switch v := value.(type) {
+		case *json.JsonObject:
+			if v.IsEmpty() {
+				fmt.Fprintf(out, "%s%s: -\n", indent, key)
+				return true
+			}
+			fmt.Fprintf(out, "%s%s:\n", indent, key)
+			writeTextObject(out, v, depth+1)
+		case *json.JsonList:
+			writeTextList(out, key, v, depth)
+		case *json.JsonValue:
+			fmt.Fprintf(out, "%s%s: %s\n", indent, key, textValue(v))
+		}
+		return true
+	})
+}
+
+func writeTextList(out *bufio.Writer, key string, list *json.JsonList, depth int) {
+	indent := strings.Repeat("  ", depth)
+	items := list.ToSlice()
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		jv, ok := item.(*json.JsonValue)
+		if !ok {
+			break
+		}
+		values = append(values, textValue(jv))
+	}
+	if len(values) == len(items) {
+		if len(values) == 0 {
+			fmt.Fprintf(out, "%s%s: -\n", indent, key)
+		} else {
+			fmt.Fprintf(out, "%s%s: %s\n", indent, key, strings.Join(values, ", "))
+		}
+		return
+	}
+
+	fmt.Fprintf(out, "%s%s: (%d)\n", indent, key, len(items))
+	for i, item := range items {
+		switch v := item.(type) {
+		case *json.JsonObject:
+			_, title := listLabel(v, i)
+			fmt.Fprintf(out, "%s  - %s\n", indent, title)
+			writeTextObject(out, v, depth+2)
+		case *json.JsonList:
+			writeTextList(out, "-", v, depth+1)
+		case *json.JsonValue:
+			fmt.Fprintf(out, "%s  - %s\n", indent, textValue(v))
+		}
+	}
+}
+
+// textValue renders a value, with floats rounded to three decimals
+func textValue(v *json.JsonValue) string {
+	if f, ok := v.GetFloat(); ok {
+		s := strconv.FormatFloat(f, 'f', 3, 64)
+		return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+	return v.String()
+}
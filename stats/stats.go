@@ -0,0 +1,175 @@
+// Package stats composes the /stats document from the metric providers each module registers.
+// A module registers a provider as a top-level section, and may add named sub-sections to its
+// own (or another module's) section; the registry assembles them in registration order, so a
+// new subsystem surfaces its metrics with one Register call instead of edits to a hand-built map.
+package stats
+
+import (
+	"sync"
+
+	json "github.com/girino/nostr-lib/json"
+)
+
+// Provider is a named source of metrics
+type Provider interface {
+	// GetStatsName returns the provider's key in its section
+	GetStatsName() string
+	// GetStats returns the current metrics as a JsonEntity
+	GetStats() json.JsonEntity
+}
+
+// Registrar is what modules register their metric providers with
+type Registrar interface {
+	// Register adds provider as the top-level section named after GetStatsName
+	Register(provider Provider)
+	// RegisterIn adds provider to module's section under GetStatsName, after the fields of the
+	// module's own provider if it has one
+	RegisterIn(module string, provider Provider)
+	// Unregister removes the top-level section name with all its providers
+	Unregister(name string)
+}
+
+// funcProvider adapts a function to Provider
+type funcProvider struct {
+	name string
+	get  func() json.JsonEntity
+}
+
+func (p funcProvider) GetStatsName() string      { return p.name }
+func (p funcProvider) GetStats() json.JsonEntity { return p.get() }
+
+// Func returns a Provider named name reporting get()
+func Func(name string, get func() json.JsonEntity) Provider {
+	return funcProvider{name: name, get: get}
+}
+
+// section is one top-level key of the document
+type section struct {
+	base  Provider   // the module's own provider (nil if it only has sub-sections)
+	parts []Provider // sub-sections, in registration order
+}
+
+// Registry implements Registrar and composes the registered providers
+type Registry struct {
+	mu       sync.RWMutex
+	order    []string
+	sections map[string]*section
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{sections: make(map[string]*section)}
+}
+
+var (
+	defaultRegistry     *Registry
+	defaultRegistryOnce sync.Once
+)
+
+// Default returns the process-wide registry /stats is served from
+func Default() *Registry {
+	defaultRegistryOnce.Do(func() {
+		defaultRegistry = NewRegistry()
+	})
+	return defaultRegistry
+}
+
+// sectionLocked returns name's section, creating it at the end of the document
+func (r *Registry) sectionLocked(name string) *section {
+	s, ok := r.sections[name]
+	if !ok {
+		s = &section{}
+		r.sections[name] = s
+		r.order = append(r.order, name)
+	}
+	return s
+}
+
+// Register adds provider as the top-level section named after GetStatsName; registering a
+// provider under a name already taken replaces the previous one
+func (r *Registry) Register(provider Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sectionLocked(provider.GetStatsName()).base = provider
+}
+
+// RegisterIn adds provider to module's section under GetStatsName, replacing a sub-section of
+// the same name
+func (r *Registry) RegisterIn(module string, provider Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.sectionLocked(module)
+	for i, part := range s.parts {
+		if part.GetStatsName() == provider.GetStatsName() {
+			s.parts[i] = provider
+			return
+		}
+	}
+	s.parts = append(s.parts, provider)
+}
+
+// Unregister removes the top-level section name with all its providers
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sections[name]; !ok {
+		return
+	}
+	delete(r.sections, name)
+	for i, n := range r.order {
+		if n == name {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// compose builds a section: the base provider's fields followed by the sub-sections. A base
+// reporting something other than an object is kept under its own name.
+func (s *section) compose() json.JsonEntity {
+	if len(s.parts) == 0 && s.base != nil {
+		return s.base.GetStats()
+	}
+	obj := json.NewJsonObject()
+	if s.base != nil {
+		entity := s.base.GetStats()
+		if base, ok := entity.(*json.JsonObject); ok {
+			obj = base
+		} else {
+			obj.Set(s.base.GetStatsName(), entity)
+		}
+	}
+	for _, part := range s.parts {
+		obj.Set(part.GetStatsName(), part.GetStats())
+	}
+	return obj
+}
+
+// Section returns the composed section name, or nil if nothing is registered under it
+func (r *Registry) Section(name string) json.JsonEntity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sections[name]
+	if !ok {
+		return nil
+	}
+	return s.compose()
+}
+
+// Names returns the top-level section names in document order
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.order...)
+}
+
+// Snapshot composes every section, in registration order
+func (r *Registry) Snapshot() *json.JsonObject {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	obj := json.NewJsonObject()
+	for _, name := range r.order {
+		obj.Set(name, r.sections[name].compose())
+	}
+	return obj
+}
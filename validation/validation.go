@@ -0,0 +1,251 @@
+// Package validation rejects structurally malformed events before they are broadcast, so the
+// relay does not amplify garbage to dozens of destinations. Checks are per kind (e.g. kind 0
+// content must be a JSON object, kind 3 may only carry p tags, zap receipts must embed their
+// zap request) plus NIP-30 custom emoji tags on any kind.
+//
+// Usage:
+//
+//	validation.New(validation.Config{SkipKinds: []int{9735}}).Apply(relay)
+package validation
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	json "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Config holds validation options
+type Config struct {
+	// SkipKinds are never checked by their per-kind rule (generic tag checks still apply).
+	SkipKinds []int
+
+	// LogDebug is optional (e.g. connect to verbose logging).
+	LogDebug func(format string, args ...any)
+}
+
+// kindRule checks the structure of one kind; the error message becomes the rejection reason
+type kindRule func(event *nostr.Event) error
+
+var kindRules = map[int]kindRule{
+	nostr.KindProfileMetadata:   checkProfileMetadata,
+	nostr.KindFollowList:        checkFollowList,
+	nostr.KindDeletion:          checkDeletion,
+	nostr.KindReaction:          checkReaction,
+	nostr.KindZap:               checkZapReceipt,
+	nostr.KindRelayListMetadata: checkRelayList,
+}
+
+var shortcodePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Validator checks events against the kind rules. Create with New, then Apply.
+type Validator struct {
+	cfg  Config
+	skip map[int]bool
+
+	checked  int64
+	rejected int64
+
+	mu           sync.Mutex
+	rejectedKind map[int]int64
+}
+
+// New returns a Validator for cfg
+func New(cfg Config) *Validator {
+	skip := make(map[int]bool, len(cfg.SkipKinds))
+	for _, k := range cfg.SkipKinds {
+		skip[k] = true
+	}
+	return &Validator{cfg: cfg, skip: skip, rejectedKind: make(map[int]int64)}
+}
+
+func (v *Validator) logf(format string, args ...any) {
+	if v.cfg.LogDebug != nil {
+		v.cfg.LogDebug(format, args...)
+	}
+}
+
+// Apply registers a RejectEvent hook on relay
+func (v *Validator) Apply(relay *khatru.Relay) {
+	if relay == nil {
+		return
+	}
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if err := v.Check(event); err != nil {
+			v.logf("validation rejected event %s (kind %d) from %s: %v", event.ID, event.Kind, khatru.GetIP(ctx), err)
+			return true, "invalid: " + err.Error()
+		}
+		return false, ""
+	})
+}
+
+// Check returns an error describing why event is malformed, or nil
+func (v *Validator) Check(event *nostr.Event) error {
+	atomic.AddInt64(&v.checked, 1)
+	err := v.check(event)
+	if err != nil {
+		atomic.AddInt64(&v.rejected, 1)
+		v.mu.Lock()
+		v.rejectedKind[event.Kind]++
+		v.mu.Unlock()
+	}
+	return err
+}
+
+func (v *Validator) check(event *nostr.Event) error {
+	for i, tag := range event.Tags {
+		if len(tag) == 0 {
+			return fmt.Errorf("tag %d is empty", i)
+		}
+		if tag[0] == "emoji" {
+			if err := checkEmojiTag(tag); err != nil {
+				return fmt.Errorf("tag %d: %w", i, err)
+			}
+		}
+	}
+
+	if v.skip[event.Kind] {
+		return nil
+	}
+	if rule := kindRules[event.Kind]; rule != nil {
+		return rule(event)
+	}
+	return nil
+}
+
+// checkEmojiTag enforces NIP-30: ["emoji", <shortcode>, <image url>]
+func checkEmojiTag(tag nostr.Tag) error {
+	if len(tag) < 3 {
+		return fmt.Errorf("emoji tag needs a shortcode and an image URL")
+	}
+	if !shortcodePattern.MatchString(tag[1]) {
+		return fmt.Errorf("emoji shortcode %q must be alphanumeric or underscore", tag[1])
+	}
+	if !strings.HasPrefix(tag[2], "https://") && !strings.HasPrefix(tag[2], "http://") {
+		return fmt.Errorf("emoji %q image must be an http(s) URL", tag[1])
+	}
+	return nil
+}
+
+// kind 0: content is a JSON object of profile fields
+func checkProfileMetadata(event *nostr.Event) error {
+	var profile map[string]any
+	if err := stdjson.Unmarshal([]byte(event.Content), &profile); err != nil || profile == nil {
+		return fmt.Errorf("kind 0 content must be a JSON object")
+	}
+	return nil
+}
+
+// kind 3: only p tags with a valid pubkey
+func checkFollowList(event *nostr.Event) error {
+	for i, tag := range event.Tags {
+		if tag[0] != "p" {
+			return fmt.Errorf("kind 3 tag %d is %q, only p tags are allowed", i, tag[0])
+		}
+		if len(tag) < 2 || !nostr.IsValidPublicKey(tag[1]) {
+			return fmt.Errorf("kind 3 tag %d has an invalid pubkey", i)
+		}
+	}
+	return nil
+}
+
+// kind 5: deletion requests must reference something to delete
+func checkDeletion(event *nostr.Event) error {
+	if !hasTag(event, "e", "a") {
+		return fmt.Errorf("kind 5 must reference events with e or a tags")
+	}
+	return nil
+}
+
+// kind 7: reactions must reference the reacted-to event
+func checkReaction(event *nostr.Event) error {
+	if !hasTag(event, "e", "a") {
+		return fmt.Errorf("kind 7 must reference the reacted event with an e or a tag")
+	}
+	return nil
+}
+
+// kind 9735: zap receipts carry the invoice, the recipient and the embedded kind 9734 zap request
+func checkZapReceipt(event *nostr.Event) error {
+	if !hasTag(event, "bolt11") {
+		return fmt.Errorf("zap receipt is missing the bolt11 tag")
+	}
+	if !hasTag(event, "p") {
+		return fmt.Errorf("zap receipt is missing the p tag")
+	}
+	description := event.Tags.GetFirst([]string{"description", ""})
+	if description == nil || len(*description) < 2 {
+		return fmt.Errorf("zap receipt is missing the description tag")
+	}
+	var request nostr.Event
+	if err := stdjson.Unmarshal([]byte((*description)[1]), &request); err != nil {
+		return fmt.Errorf("zap receipt description is not a JSON event")
+	}
+	if request.Kind != nostr.KindZapRequest {
+		return fmt.Errorf("zap receipt description is kind %d, expected %d", request.Kind, nostr.KindZapRequest)
+	}
+	return nil
+}
+
+// kind 10002: r tags hold relay URLs with an optional read/write marker
+func checkRelayList(event *nostr.Event) error {
+	for i, tag := range event.Tags {
+		if tag[0] != "r" {
+			continue
+		}
+		if len(tag) < 2 || !nostr.IsValidRelayURL(tag[1]) {
+			return fmt.Errorf("kind 10002 tag %d is not a relay URL", i)
+		}
+		if len(tag) > 2 && tag[2] != "" && tag[2] != "read" && tag[2] != "write" {
+			return fmt.Errorf("kind 10002 tag %d has marker %q, expected read or write", i, tag[2])
+		}
+	}
+	return nil
+}
+
+func hasTag(event *nostr.Event, names ...string) bool {
+	for _, tag := range event.Tags {
+		for _, name := range names {
+			if tag[0] == name && len(tag) > 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetStatsName returns the name for this stats provider
+func (v *Validator) GetStatsName() string {
+	return "validation"
+}
+
+// GetStats returns validation counters as a JsonEntity
+func (v *Validator) GetStats() json.JsonEntity {
+	v.mu.Lock()
+	kinds := make([]int, 0, len(v.rejectedKind))
+	for k := range v.rejectedKind {
+		kinds = append(kinds, k)
+	}
+	sort.Ints(kinds)
+	byKind := json.NewJsonObject()
+	for _, k := range kinds {
+		byKind.Set(strconv.Itoa(k), json.NewJsonValue(v.rejectedKind[k]))
+	}
+	v.mu.Unlock()
+
+	obj := json.NewJsonObject()
+	obj.Set("checked", json.NewJsonValue(atomic.LoadInt64(&v.checked)))
+	obj.Set("rejected", json.NewJsonValue(atomic.LoadInt64(&v.rejected)))
+	obj.Set("rejected_by_kind", byKind)
+	obj.Set("skip_kinds", json.NewJsonValue(len(v.skip)))
+	return obj
+}